@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -19,34 +20,48 @@ import (
 var logger = log.New(os.Stdout, "[catcher] ", 0)
 var ServicePort int = 12346
 
+// DefaultMaxRequests is the number of requests the catcher keeps in its
+// history unless SetMaxRequests is called.
+const DefaultMaxRequests = 1000
+
 // Service is an instance of the catcher service. This service is used to test
-// the relay. It exposes an HTTP server that captures the last request it
-// receives and makes it available via the LastRequest() and LastRequestBody()
-// methods. For websocket testing, the /echo endpoint exposes a simple websocket
-// server that echoes back whatever it receives.
+// the relay. It exposes an HTTP server that captures the requests it receives
+// and makes them available via the Requests() method, and the last of them via
+// the LastRequest() and LastRequestBody() methods. Requests are answered with
+// an index page, unless the Respond() method has programmed canned responses
+// or faults for their path. For websocket testing, the /echo endpoint exposes
+// a simple websocket server that echoes back whatever it receives.
 type Service struct {
-	lastRequest []byte
-	listener    net.Listener
-	mux         *http.ServeMux
+	listener net.Listener
+	mux      *http.ServeMux
+
+	mutex       sync.Mutex
+	requests    [][]byte // Dumps of the requests received, oldest first.
+	frames      []Frame  // Websocket frames received and sent on /echo, oldest first.
+	maxRequests int
+	responses   map[string][]Response // Canned responses not yet sent, by path.
 }
 
 func NewService() *Service {
-	service := &Service{}
+	service := &Service{maxRequests: DefaultMaxRequests, responses: map[string][]Response{}}
 
 	service.mux = http.NewServeMux()
-	service.mux.Handle("/echo", websocket.Handler(EchoServer))
+	service.mux.Handle("/echo", websocket.Handler(service.echo))
 	service.mux.HandleFunc("/favicon.ico", func(response http.ResponseWriter, request *http.Request) {
 		response.WriteHeader(http.StatusNotFound)
 		response.Write([]byte("No favicon"))
 	})
 	service.mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		dump, _ := httputil.DumpRequest(request, true)
+		service.catch(dump)
+		logger.Println("Caught:", request.URL)
+
+		if canned := service.nextResponse(request.URL.Path); canned != nil {
+			canned.write(response, request)
+			return
+		}
 		response.WriteHeader(http.StatusOK)
 		response.Write([]byte(IndexHTML))
-
-		lastRequest, _ := httputil.DumpRequest(request, true)
-		service.lastRequest = lastRequest
-
-		logger.Println("Caught:", request.URL)
 	})
 
 	return service
@@ -67,11 +82,119 @@ func (service *Service) HttpUrl() string {
 	return fmt.Sprintf("http://%v", addr)
 }
 
+// catch adds a request to the history, discarding the oldest requests if
+// there are more than the maximum.
+func (service *Service) catch(dump []byte) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.requests = append(service.requests, dump)
+	if excess := len(service.requests) - service.maxRequests; excess > 0 {
+		service.requests = append([][]byte{}, service.requests[excess:]...)
+	}
+}
+
+// SetMaxRequests sets the number of requests kept in the history, which must
+// be at least one. If more have already been received, the oldest are
+// discarded. The same number of websocket frames are kept.
+func (service *Service) SetMaxRequests(maxRequests int) {
+	if maxRequests < 1 {
+		maxRequests = 1
+	}
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.maxRequests = maxRequests
+	if excess := len(service.requests) - maxRequests; excess > 0 {
+		service.requests = append([][]byte{}, service.requests[excess:]...)
+	}
+	if excess := len(service.frames) - maxRequests; excess > 0 {
+		service.frames = append([]Frame{}, service.frames[excess:]...)
+	}
+}
+
+// Reset forgets every request and websocket frame received so far.
+func (service *Service) Reset() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.requests = nil
+	service.frames = nil
+}
+
+// RequestFilter selects requests from the history.
+type RequestFilter func(request *http.Request) bool
+
+// WithPath selects requests for the provided path.
+func WithPath(path string) RequestFilter {
+	return func(request *http.Request) bool {
+		return request.URL.Path == path
+	}
+}
+
+// WithMethod selects requests made with the provided method.
+func WithMethod(method string) RequestFilter {
+	return func(request *http.Request) bool {
+		return request.Method == method
+	}
+}
+
+// WithHeader selects requests which have the provided header with the provided
+// value, or with any value if value is empty.
+func WithHeader(name string, value string) RequestFilter {
+	return func(request *http.Request) bool {
+		values, ok := request.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if value == "" {
+			return true
+		}
+		for _, headerValue := range values {
+			if headerValue == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Requests returns the requests in the history which every filter selects,
+// oldest first. Each call returns new requests, whose bodies can be read.
+func (service *Service) Requests(filters ...RequestFilter) ([]*http.Request, error) {
+	service.mutex.Lock()
+	dumps := service.requests
+	service.mutex.Unlock()
+
+	requests := []*http.Request{}
+	for _, dump := range dumps {
+		request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(dump)))
+		if err != nil {
+			return nil, err
+		}
+		selected := true
+		for _, filter := range filters {
+			if !filter(request) {
+				selected = false
+				break
+			}
+		}
+		if selected {
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
 func (service *Service) LastRequest() (*http.Request, error) {
-	if service.lastRequest == nil {
+	service.mutex.Lock()
+	var lastRequest []byte
+	if len(service.requests) > 0 {
+		lastRequest = service.requests[len(service.requests)-1]
+	}
+	service.mutex.Unlock()
+
+	if lastRequest == nil {
 		return nil, errors.New("No last request available")
 	}
-	return http.ReadRequest(bufio.NewReader(bytes.NewReader(service.lastRequest)))
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(lastRequest)))
 }
 
 func (service *Service) LastRequestBody() ([]byte, error) {
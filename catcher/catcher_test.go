@@ -0,0 +1,286 @@
+package catcher_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"golang.org/x/net/websocket"
+)
+
+func TestRequests(t *testing.T) {
+	service := catcher.NewService()
+	if err := service.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting catcher: %v", err)
+	}
+	defer service.Close()
+
+	send := func(method string, path string, tenant string) {
+		request, _ := http.NewRequest(method, service.HttpUrl()+path, strings.NewReader(path))
+		if tenant != "" {
+			request.Header.Set("X-Tenant", tenant)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		response.Body.Close()
+	}
+	send("POST", "/events", "acme")
+	send("GET", "/config", "")
+	send("POST", "/events", "globex")
+	send("POST", "/logs", "acme")
+
+	testCases := []struct {
+		desc     string
+		filters  []catcher.RequestFilter
+		expected []string
+	}{
+		{
+			desc:     "Every request is returned in order",
+			expected: []string{"POST /events /events", "GET /config /config", "POST /events /events", "POST /logs /logs"},
+		},
+		{
+			desc:     "Requests can be filtered by path",
+			filters:  []catcher.RequestFilter{catcher.WithPath("/events")},
+			expected: []string{"POST /events /events", "POST /events /events"},
+		},
+		{
+			desc:     "Requests can be filtered by method",
+			filters:  []catcher.RequestFilter{catcher.WithMethod("GET")},
+			expected: []string{"GET /config /config"},
+		},
+		{
+			desc:     "Requests can be filtered by header",
+			filters:  []catcher.RequestFilter{catcher.WithHeader("x-tenant", "acme")},
+			expected: []string{"POST /events /events", "POST /logs /logs"},
+		},
+		{
+			desc:     "Requests can be filtered by the presence of a header",
+			filters:  []catcher.RequestFilter{catcher.WithHeader("X-Tenant", "")},
+			expected: []string{"POST /events /events", "POST /events /events", "POST /logs /logs"},
+		},
+		{
+			desc:     "Filters are combined",
+			filters:  []catcher.RequestFilter{catcher.WithPath("/events"), catcher.WithHeader("X-Tenant", "globex")},
+			expected: []string{"POST /events /events"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		requests, err := service.Requests(testCase.filters...)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading requests: %v", testCase.desc, err)
+			continue
+		}
+		if summaries := summarize(requests); !reflect.DeepEqual(summaries, testCase.expected) {
+			t.Errorf("Test '%v': Expected requests %v but got %v", testCase.desc, testCase.expected, summaries)
+		}
+	}
+
+	// The oldest requests are discarded beyond the maximum.
+	service.SetMaxRequests(2)
+	send("GET", "/latest", "")
+	requests, _ := service.Requests()
+	if summaries := summarize(requests); !reflect.DeepEqual(summaries, []string{"POST /logs /logs", "GET /latest /latest"}) {
+		t.Errorf("Expected only the 2 latest requests to be kept but got %v", summaries)
+	}
+
+	service.Reset()
+	if requests, _ := service.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no requests after Reset but got %v", summarize(requests))
+	}
+	if _, err := service.LastRequest(); err == nil {
+		t.Errorf("Expected no last request after Reset")
+	}
+}
+
+func summarize(requests []*http.Request) []string {
+	summaries := []string{}
+	for _, request := range requests {
+		body, _ := io.ReadAll(request.Body)
+		summaries = append(summaries, fmt.Sprintf("%v %v %s", request.Method, request.URL.Path, body))
+	}
+	return summaries
+}
+
+func TestResponses(t *testing.T) {
+	service := catcher.NewService()
+	if err := service.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting catcher: %v", err)
+	}
+	defer service.Close()
+
+	service.Respond("/flaky",
+		catcher.Response{Status: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"1"}}},
+		catcher.Response{Status: http.StatusCreated, Body: []byte("created")},
+	)
+	service.Respond("/slow", catcher.Response{Delay: 100 * time.Millisecond, Body: []byte("slow")})
+	service.Respond("/drip", catcher.Response{Fault: catcher.FaultSlowDrip, DripInterval: 20 * time.Millisecond, Body: []byte("drip")})
+	service.Respond("/reset", catcher.Response{Fault: catcher.FaultConnectionReset})
+	service.Respond("/chunks", catcher.Response{Fault: catcher.FaultMalformedChunks, Body: []byte("partial")})
+
+	testCases := []struct {
+		desc           string
+		path           string
+		expectedStatus int
+		expectedHeader http.Header
+		expectedBody   string
+		expectError    bool // If true, the response or its body can't be read.
+		minDuration    time.Duration
+	}{
+		{
+			desc:           "Canned responses are sent in order",
+			path:           "/flaky",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedHeader: http.Header{"Retry-After": {"1"}},
+		},
+		{
+			desc:           "The next canned response is sent",
+			path:           "/flaky",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   "created",
+		},
+		{
+			desc:           "The last canned response is repeated",
+			path:           "/flaky",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   "created",
+		},
+		{
+			desc:           "Responses can be delayed",
+			path:           "/slow",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "slow",
+			minDuration:    100 * time.Millisecond,
+		},
+		{
+			desc:           "Bodies can be sent slowly",
+			path:           "/drip",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "drip",
+			minDuration:    80 * time.Millisecond,
+		},
+		{
+			desc:        "Connections can be reset",
+			path:        "/reset",
+			expectError: true,
+		},
+		{
+			desc:           "Chunked bodies can be malformed",
+			path:           "/chunks",
+			expectedStatus: http.StatusOK,
+			expectError:    true,
+		},
+		{
+			desc:           "Other paths get the index page",
+			path:           "/other",
+			expectedStatus: http.StatusOK,
+			expectedBody:   catcher.IndexHTML,
+		},
+	}
+
+	// Requests on reused connections which are reset would be retried.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, testCase := range testCases {
+		start := time.Now()
+		response, err := client.Get(service.HttpUrl() + testCase.path)
+		if err != nil {
+			if !testCase.expectError {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			}
+			continue
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		elapsed := time.Since(start)
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error reading the body, but got %q", testCase.desc, body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+		}
+		if string(body) != testCase.expectedBody {
+			t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+		}
+		for name := range testCase.expectedHeader {
+			if value := response.Header.Get(name); value != testCase.expectedHeader.Get(name) {
+				t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, name, testCase.expectedHeader.Get(name), value)
+			}
+		}
+		if elapsed < testCase.minDuration {
+			t.Errorf("Test '%v': Expected the response to take at least %v but it took %v", testCase.desc, testCase.minDuration, elapsed)
+		}
+	}
+
+	// Every request is recorded, however it was answered.
+	if requests, _ := service.Requests(); len(requests) != len(testCases) {
+		t.Errorf("Expected %v requests to be recorded but got %v", len(testCases), len(requests))
+	}
+
+	service.ClearResponses()
+	if response, err := http.Get(service.HttpUrl() + "/reset"); err != nil {
+		t.Errorf("Expected the index page once responses are cleared, but got %v", err)
+	} else {
+		response.Body.Close()
+	}
+}
+
+func TestFrames(t *testing.T) {
+	service := catcher.NewService()
+	if err := service.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting catcher: %v", err)
+	}
+	defer service.Close()
+
+	ws, err := websocket.Dial(strings.Replace(service.HttpUrl(), "http", "ws", 1)+"/echo", "", service.HttpUrl())
+	if err != nil {
+		t.Fatalf("Error dialing websocket: %v", err)
+	}
+	if err := websocket.Message.Send(ws, "hello"); err != nil {
+		t.Fatalf("Error sending text message: %v", err)
+	}
+	var echoed string
+	websocket.Message.Receive(ws, &echoed)
+	if err := websocket.Message.Send(ws, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("Error sending binary message: %v", err)
+	}
+	websocket.Message.Receive(ws, &echoed)
+	ws.Close()
+
+	expected := []catcher.Frame{
+		{Direction: catcher.FrameReceived, Opcode: websocket.TextFrame, Payload: []byte("hello")},
+		{Direction: catcher.FrameSent, Opcode: websocket.TextFrame, Payload: []byte("hello")},
+		{Direction: catcher.FrameReceived, Opcode: websocket.BinaryFrame, Payload: []byte{1, 2, 3}},
+		{Direction: catcher.FrameSent, Opcode: websocket.TextFrame, Payload: []byte{1, 2, 3}},
+		{Direction: catcher.FrameReceived, Opcode: websocket.CloseFrame, Payload: []byte{0x03, 0xe8}},
+	}
+	// The close frame is received once the connection has closed on the
+	// client's side.
+	var frames []catcher.Frame
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if frames = service.Frames(); len(frames) >= len(expected) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Errorf("Expected frames %v but got %v", expected, frames)
+	}
+
+	service.Reset()
+	if frames := service.Frames(); len(frames) != 0 {
+		t.Errorf("Expected no frames after Reset but got %v", frames)
+	}
+}
@@ -0,0 +1,100 @@
+package catcher
+
+import (
+	"io"
+
+	"golang.org/x/net/websocket"
+)
+
+// FrameDirection tells whether the catcher received or sent a websocket frame.
+type FrameDirection string
+
+const (
+	FrameReceived FrameDirection = "received"
+	FrameSent     FrameDirection = "sent"
+)
+
+// Frame is a websocket frame which the catcher received or sent on /echo.
+type Frame struct {
+	Direction FrameDirection
+	Opcode    byte // One of websocket.TextFrame, websocket.BinaryFrame, websocket.PingFrame, and so on.
+	Payload   []byte
+}
+
+// maxControlPayload is the longest payload a websocket control frame can have.
+const maxControlPayload = 125
+
+// Frames returns the websocket frames received and sent on /echo, oldest
+// first. Pings are answered with pongs, and the payloads of data frames are
+// echoed back in text frames, as EchoServer does; the connection is closed
+// once a close frame is received.
+func (service *Service) Frames() []Frame {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	return append([]Frame{}, service.frames...)
+}
+
+func (service *Service) recordFrame(direction FrameDirection, opcode byte, payload []byte) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.frames = append(service.frames, Frame{Direction: direction, Opcode: opcode, Payload: payload})
+	if excess := len(service.frames) - service.maxRequests; excess > 0 {
+		service.frames = append([]Frame{}, service.frames[excess:]...)
+	}
+}
+
+// echo records the frames received on a websocket connection, and echoes each
+// back. Frames are read individually, rather than as messages, so that each
+// can be recorded as it was sent.
+func (service *Service) echo(ws *websocket.Conn) {
+	for {
+		frame, err := ws.NewFrameReader()
+		if err != nil {
+			return
+		}
+		opcode := frame.PayloadType()
+
+		switch opcode {
+		case websocket.CloseFrame, websocket.PingFrame, websocket.PongFrame:
+			payload, err := io.ReadAll(io.LimitReader(frame, maxControlPayload))
+			if err != nil {
+				return
+			}
+			service.recordFrame(FrameReceived, opcode, payload)
+			if opcode == websocket.CloseFrame {
+				// The close frame is answered as the connection is closed.
+				return
+			}
+			if opcode == websocket.PingFrame {
+				if err := service.sendFrame(ws, websocket.PongFrame, payload); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		if frame, err = ws.HandleFrame(frame); err != nil {
+			return
+		}
+		payload, err := io.ReadAll(frame)
+		if err != nil {
+			return
+		}
+		service.recordFrame(FrameReceived, opcode, payload)
+		if err := service.sendFrame(ws, ws.PayloadType, payload); err != nil {
+			return
+		}
+	}
+}
+
+func (service *Service) sendFrame(ws *websocket.Conn, opcode byte, payload []byte) error {
+	writer, err := ws.NewFrameWriter(opcode)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return err
+	}
+	service.recordFrame(FrameSent, opcode, payload)
+	return writer.Close()
+}
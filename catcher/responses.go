@@ -0,0 +1,158 @@
+package catcher
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Fault is a way in which the catcher can misbehave instead of responding
+// normally, to exercise how the relay handles targets which do.
+type Fault string
+
+const (
+	// NoFault responds normally.
+	NoFault Fault = ""
+	// FaultConnectionReset closes the connection abruptly, without
+	// responding, so that the client sees a connection reset.
+	FaultConnectionReset Fault = "connection-reset"
+	// FaultSlowDrip sends the body one byte at a time, DripInterval apart.
+	FaultSlowDrip Fault = "slow-drip"
+	// FaultMalformedChunks sends the status and headers, then a chunked body
+	// whose first chunk has an invalid size, and closes the connection.
+	FaultMalformedChunks Fault = "malformed-chunks"
+)
+
+// DefaultDripInterval is the time between the bytes of a FaultSlowDrip
+// response unless its DripInterval is set.
+const DefaultDripInterval = 100 * time.Millisecond
+
+// Response is a canned response which the catcher sends instead of its index
+// page. Requests for which canned responses are sent are still recorded.
+type Response struct {
+	Status       int // If zero, 200 is used.
+	Header       http.Header
+	Body         []byte
+	Delay        time.Duration // How long to wait before responding, or misbehaving.
+	Fault        Fault
+	DripInterval time.Duration // For FaultSlowDrip. If zero, DefaultDripInterval is used.
+}
+
+// Respond programs the catcher to answer requests for path with the provided
+// responses, one per request, in order. The last response is repeated for
+// any further requests. It replaces any responses programmed for path before.
+func (service *Service) Respond(path string, responses ...Response) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if len(responses) == 0 {
+		delete(service.responses, path)
+		return
+	}
+	service.responses[path] = append([]Response{}, responses...)
+}
+
+// ClearResponses forgets every canned response, so that every path is
+// answered with the index page again.
+func (service *Service) ClearResponses() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.responses = map[string][]Response{}
+}
+
+// nextResponse returns the canned response for a request for path, if any.
+func (service *Service) nextResponse(path string) *Response {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	responses := service.responses[path]
+	if len(responses) == 0 {
+		return nil
+	}
+	response := responses[0]
+	if len(responses) > 1 {
+		service.responses[path] = responses[1:]
+	}
+	return &response
+}
+
+func (canned *Response) write(response http.ResponseWriter, request *http.Request) {
+	if canned.Delay > 0 {
+		select {
+		case <-time.After(canned.Delay):
+		case <-request.Context().Done():
+			return
+		}
+	}
+
+	status := canned.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch canned.Fault {
+	case FaultConnectionReset:
+		conn, _, err := http.NewResponseController(response).Hijack()
+		if err != nil {
+			logger.Println("Error hijacking connection:", err)
+			return
+		}
+		// Discarding unsent data on close makes the kernel send a RST.
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+
+	case FaultMalformedChunks:
+		conn, buffered, err := http.NewResponseController(response).Hijack()
+		if err != nil {
+			logger.Println("Error hijacking connection:", err)
+			return
+		}
+		defer conn.Close()
+		canned.writeMalformedChunks(buffered.Writer, status)
+		buffered.Flush()
+
+	case FaultSlowDrip:
+		canned.writeHeader(response)
+		response.Header().Set("Content-Length", strconv.Itoa(len(canned.Body)))
+		response.WriteHeader(status)
+		controller := http.NewResponseController(response)
+		controller.Flush()
+		interval := canned.DripInterval
+		if interval <= 0 {
+			interval = DefaultDripInterval
+		}
+		for i := range canned.Body {
+			select {
+			case <-time.After(interval):
+			case <-request.Context().Done():
+				return
+			}
+			if _, err := response.Write(canned.Body[i : i+1]); err != nil {
+				return
+			}
+			controller.Flush()
+		}
+
+	default:
+		canned.writeHeader(response)
+		response.WriteHeader(status)
+		response.Write(canned.Body)
+	}
+}
+
+// writeHeader copies the canned response's headers to the response.
+func (canned *Response) writeHeader(response http.ResponseWriter) {
+	for name, values := range canned.Header {
+		response.Header()[name] = append([]string{}, values...)
+	}
+}
+
+func (canned *Response) writeMalformedChunks(writer *bufio.Writer, status int) {
+	fmt.Fprintf(writer, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	canned.Header.Write(writer)
+	writer.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+	fmt.Fprintf(writer, "not-a-chunk-size\r\n%s\r\n", canned.Body)
+}
@@ -0,0 +1,154 @@
+// Package accesslog writes one JSON object per relayed request. Access logging
+// sits on the hot path of every request, so entries are encoded by hand into
+// pooled buffers rather than with encoding/json or fmt; logging an entry
+// doesn't allocate once the pool has warmed up.
+package accesslog
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Entry describes a single request handled by the relay.
+type Entry struct {
+	Time          time.Time     // When the request was received.
+	Method        string        // The request method.
+	Host          string        // The host the request was relayed to.
+	Path          string        // The path of the original request URL.
+	Status        int           // The status code returned to the client.
+	RequestBytes  int64         // The request Content-Length, or -1 if unknown.
+	ResponseBytes int64         // The number of response body bytes written.
+	Duration      time.Duration // The time taken to handle the request.
+	Serviced      bool          // True if the relay or a plugin serviced the request.
+	Tags          []string      // Tags attached to the request by plugins.
+}
+
+// initialBufferSize is large enough for typical entries, so that buffers taken
+// from the pool rarely need to grow.
+const initialBufferSize = 512
+
+// maxPooledBufferSize bounds the size of buffers returned to the pool, so that
+// one unusually long entry doesn't pin a large buffer in memory.
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 0, initialBufferSize)
+		return &buffer
+	},
+}
+
+// Logger writes access log entries to an io.Writer, one JSON object per line.
+// It's safe for concurrent use.
+type Logger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewLogger returns a Logger which writes entries to writer.
+func NewLogger(writer io.Writer) *Logger {
+	return &Logger{writer: writer}
+}
+
+// Log writes an entry. Errors writing the entry are ignored, since there's
+// nowhere more useful to report them.
+func (logger *Logger) Log(entry *Entry) {
+	if logger == nil {
+		return
+	}
+
+	buffer := bufferPool.Get().(*[]byte)
+	line := AppendEntry((*buffer)[:0], entry)
+	line = append(line, '\n')
+
+	logger.mutex.Lock()
+	logger.writer.Write(line)
+	logger.mutex.Unlock()
+
+	if cap(line) <= maxPooledBufferSize {
+		*buffer = line
+		bufferPool.Put(buffer)
+	}
+}
+
+// AppendEntry appends the JSON encoding of entry to dst and returns the
+// extended buffer.
+func AppendEntry(dst []byte, entry *Entry) []byte {
+	dst = append(dst, `{"time":"`...)
+	dst = entry.Time.UTC().AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, `","method":`...)
+	dst = appendString(dst, entry.Method)
+	dst = append(dst, `,"host":`...)
+	dst = appendString(dst, entry.Host)
+	dst = append(dst, `,"path":`...)
+	dst = appendString(dst, entry.Path)
+	dst = append(dst, `,"status":`...)
+	dst = strconv.AppendInt(dst, int64(entry.Status), 10)
+	dst = append(dst, `,"request_bytes":`...)
+	dst = strconv.AppendInt(dst, entry.RequestBytes, 10)
+	dst = append(dst, `,"response_bytes":`...)
+	dst = strconv.AppendInt(dst, entry.ResponseBytes, 10)
+	dst = append(dst, `,"duration_ms":`...)
+	dst = strconv.AppendFloat(dst, float64(entry.Duration)/float64(time.Millisecond), 'f', 3, 64)
+	dst = append(dst, `,"serviced":`...)
+	dst = strconv.AppendBool(dst, entry.Serviced)
+	if len(entry.Tags) > 0 {
+		dst = append(dst, `,"tags":[`...)
+		for i, tag := range entry.Tags {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendString(dst, tag)
+		}
+		dst = append(dst, ']')
+	}
+	return append(dst, '}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendString appends s to dst as a quoted JSON string. Invalid UTF-8 is
+// replaced with U+FFFD, as encoding/json does.
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,138 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/accesslog"
+)
+
+var testEntry = accesslog.Entry{
+	Time:          time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC),
+	Method:        "POST",
+	Host:          "relay-target.example",
+	Path:          "/rec/bundle/v2",
+	Status:        200,
+	RequestBytes:  1534,
+	ResponseBytes: 27,
+	Duration:      12345678 * time.Nanosecond,
+	Serviced:      true,
+	Tags:          []string{"bot", "internal"},
+}
+
+func TestAppendEntry(t *testing.T) {
+	encoded := string(accesslog.AppendEntry(nil, &testEntry))
+	expected := `{"time":"2024-05-06T07:08:09.123456789Z","method":"POST","host":"relay-target.example",` +
+		`"path":"/rec/bundle/v2","status":200,"request_bytes":1534,"response_bytes":27,` +
+		`"duration_ms":12.346,"serviced":true,"tags":["bot","internal"]}`
+	if encoded != expected {
+		t.Errorf("Expected:\n%v\nbut got:\n%v", expected, encoded)
+	}
+}
+
+func TestAppendEntryEscapesStrings(t *testing.T) {
+	testCases := []string{
+		`plain`,
+		`"quoted" \back\slashed\`,
+		"line\nbreaks\r\tand\x00control\x1fcharacters",
+		"unicode: héllo, 世界, 🙂",
+		"invalid \xff utf-8 \xc3",
+		"<html> &  ",
+	}
+
+	for _, path := range testCases {
+		entry := accesslog.Entry{Path: path}
+		var decoded struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(accesslog.AppendEntry(nil, &entry), &decoded); err != nil {
+			t.Errorf("Test '%q': Error decoding entry: %v", path, err)
+			continue
+		}
+
+		expected, _ := json.Marshal(path)
+		var expectedPath string
+		json.Unmarshal(expected, &expectedPath)
+		if decoded.Path != expectedPath {
+			t.Errorf("Test '%q': Expected path %q but got %q", path, expectedPath, decoded.Path)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger := accesslog.NewLogger(&output)
+	logger.Log(&testEntry)
+	logger.Log(&accesslog.Entry{Method: "GET", Status: 404})
+
+	lines := bytes.Split(bytes.TrimSuffix(output.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines but got %q", output.String())
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(lines[1], &decoded); err != nil {
+		t.Fatalf("Error decoding entry: %v", err)
+	}
+	if decoded["method"] != "GET" || decoded["status"] != float64(404) {
+		t.Errorf("Unexpected entry: %v", decoded)
+	}
+	if _, ok := decoded["tags"]; ok {
+		t.Errorf("Expected tags to be omitted when empty: %v", decoded)
+	}
+
+	if !reflect.DeepEqual(lines[0], accesslog.AppendEntry(nil, &testEntry)) {
+		t.Errorf("Expected the logged entry to match AppendEntry: %q", lines[0])
+	}
+}
+
+func TestLoggerDoesNotAllocate(t *testing.T) {
+	logger := accesslog.NewLogger(io.Discard)
+	logger.Log(&testEntry) // Warm up the buffer pool.
+
+	if allocs := testing.AllocsPerRun(100, func() { logger.Log(&testEntry) }); allocs != 0 {
+		t.Errorf("Expected logging to be allocation-free but got %v allocations per entry", allocs)
+	}
+}
+
+func BenchmarkLogger(b *testing.B) {
+	logger := accesslog.NewLogger(io.Discard)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			logger.Log(&testEntry)
+		}
+	})
+}
+
+func BenchmarkAppendEntry(b *testing.B) {
+	buffer := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer = accesslog.AppendEntry(buffer[:0], &testEntry)
+	}
+}
+
+// BenchmarkEncodingJSON encodes the same entry with encoding/json, for
+// comparison.
+func BenchmarkEncodingJSON(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		json.NewEncoder(io.Discard).Encode(map[string]interface{}{
+			"time":           testEntry.Time,
+			"method":         testEntry.Method,
+			"host":           testEntry.Host,
+			"path":           testEntry.Path,
+			"status":         testEntry.Status,
+			"request_bytes":  testEntry.RequestBytes,
+			"response_bytes": testEntry.ResponseBytes,
+			"duration_ms":    float64(testEntry.Duration) / float64(time.Millisecond),
+			"serviced":       testEntry.Serviced,
+			"tags":           testEntry.Tags,
+		})
+	}
+}
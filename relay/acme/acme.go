@@ -0,0 +1,361 @@
+// Package acme obtains and renews TLS certificates automatically from an ACME
+// certificate authority, like Let's Encrypt, as described in RFC 8555.
+//
+// Domains are validated using the tls-alpn-01 challenge (RFC 8737), which is
+// answered on the relay's own TLS listener, so no additional ports need to be
+// exposed. The listener must be reachable on port 443 for validation to
+// succeed. Certificates are obtained the first time a client requests one of
+// the configured domains, and renewed in the background as they approach
+// expiry.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/logging"
+)
+
+var logger = logging.New("relay-acme")
+
+// LetsEncryptURL is the directory URL of Let's Encrypt's production
+// certificate authority.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ALPNProto is the ALPN protocol which certificate authorities use when
+// validating a tls-alpn-01 challenge. TLS listeners must advertise it.
+const ALPNProto = "acme-tls/1"
+
+const (
+	defaultRenewBefore = 30 * 24 * time.Hour
+	obtainTimeout      = 5 * time.Minute
+	accountKeyFile     = "acme-account.key"
+)
+
+// Options configures a Manager.
+type Options struct {
+	Domains      []string      // The domains for which certificates are obtained.
+	Email        string        // If non-empty, a contact address for the ACME account.
+	DirectoryURL string        // The certificate authority's directory URL. Defaults to LetsEncryptURL.
+	CacheDir     string        // The directory in which the account key and certificates are stored.
+	RenewBefore  time.Duration // How long before expiry certificates are renewed. Defaults to 30 days.
+	HTTPClient   *http.Client  // The client used to talk to the certificate authority. Defaults to http.DefaultClient.
+	Clock        clock.Clock   // The source of the current time. If nil, the real time is used.
+}
+
+// Validate checks that the options are usable.
+func (options *Options) Validate() error {
+	if len(options.Domains) == 0 {
+		return errors.New(`ACME requires at least one domain`)
+	}
+	for _, domain := range options.Domains {
+		if domain == "" || strings.Contains(domain, "*") {
+			return fmt.Errorf(`Invalid ACME domain "%v": wildcard domains can't be validated with tls-alpn-01`, domain)
+		}
+		if strings.ContainsAny(domain, `/\`) {
+			return fmt.Errorf(`Invalid ACME domain "%v"`, domain)
+		}
+	}
+	if options.CacheDir == "" {
+		return errors.New(`ACME requires a "cache-dir" in which to store certificates`)
+	}
+	return nil
+}
+
+// Covers returns true if certificates are obtained for the provided server
+// name.
+func (options *Options) Covers(serverName string) bool {
+	return slices.Contains(options.Domains, normalizeDomain(serverName))
+}
+
+// Manager provides certificates for the configured domains, obtaining and
+// renewing them as needed. It's safe for concurrent use.
+type Manager struct {
+	options *Options
+	clock   clock.Clock
+
+	mutex        sync.Mutex
+	client       *client                     // Created when the first certificate is needed.
+	certificates map[string]*tls.Certificate // By domain.
+	challenges   map[string]*tls.Certificate // Pending tls-alpn-01 challenge certificates, by domain.
+	renewing     map[string]bool             // Domains being renewed in the background.
+
+	obtainMutex sync.Mutex // Held while obtaining a certificate, so each is only obtained once.
+}
+
+// NewManager creates a Manager. No requests are made to the certificate
+// authority until a certificate is needed.
+func NewManager(options *Options) (*Manager, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(options.CacheDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	normalized := *options
+	normalized.Domains = nil
+	for _, domain := range options.Domains {
+		normalized.Domains = append(normalized.Domains, normalizeDomain(domain))
+	}
+	if normalized.DirectoryURL == "" {
+		normalized.DirectoryURL = LetsEncryptURL
+	}
+	if normalized.RenewBefore == 0 {
+		normalized.RenewBefore = defaultRenewBefore
+	}
+	if normalized.HTTPClient == nil {
+		normalized.HTTPClient = http.DefaultClient
+	}
+
+	return &Manager{
+		options:      &normalized,
+		clock:        clock.OrReal(options.Clock),
+		certificates: map[string]*tls.Certificate{},
+		challenges:   map[string]*tls.Certificate{},
+		renewing:     map[string]bool{},
+	}, nil
+}
+
+// Covers returns true if the Manager provides certificates for the provided
+// server name.
+func (manager *Manager) Covers(serverName string) bool {
+	return manager.options.Covers(serverName)
+}
+
+// IsChallenge returns true if a TLS handshake is a certificate authority
+// validating a tls-alpn-01 challenge.
+func IsChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto
+}
+
+// GetCertificate returns the certificate for the server name in a TLS
+// handshake, or the challenge certificate if the handshake is validating a
+// challenge. It may be used as tls.Config.GetCertificate; if no certificate
+// has been obtained for the domain yet, it blocks until one is.
+func (manager *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := normalizeDomain(hello.ServerName)
+	if IsChallenge(hello) {
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		if certificate := manager.challenges[domain]; certificate != nil {
+			return certificate, nil
+		}
+		return nil, fmt.Errorf("No pending ACME challenge for %q", domain)
+	}
+
+	if !manager.Covers(domain) {
+		return nil, fmt.Errorf("ACME isn't configured for %q", domain)
+	}
+	return manager.certificate(domain)
+}
+
+// certificate returns a valid certificate for the domain, from memory, from
+// the cache directory, or from the certificate authority, in that order of
+// preference.
+func (manager *Manager) certificate(domain string) (*tls.Certificate, error) {
+	manager.mutex.Lock()
+	certificate := manager.certificates[domain]
+	if certificate == nil {
+		certificate = manager.loadCachedCertificate(domain)
+		if certificate != nil {
+			manager.certificates[domain] = certificate
+		}
+	}
+	manager.mutex.Unlock()
+
+	now := manager.clock.Now()
+	if certificate != nil && now.Before(certificate.Leaf.NotAfter) {
+		if now.Add(manager.options.RenewBefore).After(certificate.Leaf.NotAfter) {
+			manager.renewInBackground(domain)
+		}
+		return certificate, nil
+	}
+
+	return manager.obtain(domain, certificate)
+}
+
+// renewInBackground obtains a new certificate for the domain without blocking
+// the handshake which noticed that the current one is expiring.
+func (manager *Manager) renewInBackground(domain string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.renewing[domain] {
+		return
+	}
+	manager.renewing[domain] = true
+
+	current := manager.certificates[domain]
+	go func() {
+		if _, err := manager.obtain(domain, current); err != nil {
+			logger.Errorf("Error renewing certificate for %v: %v", domain, err)
+		}
+		manager.mutex.Lock()
+		delete(manager.renewing, domain)
+		manager.mutex.Unlock()
+	}()
+}
+
+// obtain requests a new certificate for the domain, replacing the provided
+// one, which may be nil.
+func (manager *Manager) obtain(domain string, replacing *tls.Certificate) (*tls.Certificate, error) {
+	manager.obtainMutex.Lock()
+	defer manager.obtainMutex.Unlock()
+
+	// Another handshake may have obtained a certificate while this one waited.
+	manager.mutex.Lock()
+	if certificate := manager.certificates[domain]; certificate != replacing {
+		manager.mutex.Unlock()
+		return certificate, nil
+	}
+	manager.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	client, err := manager.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Obtaining certificate for %v", domain)
+	key, chain, err := client.obtainCertificate(ctx, domain, manager.setChallenge)
+	if err != nil {
+		return nil, fmt.Errorf("Error obtaining certificate for %v: %v", domain, err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	contents := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	certificate, err := parseCertificate(contents)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(manager.certificatePath(domain), contents, 0o600); err != nil {
+		logger.Errorf("Error caching certificate for %v: %v", domain, err)
+	}
+
+	logger.Printf("Obtained certificate for %v, valid until %v", domain, certificate.Leaf.NotAfter)
+	manager.mutex.Lock()
+	manager.certificates[domain] = certificate
+	manager.mutex.Unlock()
+	return certificate, nil
+}
+
+// setChallenge makes a challenge certificate available to validation
+// handshakes, or removes it if certificate is nil.
+func (manager *Manager) setChallenge(domain string, certificate *tls.Certificate) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if certificate == nil {
+		delete(manager.challenges, domain)
+	} else {
+		manager.challenges[domain] = certificate
+	}
+}
+
+// acmeClient returns the client used to talk to the certificate authority,
+// creating it, and the account key if necessary, the first time it's needed.
+// It must be called with obtainMutex held.
+func (manager *Manager) acmeClient(ctx context.Context) (*client, error) {
+	if manager.client != nil {
+		return manager.client, nil
+	}
+
+	key, err := manager.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := newClient(manager.options.HTTPClient, manager.options.DirectoryURL, key)
+	if err := client.register(ctx, manager.options.Email); err != nil {
+		return nil, fmt.Errorf("Error registering ACME account: %v", err)
+	}
+	manager.client = client
+	return client, nil
+}
+
+// accountKey loads the ACME account key from the cache directory, generating
+// and saving one if there isn't one yet.
+func (manager *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(manager.options.CacheDir, accountKeyFile)
+	if contents, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid ACME account key in %v", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadCachedCertificate returns the certificate for the domain from the cache
+// directory, or nil if there isn't a usable one.
+func (manager *Manager) loadCachedCertificate(domain string) *tls.Certificate {
+	contents, err := os.ReadFile(manager.certificatePath(domain))
+	if err != nil {
+		return nil
+	}
+	certificate, err := parseCertificate(contents)
+	if err != nil {
+		logger.Errorf("Ignoring invalid cached certificate for %v: %v", domain, err)
+		return nil
+	}
+	return certificate
+}
+
+func (manager *Manager) certificatePath(domain string) string {
+	return filepath.Join(manager.options.CacheDir, domain+".pem")
+}
+
+// parseCertificate parses a PEM file containing a private key followed by a
+// certificate chain.
+func parseCertificate(contents []byte) (*tls.Certificate, error) {
+	certificate, err := tls.X509KeyPair(contents, contents)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf = leaf
+	return &certificate, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
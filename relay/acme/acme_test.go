@@ -0,0 +1,424 @@
+package acme_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/acme"
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+// fakeAuthority is a minimal ACME certificate authority. It verifies the
+// signature and nonce of every request, and validates tls-alpn-01 challenges
+// by calling validate, which should perform a handshake against the relay.
+type fakeAuthority struct {
+	server   *httptest.Server
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	validate func(domain string) *tls.Certificate
+
+	mutex      sync.Mutex
+	nonce      int
+	nonces     map[string]bool
+	accountKey *ecdsa.PublicKey
+	tokens     map[string]string // Challenge tokens, by domain.
+	authorized map[string]bool
+	issued     map[string][]byte // DER certificates, by domain.
+	orders     int
+}
+
+func newFakeAuthority(t *testing.T) *fakeAuthority {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	authority := &fakeAuthority{
+		caKey:      caKey,
+		caCert:     caCert,
+		nonces:     map[string]bool{},
+		tokens:     map[string]string{},
+		authorized: map[string]bool{},
+		issued:     map[string][]byte{},
+	}
+	authority.server = httptest.NewServer(http.HandlerFunc(authority.serveHTTP))
+	t.Cleanup(authority.server.Close)
+	return authority
+}
+
+func (authority *fakeAuthority) url(path string) string {
+	return authority.server.URL + path
+}
+
+func (authority *fakeAuthority) orderCount() int {
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	return authority.orders
+}
+
+func (authority *fakeAuthority) newNonce(response http.ResponseWriter) {
+	authority.mutex.Lock()
+	authority.nonce++
+	nonce := fmt.Sprintf("nonce-%d", authority.nonce)
+	authority.nonces[nonce] = true
+	authority.mutex.Unlock()
+	response.Header().Set("Replay-Nonce", nonce)
+}
+
+func (authority *fakeAuthority) fail(response http.ResponseWriter, status int, problemType string, detail string) {
+	response.Header().Set("Content-Type", "application/problem+json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + problemType,
+		"detail": detail,
+	})
+}
+
+func (authority *fakeAuthority) serveHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/directory" {
+		json.NewEncoder(response).Encode(map[string]string{
+			"newNonce":   authority.url("/nonce"),
+			"newAccount": authority.url("/account"),
+			"newOrder":   authority.url("/order"),
+		})
+		return
+	}
+	authority.newNonce(response)
+	if request.URL.Path == "/nonce" {
+		return
+	}
+
+	payload, err := authority.verify(request)
+	if err != nil {
+		authority.fail(response, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+
+	path := request.URL.Path
+	domain := path[strings.LastIndex(path, "/")+1:]
+	switch {
+	case path == "/account":
+		response.Header().Set("Location", authority.url("/account/1"))
+		response.WriteHeader(http.StatusCreated)
+		response.Write([]byte(`{"status":"valid"}`))
+
+	case path == "/order":
+		var newOrder struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &newOrder)
+		domain = newOrder.Identifiers[0].Value
+		authority.orders++
+		authority.authorized[domain] = false
+		authority.tokens[domain] = fmt.Sprintf("token-%d", authority.orders)
+		response.Header().Set("Location", authority.url("/orders/"+domain))
+		response.WriteHeader(http.StatusCreated)
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"status":         "pending",
+			"authorizations": []string{authority.url("/authz/" + domain)},
+			"finalize":       authority.url("/finalize/" + domain),
+		})
+
+	case strings.HasPrefix(path, "/authz/"):
+		status := "pending"
+		if authority.authorized[domain] {
+			status = "valid"
+		}
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": domain},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": authority.url("/unsupported/" + domain), "token": "unused"},
+				{"type": "tls-alpn-01", "url": authority.url("/challenge/" + domain), "token": authority.tokens[domain]},
+			},
+		})
+
+	case strings.HasPrefix(path, "/challenge/"):
+		// Validate the challenge the way a real authority would: by checking
+		// the certificate presented during a handshake with the acme-tls/1
+		// protocol.
+		keyAuthorization := acme.KeyAuthorization(authority.tokens[domain], authority.accountKey)
+		authority.mutex.Unlock()
+		certificate := authority.validate(domain)
+		authority.mutex.Lock()
+		if !validChallengeCertificate(certificate, domain, keyAuthorization) {
+			authority.fail(response, http.StatusForbidden, "unauthorized", "Invalid challenge certificate")
+			return
+		}
+		authority.authorized[domain] = true
+		response.Write([]byte(`{"status":"valid"}`))
+
+	case strings.HasPrefix(path, "/finalize/"):
+		if !authority.authorized[domain] {
+			authority.fail(response, http.StatusForbidden, "orderNotReady", "Not authorized")
+			return
+		}
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != domain {
+			authority.fail(response, http.StatusBadRequest, "badCSR", "Invalid CSR")
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(authority.orders + 1)),
+			Subject:      pkix.Name{CommonName: domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		authority.issued[domain], _ = x509.CreateCertificate(rand.Reader, template, authority.caCert, csr.PublicKey, authority.caKey)
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"status":      "valid",
+			"certificate": authority.url("/cert/" + domain),
+		})
+
+	case strings.HasPrefix(path, "/cert/"):
+		response.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(response, &pem.Block{Type: "CERTIFICATE", Bytes: authority.issued[domain]})
+		pem.Encode(response, &pem.Block{Type: "CERTIFICATE", Bytes: authority.caCert.Raw})
+
+	default:
+		authority.fail(response, http.StatusNotFound, "malformed", "Unknown resource")
+	}
+}
+
+// verify checks the JWS signature, nonce, and URL of a request, and returns
+// its payload.
+func (authority *fakeAuthority) verify(request *http.Request) ([]byte, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(request.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ X, Y string }
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, err
+	}
+
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	if !authority.nonces[protected.Nonce] {
+		return nil, fmt.Errorf("Invalid nonce %q", protected.Nonce)
+	}
+	delete(authority.nonces, protected.Nonce)
+	if protected.URL != authority.url(request.URL.Path) || protected.Alg != "ES256" {
+		return nil, fmt.Errorf("Invalid protected header %s", protectedJSON)
+	}
+
+	key := authority.accountKey
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		authority.accountKey = key
+	} else if protected.Kid != authority.url("/account/1") || key == nil {
+		return nil, fmt.Errorf("Unknown account %q", protected.Kid)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, fmt.Errorf("Invalid signature")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+// validChallengeCertificate checks a tls-alpn-01 challenge certificate as
+// described in RFC 8737 section 3.
+func validChallengeCertificate(certificate *tls.Certificate, domain string, keyAuthorization string) bool {
+	if certificate == nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != domain {
+		return false
+	}
+	expected := sha256.Sum256([]byte(keyAuthorization))
+	for _, extension := range leaf.Extensions {
+		if extension.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			var digest []byte
+			if _, err := asn1.Unmarshal(extension.Value, &digest); err != nil {
+				return false
+			}
+			return extension.Critical && bytes.Equal(digest, expected[:])
+		}
+	}
+	return false
+}
+
+// newManager creates a Manager which the fake authority validates against.
+func newManager(t *testing.T, authority *fakeAuthority, cacheDir string, relayClock clock.Clock) *acme.Manager {
+	manager, err := acme.NewManager(&acme.Options{
+		Domains:      []string{"relay.example.com"},
+		Email:        "ops@example.com",
+		DirectoryURL: authority.url("/directory"),
+		CacheDir:     cacheDir,
+		Clock:        relayClock,
+	})
+	if err != nil {
+		t.Fatalf("Error creating manager: %v", err)
+	}
+	authority.validate = func(domain string) *tls.Certificate {
+		certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:      domain,
+			SupportedProtos: []string{acme.ALPNProto},
+		})
+		if err != nil {
+			t.Errorf("Error getting challenge certificate: %v", err)
+		}
+		return certificate
+	}
+	return manager
+}
+
+func hello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{ServerName: serverName, SupportedProtos: []string{"h2", "http/1.1"}}
+}
+
+func TestManagerObtainsAndCachesCertificates(t *testing.T) {
+	authority := newFakeAuthority(t)
+	cacheDir := t.TempDir()
+	manager := newManager(t, authority, cacheDir, nil)
+
+	certificate, err := manager.GetCertificate(hello("Relay.Example.com"))
+	if err != nil {
+		t.Fatalf("Error obtaining certificate: %v", err)
+	}
+	if certificate.Leaf == nil || len(certificate.Leaf.DNSNames) != 1 || certificate.Leaf.DNSNames[0] != "relay.example.com" {
+		t.Errorf("Expected a certificate for relay.example.com but got %+v", certificate.Leaf)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.caCert)
+	if _, err := certificate.Leaf.Verify(x509.VerifyOptions{DNSName: "relay.example.com", Roots: roots}); err != nil {
+		t.Errorf("Expected a certificate issued by the authority: %v", err)
+	}
+
+	if again, err := manager.GetCertificate(hello("relay.example.com")); err != nil || again != certificate {
+		t.Errorf("Expected the certificate to be reused but got %v, %v", again, err)
+	}
+
+	// A new manager, as after a restart, should use the cached certificate.
+	restarted := newManager(t, authority, cacheDir, nil)
+	if cached, err := restarted.GetCertificate(hello("relay.example.com")); err != nil {
+		t.Errorf("Error loading cached certificate: %v", err)
+	} else if !bytes.Equal(cached.Certificate[0], certificate.Certificate[0]) {
+		t.Errorf("Expected the cached certificate to be loaded")
+	}
+
+	if orders := authority.orderCount(); orders != 1 {
+		t.Errorf("Expected 1 order but got %v", orders)
+	}
+}
+
+func TestManagerRenewsExpiringCertificates(t *testing.T) {
+	authority := newFakeAuthority(t)
+	fakeClock := clock.NewFake(time.Now())
+	manager := newManager(t, authority, t.TempDir(), fakeClock)
+
+	original, err := manager.GetCertificate(hello("relay.example.com"))
+	if err != nil {
+		t.Fatalf("Error obtaining certificate: %v", err)
+	}
+
+	// Within 30 days of expiry, the current certificate is still served while
+	// a new one is obtained in the background.
+	fakeClock.Advance(70 * 24 * time.Hour)
+	if current, err := manager.GetCertificate(hello("relay.example.com")); err != nil || current != original {
+		t.Errorf("Expected the current certificate during renewal but got %v, %v", current, err)
+	}
+
+	for attempt := 0; attempt < 100; attempt++ {
+		if renewed, _ := manager.GetCertificate(hello("relay.example.com")); renewed != original {
+			if orders := authority.orderCount(); orders != 2 {
+				t.Errorf("Expected 2 orders but got %v", orders)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Expected the certificate to be renewed")
+}
+
+func TestManagerErrors(t *testing.T) {
+	authority := newFakeAuthority(t)
+	manager := newManager(t, authority, t.TempDir(), nil)
+
+	if _, err := manager.GetCertificate(hello("other.example.com")); err == nil {
+		t.Errorf("Expected an error for an unconfigured domain")
+	}
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "relay.example.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	}); err == nil {
+		t.Errorf("Expected an error for a challenge handshake with no pending challenge")
+	}
+
+	// If validation fails, the handshake fails rather than hanging.
+	authority.validate = func(domain string) *tls.Certificate { return nil }
+	if _, err := manager.GetCertificate(hello("relay.example.com")); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("Expected a validation error but got %v", err)
+	}
+}
+
+func TestOptionsValidation(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		options acme.Options
+	}{
+		{
+			desc:    "At least one domain is required",
+			options: acme.Options{CacheDir: "/tmp/acme"},
+		},
+		{
+			desc:    "Wildcard domains are rejected",
+			options: acme.Options{Domains: []string{"*.example.com"}, CacheDir: "/tmp/acme"},
+		},
+		{
+			desc:    "A cache directory is required",
+			options: acme.Options{Domains: []string{"example.com"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		if err := testCase.options.Validate(); err == nil {
+			t.Errorf("Test '%v': Expected an error", testCase.desc)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idPeAcmeIdentifier is the OID of the certificate extension which carries
+// the key authorization digest in a tls-alpn-01 challenge certificate.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const (
+	pollInterval    = time.Second
+	maxPollInterval = 10 * time.Second
+)
+
+// directory lists the URLs of a certificate authority's resources.
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// problem is an ACME error document (RFC 8555 section 6.7).
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("%v: %v", p.Type, p.Detail)
+}
+
+const badNonceProblem = "urn:ietf:params:acme:error:badNonce"
+
+// client speaks the ACME protocol to a certificate authority on behalf of one
+// account.
+type client struct {
+	httpClient   *http.Client
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	directory    *directory
+	accountURL   string // The account's URL, used as the "kid" of signed requests.
+
+	nonceMutex sync.Mutex
+	nonces     []string
+}
+
+func newClient(httpClient *http.Client, directoryURL string, key *ecdsa.PrivateKey) *client {
+	return &client{httpClient: httpClient, directoryURL: directoryURL, key: key}
+}
+
+// register fetches the directory and creates the account, or looks it up if
+// the key is already registered.
+func (c *client) register(ctx context.Context, email string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status fetching directory: %v", response.Status)
+	}
+	c.directory = &directory{}
+	if err := json.NewDecoder(response.Body).Decode(c.directory); err != nil {
+		return fmt.Errorf("Invalid directory: %v", err)
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	accountResponse, _, err := c.post(ctx, c.directory.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	c.accountURL = accountResponse.Header.Get("Location")
+	if c.accountURL == "" {
+		return errors.New("Certificate authority didn't return an account URL")
+	}
+	return nil
+}
+
+// obtainCertificate orders a certificate for the domain, answering the
+// tls-alpn-01 challenge by passing a challenge certificate to setChallenge
+// until validation finishes. It returns the certificate's private key and its
+// DER-encoded chain.
+func (c *client) obtainCertificate(
+	ctx context.Context,
+	domain string,
+	setChallenge func(domain string, certificate *tls.Certificate),
+) (*ecdsa.PrivateKey, [][]byte, error) {
+	orderResponse, body, err := c.post(ctx, c.directory.NewOrder, map[string]interface{}{
+		"identifiers": []identifier{{Type: "dns", Value: domain}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := orderResponse.Header.Get("Location")
+	currentOrder := &order{}
+	if err := json.Unmarshal(body, currentOrder); err != nil {
+		return nil, nil, fmt.Errorf("Invalid order: %v", err)
+	}
+
+	for _, authorizationURL := range currentOrder.Authorizations {
+		if err := c.authorize(ctx, authorizationURL, setChallenge); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, body, err = c.post(ctx, currentOrder.Finalize, map[string]string{
+		"csr": base64.RawURLEncoding.EncodeToString(csr),
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(body, currentOrder); err != nil {
+		return nil, nil, fmt.Errorf("Invalid order: %v", err)
+	}
+
+	for delay := pollInterval; currentOrder.Status != "valid"; delay = min(delay*2, maxPollInterval) {
+		switch currentOrder.Status {
+		case "invalid":
+			if currentOrder.Error != nil {
+				return nil, nil, fmt.Errorf("Order failed: %v", currentOrder.Error)
+			}
+			return nil, nil, errors.New("Order failed")
+		case "processing", "ready", "pending":
+		default:
+			return nil, nil, fmt.Errorf("Unexpected order status %q", currentOrder.Status)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, nil, err
+		}
+		if _, body, err = c.post(ctx, orderURL, nil); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(body, currentOrder); err != nil {
+			return nil, nil, fmt.Errorf("Invalid order: %v", err)
+		}
+	}
+
+	_, body, err = c.post(ctx, currentOrder.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain [][]byte
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("Certificate authority returned no certificates")
+	}
+	return key, chain, nil
+}
+
+// authorize completes an authorization using the tls-alpn-01 challenge, and
+// waits for the certificate authority to validate it.
+func (c *client) authorize(
+	ctx context.Context,
+	authorizationURL string,
+	setChallenge func(domain string, certificate *tls.Certificate),
+) error {
+	current, err := c.fetchAuthorization(ctx, authorizationURL)
+	if err != nil {
+		return err
+	}
+	if current.Status == "valid" {
+		return nil // Authorizations are reused across orders for a while.
+	}
+
+	var tlsALPNChallenge *challenge
+	for i := range current.Challenges {
+		if current.Challenges[i].Type == "tls-alpn-01" {
+			tlsALPNChallenge = &current.Challenges[i]
+		}
+	}
+	if tlsALPNChallenge == nil {
+		return fmt.Errorf("Certificate authority didn't offer a tls-alpn-01 challenge for %v", current.Identifier.Value)
+	}
+
+	domain := current.Identifier.Value
+	certificate, err := c.challengeCertificate(domain, tlsALPNChallenge.Token)
+	if err != nil {
+		return err
+	}
+	setChallenge(domain, certificate)
+	defer setChallenge(domain, nil)
+
+	if _, _, err := c.post(ctx, tlsALPNChallenge.URL, struct{}{}); err != nil {
+		return err
+	}
+
+	for delay := pollInterval; ; delay = min(delay*2, maxPollInterval) {
+		if current, err = c.fetchAuthorization(ctx, authorizationURL); err != nil {
+			return err
+		}
+		switch current.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, challenge := range current.Challenges {
+				if challenge.Error != nil {
+					return fmt.Errorf("Validation of %v failed: %v", domain, challenge.Error)
+				}
+			}
+			return fmt.Errorf("Validation of %v failed with status %q", domain, current.Status)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) fetchAuthorization(ctx context.Context, authorizationURL string) (*authorization, error) {
+	_, body, err := c.post(ctx, authorizationURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &authorization{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("Invalid authorization: %v", err)
+	}
+	return result, nil
+}
+
+// challengeCertificate creates the self-signed certificate presented to the
+// certificate authority during tls-alpn-01 validation (RFC 8737 section 3).
+func (c *client) challengeCertificate(domain string, token string) (*tls.Certificate, error) {
+	digest := sha256.Sum256([]byte(KeyAuthorization(token, &c.key.PublicKey)))
+	extensionValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeAcmeIdentifier, Critical: true, Value: extensionValue},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// KeyAuthorization returns the key authorization for a challenge token: the
+// token joined to the thumbprint of the account key (RFC 8555 section 8.1).
+func KeyAuthorization(token string, accountKey *ecdsa.PublicKey) string {
+	thumbprint := sha256.Sum256(jwkJSON(accountKey))
+	return token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+// jwkJSON returns the JSON Web Key for a P-256 public key, with its members in
+// the canonical order used for thumbprints (RFC 7638).
+func jwkJSON(key *ecdsa.PublicKey) []byte {
+	x := base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32)))
+	y := base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32)))
+	return []byte(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%v","y":"%v"}`, x, y))
+}
+
+// post sends a signed request to the certificate authority, retrying once if
+// the nonce was rejected. A nil payload sends a POST-as-GET request.
+func (c *client) post(ctx context.Context, url string, payload interface{}) (*http.Response, []byte, error) {
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		if payloadJSON, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := c.sign(url, nonce, payloadJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		request.Header.Set("Content-Type", "application/jose+json")
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			return nil, nil, err
+		}
+		responseBody, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if nonce := response.Header.Get("Replay-Nonce"); nonce != "" {
+			c.nonceMutex.Lock()
+			c.nonces = append(c.nonces, nonce)
+			c.nonceMutex.Unlock()
+		}
+
+		if response.StatusCode < 400 {
+			return response, responseBody, nil
+		}
+		responseProblem := &problem{}
+		if err := json.Unmarshal(responseBody, responseProblem); err != nil || responseProblem.Type == "" {
+			return nil, nil, fmt.Errorf("Unexpected status from %v: %v", url, response.Status)
+		}
+		if responseProblem.Type == badNonceProblem && attempt == 0 {
+			continue
+		}
+		return nil, nil, responseProblem
+	}
+}
+
+// nonce returns an unused anti-replay nonce, fetching a new one if necessary.
+func (c *client) nonce(ctx context.Context) (string, error) {
+	c.nonceMutex.Lock()
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		c.nonceMutex.Unlock()
+		return nonce, nil
+	}
+	c.nonceMutex.Unlock()
+
+	request, err := http.NewRequestWithContext(ctx, "HEAD", c.directory.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	nonce := response.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("Certificate authority didn't return a nonce")
+	}
+	return nonce, nil
+}
+
+// sign wraps a payload in a flattened JWS signed with the account key (RFC
+// 8555 section 6.2). Until the account is registered, the key itself is
+// embedded; afterwards, the account URL is used instead.
+func (c *client) sign(url string, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.accountURL == "" {
+		protected["jwk"] = json.RawMessage(jwkJSON(&c.key.PublicKey))
+	} else {
+		protected["kid"] = c.accountURL
+	}
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// sleep waits for the provided delay, or until the context is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,357 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"github.com/immersa-co/relay-core/relay/version"
+)
+
+// The paths served on the admin listener.
+var (
+	HealthPath      = "/healthz"
+	ReadyPath       = "/readyz"
+	PluginsPath     = "/plugins"
+	RoutesPath      = "/routes"
+	JournalPath     = "/journal"
+	JournalDumpPath = "/journal/dump"
+	DrainPath       = "/drain"
+	DrainClosePath  = "/drain/close"
+	ReadOnlyPath    = "/read-only"
+	ReloadPath      = "/reload"
+)
+
+// PluginStatus describes an active plugin on the admin listener's plugins
+// endpoint.
+type PluginStatus struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	ConfigHash string `json:"config_hash"`     // The SHA-256 hash of the plugin's configuration section.
+	Route      string `json:"route,omitempty"` // The pattern of the route which loaded the plugin, if it isn't one of the service's own.
+}
+
+// PluginsResponse is the body served at PluginsPath.
+type PluginsResponse struct {
+	RelayVersion string          `json:"relay_version"`
+	Plugins      []*PluginStatus `json:"plugins"`
+}
+
+// PluginAdminPath returns the path under which a plugin's own admin endpoints
+// are served; see traffic.AdminPlugin.
+func PluginAdminPath(pluginName string) string {
+	return PluginsPath + "/" + pluginName
+}
+
+// RoutePluginAdminPath returns the path under which the admin endpoints of a
+// plugin loaded from a route's own plugin configuration are served.
+func RoutePluginAdminPath(route string, pluginName string) string {
+	return RoutesPath + "/" + route + PluginAdminPath(pluginName)
+}
+
+// AdminUrl returns the base URL of the admin listener, or "" if it hasn't been
+// started.
+func (service *Service) AdminUrl() string {
+	if service.adminListener == nil {
+		return ""
+	}
+	return fmt.Sprintf("http://%v", service.adminListener.Addr().String())
+}
+
+// StartAdmin starts a separate listener which serves endpoints for health
+// checks and for inspecting the relay:
+//
+//   - HealthPath returns 200 as long as the process is able to serve requests.
+//   - ReadyPath returns 200 while the service is accepting traffic, and 503
+//     before Start is called or after Close is called. It also returns 503,
+//     along with the reason, while a plugin which implements
+//     traffic.ReadinessPlugin reports that it isn't ready.
+//   - PluginsPath lists the active plugins as JSON, including those which
+//     virtual hosts and SNI routes load from their own plugin configuration.
+//     The configuration file, or if it's nil, the one the service was created
+//     from, is used to compute a hash of each plugin's configuration.
+//   - If the request journal is enabled, JournalPath returns its entries as
+//     JSON, and a POST to JournalDumpPath writes them to disk.
+//   - Plugins which implement traffic.AdminPlugin serve their own endpoints
+//     under PluginAdminPath, or, if a route loaded them, under
+//     RoutePluginAdminPath.
+//   - DrainPath returns a DrainReport describing the requests in progress,
+//     and a POST to it starts draining, as described in Drain. A POST to
+//     DrainClosePath closes the connections of requests older than its
+//     "older-than" query parameter, like "30s", or of every request if it's
+//     absent.
+//   - ReadOnlyPath returns "true" if the service is read-only, as described
+//     in SetReadOnly, and "false" otherwise. A POST to it makes the service
+//     read-only, unless its "enabled" query parameter is "false", in which
+//     case the service relays every request again.
+//   - ReloadPath returns a ReloadReport describing the changes made by the
+//     most recent Reload, or 404 if the service hasn't been reloaded.
+//
+// Like metrics, these endpoints are served on their own port so that they
+// aren't exposed to the clients whose traffic is being relayed.
+func (service *Service) StartAdmin(host string, port int, configFile *config.File) error {
+	address := fmt.Sprintf("%v:%v", host, port)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           service.adminHandler(configFile),
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	service.adminListener = listener
+
+	go server.Serve(listener)
+
+	return nil
+}
+
+func (service *Service) adminHandler(configFile *config.File) http.Handler {
+	service.lock.Lock()
+	if configFile != nil {
+		service.configFile = configFile
+	}
+	service.pluginAdmin = service.newPluginAdminHandler()
+	service.lock.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthPath, func(response http.ResponseWriter, request *http.Request) {
+		writeAdminStatus(response, http.StatusOK)
+	})
+	mux.HandleFunc(ReadyPath, func(response http.ResponseWriter, request *http.Request) {
+		if !service.ready.Load() {
+			writeAdminStatus(response, http.StatusServiceUnavailable)
+			return
+		}
+		if err := service.pluginsReady(); err != nil {
+			writeAdminStatus(response, http.StatusServiceUnavailable)
+			fmt.Fprintln(response, err)
+			return
+		}
+		writeAdminStatus(response, http.StatusOK)
+	})
+	mux.HandleFunc(PluginsPath, func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(service.pluginsResponse()); err != nil {
+			logger.Errorf("Error writing plugin status: %v", err)
+		}
+	})
+	mux.HandleFunc(DrainPath, func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			service.Drain()
+		default:
+			response.Header().Set("Allow", "GET, HEAD, POST")
+			writeAdminStatus(response, http.StatusMethodNotAllowed)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(service.DrainReport()); err != nil {
+			logger.Errorf("Error writing drain report: %v", err)
+		}
+	})
+	mux.HandleFunc(DrainClosePath, func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			response.Header().Set("Allow", http.MethodPost)
+			writeAdminStatus(response, http.StatusMethodNotAllowed)
+			return
+		}
+		var minAge time.Duration
+		if olderThan := request.URL.Query().Get("older-than"); olderThan != "" {
+			var err error
+			if minAge, err = time.ParseDuration(olderThan); err != nil || minAge < 0 {
+				writeAdminStatus(response, http.StatusBadRequest)
+				return
+			}
+		}
+		closed := service.CloseRequestsOlderThan(minAge)
+		response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(response, closed)
+	})
+	mux.HandleFunc(ReadOnlyPath, func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			readOnly := true
+			if enabled := request.URL.Query().Get("enabled"); enabled != "" {
+				var err error
+				if readOnly, err = strconv.ParseBool(enabled); err != nil {
+					writeAdminStatus(response, http.StatusBadRequest)
+					return
+				}
+			}
+			service.SetReadOnly(readOnly)
+		default:
+			response.Header().Set("Allow", "GET, HEAD, POST")
+			writeAdminStatus(response, http.StatusMethodNotAllowed)
+			return
+		}
+		response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(response, service.ReadOnly())
+	})
+	mux.HandleFunc(ReloadPath, func(response http.ResponseWriter, request *http.Request) {
+		service.lock.RLock()
+		lastReload := service.lastReload
+		service.lock.RUnlock()
+		if lastReload == nil {
+			writeAdminStatus(response, http.StatusNotFound)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(lastReload); err != nil {
+			logger.Errorf("Error writing reload report: %v", err)
+		}
+	})
+	pluginAdmin := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		service.lock.RLock()
+		handler := service.pluginAdmin
+		service.lock.RUnlock()
+		handler.ServeHTTP(response, request)
+	})
+	mux.Handle(PluginsPath+"/", pluginAdmin)
+	mux.Handle(RoutesPath+"/", pluginAdmin)
+	if service.journal != nil {
+		mux.HandleFunc(JournalPath, func(response http.ResponseWriter, request *http.Request) {
+			response.Header().Set("Content-Type", "application/json")
+			if err := service.journal.WriteJSON(response); err != nil {
+				logger.Errorf("Error writing request journal: %v", err)
+			}
+		})
+		mux.HandleFunc(JournalDumpPath, func(response http.ResponseWriter, request *http.Request) {
+			if request.Method != http.MethodPost {
+				response.Header().Set("Allow", http.MethodPost)
+				writeAdminStatus(response, http.StatusMethodNotAllowed)
+				return
+			}
+			path, err := service.journal.Dump(service.clock.Now())
+			if err != nil {
+				logger.Errorf("Error dumping request journal: %v", err)
+				writeAdminStatus(response, http.StatusInternalServerError)
+				return
+			}
+			logger.Printf("Request journal dumped to %v\n", path)
+			response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(response, path)
+		})
+	}
+	return mux
+}
+
+func writeAdminStatus(response http.ResponseWriter, status int) {
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.WriteHeader(status)
+	fmt.Fprintln(response, http.StatusText(status))
+}
+
+// newPluginAdminHandler returns a handler which serves the endpoints of the
+// service's plugins, and its routes' plugins, which implement
+// traffic.AdminPlugin. The service's lock must be held.
+func (service *Service) newPluginAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, plugin := range service.trafficPlugins {
+		if adminPlugin, ok := traffic.UnwrapPlugin(plugin).(traffic.AdminPlugin); ok {
+			prefix := PluginAdminPath(plugin.Name())
+			mux.Handle(prefix+"/", http.StripPrefix(prefix, adminPlugin.AdminHandler()))
+		}
+	}
+	mountedRoutes := map[string]bool{}
+	for _, route := range service.routes {
+		ownPlugins := route.ownPlugins()
+		if len(ownPlugins) == 0 {
+			continue
+		}
+		// A host and an SNI route may share a pattern; only the first one's
+		// plugins can be served.
+		if mountedRoutes[route.pattern] {
+			logger.Warnf("Admin endpoints of route %v's plugins are already served; skipping its duplicate", route.pattern)
+			continue
+		}
+		mountedRoutes[route.pattern] = true
+		for _, plugin := range ownPlugins {
+			if adminPlugin, ok := traffic.UnwrapPlugin(plugin).(traffic.AdminPlugin); ok {
+				prefix := RoutePluginAdminPath(route.pattern, plugin.Name())
+				mux.Handle(prefix+"/", http.StripPrefix(prefix, adminPlugin.AdminHandler()))
+			}
+		}
+	}
+	return mux
+}
+
+// pluginsReady returns an error describing the first of the service's
+// plugins, or its routes' plugins, which implements traffic.ReadinessPlugin
+// and reports that it isn't ready.
+func (service *Service) pluginsReady() error {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	if err := pluginsReady(service.trafficPlugins); err != nil {
+		return err
+	}
+	for _, route := range service.routes {
+		if err := pluginsReady(route.ownPlugins()); err != nil {
+			return fmt.Errorf("Route %v: %v", route.pattern, err)
+		}
+	}
+	return nil
+}
+
+// pluginsResponse describes the service's plugins, and its routes' plugins.
+func (service *Service) pluginsResponse() *PluginsResponse {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	plugins := &PluginsResponse{
+		RelayVersion: version.RelayRelease,
+		Plugins:      pluginStatuses(service.trafficPlugins, service.configFile, ""),
+	}
+	for _, route := range service.routes {
+		if ownPlugins := route.ownPlugins(); len(ownPlugins) > 0 {
+			plugins.Plugins = append(plugins.Plugins, pluginStatuses(ownPlugins, route.pluginConfig, route.pattern)...)
+		}
+	}
+	return plugins
+}
+
+// pluginsReady returns an error naming the first of the provided plugins which
+// implements traffic.ReadinessPlugin and reports that it isn't ready.
+func pluginsReady(trafficPlugins []traffic.Plugin) error {
+	for _, plugin := range trafficPlugins {
+		if readinessPlugin, ok := traffic.UnwrapPlugin(plugin).(traffic.ReadinessPlugin); ok {
+			if err := readinessPlugin.Ready(); err != nil {
+				return fmt.Errorf("%v: %v", plugin.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// pluginStatuses describes each of the provided plugins, which were loaded by
+// the route with the provided pattern, or by the service if it's empty.
+// Plugins are built into the relay, so unless they report their own version,
+// they share the relay's.
+func pluginStatuses(trafficPlugins []traffic.Plugin, configFile *config.File, route string) []*PluginStatus {
+	statuses := []*PluginStatus{}
+	for _, plugin := range trafficPlugins {
+		status := &PluginStatus{Name: plugin.Name(), Version: version.RelayRelease, Route: route}
+		if versionedPlugin, ok := traffic.UnwrapPlugin(plugin).(traffic.VersionedPlugin); ok {
+			status.Version = versionedPlugin.Version()
+		}
+
+		var section *config.Section
+		if configFile != nil {
+			section = configFile.LookupOptionalSection(plugin.Name())
+		}
+		if section == nil {
+			section = config.NewSection(plugin.Name())
+		}
+		status.ConfigHash = section.Hash()
+
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
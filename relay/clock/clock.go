@@ -0,0 +1,74 @@
+// Package clock provides a source of the current time which can be replaced in
+// tests, so that time-dependent behavior like timestamps and expiry can be
+// asserted on deterministically.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time. Code which generates timestamps or measures elapsed
+// time should use a Clock rather than calling time.Now directly.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+// Real is a Clock which reports the actual time.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// OrReal returns c, or Real if c is nil. This allows a nil Clock in an options
+// struct to mean "use the real time".
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// Fake is a Clock whose time only changes when it's explicitly set or
+// advanced. It's safe for concurrent use.
+type Fake struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewFake returns a Fake which reports the provided time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (fake *Fake) Now() time.Time {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.now
+}
+
+func (fake *Fake) Since(t time.Time) time.Duration {
+	return fake.Now().Sub(t)
+}
+
+// Set changes the time reported by the clock.
+func (fake *Fake) Set(now time.Time) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.now = now
+}
+
+// Advance moves the clock forward by the provided duration.
+func (fake *Fake) Advance(d time.Duration) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.now = fake.now.Add(d)
+}
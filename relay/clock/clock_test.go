@@ -0,0 +1,39 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := clock.NewFake(start)
+
+	if now := fake.Now(); !now.Equal(start) {
+		t.Errorf("Expected %v but got %v", start, now)
+	}
+
+	fake.Advance(90 * time.Second)
+	if elapsed := fake.Since(start); elapsed != 90*time.Second {
+		t.Errorf("Expected 1m30s to have elapsed but got %v", elapsed)
+	}
+
+	later := start.Add(24 * time.Hour)
+	fake.Set(later)
+	if now := fake.Now(); !now.Equal(later) {
+		t.Errorf("Expected %v but got %v", later, now)
+	}
+}
+
+func TestOrReal(t *testing.T) {
+	if clock.OrReal(nil) != clock.Real {
+		t.Errorf("Expected a nil clock to be replaced by the real clock")
+	}
+
+	fake := clock.NewFake(time.Time{})
+	if clock.OrReal(fake) != fake {
+		t.Errorf("Expected a non-nil clock to be returned unchanged")
+	}
+}
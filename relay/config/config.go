@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
 
 	"gopkg.in/yaml.v3"
 )
@@ -30,7 +33,20 @@ func NewFileFromYamlString(fileYaml string) (*File, error) {
 	if err := yaml.Unmarshal([]byte(fileYaml), &yamlSections); err != nil {
 		return nil, err
 	}
+	return newFileFromYamlSections(yamlSections), nil
+}
+
+// NewFileFromYamlNode is like NewFileFromYamlString, but it reads the File
+// from a YAML mapping node, such as a value nested within another File.
+func NewFileFromYamlNode(node yaml.Node) (*File, error) {
+	var yamlSections map[string]map[string]yaml.Node
+	if err := node.Decode(&yamlSections); err != nil {
+		return nil, err
+	}
+	return newFileFromYamlSections(yamlSections), nil
+}
 
+func newFileFromYamlSections(yamlSections map[string]map[string]yaml.Node) *File {
 	file := NewFile()
 	for sectionName, sectionValues := range yamlSections {
 		section := file.GetOrAddSection(sectionName)
@@ -39,7 +55,21 @@ func NewFileFromYamlString(fileYaml string) (*File, error) {
 		}
 	}
 
-	return file, nil
+	return file
+}
+
+// WithOverrides returns a new File containing this File's sections, except
+// that sections which also appear in overrides are replaced by the overriding
+// versions. Neither File is modified.
+func (file *File) WithOverrides(overrides *File) *File {
+	result := NewFile()
+	for name, section := range file.sections {
+		result.sections[name] = section
+	}
+	for name, section := range overrides.sections {
+		result.sections[name] = section
+	}
+	return result
 }
 
 // GetOrAddSection returns the Section with the specified name, if one exists.
@@ -67,6 +97,17 @@ func (file *File) LookupRequiredSection(name string) (*Section, error) {
 	return file.sections[name], nil
 }
 
+// SectionNames returns the names of the sections in the File, in sorted
+// order.
+func (file *File) SectionNames() []string {
+	names := make([]string, 0, len(file.sections))
+	for name := range file.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Section is a named collection of values usually found within a File.
 // Generally a Section is associated with a plugin or subsystem, and the values
 // it contains represent configuration options for that plugin or subsystem.
@@ -91,6 +132,41 @@ func (section *Section) Set(key string, value interface{}) {
 	section.values[key] = value
 }
 
+// Hash returns a hex-encoded SHA-256 hash of the Section's values. Sections
+// with the same values have the same hash, which makes it easy to tell whether
+// two relays are running with the same configuration without revealing it.
+func (section *Section) Hash() string {
+	// Values are decoded first so that formatting differences in the source
+	// don't affect the hash. Maps are marshaled with their keys in sorted
+	// order, so the encoding is deterministic.
+	values := section.decodedValues()
+	encoded, err := yaml.Marshal(values)
+	if err != nil {
+		encoded = []byte(fmt.Sprintf("%v", values))
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// decodedValues returns the Section's values, with YAML nodes decoded into
+// plain values. A nil Section has no values.
+func (section *Section) decodedValues() map[string]interface{} {
+	values := map[string]interface{}{}
+	if section == nil {
+		return values
+	}
+	for key, nodeOrValue := range section.values {
+		if node, ok := nodeOrValue.(yaml.Node); ok {
+			var value interface{}
+			if err := node.Decode(&value); err == nil {
+				nodeOrValue = value
+			}
+		}
+		values[key] = nodeOrValue
+	}
+	return values
+}
+
 // lookupValueInSection is an internal helper that attempts to read the value
 // with the provided key from the provided Section. If the value has type T, the
 // value is returned. If the value has type yaml.Node and can be unmarshaled
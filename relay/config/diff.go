@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The kinds of Change.
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// RedactedValue replaces the values of secrets in a Change.
+const RedactedValue = "[redacted]"
+
+// Change describes one difference between two configuration files, so that
+// operators can see exactly what a new configuration does. Values which look
+// like secrets are replaced by RedactedValue; see IsSecretKey.
+type Change struct {
+	Section string `json:"section"`
+	Key     string `json:"key,omitempty"` // Empty if the whole section was added or removed.
+	Kind    string `json:"kind"`          // Added, Removed, or Changed.
+
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+
+	// If both values are lists, such as lists of rules, the elements which
+	// were added and removed are listed instead of the old and new values.
+	AddedElements   []interface{} `json:"added_elements,omitempty"`
+	RemovedElements []interface{} `json:"removed_elements,omitempty"`
+}
+
+func (change *Change) String() string {
+	name := change.Section
+	if change.Key != "" {
+		name = fmt.Sprintf("%v.%v", change.Section, change.Key)
+	}
+	switch {
+	case change.Kind == Added:
+		return fmt.Sprintf("%v: added %v", name, formatValue(change.New))
+	case change.Kind == Removed:
+		return fmt.Sprintf("%v: removed %v", name, formatValue(change.Old))
+	case change.AddedElements != nil || change.RemovedElements != nil:
+		var parts []string
+		for _, element := range change.AddedElements {
+			parts = append(parts, "+"+formatValue(element))
+		}
+		for _, element := range change.RemovedElements {
+			parts = append(parts, "-"+formatValue(element))
+		}
+		return fmt.Sprintf("%v: changed %v", name, strings.Join(parts, " "))
+	default:
+		return fmt.Sprintf("%v: changed %v -> %v", name, formatValue(change.Old), formatValue(change.New))
+	}
+}
+
+// Diff returns the differences between two configuration files, ordered by
+// section and key. Sections and keys which are present but empty are treated
+// like missing ones, since the relay treats them the same way.
+func Diff(old *File, new *File) []*Change {
+	var changes []*Change
+	for _, name := range unionKeys(old.sections, new.sections) {
+		oldValues := settings(old.sections[name])
+		newValues := settings(new.sections[name])
+		switch {
+		case len(oldValues) == 0 && len(newValues) == 0:
+		case len(oldValues) == 0:
+			changes = append(changes, &Change{Section: name, Kind: Added, New: redact("", newValues)})
+		case len(newValues) == 0:
+			changes = append(changes, &Change{Section: name, Kind: Removed, Old: redact("", oldValues)})
+		default:
+			for _, key := range unionKeys(oldValues, newValues) {
+				if change := diffValue(name, key, oldValues[key], newValues[key]); change != nil {
+					changes = append(changes, change)
+				}
+			}
+		}
+	}
+	return changes
+}
+
+// settings returns the values in a section which are actually set.
+func settings(section *Section) map[string]interface{} {
+	values := section.decodedValues()
+	for key, value := range values {
+		if value == nil {
+			delete(values, key)
+		}
+	}
+	return values
+}
+
+func diffValue(section string, key string, oldValue interface{}, newValue interface{}) *Change {
+	switch {
+	case reflect.DeepEqual(oldValue, newValue):
+		return nil
+	case oldValue == nil:
+		return &Change{Section: section, Key: key, Kind: Added, New: redact(key, newValue)}
+	case newValue == nil:
+		return &Change{Section: section, Key: key, Kind: Removed, Old: redact(key, oldValue)}
+	}
+
+	change := &Change{Section: section, Key: key, Kind: Changed}
+	oldList, oldIsList := oldValue.([]interface{})
+	newList, newIsList := newValue.([]interface{})
+	if oldIsList && newIsList && !IsSecretKey(key) {
+		change.AddedElements = listDifference(newList, oldList)
+		change.RemovedElements = listDifference(oldList, newList)
+		if change.AddedElements != nil || change.RemovedElements != nil {
+			return change
+		}
+		// Only the order of the elements changed.
+	}
+	change.Old = redact(key, oldValue)
+	change.New = redact(key, newValue)
+	return change
+}
+
+// listDifference returns the elements of list which aren't in other, with any
+// secrets they contain redacted.
+func listDifference(list []interface{}, other []interface{}) []interface{} {
+	var difference []interface{}
+	for _, element := range list {
+		found := false
+		for _, otherElement := range other {
+			if reflect.DeepEqual(element, otherElement) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			difference = append(difference, redact("", element))
+		}
+	}
+	return difference
+}
+
+// secretWords are the final words of keys whose values are secrets.
+var secretWords = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+}
+
+// IsSecretKey returns true if the value of a configuration key, or of a key
+// nested within one, such as a header name, is likely to be a secret: that is,
+// if its last hyphen-separated word is something like "key", "secret", or
+// "token". Keys like "encryption-key-file", which name a file containing a
+// secret, aren't secret themselves.
+func IsSecretKey(key string) bool {
+	words := strings.Split(strings.ToLower(key), "-")
+	return secretWords[words[len(words)-1]]
+}
+
+// redact returns a copy of the value of key in which secrets are replaced by
+// RedactedValue.
+func redact(key string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if IsSecretKey(key) {
+		return RedactedValue
+	}
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		redacted := map[string]interface{}{}
+		for nestedKey, nestedValue := range typedValue {
+			redacted[nestedKey] = redact(nestedKey, nestedValue)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(typedValue))
+		for i, element := range typedValue {
+			redacted[i] = redact("", element)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+func formatValue(value interface{}) string {
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	// Use YAML's flow style, so that each change fits on one line.
+	var node yaml.Node
+	if err := yaml.Unmarshal(encoded, &node); err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	setFlowStyle(&node)
+	encoded, err = yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return strings.TrimSpace(string(encoded))
+}
+
+func setFlowStyle(node *yaml.Node) {
+	node.Style |= yaml.FlowStyle
+	for _, child := range node.Content {
+		setFlowStyle(child)
+	}
+}
+
+func unionKeys[V any](first map[string]V, second map[string]V) []string {
+	keys := make([]string, 0, len(first)+len(second))
+	for key := range first {
+		keys = append(keys, key)
+	}
+	for key := range second {
+		if _, ok := first[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
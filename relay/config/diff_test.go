@@ -0,0 +1,99 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+)
+
+func TestDiff(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		old      string
+		new      string
+		expected []string
+	}{
+		{
+			desc:     "Identical files have no changes",
+			old:      "relay:\n  target: http://a.example.com\n",
+			new:      "relay: {target: 'http://a.example.com'}\n",
+			expected: nil,
+		},
+		{
+			desc: "Changed targets are reported",
+			old:  "relay:\n  port: 8990\n  target: http://a.example.com\n",
+			new:  "relay:\n  port: 8990\n  target: http://b.example.com\n",
+			expected: []string{
+				"relay.target: changed http://a.example.com -> http://b.example.com",
+			},
+		},
+		{
+			desc: "Added and removed keys and sections are reported",
+			old:  "relay:\n  port: 8990\n  dry-run: true\ncookies:\n  allowlist: [session]\n",
+			new:  "relay:\n  port: 8990\n  max-body-size: 1024\npaths:\n  routes: []\n",
+			expected: []string{
+				"cookies: removed {allowlist: [session]}",
+				"paths: added {routes: []}",
+				"relay.dry-run: removed true",
+				"relay.max-body-size: added 1024",
+			},
+		},
+		{
+			desc:     "Empty keys and sections are treated as missing",
+			old:      "relay:\n  port: 8990\n  dry-run:\nstore-forward:\n  directory:\n",
+			new:      "relay:\n  port: 8990\n",
+			expected: nil,
+		},
+		{
+			desc: "Added and removed rules are listed individually",
+			old:  "block-content:\n  body-blocklist: ['one', 'two']\n",
+			new:  "block-content:\n  body-blocklist: ['two', 'three']\n",
+			expected: []string{
+				"block-content.body-blocklist: changed +three -one",
+			},
+		},
+		{
+			desc: "Secrets are redacted",
+			old:  "anonymous-id:\n  secret: old\nupstream-auth:\n  bearer-token: old\n  bearer-token-file: /old\n",
+			new:  "anonymous-id:\n  secret: new\nupstream-auth:\n  bearer-token: new\n  bearer-token-file: /new\n",
+			expected: []string{
+				"anonymous-id.secret: changed '[redacted]' -> '[redacted]'",
+				"upstream-auth.bearer-token: changed '[redacted]' -> '[redacted]'",
+				"upstream-auth.bearer-token-file: changed /old -> /new",
+			},
+		},
+		{
+			desc: "Nested secrets are redacted",
+			old:  "relay:\n  port: 8990\n",
+			new:  "outbound-headers:\n  set:\n    Authorization: Bearer token\n    X-Source: relay\n",
+			expected: []string{
+				"outbound-headers: added {set: {Authorization: '[redacted]', X-Source: relay}}",
+				"relay: removed {port: 8990}",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		oldFile, err := config.NewFileFromYamlString(testCase.old)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing old configuration: %v", testCase.desc, err)
+			continue
+		}
+		newFile, err := config.NewFileFromYamlString(testCase.new)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing new configuration: %v", testCase.desc, err)
+			continue
+		}
+
+		changes := config.Diff(oldFile, newFile)
+		if len(changes) != len(testCase.expected) {
+			t.Errorf("Test '%v': Expected %v changes but got %v", testCase.desc, testCase.expected, changes)
+			continue
+		}
+		for i, change := range changes {
+			if change.String() != testCase.expected[i] {
+				t.Errorf("Test '%v': Expected change '%v' but got '%v'", testCase.desc, testCase.expected[i], change)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package configcheck validates a relay configuration without starting the
+// relay. Every section is checked, rather than stopping at the first problem,
+// so that operators can fix all of their mistakes in one pass.
+package configcheck
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
+)
+
+// coreSections are the sections read by the relay itself, rather than by a
+// plugin.
+var coreSections = []string{"relay", "logging", "outbound-headers", "dead-letter", "audit", "s3-spool"}
+
+// SectionError is a problem with one section of the configuration.
+type SectionError struct {
+	Section string
+	Err     error
+}
+
+func (err *SectionError) Error() string {
+	return fmt.Sprintf("[%v] %v", err.Section, err.Err)
+}
+
+// Report lists the problems found in a configuration.
+type Report struct {
+	Errors []*SectionError
+}
+
+// Valid returns true if no problems were found.
+func (report *Report) Valid() bool {
+	return len(report.Errors) == 0
+}
+
+func (report *Report) add(section string, err error) {
+	report.Errors = append(report.Errors, &SectionError{Section: section, Err: err})
+}
+
+// Check validates every section of a configuration file:
+//
+//   - The core 'relay', 'logging', and 'outbound-headers' sections are read
+//     just as they are when the relay starts, which validates options like
+//     the target URL. Logging sinks are opened, to check that they're usable,
+//     and closed again.
+//   - Each plugin is instantiated via plugin_loader, which validates its
+//     rules, like regular expressions and URLs.
+//   - Cookie and outbound header allowlists are checked for invalid names,
+//     which would never match anything.
+//   - Sections which don't belong to the core relay or any plugin are
+//     reported, since they're usually typos.
+//
+// Nothing is started and no ports are bound.
+func Check(configFile *config.File, pluginFactories []traffic.PluginFactory) *Report {
+	report := &Report{}
+
+	// Loading plugins adds their sections to the file, so note which sections
+	// were actually present first.
+	presentSections := configFile.SectionNames()
+
+	relayOptions, err := relay.ReadOptions(configFile)
+	if err != nil {
+		report.add("relay", err)
+	}
+
+	if loggingOptions, err := logging.ReadOptions(configFile); err != nil {
+		report.add("logging", err)
+	} else {
+		for _, sink := range loggingOptions.Sinks {
+			sink.Close()
+		}
+	}
+
+	outboundHeaderPolicy, err := traffic.ReadOutboundHeaderPolicy(configFile)
+	if err != nil {
+		report.add("outbound-headers", err)
+		outboundHeaderPolicy = &traffic.OutboundHeaderPolicy{}
+	}
+	for _, header := range outboundHeaderPolicy.Allowlist {
+		if !isToken(header) {
+			report.add("outbound-headers", fmt.Errorf(`Invalid header name "%v" in allowlist`, header))
+		}
+	}
+
+	for _, factory := range pluginFactories {
+		if _, err := plugin_loader.LoadPlugin(factory, configFile, outboundHeaderPolicy); err != nil {
+			report.add(factory.Name(), err)
+		}
+	}
+	if relayOptions != nil {
+		checkRoutes(relayOptions.Service, pluginFactories, outboundHeaderPolicy, report)
+	}
+	checkCookieAllowlist(configFile, report)
+
+	known := map[string]bool{}
+	for _, section := range coreSections {
+		known[section] = true
+	}
+	for _, factory := range pluginFactories {
+		known[factory.Name()] = true
+	}
+	for _, section := range presentSections {
+		if !known[section] {
+			report.add(section, fmt.Errorf("Unknown configuration section"))
+		}
+	}
+
+	return report
+}
+
+// checkRoutes loads the plugins of each SNI route and virtual host which
+// overrides them, since a route's plugin configuration is only otherwise read
+// at startup.
+func checkRoutes(
+	serviceOptions *relay.ServiceOptions,
+	pluginFactories []traffic.PluginFactory,
+	outboundHeaderPolicy *traffic.OutboundHeaderPolicy,
+	report *Report,
+) {
+	checkRoute := func(description string, route *relay.RouteOptions) {
+		if route.PluginConfig == nil {
+			return
+		}
+		for _, factory := range pluginFactories {
+			if _, err := plugin_loader.LoadPlugin(factory, route.PluginConfig, outboundHeaderPolicy); err != nil {
+				report.add("relay", fmt.Errorf(`%v: %v: %v`, description, factory.Name(), err))
+			}
+		}
+	}
+
+	if serviceOptions.TLS != nil {
+		for _, route := range serviceOptions.TLS.SNIRoutes {
+			checkRoute(fmt.Sprintf(`SNI route "%v"`, route.ServerName), &route.RouteOptions)
+		}
+	}
+	for _, host := range serviceOptions.Hosts {
+		checkRoute(fmt.Sprintf(`Host "%v"`, host.Host), &host.RouteOptions)
+	}
+}
+
+// checkCookieAllowlist reports invalid cookie names in the cookies plugin's
+// allowlist.
+func checkCookieAllowlist(configFile *config.File, report *Report) {
+	section := configFile.LookupOptionalSection("cookies")
+	if section == nil {
+		return
+	}
+	allowlist, err := config.LookupOptional[[]string](section, "allowlist")
+	if err != nil || allowlist == nil {
+		return // Any error has already been reported by the plugin.
+	}
+	for _, cookieName := range *allowlist {
+		if !isToken(cookieName) {
+			report.add("cookies", fmt.Errorf(`Invalid cookie name "%v" in allowlist`, cookieName))
+		}
+	}
+}
+
+// isToken returns true if name is a valid HTTP token, as header and cookie
+// names must be.
+func isToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	})
+}
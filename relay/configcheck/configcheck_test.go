@@ -0,0 +1,88 @@
+package configcheck_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/configcheck"
+	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		yaml             string
+		expectedSections []string
+	}{
+		{
+			desc: "valid configuration",
+			yaml: `relay:
+    port: 8990
+    target: https://relay-target.example
+cookies:
+    allowlist: [session_id]
+block-content:
+    body:
+        - mask: '[0-9]+'
+`,
+		},
+		{
+			desc: "errors in several sections",
+			yaml: `relay:
+    port: 8990
+    target: not-a-url
+logging:
+    level: loud
+outbound-headers:
+    allowlist: [User-Agent, "Bad Header"]
+cookies:
+    allowlist: [session_id, "bad;cookie"]
+block-content:
+    body:
+        - exclude: '('
+paths:
+    routes:
+        - path: '[unclosed'
+          target-path: /bar/
+segment-proxi:
+    compress-batches: true
+`,
+			expectedSections: []string{
+				"relay",
+				"logging",
+				"outbound-headers",
+				"block-content",
+				"paths",
+				"cookies",
+				"segment-proxi",
+			},
+		},
+		{
+			desc:             "missing relay section",
+			yaml:             "cookies:\n    allowlist: [session_id]\n",
+			expectedSections: []string{"relay"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.yaml)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing YAML: %v", testCase.desc, err)
+			continue
+		}
+
+		report := configcheck.Check(configFile, plugin_loader.DefaultPlugins)
+
+		var sections []string
+		for _, sectionError := range report.Errors {
+			sections = append(sections, sectionError.Section)
+		}
+		if !reflect.DeepEqual(sections, testCase.expectedSections) {
+			t.Errorf("Test '%v': Expected errors in sections %v but got %v", testCase.desc, testCase.expectedSections, report.Errors)
+		}
+		if report.Valid() != (len(testCase.expectedSections) == 0) {
+			t.Errorf("Test '%v': Unexpected result from Valid", testCase.desc)
+		}
+	}
+}
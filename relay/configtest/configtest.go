@@ -0,0 +1,216 @@
+// Package configtest runs declarative test cases against a relay
+// configuration. Each test case describes a request sent to the relay and the
+// request the target is expected to receive, so operators can check their
+// blocking, enrichment, and routing rules without writing Go.
+package configtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
+	"gopkg.in/yaml.v3"
+)
+
+// Suite is the top-level structure of a test fixture file.
+type Suite struct {
+	Tests []Case `yaml:"tests"`
+}
+
+// Case is a single test case.
+type Case struct {
+	Name    string          `yaml:"name"`
+	Request RequestFixture  `yaml:"request"`
+	Expect  ExpectedOutcome `yaml:"expect"`
+}
+
+// RequestFixture describes the request sent to the relay.
+type RequestFixture struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+}
+
+// ExpectedOutcome describes what should happen to the request. Any field left
+// unset is not checked.
+type ExpectedOutcome struct {
+	// The status code the relay should return to the client.
+	Status int `yaml:"status"`
+
+	// Whether the request should reach the target. Defaults to true.
+	Relayed *bool `yaml:"relayed"`
+
+	// The path (including any query string) the target should receive.
+	Path string `yaml:"path"`
+
+	// Headers the target should receive with exactly these values, and headers
+	// which should be absent.
+	Headers       map[string]string `yaml:"headers"`
+	AbsentHeaders []string          `yaml:"absent-headers"`
+
+	// The exact body the target should receive, and substrings that it should
+	// or should not contain.
+	Body         *string  `yaml:"body"`
+	BodyContains []string `yaml:"body-contains"`
+	BodyExcludes []string `yaml:"body-excludes"`
+}
+
+// Result reports the outcome of a single test case.
+type Result struct {
+	Name     string
+	Failures []string
+}
+
+func (result *Result) Passed() bool {
+	return len(result.Failures) == 0
+}
+
+func (result *Result) failf(format string, args ...interface{}) {
+	result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+}
+
+// ParseSuite parses a test fixture file.
+func ParseSuite(suiteYaml []byte) (*Suite, error) {
+	suite := &Suite{}
+	if err := yaml.Unmarshal(suiteYaml, suite); err != nil {
+		return nil, fmt.Errorf("Could not parse test fixtures: %v", err)
+	}
+	for i, testCase := range suite.Tests {
+		if testCase.Name == "" {
+			suite.Tests[i].Name = fmt.Sprintf("test %d", i+1)
+		}
+	}
+	return suite, nil
+}
+
+// Run executes each test case in the suite against a relay configured using
+// configYaml. The relay's target is replaced with a local catcher service so
+// that the requests the target would receive can be inspected; every other
+// option is used as written.
+func Run(configYaml string, suite *Suite, pluginFactories []traffic.PluginFactory) ([]*Result, error) {
+	var results []*Result
+	for _, testCase := range suite.Tests {
+		result, err := runCase(configYaml, testCase, pluginFactories)
+		if err != nil {
+			return nil, fmt.Errorf("Test '%v': %v", testCase.Name, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// runCase runs a single test case using a fresh catcher and relay, so that
+// state from one case can't leak into the next.
+func runCase(configYaml string, testCase Case, pluginFactories []traffic.PluginFactory) (*Result, error) {
+	catcherService := catcher.NewService()
+	if err := catcherService.Start("localhost", 0); err != nil {
+		return nil, fmt.Errorf("Error starting catcher: %v", err)
+	}
+	defer catcherService.Close()
+
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		return nil, err
+	}
+	relaySection := configFile.GetOrAddSection("relay")
+	relaySection.Set("port", 0)
+	relaySection.Set("target", catcherService.HttpUrl())
+
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		return nil, err
+	}
+	trafficPlugins, err := plugin_loader.Load(pluginFactories, configFile)
+	if err != nil {
+		return nil, err
+	}
+	relayService := relay.NewService(options.Relay, trafficPlugins)
+	if err := relayService.Start("localhost", 0); err != nil {
+		return nil, fmt.Errorf("Error starting relay: %v", err)
+	}
+	defer relayService.Close()
+
+	method := testCase.Request.Method
+	if method == "" {
+		method = "GET"
+	}
+	path := testCase.Request.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	request, err := http.NewRequest(method, relayService.HttpUrl()+path, strings.NewReader(testCase.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	for header, value := range testCase.Request.Headers {
+		request.Header.Set(header, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	result := &Result{Name: testCase.Name}
+	expect := testCase.Expect
+	if expect.Status != 0 && response.StatusCode != expect.Status {
+		result.failf("expected status %d but got %d", expect.Status, response.StatusCode)
+	}
+
+	lastRequest, _ := catcherService.LastRequest()
+	expectRelayed := expect.Relayed == nil || *expect.Relayed
+	if !expectRelayed {
+		if lastRequest != nil {
+			result.failf("expected request not to be relayed, but the target received it")
+		}
+		return result, nil
+	}
+	if lastRequest == nil {
+		result.failf("expected request to be relayed, but the target did not receive it")
+		return result, nil
+	}
+
+	if expect.Path != "" && lastRequest.URL.RequestURI() != expect.Path {
+		result.failf("expected path %q but got %q", expect.Path, lastRequest.URL.RequestURI())
+	}
+	for header, expectedValue := range expect.Headers {
+		if actualValue := lastRequest.Header.Get(header); actualValue != expectedValue {
+			result.failf("expected header %v to be %q but got %q", header, expectedValue, actualValue)
+		}
+	}
+	for _, header := range expect.AbsentHeaders {
+		if values := lastRequest.Header.Values(header); len(values) > 0 {
+			result.failf("expected header %v to be absent but got %q", header, values)
+		}
+	}
+
+	body, err := io.ReadAll(lastRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+	if expect.Body != nil && !bytes.Equal(body, []byte(*expect.Body)) {
+		result.failf("expected body %q but got %q", *expect.Body, body)
+	}
+	for _, substring := range expect.BodyContains {
+		if !bytes.Contains(body, []byte(substring)) {
+			result.failf("expected body to contain %q but got %q", substring, body)
+		}
+	}
+	for _, substring := range expect.BodyExcludes {
+		if bytes.Contains(body, []byte(substring)) {
+			result.failf("expected body not to contain %q but got %q", substring, body)
+		}
+	}
+
+	return result, nil
+}
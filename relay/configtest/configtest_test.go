@@ -0,0 +1,64 @@
+package configtest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/configtest"
+	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+const testConfig = `relay:
+    target: http://unused.example
+block-content:
+    body:
+        - mask: 'SECRET'
+`
+
+func TestRun(t *testing.T) {
+	suite, err := configtest.ParseSuite([]byte(`tests:
+  - name: secrets are masked
+    request:
+      method: POST
+      path: /ingest?x=1
+      headers:
+        Content-Type: text/plain
+      body: 'my SECRET value'
+    expect:
+      status: 200
+      path: /ingest?x=1
+      headers:
+        Content-Type: text/plain
+      body: 'my ****** value'
+      body-excludes: ['SECRET']
+  - request:
+      method: POST
+      body: 'SECRET'
+    expect:
+      body-contains: ['SECRET']
+`))
+	if err != nil {
+		t.Fatalf("Error parsing suite: %v", err)
+	}
+
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	results, err := configtest.Run(testConfig, suite, plugins)
+	if err != nil {
+		t.Fatalf("Error running suite: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results but got %v", len(results))
+	}
+
+	if !results[0].Passed() {
+		t.Errorf("Expected first test to pass: %v", results[0].Failures)
+	}
+
+	if results[1].Name != "test 2" {
+		t.Errorf("Expected unnamed test to get a default name but got '%v'", results[1].Name)
+	}
+	if results[1].Passed() || !strings.Contains(results[1].Failures[0], "to contain") {
+		t.Errorf("Expected second test to fail with a body mismatch: %v", results[1].Failures)
+	}
+}
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// connectionTrackingListener wraps a net.Listener and notifies plugins which
+// implement traffic.ConnectionPlugin when connections are accepted and closed.
+type connectionTrackingListener struct {
+	net.Listener
+	plugins []traffic.ConnectionPlugin
+	clock   clock.Clock
+}
+
+func newConnectionTrackingListener(
+	listener net.Listener,
+	plugins []traffic.ConnectionPlugin,
+	clock clock.Clock,
+) net.Listener {
+	if len(plugins) == 0 {
+		return listener
+	}
+	return &connectionTrackingListener{
+		Listener: listener,
+		plugins:  plugins,
+		clock:    clock,
+	}
+}
+
+func (listener *connectionTrackingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// The plugins are told about the connection once it's first used, which
+	// happens on its own goroutine, so that slow plugins don't hold up the
+	// accept loop.
+	return &trackedConn{
+		Conn:        conn,
+		plugins:     listener.plugins,
+		clock:       listener.clock,
+		connectedAt: listener.clock.Now(),
+	}, nil
+}
+
+// tlsListener terminates TLS on the connections accepted by a listener, like
+// tls.NewListener. If the listener tracks connections, the tracked connections
+// are told about their TLS state. Tracking happens beneath TLS, rather than by
+// wrapping the tls.Conn, so that net/http can see the TLS state and serve
+// HTTP/2 to clients which negotiate it.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func newTLSListener(listener net.Listener, config *tls.Config) net.Listener {
+	return &tlsListener{Listener: listener, config: config}
+}
+
+func (listener *tlsListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, listener.config)
+	if trackedConn, ok := conn.(*trackedConn); ok {
+		trackedConn.tlsConn.Store(tlsConn)
+	}
+	return tlsConn, nil
+}
+
+// trackedConn counts the bytes passing through a connection and reports it to
+// connection plugins when it's first used and when it's closed. If TLS is
+// terminated on the connection, the byte counts include TLS overhead.
+type trackedConn struct {
+	net.Conn
+	tlsConn      atomic.Pointer[tls.Conn] // Set if TLS is terminated on the connection.
+	plugins      []traffic.ConnectionPlugin
+	clock        clock.Clock
+	connectedAt  time.Time
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	connectOnce  sync.Once
+	closeOnce    sync.Once
+}
+
+// connect invokes the plugins' OnConnect hooks, unless they already have been.
+func (conn *trackedConn) connect() {
+	conn.connectOnce.Do(func() {
+		// The TLS handshake, if any, hasn't happened yet, and may be what's
+		// reading, so the TLS state can't be asked for.
+		info := traffic.ConnectionInfo{
+			RemoteAddr:  conn.RemoteAddr(),
+			LocalAddr:   conn.LocalAddr(),
+			ConnectedAt: conn.connectedAt,
+		}
+		for _, plugin := range conn.plugins {
+			plugin.OnConnect(info)
+		}
+	})
+}
+
+func (conn *trackedConn) Read(b []byte) (int, error) {
+	conn.connect()
+	n, err := conn.Conn.Read(b)
+	conn.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (conn *trackedConn) Write(b []byte) (int, error) {
+	conn.connect()
+	n, err := conn.Conn.Write(b)
+	conn.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+func (conn *trackedConn) Close() error {
+	err := conn.Conn.Close()
+	// OnConnect is always invoked before OnDisconnect, even if the connection
+	// was never used.
+	conn.connect()
+	conn.closeOnce.Do(func() {
+		info := conn.info()
+		info.Duration = conn.clock.Since(conn.connectedAt)
+		for _, plugin := range conn.plugins {
+			plugin.OnDisconnect(info)
+		}
+	})
+	return err
+}
+
+func (conn *trackedConn) info() traffic.ConnectionInfo {
+	info := traffic.ConnectionInfo{
+		RemoteAddr:   conn.RemoteAddr(),
+		LocalAddr:    conn.LocalAddr(),
+		ConnectedAt:  conn.connectedAt,
+		BytesRead:    conn.bytesRead.Load(),
+		BytesWritten: conn.bytesWritten.Load(),
+	}
+	if tlsConn := conn.tlsConn.Load(); tlsConn != nil {
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
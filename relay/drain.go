@@ -0,0 +1,208 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/journal"
+)
+
+// DrainReport describes the requests the relay is still handling, so that
+// deploy tooling can decide when it's safe to stop a draining relay.
+type DrainReport struct {
+	Draining    bool             `json:"draining"`
+	DrainingFor journal.Duration `json:"draining_for,omitempty"` // How long ago draining started.
+	Requests    int              `json:"requests"`               // HTTP requests, not counting websockets.
+	Websockets  int              `json:"websockets"`
+	OldestAge   journal.Duration `json:"oldest_age"`
+	Active      []*ActiveRequest `json:"active"` // Oldest first.
+}
+
+// ActiveRequest describes a request, or websocket session, which the relay is
+// still handling.
+type ActiveRequest struct {
+	Method    string           `json:"method"`
+	Host      string           `json:"host"`
+	Path      string           `json:"path"`
+	Websocket bool             `json:"websocket"`
+	Age       journal.Duration `json:"age"`
+}
+
+// requestTracker keeps track of the requests being handled, so they can be
+// reported while draining and closed if they outstay a deadline.
+type requestTracker struct {
+	handler http.Handler
+	clock   clock.Clock
+
+	mutex         sync.Mutex
+	active        map[*trackedRequest]bool
+	completed     *sync.Cond // Signalled, with mutex, when a request completes.
+	drainingSince time.Time  // Zero unless draining.
+}
+
+type trackedRequest struct {
+	method    string
+	host      string
+	path      string
+	websocket bool
+	started   time.Time
+	conn      net.Conn // The client's connection, if known.
+}
+
+type connContextKey struct{}
+
+// withConn makes a connection available to the requests made on it. It's used
+// as http.Server.ConnContext.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+func newRequestTracker(handler http.Handler, clock clock.Clock) *requestTracker {
+	tracker := &requestTracker{
+		handler: handler,
+		clock:   clock,
+		active:  map[*trackedRequest]bool{},
+	}
+	tracker.completed = sync.NewCond(&tracker.mutex)
+	return tracker
+}
+
+func (tracker *requestTracker) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	tracked := &trackedRequest{
+		method:    request.Method,
+		host:      request.Host,
+		path:      request.URL.Path,
+		websocket: request.Header.Get("Upgrade") == "websocket",
+		started:   tracker.clock.Now(),
+	}
+	tracked.conn, _ = request.Context().Value(connContextKey{}).(net.Conn)
+
+	tracker.mutex.Lock()
+	tracker.active[tracked] = true
+	tracker.mutex.Unlock()
+	defer func() {
+		tracker.mutex.Lock()
+		delete(tracker.active, tracked)
+		tracker.completed.Broadcast()
+		tracker.mutex.Unlock()
+	}()
+
+	tracker.handler.ServeHTTP(response, request)
+}
+
+// drain records that draining has started, unless it already has.
+func (tracker *requestTracker) drain() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.drainingSince.IsZero() {
+		tracker.drainingSince = tracker.clock.Now()
+	}
+}
+
+// wait blocks until the requests which are in progress now have completed.
+// Requests which start later aren't waited for.
+func (tracker *requestTracker) wait() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	pending := map[*trackedRequest]bool{}
+	for tracked := range tracker.active {
+		pending[tracked] = true
+	}
+	for len(pending) > 0 {
+		tracker.completed.Wait()
+		for tracked := range pending {
+			if !tracker.active[tracked] {
+				delete(pending, tracked)
+			}
+		}
+	}
+}
+
+func (tracker *requestTracker) report() *DrainReport {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := tracker.clock.Now()
+	report := &DrainReport{
+		Draining: !tracker.drainingSince.IsZero(),
+		Active:   []*ActiveRequest{},
+	}
+	if report.Draining {
+		report.DrainingFor = journal.Duration(now.Sub(tracker.drainingSince))
+	}
+	for tracked := range tracker.active {
+		if tracked.websocket {
+			report.Websockets++
+		} else {
+			report.Requests++
+		}
+		report.Active = append(report.Active, &ActiveRequest{
+			Method:    tracked.method,
+			Host:      tracked.host,
+			Path:      tracked.path,
+			Websocket: tracked.websocket,
+			Age:       journal.Duration(now.Sub(tracked.started)),
+		})
+	}
+	sort.Slice(report.Active, func(i, j int) bool {
+		return report.Active[i].Age > report.Active[j].Age
+	})
+	if len(report.Active) > 0 {
+		report.OldestAge = report.Active[0].Age
+	}
+	return report
+}
+
+// closeOlderThan closes the client connections of requests which started at
+// least minAge ago, and returns the number of connections closed. Closing a
+// connection ends every request on it, which for HTTP/2 may include newer
+// requests.
+func (tracker *requestTracker) closeOlderThan(minAge time.Duration) int {
+	tracker.mutex.Lock()
+	now := tracker.clock.Now()
+	conns := map[net.Conn]bool{}
+	for tracked := range tracker.active {
+		if tracked.conn != nil && now.Sub(tracked.started) >= minAge {
+			conns[tracked.conn] = true
+		}
+	}
+	tracker.mutex.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// Drain prepares the service to be stopped: the readiness check starts
+// failing, so load balancers stop sending new traffic, and connections are no
+// longer kept alive once their current request completes. Requests already in
+// progress, including websocket sessions, carry on; DrainReport describes
+// them, and CloseRequestsOlderThan ends those which outstay a deadline.
+func (service *Service) Drain() {
+	service.ready.Store(false)
+	if service.server != nil {
+		service.server.SetKeepAlivesEnabled(false)
+	}
+	service.requests.drain()
+	logger.Printf("Draining: %v requests in progress\n", len(service.requests.report().Active))
+}
+
+// DrainReport describes the requests the service is still handling.
+func (service *Service) DrainReport() *DrainReport {
+	return service.requests.report()
+}
+
+// CloseRequestsOlderThan force-closes the client connections of requests, and
+// websocket sessions, which started at least minAge ago. It returns the
+// number of connections closed.
+func (service *Service) CloseRequestsOlderThan(minAge time.Duration) int {
+	closed := service.requests.closeOlderThan(minAge)
+	logger.Printf("Closed %v connections with requests older than %v\n", closed, minAge)
+	return closed
+}
@@ -3,16 +3,16 @@ package environment
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"strings"
 
+	"github.com/immersa-co/relay-core/relay/logging"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	logger = log.New(os.Stdout, "[relay] ", 0)
+	logger = logging.New("relay")
 
 	// Matches "${FOO}", "${FOO:BAR}", "$(FOO)", or "$(FOO:BAR)".
 	varSubstitutionRegexp = regexp.MustCompile(`(\\*)((\$\{([^:}]*)(:([^}]*))?})|(\$\(([^:)]*)(:([^)]*))?\)))`)
@@ -121,7 +121,7 @@ func (env *Map) SubstituteVarsIntoYaml(input string) string {
 				}
 
 				// The input is invalid; just return the empty string.
-				logger.Printf(`Invalid value for environment variable '%v': %v`, envVar, value)
+				logger.Warnf(`Invalid value for environment variable '%v': %v`, envVar, value)
 				return ""
 			}
 		} else {
@@ -215,7 +215,7 @@ func parseDotEnv(filePath string) map[string]string {
 		}
 		separatorIndex := strings.Index(line, "=")
 		if separatorIndex == -1 || separatorIndex == len(line)-1 {
-			logger.Println("Invalid dotenv line:", line)
+			logger.Warnf("Invalid dotenv line: %v", line)
 			continue
 		}
 		key := strings.Trim(line[0:separatorIndex], " 	")
@@ -0,0 +1,143 @@
+// Package journal keeps summaries of the most recent requests handled by the
+// relay in a fixed-size ring buffer. The journal is cheap enough to leave on
+// in production, where full access logging may not be, and it can be dumped
+// to disk when the relay panics or fetched from the admin listener, which
+// helps with postmortems.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration which is encoded in JSON as a human-readable
+// string, like "1.5ms".
+type Duration time.Duration
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	*duration = Duration(parsed)
+	return err
+}
+
+// PluginDecision records how a plugin handled a request.
+type PluginDecision struct {
+	Plugin   string   `json:"plugin"`
+	Serviced bool     `json:"serviced"` // True if the plugin serviced the request itself.
+	Duration Duration `json:"duration"`
+}
+
+// Entry summarizes a single request handled by the relay.
+type Entry struct {
+	Time     time.Time        `json:"time"` // When the request was received.
+	Method   string           `json:"method"`
+	Host     string           `json:"host"` // The Host header of the original request.
+	Path     string           `json:"path"` // The path of the original request URL.
+	Status   int              `json:"status"`
+	Duration Duration         `json:"duration"`
+	Serviced bool             `json:"serviced"`
+	Plugins  []PluginDecision `json:"plugins,omitempty"`
+	Tags     []string         `json:"tags,omitempty"`
+	Panic    string           `json:"panic,omitempty"` // If handling the request panicked, the panic value.
+}
+
+// Journal is a ring buffer of the most recent request summaries. It's safe for
+// concurrent use, and a nil Journal discards everything recorded in it.
+type Journal struct {
+	dumpDir string
+
+	mutex   sync.Mutex
+	entries []Entry
+	next    int  // The index at which the next entry will be recorded.
+	full    bool // True once the buffer has wrapped around.
+}
+
+// New returns a Journal which keeps the last size entries. Dumps are written
+// to dumpDir, or to the system's temporary directory if it's empty.
+func New(size int, dumpDir string) *Journal {
+	if size <= 0 {
+		size = 1
+	}
+	if dumpDir == "" {
+		dumpDir = os.TempDir()
+	}
+	return &Journal{dumpDir: dumpDir, entries: make([]Entry, size)}
+}
+
+// Record adds an entry to the journal, replacing the oldest entry if the
+// journal is full.
+func (journal *Journal) Record(entry Entry) {
+	if journal == nil {
+		return
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.entries[journal.next] = entry
+	journal.next++
+	if journal.next == len(journal.entries) {
+		journal.next = 0
+		journal.full = true
+	}
+}
+
+// Entries returns a copy of the entries in the journal, oldest first.
+func (journal *Journal) Entries() []Entry {
+	if journal == nil {
+		return nil
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if !journal.full {
+		return append([]Entry{}, journal.entries[:journal.next]...)
+	}
+	entries := make([]Entry, 0, len(journal.entries))
+	entries = append(entries, journal.entries[journal.next:]...)
+	return append(entries, journal.entries[:journal.next]...)
+}
+
+// WriteJSON writes the entries in the journal to writer as a JSON array,
+// oldest first.
+func (journal *Journal) WriteJSON(writer io.Writer) error {
+	entries := journal.Entries()
+	if entries == nil {
+		entries = []Entry{}
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// Dump writes the entries in the journal to a new file in the dump directory,
+// named for the provided time, and returns the file's path.
+func (journal *Journal) Dump(now time.Time) (string, error) {
+	if journal == nil {
+		return "", fmt.Errorf("The request journal is disabled")
+	}
+
+	name := fmt.Sprintf("relay-journal-%v.json", now.UTC().Format("20060102T150405.000000000Z"))
+	path := filepath.Join(journal.dumpDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := journal.WriteJSON(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
@@ -0,0 +1,107 @@
+package journal_test
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/journal"
+)
+
+func paths(entries []journal.Entry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Path)
+	}
+	return result
+}
+
+func TestRingBuffer(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		recorded []string
+		expected []string
+	}{
+		{
+			desc:     "Empty",
+			recorded: nil,
+			expected: nil,
+		},
+		{
+			desc:     "Partially full",
+			recorded: []string{"/a", "/b"},
+			expected: []string{"/a", "/b"},
+		},
+		{
+			desc:     "Exactly full",
+			recorded: []string{"/a", "/b", "/c"},
+			expected: []string{"/a", "/b", "/c"},
+		},
+		{
+			desc:     "Wrapped around",
+			recorded: []string{"/a", "/b", "/c", "/d", "/e"},
+			expected: []string{"/c", "/d", "/e"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		requestJournal := journal.New(3, "")
+		for _, path := range testCase.recorded {
+			requestJournal.Record(journal.Entry{Path: path})
+		}
+		if actual := paths(requestJournal.Entries()); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Test '%v': Expected %v but got %v", testCase.desc, testCase.expected, actual)
+		}
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var requestJournal *journal.Journal
+	requestJournal.Record(journal.Entry{Path: "/ignored"})
+	if entries := requestJournal.Entries(); entries != nil {
+		t.Errorf("Expected no entries but got %v", entries)
+	}
+	if _, err := requestJournal.Dump(time.Now()); err == nil {
+		t.Errorf("Expected an error dumping a nil journal")
+	}
+}
+
+func TestDump(t *testing.T) {
+	requestJournal := journal.New(2, t.TempDir())
+	recorded := journal.Entry{
+		Time:     time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		Method:   "POST",
+		Host:     "relay.example",
+		Path:     "/events",
+		Status:   502,
+		Duration: journal.Duration(1500 * time.Microsecond),
+		Plugins: []journal.PluginDecision{
+			{Plugin: "block-content", Duration: journal.Duration(200 * time.Microsecond)},
+		},
+		Panic: "boom",
+	}
+	requestJournal.Record(recorded)
+
+	path, err := requestJournal.Dump(time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error dumping journal: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading dump: %v", err)
+	}
+
+	var dumped []journal.Entry
+	if err := json.Unmarshal(content, &dumped); err != nil {
+		t.Fatalf("Error parsing dump: %v\n%s", err, content)
+	}
+	if !reflect.DeepEqual(dumped, []journal.Entry{recorded}) {
+		t.Errorf("Expected %+v but got %+v", recorded, dumped)
+	}
+	if !strings.Contains(string(content), `"duration": "1.5ms"`) {
+		t.Errorf("Expected durations to be human-readable:\n%s", content)
+	}
+}
@@ -0,0 +1,40 @@
+package relay
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// concurrencyLimiter rejects requests with a 503 while a maximum number of
+// requests are already being handled, so that a flood of requests can't
+// exhaust the relay's memory or file descriptors. Websocket connections count
+// as requests for as long as they're open.
+type concurrencyLimiter struct {
+	handler  http.Handler
+	limit    int64 // If zero, requests aren't limited.
+	inFlight atomic.Int64
+}
+
+func (limiter *concurrencyLimiter) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if limiter.limit == 0 {
+		limiter.handler.ServeHTTP(response, request)
+		return
+	}
+
+	defer limiter.inFlight.Add(-1)
+	if limiter.inFlight.Add(1) > limiter.limit {
+		logger.Printf("Rejecting %s %s %s: too many concurrent requests", request.Method, request.Host, request.URL)
+		response.Header().Set("Retry-After", "1")
+		http.Error(response, "Too many concurrent requests", http.StatusServiceUnavailable)
+		return
+	}
+	limiter.handler.ServeHTTP(response, request)
+}
+
+// SetRequestLimits limits the number of requests the service handles at once
+// and the size of request headers, as described in ServiceOptions. It must be
+// called before Start.
+func (service *Service) SetRequestLimits(options *ServiceOptions) {
+	service.limiter.limit = int64(options.MaxConcurrentRequests)
+	service.maxHeaderBytes = options.MaxHeaderBytes
+}
@@ -0,0 +1,381 @@
+// Package logging provides the structured logger shared by the relay and its
+// plugins. Each package creates a Logger for its component with New; the
+// level, output format, and destinations of every Logger are configured
+// centrally, from the 'logging' section of the relay configuration.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+)
+
+// Level is the severity of a log message. The zero value is Info.
+type Level int
+
+const (
+	Debug Level = iota - 1
+	Info
+	Warn
+	Error
+)
+
+func (level Level) String() string {
+	switch level {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+}
+
+// ParseLevel parses a level name, like "info" or "error".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	default:
+		return Info, fmt.Errorf(`Invalid log level "%v"`, name)
+	}
+}
+
+// Format determines how log messages are rendered.
+type Format int
+
+const (
+	// Text renders messages as "[component] message key=value", which is
+	// easy to read on a terminal.
+	Text Format = iota
+
+	// JSON renders each message as a JSON object.
+	JSON
+
+	// Logfmt renders each message as a line of key=value pairs.
+	Logfmt
+)
+
+// ParseFormat parses a format name: "text", "json", or "logfmt".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	case "logfmt":
+		return Logfmt, nil
+	default:
+		return Text, fmt.Errorf(`Invalid log format "%v"`, name)
+	}
+}
+
+// Options configures the output of every Logger.
+type Options struct {
+	Level  Level
+	Format Format
+	Sinks  []Sink      // Where messages are written. If empty, messages are written to stdout.
+	Clock  clock.Clock // The source of message timestamps. If nil, the real time is used.
+}
+
+// SinkConfig describes a sink in the 'sinks' list of the logging section.
+type SinkConfig struct {
+	Type       string `yaml:"type"`        // "stdout", "stderr", "file", or "syslog".
+	Path       string `yaml:"path"`        // For "file": the path of the log file.
+	MaxSize    int64  `yaml:"max-size"`    // For "file": the size in bytes at which the file is rotated.
+	MaxBackups int    `yaml:"max-backups"` // For "file": the number of rotated files to keep.
+	Network    string `yaml:"network"`     // For "syslog": "udp", "tcp", or "" for the local daemon.
+	Address    string `yaml:"address"`     // For "syslog": the address of a remote daemon.
+	Tag        string `yaml:"tag"`         // For "syslog": the tag to log with; the default is "relay".
+}
+
+// ReadOptions reads logging options from the optional 'logging' section of
+// the configuration file. Sinks are opened immediately, so files and syslog
+// connections are ready by the time the options are passed to Configure.
+func ReadOptions(configFile *config.File) (*Options, error) {
+	options := &Options{Level: Info, Format: Text}
+	section := configFile.LookupOptionalSection("logging")
+	if section == nil {
+		return options, nil
+	}
+
+	if err := config.ParseOptional(section, "level", func(key string, value string) error {
+		level, err := ParseLevel(value)
+		options.Level = level
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(section, "format", func(key string, value string) error {
+		format, err := ParseFormat(value)
+		options.Format = format
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(section, "sinks", func(key string, value []SinkConfig) error {
+		for _, sinkConfig := range value {
+			sink, err := NewSink(sinkConfig)
+			if err != nil {
+				for _, opened := range options.Sinks {
+					opened.Close()
+				}
+				options.Sinks = nil
+				return err
+			}
+			options.Sinks = append(options.Sinks, sink)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// output is the shared destination of every Logger.
+type output struct {
+	options Options
+	mutex   sync.Mutex // Serializes writes to the sinks.
+}
+
+var current atomic.Pointer[output]
+
+func init() {
+	current.Store(&output{options: Options{
+		Level:  Info,
+		Format: Text,
+		Sinks:  []Sink{NewWriterSink(os.Stdout)},
+		Clock:  clock.Real,
+	}})
+}
+
+// Configure replaces the output of every Logger. Sinks from the previous
+// configuration are closed.
+func Configure(options *Options) {
+	next := &output{options: *options}
+	if len(next.options.Sinks) == 0 {
+		next.options.Sinks = []Sink{NewWriterSink(os.Stdout)}
+	}
+	next.options.Clock = clock.OrReal(next.options.Clock)
+
+	previous := current.Swap(next)
+	previous.mutex.Lock()
+	defer previous.mutex.Unlock()
+	for _, sink := range previous.options.Sinks {
+		sink.Close()
+	}
+}
+
+// Logger writes messages on behalf of a single component of the relay, like
+// "relay-traffic" or "traffic-block-content". It's safe for concurrent use.
+type Logger struct {
+	component string
+}
+
+// New returns a Logger for the named component.
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Enabled returns true if messages at the provided level are being written.
+// It can be used to avoid expensive work to build messages which would be
+// discarded.
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= current.Load().options.Level
+}
+
+// Log writes a message with optional structured fields, given as alternating
+// keys and values.
+func (logger *Logger) Log(level Level, message string, keyvals ...any) {
+	out := current.Load()
+	if level < out.options.Level {
+		return
+	}
+
+	record := record{
+		time:      out.options.Clock.Now(),
+		level:     level,
+		component: logger.component,
+		message:   strings.TrimSuffix(message, "\n"),
+		keyvals:   keyvals,
+	}
+	line := record.format(out.options.Format)
+
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	for _, sink := range out.options.Sinks {
+		sink.Write(level, line)
+	}
+}
+
+func (logger *Logger) Debug(message string, keyvals ...any) {
+	logger.Log(Debug, message, keyvals...)
+}
+
+func (logger *Logger) Info(message string, keyvals ...any) {
+	logger.Log(Info, message, keyvals...)
+}
+
+func (logger *Logger) Warn(message string, keyvals ...any) {
+	logger.Log(Warn, message, keyvals...)
+}
+
+func (logger *Logger) Error(message string, keyvals ...any) {
+	logger.Log(Error, message, keyvals...)
+}
+
+func (logger *Logger) Debugf(format string, args ...any) {
+	if logger.Enabled(Debug) {
+		logger.Log(Debug, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *Logger) Warnf(format string, args ...any) {
+	if logger.Enabled(Warn) {
+		logger.Log(Warn, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *Logger) Errorf(format string, args ...any) {
+	if logger.Enabled(Error) {
+		logger.Log(Error, fmt.Sprintf(format, args...))
+	}
+}
+
+// Printf writes a message at the Info level. Along with Println, it allows a
+// Logger to stand in for a log.Logger.
+func (logger *Logger) Printf(format string, args ...any) {
+	if logger.Enabled(Info) {
+		logger.Log(Info, fmt.Sprintf(format, args...))
+	}
+}
+
+// Println writes a message at the Info level, formatting its arguments like
+// fmt.Println.
+func (logger *Logger) Println(args ...any) {
+	if logger.Enabled(Info) {
+		logger.Log(Info, fmt.Sprintln(args...))
+	}
+}
+
+// record is a single log message.
+type record struct {
+	time      time.Time
+	level     Level
+	component string
+	message   string
+	keyvals   []any
+}
+
+// fields returns the record's structured fields as key/value pairs. A key
+// without a value is reported under the key "!BADKEY".
+func (record *record) fields() [][2]any {
+	var fields [][2]any
+	for i := 0; i < len(record.keyvals); i += 2 {
+		if i+1 == len(record.keyvals) {
+			fields = append(fields, [2]any{"!BADKEY", record.keyvals[i]})
+			break
+		}
+		fields = append(fields, [2]any{record.keyvals[i], record.keyvals[i+1]})
+	}
+	return fields
+}
+
+func (record *record) format(format Format) []byte {
+	var builder strings.Builder
+	switch format {
+	case JSON:
+		builder.WriteString(`{"time":`)
+		writeJSON(&builder, record.time.Format(time.RFC3339Nano))
+		builder.WriteString(`,"level":`)
+		writeJSON(&builder, record.level.String())
+		builder.WriteString(`,"component":`)
+		writeJSON(&builder, record.component)
+		builder.WriteString(`,"msg":`)
+		writeJSON(&builder, record.message)
+		for _, field := range record.fields() {
+			builder.WriteByte(',')
+			writeJSON(&builder, fmt.Sprint(field[0]))
+			builder.WriteByte(':')
+			writeJSON(&builder, field[1])
+		}
+		builder.WriteByte('}')
+
+	case Logfmt:
+		builder.WriteString("time=")
+		builder.WriteString(record.time.Format(time.RFC3339Nano))
+		builder.WriteString(" level=")
+		builder.WriteString(record.level.String())
+		builder.WriteString(" component=")
+		writeLogfmtValue(&builder, record.component)
+		builder.WriteString(" msg=")
+		writeLogfmtValue(&builder, record.message)
+		writeLogfmtFields(&builder, record.fields())
+
+	default:
+		builder.WriteByte('[')
+		builder.WriteString(record.component)
+		builder.WriteString("] ")
+		builder.WriteString(record.message)
+		writeLogfmtFields(&builder, record.fields())
+	}
+	return []byte(builder.String())
+}
+
+func writeJSON(builder *strings.Builder, value any) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	builder.Write(encoded)
+}
+
+func writeLogfmtFields(builder *strings.Builder, fields [][2]any) {
+	for _, field := range fields {
+		builder.WriteByte(' ')
+		builder.WriteString(fmt.Sprint(field[0]))
+		builder.WriteByte('=')
+		writeLogfmtValue(builder, fmt.Sprint(field[1]))
+	}
+}
+
+// writeLogfmtValue writes a logfmt value, quoting it if necessary.
+func writeLogfmtValue(builder *strings.Builder, value string) {
+	needsQuotes := value == ""
+	for _, r := range value {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			needsQuotes = true
+			break
+		}
+	}
+	if !needsQuotes {
+		builder.WriteString(value)
+		return
+	}
+	encoded, _ := json.Marshal(value)
+	builder.Write(encoded)
+}
@@ -0,0 +1,198 @@
+package logging_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+)
+
+// withOutput configures logging to write to a buffer for the duration of a
+// test.
+func withOutput(t *testing.T, level logging.Level, format logging.Format) *bytes.Buffer {
+	var output bytes.Buffer
+	logging.Configure(&logging.Options{
+		Level:  level,
+		Format: format,
+		Sinks:  []logging.Sink{logging.NewWriterSink(&output)},
+		Clock:  clock.NewFake(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)),
+	})
+	t.Cleanup(func() { logging.Configure(&logging.Options{}) })
+	return &output
+}
+
+func TestFormats(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		format   logging.Format
+		expected string
+	}{
+		{
+			desc:     "text",
+			format:   logging.Text,
+			expected: `[test-component] Relayed request method=POST path="/a b" error=boom`,
+		},
+		{
+			desc:   "json",
+			format: logging.JSON,
+			expected: `{"time":"2024-05-06T07:08:09Z","level":"warn","component":"test-component",` +
+				`"msg":"Relayed request","method":"POST","path":"/a b","error":"boom"}`,
+		},
+		{
+			desc:   "logfmt",
+			format: logging.Logfmt,
+			expected: `time=2024-05-06T07:08:09Z level=warn component=test-component msg="Relayed request" ` +
+				`method=POST path="/a b" error=boom`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		output := withOutput(t, logging.Info, testCase.format)
+		logger := logging.New("test-component")
+		logger.Warn("Relayed request", "method", "POST", "path", "/a b", "error", errors.New("boom"))
+
+		if actual := strings.TrimSuffix(output.String(), "\n"); actual != testCase.expected {
+			t.Errorf("Test '%v': Expected:\n%v\nbut got:\n%v", testCase.desc, testCase.expected, actual)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	output := withOutput(t, logging.Warn, logging.Text)
+	logger := logging.New("test")
+
+	logger.Debugf("debug %v", 1)
+	logger.Printf("info %v", 2)
+	logger.Warnf("warn %v", 3)
+	logger.Errorf("error %v", 4)
+	logger.Println("info", 5)
+
+	expected := "[test] warn 3\n[test] error 4\n"
+	if output.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, output.String())
+	}
+	if logger.Enabled(logging.Info) || !logger.Enabled(logging.Error) {
+		t.Errorf("Unexpected result from Enabled")
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "relay.log")
+	testCases := []struct {
+		desc          string
+		yaml          string
+		expectedError string
+		expectedLevel logging.Level
+		expectedSinks int
+	}{
+		{
+			desc:          "no logging section",
+			yaml:          "relay:\n  port: 8990\n",
+			expectedLevel: logging.Info,
+		},
+		{
+			desc: "all options",
+			yaml: `logging:
+    level: error
+    format: logfmt
+    sinks:
+      - type: stderr
+      - type: file
+        path: ` + logPath + `
+        max-size: 1024
+`,
+			expectedLevel: logging.Error,
+			expectedSinks: 2,
+		},
+		{
+			desc:          "invalid level",
+			yaml:          "logging:\n  level: loud\n",
+			expectedError: `Invalid log level "loud"`,
+		},
+		{
+			desc:          "invalid format",
+			yaml:          "logging:\n  format: xml\n",
+			expectedError: `Invalid log format "xml"`,
+		},
+		{
+			desc:          "invalid sink",
+			yaml:          "logging:\n  sinks:\n    - type: carrier-pigeon\n",
+			expectedError: `Invalid log sink type "carrier-pigeon"`,
+		},
+		{
+			desc:          "file sink without a path",
+			yaml:          "logging:\n  sinks:\n    - type: file\n",
+			expectedError: `Log sinks of type "file" require a path`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.yaml)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing YAML: %v", testCase.desc, err)
+			continue
+		}
+
+		options, err := logging.ReadOptions(configFile)
+		if testCase.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("Test '%v': Expected error %q but got %v", testCase.desc, testCase.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Unexpected error: %v", testCase.desc, err)
+			continue
+		}
+
+		if options.Level != testCase.expectedLevel {
+			t.Errorf("Test '%v': Expected level %v but got %v", testCase.desc, testCase.expectedLevel, options.Level)
+		}
+		if len(options.Sinks) != testCase.expectedSinks {
+			t.Errorf("Test '%v': Expected %v sinks but got %v", testCase.desc, testCase.expectedSinks, len(options.Sinks))
+		}
+		for _, sink := range options.Sinks {
+			sink.Close()
+		}
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "relay.log")
+	sink, err := logging.NewFileSink(logPath, 20, 2)
+	if err != nil {
+		t.Fatalf("Error creating file sink: %v", err)
+	}
+
+	// Each line is 10 bytes including its newline, so every file holds two.
+	for _, line := range []string{"line-0001", "line-0002", "line-0003", "line-0004", "line-0005", "line-0006", "line-0007"} {
+		if err := sink.Write(logging.Info, []byte(line)); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	sink.Close()
+
+	expected := map[string]string{
+		logPath:        "line-0007\n",
+		logPath + ".1": "line-0005\nline-0006\n",
+		logPath + ".2": "line-0003\nline-0004\n",
+	}
+	for path, expectedContent := range expected {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("Error reading %v: %v", path, err)
+		} else if string(content) != expectedContent {
+			t.Errorf("Expected %v to contain %q but got %q", path, expectedContent, content)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Sink is a destination for log messages. Operators choose sinks in the
+// configuration; other destinations can be supported by implementing Sink and
+// passing it to Configure.
+//
+// Calls to Write are serialized, so sinks needn't be safe for concurrent use.
+type Sink interface {
+	// Write writes a single formatted message, which doesn't include a
+	// trailing newline.
+	Write(level Level, line []byte) error
+
+	// Close releases any resources held by the sink.
+	Close() error
+}
+
+// NewSink creates a sink from its configuration.
+func NewSink(sinkConfig SinkConfig) (Sink, error) {
+	switch strings.ToLower(sinkConfig.Type) {
+	case "", "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case "stderr":
+		return NewWriterSink(os.Stderr), nil
+	case "file":
+		if sinkConfig.Path == "" {
+			return nil, fmt.Errorf(`Log sinks of type "file" require a path`)
+		}
+		return NewFileSink(sinkConfig.Path, sinkConfig.MaxSize, sinkConfig.MaxBackups)
+	case "syslog":
+		tag := sinkConfig.Tag
+		if tag == "" {
+			tag = "relay"
+		}
+		return NewSyslogSink(sinkConfig.Network, sinkConfig.Address, tag)
+	default:
+		return nil, fmt.Errorf(`Invalid log sink type "%v"`, sinkConfig.Type)
+	}
+}
+
+// writerSink writes messages to an io.Writer, one per line. It never closes
+// the writer, since it's usually stdout or stderr.
+type writerSink struct {
+	writer io.Writer
+	buffer []byte
+}
+
+// NewWriterSink returns a Sink which writes messages to writer, one per line.
+func NewWriterSink(writer io.Writer) Sink {
+	return &writerSink{writer: writer}
+}
+
+func (sink *writerSink) Write(level Level, line []byte) error {
+	sink.buffer = append(append(sink.buffer[:0], line...), '\n')
+	_, err := sink.writer.Write(sink.buffer)
+	return err
+}
+
+func (sink *writerSink) Close() error {
+	return nil
+}
+
+// FileSink writes messages to a file, one per line. When the file would grow
+// beyond its maximum size, it's rotated: "relay.log" is renamed to
+// "relay.log.1", "relay.log.1" to "relay.log.2", and so on, and the oldest
+// file beyond the maximum number of backups is deleted.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens the file at path for appending. If maxSize is zero, the
+// file is never rotated.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("Log file size and backup limits must not be negative")
+	}
+	sink := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *FileSink) Write(level Level, line []byte) error {
+	length := int64(len(line)) + 1
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+length > sink.maxSize {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := sink.file.Write(append(line, '\n'))
+	sink.size += int64(n)
+	return err
+}
+
+// rotate shifts the existing backups, moves the current file into the first
+// backup slot, and opens a new, empty file.
+func (sink *FileSink) rotate() error {
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+
+	if sink.maxBackups == 0 {
+		os.Remove(sink.path)
+	} else {
+		os.Remove(sink.backupPath(sink.maxBackups))
+		for i := sink.maxBackups - 1; i >= 1; i-- {
+			os.Rename(sink.backupPath(i), sink.backupPath(i+1))
+		}
+		if err := os.Rename(sink.path, sink.backupPath(1)); err != nil {
+			return err
+		}
+	}
+
+	return sink.open()
+}
+
+func (sink *FileSink) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", sink.path, index)
+}
+
+func (sink *FileSink) Close() error {
+	return sink.file.Close()
+}
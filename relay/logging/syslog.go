@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"log/syslog"
+)
+
+// syslogSink writes messages to a syslog daemon, mapping each message's level
+// to the corresponding syslog severity.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to a syslog daemon. If network is empty, it connects
+// to the local daemon.
+func NewSyslogSink(network, address, tag string) (Sink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (sink *syslogSink) Write(level Level, line []byte) error {
+	message := string(line)
+	switch level {
+	case Debug:
+		return sink.writer.Debug(message)
+	case Warn:
+		return sink.writer.Warning(message)
+	case Error:
+		return sink.writer.Err(message)
+	default:
+		return sink.writer.Info(message)
+	}
+}
+
+func (sink *syslogSink) Close() error {
+	return sink.writer.Close()
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewSyslogSink always fails, because syslog isn't supported on this
+// platform.
+func NewSyslogSink(network, address, tag string) (Sink, error) {
+	return nil, fmt.Errorf("Syslog is not supported on %v", runtime.GOOS)
+}
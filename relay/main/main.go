@@ -1,19 +1,36 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
-	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/immersa-co/relay-core/relay"
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/configcheck"
+	"github.com/immersa-co/relay-core/relay/configtest"
 	"github.com/immersa-co/relay-core/relay/environment"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/traffic"
 	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
 )
 
-var logger = log.New(os.Stdout, "[relay] ", 0)
+var logger = logging.New("relay")
+
+// loadDefaultPlugins loads the default set of plugins from a configuration
+// file.
+func loadDefaultPlugins(configFile *config.File) ([]traffic.Plugin, error) {
+	return plugin_loader.Load(plugin_loader.DefaultPlugins, configFile)
+}
 
 func readConfigFile(path string) (rawConfigFileBytes []byte, err error) {
 	if path == "-" {
@@ -25,31 +42,356 @@ func readConfigFile(path string) (rawConfigFileBytes []byte, err error) {
 	return
 }
 
+// loadConfigYaml reads the configuration file at the provided path and
+// substitutes the values of environment variables into it.
+func loadConfigYaml(path string) (string, error) {
+	rawConfigFileBytes, err := readConfigFile(path)
+	if err != nil {
+		return "", fmt.Errorf(`Couldn't read configuration file "%s": %v`, path, err)
+	}
+
+	// Substitute the values of environment variables into the configuration
+	// file. In versions of the relay prior to 0.3, configuration was performed
+	// entirely via environment variables. Environment variable substitution
+	// allows configurations based on those older environment variables to
+	// continue to work and generally increases the flexibility of the
+	// configuration file.
+	envProvider := environment.NewDefaultProvider()
+	env := environment.NewMap(envProvider)
+	return env.SubstituteVarsIntoYaml(string(rawConfigFileBytes)), nil
+}
+
+// runTests implements the 'test' subcommand, which runs declarative test
+// fixtures against the configuration file:
+//
+//	relay test [--config relay.yaml] fixtures.yaml...
+func runTests(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	configFilePath := flags.String("config", "relay.yaml", "Configuration file path")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		logger.Println("Usage: relay test [--config relay.yaml] fixtures.yaml...")
+		os.Exit(2)
+	}
+
+	configYaml, err := loadConfigYaml(*configFilePath)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, fixturePath := range flags.Args() {
+		fixtureBytes, err := os.ReadFile(fixturePath)
+		if err != nil {
+			logger.Errorf(`Couldn't read test fixtures "%s": %v\n`, fixturePath, err)
+			os.Exit(1)
+		}
+		suite, err := configtest.ParseSuite(fixtureBytes)
+		if err != nil {
+			logger.Printf("%s: %v\n", fixturePath, err)
+			os.Exit(1)
+		}
+
+		results, err := configtest.Run(configYaml, suite, plugin_loader.DefaultPlugins)
+		if err != nil {
+			logger.Printf("%s: %v\n", fixturePath, err)
+			os.Exit(1)
+		}
+
+		for _, result := range results {
+			if result.Passed() {
+				fmt.Printf("PASS %s: %s\n", fixturePath, result.Name)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL %s: %s\n", fixturePath, result.Name)
+			for _, failure := range result.Failures {
+				fmt.Printf("    %s\n", failure)
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d test(s) failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+// openSectionStore opens the storage directory configured in a section of the
+// configuration file, for subcommands which read what the relay stored.
+func openSectionStore(configFilePath string, sectionName string) (*storage.Store, error) {
+	configYaml, err := loadConfigYaml(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		return nil, err
+	}
+	section, err := configFile.LookupRequiredSection(sectionName)
+	if err != nil {
+		return nil, err
+	}
+	storageOptions, err := storage.ReadOptions(section)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewStore(storageOptions)
+}
+
+// runAudit implements the 'audit' subcommand, which writes the entries in the
+// audit log to stdout as JSON lines, oldest first, decrypting them if
+// necessary:
+//
+//	relay audit [--config relay.yaml]
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	configFilePath := flags.String("config", "relay.yaml", "Configuration file path")
+	flags.Parse(args)
+
+	store, err := openSectionStore(*configFilePath, "audit")
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	names, err := store.List()
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, name := range names {
+		entries, err := traffic.ReadAuditEntries(store, name)
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+	}
+}
+
+// runRedrive implements the 'redrive' subcommand, which sends requests captured
+// in the dead letter directory to the target again, deleting those it accepts:
+//
+//	relay redrive [--config relay.yaml] [--target https://example.com] [--dry-run]
+func runRedrive(args []string) {
+	flags := flag.NewFlagSet("redrive", flag.ExitOnError)
+	configFilePath := flags.String("config", "relay.yaml", "Configuration file path")
+	targetOverride := flags.String("target", "", "Send requests to this target instead of the one they were originally sent to")
+	dryRun := flags.Bool("dry-run", false, "List the dead letters without sending them")
+	flags.Parse(args)
+
+	store, err := openSectionStore(*configFilePath, "dead-letter")
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	var target *url.URL
+	if *targetOverride != "" {
+		if target, err = url.Parse(*targetOverride); err != nil || target.Scheme == "" || target.Host == "" {
+			logger.Printf("Invalid target URL \"%s\"\n", *targetOverride)
+			os.Exit(2)
+		}
+	}
+
+	if *dryRun {
+		names, err := store.List()
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		for _, name := range names {
+			letter, err := traffic.ReadDeadLetter(store, name)
+			if err != nil {
+				fmt.Printf("%s: %v\n", name, err)
+				continue
+			}
+			fmt.Printf("%s: %s %s (%d bytes)\n", name, letter.Method, letter.URL, len(letter.Body))
+		}
+		return
+	}
+
+	delivered, remaining, err := traffic.RedriveDeadLetters(store, &http.Client{Timeout: time.Minute}, target)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d dead letter(s) delivered, %d remaining\n", delivered, remaining)
+	if remaining > 0 {
+		os.Exit(1)
+	}
+}
+
+// runReplay implements the 'replay' subcommand, which sends the requests in
+// recordings again, at the pace at which they were recorded or faster. The
+// recordings are read from the directory configured in the 'recording'
+// section, and decrypted if necessary; all of them are replayed, oldest first,
+// unless some are named. They can also be listed, or written to stdout, e.g.
+// to open a HAR recording in a browser's developer tools:
+//
+//	relay replay [--config relay.yaml] [--target https://example.com] [--speed 1] [recording...]
+//	relay replay [--config relay.yaml] --list
+//	relay replay [--config relay.yaml] --export recording
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFilePath := flags.String("config", "relay.yaml", "Configuration file path")
+	targetOverride := flags.String("target", "", "Send requests to this target instead of the one they were originally sent to")
+	speed := flags.Float64("speed", 1, "How many times faster than recorded to send requests, or 0 to send them without pauses")
+	list := flags.Bool("list", false, "List the recordings instead of replaying them")
+	export := flags.Bool("export", false, "Write the recording to stdout instead of replaying it")
+	flags.Parse(args)
+
+	if *speed < 0 || (*export && flags.NArg() != 1) {
+		logger.Println("Usage: relay replay [--config relay.yaml] [--target https://example.com] [--speed 1] [--list] [--export] [recording...]")
+		os.Exit(2)
+	}
+
+	store, err := openSectionStore(*configFilePath, "recording")
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	names := flags.Args()
+	if len(names) == 0 {
+		if names, err = store.List(); err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *list {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	if *export {
+		reader, err := store.Open(names[0])
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		defer reader.Close()
+		if _, err := io.Copy(os.Stdout, reader); err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	options := traffic.ReplayOptions{
+		Client: &http.Client{Timeout: time.Minute},
+		Speed:  *speed,
+		Report: func(record *traffic.RecordedRequest, status int, err error) {
+			if err != nil {
+				fmt.Printf("%s %s: %v\n", record.Method, record.URL, err)
+				return
+			}
+			fmt.Printf("%s %s: %d (recorded %d)\n", record.Method, record.URL, status, record.Status)
+		},
+	}
+	if *targetOverride != "" {
+		target, err := url.Parse(*targetOverride)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			logger.Printf("Invalid target URL \"%s\"\n", *targetOverride)
+			os.Exit(2)
+		}
+		options.Target = target
+	}
+
+	failed := false
+	for _, name := range names {
+		if !replayRecording(store, name, options) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replayRecording replays one recording, and returns false if it couldn't be
+// read or any of its requests couldn't be sent. Recordings which the relay is
+// still writing, or stopped without closing, are replayed as far as they go.
+func replayRecording(store *storage.Store, name string, options traffic.ReplayOptions) bool {
+	reader, err := store.Open(name)
+	if err != nil {
+		logger.Println(err)
+		return false
+	}
+	defer reader.Close()
+
+	sent, failed, err := traffic.ReplayRecording(reader, options)
+	fmt.Printf("%s: %d request(s) sent, %d failed\n", name, sent, failed)
+	if errors.Is(err, storage.ErrUnfinished) {
+		fmt.Printf("%s: the recording is unfinished; the relay may still be writing it\n", name)
+	} else if err != nil {
+		logger.Println(err)
+		return false
+	}
+	return failed == 0
+}
+
+// checkConfig implements the --check-config option, which validates the
+// configuration file without starting the relay. Every problem found is
+// reported, grouped by section, and the process exits non-zero if there were
+// any.
+func checkConfig(configFilePath string, configFile *config.File) {
+	// Keep routine startup messages out of the report.
+	logging.Configure(&logging.Options{Level: logging.Warn})
+
+	report := configcheck.Check(configFile, plugin_loader.DefaultPlugins)
+	if report.Valid() {
+		fmt.Printf("Configuration file \"%s\" is valid\n", configFilePath)
+		os.Exit(0)
+	}
+
+	fmt.Printf("Configuration file \"%s\" has %d error(s):\n", configFilePath, len(report.Errors))
+	for _, sectionError := range report.Errors {
+		fmt.Printf("    %s\n", sectionError)
+	}
+	os.Exit(1)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		runTests(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "redrive" {
+		runRedrive(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
 	// The --config option determines the path to the configuration file. A
 	// default configuration file, 'relay.yaml', is distributed with the relay,
 	// so it's not necessary to specify one if you just want to configure the
 	// relay with environment variables. Use '-' to read the configuration file
 	// from stdin.
 	configFilePath := flag.String("config", "relay.yaml", "Configuration file path")
+	checkConfigOnly := flag.Bool("check-config", false, "Validate the configuration file and exit without starting the relay")
 	flag.Parse()
 
-	rawConfigFileBytes, err := readConfigFile(*configFilePath)
+	configFileString, err := loadConfigYaml(*configFilePath)
 	if err != nil {
-		logger.Printf(`Couldn't read configuration file "%s": %v\n`, *configFilePath, err)
+		logger.Println(err)
 		os.Exit(1)
 	}
 
-	// Substitute the values of environment variables into the configuration
-	// file. In versions of the relay prior to 0.3, configuration was performed
-	// entirely via environment variables. Environment variable substitution
-	// allows configurations based on those older environment variables to
-	// continue to work and generally increases the flexibility of the
-	// configuration file.
-	envProvider := environment.NewDefaultProvider()
-	env := environment.NewMap(envProvider)
-	configFileString := env.SubstituteVarsIntoYaml(string(rawConfigFileBytes))
-
 	// Parse the configuration file.
 	configFile, err := config.NewFileFromYamlString(configFileString)
 	if err != nil {
@@ -57,13 +399,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *checkConfigOnly {
+		checkConfig(*configFilePath, configFile)
+	}
+
+	// Set up logging first, so that everything below is logged as configured.
+	loggingOptions, err := logging.ReadOptions(configFile)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	logging.Configure(loggingOptions)
+
 	config, err := relay.ReadOptions(configFile)
 	if err != nil {
 		logger.Println(err)
 		os.Exit(1)
 	}
 
-	trafficPlugins, err := plugin_loader.Load(plugin_loader.DefaultPlugins, configFile)
+	trafficPlugins, err := loadDefaultPlugins(configFile)
 	if err != nil {
 		logger.Println(err)
 		os.Exit(1)
@@ -74,13 +428,92 @@ func main() {
 		logger.Println("\tTraffic:", tp.Name())
 	}
 
-	relayService := relay.NewService(config.Relay, trafficPlugins)
+	relayService, err := relay.NewFromConfig(config, trafficPlugins, loadDefaultPlugins)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
 	if err := relayService.Start("0.0.0.0", config.Service.Port); err != nil {
 		panic("Could not start catcher service: " + err.Error())
 	}
 	logger.Println("Relay listening on port", relayService.Port())
-	for {
-		time.Sleep(100 * time.Minute)
+
+	if config.Service.MetricsPort != 0 {
+		if err := relayService.StartMetrics("0.0.0.0", config.Service.MetricsPort); err != nil {
+			panic("Could not start metrics listener: " + err.Error())
+		}
+		logger.Println("Metrics listening on port", config.Service.MetricsPort)
+	}
+
+	if config.Service.AdminPort != 0 {
+		if err := relayService.StartAdmin("0.0.0.0", config.Service.AdminPort, configFile); err != nil {
+			panic("Could not start admin listener: " + err.Error())
+		}
+		logger.Println("Admin endpoints listening on port", config.Service.AdminPort)
+	}
+
+	// SIGHUP reloads the plugins from the configuration file; see
+	// Service.Reload. SIGINT and SIGTERM stop the relay; see shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			reloadConfig(relayService, *configFilePath)
+			continue
+		}
+		shutdown(relayService, config.Relay.Recorder)
+		os.Exit(0)
+	}
+}
+
+// shutdownTimeout is how long shutdown waits for requests in progress to
+// complete before closing their connections.
+const shutdownTimeout = 30 * time.Second
+
+// shutdown drains the relay, waits up to shutdownTimeout for the requests in
+// progress to complete, and then closes the service, so that plugins write
+// out what they've buffered, and completes the recording, if there is one.
+func shutdown(relayService *relay.Service, recorder *traffic.Recorder) {
+	relayService.Drain()
+	deadline := time.Now().Add(shutdownTimeout)
+	for len(relayService.DrainReport().Active) > 0 {
+		if time.Now().After(deadline) {
+			relayService.CloseRequestsOlderThan(0)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := relayService.Close(); err != nil {
+		logger.Errorf("Error closing relay: %v", err)
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			logger.Errorf("Error closing recording: %v", err)
+		}
+	}
+}
+
+// reloadConfig reads the configuration file again and reloads the relay's
+// plugins from it. If that fails, the relay keeps running as it was.
+func reloadConfig(relayService *relay.Service, configFilePath string) {
+	if configFilePath == "-" {
+		logger.Println("Can't reload a configuration file read from stdin")
+		return
+	}
+	logger.Printf("Reloading configuration file %v\n", configFilePath)
+	configFileString, err := loadConfigYaml(configFilePath)
+	if err != nil {
+		logger.Errorf("Error reloading configuration: %v", err)
+		return
+	}
+	configFile, err := config.NewFileFromYamlString(configFileString)
+	if err != nil {
+		logger.Errorf("Error reloading configuration: %v", err)
+		return
+	}
+	if _, err := relayService.Reload(configFile, loadDefaultPlugins); err != nil {
+		logger.Errorf("Error reloading configuration: %v", err)
 	}
 }
 
@@ -0,0 +1,346 @@
+// Package metrics collects operational metrics for the relay and exposes them
+// in the Prometheus text format.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sizeBuckets are the histogram buckets used for body sizes, from 256 bytes to
+// 16MiB.
+var sizeBuckets = prometheus.ExponentialBuckets(256, 4, 9)
+
+// Registry holds the relay's metrics. Each relay service has its own Registry,
+// so multiple services can coexist in the same process (as they do in tests).
+type Registry struct {
+	registry *prometheus.Registry
+
+	pluginRequests       *prometheus.CounterVec
+	pluginServiced       *prometheus.CounterVec
+	pluginBodiesModified *prometheus.CounterVec
+	pluginBytesRedacted  *prometheus.CounterVec
+	pluginErrors         *prometheus.CounterVec
+
+	upstreamLatency  prometheus.Histogram
+	requestBodySize  prometheus.Histogram
+	responseBodySize prometheus.Histogram
+
+	mirrorRequests         *prometheus.CounterVec
+	mirrorComparisons      *prometheus.CounterVec
+	mirrorMismatches       *prometheus.CounterVec
+	malformedRequestBodies *prometheus.CounterVec
+	deadLetters            *prometheus.CounterVec
+
+	syntheticChecks       *prometheus.CounterVec
+	syntheticCheckPassing prometheus.Gauge
+	syntheticCheckLatency prometheus.Histogram
+
+	websocketSessions       *prometheus.CounterVec
+	websocketSessionsActive prometheus.Gauge
+}
+
+func NewRegistry() *Registry {
+	pluginCounter := func(name string, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Subsystem: "plugin",
+			Name:      name,
+			Help:      help,
+		}, []string{"plugin"})
+	}
+
+	registry := &Registry{
+		registry: prometheus.NewRegistry(),
+
+		pluginRequests:       pluginCounter("requests_total", "Requests passed to the plugin."),
+		pluginServiced:       pluginCounter("requests_serviced_total", "Requests the plugin responded to itself."),
+		pluginBodiesModified: pluginCounter("bodies_modified_total", "Request or response bodies modified by the plugin."),
+		pluginBytesRedacted:  pluginCounter("bytes_redacted_total", "Bytes of content removed or masked by the plugin."),
+		pluginErrors:         pluginCounter("errors_total", "Errors encountered by the plugin."),
+
+		upstreamLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "relay",
+			Name:      "upstream_latency_seconds",
+			Help:      "Time from sending a request to the target until its response headers are received.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		requestBodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "relay",
+			Name:      "request_body_size_bytes",
+			Help:      "Size of request bodies received from clients, as sent on the wire.",
+			Buckets:   sizeBuckets,
+		}),
+		responseBodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "relay",
+			Name:      "response_body_size_bytes",
+			Help:      "Size of response bodies relayed to clients.",
+			Buckets:   sizeBuckets,
+		}),
+
+		mirrorRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "mirror_requests_total",
+			Help:      "Requests copied to the mirror target, by result: sent, failed, or dropped because the queue was full.",
+		}, []string{"result"}),
+		mirrorComparisons: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "mirror_comparisons_total",
+			Help:      "Comparisons of the target's and mirror target's responses, by result: match, mismatch, or skipped if either response was unavailable.",
+		}, []string{"result"}),
+		mirrorMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "mirror_mismatches_total",
+			Help:      "Differences between the target's and mirror target's responses, by what differed: status, header, or body.",
+		}, []string{"field"}),
+		malformedRequestBodies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "malformed_request_bodies_total",
+			Help:      "Request bodies which couldn't be decoded using their Content-Encoding, by encoding.",
+		}, []string{"encoding"}),
+		deadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "dead_letters_total",
+			Help:      "Requests which couldn't be delivered to the target, by where they were captured: stored, webhook, or failed if capturing them failed too.",
+		}, []string{"result"}),
+
+		syntheticChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "synthetic_checks_total",
+			Help:      "Synthetic checks of the target, by result: passed or failed.",
+		}, []string{"result"}),
+		syntheticCheckPassing: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "relay",
+			Name:      "synthetic_check_passing",
+			Help:      "1 if the most recent synthetic check of the target passed, and 0 otherwise.",
+		}),
+		syntheticCheckLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "relay",
+			Name:      "synthetic_check_latency_seconds",
+			Help:      "Time taken by synthetic checks of the target, including reading the response body.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+
+		websocketSessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "websocket_sessions_total",
+			Help:      "Relayed websocket connections which have ended, by result: closed, or timed-out if a deadline was exceeded.",
+		}, []string{"result"}),
+		websocketSessionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "relay",
+			Name:      "websocket_sessions_active",
+			Help:      "Websocket connections currently being relayed.",
+		}),
+	}
+
+	registry.registry.MustRegister(
+		registry.pluginRequests,
+		registry.pluginServiced,
+		registry.pluginBodiesModified,
+		registry.pluginBytesRedacted,
+		registry.pluginErrors,
+		registry.upstreamLatency,
+		registry.requestBodySize,
+		registry.responseBodySize,
+		registry.mirrorRequests,
+		registry.mirrorComparisons,
+		registry.mirrorMismatches,
+		registry.malformedRequestBodies,
+		registry.deadLetters,
+		registry.syntheticChecks,
+		registry.syntheticCheckPassing,
+		registry.syntheticCheckLatency,
+		registry.websocketSessions,
+		registry.websocketSessionsActive,
+	)
+
+	return registry
+}
+
+// Handler returns an HTTP handler which serves the metrics in the Prometheus
+// text format.
+func (registry *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(registry.registry, promhttp.HandlerOpts{})
+}
+
+// Value returns the current value of the metric with the provided name, like
+// "relay_plugin_bytes_redacted_total", and labels. Counters and gauges report
+// their value, and histograms the number of observations. Metrics which
+// haven't been recorded yet are reported as zero.
+func (registry *Registry) Value(name string, labels map[string]string) (float64, error) {
+	families, err := registry.registry.Gather()
+	if err != nil {
+		return 0, err
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.Counter.GetValue(), nil
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue(), nil
+			case metric.Histogram != nil:
+				return float64(metric.Histogram.GetSampleCount()), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+// Plugin returns the metrics for the named plugin.
+func (registry *Registry) Plugin(name string) *PluginMetrics {
+	return &PluginMetrics{
+		requests:       registry.pluginRequests.WithLabelValues(name),
+		serviced:       registry.pluginServiced.WithLabelValues(name),
+		bodiesModified: registry.pluginBodiesModified.WithLabelValues(name),
+		bytesRedacted:  registry.pluginBytesRedacted.WithLabelValues(name),
+		errors:         registry.pluginErrors.WithLabelValues(name),
+		registry:       registry,
+	}
+}
+
+// ObserveUpstreamLatency records how long the target took to respond.
+func (registry *Registry) ObserveUpstreamLatency(latency time.Duration) {
+	registry.upstreamLatency.Observe(latency.Seconds())
+}
+
+// ObserveRequestBodySize records the size of a request body.
+func (registry *Registry) ObserveRequestBodySize(size int64) {
+	registry.requestBodySize.Observe(float64(size))
+}
+
+// ObserveResponseBodySize records the size of a response body.
+func (registry *Registry) ObserveResponseBodySize(size int64) {
+	registry.responseBodySize.Observe(float64(size))
+}
+
+// MirrorRequest records the result of copying a request to the mirror target:
+// "sent", "failed", or "dropped".
+func (registry *Registry) MirrorRequest(result string) {
+	registry.mirrorRequests.WithLabelValues(result).Inc()
+}
+
+// MirrorComparison records the result of comparing the target's response to a
+// request with the mirror target's: "match", "mismatch", or "skipped".
+func (registry *Registry) MirrorComparison(result string) {
+	registry.mirrorComparisons.WithLabelValues(result).Inc()
+}
+
+// MirrorMismatch records a difference between the target's and the mirror
+// target's responses: in their "status", a compared "header", or their "body".
+func (registry *Registry) MirrorMismatch(field string) {
+	registry.mirrorMismatches.WithLabelValues(field).Inc()
+}
+
+// DeadLetter records the result of capturing a request which couldn't be
+// delivered to the target: "stored", "webhook", or "failed".
+func (registry *Registry) DeadLetter(result string) {
+	registry.deadLetters.WithLabelValues(result).Inc()
+}
+
+// MalformedRequestBody records a request body which couldn't be decoded using
+// the named Content-Encoding.
+func (registry *Registry) MalformedRequestBody(encoding string) {
+	registry.malformedRequestBodies.WithLabelValues(encoding).Inc()
+}
+
+// WebsocketSessionOpened records the start of a relayed websocket connection.
+func (registry *Registry) WebsocketSessionOpened() {
+	registry.websocketSessionsActive.Inc()
+}
+
+// WebsocketSessionClosed records the end of a relayed websocket connection:
+// "closed", or "timed-out".
+func (registry *Registry) WebsocketSessionClosed(result string) {
+	registry.websocketSessionsActive.Dec()
+	registry.websocketSessions.WithLabelValues(result).Inc()
+}
+
+// PluginMetrics records metrics for a single plugin. The relay counts the
+// requests passed to each plugin automatically; plugins report the remaining
+// metrics themselves.
+//
+// All methods are safe to call on a nil PluginMetrics, so plugins don't need
+// to check whether metrics have been configured.
+type PluginMetrics struct {
+	requests       prometheus.Counter
+	serviced       prometheus.Counter
+	bodiesModified prometheus.Counter
+	bytesRedacted  prometheus.Counter
+	errors         prometheus.Counter
+	registry       *Registry
+}
+
+// RequestHandled records that a request was passed to the plugin, and whether
+// the plugin serviced it.
+func (metrics *PluginMetrics) RequestHandled(serviced bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.requests.Inc()
+	if serviced {
+		metrics.serviced.Inc()
+	}
+}
+
+// BodyModified records that the plugin modified a request or response body.
+func (metrics *PluginMetrics) BodyModified() {
+	if metrics == nil {
+		return
+	}
+	metrics.bodiesModified.Inc()
+}
+
+// BytesRedacted records that the plugin removed or masked some content.
+func (metrics *PluginMetrics) BytesRedacted(count int) {
+	if metrics == nil || count <= 0 {
+		return
+	}
+	metrics.bytesRedacted.Add(float64(count))
+}
+
+// Error records that the plugin encountered an error.
+func (metrics *PluginMetrics) Error() {
+	if metrics == nil {
+		return
+	}
+	metrics.errors.Inc()
+}
+
+// SyntheticCheck records the result of a synthetic check of the target, and
+// how long it took.
+func (metrics *PluginMetrics) SyntheticCheck(passed bool, latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+	result, passing := "failed", 0.0
+	if passed {
+		result, passing = "passed", 1.0
+	}
+	metrics.registry.syntheticChecks.WithLabelValues(result).Inc()
+	metrics.registry.syntheticCheckPassing.Set(passing)
+	metrics.registry.syntheticCheckLatency.Observe(latency.Seconds())
+}
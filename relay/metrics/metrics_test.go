@@ -0,0 +1,104 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/metrics"
+)
+
+func scrape(t *testing.T, registry *metrics.Registry) string {
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatalf("Error reading metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	plugin := registry.Plugin("example")
+	plugin.RequestHandled(false)
+	plugin.RequestHandled(true)
+	plugin.BodyModified()
+	plugin.BytesRedacted(12)
+	plugin.Error()
+	plugin.SyntheticCheck(true, time.Second)
+	registry.ObserveUpstreamLatency(50 * time.Millisecond)
+	registry.ObserveRequestBodySize(1000)
+	registry.ObserveResponseBodySize(2000)
+	registry.MirrorRequest("dropped")
+	registry.MalformedRequestBody("gzip")
+	registry.DeadLetter("stored")
+	registry.WebsocketSessionOpened()
+	registry.WebsocketSessionOpened()
+	registry.WebsocketSessionClosed("timed-out")
+
+	output := scrape(t, registry)
+	for _, expected := range []string{
+		`relay_plugin_requests_total{plugin="example"} 2`,
+		`relay_plugin_requests_serviced_total{plugin="example"} 1`,
+		`relay_plugin_bodies_modified_total{plugin="example"} 1`,
+		`relay_plugin_bytes_redacted_total{plugin="example"} 12`,
+		`relay_plugin_errors_total{plugin="example"} 1`,
+		`relay_upstream_latency_seconds_count 1`,
+		`relay_request_body_size_bytes_sum 1000`,
+		`relay_response_body_size_bytes_sum 2000`,
+		`relay_mirror_requests_total{result="dropped"} 1`,
+		`relay_malformed_request_bodies_total{encoding="gzip"} 1`,
+		`relay_dead_letters_total{result="stored"} 1`,
+		`relay_websocket_sessions_active 1`,
+		`relay_websocket_sessions_total{result="timed-out"} 1`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected metrics output to contain %q:\n%s", expected, output)
+		}
+	}
+}
+
+func TestNilPluginMetrics(t *testing.T) {
+	// Plugins used without a relay (as in some unit tests) have no metrics.
+	var plugin *metrics.PluginMetrics
+	plugin.RequestHandled(true)
+	plugin.BodyModified()
+	plugin.BytesRedacted(1)
+	plugin.Error()
+	plugin.SyntheticCheck(true, time.Second)
+}
+
+func TestRegistryValue(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Plugin("first").BytesRedacted(5)
+	registry.Plugin("first").BytesRedacted(3)
+	registry.Plugin("second").BytesRedacted(1)
+	registry.ObserveUpstreamLatency(time.Second)
+	registry.ObserveUpstreamLatency(time.Second)
+
+	testCases := []struct {
+		desc     string
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"Counters report their value", "relay_plugin_bytes_redacted_total", map[string]string{"plugin": "first"}, 8},
+		{"Labels select the metric", "relay_plugin_bytes_redacted_total", map[string]string{"plugin": "second"}, 1},
+		{"Histograms report their count", "relay_upstream_latency_seconds", nil, 2},
+		{"Unrecorded labels are zero", "relay_plugin_bytes_redacted_total", map[string]string{"plugin": "third"}, 0},
+		{"Unknown metrics are zero", "relay_unknown_total", nil, 0},
+	}
+
+	for _, testCase := range testCases {
+		value, err := registry.Value(testCase.name, testCase.labels)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading value: %v", testCase.desc, err)
+		} else if value != testCase.expected {
+			t.Errorf("Test '%v': Expected %v but got %v", testCase.desc, testCase.expected, value)
+		}
+	}
+}
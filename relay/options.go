@@ -2,21 +2,37 @@ package relay
 
 import (
 	"fmt"
+	"net/netip"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/journal"
+	"github.com/immersa-co/relay-core/relay/s3"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/tracing"
 	"github.com/immersa-co/relay-core/relay/traffic"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type Options struct {
 	Service *ServiceOptions
 	Relay   *traffic.RelayOptions
+
+	// The configuration file from which the options were read, if any. A
+	// Service created from the options diffs it against the configuration
+	// it's reloaded with; see Service.Reload.
+	ConfigFile *config.File
 }
 
 func ReadOptions(configFile *config.File) (*Options, error) {
 	options := &Options{
-		Service: NewDefaultServiceOptions(),
-		Relay:   traffic.NewDefaultRelayOptions(),
+		Service:    NewDefaultServiceOptions(),
+		Relay:      traffic.NewDefaultRelayOptions(),
+		ConfigFile: configFile,
 	}
 
 	configSection, err := configFile.LookupRequiredSection("relay")
@@ -31,6 +47,62 @@ func ReadOptions(configFile *config.File) (*Options, error) {
 		options.Service.Port = port
 	}
 
+	if metricsPort, err := config.LookupOptional[int](configSection, "metrics-port"); err != nil {
+		return nil, err
+	} else if metricsPort != nil {
+		logger.Printf("Metrics port: %v\n", *metricsPort)
+		options.Service.MetricsPort = *metricsPort
+	}
+
+	if adminPort, err := config.LookupOptional[int](configSection, "admin-port"); err != nil {
+		return nil, err
+	} else if adminPort != nil {
+		logger.Printf("Admin port: %v\n", *adminPort)
+		options.Service.AdminPort = *adminPort
+	}
+
+	for _, option := range []struct {
+		key    string
+		target *int
+	}{
+		{"max-concurrent-requests", &options.Service.MaxConcurrentRequests},
+		{"max-header-bytes", &options.Service.MaxHeaderBytes},
+	} {
+		if value, err := config.LookupOptional[int](configSection, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 0 {
+				return nil, fmt.Errorf(`Invalid value for configuration option "%v": must not be negative`, option.key)
+			}
+			logger.Printf("%v: %v\n", option.key, *value)
+			*option.target = *value
+		}
+	}
+
+	if readOnly, err := config.LookupOptional[bool](configSection, "read-only"); err != nil {
+		return nil, err
+	} else if readOnly != nil {
+		options.Service.ReadOnly = *readOnly
+	}
+
+	if tlsOptions, err := readTLSOptions(configSection, configFile); err != nil {
+		return nil, err
+	} else {
+		options.Service.TLS = tlsOptions
+	}
+
+	if hosts, err := readVirtualHosts(configSection, configFile); err != nil {
+		return nil, err
+	} else {
+		options.Service.Hosts = hosts
+	}
+
+	if tlsOptions, err := addVirtualHostCertificates(options.Service.TLS, options.Service.Hosts); err != nil {
+		return nil, err
+	} else {
+		options.Service.TLS = tlsOptions
+	}
+
 	if err := config.ParseRequired(configSection, "target", func(key, value string) error {
 		logger.Printf("Target: %v\n", value)
 		if targetURL, err := url.Parse(value); err != nil {
@@ -46,6 +118,136 @@ func ReadOptions(configFile *config.File) (*Options, error) {
 		return nil, err
 	}
 
+	if err := config.ParseOptional(configSection, "mirror-target", func(key, value string) error {
+		logger.Printf("Mirror target: %v\n", value)
+		if mirrorURL, err := url.Parse(value); err != nil {
+			return err
+		} else if mirrorURL.Scheme == "" || mirrorURL.Host == "" {
+			return fmt.Errorf("Invalid or relative mirror target URL")
+		} else {
+			options.Relay.Mirror.TargetScheme = mirrorURL.Scheme
+			options.Relay.Mirror.TargetHost = mirrorURL.Host
+			return nil
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	if queueSize, err := config.LookupOptional[int](configSection, "mirror-queue-size"); err != nil {
+		return nil, err
+	} else if queueSize != nil {
+		if *queueSize < 1 {
+			return nil, fmt.Errorf(`Invalid value for configuration option "mirror-queue-size": must be at least 1`)
+		}
+		options.Relay.Mirror.QueueSize = *queueSize
+	}
+
+	if compare, err := config.LookupOptional[bool](configSection, "mirror-compare"); err != nil {
+		return nil, err
+	} else if compare != nil && *compare {
+		if options.Relay.Mirror.TargetScheme == "" {
+			return nil, fmt.Errorf(`Configuration option "mirror-compare" requires "mirror-target"`)
+		}
+		options.Relay.Mirror.Compare = true
+	}
+
+	if headers, err := config.LookupOptional[[]string](configSection, "mirror-compare-headers"); err != nil {
+		return nil, err
+	} else if headers != nil && len(*headers) > 0 {
+		if !options.Relay.Mirror.Compare {
+			return nil, fmt.Errorf(`Configuration option "mirror-compare-headers" requires "mirror-compare"`)
+		}
+		options.Relay.Mirror.CompareHeaders = *headers
+	}
+
+	if targetTLS, err := readTargetTLSConfig(configSection); err != nil {
+		return nil, err
+	} else {
+		options.Relay.TargetTLS = targetTLS
+	}
+
+	if targetHTTP2, err := config.LookupOptional[bool](configSection, "target-http2"); err != nil {
+		return nil, err
+	} else if targetHTTP2 != nil {
+		logger.Printf("Target HTTP/2: %v\n", *targetHTTP2)
+		options.Relay.TargetHTTP2 = *targetHTTP2
+	}
+
+	if bridgePath, err := config.LookupOptional[string](configSection, "websocket-bridge-path"); err != nil {
+		return nil, err
+	} else if bridgePath != nil {
+		if !strings.HasPrefix(*bridgePath, "/") {
+			return nil, fmt.Errorf(`Invalid value for configuration option "websocket-bridge-path": must start with '/'`)
+		}
+		logger.Printf("Websocket bridge path: %v\n", *bridgePath)
+		options.Relay.WebsocketBridge.Path = *bridgePath
+	}
+
+	for _, option := range []struct {
+		key    string
+		target *time.Duration
+	}{
+		{"websocket-idle-timeout", &options.Relay.Websocket.IdleTimeout},
+		{"websocket-write-timeout", &options.Relay.Websocket.WriteTimeout},
+		{"websocket-ping-interval", &options.Relay.Websocket.PingInterval},
+	} {
+		if value, err := config.LookupOptional[time.Duration](configSection, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 0 {
+				return nil, fmt.Errorf(`Invalid value for configuration option "%v": must not be negative`, option.key)
+			}
+			logger.Printf("%v: %v\n", option.key, *value)
+			*option.target = *value
+		}
+	}
+	if websocket := options.Relay.Websocket; websocket.PingInterval > 0 && websocket.IdleTimeout > 0 &&
+		websocket.PingInterval >= websocket.IdleTimeout {
+		return nil, fmt.Errorf(`Configuration option "websocket-ping-interval" must be shorter than "websocket-idle-timeout"`)
+	}
+
+	if dryRun, err := config.LookupOptional[bool](configSection, "dry-run"); err != nil {
+		return nil, err
+	} else if dryRun != nil && *dryRun {
+		logger.Printf("Dry run: requests will be previewed rather than relayed\n")
+		options.Relay.DryRun = true
+	}
+
+	if debugHeaders, err := config.LookupOptional[bool](configSection, "debug-headers"); err != nil {
+		return nil, err
+	} else if debugHeaders != nil && *debugHeaders {
+		logger.Printf("Debug headers: added to every response\n")
+		options.Relay.DebugHeaders = true
+	}
+
+	if err := config.ParseOptional(configSection, "debug-networks", func(key string, networks []string) error {
+		for _, network := range networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return fmt.Errorf(`Invalid network "%v" in configuration option "debug-networks": %v`, network, err)
+			}
+			options.Relay.DebugNetworks = append(options.Relay.DebugNetworks, prefix.Masked())
+		}
+		logger.Printf("Debug headers: available on request to %v\n", networks)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "trusted-proxies", func(key string, networks []string) error {
+		for _, network := range networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return fmt.Errorf(`Invalid network "%v" in configuration option "trusted-proxies": %v`, network, err)
+			}
+			options.Relay.TrustedProxies = append(options.Relay.TrustedProxies, prefix.Masked())
+		}
+		logger.Printf("Trusted proxies: %v\n", networks)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
 	if maxBodySize, err := config.LookupOptional[int64](configSection, "max-body-size"); err != nil {
 		return nil, err
 	} else if maxBodySize != nil {
@@ -53,5 +255,494 @@ func ReadOptions(configFile *config.File) (*Options, error) {
 		options.Relay.MaxBodySize = *maxBodySize
 	}
 
+	if spoolThreshold, err := config.LookupOptional[int64](configSection, "spool-threshold"); err != nil {
+		return nil, err
+	} else if spoolThreshold != nil {
+		if *spoolThreshold <= 0 || *spoolThreshold >= options.Relay.MaxBodySize {
+			return nil, fmt.Errorf(`Invalid value for configuration option "spool-threshold": must be positive and less than "max-body-size"`)
+		}
+		logger.Printf("Request bodies larger than %v bytes are spooled to disk\n", *spoolThreshold)
+		options.Relay.SpoolThreshold = *spoolThreshold
+	}
+
+	if err := config.ParseOptional(configSection, "spool-dir", func(key, dir string) error {
+		if info, err := os.Stat(dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf(`Spool directory "%v" is not a directory`, dir)
+		}
+		options.Relay.SpoolDir = dir
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if options.Relay.SpoolEncryptionKey, err = storage.ReadKey(configSection, "spool-encryption-key"); err != nil {
+		return nil, err
+	}
+
+	if spoolMaxAge, err := config.LookupOptional[time.Duration](configSection, "spool-max-age"); err != nil {
+		return nil, err
+	} else if spoolMaxAge != nil {
+		if *spoolMaxAge <= 0 {
+			return nil, fmt.Errorf(`Invalid value for configuration option "spool-max-age": must be positive`)
+		}
+		options.Relay.SpoolMaxAge = *spoolMaxAge
+	}
+
+	if maxResponseSize, err := config.LookupOptional[int64](configSection, "max-response-size"); err != nil {
+		return nil, err
+	} else if maxResponseSize != nil {
+		if *maxResponseSize < 0 {
+			return nil, fmt.Errorf(`Invalid value for configuration option "max-response-size": must not be negative`)
+		}
+		logger.Printf("Maximum response size: %v\n", *maxResponseSize)
+		options.Relay.MaxResponseSize = *maxResponseSize
+	}
+
+	if truncate, err := config.LookupOptional[bool](configSection, "truncate-oversized-responses"); err != nil {
+		return nil, err
+	} else if truncate != nil {
+		logger.Printf("Truncate oversized responses: %v\n", *truncate)
+		options.Relay.TruncateOversizedResponses = *truncate
+	}
+
+	if inspectPartial, err := config.LookupOptional[bool](configSection, "inspect-partial-responses"); err != nil {
+		return nil, err
+	} else if inspectPartial != nil {
+		logger.Printf("Inspect partial responses: %v\n", *inspectPartial)
+		options.Relay.InspectPartialResponses = *inspectPartial
+	}
+
+	if accessLog, err := config.LookupOptional[bool](configSection, "access-log"); err != nil {
+		return nil, err
+	} else if accessLog != nil && *accessLog {
+		logger.Printf("Access log: enabled\n")
+		options.Relay.AccessLog = os.Stdout
+	}
+
+	if journalSize, err := config.LookupOptional[int](configSection, "journal-size"); err != nil {
+		return nil, err
+	} else if journalSize != nil && *journalSize > 0 {
+		journalDir, err := config.LookupOptional[string](configSection, "journal-dir")
+		if err != nil {
+			return nil, err
+		}
+		dumpDir := ""
+		if journalDir != nil {
+			dumpDir = *journalDir
+		}
+		logger.Printf("Request journal: last %v requests\n", *journalSize)
+		options.Relay.Journal = journal.New(*journalSize, dumpDir)
+	}
+
+	if err := config.ParseOptional(configSection, "duplicate-header-policy", func(key, value string) error {
+		policy, err := traffic.ParseDuplicateHeaderPolicy(value)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Duplicate header policy: %v\n", policy)
+		options.Relay.DuplicateHeaders = policy
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "malformed-body-policy", func(key, value string) error {
+		policy, err := traffic.ParseMalformedBodyPolicy(value)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Malformed body policy: %v\n", policy)
+		options.Relay.MalformedBodies = policy
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "ip-family-preference", func(key, value string) error {
+		preference, err := traffic.ParseIPFamilyPreference(value)
+		if err != nil {
+			return err
+		}
+		logger.Printf("IP family preference: %v\n", preference)
+		options.Relay.Dial.Preference = preference
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, option := range []struct {
+		key    string
+		target *time.Duration
+	}{
+		{"dial-fallback-delay", &options.Relay.Dial.FallbackDelay},
+		{"ipv4-dial-timeout", &options.Relay.Dial.IPv4Timeout},
+		{"ipv6-dial-timeout", &options.Relay.Dial.IPv6Timeout},
+		{"dns-cache-ttl", &options.Relay.Dial.DNSCacheTTL},
+	} {
+		if value, err := config.LookupOptional[time.Duration](configSection, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			logger.Printf("%v: %v\n", option.key, *value)
+			*option.target = *value
+		}
+	}
+
+	if err := config.ParseOptional(configSection, "dns-servers", func(key string, servers []string) error {
+		for _, server := range servers {
+			address, err := traffic.ParseDNSServer(server)
+			if err != nil {
+				return err
+			}
+			options.Relay.Dial.DNSServers = append(options.Relay.Dial.DNSServers, address)
+		}
+		logger.Printf("DNS servers: %v\n", options.Relay.Dial.DNSServers)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if retries, err := readRetryOptions(configSection); err != nil {
+		return nil, err
+	} else {
+		options.Relay.Retries = retries
+	}
+
+	if upstreamProxy, err := readUpstreamOptions(configSection); err != nil {
+		return nil, err
+	} else {
+		options.Relay.UpstreamProxy = upstreamProxy
+	}
+
+	if s3Tier, err := readS3SpoolOptions(configFile, options.Relay); err != nil {
+		return nil, err
+	} else if s3Tier != nil {
+		options.Relay.BodyStores = append(options.Relay.BodyStores, *s3Tier)
+	}
+
+	if tracerProvider, err := readTracingOptions(configSection); err != nil {
+		return nil, err
+	} else if tracerProvider != nil {
+		options.Relay.TracerProvider = tracerProvider
+	}
+
+	if deadLetters, err := readDeadLetterOptions(configFile); err != nil {
+		return nil, err
+	} else {
+		options.Relay.DeadLetters = deadLetters
+	}
+
+	if audit, err := readAuditOptions(configFile); err != nil {
+		return nil, err
+	} else {
+		options.Relay.Audit = audit
+	}
+
+	if recorder, err := readRecordingOptions(configFile); err != nil {
+		return nil, err
+	} else {
+		options.Relay.Recorder = recorder
+	}
+
+	return options, nil
+}
+
+// retriesConfig is the YAML structure of the 'retries' option.
+type retriesConfig struct {
+	MaxAttempts    int           `yaml:"max-attempts"`
+	InitialBackoff time.Duration `yaml:"initial-backoff"`
+	MaxBackoff     time.Duration `yaml:"max-backoff"`
+	MaxElapsed     time.Duration `yaml:"max-elapsed"`
+}
+
+// readRetryOptions reads the 'retries' option from the relay section. Retries
+// are disabled unless 'max-attempts' is greater than one.
+func readRetryOptions(configSection *config.Section) (traffic.RetryOptions, error) {
+	value, err := config.LookupOptional[retriesConfig](configSection, "retries")
+	if err != nil || value == nil {
+		return traffic.RetryOptions{}, err
+	}
+	if value.MaxAttempts < 0 || value.InitialBackoff < 0 || value.MaxBackoff < 0 || value.MaxElapsed < 0 {
+		return traffic.RetryOptions{}, fmt.Errorf(`Invalid value for configuration option "retries": values must not be negative`)
+	}
+	if value.InitialBackoff > 0 && value.MaxBackoff > 0 && value.InitialBackoff > value.MaxBackoff {
+		return traffic.RetryOptions{}, fmt.Errorf(`Retry option "initial-backoff" must not exceed "max-backoff"`)
+	}
+
+	retries := traffic.RetryOptions(*value)
+	if retries.MaxAttempts > 1 {
+		logger.Printf("Retries: up to %v attempts\n", retries.MaxAttempts)
+	}
+	return retries, nil
+}
+
+// upstreamConfig is the YAML structure of the 'upstream' option.
+type upstreamConfig struct {
+	ProxyURL string `yaml:"proxy-url"`
+}
+
+// readUpstreamOptions reads the 'upstream' option from the relay section,
+// returning the proxy to connect to the target through, if any.
+func readUpstreamOptions(configSection *config.Section) (*url.URL, error) {
+	value, err := config.LookupOptional[upstreamConfig](configSection, "upstream")
+	if err != nil || value == nil || value.ProxyURL == "" {
+		return nil, err
+	}
+	proxyURL, err := traffic.ParseUpstreamProxy(value.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf(`Invalid value for upstream option "proxy-url": %w`, err)
+	}
+	logger.Printf("Upstream proxy: %v\n", proxyURL.Redacted())
+	return proxyURL, nil
+}
+
+// tracingConfig is the YAML structure of the 'tracing' option.
+type tracingConfig struct {
+	Exporter    string   `yaml:"exporter"`
+	Endpoint    string   `yaml:"endpoint"`
+	Insecure    bool     `yaml:"insecure"`
+	SampleRatio *float64 `yaml:"sample-ratio"`
+	ServiceName string   `yaml:"service-name"`
+}
+
+// readTracingOptions reads the 'tracing' option from the relay section and
+// returns a provider which exports spans as configured. Tracing is disabled
+// unless 'exporter' is set.
+func readTracingOptions(configSection *config.Section) (*sdktrace.TracerProvider, error) {
+	value, err := config.LookupOptional[tracingConfig](configSection, "tracing")
+	if err != nil || value == nil || value.Exporter == "" {
+		return nil, err
+	}
+	exporter, err := tracing.ParseExporter(value.Exporter)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &tracing.Options{
+		Exporter:    exporter,
+		Endpoint:    value.Endpoint,
+		Insecure:    value.Insecure,
+		SampleRatio: 1,
+		ServiceName: value.ServiceName,
+	}
+	if value.SampleRatio != nil {
+		if *value.SampleRatio < 0 || *value.SampleRatio > 1 {
+			return nil, fmt.Errorf(`Tracing option "sample-ratio" must be between 0 and 1`)
+		}
+		options.SampleRatio = *value.SampleRatio
+	}
+
+	provider, err := tracing.NewTracerProvider(options)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Tracing: exported using %v, sampling %v of requests\n", exporter, options.SampleRatio)
+	return provider, nil
+}
+
+// readS3SpoolOptions reads the top-level 's3-spool' section, which configures
+// an S3 bucket for request bodies larger than 'threshold'. It's disabled unless
+// 'bucket' is set.
+func readS3SpoolOptions(configFile *config.File, relayOptions *traffic.RelayOptions) (*traffic.BodyStoreTier, error) {
+	section := configFile.LookupOptionalSection("s3-spool")
+	if section == nil {
+		return nil, nil
+	}
+	bucket, err := config.LookupOptional[string](section, "bucket")
+	if err != nil || bucket == nil || *bucket == "" {
+		return nil, err
+	}
+
+	threshold, err := config.LookupRequired[int64](section, "threshold")
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= relayOptions.SpoolThreshold || threshold >= relayOptions.MaxBodySize {
+		return nil, fmt.Errorf(`S3 spool option "threshold" must be greater than "spool-threshold" and less than "max-body-size"`)
+	}
+
+	options := &s3.Options{Bucket: *bucket}
+	if options.Region, err = config.LookupRequired[string](section, "region"); err != nil {
+		return nil, err
+	}
+	if err := config.ParseOptional(section, "endpoint", func(key string, value string) error {
+		if endpoint, err := url.Parse(value); err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return fmt.Errorf(`Invalid URL "%v" in S3 spool option "endpoint"`, value)
+		}
+		options.Endpoint = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if prefix, err := config.LookupOptional[string](section, "prefix"); err != nil {
+		return nil, err
+	} else if prefix != nil {
+		options.Prefix = *prefix
+	}
+	if partSize, err := config.LookupOptional[int64](section, "part-size"); err != nil {
+		return nil, err
+	} else if partSize != nil {
+		if *partSize < s3.MinPartSize {
+			return nil, fmt.Errorf(`S3 spool option "part-size" must be at least %v`, s3.MinPartSize)
+		}
+		options.PartSize = *partSize
+	}
+
+	for _, secret := range []struct {
+		key      string
+		target   **secrets.Secret
+		required bool
+	}{
+		{"access-key-id", &options.AccessKeyID, true},
+		{"secret-access-key", &options.SecretAccessKey, true},
+		{"session-token", &options.SessionToken, false},
+	} {
+		value, err := secrets.Lookup(section, secret.key)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil && secret.required {
+			return nil, fmt.Errorf(`Missing required configuration option "%v" in section "%v"`, secret.key, section.Name)
+		}
+		*secret.target = value
+	}
+
+	if relayOptions.SpoolThreshold == 0 {
+		logger.Printf("Request bodies are buffered before plugins run\n")
+	}
+	logger.Printf("Request bodies larger than %v bytes are spooled to S3 bucket %v\n", threshold, *bucket)
+	return &traffic.BodyStoreTier{Threshold: threshold, Store: s3.NewBodyStore(options)}, nil
+}
+
+// readDeadLetterOptions reads the top-level 'dead-letter' section. It holds
+// storage options, which are used if 'directory' is set, along with 'webhook'
+// and 'redact-headers'. Dead letters aren't captured unless a directory or
+// webhook is configured.
+func readDeadLetterOptions(configFile *config.File) (*traffic.DeadLetterOptions, error) {
+	section := configFile.LookupOptionalSection("dead-letter")
+	if section == nil {
+		return nil, nil
+	}
+	options := &traffic.DeadLetterOptions{}
+
+	if directory, err := config.LookupOptional[string](section, "directory"); err != nil {
+		return nil, err
+	} else if directory != nil && *directory != "" {
+		storageOptions, err := storage.ReadOptions(section)
+		if err != nil {
+			return nil, err
+		}
+		if options.Store, err = storage.NewStore(storageOptions); err != nil {
+			return nil, err
+		}
+		options.Store.StartCleanup(time.Hour)
+		logger.Printf("Dead letters: stored in %v\n", *directory)
+	}
+
+	if err := config.ParseOptional(section, "webhook", func(key string, value string) error {
+		if webhookURL, err := url.Parse(value); err != nil || webhookURL.Scheme == "" || webhookURL.Host == "" {
+			return fmt.Errorf(`Invalid URL "%v" in dead letter option "webhook"`, value)
+		}
+		logger.Printf("Dead letters: sent to %v\n", value)
+		options.WebhookURL = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(section, "redact-headers", func(key string, value []string) error {
+		options.RedactHeaders = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if options.Store == nil && options.WebhookURL == "" {
+		return nil, nil
+	}
 	return options, nil
 }
+
+// readAuditOptions reads the top-level 'audit' section, which holds storage
+// options along with 'flush-interval'. The audit log is disabled unless
+// 'directory' is set.
+func readAuditOptions(configFile *config.File) (*traffic.AuditOptions, error) {
+	section := configFile.LookupOptionalSection("audit")
+	if section == nil {
+		return nil, nil
+	}
+	if directory, err := config.LookupOptional[string](section, "directory"); err != nil || directory == nil || *directory == "" {
+		return nil, err
+	}
+
+	storageOptions, err := storage.ReadOptions(section)
+	if err != nil {
+		return nil, err
+	}
+	options := &traffic.AuditOptions{}
+	if flushInterval, err := config.LookupOptional[time.Duration](section, "flush-interval"); err != nil {
+		return nil, err
+	} else if flushInterval != nil {
+		if *flushInterval <= 0 {
+			return nil, fmt.Errorf(`Audit option "flush-interval" must be positive`)
+		}
+		options.FlushInterval = *flushInterval
+	}
+	if options.Store, err = storage.NewStore(storageOptions); err != nil {
+		return nil, err
+	}
+	options.Store.StartCleanup(time.Hour)
+	logger.Printf("Audit log: stored in %v\n", storageOptions.Directory)
+	return options, nil
+}
+
+// readRecordingOptions reads the top-level 'recording' section, which holds
+// storage options along with 'format', 'redact-headers', and
+// 'max-body-bytes'. Requests aren't recorded unless 'directory' is set.
+func readRecordingOptions(configFile *config.File) (*traffic.Recorder, error) {
+	section := configFile.LookupOptionalSection("recording")
+	if section == nil {
+		return nil, nil
+	}
+	if directory, err := config.LookupOptional[string](section, "directory"); err != nil || directory == nil || *directory == "" {
+		return nil, err
+	}
+
+	storageOptions, err := storage.ReadOptions(section)
+	if err != nil {
+		return nil, err
+	}
+	options := traffic.RecorderOptions{Format: traffic.RecordingFramed}
+	if err := config.ParseOptional(section, "format", func(key string, value string) error {
+		options.Format, err = traffic.ParseRecordingFormat(value)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := config.ParseOptional(section, "redact-headers", func(key string, value []string) error {
+		options.RedactHeaders = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if maxBodyBytes, err := config.LookupOptional[int64](section, "max-body-bytes"); err != nil {
+		return nil, err
+	} else if maxBodyBytes != nil {
+		if *maxBodyBytes <= 0 {
+			return nil, fmt.Errorf(`Recording option "max-body-bytes" must be positive`)
+		}
+		options.MaxBodyBytes = *maxBodyBytes
+	}
+
+	if options.Store, err = storage.NewStore(storageOptions); err != nil {
+		return nil, err
+	}
+	recorder, err := traffic.NewRecorder(options)
+	if err != nil {
+		return nil, err
+	}
+	options.Store.StartCleanup(time.Hour)
+	logger.Printf("Recording: requests written to %v in %v in %v format\n", recorder.Name(), storageOptions.Directory, options.Format)
+	return recorder, nil
+}
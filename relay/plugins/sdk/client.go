@@ -0,0 +1,224 @@
+package sdk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultStartTimeout is how long Start waits for a plugin to complete its
+// handshake, unless StartOptions.Timeout is set.
+const DefaultStartTimeout = 10 * time.Second
+
+// stopTimeout is how long Close waits for a plugin to exit once its stdin is
+// closed, before killing it.
+const stopTimeout = 2 * time.Second
+
+// StartOptions describe how to run a plugin's program.
+type StartOptions struct {
+	Command string
+	Args    []string
+	Env     []string      // Added to the relay's environment, as "KEY=value".
+	Timeout time.Duration // How long to wait for the handshake.
+	// Output receives each line the plugin writes to stderr, or to stdout
+	// after the handshake.
+	Output func(line string)
+}
+
+// Client calls a plugin which Serve serves from a subprocess.
+type Client struct {
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	conn    *grpc.ClientConn
+
+	exited  chan struct{} // Closed once the process has exited.
+	exitErr error         // Why the process exited, once it has.
+
+	closeOnce sync.Once
+}
+
+// Start runs a plugin's program, and connects to it once it has completed the
+// handshake.
+func Start(options StartOptions) (*Client, error) {
+	output := options.Output
+	if output == nil {
+		output = func(string) {}
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStartTimeout
+	}
+
+	command := exec.Command(options.Command, options.Args...)
+	command.Env = append(append(os.Environ(), options.Env...), MagicCookieKey+"="+MagicCookieValue)
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := command.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		command: command,
+		stdin:   stdin,
+		exited:  make(chan struct{}),
+	}
+	var drained sync.WaitGroup
+	drained.Add(2)
+	go func() {
+		defer drained.Done()
+		forwardLines(stderr, output)
+	}()
+	handshake := make(chan string, 1)
+	go func() {
+		defer drained.Done()
+		scanner := bufio.NewScanner(stdout)
+		if scanner.Scan() {
+			handshake <- scanner.Text()
+		}
+		close(handshake)
+		for scanner.Scan() {
+			output(scanner.Text())
+		}
+	}()
+	// The process is waited for once both pipes are drained, so that no
+	// output is lost.
+	go func() {
+		drained.Wait()
+		client.exitErr = command.Wait()
+		close(client.exited)
+	}()
+
+	var line string
+	select {
+	case line = <-handshake:
+	case <-time.After(timeout):
+		client.Close()
+		return nil, fmt.Errorf("Plugin did not complete its handshake within %v", timeout)
+	}
+	address, err := parseHandshake(line)
+	if err != nil {
+		client.Close()
+		if client.exitErr != nil {
+			return nil, fmt.Errorf("%v (plugin exited: %v)", err, client.exitErr)
+		}
+		return nil, err
+	}
+
+	client.conn, err = grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// parseHandshake returns the address of the unix socket in a handshake line
+// written by Serve, as a gRPC target.
+func parseHandshake(line string) (string, error) {
+	if line == "" {
+		return "", fmt.Errorf("Plugin exited without completing its handshake")
+	}
+	parts := strings.Split(line, "|")
+	if len(parts) != 4 || parts[1] != "unix" || parts[3] != "grpc" {
+		return "", fmt.Errorf(`Invalid plugin handshake "%v": the program may not be a relay plugin`, line)
+	}
+	if version, err := strconv.Atoi(parts[0]); err != nil || version != ProtocolVersion {
+		return "", fmt.Errorf(`Plugin speaks protocol version "%v", but the relay speaks version %v`, parts[0], ProtocolVersion)
+	}
+	return "unix://" + parts[2], nil
+}
+
+func forwardLines(reader io.Reader, output func(line string)) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		output(scanner.Text())
+	}
+}
+
+// Configure calls the plugin's Configure method.
+func (client *Client) Configure(ctx context.Context, config map[string]interface{}) (Info, error) {
+	response := &configureResponse{}
+	if err := client.invoke(ctx, "Configure", &configureRequest{Config: config}, response); err != nil {
+		return Info{}, err
+	}
+	return response.Info, nil
+}
+
+// HandleRequest calls the plugin's HandleRequest method.
+func (client *Client) HandleRequest(ctx context.Context, request *Request) (*Response, error) {
+	response := &Response{}
+	if err := client.invoke(ctx, "HandleRequest", request, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (client *Client) invoke(ctx context.Context, method string, request interface{}, response interface{}) error {
+	err := client.conn.Invoke(ctx, "/"+serviceName+"/"+method, request, response)
+	if err != nil {
+		if exitErr := client.Exited(); exitErr != nil {
+			return exitErr
+		}
+		// Errors returned by the plugin are reported with their own message.
+		if s, ok := status.FromError(err); ok {
+			return fmt.Errorf("%v", s.Message())
+		}
+	}
+	return err
+}
+
+// Exited returns an error describing why the plugin's process exited, or nil
+// if it's still running.
+func (client *Client) Exited() error {
+	select {
+	case <-client.exited:
+		if client.exitErr != nil {
+			return fmt.Errorf("Plugin exited: %v", client.exitErr)
+		}
+		return fmt.Errorf("Plugin exited")
+	default:
+		return nil
+	}
+}
+
+// Close stops the plugin, by closing its stdin, and kills it if it doesn't
+// exit promptly.
+func (client *Client) Close() error {
+	client.closeOnce.Do(func() {
+		if client.conn != nil {
+			client.conn.Close()
+		}
+		client.stdin.Close()
+		select {
+		case <-client.exited:
+		case <-time.After(stopTimeout):
+			client.command.Process.Kill()
+			<-client.exited
+		}
+	})
+	return nil
+}
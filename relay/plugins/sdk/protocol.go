@@ -0,0 +1,144 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+)
+
+// serviceName is the gRPC service which plugins serve.
+const serviceName = "relay.plugin.v1.Plugin"
+
+// configureRequest and configureResponse are the messages of the Configure
+// method; HandleRequest's are Request and Response.
+type configureRequest struct {
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+type configureResponse struct {
+	Info Info `json:"info"`
+}
+
+// jsonCodec encodes gRPC messages as JSON, in place of protocol buffers.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// pluginServer serves a Plugin's methods over gRPC.
+type pluginServer struct {
+	plugin Plugin
+}
+
+// pluginService is the handler type of serviceDesc.
+type pluginService interface {
+	configure(request *configureRequest) (*configureResponse, error)
+	handleRequest(request *Request) (*Response, error)
+}
+
+func (server *pluginServer) configure(request *configureRequest) (*configureResponse, error) {
+	info, err := server.plugin.Configure(request.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &configureResponse{Info: info}, nil
+}
+
+func (server *pluginServer) handleRequest(request *Request) (*Response, error) {
+	response, err := server.plugin.HandleRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		response = &Response{}
+	}
+	return response, nil
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*pluginService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Configure",
+			Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				request := &configureRequest{}
+				if err := decode(request); err != nil {
+					return nil, err
+				}
+				return srv.(pluginService).configure(request)
+			},
+		},
+		{
+			MethodName: "HandleRequest",
+			Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				request := &Request{}
+				if err := decode(request); err != nil {
+					return nil, err
+				}
+				return srv.(pluginService).handleRequest(request)
+			},
+		},
+	},
+}
+
+// Serve serves plugin to the relay which started this process, and returns
+// once the relay has stopped it, or has exited. It exits the process if it
+// wasn't started by a relay, or if it can't serve.
+//
+// Serve listens on a unix socket in a new temporary directory which only the
+// plugin's user can access, so that other local users can't call the plugin.
+// Once it's listening, it writes a handshake line to stdout which tells the
+// relay where to connect, so plugins mustn't write anything to stdout before
+// calling it. Anything they write to stderr is logged by the relay.
+func Serve(plugin Plugin) {
+	if os.Getenv(MagicCookieKey) != MagicCookieValue {
+		fmt.Fprintln(os.Stderr, "This program is a relay plugin. It's run by the relay, and can't be run on its own.")
+		os.Exit(1)
+	}
+
+	// MkdirTemp creates the directory with mode 0700.
+	dir, err := os.MkdirTemp("", "relay-plugin-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating socket directory: %v\n", err)
+		os.Exit(1)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		fmt.Fprintf(os.Stderr, "Error listening: %v\n", err)
+		os.Exit(1)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	server.RegisterService(&serviceDesc, &pluginServer{plugin: plugin})
+
+	// The relay closes stdin to stop the plugin, and it's closed for us if the
+	// relay exits without doing so.
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		server.Stop()
+	}()
+
+	fmt.Printf("%d|unix|%s|grpc\n", ProtocolVersion, listener.Addr())
+	err = server.Serve(listener)
+	os.RemoveAll(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+// Package sdk lets traffic plugins be written as separate programs, which the
+// relay's external-plugins plugin runs as subprocesses, so that custom plugins
+// don't require building a custom relay.
+//
+// A plugin program implements Plugin and passes it to Serve from its main
+// function:
+//
+//	type tagger struct{}
+//
+//	func (tagger) Configure(config map[string]interface{}) (sdk.Info, error) {
+//		return sdk.Info{Version: "1.0.0"}, nil
+//	}
+//
+//	func (tagger) HandleRequest(request *sdk.Request) (*sdk.Response, error) {
+//		header := request.Header.Clone()
+//		header.Set("X-Tagged", "true")
+//		return &sdk.Response{Header: header}, nil
+//	}
+//
+//	func main() {
+//		sdk.Serve(tagger{})
+//	}
+//
+// The relay and the plugin speak gRPC over a unix socket, in a directory which
+// only the plugin's user can access. Messages are encoded as JSON, so the
+// types in this package are the whole protocol; no generated code is needed.
+package sdk
+
+import (
+	"net/http"
+)
+
+// ProtocolVersion is the version of the protocol which the relay and its
+// plugins speak. Plugins are only run by relays which speak the same version.
+const ProtocolVersion = 1
+
+// MagicCookieKey and MagicCookieValue are set in the environment of plugin
+// processes, so that Serve can tell that it was started by the relay rather
+// than by a user.
+const (
+	MagicCookieKey   = "RELAY_PLUGIN_MAGIC_COOKIE"
+	MagicCookieValue = "7d1b3c5e9f0a4e26b8d4c2a6f1e3b5d7"
+)
+
+// Plugin is implemented by external plugins.
+type Plugin interface {
+	// Configure is called once, before any requests are handled, with the
+	// 'config' of the plugin's entry in the relay's configuration. An error
+	// stops the relay from starting.
+	Configure(config map[string]interface{}) (Info, error)
+
+	// HandleRequest is called for each request, and may modify it or respond
+	// to it instead of the target. A nil response relays the request
+	// unchanged. An error is handled as the plugin's entry in the relay's
+	// configuration says; by default, the client receives a 502. It may be
+	// called concurrently.
+	HandleRequest(request *Request) (*Response, error)
+}
+
+// Info describes a plugin once it's configured.
+type Info struct {
+	// Version is listed at /plugins on the relay's admin port.
+	Version string `json:"version,omitempty"`
+	// WantsBody asks for request bodies to be included in Requests. Bodies
+	// are read into memory to send them, so plugins should only ask for them
+	// when they're configured to use them.
+	WantsBody bool `json:"wants_body,omitempty"`
+}
+
+// Request is a request which the relay received, as modified by the plugins
+// which ran before this one.
+type Request struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"` // The path and query, like "/events?page=2".
+	Host       string      `json:"host"`
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remote_addr"`
+	Tags       []string    `json:"tags,omitempty"`
+	// Body is only sent to plugins which set Info.WantsBody, and is
+	// decompressed first.
+	Body []byte `json:"body,omitempty"`
+}
+
+// Response tells the relay how to handle a request. Unset fields leave the
+// request unchanged.
+type Response struct {
+	// Respond, if set, is sent to the client instead of relaying the request,
+	// and every other field is ignored.
+	Respond *ClientResponse `json:"respond,omitempty"`
+
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"` // The path and query to relay the request to.
+	// Header, if set, replaces every header of the request.
+	Header http.Header `json:"header,omitempty"`
+	// Body replaces the body of the request if ReplaceBody is set, so that
+	// bodies can be removed.
+	Body        []byte `json:"body,omitempty"`
+	ReplaceBody bool   `json:"replace_body,omitempty"`
+	// AddTags are added to the request's tags.
+	AddTags []string `json:"add_tags,omitempty"`
+}
+
+// ClientResponse is a response which a plugin sends to the client itself.
+type ClientResponse struct {
+	Status int         `json:"status"` // If zero, 200 is used.
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
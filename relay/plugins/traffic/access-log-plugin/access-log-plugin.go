@@ -0,0 +1,448 @@
+// This plugin writes one line per request to stdout or to a file, in Common
+// Log Format, as JSON, or using a custom template. Unlike the relay's built-in
+// 'access-log' option, the fields, including selected request headers, are
+// configurable, and query parameters which carry sensitive values can be
+// redacted. Log files are rotated once they reach a maximum size.
+//
+// Requests are logged once the relay has finished handling them, after every
+// plugin has run, so the client address and headers are those left by
+// plugins like anonymous-id.
+
+package access_log_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    accessLogPluginFactory
+	pluginName = "access-log"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	formatCommon = "common"
+	formatJSON   = "json"
+
+	defaultMaxSize    = 100 * 1024 * 1024
+	defaultMaxBackups = 5
+
+	// redactedValue replaces the values of redacted query parameters.
+	redactedValue = "REDACTED"
+)
+
+// fieldNames are the fields which may be listed in 'fields' and used in
+// templates, in the order they're written in JSON by default. Request headers
+// are added with 'headers'.
+var fieldNames = []string{
+	"time",
+	"remote_addr",
+	"method",
+	"host",
+	"path",
+	"query",
+	"protocol",
+	"status",
+	"bytes",
+	"request_bytes",
+	"latency_ms",
+	"serviced",
+	"tags",
+}
+
+// optionalFieldNames may also be listed in 'fields' and used in templates, but
+// aren't written in JSON by default. Annotations which plugins attached to the
+// request are written as an object, and may be used in templates individually
+// as "{annotation:key}".
+var optionalFieldNames = []string{
+	"request_id",
+	"route",
+	"annotations",
+}
+
+// commonLogTemplate is Common Log Format, without the identity and user
+// fields, which the relay doesn't know.
+const commonLogTemplate = `{remote_addr} - - [{clf_time}] "{method} {url} {protocol}" {status} {clf_bytes}`
+
+var placeholderPattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type accessLogPluginFactory struct{}
+
+func (f accessLogPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f accessLogPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &accessLogPlugin{
+		format:      formatCommon,
+		fields:      fieldNames,
+		redactQuery: map[string]bool{},
+	}
+
+	output, err := config.LookupOptional[string](configSection, "output")
+	if err != nil {
+		return nil, err
+	} else if output == nil || *output == "" {
+		return nil, nil
+	}
+
+	if err := config.ParseOptional(configSection, "format", func(key string, value string) error {
+		switch value {
+		case formatCommon, formatJSON:
+			plugin.format = value
+			return nil
+		default:
+			return fmt.Errorf(`Invalid access log format "%v"; expected "%v" or "%v"`, value, formatCommon, formatJSON)
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "headers", func(key string, value []string) error {
+		for _, header := range value {
+			plugin.headers = append(plugin.headers, http.CanonicalHeaderKey(header))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "fields", func(key string, value []string) error {
+		for _, field := range value {
+			if !isField(field) {
+				return fmt.Errorf(`Unknown access log field "%v"`, field)
+			}
+		}
+		plugin.fields = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	template := commonLogTemplate
+	if err := config.ParseOptional(configSection, "template", func(key string, value string) error {
+		if plugin.format == formatJSON {
+			return fmt.Errorf(`Option "template" can't be used with format "%v"`, formatJSON)
+		}
+		template = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if plugin.template, err = parseTemplate(template); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "redact-query-params", func(key string, value []string) error {
+		for _, param := range value {
+			plugin.redactQuery[param] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	maxSize := int64(defaultMaxSize)
+	if value, err := config.LookupOptional[int64](configSection, "max-size"); err != nil {
+		return nil, err
+	} else if value != nil {
+		if *value <= 0 {
+			return nil, fmt.Errorf(`Option "max-size" must be positive`)
+		}
+		maxSize = *value
+	}
+	maxBackups := defaultMaxBackups
+	if value, err := config.LookupOptional[int](configSection, "max-backups"); err != nil {
+		return nil, err
+	} else if value != nil {
+		if *value < 0 {
+			return nil, fmt.Errorf(`Option "max-backups" must not be negative`)
+		}
+		maxBackups = *value
+	}
+
+	if *output == "stdout" {
+		plugin.writer = os.Stdout
+	} else {
+		file, err := openRotatingFile(*output, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		plugin.writer = file
+	}
+
+	logger.Printf("Access log: writing %v lines to %v", plugin.format, *output)
+	return plugin, nil
+}
+
+type accessLogPlugin struct {
+	format      string
+	fields      []string   // The fields written in JSON.
+	headers     []string   // The request headers written in JSON, in canonical form.
+	template    []fragment // The template for lines in Common Log Format or a custom format.
+	redactQuery map[string]bool
+
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (plug *accessLogPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *accessLogPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	return false
+}
+
+func (plug *accessLogPlugin) HandleCompletion(completion *traffic.RequestCompletion) {
+	var line []byte
+	if plug.format == formatJSON {
+		line = plug.appendJSON(nil, completion)
+	} else {
+		line = plug.appendTemplate(nil, completion)
+	}
+	line = append(line, '\n')
+
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+	if _, err := plug.writer.Write(line); err != nil {
+		logger.Errorf("Error writing access log: %s", err)
+	}
+}
+
+// fragment is a part of a template: either literal text, or a field.
+type fragment struct {
+	literal string
+	field   string
+}
+
+func isField(name string) bool {
+	for _, field := range append(fieldNames, optionalFieldNames...) {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// templateOnlyFields may be used in templates, but not in JSON: the request
+// path with its query string, and the time and response size as Common Log
+// Format writes them.
+var templateOnlyFields = map[string]bool{"url": true, "clf_time": true, "clf_bytes": true}
+
+// parseTemplate splits a template into fragments. Fields are written as
+// "{name}", request headers as "{header:Name}", and annotations as
+// "{annotation:key}".
+func parseTemplate(template string) ([]fragment, error) {
+	var fragments []fragment
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(template, -1) {
+		if match[0] > last {
+			fragments = append(fragments, fragment{literal: template[last:match[0]]})
+		}
+		field := template[match[2]:match[3]]
+		if header, ok := strings.CutPrefix(field, "header:"); ok {
+			field = "header:" + http.CanonicalHeaderKey(header)
+		} else if !strings.HasPrefix(field, "annotation:") && !isField(field) && !templateOnlyFields[field] {
+			return nil, fmt.Errorf(`Unknown access log field "%v" in template`, field)
+		}
+		fragments = append(fragments, fragment{field: field})
+		last = match[1]
+	}
+	if last < len(template) {
+		fragments = append(fragments, fragment{literal: template[last:]})
+	}
+	return fragments, nil
+}
+
+func (plug *accessLogPlugin) appendTemplate(dst []byte, completion *traffic.RequestCompletion) []byte {
+	for _, fragment := range plug.template {
+		if fragment.field == "" {
+			dst = append(dst, fragment.literal...)
+			continue
+		}
+		value := plug.fieldValue(fragment.field, completion)
+		if value == "" {
+			value = "-"
+		}
+		dst = append(dst, value...)
+	}
+	return dst
+}
+
+func (plug *accessLogPlugin) appendJSON(dst []byte, completion *traffic.RequestCompletion) []byte {
+	dst = append(dst, '{')
+	for i, field := range plug.fields {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendQuote(dst, field)
+		dst = append(dst, ':')
+		switch field {
+		case "status", "bytes", "request_bytes", "latency_ms", "serviced":
+			dst = append(dst, plug.fieldValue(field, completion)...)
+		case "tags":
+			dst = appendJSONValue(dst, completion.Tags)
+		case "annotations":
+			annotations := completion.Annotations
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			dst = appendJSONValue(dst, annotations)
+		default:
+			dst = appendJSONValue(dst, plug.fieldValue(field, completion))
+		}
+	}
+	if len(plug.headers) > 0 {
+		if len(plug.fields) > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `"headers":{`...)
+		for i, header := range plug.headers {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendJSONValue(dst, header)
+			dst = append(dst, ':')
+			dst = appendJSONValue(dst, completion.Request.Header.Get(header))
+		}
+		dst = append(dst, '}')
+	}
+	return append(dst, '}')
+}
+
+func appendJSONValue(dst []byte, value any) []byte {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return append(dst, "null"...)
+	}
+	return append(dst, encoded...)
+}
+
+// fieldValue returns the value of a field as text. Numbers and booleans are
+// valid JSON as they are.
+func (plug *accessLogPlugin) fieldValue(field string, completion *traffic.RequestCompletion) string {
+	switch field {
+	case "time":
+		return completion.Start.UTC().Format(time.RFC3339Nano)
+	case "clf_time":
+		return completion.Start.Format("02/Jan/2006:15:04:05 -0700")
+	case "remote_addr":
+		if host, _, err := net.SplitHostPort(completion.Request.RemoteAddr); err == nil {
+			return host
+		}
+		return completion.Request.RemoteAddr
+	case "method":
+		return completion.Request.Method
+	case "host":
+		return completion.OriginalHost
+	case "path":
+		return completion.OriginalURL.EscapedPath()
+	case "query":
+		return plug.redactedQuery(completion.OriginalURL)
+	case "url":
+		if query := plug.redactedQuery(completion.OriginalURL); query != "" {
+			return completion.OriginalURL.EscapedPath() + "?" + query
+		}
+		return completion.OriginalURL.EscapedPath()
+	case "protocol":
+		return completion.Request.Proto
+	case "status":
+		return strconv.Itoa(completion.Status)
+	case "bytes":
+		return strconv.FormatInt(completion.ResponseBytes, 10)
+	case "clf_bytes":
+		if completion.ResponseBytes == 0 {
+			return "-"
+		}
+		return strconv.FormatInt(completion.ResponseBytes, 10)
+	case "request_bytes":
+		return strconv.FormatInt(completion.RequestBytes, 10)
+	case "latency_ms":
+		return strconv.FormatFloat(float64(completion.Duration)/float64(time.Millisecond), 'f', 3, 64)
+	case "serviced":
+		return strconv.FormatBool(completion.Serviced)
+	case "tags":
+		return strings.Join(completion.Tags, ",")
+	case "request_id":
+		return completion.ID
+	case "route":
+		return completion.Route
+	case "annotations":
+		keys := make([]string, 0, len(completion.Annotations))
+		for key := range completion.Annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = key + "=" + completion.Annotations[key]
+		}
+		return strings.Join(pairs, ",")
+	}
+	if header, ok := strings.CutPrefix(field, "header:"); ok {
+		return completion.Request.Header.Get(header)
+	}
+	if key, ok := strings.CutPrefix(field, "annotation:"); ok {
+		return completion.Annotations[key]
+	}
+	return ""
+}
+
+// redactedQuery returns the URL's query string with the values of redacted
+// parameters replaced. The order of the parameters is preserved.
+func (plug *accessLogPlugin) redactedQuery(requestURL *url.URL) string {
+	if len(plug.redactQuery) == 0 || requestURL.RawQuery == "" {
+		return requestURL.RawQuery
+	}
+	params := strings.Split(requestURL.RawQuery, "&")
+	for i, param := range params {
+		name, _, hasValue := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if hasValue && plug.redactQuery[name] {
+			params[i] = param[:strings.Index(param, "=")+1] + redactedValue
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
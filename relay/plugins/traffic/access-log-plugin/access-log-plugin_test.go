@@ -0,0 +1,246 @@
+package access_log_plugin_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	access_log_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/access-log-plugin"
+	content_enricher_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-enricher-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestAccessLogPlugin(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		config       string
+		path         string
+		expectedLine string // A regular expression.
+	}{
+		{
+			desc:         "Requests are logged in Common Log Format by default",
+			config:       "",
+			path:         "/page?id=1",
+			expectedLine: `^127\.0\.0\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] "GET /page\?id=1 HTTP/1\.1" 200 (\d+|-)$`,
+		},
+		{
+			desc:         "Query parameters can be redacted",
+			config:       "redact-query-params: [token, key]",
+			path:         "/page?token=secret&id=1&key=secret",
+			expectedLine: `"GET /page\?token=REDACTED&id=1&key=REDACTED HTTP/1\.1"`,
+		},
+		{
+			desc:         "Requests can be logged as JSON",
+			config:       "format: json",
+			path:         "/page?id=1",
+			expectedLine: `^\{"time":"[^"]+","remote_addr":"127\.0\.0\.1","method":"GET","host":"127\.0\.0\.1:\d+","path":"/page","query":"id=1","protocol":"HTTP/1\.1","status":200,"bytes":\d+,"request_bytes":0,"latency_ms":\d+\.\d{3},"serviced":true,"tags":\[\]\}$`,
+		},
+		{
+			desc:         "JSON fields and headers can be selected",
+			config:       "format: json\n    fields: [method, status]\n    headers: [user-agent]\n    redact-query-params: [token]",
+			path:         "/page?token=secret",
+			expectedLine: `^\{"method":"GET","status":200,"headers":\{"User-Agent":"access-log-test"\}\}$`,
+		},
+		{
+			desc:         "Lines can use a custom template",
+			config:       `template: "{method} {path} {status} {latency_ms}ms {header:user-agent} {header:referer}"`,
+			path:         "/page",
+			expectedLine: `^GET /page 200 \d+\.\d{3}ms access-log-test -$`,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		access_log_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		logPath := filepath.Join(t.TempDir(), "access.log")
+		configYaml := fmt.Sprintf("access-log:\n    output: %v\n    %v\n", logPath, testCase.config)
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("User-Agent", "access-log-test")
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			lines := readLog(logPath)
+			if len(lines) != 1 {
+				t.Errorf("Test '%v': Expected one line in the access log but got %q", testCase.desc, lines)
+				return
+			}
+			if !regexp.MustCompile(testCase.expectedLine).MatchString(lines[0]) {
+				t.Errorf("Test '%v': Expected a line matching %v but got %v", testCase.desc, testCase.expectedLine, lines[0])
+			}
+		})
+	}
+}
+
+func TestAccessLogAnnotations(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		config       string
+		expectedLine string // A regular expression.
+	}{
+		{
+			desc:         "Templates may include the request ID and annotations",
+			config:       `template: "{request_id} {annotation:tenant} {annotation:missing} {annotations}"`,
+			expectedLine: `^[0-9a-f]{32} acme - plan=free,tenant=acme$`,
+		},
+		{
+			desc:         "JSON lines may include the request ID, route, and annotations",
+			config:       "format: json\n    fields: [request_id, route, annotations]",
+			expectedLine: `^\{"request_id":"[0-9a-f]{32}","route":"","annotations":\{"plan":"free","tenant":"acme"\}\}$`,
+		},
+	}
+
+	// The enrich-content plugin annotates each request, and the access log
+	// records the annotations once the request has been handled.
+	plugins := []traffic.PluginFactory{
+		content_enricher_plugin.Factory,
+		access_log_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		logPath := filepath.Join(t.TempDir(), "access.log")
+		configYaml := fmt.Sprintf(
+			"enrich-content:\n    annotations:\n        tenant: acme\n        plan: free\naccess-log:\n    output: %v\n    %v\n",
+			logPath, testCase.config,
+		)
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + "/page")
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			lines := readLog(logPath)
+			if len(lines) != 1 {
+				t.Errorf("Test '%v': Expected one line in the access log but got %q", testCase.desc, lines)
+				return
+			}
+			if !regexp.MustCompile(testCase.expectedLine).MatchString(lines[0]) {
+				t.Errorf("Test '%v': Expected a line matching %v but got %v", testCase.desc, testCase.expectedLine, lines[0])
+			}
+		})
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	configYaml := fmt.Sprintf(`access-log:
+    output: %v
+    template: "{method} {path}"
+    max-size: 20
+    max-backups: 2
+`, logPath)
+
+	test.WithCatcherAndRelay(t, configYaml, []traffic.PluginFactory{access_log_plugin.Factory}, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for i := 1; i <= 4; i++ {
+			response, err := http.Get(fmt.Sprintf("%v/request-%d", relayService.HttpUrl(), i))
+			if err != nil {
+				t.Errorf("Error sending request: %v", err)
+				return
+			}
+			response.Body.Close()
+			// Wait for each request to be logged, so they're logged in order.
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				if contents, _ := os.ReadFile(logPath); strings.Contains(string(contents), fmt.Sprintf("request-%d", i)) {
+					break
+				}
+			}
+		}
+	})
+
+	// Each line is 15 bytes long, so each file holds one line, and the oldest
+	// is removed.
+	expectedFiles := map[string]string{
+		logPath:        "GET /request-4\n",
+		logPath + ".1": "GET /request-3\n",
+		logPath + ".2": "GET /request-2\n",
+	}
+	for path, expected := range expectedFiles {
+		if contents, err := os.ReadFile(path); err != nil {
+			t.Errorf("Error reading %v: %v", path, err)
+		} else if string(contents) != expected {
+			t.Errorf("Expected %v to contain %q but got %q", path, expected, contents)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestAccessLogConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"format: apache",
+		"fields: [method, referer]",
+		"template: '{method} {unknown}'",
+		"format: json\n    template: '{method}'",
+		"max-size: 0",
+		"max-backups: -1",
+		"output: /nonexistent/relay/access.log",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		if !strings.HasPrefix(invalidConfig, "output:") {
+			invalidConfig = "output: stdout\n    " + invalidConfig
+		}
+		configFile, err := config.NewFileFromYamlString("access-log:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := access_log_plugin.Factory.New(configFile.LookupOptionalSection("access-log")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+// readLog returns the lines in the access log, waiting briefly for the first,
+// since requests are logged once the relay has finished handling them, which
+// may be after the client has received the response.
+func readLog(path string) []string {
+	var contents []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if contents, _ = os.ReadFile(path); len(contents) > 0 {
+			break
+		}
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,373 @@
+// This plugin combines small JSON event POSTs into batches, so that chatty
+// clients which send each event in its own request cost the target far fewer
+// requests. Events sent to the same path by the same session are buffered for
+// up to 'max-delay', or until 'max-events' have arrived, and then sent to the
+// target as a single JSON array, in the order they arrived; events which are
+// themselves arrays contribute their elements.
+//
+// Each client waits for its batch to be sent, and receives the target's
+// response to the batch, so failures are reported to every client whose events
+// were part of it. The batch is sent with the headers of its first request, so
+// sessions should be identified by a header which distinguishes clients whose
+// requests would be relayed differently.
+//
+// The batches are sent by the plugin itself, so it should run after every
+// other plugin which modifies requests.
+
+package aggregate_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    aggregatePluginFactory
+	pluginName = "aggregate"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// BatchedEventsHeaderName is the response header which reports how many events
+// were sent to the target in the same batch as the client's.
+const BatchedEventsHeaderName = "X-Relay-Batched-Events"
+
+const (
+	defaultMaxDelay     = 100 * time.Millisecond
+	defaultMaxEvents    = 20
+	defaultMaxEventSize = 1024
+
+	// sendTimeout bounds the time spent sending a batch to the target, since
+	// batches outlive the requests they're made from.
+	sendTimeout = 30 * time.Second
+
+	// maxResponseSize bounds the size of the target's response to a batch,
+	// which is buffered so that it can be sent to each waiting client.
+	maxResponseSize = 1024 * 1024
+)
+
+type aggregatePluginFactory struct{}
+
+func (f aggregatePluginFactory) Name() string {
+	return pluginName
+}
+
+func (f aggregatePluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &aggregatePlugin{
+		maxDelay:     defaultMaxDelay,
+		maxEvents:    defaultMaxEvents,
+		maxEventSize: defaultMaxEventSize,
+		transport:    http.DefaultTransport,
+		batches:      map[batchKey]*batch{},
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			plugin.paths = append(plugin.paths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(plugin.paths) == 0 {
+		return nil, nil
+	}
+
+	if maxDelay, err := config.LookupOptional[time.Duration](configSection, "max-delay"); err != nil {
+		return nil, err
+	} else if maxDelay != nil {
+		if *maxDelay <= 0 {
+			return nil, fmt.Errorf(`Invalid max-delay "%v": must be positive`, *maxDelay)
+		}
+		plugin.maxDelay = *maxDelay
+	}
+
+	for _, option := range []struct {
+		key    string
+		target *int
+	}{
+		{"max-events", &plugin.maxEvents},
+		{"max-event-size", &plugin.maxEventSize},
+	} {
+		if value, err := config.LookupOptional[int](configSection, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 1 {
+				return nil, fmt.Errorf(`Invalid %v "%v": must be at least 1`, option.key, *value)
+			}
+			*option.target = *value
+		}
+	}
+
+	if sessionHeader, err := config.LookupOptional[string](configSection, "session-header"); err != nil {
+		return nil, err
+	} else if sessionHeader != nil {
+		plugin.sessionHeader = http.CanonicalHeaderKey(*sessionHeader)
+	}
+
+	for _, match := range plugin.paths {
+		logger.Printf(`Added rule: batch events sent to "%s" for up to %v or %v events`, match, plugin.maxDelay, plugin.maxEvents)
+	}
+
+	return plugin, nil
+}
+
+type aggregatePlugin struct {
+	paths         []*regexp.Regexp // Only events sent to matching paths are batched.
+	maxDelay      time.Duration    // How long the first event in a batch may wait.
+	maxEvents     int              // Batches are sent as soon as they have this many events.
+	maxEventSize  int              // Larger bodies are relayed on their own.
+	sessionHeader string           // If set, sessions are identified by this header rather than the client's IP.
+	transport     http.RoundTripper
+
+	mutex   sync.Mutex
+	batches map[batchKey]*batch // Batches which are still accepting events.
+}
+
+// batchKey identifies the events which may be batched together.
+type batchKey struct {
+	session string
+	path    string
+}
+
+// batch is a set of events which will be sent to the target together.
+type batch struct {
+	request *http.Request // The first request, whose URL and headers the batch is sent with.
+	events  []json.RawMessage
+	timer   *time.Timer
+	done    chan struct{} // Closed once result is set.
+	result  *batchResult
+}
+
+// batchResult is the target's response to a batch, which is sent to each
+// client whose events were part of it.
+type batchResult struct {
+	status int
+	header http.Header
+	body   []byte
+	events int
+}
+
+func (plug *aggregatePlugin) Name() string {
+	return pluginName
+}
+
+func (plug *aggregatePlugin) SetTransport(transport http.RoundTripper) {
+	plug.transport = transport
+}
+
+func (plug *aggregatePlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced || request.Method != http.MethodPost || !plug.matchesPath(info.OriginalURL.Path) {
+		return false
+	}
+
+	// Only plain bodies are batched, since a batch can't mix encodings.
+	if encoding, err := traffic.GetContentEncoding(request); err != nil || encoding != traffic.Identity {
+		return false
+	}
+	if request.ContentLength < 0 || request.ContentLength > int64(plug.maxEventSize) {
+		return false
+	}
+
+	body, err := io.ReadAll(request.Body)
+	traffic.SetRequestBody(request, body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
+		return true
+	}
+	events, ok := parseEvents(body)
+	if !ok {
+		return false
+	}
+
+	joined := plug.add(batchKey{plug.sessionKey(request), info.OriginalURL.Path}, request, events)
+	select {
+	case <-joined.done:
+	case <-request.Context().Done():
+		// The client has gone away, but its events will still be sent.
+		return true
+	}
+
+	result := joined.result
+	for name, values := range result.header {
+		for _, value := range values {
+			response.Header().Add(name, value)
+		}
+	}
+	response.Header().Set(BatchedEventsHeaderName, strconv.Itoa(result.events))
+	response.Header().Set("Content-Length", strconv.Itoa(len(result.body)))
+	response.WriteHeader(result.status)
+	response.Write(result.body)
+	return true
+}
+
+func (plug *aggregatePlugin) matchesPath(path string) bool {
+	for _, match := range plug.paths {
+		if match.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionKey identifies the session which sent a request. Requests without the
+// configured session header are identified by their IP instead.
+func (plug *aggregatePlugin) sessionKey(request *http.Request) string {
+	if plug.sessionHeader != "" {
+		if value := request.Header.Get(plug.sessionHeader); value != "" {
+			return "header:" + value
+		}
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + request.RemoteAddr
+}
+
+// parseEvents returns the events in a request body, which may be a single
+// JSON value or an array of them.
+func parseEvents(body []byte) ([]json.RawMessage, bool) {
+	var event json.RawMessage
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, false
+	}
+	var events []json.RawMessage
+	if err := json.Unmarshal(event, &events); err == nil {
+		return events, true
+	}
+	return []json.RawMessage{event}, true
+}
+
+// add adds events to the session's current batch, starting a new batch if
+// there isn't one, and returns the batch they were added to. Batches which
+// reach the maximum number of events are sent right away, and others are sent
+// once the first event has waited for the maximum delay.
+func (plug *aggregatePlugin) add(key batchKey, request *http.Request, events []json.RawMessage) *batch {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	current := plug.batches[key]
+	if current == nil {
+		// The batch is sent after this request has been handled, so it can't
+		// use the request's context.
+		current = &batch{
+			request: request.Clone(context.Background()),
+			done:    make(chan struct{}),
+		}
+		current.timer = time.AfterFunc(plug.maxDelay, func() {
+			plug.flush(key, current)
+		})
+		plug.batches[key] = current
+	}
+	current.events = append(current.events, events...)
+
+	if len(current.events) >= plug.maxEvents {
+		current.timer.Stop()
+		delete(plug.batches, key)
+		go plug.send(current)
+	}
+	return current
+}
+
+// flush sends a batch once its delay has expired, unless it has already been
+// sent because it filled up.
+func (plug *aggregatePlugin) flush(key batchKey, expired *batch) {
+	plug.mutex.Lock()
+	if plug.batches[key] != expired {
+		plug.mutex.Unlock()
+		return
+	}
+	delete(plug.batches, key)
+	plug.mutex.Unlock()
+
+	plug.send(expired)
+}
+
+// send sends a batch to the target, and makes the target's response available
+// to the clients waiting for it.
+func (plug *aggregatePlugin) send(sending *batch) {
+	defer close(sending.done)
+
+	body, err := json.Marshal(sending.events)
+	if err != nil {
+		sending.result = errorResult(err, len(sending.events))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	batchRequest := sending.request.WithContext(ctx)
+	traffic.SetRequestBody(batchRequest, body)
+	traffic.AddRelayHeaders(batchRequest)
+
+	targetResponse, err := plug.transport.RoundTrip(batchRequest)
+	if err != nil {
+		sending.result = errorResult(err, len(sending.events))
+		return
+	}
+	defer targetResponse.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(targetResponse.Body, maxResponseSize))
+	if err != nil {
+		sending.result = errorResult(err, len(sending.events))
+		return
+	}
+
+	header := targetResponse.Header.Clone()
+	header.Del("Content-Length")
+	sending.result = &batchResult{
+		status: targetResponse.StatusCode,
+		header: header,
+		body:   responseBody,
+		events: len(sending.events),
+	}
+}
+
+func errorResult(err error, events int) *batchResult {
+	logger.Errorf("Error sending batch of %v events: %s", events, err)
+	return &batchResult{
+		status: http.StatusBadGateway,
+		header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		body:   []byte("Error sending events to target\n"),
+		events: events,
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,284 @@
+package aggregate_plugin_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	aggregate_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/aggregate-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type aggregateRequest struct {
+	path    string
+	session string
+	body    string
+}
+
+func TestAggregatePlugin(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		config          string
+		requests        []aggregateRequest // Sent concurrently.
+		expectedBodies  []string           // Sorted, with events sorted within each batch.
+		expectedStatus  int
+		expectedBatched string
+	}{
+		{
+			desc: "Events are batched until there are enough of them",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-delay: 1m
+    max-events: 3
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `{"n":1}`},
+				{path: "/event", body: `{"n":2}`},
+				{path: "/event", body: `{"n":3}`},
+			},
+			expectedBodies:  []string{`[{"n":1},{"n":2},{"n":3}]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatched: "3",
+		},
+		{
+			desc: "Batches are sent after the maximum delay",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-delay: 10ms
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `{"n":1}`},
+			},
+			expectedBodies:  []string{`[{"n":1}]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatched: "1",
+		},
+		{
+			desc: "Arrays contribute their elements",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-delay: 1m
+    max-events: 3
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `[{"n":1},{"n":2}]`},
+				{path: "/event", body: `{"n":3}`},
+			},
+			expectedBodies:  []string{`[{"n":1},{"n":2},{"n":3}]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatched: "3",
+		},
+		{
+			desc: "Sessions are batched separately",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-delay: 1m
+    max-events: 2
+    session-header: X-Session-Id
+`,
+			requests: []aggregateRequest{
+				{path: "/event", session: "a", body: `{"a":1}`},
+				{path: "/event", session: "b", body: `{"b":1}`},
+				{path: "/event", session: "a", body: `{"a":2}`},
+				{path: "/event", session: "b", body: `{"b":2}`},
+			},
+			expectedBodies:  []string{`[{"a":1},{"a":2}]`, `[{"b":1},{"b":2}]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatched: "2",
+		},
+		{
+			desc: "Requests to other paths are relayed as is",
+			config: `aggregate:
+    paths:
+        - ^/event$
+`,
+			requests: []aggregateRequest{
+				{path: "/other", body: `{"n":1}`},
+			},
+			expectedBodies: []string{`{"n":1}`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Large events are relayed as is",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-event-size: 10
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `{"n":"0123456789"}`},
+			},
+			expectedBodies: []string{`{"n":"0123456789"}`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Bodies other than JSON are relayed as is",
+			config: `aggregate:
+    paths:
+        - ^/event$
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `n=1`},
+			},
+			expectedBodies: []string{`n=1`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Failures are reported to every client in the batch",
+			config: `aggregate:
+    paths:
+        - ^/event$
+    max-delay: 1m
+    max-events: 2
+`,
+			requests: []aggregateRequest{
+				{path: "/event", body: `{"fail":1}`},
+				{path: "/event", body: `{"n":2}`},
+			},
+			expectedBodies:  []string{`[{"fail":1},{"n":2}]`},
+			expectedStatus:  http.StatusServiceUnavailable,
+			expectedBatched: "2",
+		},
+	}
+
+	var mutex sync.Mutex
+	var receivedBodies []string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		mutex.Lock()
+		receivedBodies = append(receivedBodies, sortEvents(string(body)))
+		mutex.Unlock()
+
+		if request.Header.Get(traffic.RelayVersionHeaderName) == "" {
+			t.Errorf("Expected every request to carry the relay headers")
+		}
+		if strings.Contains(string(body), "fail") {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := aggregate_plugin.Factory.New(configFile.LookupOptionalSection("aggregate"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+
+		mutex.Lock()
+		receivedBodies = nil
+		mutex.Unlock()
+
+		var waitGroup sync.WaitGroup
+		for _, aggregateRequest := range testCase.requests {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				request, _ := http.NewRequest("POST", relayServer.URL+aggregateRequest.path, strings.NewReader(aggregateRequest.body))
+				request.Header.Set("Content-Type", "application/json")
+				if aggregateRequest.session != "" {
+					request.Header.Set("X-Session-Id", aggregateRequest.session)
+				}
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+					return
+				}
+				response.Body.Close()
+
+				if response.StatusCode != testCase.expectedStatus {
+					t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				}
+				if batched := response.Header.Get(aggregate_plugin.BatchedEventsHeaderName); batched != testCase.expectedBatched {
+					t.Errorf("Test '%v': Expected %v header '%v' but got '%v'", testCase.desc, aggregate_plugin.BatchedEventsHeaderName, testCase.expectedBatched, batched)
+				}
+			}()
+		}
+		waitGroup.Wait()
+		relayServer.Close()
+
+		mutex.Lock()
+		sort.Strings(receivedBodies)
+		if !reflect.DeepEqual(receivedBodies, testCase.expectedBodies) {
+			t.Errorf("Test '%v': Expected target to receive %v but got %v", testCase.desc, testCase.expectedBodies, receivedBodies)
+		}
+		mutex.Unlock()
+	}
+}
+
+// sortEvents sorts the events in a JSON array body, since events sent
+// concurrently may arrive in any order. Other bodies are returned as is.
+func sortEvents(body string) string {
+	var events []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &events); err != nil {
+		return body
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return string(events[i]) < string(events[j])
+	})
+	sorted, _ := json.Marshal(events)
+	return string(sorted)
+}
+
+func TestAggregateConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"paths:\n        - \"[\"",
+		"paths:\n        - ^/event\n    max-delay: 0s",
+		"paths:\n        - ^/event\n    max-delay: soon",
+		"paths:\n        - ^/event\n    max-events: 0",
+		"paths:\n        - ^/event\n    max-event-size: -1",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("aggregate:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := aggregate_plugin.Factory.New(configFile.LookupOptionalSection("aggregate")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
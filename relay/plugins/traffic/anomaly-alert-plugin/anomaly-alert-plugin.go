@@ -0,0 +1,434 @@
+// This plugin watches the shape of the relay's traffic and raises alerts when
+// it changes suddenly, giving early warning of SDK regressions or attacks.
+// Requests are grouped into configured routes, and counted in fixed windows.
+// Each route keeps a baseline of its request rate and error rate, which is a
+// moving average over the last 'baseline-windows' windows. When a window's
+// rate differs from the baseline by more than 'rate-change' times, or its
+// error rate exceeds the baseline by more than 'error-rate-increase', an alert
+// is logged and, if a webhook is configured, POSTed to it as JSON. Another is
+// sent once the route returns to normal.
+//
+// Windows are closed when the first request after their end completes, so
+// there's no background work; if the relay receives no traffic at all, no
+// alerts are raised. Every window, including anomalous ones, is folded into
+// the baseline, so a lasting change becomes the new normal.
+
+package anomaly_alert_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    anomalyAlertPluginFactory
+	pluginName = "anomaly-alerts"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	defaultWindow          = time.Minute
+	defaultBaselineWindows = 30
+	defaultMinRequests     = 20
+)
+
+// defaultRouteName is the route of requests which match no configured route.
+const defaultRouteName = "default"
+
+// webhookTimeout bounds the time spent sending each alert to the webhook.
+const webhookTimeout = 10 * time.Second
+
+// The kinds of anomaly which are detected.
+const (
+	kindRequestRate = "request-rate"
+	kindErrorRate   = "error-rate"
+)
+
+// The states reported in alerts.
+const (
+	stateFiring   = "firing"
+	stateResolved = "resolved"
+)
+
+// ConfigRoute is the YAML structure of a route. Requests whose paths match
+// the Path regular expression are counted towards the route.
+type ConfigRoute struct {
+	Name string
+	Path string
+}
+
+type anomalyAlertPluginFactory struct{}
+
+func (f anomalyAlertPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f anomalyAlertPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &anomalyAlertPlugin{
+		window:          defaultWindow,
+		baselineWindows: defaultBaselineWindows,
+		minRequests:     defaultMinRequests,
+		clock:           clock.Real,
+		client:          &http.Client{Timeout: webhookTimeout},
+		stats:           map[string]*routeStats{},
+	}
+
+	if rateChange, err := config.LookupOptional[float64](configSection, "rate-change"); err != nil {
+		return nil, err
+	} else if rateChange != nil {
+		if *rateChange <= 1 {
+			return nil, fmt.Errorf(`Invalid rate-change "%v": must be greater than 1`, *rateChange)
+		}
+		plugin.rateChange = *rateChange
+	}
+	if increase, err := config.LookupOptional[float64](configSection, "error-rate-increase"); err != nil {
+		return nil, err
+	} else if increase != nil {
+		if *increase <= 0 || *increase >= 1 {
+			return nil, fmt.Errorf(`Invalid error-rate-increase "%v": must be between 0 and 1`, *increase)
+		}
+		plugin.errorRateIncrease = *increase
+	}
+	if plugin.rateChange == 0 && plugin.errorRateIncrease == 0 {
+		return nil, nil
+	}
+
+	if window, err := config.LookupOptional[time.Duration](configSection, "window"); err != nil {
+		return nil, err
+	} else if window != nil {
+		if *window <= 0 {
+			return nil, fmt.Errorf(`Invalid window "%v": must be positive`, *window)
+		}
+		plugin.window = *window
+	}
+	if baselineWindows, err := config.LookupOptional[int](configSection, "baseline-windows"); err != nil {
+		return nil, err
+	} else if baselineWindows != nil {
+		if *baselineWindows <= 0 {
+			return nil, fmt.Errorf(`Invalid baseline-windows "%v": must be positive`, *baselineWindows)
+		}
+		plugin.baselineWindows = *baselineWindows
+	}
+	if minRequests, err := config.LookupOptional[int](configSection, "min-requests"); err != nil {
+		return nil, err
+	} else if minRequests != nil {
+		if *minRequests < 0 {
+			return nil, fmt.Errorf(`Invalid min-requests "%v": must not be negative`, *minRequests)
+		}
+		plugin.minRequests = *minRequests
+	}
+
+	if err := config.ParseOptional(configSection, "webhook", func(key string, value string) error {
+		if webhookURL, err := url.Parse(value); err != nil || webhookURL.Scheme == "" || webhookURL.Host == "" {
+			return fmt.Errorf(`Invalid URL "%v" in option "webhook"`, value)
+		}
+		plugin.webhookURL = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "routes", func(key string, routes []ConfigRoute) error {
+		for _, configRoute := range routes {
+			if configRoute.Name == "" || configRoute.Path == "" {
+				return fmt.Errorf(`Route must include a Name and a Path property`)
+			}
+			if configRoute.Name == defaultRouteName {
+				return fmt.Errorf(`Route name "%v" is reserved for requests which match no route`, defaultRouteName)
+			}
+			path, err := regexp.Compile(configRoute.Path)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, configRoute.Path, err)
+			}
+			plugin.routes = append(plugin.routes, route{name: configRoute.Name, path: path})
+			logger.Printf("Added route %v for paths matching \"%s\"", configRoute.Name, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if plugin.rateChange > 0 {
+		logger.Printf("Alerting when request rates change by more than %vx", plugin.rateChange)
+	}
+	if plugin.errorRateIncrease > 0 {
+		logger.Printf("Alerting when error rates increase by more than %v", plugin.errorRateIncrease)
+	}
+	return plugin, nil
+}
+
+type anomalyAlertPlugin struct {
+	window            time.Duration
+	baselineWindows   int     // The number of windows the baselines average over.
+	minRequests       int     // Windows with fewer requests than this are too small to judge.
+	rateChange        float64 // The factor by which the request rate may change, or 0 to ignore it.
+	errorRateIncrease float64 // The amount by which the error rate may rise, or 0 to ignore it.
+	webhookURL        string
+	routes            []route
+
+	clock   clock.Clock
+	client  *http.Client
+	metrics *metrics.PluginMetrics
+
+	mutex       sync.Mutex
+	windowStart time.Time // The start of the current window, or zero before the first request.
+	stats       map[string]*routeStats
+}
+
+type route struct {
+	name string
+	path *regexp.Regexp
+}
+
+// routeStats holds a route's counts for the current window and its baselines.
+type routeStats struct {
+	requests int
+	errors   int
+
+	windows      int     // The number of windows folded into the baselines.
+	rate         float64 // The average number of requests per window.
+	errorRate    float64 // The average fraction of requests which failed.
+	rateFiring   bool
+	errorsFiring bool
+}
+
+// alert is the JSON structure POSTed to the webhook. Rates are per second.
+type alert struct {
+	Route         string    `json:"route"`
+	Kind          string    `json:"kind"`
+	State         string    `json:"state"`
+	Value         float64   `json:"value"`
+	Baseline      float64   `json:"baseline"`
+	WindowStart   time.Time `json:"window_start"`
+	WindowSeconds float64   `json:"window_seconds"`
+}
+
+func (plug *anomalyAlertPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *anomalyAlertPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *anomalyAlertPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+func (plug *anomalyAlertPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	return false
+}
+
+// HandleCompletion implements traffic.CompletionPlugin. It closes any windows
+// which have ended, then counts the request in the current one.
+func (plug *anomalyAlertPlugin) HandleCompletion(completion *traffic.RequestCompletion) {
+	now := plug.clock.Now()
+
+	plug.mutex.Lock()
+	alerts := plug.advance(now)
+	stats := plug.statsFor(plug.routeOf(completion.OriginalURL.Path))
+	stats.requests++
+	if completion.Status >= 500 {
+		stats.errors++
+	}
+	plug.mutex.Unlock()
+
+	for _, alert := range alerts {
+		plug.raise(alert)
+	}
+}
+
+func (plug *anomalyAlertPlugin) routeOf(path string) string {
+	for _, route := range plug.routes {
+		if route.path.MatchString(path) {
+			return route.name
+		}
+	}
+	return defaultRouteName
+}
+
+func (plug *anomalyAlertPlugin) statsFor(routeName string) *routeStats {
+	stats, ok := plug.stats[routeName]
+	if !ok {
+		stats = &routeStats{}
+		plug.stats[routeName] = stats
+	}
+	return stats
+}
+
+// advance closes every window which ended before now, returning the alerts
+// they raised. Windows without any requests are closed too, so that a drop in
+// traffic is noticed, but only enough of them to fill the baselines.
+func (plug *anomalyAlertPlugin) advance(now time.Time) []alert {
+	if plug.windowStart.IsZero() {
+		plug.windowStart = now
+		return nil
+	}
+	ended := int64(now.Sub(plug.windowStart) / plug.window)
+	if ended <= 0 {
+		return nil
+	}
+
+	alerts := []alert{}
+	for i := int64(0); i < ended && i <= int64(plug.baselineWindows); i++ {
+		windowStart := plug.windowStart.Add(time.Duration(i) * plug.window)
+		for routeName, stats := range plug.stats {
+			alerts = append(alerts, plug.closeWindow(routeName, stats, windowStart)...)
+		}
+	}
+	plug.windowStart = plug.windowStart.Add(time.Duration(ended) * plug.window)
+	return alerts
+}
+
+// closeWindow compares a route's counts for a window with its baselines, then
+// folds them into the baselines and resets them.
+func (plug *anomalyAlertPlugin) closeWindow(routeName string, stats *routeStats, windowStart time.Time) []alert {
+	alerts := []alert{}
+	newAlert := func(kind string, state string, value float64, baseline float64) alert {
+		return alert{
+			Route:         routeName,
+			Kind:          kind,
+			State:         state,
+			Value:         value,
+			Baseline:      baseline,
+			WindowStart:   windowStart,
+			WindowSeconds: plug.window.Seconds(),
+		}
+	}
+
+	rate := float64(stats.requests)
+	errorRate := 0.0
+	if stats.requests > 0 {
+		errorRate = float64(stats.errors) / float64(stats.requests)
+	}
+	warm := stats.windows >= plug.baselineWindows
+	large := stats.requests >= plug.minRequests
+
+	if plug.rateChange > 0 && warm {
+		perSecond := func(count float64) float64 { return count / plug.window.Seconds() }
+		anomalous := math.Max(rate, stats.rate) >= float64(plug.minRequests) &&
+			(rate > stats.rate*plug.rateChange || rate < stats.rate/plug.rateChange)
+		if anomalous && !stats.rateFiring {
+			alerts = append(alerts, newAlert(kindRequestRate, stateFiring, perSecond(rate), perSecond(stats.rate)))
+		} else if !anomalous && stats.rateFiring {
+			alerts = append(alerts, newAlert(kindRequestRate, stateResolved, perSecond(rate), perSecond(stats.rate)))
+		}
+		stats.rateFiring = anomalous
+	}
+
+	// Error rates in small windows are too noisy to judge, so they neither
+	// raise nor resolve alerts.
+	if plug.errorRateIncrease > 0 && warm && large {
+		anomalous := errorRate-stats.errorRate > plug.errorRateIncrease
+		if anomalous && !stats.errorsFiring {
+			alerts = append(alerts, newAlert(kindErrorRate, stateFiring, errorRate, stats.errorRate))
+		} else if !anomalous && stats.errorsFiring {
+			alerts = append(alerts, newAlert(kindErrorRate, stateResolved, errorRate, stats.errorRate))
+		}
+		stats.errorsFiring = anomalous
+	}
+
+	// Until the baselines are full, they're plain averages of the windows seen
+	// so far; afterwards, they're exponential moving averages.
+	weight := 2 / float64(plug.baselineWindows+1)
+	if !warm {
+		weight = 1 / float64(stats.windows+1)
+	}
+	stats.rate += weight * (rate - stats.rate)
+	if stats.requests > 0 {
+		stats.errorRate += weight * (errorRate - stats.errorRate)
+	}
+	stats.windows++
+	stats.requests = 0
+	stats.errors = 0
+	return alerts
+}
+
+// raise logs an alert and sends it to the webhook, if one is configured.
+func (plug *anomalyAlertPlugin) raise(alert alert) {
+	unit := "requests/s"
+	if alert.Kind == kindErrorRate {
+		unit = "of requests failed"
+	}
+	if alert.State == stateFiring {
+		logger.Warnf("Anomalous %v for route %v: %.3g %v, baseline %.3g", alert.Kind, alert.Route, alert.Value, unit, alert.Baseline)
+	} else {
+		logger.Printf("Resolved anomalous %v for route %v: %.3g %v, baseline %.3g", alert.Kind, alert.Route, alert.Value, unit, alert.Baseline)
+	}
+
+	if plug.webhookURL != "" {
+		go plug.sendWebhook(alert)
+	}
+}
+
+func (plug *anomalyAlertPlugin) sendWebhook(alert alert) {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		logger.Errorf("Error sending alert to webhook: %s", err)
+		plug.metrics.Error()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, plug.webhookURL, bytes.NewReader(data))
+	if err != nil {
+		logger.Errorf("Error sending alert to webhook: %s", err)
+		plug.metrics.Error()
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := plug.client.Do(request)
+	if err != nil {
+		logger.Errorf("Error sending alert to webhook: %s", err)
+		plug.metrics.Error()
+		return
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logger.Errorf("Error sending alert to webhook: status %v", response.StatusCode)
+		plug.metrics.Error()
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,211 @@
+package anomaly_alert_plugin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	anomaly_alert_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/anomaly-alert-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// anomalyWindow describes the requests completed during one window.
+type anomalyWindow struct {
+	path           string
+	requests       int
+	errors         int
+	expectedAlerts []string // "route kind state" for each alert raised when the window closes.
+}
+
+func TestAnomalyAlerts(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		config  string
+		windows []anomalyWindow
+	}{
+		{
+			desc: "Request rate spikes and drops raise and resolve alerts",
+			config: `anomaly-alerts:
+    rate-change: 3
+    baseline-windows: 3
+    min-requests: 5
+`,
+			windows: []anomalyWindow{
+				{path: "/", requests: 10},
+				{path: "/", requests: 10},
+				{path: "/", requests: 10},
+				{path: "/", requests: 40, expectedAlerts: []string{"default request-rate firing"}},
+				{path: "/", requests: 12, expectedAlerts: []string{"default request-rate resolved"}},
+				{path: "/", requests: 1, expectedAlerts: []string{"default request-rate firing"}},
+			},
+		},
+		{
+			desc: "Small changes don't raise alerts",
+			config: `anomaly-alerts:
+    rate-change: 3
+    baseline-windows: 3
+    min-requests: 5
+`,
+			windows: []anomalyWindow{
+				{path: "/", requests: 10},
+				{path: "/", requests: 10},
+				{path: "/", requests: 10},
+				{path: "/", requests: 25},
+				{path: "/", requests: 7},
+			},
+		},
+		{
+			desc: "Error rate increases raise alerts per route",
+			config: `anomaly-alerts:
+    error-rate-increase: 0.2
+    baseline-windows: 2
+    min-requests: 5
+    routes:
+      - name: ingest
+        path: ^/rec/
+`,
+			windows: []anomalyWindow{
+				{path: "/rec/bundle", requests: 10, errors: 1},
+				{path: "/rec/bundle", requests: 10, errors: 1},
+				{path: "/rec/bundle", requests: 10, errors: 6, expectedAlerts: []string{"ingest error-rate firing"}},
+				{path: "/other", requests: 10},
+				{path: "/rec/bundle", requests: 10, errors: 1, expectedAlerts: []string{"ingest error-rate resolved"}},
+			},
+		},
+		{
+			desc: "Alerts wait for the baseline",
+			config: `anomaly-alerts:
+    rate-change: 2
+    baseline-windows: 3
+    min-requests: 5
+`,
+			windows: []anomalyWindow{
+				{path: "/", requests: 10},
+				{path: "/", requests: 100},
+				{path: "/", requests: 10},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		alerts := make(chan map[string]interface{}, 100)
+		webhook := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			alert := map[string]interface{}{}
+			if err := json.NewDecoder(request.Body).Decode(&alert); err != nil {
+				t.Errorf("Test '%v': Error decoding alert: %v", testCase.desc, err)
+			}
+			alerts <- alert
+		}))
+
+		configFile, err := config.NewFileFromYamlString(testCase.config + "    webhook: " + webhook.URL + "\n")
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			webhook.Close()
+			continue
+		}
+		plugin, err := anomaly_alert_plugin.Factory.New(configFile.LookupOptionalSection("anomaly-alerts"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			webhook.Close()
+			continue
+		}
+		fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+		plugin.(traffic.ClockPlugin).SetClock(fakeClock)
+		completionPlugin := plugin.(traffic.CompletionPlugin)
+
+		complete := func(path string, status int) {
+			completionPlugin.HandleCompletion(&traffic.RequestCompletion{
+				OriginalURL: &url.URL{Path: path},
+				Status:      status,
+			})
+		}
+
+		expectAlerts := func(i int, expectedAlerts []string) {
+			for _, expected := range expectedAlerts {
+				select {
+				case alert := <-alerts:
+					if got := alert["route"].(string) + " " + alert["kind"].(string) + " " + alert["state"].(string); got != expected {
+						t.Errorf("Test '%v': Window %v: Expected alert '%v' but got '%v'", testCase.desc, i, expected, got)
+					}
+				case <-time.After(5 * time.Second):
+					t.Errorf("Test '%v': Window %v: Expected alert '%v' but got none", testCase.desc, i, expected)
+				}
+			}
+			select {
+			case alert := <-alerts:
+				t.Errorf("Test '%v': Window %v: Unexpected alert %v", testCase.desc, i, alert)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		// Each window is closed by the first request of the next one.
+		for i, window := range testCase.windows {
+			for j := 0; j < window.requests; j++ {
+				status := http.StatusOK
+				if j < window.errors {
+					status = http.StatusInternalServerError
+				}
+				complete(window.path, status)
+			}
+			if i > 0 {
+				expectAlerts(i-1, testCase.windows[i-1].expectedAlerts)
+			}
+			fakeClock.Advance(time.Minute)
+		}
+		complete("/", http.StatusOK)
+		expectAlerts(len(testCase.windows)-1, testCase.windows[len(testCase.windows)-1].expectedAlerts)
+
+		webhook.Close()
+	}
+}
+
+func TestAnomalyAlertConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"rate-change: 1",
+		"rate-change: fast",
+		"error-rate-increase: 0",
+		"error-rate-increase: 1.5",
+		"rate-change: 2\n    window: 0s",
+		"rate-change: 2\n    baseline-windows: 0",
+		"rate-change: 2\n    min-requests: -1",
+		"rate-change: 2\n    webhook: not-a-url",
+		"rate-change: 2\n    routes:\n      - name: ingest",
+		"rate-change: 2\n    routes:\n      - name: default\n        path: ^/",
+		"rate-change: 2\n    routes:\n      - name: ingest\n        path: '('",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("anomaly-alerts:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := anomaly_alert_plugin.Factory.New(configFile.LookupOptionalSection("anomaly-alerts")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
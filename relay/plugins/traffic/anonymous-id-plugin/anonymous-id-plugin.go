@@ -0,0 +1,199 @@
+// This plugin replaces the identifiers which could be used to track a client,
+// like its IP address and User-Agent, with a derived anonymous ID. The ID is
+// an HMAC of the identifiers, keyed with a salt which rotates on a configurable
+// schedule; within a rotation period, requests from the same client share an
+// ID, so the target can still correlate them, but IDs can't be linked across
+// periods or reversed to recover the identifiers.
+//
+// Salts are derived from a configured secret rather than generated randomly, so
+// every relay sharing the secret derives the same IDs. By default, IDs are
+// derived from the client's IP address and User-Agent; alternatively, they can
+// be derived from a header, like one containing a user ID.
+
+package anonymous_id_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    anonymousIdPluginFactory
+	pluginName = "anonymous-id"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	defaultHeader       = "X-Anonymous-Id"
+	defaultSaltRotation = 24 * time.Hour
+)
+
+// clientAddressHeaders are headers which may carry the client's IP address.
+// They're removed when IDs are derived from the client's address, since
+// they'd otherwise reveal it.
+var clientAddressHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"}
+
+type anonymousIdPluginFactory struct{}
+
+func (f anonymousIdPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f anonymousIdPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &anonymousIdPlugin{
+		header:       defaultHeader,
+		saltRotation: defaultSaltRotation,
+		clock:        clock.Real,
+	}
+
+	if secret, err := config.LookupOptional[string](configSection, "secret"); err != nil {
+		return nil, err
+	} else if secret == nil {
+		return nil, nil
+	} else if len(*secret) < 16 {
+		return nil, fmt.Errorf(`Invalid secret: must be at least 16 characters long`)
+	} else {
+		plugin.secret = []byte(*secret)
+	}
+
+	if header, err := config.LookupOptional[string](configSection, "header"); err != nil {
+		return nil, err
+	} else if header != nil {
+		plugin.header = http.CanonicalHeaderKey(*header)
+	}
+
+	if sourceHeader, err := config.LookupOptional[string](configSection, "source-header"); err != nil {
+		return nil, err
+	} else if sourceHeader != nil {
+		plugin.sourceHeader = http.CanonicalHeaderKey(*sourceHeader)
+	}
+
+	if saltRotation, err := config.LookupOptional[time.Duration](configSection, "salt-rotation"); err != nil {
+		return nil, err
+	} else if saltRotation != nil {
+		if *saltRotation < time.Minute {
+			return nil, fmt.Errorf(`Invalid salt-rotation "%v": must be at least 1m`, *saltRotation)
+		}
+		plugin.saltRotation = *saltRotation
+	}
+
+	if plugin.sourceHeader != "" {
+		logger.Printf(`Added rule: derive "%s" from "%s", rotating salts every %v`, plugin.header, plugin.sourceHeader, plugin.saltRotation)
+	} else {
+		logger.Printf(`Added rule: derive "%s" from the client's address and User-Agent, rotating salts every %v`, plugin.header, plugin.saltRotation)
+	}
+
+	return plugin, nil
+}
+
+type anonymousIdPlugin struct {
+	secret       []byte        // The secret from which salts are derived.
+	header       string        // The header in which the anonymous ID is sent to the target.
+	sourceHeader string        // If set, IDs are derived from this header rather than the client's address.
+	saltRotation time.Duration // How often the salt changes.
+	clock        clock.Clock
+}
+
+func (plug *anonymousIdPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *anonymousIdPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *anonymousIdPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	// Never relay an ID supplied by the client.
+	request.Header.Del(plug.header)
+
+	var identifiers []string
+	if plug.sourceHeader != "" {
+		if value := request.Header.Get(plug.sourceHeader); value != "" {
+			identifiers = []string{value}
+		}
+		request.Header.Del(plug.sourceHeader)
+	} else {
+		identifiers = []string{clientIP(request), request.UserAgent()}
+		for _, header := range clientAddressHeaders {
+			request.Header.Del(header)
+		}
+		// An empty User-Agent, unlike a missing one, keeps the transport from
+		// sending its default.
+		request.Header.Set("User-Agent", "")
+		request.RemoteAddr = ""
+	}
+
+	if identifiers != nil {
+		request.Header.Set(plug.header, plug.deriveID(plug.clock.Now(), identifiers))
+	}
+	return false
+}
+
+// deriveID returns the anonymous ID for the provided identifiers at a point in
+// time.
+func (plug *anonymousIdPlugin) deriveID(now time.Time, identifiers []string) string {
+	mac := hmac.New(sha256.New, plug.salt(now))
+	for _, identifier := range identifiers {
+		// Length-prefix each identifier so that different splits of the same
+		// bytes produce different IDs.
+		binary.Write(mac, binary.BigEndian, uint32(len(identifier)))
+		mac.Write([]byte(identifier))
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// salt returns the salt for the rotation period containing the provided time.
+// Periods are aligned to the Unix epoch, so daily salts rotate at midnight UTC.
+func (plug *anonymousIdPlugin) salt(now time.Time) []byte {
+	period := now.UnixNano() / int64(plug.saltRotation)
+	mac := hmac.New(sha256.New, plug.secret)
+	binary.Write(mac, binary.BigEndian, period)
+	return mac.Sum(nil)
+}
+
+// clientIP returns the IP address of the client which sent the request.
+func clientIP(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,231 @@
+package anonymous_id_plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	anonymous_id_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/anonymous-id-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+const ipConfig = `anonymous-id:
+    secret: 0123456789abcdef0123456789abcdef
+`
+
+const headerConfig = `anonymous-id:
+    secret: 0123456789abcdef0123456789abcdef
+    header: X-Visitor
+    source-header: X-User-Id
+`
+
+func TestAnonymousIdPlugin(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		config            string
+		firstHeaders      map[string]string
+		secondHeaders     map[string]string
+		expectedHeader    string
+		expectSameId      bool
+		expectedAbsent    []string
+		expectedUnchanged []string
+	}{
+		{
+			desc:         "IDs are derived from the client's address and User-Agent",
+			config:       ipConfig,
+			firstHeaders: map[string]string{"User-Agent": "agent-a", "Accept": "text/plain"},
+			secondHeaders: map[string]string{
+				"User-Agent":      "agent-a",
+				"Accept":          "text/plain",
+				"X-Forwarded-For": "192.168.0.1",
+				"X-Anonymous-Id":  "forged",
+			},
+			expectedHeader:    "X-Anonymous-Id",
+			expectSameId:      true,
+			expectedAbsent:    []string{"User-Agent", "X-Forwarded-For", "X-Forwarded-Port", "X-Real-Ip", "Forwarded"},
+			expectedUnchanged: []string{"Accept"},
+		},
+		{
+			desc:           "Different User-Agents produce different IDs",
+			config:         ipConfig,
+			firstHeaders:   map[string]string{"User-Agent": "agent-a"},
+			secondHeaders:  map[string]string{"User-Agent": "agent-b"},
+			expectedHeader: "X-Anonymous-Id",
+			expectSameId:   false,
+			expectedAbsent: []string{"User-Agent", "X-Forwarded-For"},
+		},
+		{
+			desc:              "IDs can be derived from a header",
+			config:            headerConfig,
+			firstHeaders:      map[string]string{"X-User-Id": "user-1", "User-Agent": "agent-a"},
+			secondHeaders:     map[string]string{"X-User-Id": "user-1", "User-Agent": "agent-b"},
+			expectedHeader:    "X-Visitor",
+			expectSameId:      true,
+			expectedAbsent:    []string{"X-User-Id"},
+			expectedUnchanged: []string{"User-Agent"},
+		},
+		{
+			desc:           "Different header values produce different IDs",
+			config:         headerConfig,
+			firstHeaders:   map[string]string{"X-User-Id": "user-1"},
+			secondHeaders:  map[string]string{"X-User-Id": "user-2"},
+			expectedHeader: "X-Visitor",
+			expectSameId:   false,
+			expectedAbsent: []string{"X-User-Id"},
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		anonymous_id_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			var ids []string
+			for _, headers := range []map[string]string{testCase.firstHeaders, testCase.secondHeaders} {
+				request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+				if err != nil {
+					t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+					return
+				}
+				for headerName, headerValue := range headers {
+					request.Header.Set(headerName, headerValue)
+				}
+
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+					return
+				}
+				response.Body.Close()
+
+				lastRequest, err := catcherService.LastRequest()
+				if err != nil {
+					t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+					return
+				}
+
+				id := lastRequest.Header.Values(testCase.expectedHeader)
+				if len(id) != 1 || len(id[0]) != 32 || id[0] == "forged" {
+					t.Errorf("Test '%v': Expected one derived ID in '%v' but got %v", testCase.desc, testCase.expectedHeader, id)
+				} else {
+					ids = append(ids, id[0])
+				}
+				for _, headerName := range testCase.expectedAbsent {
+					if values := lastRequest.Header.Values(headerName); len(values) != 0 {
+						t.Errorf("Test '%v': Expected no '%v' header but got %v", testCase.desc, headerName, values)
+					}
+				}
+				for _, headerName := range testCase.expectedUnchanged {
+					if value := lastRequest.Header.Get(headerName); value != headers[headerName] {
+						t.Errorf("Test '%v': Expected '%v' header '%v' but got '%v'", testCase.desc, headerName, headers[headerName], value)
+					}
+				}
+			}
+
+			if len(ids) == 2 && (ids[0] == ids[1]) != testCase.expectSameId {
+				t.Errorf("Test '%v': Expected same ID to be %v, but got IDs '%v' and '%v'", testCase.desc, testCase.expectSameId, ids[0], ids[1])
+			}
+		})
+	}
+}
+
+func TestAnonymousIdSaltRotation(t *testing.T) {
+	var lastID string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		lastID = request.Header.Get("X-Anonymous-Id")
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	configFile, err := config.NewFileFromYamlString(ipConfig + "    salt-rotation: 1h\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := anonymous_id_plugin.Factory.New(configFile.LookupOptionalSection("anonymous-id"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+
+	fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.Clock = fakeClock
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+	defer relayServer.Close()
+
+	get := func() string {
+		response, err := http.Get(relayServer.URL)
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+		return lastID
+	}
+
+	first := get()
+	fakeClock.Advance(59 * time.Minute)
+	if id := get(); id != first {
+		t.Errorf("Expected ID '%v' within the same rotation period but got '%v'", first, id)
+	}
+	fakeClock.Advance(time.Minute)
+	if id := get(); id == first {
+		t.Errorf("Expected a new ID after the salt rotated but got '%v' again", id)
+	}
+}
+
+func TestAnonymousIdConfigValidation(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+	}{
+		{
+			desc: "Short secrets are rejected",
+			config: `anonymous-id:
+    secret: short
+`,
+		},
+		{
+			desc:   "Short rotation periods are rejected",
+			config: ipConfig + "    salt-rotation: 1s\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		if _, err := anonymous_id_plugin.Factory.New(configFile.LookupOptionalSection("anonymous-id")); err == nil {
+			t.Errorf("Test '%v': Expected an error", testCase.desc)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,425 @@
+// This plugin only relays requests which carry a valid API key, and limits the
+// rate at which each key may be used. Keys are listed in the configuration, in
+// a file which is re-read when it changes, or both; each has a name, which
+// identifies it in logs and usage reports without revealing it, and may have
+// its own rate limit. Requests without a valid key are rejected with a 401,
+// and requests over their key's limit with a 429 and a Retry-After header.
+//
+// The key is read from a header or, optionally, a query parameter. It's
+// removed from relayed requests, which instead carry the key's name in the
+// KeyNameHeaderName header, so the target can tell clients apart without
+// holding their keys.
+//
+// The number of requests made with each key is served on the admin listener,
+// at "/plugins/api-keys/usage".
+
+package api_keys_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	Factory    apiKeysPluginFactory
+	pluginName = "api-keys"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// KeyNameHeaderName is the request header in which the name of the client's
+// key is sent to the target.
+const KeyNameHeaderName = "X-Relay-Api-Key-Name"
+
+// UsagePath is the path, relative to the plugin's admin endpoints, at which
+// the usage of each key is served.
+const UsagePath = "/usage"
+
+const defaultHeader = "X-Api-Key"
+
+// ConfigKey is an API key which clients may use. If RequestsPerSecond is zero,
+// the plugin's default limit applies.
+type ConfigKey struct {
+	Name              string
+	Key               string
+	RequestsPerSecond float64 `yaml:"requests-per-second"`
+	Burst             int
+}
+
+// KeyUsage reports how much a key has been used since the relay started.
+type KeyUsage struct {
+	Name        string     `json:"name"`
+	Requests    int64      `json:"requests"`     // Requests which were allowed.
+	RateLimited int64      `json:"rate_limited"` // Requests rejected for exceeding the key's limit.
+	LastRequest *time.Time `json:"last_request,omitempty"`
+}
+
+// UsageResponse is the body of the usage endpoint's responses.
+type UsageResponse struct {
+	Keys []*KeyUsage `json:"keys"`
+}
+
+type apiKeysPluginFactory struct{}
+
+func (f apiKeysPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f apiKeysPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &apiKeysPlugin{
+		header: defaultHeader,
+		clock:  clock.Real,
+		usage:  map[string]*keyUsage{},
+	}
+
+	if err := config.ParseOptional(configSection, "keys", func(key string, keys []ConfigKey) error {
+		plugin.configKeys = keys
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if keysFile, err := config.LookupOptional[string](configSection, "keys-file"); err != nil {
+		return nil, err
+	} else if keysFile != nil {
+		plugin.keysFile = *keysFile
+	}
+
+	if rate, err := config.LookupOptional[float64](configSection, "requests-per-second"); err != nil {
+		return nil, err
+	} else if rate != nil {
+		if *rate <= 0 {
+			return nil, fmt.Errorf(`Invalid requests-per-second "%v": must be positive`, *rate)
+		}
+		plugin.defaultLimit.rate = *rate
+	}
+	if burst, err := config.LookupOptional[int](configSection, "burst"); err != nil {
+		return nil, err
+	} else if burst != nil {
+		if *burst < 1 {
+			return nil, fmt.Errorf(`Invalid burst "%v": must be at least 1`, *burst)
+		}
+		if plugin.defaultLimit.rate == 0 {
+			return nil, fmt.Errorf(`Option "burst" requires "requests-per-second"`)
+		}
+		plugin.defaultLimit.burst = float64(*burst)
+	}
+
+	if header, err := config.LookupOptional[string](configSection, "header"); err != nil {
+		return nil, err
+	} else if header != nil {
+		plugin.header = http.CanonicalHeaderKey(*header)
+	}
+	if queryParam, err := config.LookupOptional[string](configSection, "query-param"); err != nil {
+		return nil, err
+	} else if queryParam != nil {
+		plugin.queryParam = *queryParam
+	}
+
+	if plugin.configKeys == nil && plugin.keysFile == "" {
+		return nil, nil
+	}
+	// Read the keys now, so that mistakes are reported at startup.
+	if err := plugin.loadKeys(); err != nil {
+		return nil, err
+	}
+
+	logger.Printf(`Added rule: require one of %v API keys in "%v"`, len(plugin.keys), plugin.header)
+	return plugin, nil
+}
+
+type apiKeysPlugin struct {
+	configKeys   []ConfigKey
+	keysFile     string    // If set, a YAML file listing further keys.
+	defaultLimit rateLimit // The limit of keys which don't have their own.
+	header       string
+	queryParam   string // If set, keys may be sent in this query parameter instead.
+	clock        clock.Clock
+
+	mutex       sync.Mutex
+	keys        map[string]*apiKey   // By key.
+	usage       map[string]*keyUsage // By name; kept when keys are reloaded.
+	keysModTime time.Time            // The modification time of keysFile when it was last read.
+}
+
+// rateLimit is the rate at which a key may be used; a zero rate means that it
+// isn't limited.
+type rateLimit struct {
+	rate  float64 // Requests per second.
+	burst float64
+}
+
+type apiKey struct {
+	name  string
+	limit rateLimit
+}
+
+// keyUsage counts a key's requests, and holds its token bucket. Rather than
+// being refilled continuously, the bucket is refilled lazily, based on the
+// time since it was last updated.
+type keyUsage struct {
+	requests    int64
+	rateLimited int64
+	lastRequest time.Time
+
+	tokens  float64
+	updated time.Time
+}
+
+func (plug *apiKeysPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *apiKeysPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *apiKeysPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	presented := plug.presentedKey(request)
+	if presented == "" {
+		http.Error(response, "Missing API key", http.StatusUnauthorized)
+		return true
+	}
+	name, allowed, retryAfter := plug.use(presented)
+	if name == "" {
+		logger.Printf("%s %s: rejected: invalid API key", request.Method, request.URL.Path)
+		http.Error(response, "Invalid API key", http.StatusUnauthorized)
+		return true
+	}
+	if !allowed {
+		response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(response, "Too many requests", http.StatusTooManyRequests)
+		return true
+	}
+
+	// The target learns which key was used, but never the key itself.
+	request.Header.Del(plug.header)
+	if plug.queryParam != "" {
+		query := request.URL.Query()
+		if query.Has(plug.queryParam) {
+			query.Del(plug.queryParam)
+			request.URL.RawQuery = query.Encode()
+		}
+	}
+	request.Header.Set(KeyNameHeaderName, name)
+	return false
+}
+
+// presentedKey returns the key which the client sent, or "" if there isn't
+// one.
+func (plug *apiKeysPlugin) presentedKey(request *http.Request) string {
+	if value := request.Header.Get(plug.header); value != "" {
+		return value
+	}
+	if plug.queryParam != "" {
+		return request.URL.Query().Get(plug.queryParam)
+	}
+	return ""
+}
+
+// use records a request made with a key. It returns the key's name, or "" if
+// the key isn't valid, and whether the request is within the key's limit; if
+// it isn't, it also returns how long the client must wait.
+func (plug *apiKeysPlugin) use(presented string) (string, bool, time.Duration) {
+	if plug.keysFile != "" {
+		if err := plug.loadKeys(); err != nil {
+			logger.Errorf("Error reloading API keys, using the last keys read: %v", err)
+		}
+	}
+
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	key := plug.keys[presented]
+	if key == nil {
+		return "", false, 0
+	}
+	usage := plug.usage[key.name]
+	if usage == nil {
+		usage = &keyUsage{}
+		plug.usage[key.name] = usage
+	}
+
+	now := plug.clock.Now()
+	if limit := key.limit; limit.rate > 0 {
+		if usage.updated.IsZero() {
+			usage.tokens = limit.burst
+		} else if elapsed := now.Sub(usage.updated); elapsed > 0 {
+			usage.tokens = math.Min(limit.burst, usage.tokens+elapsed.Seconds()*limit.rate)
+		}
+		usage.updated = now
+		if usage.tokens < 1 {
+			usage.rateLimited++
+			return key.name, false, time.Duration((1 - usage.tokens) / limit.rate * float64(time.Second))
+		}
+		usage.tokens--
+	}
+	usage.requests++
+	usage.lastRequest = now
+	return key.name, true, 0
+}
+
+// loadKeys reads the keys from the configuration and, if it has changed since
+// it was last read, the keys file. If the keys are invalid, the previous keys
+// remain in use.
+func (plug *apiKeysPlugin) loadKeys() error {
+	var modTime time.Time
+	configKeys := plug.configKeys
+	if plug.keysFile != "" {
+		info, err := os.Stat(plug.keysFile)
+		if err != nil {
+			return fmt.Errorf("Error reading keys file: %v", err)
+		}
+		modTime = info.ModTime()
+
+		plug.mutex.Lock()
+		unchanged := plug.keys != nil && modTime.Equal(plug.keysModTime)
+		plug.mutex.Unlock()
+		if unchanged {
+			return nil
+		}
+
+		data, err := os.ReadFile(plug.keysFile)
+		if err != nil {
+			return fmt.Errorf("Error reading keys file: %v", err)
+		}
+		var fileKeys []ConfigKey
+		if err := yaml.Unmarshal(data, &fileKeys); err != nil {
+			return fmt.Errorf("Error parsing keys file %v: %v", plug.keysFile, err)
+		}
+		configKeys = append(append([]ConfigKey(nil), configKeys...), fileKeys...)
+	}
+
+	keys := map[string]*apiKey{}
+	names := map[string]bool{}
+	for _, configKey := range configKeys {
+		if configKey.Name == "" {
+			return fmt.Errorf(`API key must include a "name" property`)
+		}
+		if configKey.Key == "" {
+			return fmt.Errorf(`API key "%v" must include a "key" property`, configKey.Name)
+		}
+		if names[configKey.Name] {
+			return fmt.Errorf(`More than one API key is named "%v"`, configKey.Name)
+		}
+		if keys[configKey.Key] != nil {
+			return fmt.Errorf(`API keys "%v" and "%v" are the same`, keys[configKey.Key].name, configKey.Name)
+		}
+		limit, err := plug.limitFor(configKey)
+		if err != nil {
+			return err
+		}
+		names[configKey.Name] = true
+		keys[configKey.Key] = &apiKey{name: configKey.Name, limit: limit}
+	}
+
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+	if plug.keys != nil {
+		logger.Printf("Reloaded %v API keys", len(keys))
+	}
+	plug.keys = keys
+	plug.keysModTime = modTime
+	return nil
+}
+
+// limitFor returns the rate limit of a key.
+func (plug *apiKeysPlugin) limitFor(configKey ConfigKey) (rateLimit, error) {
+	if configKey.RequestsPerSecond < 0 {
+		return rateLimit{}, fmt.Errorf(`Invalid requests-per-second "%v" for API key "%v": must be positive`, configKey.RequestsPerSecond, configKey.Name)
+	}
+	if configKey.Burst < 0 || (configKey.Burst > 0 && configKey.RequestsPerSecond == 0) {
+		return rateLimit{}, fmt.Errorf(`Invalid burst "%v" for API key "%v": must be at least 1, with requests-per-second`, configKey.Burst, configKey.Name)
+	}
+
+	limit := plug.defaultLimit
+	if configKey.RequestsPerSecond > 0 {
+		limit = rateLimit{rate: configKey.RequestsPerSecond, burst: float64(configKey.Burst)}
+	}
+	if limit.rate > 0 && limit.burst == 0 {
+		// By default, clients may send a second's worth of requests at once.
+		limit.burst = math.Max(1, math.Ceil(limit.rate))
+	}
+	return limit, nil
+}
+
+// AdminHandler implements traffic.AdminPlugin, serving the usage of each key
+// at UsagePath.
+func (plug *apiKeysPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(UsagePath, func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			response.Header().Set("Allow", "GET, HEAD")
+			http.Error(response, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(plug.report()); err != nil {
+			logger.Errorf("Error writing API key usage: %v", err)
+		}
+	})
+	return mux
+}
+
+// report returns the usage of each current key, ordered by name.
+func (plug *apiKeysPlugin) report() *UsageResponse {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	report := &UsageResponse{Keys: []*KeyUsage{}}
+	for _, key := range plug.keys {
+		keyReport := &KeyUsage{Name: key.name}
+		if usage := plug.usage[key.name]; usage != nil {
+			keyReport.Requests = usage.requests
+			keyReport.RateLimited = usage.rateLimited
+			if !usage.lastRequest.IsZero() {
+				lastRequest := usage.lastRequest
+				keyReport.LastRequest = &lastRequest
+			}
+		}
+		report.Keys = append(report.Keys, keyReport)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		return report.Keys[i].Name < report.Keys[j].Name
+	})
+	return report
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,267 @@
+package api_keys_plugin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	api_keys_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/api-keys-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type apiKeyStep struct {
+	advance            time.Duration // How long to wait before sending the request.
+	header             string        // The X-Api-Key header.
+	query              string        // The query string.
+	expectedStatus     int
+	expectedRetryAfter string
+	expectedKeyName    string // The key name which the target should receive.
+}
+
+func TestApiKeysPlugin(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		config        string
+		steps         []apiKeyStep
+		expectedUsage []api_keys_plugin.KeyUsage
+	}{
+		{
+			desc: "Requests need a valid key",
+			config: `api-keys:
+    keys:
+        - name: acme
+          key: acme-key
+        - name: globex
+          key: globex-key
+`,
+			steps: []apiKeyStep{
+				{expectedStatus: http.StatusUnauthorized},
+				{header: "wrong-key", expectedStatus: http.StatusUnauthorized},
+				{header: "acme-key", expectedStatus: http.StatusOK, expectedKeyName: "acme"},
+				{header: "globex-key", expectedStatus: http.StatusOK, expectedKeyName: "globex"},
+				{header: "acme-key", expectedStatus: http.StatusOK, expectedKeyName: "acme"},
+			},
+			expectedUsage: []api_keys_plugin.KeyUsage{
+				{Name: "acme", Requests: 2},
+				{Name: "globex", Requests: 1},
+			},
+		},
+		{
+			desc: "Keys can be sent in a query parameter",
+			config: `api-keys:
+    query-param: api_key
+    keys:
+        - name: acme
+          key: acme-key
+`,
+			steps: []apiKeyStep{
+				{query: "api_key=wrong-key", expectedStatus: http.StatusUnauthorized},
+				{query: "api_key=acme-key&page=2", expectedStatus: http.StatusOK, expectedKeyName: "acme"},
+			},
+			expectedUsage: []api_keys_plugin.KeyUsage{
+				{Name: "acme", Requests: 1},
+			},
+		},
+		{
+			desc: "Each key has its own limit",
+			config: `api-keys:
+    requests-per-second: 1
+    keys:
+        - name: acme
+          key: acme-key
+        - name: globex
+          key: globex-key
+          requests-per-second: 2
+          burst: 3
+`,
+			steps: []apiKeyStep{
+				{header: "acme-key", expectedStatus: http.StatusOK, expectedKeyName: "acme"},
+				{header: "acme-key", expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{header: "globex-key", expectedStatus: http.StatusOK, expectedKeyName: "globex"},
+				{header: "globex-key", expectedStatus: http.StatusOK, expectedKeyName: "globex"},
+				{header: "globex-key", expectedStatus: http.StatusOK, expectedKeyName: "globex"},
+				{header: "globex-key", expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{advance: time.Second, header: "acme-key", expectedStatus: http.StatusOK, expectedKeyName: "acme"},
+			},
+			expectedUsage: []api_keys_plugin.KeyUsage{
+				{Name: "acme", Requests: 2, RateLimited: 1},
+				{Name: "globex", Requests: 3, RateLimited: 1},
+			},
+		},
+	}
+
+	var lastRequest *http.Request
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		lastRequest = request
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := api_keys_plugin.Factory.New(configFile.LookupOptionalSection("api-keys"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+
+		fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		options.Clock = fakeClock
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+
+		for i, step := range testCase.steps {
+			fakeClock.Advance(step.advance)
+			lastRequest = nil
+			request, _ := http.NewRequest("GET", relayServer.URL+"/?"+step.query, nil)
+			if step.header != "" {
+				request.Header.Set("X-Api-Key", step.header)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Step %v: Error GETing: %v", testCase.desc, i, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != step.expectedStatus {
+				t.Errorf("Test '%v': Step %v: Expected status %v but got %v", testCase.desc, i, step.expectedStatus, response.StatusCode)
+			}
+			if retryAfter := response.Header.Get("Retry-After"); retryAfter != step.expectedRetryAfter {
+				t.Errorf("Test '%v': Step %v: Expected Retry-After '%v' but got '%v'", testCase.desc, i, step.expectedRetryAfter, retryAfter)
+			}
+			if step.expectedKeyName == "" {
+				if lastRequest != nil {
+					t.Errorf("Test '%v': Step %v: Expected the request not to be relayed", testCase.desc, i)
+				}
+				continue
+			}
+			if lastRequest == nil {
+				t.Errorf("Test '%v': Step %v: Expected the request to be relayed", testCase.desc, i)
+				continue
+			}
+			if name := lastRequest.Header.Get(api_keys_plugin.KeyNameHeaderName); name != step.expectedKeyName {
+				t.Errorf("Test '%v': Step %v: Expected key name '%v' but got '%v'", testCase.desc, i, step.expectedKeyName, name)
+			}
+			if lastRequest.Header.Get("X-Api-Key") != "" || lastRequest.URL.Query().Has("api_key") {
+				t.Errorf("Test '%v': Step %v: Expected the key not to be relayed, but got %v", testCase.desc, i, lastRequest.URL)
+			}
+		}
+
+		usage := readUsage(t, plugin)
+		for _, keyUsage := range usage.Keys {
+			keyUsage.LastRequest = nil
+		}
+		expectedUsage := []*api_keys_plugin.KeyUsage{}
+		for i := range testCase.expectedUsage {
+			expectedUsage = append(expectedUsage, &testCase.expectedUsage[i])
+		}
+		if !reflect.DeepEqual(usage.Keys, expectedUsage) {
+			t.Errorf("Test '%v': Expected usage %+v but got %+v", testCase.desc, testCase.expectedUsage, usage.Keys)
+		}
+
+		relayServer.Close()
+	}
+}
+
+func TestApiKeysFile(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeys := func(keys string, modTime time.Time) {
+		if err := os.WriteFile(keysFile, []byte(keys), 0o600); err != nil {
+			t.Fatalf("Error writing keys file: %v", err)
+		}
+		// Make sure the change is noticed, however coarse the filesystem's
+		// timestamps are.
+		if err := os.Chtimes(keysFile, modTime, modTime); err != nil {
+			t.Fatalf("Error setting keys file time: %v", err)
+		}
+	}
+	writeKeys("- name: acme\n  key: acme-key\n", time.Now().Add(-time.Hour))
+
+	configFile, err := config.NewFileFromYamlString("api-keys:\n    keys-file: " + keysFile + "\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := api_keys_plugin.Factory.New(configFile.LookupOptionalSection("api-keys"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+
+	status := func(key string) int {
+		request := httptest.NewRequest("GET", "http://relay/", nil)
+		request.Header.Set("X-Api-Key", key)
+		recorder := httptest.NewRecorder()
+		if !plugin.HandleRequest(recorder, request, traffic.RequestInfo{}) {
+			return http.StatusOK
+		}
+		return recorder.Code
+	}
+
+	if code := status("acme-key"); code != http.StatusOK {
+		t.Errorf("Expected the key from the file to be accepted, but got status %v", code)
+	}
+
+	writeKeys("- name: globex\n  key: globex-key\n", time.Now())
+	if code := status("acme-key"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the removed key to be rejected, but got status %v", code)
+	}
+	if code := status("globex-key"); code != http.StatusOK {
+		t.Errorf("Expected the added key to be accepted, but got status %v", code)
+	}
+
+	// Invalid files are ignored, and the last keys stay in use.
+	writeKeys("- name: globex\n", time.Now().Add(time.Hour))
+	if code := status("globex-key"); code != http.StatusOK {
+		t.Errorf("Expected the last valid keys to remain in use, but got status %v", code)
+	}
+}
+
+func TestApiKeysConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"keys: acme-key",
+		"keys:\n        - key: acme-key",
+		"keys:\n        - name: acme",
+		"keys:\n        - name: acme\n          key: a\n        - name: acme\n          key: b",
+		"keys:\n        - name: acme\n          key: a\n        - name: globex\n          key: a",
+		"keys:\n        - name: acme\n          key: a\n          requests-per-second: -1",
+		"keys:\n        - name: acme\n          key: a\n          burst: 5",
+		"keys-file: /nonexistent/keys.yaml",
+		"requests-per-second: 0\n    keys: []",
+		"burst: 5\n    keys: []",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("api-keys:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := api_keys_plugin.Factory.New(configFile.LookupOptionalSection("api-keys")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func readUsage(t *testing.T, plugin traffic.Plugin) *api_keys_plugin.UsageResponse {
+	recorder := httptest.NewRecorder()
+	plugin.(traffic.AdminPlugin).AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", api_keys_plugin.UsagePath, nil))
+	usage := &api_keys_plugin.UsageResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(usage); err != nil {
+		t.Errorf("Error decoding usage: %v", err)
+	}
+	return usage
+}
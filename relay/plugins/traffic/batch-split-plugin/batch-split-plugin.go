@@ -0,0 +1,247 @@
+// This plugin splits oversized JSON array bodies into several requests to the
+// target, for targets which limit the size of the requests they accept. Each
+// request carries a contiguous run of the array's elements, in their original
+// order, and the requests are sent one at a time, so the target receives the
+// elements in the order the client sent them.
+//
+// The client receives the target's response to the last request, or, if any
+// request fails, the response to that request; the remaining elements aren't
+// sent. Since the client will typically retry the whole body, the target may
+// then receive the elements which were accepted before the failure twice.
+//
+// The requests are sent by the plugin itself, so it should run after every
+// other plugin which modifies requests.
+
+package batch_split_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    batchSplitPluginFactory
+	pluginName = "batch-split"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// BatchCountHeaderName is the response header which reports how many requests
+// a split body was sent to the target in.
+const BatchCountHeaderName = "X-Relay-Batches"
+
+type batchSplitPluginFactory struct{}
+
+func (f batchSplitPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f batchSplitPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &batchSplitPlugin{
+		transport: http.DefaultTransport,
+	}
+
+	if err := config.ParseOptional(configSection, "max-size", func(key string, maxSize int64) error {
+		// The smallest body which can be split is "[1,2]".
+		if maxSize < 3 {
+			return fmt.Errorf(`Option "max-size" must be at least 3 bytes, got %v`, maxSize)
+		}
+		plugin.maxSize = maxSize
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			plugin.paths = append(plugin.paths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if plugin.maxSize == 0 {
+		if len(plugin.paths) > 0 {
+			return nil, fmt.Errorf(`Option "paths" requires "max-size"`)
+		}
+		return nil, nil
+	}
+
+	logger.Printf("Splitting JSON array bodies larger than %v bytes", plugin.maxSize)
+	return plugin, nil
+}
+
+type batchSplitPlugin struct {
+	maxSize   int64            // Bodies larger than this, before encoding, are split.
+	paths     []*regexp.Regexp // If non-empty, only bodies sent to matching paths are split.
+	transport http.RoundTripper
+}
+
+func (plug *batchSplitPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *batchSplitPlugin) SetTransport(transport http.RoundTripper) {
+	plug.transport = transport
+}
+
+func (plug *batchSplitPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced || request.Body == nil || request.Body == http.NoBody {
+		return false
+	}
+	if len(plug.paths) > 0 && !plug.matchesPath(info.OriginalURL.Path) {
+		return false
+	}
+
+	// The relay has already decoded the body, and ContentLength is its
+	// decoded length.
+	encoding, err := traffic.GetContentEncoding(request)
+	if err != nil {
+		return false
+	}
+	if request.ContentLength >= 0 && request.ContentLength <= plug.maxSize {
+		return false
+	}
+
+	body, err := io.ReadAll(request.Body)
+	traffic.SetRequestBody(request, body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
+		return true
+	}
+	if int64(len(body)) <= plug.maxSize {
+		return false
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil || len(elements) < 2 {
+		// Anything other than an array of several elements is relayed as is.
+		return false
+	}
+
+	batches := splitBatches(elements, plug.maxSize)
+	logger.Printf("Splitting %v byte body sent to %v into %v requests", len(body), info.OriginalURL.Path, len(batches))
+
+	traffic.AddRelayHeaders(request)
+	for i, batch := range batches {
+		targetResponse, err := plug.send(request, batch, encoding)
+		if err != nil {
+			logger.Errorf("Error sending request %v of %v: %s", i+1, len(batches), err)
+			http.Error(response, "Error sending request to target", http.StatusBadGateway)
+			return true
+		}
+
+		failed := targetResponse.StatusCode < 200 || targetResponse.StatusCode > 299
+		if failed || i == len(batches)-1 {
+			if failed {
+				logger.Printf("Request %v of %v failed with status %v", i+1, len(batches), targetResponse.StatusCode)
+			}
+			response.Header().Set(BatchCountHeaderName, strconv.Itoa(i+1))
+			relayResponse(response, targetResponse)
+			return true
+		}
+		discardResponse(targetResponse)
+	}
+	return true
+}
+
+func (plug *batchSplitPlugin) matchesPath(path string) bool {
+	for _, match := range plug.paths {
+		if match.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a copy of the request with the provided body, encoded like the
+// client's body was.
+func (plug *batchSplitPlugin) send(request *http.Request, body []byte, encoding traffic.Encoding) (*http.Response, error) {
+	if encoding != traffic.Identity {
+		encodedBody, err := traffic.EncodeData(body, encoding)
+		if err != nil {
+			return nil, err
+		}
+		body = encodedBody
+	}
+
+	batchRequest := request.Clone(request.Context())
+	traffic.SetRequestBody(batchRequest, body)
+	return plug.transport.RoundTrip(batchRequest)
+}
+
+// splitBatches packs consecutive elements into JSON arrays of at most maxSize
+// bytes. An element which is too large to fit in an array on its own is sent
+// by itself anyway, and the target can decide what to do with it.
+func splitBatches(elements []json.RawMessage, maxSize int64) [][]byte {
+	var batches [][]byte
+	batch := []byte{'['}
+	for _, element := range elements {
+		// Leave room for a comma and the closing bracket.
+		if len(batch) > 1 && int64(len(batch)+1+len(element)+1) > maxSize {
+			batches = append(batches, append(batch, ']'))
+			batch = []byte{'['}
+		}
+		if len(batch) > 1 {
+			batch = append(batch, ',')
+		}
+		batch = append(batch, element...)
+	}
+	return append(batches, append(batch, ']'))
+}
+
+func relayResponse(response http.ResponseWriter, targetResponse *http.Response) {
+	defer targetResponse.Body.Close()
+	for name, values := range targetResponse.Header {
+		for _, value := range values {
+			response.Header().Add(name, value)
+		}
+	}
+	response.WriteHeader(targetResponse.StatusCode)
+	if _, err := io.Copy(response, targetResponse.Body); err != nil {
+		logger.Errorf("Error relaying response body to client: %s", err)
+	}
+}
+
+// discardResponse reads and closes a response body, so that its connection
+// can be reused.
+func discardResponse(targetResponse *http.Response) {
+	io.Copy(io.Discard, targetResponse.Body)
+	targetResponse.Body.Close()
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
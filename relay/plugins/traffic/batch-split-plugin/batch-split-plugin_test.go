@@ -0,0 +1,249 @@
+package batch_split_plugin_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	batch_split_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/batch-split-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestBatchSplitPlugin(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		config          string
+		path            string
+		encoding        string
+		body            string
+		expectedBodies  []string
+		expectedStatus  int
+		expectedBatches string
+	}{
+		{
+			desc: "Small bodies are relayed as is",
+			config: `batch-split:
+    max-size: 20
+`,
+			body:           `["aaaaa","bbbbb"]`,
+			expectedBodies: []string{`["aaaaa","bbbbb"]`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Large arrays are split in order",
+			config: `batch-split:
+    max-size: 20
+`,
+			body:            `["aaaaa", "bbbbb", "ccccc", "ddddd", "eeeee"]`,
+			expectedBodies:  []string{`["aaaaa","bbbbb"]`, `["ccccc","ddddd"]`, `["eeeee"]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatches: "3",
+		},
+		{
+			desc: "Elements larger than the maximum are sent alone",
+			config: `batch-split:
+    max-size: 20
+`,
+			body:            `["aaaaa",{"b":"bbbbbbbbbbbbbbbbbbbb"},"ccccc"]`,
+			expectedBodies:  []string{`["aaaaa"]`, `[{"b":"bbbbbbbbbbbbbbbbbbbb"}]`, `["ccccc"]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatches: "3",
+		},
+		{
+			desc: "A failed request stops the rest from being sent",
+			config: `batch-split:
+    max-size: 20
+`,
+			body:            `["aaaaa","bbbbb","fail!","ddddd","eeeee"]`,
+			expectedBodies:  []string{`["aaaaa","bbbbb"]`, `["fail!","ddddd"]`},
+			expectedStatus:  http.StatusServiceUnavailable,
+			expectedBatches: "2",
+		},
+		{
+			desc: "Compressed bodies are split and compressed again",
+			config: `batch-split:
+    max-size: 20
+`,
+			encoding:        "gzip",
+			body:            `["aaaaa","bbbbb","ccccc"]`,
+			expectedBodies:  []string{`["aaaaa","bbbbb"]`, `["ccccc"]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatches: "2",
+		},
+		{
+			desc: "Bodies other than arrays are relayed as is",
+			config: `batch-split:
+    max-size: 20
+`,
+			body:           `{"aaaaa":"bbbbbbbbbbbbbbbbbbbb"}`,
+			expectedBodies: []string{`{"aaaaa":"bbbbbbbbbbbbbbbbbbbb"}`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Only bodies sent to matching paths are split",
+			config: `batch-split:
+    max-size: 20
+    paths:
+        - ^/bundle$
+`,
+			path:           "/other",
+			body:           `["aaaaa","bbbbb","ccccc"]`,
+			expectedBodies: []string{`["aaaaa","bbbbb","ccccc"]`},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Bodies sent to matching paths are split",
+			config: `batch-split:
+    max-size: 20
+    paths:
+        - ^/bundle$
+`,
+			path:            "/bundle",
+			body:            `["aaaaa","bbbbb","ccccc"]`,
+			expectedBodies:  []string{`["aaaaa","bbbbb"]`, `["ccccc"]`},
+			expectedStatus:  http.StatusOK,
+			expectedBatches: "2",
+		},
+	}
+
+	var mutex sync.Mutex
+	var receivedBodies []string
+	var receivedEncodings []string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		encoding, _ := traffic.GetContentEncoding(request)
+		if decoded, err := traffic.DecodeData(body, encoding); err == nil {
+			body = decoded
+		}
+
+		mutex.Lock()
+		receivedBodies = append(receivedBodies, string(body))
+		receivedEncodings = append(receivedEncodings, request.Header.Get("Content-Encoding"))
+		mutex.Unlock()
+
+		if request.Header.Get(traffic.RelayVersionHeaderName) == "" {
+			t.Errorf("Expected every request to carry the relay headers")
+		}
+		if strings.Contains(string(body), "fail!") {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+		response.Write(body)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := batch_split_plugin.Factory.New(configFile.LookupOptionalSection("batch-split"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+
+		body := []byte(testCase.body)
+		if testCase.encoding != "" {
+			encoding, _ := traffic.ParseEncoding(testCase.encoding)
+			body, _ = traffic.EncodeData(body, encoding)
+		}
+		request, _ := http.NewRequest("POST", relayServer.URL+testCase.path, bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if testCase.encoding != "" {
+			request.Header.Set("Content-Encoding", testCase.encoding)
+		}
+
+		mutex.Lock()
+		receivedBodies = nil
+		receivedEncodings = nil
+		mutex.Unlock()
+
+		response, err := http.DefaultClient.Do(request)
+		relayServer.Close()
+		if err != nil {
+			t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+			continue
+		}
+		responseBody, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		mutex.Lock()
+		if !reflect.DeepEqual(receivedBodies, testCase.expectedBodies) {
+			t.Errorf("Test '%v': Expected target to receive %v but got %v", testCase.desc, testCase.expectedBodies, receivedBodies)
+		}
+		for _, encoding := range receivedEncodings {
+			if encoding != testCase.encoding {
+				t.Errorf("Test '%v': Expected Content-Encoding '%v' but got '%v'", testCase.desc, testCase.encoding, encoding)
+			}
+		}
+		mutex.Unlock()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+		if batches := response.Header.Get(batch_split_plugin.BatchCountHeaderName); batches != testCase.expectedBatches {
+			t.Errorf("Test '%v': Expected %v header '%v' but got '%v'", testCase.desc, batch_split_plugin.BatchCountHeaderName, testCase.expectedBatches, batches)
+		}
+		// The client receives the response to the last request sent.
+		if len(testCase.expectedBodies) > 0 && testCase.encoding == "" {
+			lastBody := testCase.expectedBodies[len(testCase.expectedBodies)-1]
+			if string(responseBody) != lastBody {
+				t.Errorf("Test '%v': Expected response body '%v' but got '%s'", testCase.desc, lastBody, responseBody)
+			}
+		}
+	}
+}
+
+func TestBatchSplitConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"max-size: 0",
+		"max-size: -1",
+		"max-size: large",
+		"paths:\n        - ^/bundle",
+		"max-size: 100\n    paths:\n        - \"[\"",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("batch-split:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := batch_split_plugin.Factory.New(configFile.LookupOptionalSection("batch-split")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
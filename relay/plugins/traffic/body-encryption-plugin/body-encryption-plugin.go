@@ -0,0 +1,360 @@
+// This plugin encrypts request bodies with a public key belonging to the
+// tenant which sent them, for pipelines in which even the relay's immediate
+// target must only ever store ciphertext. Tenants are identified by a request
+// header, and each has its own RSA public key; only the holder of the
+// matching private key can read the body.
+//
+// Bodies are encrypted as JWE compact serializations (RFC 7516) using
+// RSA-OAEP-256 to encrypt a random content key and A256GCM to encrypt the
+// body, so any JOSE library can decrypt them. The JWE's "kid" header, and the
+// KeyIdHeaderName request header, identify the key used; its "cty" header
+// holds the body's original Content-Type.
+//
+// The body is encrypted after every other plugin has modified it, so content
+// blocking rules still apply. Plugins which need to read bodies, like
+// batch-split, can't see through the encryption.
+
+package body_encryption_plugin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    bodyEncryptionPluginFactory
+	pluginName = "encrypt-body"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// KeyIdHeaderName is the request header which identifies the key with which
+// the body was encrypted.
+const KeyIdHeaderName = "X-Relay-Encryption-Key-Id"
+
+// ContentType is the Content-Type of encrypted bodies.
+const ContentType = "application/jose"
+
+// AnyTenant is the tenant of a key which encrypts the bodies of tenants that
+// don't have a key of their own.
+const AnyTenant = "*"
+
+// minKeyBits is the size of the smallest RSA key which is accepted.
+const minKeyBits = 2048
+
+// ConfigKey assigns a public key to a tenant. The key is a PEM-encoded RSA
+// public key, given inline or as the path to a file.
+type ConfigKey struct {
+	Tenant        string
+	KeyId         string `yaml:"key-id"`
+	PublicKey     string `yaml:"public-key"`
+	PublicKeyFile string `yaml:"public-key-file"`
+}
+
+type bodyEncryptionPluginFactory struct{}
+
+func (f bodyEncryptionPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f bodyEncryptionPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &bodyEncryptionPlugin{keys: map[string]*tenantKey{}}
+
+	if err := config.ParseOptional(configSection, "keys", func(key string, keys []ConfigKey) error {
+		for _, configKey := range keys {
+			tenantKey, err := readKey(configKey)
+			if err != nil {
+				return err
+			}
+			if plugin.keys[configKey.Tenant] != nil {
+				return fmt.Errorf(`Tenant "%v" has more than one key`, configKey.Tenant)
+			}
+			plugin.keys[configKey.Tenant] = tenantKey
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if tenantHeader, err := config.LookupOptional[string](configSection, "tenant-header"); err != nil {
+		return nil, err
+	} else if tenantHeader != nil {
+		plugin.tenantHeader = http.CanonicalHeaderKey(*tenantHeader)
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			plugin.paths = append(plugin.paths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(plugin.keys) == 0 {
+		if plugin.tenantHeader != "" || len(plugin.paths) > 0 {
+			return nil, fmt.Errorf(`Options "tenant-header" and "paths" require "keys"`)
+		}
+		return nil, nil
+	}
+	if plugin.tenantHeader == "" && (len(plugin.keys) > 1 || plugin.keys[AnyTenant] == nil) {
+		return nil, fmt.Errorf(`Option "tenant-header" is required unless the only key is for tenant "%v"`, AnyTenant)
+	}
+
+	for tenant, key := range plugin.keys {
+		logger.Printf(`Encrypting bodies from tenant "%v" with key "%v"`, tenant, key.id)
+	}
+	return plugin, nil
+}
+
+// readKey reads and checks a tenant's public key.
+func readKey(configKey ConfigKey) (*tenantKey, error) {
+	if configKey.Tenant == "" {
+		return nil, fmt.Errorf(`Encryption key must include a "tenant" property`)
+	}
+	if configKey.KeyId == "" {
+		return nil, fmt.Errorf(`Encryption key for tenant "%v" must include a "key-id" property`, configKey.Tenant)
+	}
+
+	keyPEM := []byte(configKey.PublicKey)
+	switch {
+	case configKey.PublicKey != "" && configKey.PublicKeyFile != "":
+		return nil, fmt.Errorf(`Encryption key for tenant "%v" may only include one of "public-key" and "public-key-file"`, configKey.Tenant)
+	case configKey.PublicKeyFile != "":
+		var err error
+		if keyPEM, err = os.ReadFile(configKey.PublicKeyFile); err != nil {
+			return nil, fmt.Errorf(`Error reading public key for tenant "%v": %v`, configKey.Tenant, err)
+		}
+	case configKey.PublicKey == "":
+		return nil, fmt.Errorf(`Encryption key for tenant "%v" must include "public-key" or "public-key-file"`, configKey.Tenant)
+	}
+
+	publicKey, err := parsePublicKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf(`Invalid public key for tenant "%v": %v`, configKey.Tenant, err)
+	}
+	return &tenantKey{id: configKey.KeyId, publicKey: publicKey}, nil
+}
+
+// parsePublicKey parses a PEM-encoded RSA public key, in either PKIX ("PUBLIC
+// KEY") or PKCS #1 ("RSA PUBLIC KEY") form.
+func parsePublicKey(keyPEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	var publicKey *rsa.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if publicKey, ok = parsed.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("only RSA keys are supported")
+		}
+	case "RSA PUBLIC KEY":
+		var err error
+		if publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf(`unexpected PEM block type "%v"`, block.Type)
+	}
+
+	if publicKey.N.BitLen() < minKeyBits {
+		return nil, fmt.Errorf("key must be at least %v bits long", minKeyBits)
+	}
+	return publicKey, nil
+}
+
+type tenantKey struct {
+	id        string
+	publicKey *rsa.PublicKey
+}
+
+type bodyEncryptionPlugin struct {
+	keys         map[string]*tenantKey // By tenant.
+	tenantHeader string                // The header identifying the tenant which sent a request.
+	paths        []*regexp.Regexp      // If non-empty, only bodies sent to matching paths are encrypted.
+	metrics      *metrics.PluginMetrics
+}
+
+func (plug *bodyEncryptionPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *bodyEncryptionPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+func (plug *bodyEncryptionPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+	// Only the relay may say how a body was encrypted.
+	request.Header.Del(KeyIdHeaderName)
+
+	if request.Body == nil || request.Body == http.NoBody {
+		return false
+	}
+	if len(plug.paths) > 0 && !matchesAny(plug.paths, info.OriginalURL.Path) {
+		return false
+	}
+
+	key := plug.keyFor(request)
+	if key == nil {
+		// Relaying the body in plaintext would defeat the purpose.
+		logger.Printf("%s %s: rejected: no encryption key for tenant %q", request.Method, request.URL, request.Header.Get(plug.tenantHeader))
+		http.Error(response, "No encryption key for tenant", http.StatusBadRequest)
+		return true
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error reading request body: %s", err)
+		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
+		request.Body = http.NoBody
+		return true
+	}
+
+	encrypted, err := encrypt(body, key, request.Header.Get("Content-Type"))
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error encrypting request body: %s", err)
+		http.Error(response, "Error encrypting request body", http.StatusInternalServerError)
+		request.Body = http.NoBody
+		return true
+	}
+	plug.metrics.BodyModified()
+
+	traffic.SetRequestBody(request, encrypted)
+	request.Header.Set("Content-Type", ContentType)
+	request.Header.Set(KeyIdHeaderName, key.id)
+	return false
+}
+
+// keyFor returns the key with which the request's body should be encrypted,
+// or nil if there isn't one.
+func (plug *bodyEncryptionPlugin) keyFor(request *http.Request) *tenantKey {
+	if plug.tenantHeader != "" {
+		if tenant := request.Header.Get(plug.tenantHeader); tenant != "" {
+			if key := plug.keys[tenant]; key != nil {
+				return key
+			}
+		}
+	}
+	return plug.keys[AnyTenant]
+}
+
+// jweHeader is the protected header of an encrypted body.
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	KeyId       string `json:"kid"`
+	ContentType string `json:"cty,omitempty"`
+}
+
+// encrypt encrypts a body as a JWE compact serialization.
+func encrypt(body []byte, key *tenantKey, contentType string) ([]byte, error) {
+	header, err := json.Marshal(jweHeader{
+		Algorithm:   "RSA-OAEP-256",
+		Encryption:  "A256GCM",
+		KeyId:       key.id,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+
+	contentKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, contentKey); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.publicKey, contentKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	// The protected header is authenticated along with the body.
+	sealed := aead.Seal(nil, iv, body, []byte(protected))
+	ciphertext, tag := sealed[:len(body)], sealed[len(body):]
+
+	var encrypted bytes.Buffer
+	encrypted.WriteString(protected)
+	for _, part := range [][]byte{encryptedKey, iv, ciphertext, tag} {
+		encrypted.WriteByte('.')
+		encrypted.WriteString(base64.RawURLEncoding.EncodeToString(part))
+	}
+	return encrypted.Bytes(), nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
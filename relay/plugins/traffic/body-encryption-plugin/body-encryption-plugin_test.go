@@ -0,0 +1,324 @@
+package body_encryption_plugin_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	body_encryption_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/body-encryption-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestBodyEncryption(t *testing.T) {
+	acmeKey := generateKey(t)
+	otherKey := generateKey(t)
+	directory := t.TempDir()
+	acmeKeyFile := filepath.Join(directory, "acme.pem")
+	writePEM(t, acmeKeyFile, "PUBLIC KEY", marshalPKIX(t, &acmeKey.PublicKey))
+
+	// The fallback key is given inline, in PKCS #1 form.
+	otherKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&otherKey.PublicKey)})
+	keysConfig := fmt.Sprintf(`encrypt-body:
+    tenant-header: X-Tenant-Id
+    keys:
+        - tenant: acme
+          key-id: acme-2024
+          public-key-file: %v
+        - tenant: "*"
+          key-id: shared-1
+          public-key: |
+              %v
+`, acmeKeyFile, strings.ReplaceAll(strings.TrimSpace(string(otherKeyPEM)), "\n", "\n              "))
+
+	testCases := []struct {
+		desc           string
+		config         string
+		path           string
+		tenant         string
+		body           string
+		expectedStatus int
+		expectedKeyId  string
+		expectedKey    *rsa.PrivateKey
+	}{
+		{
+			desc:           "Bodies are relayed as is by default",
+			config:         "",
+			tenant:         "acme",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Bodies are encrypted with the tenant's key",
+			config:         keysConfig,
+			tenant:         "acme",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusOK,
+			expectedKeyId:  "acme-2024",
+			expectedKey:    acmeKey,
+		},
+		{
+			desc:           "Bodies from other tenants are encrypted with the fallback key",
+			config:         keysConfig,
+			tenant:         "globex",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusOK,
+			expectedKeyId:  "shared-1",
+			expectedKey:    otherKey,
+		},
+		{
+			desc: "Bodies from tenants without a key are rejected",
+			config: fmt.Sprintf(`encrypt-body:
+    tenant-header: X-Tenant-Id
+    keys:
+        - tenant: acme
+          key-id: acme-2024
+          public-key-file: %v
+`, acmeKeyFile),
+			tenant:         "globex",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc: "Bodies sent to other paths are relayed as is",
+			config: fmt.Sprintf(`encrypt-body:
+    tenant-header: X-Tenant-Id
+    paths: ['^/payments/']
+    keys:
+        - tenant: acme
+          key-id: acme-2024
+          public-key-file: %v
+`, acmeKeyFile),
+			path:           "/events",
+			tenant:         "globex",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Bodies sent to matching paths are encrypted",
+			config: fmt.Sprintf(`encrypt-body:
+    tenant-header: X-Tenant-Id
+    paths: ['^/payments/']
+    keys:
+        - tenant: acme
+          key-id: acme-2024
+          public-key-file: %v
+`, acmeKeyFile),
+			path:           "/payments/new",
+			tenant:         "acme",
+			body:           `{"card":"4111111111111111"}`,
+			expectedStatus: http.StatusOK,
+			expectedKeyId:  "acme-2024",
+			expectedKey:    acmeKey,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		body_encryption_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("POST", relayService.HttpUrl()+testCase.path, strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("X-Tenant-Id", testCase.tenant)
+			// Clients can't claim that their bodies were encrypted.
+			request.Header.Set(body_encryption_plugin.KeyIdHeaderName, "forged")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				return
+			}
+			if response.StatusCode != http.StatusOK {
+				return
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			lastBody, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request body from catcher: %v", testCase.desc, err)
+				return
+			}
+			if keyId := lastRequest.Header.Get(body_encryption_plugin.KeyIdHeaderName); testCase.config != "" && keyId != testCase.expectedKeyId {
+				t.Errorf("Test '%v': Expected key ID '%v' but got '%v'", testCase.desc, testCase.expectedKeyId, keyId)
+			}
+
+			if testCase.expectedKey == nil {
+				if string(lastBody) != testCase.body {
+					t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.body, string(lastBody))
+				}
+				return
+			}
+
+			if contentType := lastRequest.Header.Get("Content-Type"); contentType != body_encryption_plugin.ContentType {
+				t.Errorf("Test '%v': Expected Content-Type '%v' but got '%v'", testCase.desc, body_encryption_plugin.ContentType, contentType)
+			}
+			if strings.Contains(string(lastBody), "4111") {
+				t.Errorf("Test '%v': Expected the body to be encrypted but got '%v'", testCase.desc, string(lastBody))
+			}
+			header, plaintext, err := decrypt(string(lastBody), testCase.expectedKey)
+			if err != nil {
+				t.Errorf("Test '%v': Error decrypting body: %v", testCase.desc, err)
+				return
+			}
+			if string(plaintext) != testCase.body {
+				t.Errorf("Test '%v': Expected decrypted body '%v' but got '%v'", testCase.desc, testCase.body, string(plaintext))
+			}
+			if header["kid"] != testCase.expectedKeyId || header["cty"] != "application/json" {
+				t.Errorf("Test '%v': Unexpected protected header %v", testCase.desc, header)
+			}
+		})
+	}
+}
+
+func TestBodyEncryptionConfigValidation(t *testing.T) {
+	directory := t.TempDir()
+	keyFile := filepath.Join(directory, "key.pem")
+	writePEM(t, keyFile, "PUBLIC KEY", marshalPKIX(t, &generateKey(t).PublicKey))
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	smallKeyFile := filepath.Join(directory, "small.pem")
+	writePEM(t, smallKeyFile, "PUBLIC KEY", marshalPKIX(t, &smallKey.PublicKey))
+
+	invalidConfigs := []string{
+		// A tenant header is required unless there's only a fallback key.
+		fmt.Sprintf("keys: [{tenant: acme, key-id: a, public-key-file: %v}]\n", keyFile),
+		"tenant-header: X-Tenant-Id\n",
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{key-id: a, public-key-file: %v}]\n", keyFile),
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, public-key-file: %v}]\n", keyFile),
+		"tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a}]\n",
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a, public-key-file: %v, public-key: x}]\n", keyFile),
+		"tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a, public-key: not-a-key}]\n",
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a, public-key-file: %v}]\n", filepath.Join(directory, "missing.pem")),
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a, public-key-file: %v}]\n", smallKeyFile),
+		fmt.Sprintf("tenant-header: X-Tenant-Id\nkeys: [{tenant: acme, key-id: a, public-key-file: %v}, {tenant: acme, key-id: b, public-key-file: %v}]\n", keyFile, keyFile),
+		fmt.Sprintf("tenant-header: X-Tenant-Id\npaths: ['(']\nkeys: [{tenant: acme, key-id: a, public-key-file: %v}]\n", keyFile),
+	}
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("encrypt-body:\n    " + strings.ReplaceAll(strings.TrimSpace(invalidConfig), "\n", "\n    "))
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", invalidConfig, err)
+			continue
+		}
+		if _, err := body_encryption_plugin.Factory.New(configFile.LookupOptionalSection("encrypt-body")); err == nil {
+			t.Errorf("Expected an error for configuration %q", invalidConfig)
+		}
+	}
+
+	// A fallback key alone needs no tenant header.
+	configFile, _ := config.NewFileFromYamlString(fmt.Sprintf("encrypt-body:\n    keys: [{tenant: '*', key-id: a, public-key-file: %v}]\n", keyFile))
+	if plugin, err := body_encryption_plugin.Factory.New(configFile.LookupOptionalSection("encrypt-body")); err != nil || plugin == nil {
+		t.Errorf("Expected a fallback key without a tenant header to be accepted but got %v, %v", plugin, err)
+	}
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	return key
+}
+
+func marshalPKIX(t *testing.T, key *rsa.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling public key: %v", err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+}
+
+// decrypt decrypts a JWE compact serialization, as the holder of the tenant's
+// private key would.
+func decrypt(jwe string, key *rsa.PrivateKey) (map[string]string, []byte, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return nil, nil, fmt.Errorf("expected 5 parts but got %v", len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header := map[string]string{}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, nil, err
+	}
+	if header["alg"] != "RSA-OAEP-256" || header["enc"] != "A256GCM" {
+		return nil, nil, fmt.Errorf("unexpected algorithms in %v", header)
+	}
+
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decoded[1], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+	return header, plaintext, err
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
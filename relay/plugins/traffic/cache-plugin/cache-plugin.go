@@ -0,0 +1,442 @@
+// This plugin caches the target's responses to GET requests in memory, so
+// that requests for things which rarely change, like configuration and static
+// assets, needn't reach the target every time. Only requests whose paths match
+// one of the configured rules are cached, for the rule's TTL, unless the
+// target's Cache-Control header says otherwise.
+//
+// Responses are cached by the request's URL, and the values of any request
+// headers configured as part of the key. Responses which vary on other
+// headers, set cookies, or are marked no-store, no-cache, or private, aren't
+// cached, and neither are responses to requests which carry credentials in an
+// Authorization header unless it's part of the key. Clients which send
+// Cache-Control: no-cache or no-store bypass the cache.
+//
+// The cache holds up to 'max-bytes' of responses, discarding the least
+// recently used when it's full. Cached responses are served with an Age
+// header, and every cacheable response with a CacheHeaderName header saying
+// whether it was a hit or a miss.
+//
+// Responses are cached as they're sent to the client, after every response
+// plugin has modified them, so the plugin should run after every other plugin
+// which modifies requests, so that cache keys describe the request which is
+// relayed.
+
+package cache_plugin
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    cachePluginFactory
+	pluginName = "cache"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// CacheHeaderName is the response header which says whether a response was
+// served from the cache ("hit") or relayed from the target ("miss").
+const CacheHeaderName = "X-Relay-Cache"
+
+const (
+	defaultMaxBytes      = 64 << 20
+	defaultMaxEntryBytes = 1 << 20
+)
+
+// ConfigRule caches the responses to requests whose paths match Path, for TTL
+// unless the response's Cache-Control header gives its own max-age.
+type ConfigRule struct {
+	Path string
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+type cachePluginFactory struct{}
+
+func (f cachePluginFactory) Name() string {
+	return pluginName
+}
+
+func (f cachePluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &cachePlugin{
+		maxBytes:      defaultMaxBytes,
+		maxEntryBytes: defaultMaxEntryBytes,
+		clock:         clock.Real,
+		entries:       map[string]*list.Element{},
+		recency:       list.New(),
+	}
+
+	if err := config.ParseOptional(configSection, "rules", func(key string, rules []ConfigRule) error {
+		for _, configRule := range rules {
+			path, err := regexp.Compile(configRule.Path)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, configRule.Path, err)
+			}
+			if configRule.TTL <= 0 {
+				return fmt.Errorf(`Rule for "%v" must include a positive "ttl"`, configRule.Path)
+			}
+			plugin.rules = append(plugin.rules, cacheRule{path: path, ttl: configRule.TTL})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "key-headers", func(key string, headers []string) error {
+		for _, header := range headers {
+			plugin.keyHeaders = append(plugin.keyHeaders, http.CanonicalHeaderKey(header))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if maxBytes, err := config.LookupOptional[int64](configSection, "max-bytes"); err != nil {
+		return nil, err
+	} else if maxBytes != nil {
+		if *maxBytes <= 0 {
+			return nil, fmt.Errorf(`Invalid max-bytes "%v": must be positive`, *maxBytes)
+		}
+		plugin.maxBytes = *maxBytes
+	}
+	if maxEntryBytes, err := config.LookupOptional[int64](configSection, "max-entry-bytes"); err != nil {
+		return nil, err
+	} else if maxEntryBytes != nil {
+		if *maxEntryBytes <= 0 {
+			return nil, fmt.Errorf(`Invalid max-entry-bytes "%v": must be positive`, *maxEntryBytes)
+		}
+		plugin.maxEntryBytes = *maxEntryBytes
+	}
+	if plugin.maxEntryBytes > plugin.maxBytes {
+		plugin.maxEntryBytes = plugin.maxBytes
+	}
+
+	if len(plugin.rules) == 0 {
+		return nil, nil
+	}
+	for _, rule := range plugin.rules {
+		logger.Printf(`Added rule: cache responses for paths matching "%v" for %v`, rule.path, rule.ttl)
+	}
+	return plugin, nil
+}
+
+type cachePlugin struct {
+	rules         []cacheRule
+	keyHeaders    []string // Request headers whose values are part of the cache key.
+	maxBytes      int64    // The size of the cache.
+	maxEntryBytes int64    // The size of the largest body which is cached.
+	clock         clock.Clock
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element // Of *cacheEntry, by key.
+	recency *list.List               // Of *cacheEntry, most recently used first.
+	size    int64
+}
+
+type cacheRule struct {
+	path *regexp.Regexp
+	ttl  time.Duration
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// size approximates the memory used by an entry.
+func (entry *cacheEntry) size() int64 {
+	size := int64(len(entry.key) + len(entry.body))
+	for name, values := range entry.header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+func (plug *cachePlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *cachePlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *cachePlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+	key, _, ok := plug.cacheKey(request)
+	if !ok {
+		return false
+	}
+
+	entry := plug.lookup(key)
+	if entry == nil {
+		return false
+	}
+
+	header := response.Header()
+	for name, values := range entry.header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(plug.clock.Since(entry.stored).Seconds())))
+	header.Set(CacheHeaderName, "hit")
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	response.WriteHeader(entry.status)
+	if _, err := response.Write(entry.body); err != nil {
+		logger.Debugf("Error writing cached response: %v", err)
+	}
+	return true
+}
+
+// HandleResponse implements traffic.ResponsePlugin. Cacheable responses are
+// captured as they're relayed to the client, and stored once the client has
+// received all of them.
+func (plug *cachePlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	key, ttl, ok := plug.cacheKey(response.Request)
+	if !ok {
+		return
+	}
+	response.Header.Set(CacheHeaderName, "miss")
+
+	ttl, ok = plug.freshness(response, ttl)
+	if !ok || response.Body == nil || response.Body == http.NoBody {
+		return
+	}
+	if response.ContentLength > plug.maxEntryBytes {
+		return
+	}
+	response.Body = &capturingBody{
+		ReadCloser: response.Body,
+		plugin:     plug,
+		response:   response,
+		key:        key,
+		ttl:        ttl,
+		length:     response.ContentLength,
+	}
+}
+
+// cacheKey returns the key under which the response to a request is cached,
+// and the TTL of the rule which matches it. It returns false if the request
+// isn't cacheable.
+func (plug *cachePlugin) cacheKey(request *http.Request) (string, time.Duration, bool) {
+	if request.Method != http.MethodGet {
+		return "", 0, false
+	}
+	directives := parseCacheControl(request.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return "", 0, false
+	}
+	if _, ok := directives["no-store"]; ok {
+		return "", 0, false
+	}
+
+	var ttl time.Duration
+	for _, rule := range plug.rules {
+		if rule.path.MatchString(request.URL.Path) {
+			ttl = rule.ttl
+			break
+		}
+	}
+	if ttl == 0 {
+		return "", 0, false
+	}
+
+	var key strings.Builder
+	key.WriteString(request.URL.String())
+	authorizationKeyed := false
+	for _, header := range plug.keyHeaders {
+		key.WriteString("\n" + header + ": " + strings.Join(request.Header.Values(header), ", "))
+		authorizationKeyed = authorizationKeyed || header == "Authorization"
+	}
+	if request.Header.Get("Authorization") != "" && !authorizationKeyed {
+		// The response may be meant for this client alone.
+		return "", 0, false
+	}
+	return key.String(), ttl, true
+}
+
+// freshness returns how long a response may be cached, given the TTL of its
+// rule, or false if it mustn't be cached.
+func (plug *cachePlugin) freshness(response *http.Response, ttl time.Duration) (time.Duration, bool) {
+	if response.StatusCode != http.StatusOK || response.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	for _, vary := range response.Header.Values("Vary") {
+		for _, header := range strings.Split(vary, ",") {
+			if header = http.CanonicalHeaderKey(strings.TrimSpace(header)); header != "" && !plug.isKeyHeader(header) {
+				return 0, false
+			}
+		}
+	}
+
+	directives := parseCacheControl(response.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0, false
+		}
+	}
+	// The target's own lifetime for shared caches takes precedence.
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return ttl, true
+}
+
+func (plug *cachePlugin) isKeyHeader(header string) bool {
+	for _, keyHeader := range plug.keyHeaders {
+		if header == keyHeader {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the fresh entry stored under key, or nil if there isn't one.
+func (plug *cachePlugin) lookup(key string) *cacheEntry {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	element := plug.entries[key]
+	if element == nil {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !plug.clock.Now().Before(entry.expires) {
+		plug.remove(element)
+		return nil
+	}
+	plug.recency.MoveToFront(element)
+	return entry
+}
+
+// store adds an entry to the cache, discarding the least recently used
+// entries to make room for it.
+func (plug *cachePlugin) store(entry *cacheEntry) {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	if element := plug.entries[entry.key]; element != nil {
+		plug.remove(element)
+	}
+	plug.entries[entry.key] = plug.recency.PushFront(entry)
+	plug.size += entry.size()
+	for plug.size > plug.maxBytes {
+		plug.remove(plug.recency.Back())
+	}
+}
+
+// remove removes an entry from the cache. It must be called with the mutex
+// held.
+func (plug *cachePlugin) remove(element *list.Element) {
+	entry := plug.recency.Remove(element).(*cacheEntry)
+	delete(plug.entries, entry.key)
+	plug.size -= entry.size()
+}
+
+// capturingBody copies a response body as it's read, and stores the response
+// in the cache once all of it has been read.
+type capturingBody struct {
+	io.ReadCloser
+	plugin   *cachePlugin
+	response *http.Response
+	key      string
+	ttl      time.Duration
+	length   int64 // The expected length of the body, or -1 if unknown.
+
+	captured bytes.Buffer
+	done     bool // True once the body was stored, or found to be too large.
+}
+
+func (body *capturingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if body.done {
+		return n, err
+	}
+	body.captured.Write(p[:n])
+	if int64(body.captured.Len()) > body.plugin.maxEntryBytes {
+		body.done = true
+		body.captured = bytes.Buffer{}
+		return n, err
+	}
+	// The relay stops reading once it has read Content-Length bytes, so it
+	// may never see io.EOF.
+	if err == io.EOF || (body.length >= 0 && int64(body.captured.Len()) == body.length) {
+		body.done = true
+		now := body.plugin.clock.Now()
+		header := body.response.Header.Clone()
+		header.Del(CacheHeaderName)
+		body.plugin.store(&cacheEntry{
+			key:     body.key,
+			status:  body.response.StatusCode,
+			header:  header,
+			body:    body.captured.Bytes(),
+			stored:  now,
+			expires: now.Add(body.ttl),
+		})
+	}
+	return n, err
+}
+
+// parseCacheControl returns the directives in a Cache-Control header, by
+// lowercase name, with their values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
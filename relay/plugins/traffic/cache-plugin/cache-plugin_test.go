@@ -0,0 +1,252 @@
+package cache_plugin_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	cache_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/cache-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type cacheStep struct {
+	advance       time.Duration // How long to wait before sending the request.
+	path          string        // The query may set the target's "cache-control", "vary", and "cookie".
+	header        map[string]string
+	expectedCache string // The expected X-Relay-Cache header.
+	expectedBody  string
+}
+
+func TestCachePlugin(t *testing.T) {
+	defaultConfig := `cache:
+    rules:
+        - path: ^/config/
+          ttl: 1m
+`
+	testCases := []struct {
+		desc   string
+		config string
+		steps  []cacheStep
+	}{
+		{
+			desc:   "Responses are cached for the rule's TTL",
+			config: defaultConfig,
+			steps: []cacheStep{
+				{path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/a", expectedCache: "hit", expectedBody: "/config/a 1"},
+				{path: "/config/b", expectedCache: "miss", expectedBody: "/config/b 2"},
+				{advance: 59 * time.Second, path: "/config/a", expectedCache: "hit", expectedBody: "/config/a 1"},
+				{advance: time.Second, path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 3"},
+				{path: "/config/a?page=2", expectedCache: "miss", expectedBody: "/config/a 4"},
+			},
+		},
+		{
+			desc:   "Other paths aren't cached",
+			config: defaultConfig,
+			steps: []cacheStep{
+				{path: "/events", expectedBody: "/events 1"},
+				{path: "/events", expectedBody: "/events 2"},
+			},
+		},
+		{
+			desc:   "The target's Cache-Control is honored",
+			config: defaultConfig,
+			steps: []cacheStep{
+				{path: "/config/a?cache-control=max-age%3D5", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{advance: 4 * time.Second, path: "/config/a?cache-control=max-age%3D5", expectedCache: "hit", expectedBody: "/config/a 1"},
+				{advance: time.Second, path: "/config/a?cache-control=max-age%3D5", expectedCache: "miss", expectedBody: "/config/a 2"},
+				{path: "/config/b?cache-control=no-store", expectedCache: "miss", expectedBody: "/config/b 3"},
+				{path: "/config/b?cache-control=no-store", expectedCache: "miss", expectedBody: "/config/b 4"},
+				{path: "/config/c?cache-control=private,+max-age%3D60", expectedCache: "miss", expectedBody: "/config/c 5"},
+				{path: "/config/c?cache-control=private,+max-age%3D60", expectedCache: "miss", expectedBody: "/config/c 6"},
+			},
+		},
+		{
+			desc:   "Clients can bypass the cache",
+			config: defaultConfig,
+			steps: []cacheStep{
+				{path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/a", header: map[string]string{"Cache-Control": "no-cache"}, expectedBody: "/config/a 2"},
+				{path: "/config/a", expectedCache: "hit", expectedBody: "/config/a 1"},
+			},
+		},
+		{
+			desc: "Key headers distinguish responses",
+			config: defaultConfig + `    key-headers:
+        - accept-language
+`,
+			steps: []cacheStep{
+				{path: "/config/a?vary=Accept-Language", header: map[string]string{"Accept-Language": "en"}, expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/a?vary=Accept-Language", header: map[string]string{"Accept-Language": "fr"}, expectedCache: "miss", expectedBody: "/config/a 2"},
+				{path: "/config/a?vary=Accept-Language", header: map[string]string{"Accept-Language": "en"}, expectedCache: "hit", expectedBody: "/config/a 1"},
+			},
+		},
+		{
+			desc:   "Private responses aren't cached",
+			config: defaultConfig,
+			steps: []cacheStep{
+				{path: "/config/a?vary=Accept-Language", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/a?vary=Accept-Language", expectedCache: "miss", expectedBody: "/config/a 2"},
+				{path: "/config/b?cookie=session", expectedCache: "miss", expectedBody: "/config/b 3"},
+				{path: "/config/b?cookie=session", expectedCache: "miss", expectedBody: "/config/b 4"},
+				{path: "/config/c", header: map[string]string{"Authorization": "Bearer client"}, expectedBody: "/config/c 5"},
+				{path: "/config/c", header: map[string]string{"Authorization": "Bearer client"}, expectedBody: "/config/c 6"},
+			},
+		},
+		{
+			desc: "The least recently used responses are discarded",
+			config: defaultConfig + `    max-bytes: 300
+`,
+			steps: []cacheStep{
+				{path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/b", expectedCache: "miss", expectedBody: "/config/b 2"},
+				{path: "/config/a", expectedCache: "hit", expectedBody: "/config/a 1"},
+				{path: "/config/c", expectedCache: "miss", expectedBody: "/config/c 3"},
+				{path: "/config/a", expectedCache: "hit", expectedBody: "/config/a 1"},
+				{path: "/config/b", expectedCache: "miss", expectedBody: "/config/b 4"},
+			},
+		},
+		{
+			desc: "Large responses aren't cached",
+			config: defaultConfig + `    max-entry-bytes: 5
+`,
+			steps: []cacheStep{
+				{path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 1"},
+				{path: "/config/a", expectedCache: "miss", expectedBody: "/config/a 2"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		var requests atomic.Int32
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			query := request.URL.Query()
+			if cacheControl := query.Get("cache-control"); cacheControl != "" {
+				response.Header().Set("Cache-Control", cacheControl)
+			}
+			if vary := query.Get("vary"); vary != "" {
+				response.Header().Set("Vary", vary)
+			}
+			if cookie := query.Get("cookie"); cookie != "" {
+				http.SetCookie(response, &http.Cookie{Name: cookie, Value: "1"})
+			}
+			fmt.Fprintf(response, "%v %v", request.URL.Path, requests.Add(1))
+		}))
+		relayServer, fakeClock := newCachingRelay(t, testCase.config, target.URL)
+
+		for i, step := range testCase.steps {
+			fakeClock.Advance(step.advance)
+			request, _ := http.NewRequest("GET", relayServer.URL+step.path, nil)
+			for name, value := range step.header {
+				request.Header.Set(name, value)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Step %v: Error GETing: %v", testCase.desc, i, err)
+				continue
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+
+			if string(body) != step.expectedBody {
+				t.Errorf("Test '%v': Step %v: Expected body '%v' but got '%v'", testCase.desc, i, step.expectedBody, string(body))
+			}
+			if cache := response.Header.Get(cache_plugin.CacheHeaderName); cache != step.expectedCache {
+				t.Errorf("Test '%v': Step %v: Expected %v '%v' but got '%v'", testCase.desc, i, cache_plugin.CacheHeaderName, step.expectedCache, cache)
+			}
+		}
+
+		relayServer.Close()
+		target.Close()
+	}
+}
+
+func TestCachePluginEncodedResponses(t *testing.T) {
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+		var body bytes.Buffer
+		writer := gzip.NewWriter(&body)
+		writer.Write([]byte(strings.Repeat("compressed ", 100)))
+		writer.Close()
+		response.Header().Set("Content-Encoding", "gzip")
+		response.Header().Set("Cache-Control", "public, max-age=60")
+		response.Write(body.Bytes())
+	}))
+	defer target.Close()
+	relayServer, fakeClock := newCachingRelay(t, "cache:\n    rules:\n        - path: .\n          ttl: 1m\n", target.URL)
+	defer relayServer.Close()
+
+	for i := 0; i < 2; i++ {
+		fakeClock.Advance(10 * time.Second)
+		response, err := http.Get(relayServer.URL + "/app.js")
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != strings.Repeat("compressed ", 100) {
+			t.Errorf("Request %v: Expected the decompressed body but got %q", i, body)
+		}
+		if i == 1 && response.Header.Get("Age") != "10" {
+			t.Errorf("Expected the cached response to have Age 10 but got '%v'", response.Header.Get("Age"))
+		}
+	}
+	if count := requests.Load(); count != 1 {
+		t.Errorf("Expected the target to receive 1 request but got %v", count)
+	}
+}
+
+func TestCacheConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"rules: ^/config/",
+		"rules:\n        - path: ^/config/",
+		"rules:\n        - path: ^/config/\n          ttl: soon",
+		"rules:\n        - path: (\n          ttl: 1m",
+		"rules:\n        - path: ^/config/\n          ttl: 1m\n    max-bytes: 0",
+		"rules:\n        - path: ^/config/\n          ttl: 1m\n    max-entry-bytes: -1",
+		"rules:\n        - path: ^/config/\n          ttl: 1m\n    key-headers: Accept",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("cache:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := cache_plugin.Factory.New(configFile.LookupOptionalSection("cache")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+// newCachingRelay starts a relay to the target with the cache plugin, whose
+// clock is faked.
+func newCachingRelay(t *testing.T, configYaml string, targetURL string) (*httptest.Server, *clock.Fake) {
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := cache_plugin.Factory.New(configFile.LookupOptionalSection("cache"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+
+	parsedURL, _ := url.Parse(targetURL)
+	fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = parsedURL.Scheme
+	options.TargetHost = parsedURL.Host
+	options.Clock = fakeClock
+	return httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin})), fakeClock
+}
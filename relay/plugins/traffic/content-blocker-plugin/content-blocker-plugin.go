@@ -14,25 +14,67 @@
 // Whether these benefits are more important than the thoroughness of using an
 // Exclude rule will depend on the application.
 //
+// Content can also be pseudonymized rather than destroyed. A Hash rule
+// replaces it with the hex-encoded HMAC-SHA256 of the content, keyed by the
+// 'hash-key' option, so the same identifier always produces the same value. A
+// Replace rule substitutes the template in its With property, which may refer
+// to capture groups, like "$1" or "${name}".
+//
+// A Tokenize rule also replaces content with a stable token, but remembers
+// which content each token replaced, so that what was scrubbed can be audited
+// via the plugin's authenticated detokenization endpoint. Tokenization is
+// configured by the 'token-*' options; see the tokenize package.
+//
+// Some kinds of sensitive content, like credit card numbers, can't be matched
+// precisely by a regular expression. Rules can instead name a built-in
+// Detector, which validates each match, such as with a checksum, before it's
+// blocked. There are detectors for credit card numbers, email addresses, phone
+// numbers, US Social Security numbers, and IBANs; see detectors.go.
+//
 // It's important to understand that this plugin does not understand the format
 // of the requests it processes; it simply treats the entire request body as
 // text. This makes it robust to request format changes, but it also means that
 // using a regular expression that matches JSON, HTML, or CSS syntax may corrupt
 // the request, so be careful.
+//
+// Request bodies are normally buffered in full before the rules are applied.
+// If 'streaming-threshold' is set, bodies larger than the threshold (or of
+// unknown length) are instead redacted incrementally; see streaming.go.
+//
+// Rules can also be imported from files exported by a DLP system, so that
+// security teams can keep a single source of truth for them; see dlp.go.
+//
+// Rules in the 'query' section apply to URL query parameters, selected by name
+// or by value; see query.go. Body rules are applied to the values of the
+// parameters of URL-encoded form bodies one by one, after they're unescaped;
+// see form.go.
+//
+// For structured payloads, 'json' rules select values by path rather than by
+// regular expression; see json.go. They're only applied to requests with an
+// application/json Content-Type. JSON rules can also tag values with a data
+// class, which is reported to the target in a header. Similarly, 'protobuf'
+// rules clear or hash fields of protobuf bodies, which are decoded using a
+// compiled descriptor set; see protobuf.go. Protobuf rules are also applied to
+// each message the client sends in a gRPC call.
 
 package content_blocker_plugin
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"regexp"
-	"strconv"
+	"strings"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/tokenize"
 	"github.com/immersa-co/relay-core/relay/traffic"
 	"github.com/immersa-co/relay-core/relay/version"
 )
@@ -40,14 +82,33 @@ import (
 var (
 	Factory    contentBlockerPluginFactory
 	pluginName = "block-content"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 
 	PluginVersionHeaderName = "X-Relay-Content-Blocker-Version"
 )
 
+const (
+	defaultStreamingChunkSize = 64 * 1024
+	defaultStreamingOverlap   = 4 * 1024
+)
+
+// ConfigBlockRule is a block rule for request or response content. Exactly
+// one of the Exclude, Mask, Hash, Tokenize, Replace, or Detector properties
+// must be set; the value is a regular expression, except for Detector, whose
+// value names a built-in detector (see detectors.go). With is the replacement
+// template for Replace rules, and Action is the mode, like "mask" or
+// "tokenize", in which Detector rules block content. Locale selects a
+// detector's variant for a country, like "gb".
 type ConfigBlockRule struct {
-	Exclude string
-	Mask    string
+	Exclude  string
+	Mask     string
+	Hash     string
+	Tokenize string
+	Replace  string
+	With     string
+	Detector string
+	Locale   string
+	Action   string
 }
 
 type contentBlockerPluginFactory struct{}
@@ -57,34 +118,100 @@ func (f contentBlockerPluginFactory) Name() string {
 }
 
 func (f contentBlockerPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
-	plugin := &contentBlockerPlugin{}
+	plugin := &contentBlockerPlugin{
+		streamingChunkSize: defaultStreamingChunkSize,
+		streamingOverlap:   defaultStreamingOverlap,
+	}
+
+	hashKey, err := secrets.Lookup(configSection, "hash-key")
+	if err != nil {
+		return nil, err
+	}
+	tokenOptions, err := tokenize.ReadOptions(configSection)
+	if err != nil {
+		return nil, err
+	} else if tokenOptions != nil {
+		plugin.vault = tokenize.NewVault(tokenOptions)
+		plugin.detokenize = tokenOptions.DetokenizeToken != nil
+		if !plugin.detokenize {
+			logger.Printf(`The detokenization endpoint is disabled; set "detokenize-token" to enable it`)
+		}
+	}
 
 	addRules := func(contentKind string, rules []ConfigBlockRule) error {
 		blockers := []*contentBlocker{}
 
 		for _, rule := range rules {
-			if rule.Exclude == "" && rule.Mask == "" {
-				return fmt.Errorf(`Block rule must include an Exclude or Mask property`)
+			set := 0
+			for _, property := range []string{rule.Exclude, rule.Mask, rule.Hash, rule.Tokenize, rule.Replace, rule.Detector} {
+				if property != "" {
+					set++
+				}
 			}
-			if rule.Exclude != "" && rule.Mask != "" {
-				return fmt.Errorf(`Block rule may not include both Exclude and Mask properties`)
+			if set == 0 {
+				return fmt.Errorf(`Block rule must include an Exclude, Mask, Hash, Tokenize, Replace, or Detector property`)
+			}
+			if set > 1 {
+				return fmt.Errorf(`Block rule may only include one of the Exclude, Mask, Hash, Tokenize, Replace, and Detector properties`)
+			}
+			if rule.With != "" && rule.Replace == "" {
+				return fmt.Errorf(`Block rule may only include a With property alongside Replace`)
+			}
+			if (rule.Action != "" || rule.Locale != "") && rule.Detector == "" {
+				return fmt.Errorf(`Block rule may only include Action and Locale properties alongside Detector`)
 			}
 
-			pattern := rule.Exclude
-			mode := excludeMode
-			if pattern == "" {
-				pattern = rule.Mask
-				mode = maskMode
+			var pattern string
+			var mode contentBlockerMode
+			var detected *detector
+			switch {
+			case rule.Exclude != "":
+				pattern, mode = rule.Exclude, excludeMode
+			case rule.Mask != "":
+				pattern, mode = rule.Mask, maskMode
+			case rule.Hash != "":
+				pattern, mode = rule.Hash, hashMode
+			case rule.Tokenize != "":
+				pattern, mode = rule.Tokenize, tokenizeMode
+			case rule.Detector != "":
+				var err error
+				if detected, mode, err = lookupDetector(rule.Detector, rule.Locale, rule.Action); err != nil {
+					return err
+				}
+				pattern = detected.regexp.String()
+			default:
+				pattern, mode = rule.Replace, replaceMode
+			}
+			if mode == hashMode && hashKey == nil {
+				return fmt.Errorf(`Hash block rules require the "hash-key" or "hash-key-file" option`)
+			}
+			if mode == tokenizeMode && plugin.vault == nil {
+				return fmt.Errorf(`Tokenize block rules require the "token-key" or "token-key-file" option`)
 			}
 
 			if regexp, err := regexp.Compile(pattern); err != nil {
 				return fmt.Errorf(`could not compile regular expression "%v": %v`, pattern, err)
 			} else {
-				logger.Printf("Added rule: %s %s content matching \"%s\"", mode, contentKind, regexp)
-				blockers = append(blockers, &contentBlocker{
-					mode:   mode,
-					regexp: regexp,
-				})
+				blocker := &contentBlocker{
+					mode:     mode,
+					regexp:   regexp,
+					template: rule.With,
+					hashKey:  hashKey,
+					vault:    plugin.vault,
+				}
+				if detected != nil {
+					blocker.validate = detected.validate
+					if rule.Locale != "" {
+						logger.Printf("Added rule: %s %s content detected as %s (%s)", mode, contentKind, rule.Detector, rule.Locale)
+					} else {
+						logger.Printf("Added rule: %s %s content detected as %s", mode, contentKind, rule.Detector)
+					}
+				} else if mode == replaceMode {
+					logger.Printf("Added rule: %s %s content matching \"%s\" with \"%s\"", mode, contentKind, regexp, rule.With)
+				} else {
+					logger.Printf("Added rule: %s %s content matching \"%s\"", mode, contentKind, regexp)
+				}
+				blockers = append(blockers, blocker)
 			}
 		}
 
@@ -93,6 +220,10 @@ func (f contentBlockerPluginFactory) New(configSection *config.Section) (traffic
 			plugin.bodyBlockers = append(plugin.bodyBlockers, blockers...)
 		case "header":
 			plugin.headerBlockers = append(plugin.headerBlockers, blockers...)
+		case "response-body":
+			plugin.responseBodyBlockers = append(plugin.responseBodyBlockers, blockers...)
+		case "response-header":
+			plugin.responseHeaderBlockers = append(plugin.responseHeaderBlockers, blockers...)
 		default:
 			return fmt.Errorf(`unexpected content kind %s`, contentKind)
 		}
@@ -106,6 +237,32 @@ func (f contentBlockerPluginFactory) New(configSection *config.Section) (traffic
 	if err := config.ParseOptional(configSection, "header", addRules); err != nil {
 		return nil, err
 	}
+	if err := config.ParseOptional(configSection, "response-body", addRules); err != nil {
+		return nil, err
+	}
+	if err := config.ParseOptional(configSection, "response-header", addRules); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "import", func(key string, sources []ConfigImport) error {
+		for _, source := range sources {
+			rules, err := importRules(source)
+			if err != nil {
+				return err
+			}
+			count := 0
+			for _, contentKind := range []string{"body", "header", "response-body", "response-header"} {
+				if err := addRules(contentKind, rules[contentKind]); err != nil {
+					return fmt.Errorf(`Invalid rule imported from "%v": %v`, source.File, err)
+				}
+				count += len(rules[contentKind])
+			}
+			logger.Printf("Imported %d rules from %s", count, source.File)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
 	if err := config.ParseOptional(
 		configSection,
@@ -144,16 +301,132 @@ func (f contentBlockerPluginFactory) New(configSection *config.Section) (traffic
 		return nil, err
 	}
 
-	if len(plugin.bodyBlockers) == 0 && len(plugin.headerBlockers) == 0 {
+	if err := config.ParseOptional(configSection, "query", func(key string, rules []ConfigQueryRule) error {
+		for _, rule := range rules {
+			blocker, err := newQueryBlocker(rule)
+			if err != nil {
+				return err
+			}
+			logger.Printf("Added rule: %s", blocker)
+			plugin.queryBlockers = append(plugin.queryBlockers, blocker)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "json", func(key string, rules []ConfigJsonRule) error {
+		for _, rule := range rules {
+			blocker, err := newJsonBlocker(rule)
+			if err != nil {
+				return err
+			}
+			if blocker.class != "" {
+				logger.Printf("Added rule: %s JSON values at \"%s\" as %s", blocker.action, blocker.path, blocker.class)
+			} else {
+				logger.Printf("Added rule: %s JSON values at \"%s\"", blocker.action, blocker.path)
+			}
+			plugin.jsonBlockers = append(plugin.jsonBlockers, blocker)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "protobuf", func(key string, rules []ConfigProtobufRule) error {
+		descriptorSetFile, err := config.LookupRequired[string](configSection, "protobuf-descriptor-set-file")
+		if err != nil {
+			return err
+		}
+		messageName, err := config.LookupRequired[string](configSection, "protobuf-message")
+		if err != nil {
+			return err
+		}
+		blocker, err := newProtobufBlocker(descriptorSetFile, messageName, rules, hashKey)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if rule.Clear != "" {
+				logger.Printf("Added rule: %s protobuf field \"%s\" in %s", protobufClearAction, rule.Clear, messageName)
+			} else {
+				logger.Printf("Added rule: %s protobuf field \"%s\" in %s", protobufHashAction, rule.Hash, messageName)
+			}
+		}
+		plugin.protobufBlocker = blocker
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(plugin.bodyBlockers) == 0 &&
+		len(plugin.headerBlockers) == 0 &&
+		len(plugin.jsonBlockers) == 0 &&
+		plugin.protobufBlocker == nil &&
+		len(plugin.queryBlockers) == 0 &&
+		len(plugin.responseBodyBlockers) == 0 &&
+		len(plugin.responseHeaderBlockers) == 0 {
 		return nil, nil
 	}
 
+	for _, option := range []struct {
+		key         string
+		destination *int64
+	}{
+		{"streaming-threshold", &plugin.streamingThreshold},
+		{"streaming-chunk-size", &plugin.streamingChunkSize},
+		{"streaming-overlap", &plugin.streamingOverlap},
+	} {
+		if value, err := config.LookupOptional[int64](configSection, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 0 {
+				return nil, fmt.Errorf(`Invalid %v "%v": must not be negative`, option.key, *value)
+			}
+			*option.destination = *value
+		}
+	}
+	if plugin.streamingChunkSize == 0 {
+		return nil, fmt.Errorf(`Invalid streaming-chunk-size: must be positive`)
+	}
+	if plugin.streamingThreshold > 0 {
+		logger.Printf(
+			"Streaming bodies larger than %d bytes in %d byte chunks with %d byte overlap",
+			plugin.streamingThreshold,
+			plugin.streamingChunkSize,
+			plugin.streamingOverlap,
+		)
+	}
+
 	return plugin, nil
 }
 
 type contentBlockerPlugin struct {
 	bodyBlockers   []*contentBlocker
 	headerBlockers []*contentBlocker
+	jsonBlockers   []*jsonBlocker
+	queryBlockers  []*queryBlocker
+
+	protobufBlocker *protobufBlocker // Nil unless there are protobuf rules.
+
+	responseBodyBlockers   []*contentBlocker
+	responseHeaderBlockers []*contentBlocker
+
+	// Bodies larger than streamingThreshold bytes are redacted incrementally.
+	// A threshold of zero disables streaming.
+	streamingThreshold int64
+	streamingChunkSize int64
+	streamingOverlap   int64
+
+	vault      *tokenize.Vault // Nil unless tokenization is configured.
+	detokenize bool            // True if the detokenization endpoint is served.
+
+	metrics *metrics.PluginMetrics
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *contentBlockerPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
 }
 
 func (plug contentBlockerPlugin) Name() string {
@@ -169,6 +442,13 @@ func (plug contentBlockerPlugin) HandleRequest(
 		return false
 	}
 
+	// Only the relay may classify request content; don't trust a manifest
+	// sent by the client.
+	if hasDataClasses(plug.jsonBlockers) {
+		request.Header.Del(DataClassesHeaderName)
+	}
+
+	plug.metrics.BytesRedacted(blockQuery(request, plug.queryBlockers))
 	if serviced := plug.blockHeaderContent(response, request); serviced {
 		return true
 	}
@@ -187,69 +467,236 @@ func (plug contentBlockerPlugin) blockHeaderContent(response http.ResponseWriter
 		return false
 	}
 
-	for _, headerValues := range request.Header {
+	blockHeaders(request.Header, plug.headerBlockers)
+	return false
+}
+
+// blockHeaders applies the blockers to the values (but not the names) of the
+// provided headers.
+func blockHeaders(headers http.Header, blockers []*contentBlocker) {
+	for _, headerValues := range headers {
 		for i, headerValue := range headerValues {
 			processedValue := []byte(headerValue)
-			for _, blocker := range plug.headerBlockers {
+			for _, blocker := range blockers {
 				processedValue = blocker.Block(processedValue)
 			}
 			headerValues[i] = string(processedValue)
 		}
 	}
-
-	return false
 }
 
 func (plug contentBlockerPlugin) blockBodyContent(response http.ResponseWriter, request *http.Request) bool {
-	if len(plug.bodyBlockers) == 0 {
+	if len(plug.bodyBlockers) == 0 && len(plug.jsonBlockers) == 0 && plug.protobufBlocker == nil {
 		return false
 	}
 
-	// Block all websocket connections if we're blocking body content.
-	// TODO(sethf): This is necessary because the current plugin architecture
-	// doesn't give us a hook that would allow us to handle websocket messages,
-	// so we wouldn't be able to actually do any blocking. The safest thing to
-	// do for now is to fail closed. In the short term, this won't do any harm,
-	// because we don't actually need to support websockets, but if that changes
-	// we'll need to revisit this.
-	if len(plug.bodyBlockers) > 0 && request.Header.Get("Upgrade") == "websocket" {
-		logger.Println("Rejecting websocket connection (content blocking is not supported with websockets):", request.URL)
-		http.Error(response, fmt.Sprintf("Blocking unsupported websocket connection: %v", request.URL), 500)
-		return true
+	// Websocket messages are handled by HandleMessage once the
+	// connection is upgraded, and gRPC messages by HandleGrpcMessage as
+	// they're relayed.
+	if request.Body == nil || request.Body == http.NoBody || traffic.IsGrpcRequest(request) {
+		return false
 	}
 
-	if request.Body == nil || request.Body == http.NoBody {
+	// JSON and protobuf rules need the entire body, so those requests are
+	// never streamed; nor are forms, whose parameters are blocked one by one.
+	jsonRequest := len(plug.jsonBlockers) > 0 && isJsonRequest(request)
+	protobufRequest := plug.protobufBlocker != nil && isProtobufRequest(request)
+	formRequest := len(plug.bodyBlockers) > 0 && isFormRequest(request)
+
+	if !jsonRequest && !protobufRequest && !formRequest && plug.shouldStream(request) {
+		blocker := newStreamingBlocker(
+			request.Body,
+			plug.bodyBlockers,
+			int(plug.streamingChunkSize),
+			int(plug.streamingOverlap),
+			plug.metrics,
+		)
+
+		// Masking preserves the length of the body, but excluding content
+		// changes it in ways we can't know in advance.
+		if plug.preservesLength() {
+			blocker.size = request.ContentLength
+		}
+		request.Body = blocker
 		return false
 	}
 
 	processedBody, err := io.ReadAll(request.Body)
 	if err != nil {
+		plug.metrics.Error()
 		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), 500)
 		request.Body = http.NoBody
 		return true
 	}
 
-	for _, blocker := range plug.bodyBlockers {
-		processedBody = blocker.Block(processedBody)
+	modified := false
+	if jsonRequest && len(processedBody) > 0 {
+		if blockedBody, manifest, err := blockJson(processedBody, plug.jsonBlockers); err != nil {
+			plug.metrics.Error()
+			logger.Errorf("Error parsing JSON body, JSON rules were not applied: %s", err)
+		} else {
+			modified = !bytes.Equal(blockedBody, processedBody)
+			processedBody = blockedBody
+			if manifest != "" {
+				request.Header.Set(DataClassesHeaderName, manifest)
+			}
+		}
 	}
 
-	// If the length of the body has changed, we should update the
-	// Content-Length header too.
-	contentLength := int64(len(processedBody))
-	if contentLength != request.ContentLength {
-		request.ContentLength = contentLength
-		request.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	if protobufRequest && len(processedBody) > 0 {
+		if blockedBody, count, err := plug.protobufBlocker.Block(processedBody); err != nil {
+			plug.metrics.Error()
+			logger.Errorf("Error decoding protobuf body, protobuf rules were not applied: %s", err)
+		} else if count > 0 {
+			modified = true
+			processedBody = blockedBody
+		}
 	}
 
-	request.Body = io.NopCloser(bytes.NewBuffer(processedBody))
+	var redacted int
+	if formRequest {
+		processedBody, redacted = blockForm(processedBody, plug.bodyBlockers)
+	} else {
+		processedBody, redacted = applyBlockers(processedBody, plug.bodyBlockers)
+	}
+	if modified || redacted > 0 {
+		plug.metrics.BodyModified()
+		plug.metrics.BytesRedacted(redacted)
+	}
+
+	traffic.SetRequestBody(request, processedBody)
 	return false
 }
 
+// NeedsResponseBody implements traffic.ResponseBodyPlugin. Response bodies are
+// only buffered if there are rules to apply to them.
+func (plug contentBlockerPlugin) NeedsResponseBody() bool {
+	return len(plug.responseBodyBlockers) > 0
+}
+
+// HandleResponse applies the response block rules to the target's response.
+func (plug contentBlockerPlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	blockHeaders(response.Header, plug.responseHeaderBlockers)
+
+	if len(plug.responseBodyBlockers) == 0 || response.Body == nil || response.Body == http.NoBody {
+		return
+	}
+
+	processedBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		// Don't risk relaying content that should have been blocked.
+		plug.metrics.Error()
+		logger.Errorf("Error reading response body: %s", err)
+		processedBody = nil
+	}
+	processedBody, redacted := applyBlockers(processedBody, plug.responseBodyBlockers)
+	if redacted > 0 {
+		plug.metrics.BodyModified()
+		plug.metrics.BytesRedacted(redacted)
+	}
+
+	traffic.SetResponseBody(response, processedBody)
+}
+
+// HandleServerSentEvent applies the response body rules to the data lines of
+// the events the target streams, since event streams aren't buffered for
+// HandleResponse.
+func (plug contentBlockerPlugin) HandleServerSentEvent(request *http.Request, event *traffic.ServerSentEvent) {
+	if len(plug.responseBodyBlockers) == 0 {
+		return
+	}
+	total := 0
+	for i, line := range event.Lines {
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		blocked, redacted := applyBlockers([]byte(data), plug.responseBodyBlockers)
+		if redacted > 0 {
+			event.Lines[i] = "data:" + string(blocked)
+			total += redacted
+		}
+	}
+	if total > 0 {
+		plug.metrics.BodyModified()
+		plug.metrics.BytesRedacted(total)
+	}
+}
+
+// shouldStream returns true if the request body should be redacted
+// incrementally rather than buffered in full.
+func (plug contentBlockerPlugin) shouldStream(request *http.Request) bool {
+	if plug.streamingThreshold <= 0 {
+		return false
+	}
+	return request.ContentLength < 0 || request.ContentLength > plug.streamingThreshold
+}
+
+// preservesLength returns true if applying the body blockers can never change
+// the length of the body.
+func (plug contentBlockerPlugin) preservesLength() bool {
+	for _, blocker := range plug.bodyBlockers {
+		if blocker.mode != maskMode {
+			return false
+		}
+	}
+	return true
+}
+
+// AdminHandler implements traffic.AdminPlugin. If 'detokenize-token' is set,
+// it serves the detokenization endpoint at tokenize.DetokenizePath; requests
+// must carry the token as a bearer token.
+func (plug contentBlockerPlugin) AdminHandler() http.Handler {
+	if plug.vault == nil || !plug.detokenize {
+		return http.NotFoundHandler()
+	}
+	return plug.vault.Handler()
+}
+
+// HandleMessage implements traffic.WsPlugin. It applies the body block rules
+// to the text messages the client sends over a websocket connection, and the
+// response body rules to those the target sends, just as they're applied to
+// request and response bodies. Binary messages are relayed unchanged.
+func (plug contentBlockerPlugin) HandleMessage(direction traffic.WebsocketDirection, messageType traffic.WebsocketMessageType, payload []byte) ([]byte, bool) {
+	if messageType != traffic.WebsocketTextMessage {
+		return payload, false
+	}
+	blockers := plug.bodyBlockers
+	if direction == traffic.TargetToClient {
+		blockers = plug.responseBodyBlockers
+	}
+	payload, redacted := applyBlockers(payload, blockers)
+	plug.metrics.BytesRedacted(redacted)
+	return payload, false
+}
+
+// HandleGrpcMessage applies the protobuf rules to the messages sent by the
+// client in a gRPC call. Every message of the call is decoded as the type named
+// by 'protobuf-message'.
+func (plug contentBlockerPlugin) HandleGrpcMessage(request *http.Request, message *traffic.GrpcMessage) {
+	if plug.protobufBlocker == nil || message.Direction != traffic.ClientToTarget || len(message.Payload) == 0 {
+		return
+	}
+	blocked, count, err := plug.protobufBlocker.Block(message.Payload)
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error decoding gRPC message, protobuf rules were not applied: %s", err)
+		return
+	}
+	if count > 0 {
+		plug.metrics.BodyModified()
+		message.Payload = blocked
+	}
+}
+
 type contentBlockerMode int64
 
 const (
 	maskMode contentBlockerMode = iota
 	excludeMode
+	hashMode
+	tokenizeMode
+	replaceMode
 )
 
 func (mode contentBlockerMode) String() string {
@@ -258,6 +705,12 @@ func (mode contentBlockerMode) String() string {
 		return "mask"
 	case excludeMode:
 		return "exclude"
+	case hashMode:
+		return "hash"
+	case tokenizeMode:
+		return "tokenize"
+	case replaceMode:
+		return "replace"
 	default:
 		return "(unknown mode)"
 	}
@@ -265,26 +718,106 @@ func (mode contentBlockerMode) String() string {
 
 var maskSymbol = []byte("*")
 
-// contentBlocker applies a content blocking transformation (either exclude or
-// mask) to content that matches a regular expression.
+// contentBlocker applies a content blocking transformation (exclude, mask,
+// hash, tokenize, or replace) to content that matches a regular expression.
 type contentBlocker struct {
-	mode   contentBlockerMode
-	regexp *regexp.Regexp
+	mode     contentBlockerMode
+	regexp   *regexp.Regexp
+	template string          // The replacement template, for replaceMode.
+	hashKey  *secrets.Secret // The HMAC key, for hashMode.
+	vault    *tokenize.Vault // For tokenizeMode.
+
+	// If non-nil, matches for which validate returns false are left alone.
+	validate func(matched []byte) bool
 }
 
 func (b *contentBlocker) Block(content []byte) []byte {
+	blocked, _ := b.BlockAndCount(content)
+	return blocked
+}
+
+// BlockAndCount is like Block, but also returns the number of bytes of content
+// which were blocked.
+func (b *contentBlocker) BlockAndCount(content []byte) ([]byte, int) {
+	count := 0
 	switch b.mode {
 	case maskMode:
-		return b.regexp.ReplaceAllFunc(content, func(matched []byte) []byte {
+		return b.replaceMatches(content, func(matched []byte) []byte {
 			return bytes.Repeat(maskSymbol, len(matched))
 		})
 	case excludeMode:
-		return b.regexp.ReplaceAllLiteral(content, []byte{})
+		return b.replaceMatches(content, func(matched []byte) []byte {
+			return []byte{}
+		})
+	case hashMode:
+		key, err := b.hashKey.Value()
+		if err != nil {
+			// The last key read successfully is still returned.
+			logger.Errorf("Error reading hash key: %s", err)
+		}
+		return b.replaceMatches(content, func(matched []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(matched)
+			return []byte(hex.EncodeToString(mac.Sum(nil)))
+		})
+	case tokenizeMode:
+		return b.replaceMatches(content, func(matched []byte) []byte {
+			token, err := b.vault.Tokenize(matched)
+			if err != nil {
+				// The token is still used, so the content isn't leaked; it
+				// just can't be detokenized until the store recovers.
+				logger.Errorf("Error tokenizing content: %s", err)
+			}
+			return []byte(token)
+		})
+	case replaceMode:
+		// ReplaceAllFunc doesn't expose capture groups, so the matches are
+		// expanded one at a time.
+		matches := b.regexp.FindAllSubmatchIndex(content, -1)
+		if len(matches) == 0 {
+			return content, 0
+		}
+		result := []byte{}
+		last := 0
+		for _, match := range matches {
+			count += match[1] - match[0]
+			result = append(result, content[last:match[0]]...)
+			result = b.regexp.Expand(result, []byte(b.template), content, match)
+			last = match[1]
+		}
+		return append(result, content[last:]...), count
 	default:
 		panic(fmt.Errorf("invalid content blocking mode: %v", b.mode))
 	}
 }
 
+// replaceMatches replaces each match which passes validation, if there is
+// any, with the result of replace, returning the result and the number of
+// bytes replaced.
+func (b *contentBlocker) replaceMatches(content []byte, replace func(matched []byte) []byte) ([]byte, int) {
+	count := 0
+	result := b.regexp.ReplaceAllFunc(content, func(matched []byte) []byte {
+		if b.validate != nil && !b.validate(matched) {
+			return matched
+		}
+		count += len(matched)
+		return replace(matched)
+	})
+	return result, count
+}
+
+// applyBlockers applies each of the blockers to the content in turn, returning
+// the result and the total number of bytes excluded or masked.
+func applyBlockers(content []byte, blockers []*contentBlocker) ([]byte, int) {
+	total := 0
+	for _, blocker := range blockers {
+		var count int
+		content, count = blocker.BlockAndCount(content)
+		total += count
+	}
+	return content, total
+}
+
 /*
 Copyright 2022 FullStory, Inc.
 
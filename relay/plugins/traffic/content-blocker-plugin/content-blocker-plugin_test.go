@@ -2,17 +2,26 @@ package content_blocker_plugin_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/immersa-co/relay-core/catcher"
 	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
 	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
 	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/tokenize"
 	"github.com/immersa-co/relay-core/relay/traffic"
 	"github.com/immersa-co/relay-core/relay/version"
+	"golang.org/x/net/websocket"
 )
 
 func TestContentBlocking(t *testing.T) {
@@ -131,49 +140,310 @@ func TestContentBlocking(t *testing.T) {
 				"X-Special-Header": "Some EXCLUDED,  content",
 			},
 		},
+		{
+			desc: "Large bodies can be excluded incrementally",
+			config: `block-content:
+                        body:
+                          - exclude: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+                        streaming-threshold: 16
+                        streaming-chunk-size: 8
+                        streaming-overlap: 16
+            `,
+			originalBody: `{ "a": "215.1.0.335", "b": "10.0.0.1", "c": "192.168.100.200", "d": "1.2.3.4" }`,
+			expectedBody: `{ "a": "", "b": "", "c": "", "d": "" }`,
+			streaming:    true,
+		},
+		{
+			desc: "Large bodies can be masked incrementally",
+			config: `block-content:
+                        body:
+                          - mask: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+                        streaming-threshold: 16
+                        streaming-chunk-size: 8
+                        streaming-overlap: 16
+            `,
+			originalBody: `{ "a": "215.1.0.335", "b": "10.0.0.1", "c": "192.168.100.200", "d": "1.2.3.4" }`,
+			expectedBody: `{ "a": "***********", "b": "********", "c": "***************", "d": "*******" }`,
+			streaming:    true,
+		},
+		{
+			desc: "JSON values can be excluded, masked, and hashed by path",
+			config: `block-content:
+                        json:
+                          - exclude: user.password
+                          - mask: events[*].ip
+                          - hash: user.email
+                          - hash: $.user.id
+            `,
+			originalBody: `{"user": {"email": "jane@example.com", "password": "hunter2", "id": 42}, "events": [{"ip": "10.0.0.1", "n": 1}, {"ip": "192.168.0.1", "n": 2}]}`,
+			expectedBody: `{"events":[{"ip":"********","n":1},{"ip":"***********","n":2}],"user":{"email":"8c87b489ce35cf2e2f39f80e282cb2e804932a56a213983eeeb428407d43b52d","id":"73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049"}}`,
+		},
+		{
+			desc: "JSON array elements can be excluded",
+			config: `block-content:
+                        json:
+                          - exclude: events[0]
+                          - exclude: '*.secret'
+            `,
+			originalBody: `{"events": ["first", "second"], "a": {"secret": 1, "b": 2}, "c": {"secret": {"deep": true}}}`,
+			expectedBody: `{"a":{"b":2},"c":{},"events":["second"]}`,
+		},
+		{
+			desc: "JSON bodies are unchanged if no paths match",
+			config: `block-content:
+                        json:
+                          - mask: user.email
+            `,
+			originalBody: `{ "content": "no user here" }`,
+			expectedBody: `{ "content": "no user here" }`,
+		},
+		{
+			desc: "JSON rules are applied before regular expression rules",
+			config: `block-content:
+                        json:
+                          - hash: ip
+                        body:
+                          - mask: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+            `,
+			originalBody: `{ "ip": "10.0.0.1", "note": "from 10.0.0.1" }`,
+			expectedBody: `{"ip":"` + sha256Hex("10.0.0.1") + `","note":"from ********"}`,
+		},
+		{
+			desc: "JSON values can be classified without being modified",
+			config: `block-content:
+                        json:
+                          - classify: user.email
+                            class: pii
+                          - classify: user.phone
+                            class: pii
+                          - classify: events[*].ip
+                            class: sensitive
+                          - classify: missing
+                            class: sensitive
+                          - classify: id
+                            class: public
+            `,
+			originalBody: `{ "id": 7, "user": { "email": "jane@example.com", "phone": "555-0100" }, "events": [{ "ip": "10.0.0.1" }] }`,
+			expectedBody: `{ "id": 7, "user": { "email": "jane@example.com", "phone": "555-0100" }, "events": [{ "ip": "10.0.0.1" }] }`,
+			expectedHeaders: map[string]string{
+				content_blocker_plugin.DataClassesHeaderName: "pii=user.email,user.phone;sensitive=events[*].ip;public=id",
+			},
+		},
+		{
+			desc: "Blocked JSON values can be classified, except when excluded",
+			config: `block-content:
+                        json:
+                          - hash: user.email
+                            class: pii
+                          - exclude: user.password
+                            class: sensitive
+            `,
+			originalBody: `{"user": {"email": "jane@example.com", "password": "hunter2"}}`,
+			expectedBody: `{"user":{"email":"` + sha256Hex("jane@example.com") + `"}}`,
+			expectedHeaders: map[string]string{
+				content_blocker_plugin.DataClassesHeaderName: "pii=user.email",
+			},
+		},
+		{
+			desc: "Body content can be hashed",
+			config: `block-content:
+                        hash-key: secret
+                        body:
+                          - hash: '[a-z]+@example\.com'
+            `,
+			originalBody: `{ "from": "jane@example.com", "to": "joe@example.com", "cc": "jane@example.com" }`,
+			expectedBody: `{ "from": "` + hmacHex("secret", "jane@example.com") + `", "to": "` + hmacHex("secret", "joe@example.com") +
+				`", "cc": "` + hmacHex("secret", "jane@example.com") + `" }`,
+		},
+		{
+			desc: "Header content can be hashed",
+			config: `block-content:
+                        hash-key: secret
+                        header:
+                          - hash: 'user-[0-9]+'
+            `,
+			originalHeaders: map[string]string{
+				"X-User": "user-123",
+			},
+			expectedHeaders: map[string]string{
+				"X-User": hmacHex("secret", "user-123"),
+			},
+		},
+		{
+			desc: "Body content can be replaced using capture groups",
+			config: `block-content:
+                        body:
+                          - replace: '([0-9]{3})-[0-9]{3}-([0-9]{4})'
+                            with: '$1-XXX-$2'
+                          - replace: '(?P<user>[a-z]+)@(?P<domain>[a-z.]+)'
+                            with: 'user@${domain}'
+            `,
+			originalBody: `{ "phone": "555-123-4567", "email": "jane@example.com" }`,
+			expectedBody: `{ "phone": "555-XXX-4567", "email": "user@example.com" }`,
+		},
+		{
+			desc: "Credit card numbers which pass the Luhn check are masked",
+			config: `block-content:
+                        body:
+                          - detector: credit-card
+            `,
+			originalBody: `{ "card": "4111 1111 1111 1111", "amex": "378282246310005", "order": "1234567890123" }`,
+			expectedBody: `{ "card": "*******************", "amex": "***************", "order": "1234567890123" }`,
+		},
+		{
+			desc: "Detected content can be blocked using other actions",
+			config: `block-content:
+                        header:
+                          - detector: credit-card
+                            action: exclude
+            `,
+			originalHeaders: map[string]string{
+				"X-Card": "card=5555-5555-5555-4444;ref=4111111111111112",
+			},
+			expectedHeaders: map[string]string{
+				"X-Card": "card=;ref=4111111111111112",
+			},
+		},
+		{
+			desc: "Detectors can be combined and selected by locale",
+			config: `block-content:
+                        body:
+                          - detector: email
+                            action: exclude
+                          - detector: phone
+                            locale: gb
+                          - detector: iban
+            `,
+			originalBody: `{ "email": "jane@example.com", "phone": "020 7946 0958", "iban": "GB29NWBK60161331926819", "ref": "GB29NWBK60161331926818" }`,
+			expectedBody: `{ "email": "", "phone": "*************", "iban": "**********************", "ref": "GB29NWBK60161331926818" }`,
+		},
+		{
+			desc: "Form parameter values are blocked after they're unescaped",
+			config: `block-content:
+                        body:
+                          - detector: email
+                            action: exclude
+                          - detector: ssn
+                          - mask: 'secret \w+'
+            `,
+			originalHeaders: map[string]string{
+				"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+			},
+			originalBody: `email=jane%40example.com&ssn=123%2D45%2D6789&note=my+secret+plan&tags=a%2Cb`,
+			expectedBody: `email=&ssn=***********&note=my+***********&tags=a%2Cb`,
+		},
+		{
+			desc: "Form parameters are unchanged if no rules match",
+			config: `block-content:
+                        body:
+                          - detector: email
+            `,
+			originalHeaders: map[string]string{
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			originalBody: `name=Jane%20Doe&city=S%C3%A3o+Paulo&flag`,
+			expectedBody: `name=Jane%20Doe&city=S%C3%A3o+Paulo&flag`,
+		},
+		{
+			desc: "Data class manifests sent by the client are discarded",
+			config: `block-content:
+                        json:
+                          - classify: user.email
+                            class: pii
+            `,
+			originalBody: `{ "content": "no user here" }`,
+			expectedBody: `{ "content": "no user here" }`,
+			originalHeaders: map[string]string{
+				content_blocker_plugin.DataClassesHeaderName: "public=user.email",
+			},
+			expectedHeaders: map[string]string{
+				content_blocker_plugin.DataClassesHeaderName: "",
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
 		runContentBlockerTest(t, testCase, traffic.Identity)
 		runContentBlockerTest(t, testCase, traffic.Gzip)
+		runContentBlockerTest(t, testCase, traffic.Brotli)
+		runContentBlockerTest(t, testCase, traffic.Zstd)
+	}
+}
+
+func TestBlockRuleValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"body:\n      - {}",
+		"body:\n      - exclude: a\n        mask: b",
+		"body:\n      - hash: a",
+		"hash-key: k\n    body:\n      - hash: a\n        replace: b",
+		"body:\n      - mask: a\n        with: b",
+		"header:\n      - replace: '('\n        with: b",
+		"body:\n      - tokenize: a",
+		"token-key: k\n    token-store: redis\n    body:\n      - tokenize: a",
+		"body:\n      - detector: passport",
+		"body:\n      - detector: credit-card\n        action: replace",
+		"body:\n      - detector: credit-card\n        action: hash",
+		"body:\n      - detector: credit-card\n        mask: a",
+		"body:\n      - mask: a\n        action: exclude",
+		"body:\n      - mask: a\n        locale: us",
+		"body:\n      - detector: ssn\n        locale: us",
+		"body:\n      - detector: phone\n        locale: xx",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("block-content:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := content_blocker_plugin.Factory.New(configFile.LookupOptionalSection("block-content")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
 	}
 }
 
-func TestBlockPluginBlocksWebsockets(t *testing.T) {
+func TestBlockPluginBlocksWebsocketMessages(t *testing.T) {
 	config := `block-content:
                   body:
                     - mask: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+                    - exclude: 'EXCLUDED'
+                  response-body:
+                    - mask: 'ECHOED'
     `
 	plugins := []traffic.PluginFactory{
 		content_blocker_plugin.Factory,
 	}
 
 	test.WithCatcherAndRelay(t, config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
-		request, err := http.NewRequest(
-			"POST",
-			relayService.HttpUrl(),
-			bytes.NewBufferString(`{ "content": "192.168.0.1" }`),
-		)
+		echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+		ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
 		if err != nil {
-			t.Errorf("Error creating request: %v", err)
+			t.Errorf("Error dialing websocket: %v", err)
 			return
 		}
+		defer ws.Close()
 
-		request.Header.Set("Content-Type", "application/json")
-		request.Header.Set("Upgrade", "websocket")
-
-		response, err := http.DefaultClient.Do(request)
-		if err != nil {
-			t.Errorf("Error POSTing: %v", err)
-			return
+		// The catcher echoes back whatever it receives, so the echoed messages
+		// show what the target saw, with the response rules applied.
+		testCases := map[string]string{
+			`{ "content": "192.168.0.1" }`: `{ "content": "***********" }`,
+			`EXCLUDED content`:             ` content`,
+			`ECHOED content`:               `****** content`,
+			`nothing to block`:             `nothing to block`,
 		}
-		defer response.Body.Close()
-
-		// This plugin doesn't support websockets, so we should fail closed and
-		// the attempt to establish a websocket connection should fail.
-		if response.StatusCode != 500 {
-			t.Errorf("Expected 500 response: %v", response)
-			return
+		for original, expected := range testCases {
+			if err := websocket.Message.Send(ws, original); err != nil {
+				t.Errorf("Error sending websocket message: %v", err)
+				return
+			}
+			var received string
+			if err := websocket.Message.Receive(ws, &received); err != nil {
+				t.Errorf("Error receiving websocket message: %v", err)
+				return
+			}
+			if received != expected {
+				t.Errorf("Expected websocket message '%v' but got '%v'", expected, received)
+			}
 		}
 	})
 }
@@ -185,17 +455,157 @@ type contentBlockerTestCase struct {
 	expectedBody    string
 	originalHeaders map[string]string
 	expectedHeaders map[string]string
+	// Bodies redacted incrementally may be sent using chunked encoding,
+	// without a Content-Length.
+	streaming bool
 }
 
-func runContentBlockerTest(t *testing.T, testCase contentBlockerTestCase, encoding traffic.Encoding) {
-	var encodingStr string
-	switch encoding {
-	case traffic.Gzip:
-		encodingStr = "gzip"
-	case traffic.Identity:
-		encodingStr = ""
+func TestContentBlockingInResponses(t *testing.T) {
+	configYaml := `block-content:
+                     response-body:
+                       - mask: 'Catcher'
+                     response-header:
+                       - exclude: 'charset=[a-z0-9-]+'
+    `
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		body, _ := io.ReadAll(response.Body)
+		if !bytes.Contains(body, []byte("<title>*******</title>")) || bytes.Contains(body, []byte("Catcher")) {
+			t.Errorf("Expected response body to be masked: %s", body)
+		}
+		if contentType := response.Header.Get("Content-Type"); strings.Contains(contentType, "charset") {
+			t.Errorf("Expected response header content to be excluded: %v", contentType)
+		}
+	})
+}
+
+func TestContentBlockingInServerSentEvents(t *testing.T) {
+	configFile, err := config.NewFileFromYamlString(`block-content:
+    response-body:
+        - mask: 'secret'
+`)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := content_blocker_plugin.Factory.New(configFile.LookupOptionalSection("block-content"))
+	if err != nil {
+		t.Fatalf("Error creating plugin: %v", err)
 	}
 
+	event := &traffic.ServerSentEvent{Lines: []string{"event: secret", "data: the secret", ": secret"}}
+	plugin.(traffic.ServerSentEventPlugin).HandleServerSentEvent(nil, event)
+	expected := []string{"event: secret", "data: the ******", ": secret"}
+	if strings.Join(event.Lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected only data lines to be masked: %q", event.Lines)
+	}
+}
+
+func TestContentTokenization(t *testing.T) {
+	configYaml := `block-content:
+                     token-key: key
+                     detokenize-token: let-me-in
+                     body:
+                       - tokenize: '[0-9]{3}-[0-9]{2}-[0-9]{4}'
+    `
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+			t.Fatalf("Error starting admin listener: %v", err)
+		}
+
+		response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader("SSN: 123-45-6789"))
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		response.Body.Close()
+		body, err := catcherService.LastRequestBody()
+		if err != nil {
+			t.Fatalf("Error reading last request body: %v", err)
+		}
+		token, tokenized := strings.CutPrefix(string(body), "SSN: tok_")
+		if !tokenized || strings.Contains(token, "123") {
+			t.Fatalf("Expected the SSN to be tokenized but got %q", body)
+		}
+		token = "tok_" + token
+
+		detokenize := func(authorization string) (int, map[string]string) {
+			request, _ := http.NewRequest("GET", relayService.AdminUrl()+relay.PluginAdminPath("block-content")+tokenize.DetokenizePath+"?token="+token, nil)
+			if authorization != "" {
+				request.Header.Set("Authorization", authorization)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("Error detokenizing: %v", err)
+			}
+			defer response.Body.Close()
+			var values map[string]string
+			json.NewDecoder(response.Body).Decode(&values)
+			return response.StatusCode, values
+		}
+		if status, _ := detokenize(""); status != http.StatusUnauthorized {
+			t.Errorf("Expected detokenizing without credentials to be rejected but got status %v", status)
+		}
+		if status, values := detokenize("Bearer let-me-in"); status != http.StatusOK || values[token] != "123-45-6789" {
+			t.Errorf("Expected %v to be detokenized but got status %v and %v", token, status, values)
+		}
+	})
+}
+
+func TestContentBlockingMetrics(t *testing.T) {
+	configYaml := `block-content:
+                     body:
+                       - mask: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+    `
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+
+	test.WithCatcherAndRelayMetrics(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for _, body := range []string{"IP address = 215.1.0.335", "nothing to block"} {
+			response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Errorf("Error POSTing: %v", err)
+				return
+			}
+			response.Body.Close()
+		}
+	}, func(metrics *test.Metrics) {
+		for _, expected := range []struct {
+			name  string
+			value float64
+		}{
+			{"requests_total", 2},
+			{"bodies_modified_total", 1},
+			{"bytes_redacted_total", 11},
+		} {
+			if value := metrics.Plugin("block-content", expected.name); value != expected.value {
+				t.Errorf("Expected %v to be %v but got %v", expected.name, expected.value, value)
+			}
+		}
+	})
+}
+
+func hmacHex(key string, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sha256Hex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func runContentBlockerTest(t *testing.T, testCase contentBlockerTestCase, encoding traffic.Encoding) {
+	encodingStr := encoding.HeaderValue()
+
 	// Add encoding to the test description
 	desc := fmt.Sprintf("%s (encoding: %v)", testCase.desc, encodingStr)
 
@@ -232,8 +642,8 @@ func runContentBlockerTest(t *testing.T, testCase contentBlockerTestCase, encodi
 			return
 		}
 
-		if encoding == traffic.Gzip {
-			request.Header.Set("Content-Encoding", "gzip")
+		if encoding != traffic.Identity {
+			request.Header.Set("Content-Encoding", encodingStr)
 		}
 
 		request.Header.Set("Content-Type", "application/json")
@@ -287,19 +697,21 @@ func runContentBlockerTest(t *testing.T, testCase contentBlockerTestCase, encodi
 			return
 		}
 
-		contentLength, err := strconv.Atoi(lastRequest.Header.Get("Content-Length"))
-		if err != nil {
-			t.Errorf("Test '%v': Error parsing Content-Length: %v", desc, err)
-			return
-		}
+		if !testCase.streaming {
+			contentLength, err := strconv.Atoi(lastRequest.Header.Get("Content-Length"))
+			if err != nil {
+				t.Errorf("Test '%v': Error parsing Content-Length: %v", desc, err)
+				return
+			}
 
-		if contentLength != len(lastRequestBody) {
-			t.Errorf(
-				"Test '%v': Content-Length is %v but actual body length is %v",
-				desc,
-				contentLength,
-				len(lastRequestBody),
-			)
+			if contentLength != len(lastRequestBody) {
+				t.Errorf(
+					"Test '%v': Content-Length is %v but actual body length is %v",
+					desc,
+					contentLength,
+					len(lastRequestBody),
+				)
+			}
 		}
 
 		decodedRequestBody, err := traffic.DecodeData(lastRequestBody, encoding)
@@ -0,0 +1,252 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A detector is a built-in rule which finds a kind of sensitive content more
+// reliably than a regular expression alone could. Candidates are found using
+// a regular expression, and then validated, so that content which merely
+// looks similar is left alone. Rules select a detector by name with their
+// Detector property, and choose what to do with detected content with their
+// Action property; content is masked by default.
+//
+// Content like phone numbers is written differently in different countries,
+// so some detectors have variants, which rules select with their Locale
+// property. Locales are lowercase ISO 3166 country codes, like "us".
+type detector struct {
+	regexp   *regexp.Regexp
+	validate func(matched []byte) bool
+
+	// The detector's variants, by locale. If nil, the detector has none.
+	locales map[string]*detector
+}
+
+var detectors = map[string]*detector{
+	// Payment card numbers (PANs) have 13 to 19 digits, which may be grouped
+	// using spaces or hyphens, and end with a Luhn check digit. Requiring a
+	// valid check digit keeps most order numbers and other IDs from being
+	// mistaken for card numbers.
+	"credit-card": {
+		regexp:   regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){12,18}\b`),
+		validate: luhnValid,
+	},
+
+	// Email addresses. Only the characters which addresses commonly use are
+	// matched in the local part, so that the keys of form-encoded bodies, like
+	// "email=", aren't swallowed along with it.
+	"email": {
+		regexp:   regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)+`),
+		validate: emailValid,
+	},
+
+	// Phone numbers in international E.164 format: a "+", a country code, and
+	// up to 15 digits in all, without separators.
+	"phone-e164": {
+		regexp: regexp.MustCompile(`\+[1-9][0-9]{7,14}\b`),
+	},
+
+	// Phone numbers as they're written within a country. The "us" locale,
+	// which is the default, covers the North American Numbering Plan, like
+	// "(212) 555-0142" or "+1 212.555.0142"; the "gb" locale covers UK
+	// numbers, like "020 7946 0958" or "+44 7700 900123".
+	"phone": withLocales("us", map[string]*detector{
+		"us": {
+			regexp: regexp.MustCompile(`(?:(?:\+1[ .-]?|\b(?:1[ .-]?)?)[2-9][0-9]{2}[ .-]?|(?:\+1 ?)?\([2-9][0-9]{2}\) ?)[2-9][0-9]{2}[ .-]?[0-9]{4}\b`),
+		},
+		"gb": {
+			regexp: regexp.MustCompile(`(?:\+44 ?(?:\(0\) ?)?|\b0)[1-37-9](?:[ -]?[0-9]){8,9}\b`),
+		},
+	}),
+
+	// US Social Security numbers, like "123-45-6789". Separators are required,
+	// since unseparated nine digit numbers are too often something else, and
+	// numbers which the SSA never issues, like those in area 000, 666, or
+	// 900-999, are left alone.
+	"ssn": {
+		regexp:   regexp.MustCompile(`\b[0-9]{3}[ -][0-9]{2}[ -][0-9]{4}\b`),
+		validate: ssnValid,
+	},
+
+	// International Bank Account Numbers, either unbroken or in groups of four
+	// characters, like "DE89 3704 0044 0532 0130 00". Matches must have the
+	// length used by their country and pass the ISO 7064 mod 97 check. A locale
+	// restricts the detector to that country's IBANs.
+	"iban": ibanDetector(),
+}
+
+// detectorActions are the modes which rules using a detector may select.
+var detectorActions = []contentBlockerMode{maskMode, excludeMode, hashMode, tokenizeMode}
+
+// lookupDetector returns the named detector, or its variant for locale if one
+// is given, and the mode selected by action, which defaults to masking.
+func lookupDetector(name string, locale string, action string) (*detector, contentBlockerMode, error) {
+	found := detectors[name]
+	if found == nil {
+		return nil, 0, fmt.Errorf(`Unknown detector "%v": must be one of %v`, name, quotedKeys(detectors))
+	}
+	if locale != "" {
+		if found.locales == nil {
+			return nil, 0, fmt.Errorf(`Detector "%v" doesn't support a locale`, name)
+		}
+		variant := found.locales[locale]
+		if variant == nil {
+			return nil, 0, fmt.Errorf(`Invalid locale "%v" for detector "%v": must be one of %v`, locale, name, quotedKeys(found.locales))
+		}
+		found = variant
+	}
+	if action == "" {
+		return found, maskMode, nil
+	}
+	actions := []string{}
+	for _, mode := range detectorActions {
+		if mode.String() == action {
+			return found, mode, nil
+		}
+		actions = append(actions, fmt.Sprintf(`"%v"`, mode))
+	}
+	return nil, 0, fmt.Errorf(`Invalid action "%v" for detector "%v": must be one of %v`, action, name, strings.Join(actions, ", "))
+}
+
+// withLocales returns a detector with the given variants, which behaves like
+// the variant for defaultLocale when no locale is selected.
+func withLocales(defaultLocale string, locales map[string]*detector) *detector {
+	return &detector{
+		regexp:   locales[defaultLocale].regexp,
+		validate: locales[defaultLocale].validate,
+		locales:  locales,
+	}
+}
+
+func quotedKeys(detectors map[string]*detector) string {
+	keys := []string{}
+	for key := range detectors {
+		keys = append(keys, fmt.Sprintf(`"%v"`, key))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// emailValid rejects matches which no mail server would accept, like those
+// with empty labels in the local part or an all-numeric top-level domain, so
+// that strings like version numbers with an "@" survive.
+func emailValid(content []byte) bool {
+	at := bytes.LastIndexByte(content, '@')
+	local, domain := content[:at], content[at+1:]
+	if len(local) > 64 || len(content) > 254 {
+		return false
+	}
+	if local[0] == '.' || local[len(local)-1] == '.' || bytes.Contains(local, []byte("..")) {
+		return false
+	}
+	tld := domain[bytes.LastIndexByte(domain, '.')+1:]
+	for _, c := range tld {
+		if c < '0' || c > '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// ssnValid returns true if the content is a Social Security number which could
+// have been issued, with consistent separators.
+func ssnValid(content []byte) bool {
+	if content[3] != content[6] {
+		return false
+	}
+	area, group, serial := string(content[0:3]), string(content[4:6]), string(content[7:11])
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// ibanLengths maps the country codes which use IBANs to their IBANs' length.
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22,
+	"BH": 22, "BR": 29, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18,
+	"DO": 28, "EE": 20, "EG": 29, "ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22,
+	"GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28, "HR": 21, "HU": 28, "IE": 22,
+	"IL": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LI": 21,
+	"LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19, "MR": 27,
+	"MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25,
+	"QA": 29, "RO": 24, "RS": 22, "SA": 24, "SE": 24, "SI": 19, "SK": 24, "SM": 27,
+	"TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+func ibanDetector() *detector {
+	pattern := regexp.MustCompile(`\b[A-Z]{2}[0-9]{2}(?:[A-Z0-9]{11,30}|(?: [A-Z0-9]{4}){2,7}(?: [A-Z0-9]{1,3})?)\b`)
+	locales := map[string]*detector{}
+	for country := range ibanLengths {
+		country := country
+		locales[strings.ToLower(country)] = &detector{
+			regexp: pattern,
+			validate: func(content []byte) bool {
+				return string(content[:2]) == country && ibanValid(content)
+			},
+		}
+	}
+	return &detector{regexp: pattern, validate: ibanValid, locales: locales}
+}
+
+// ibanValid returns true if the content, ignoring spaces, has the length of
+// its country's IBANs and passes the mod 97 check.
+func ibanValid(content []byte) bool {
+	iban := bytes.ReplaceAll(content, []byte(" "), nil)
+	if length, ok := ibanLengths[string(iban[:2])]; !ok || len(iban) != length {
+		return false
+	}
+	// The country code and check digits move to the end, and letters become
+	// the numbers 10 to 35; the result, taken mod 97, must be 1.
+	remainder := 0
+	for _, c := range append(iban[4:], iban[:4]...) {
+		if c >= 'A' && c <= 'Z' {
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		} else {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		}
+	}
+	return remainder == 1
+}
+
+// luhnValid returns true if the digits in the content, ignoring separators,
+// have a valid Luhn check digit.
+func luhnValid(content []byte) bool {
+	sum := 0
+	double := false
+	for i := len(content) - 1; i >= 0; i-- {
+		if content[i] < '0' || content[i] > '9' {
+			continue
+		}
+		digit := int(content[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,128 @@
+package content_blocker_plugin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectors(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		detector string
+		locale   string
+		content  string
+		expected []string
+	}{
+		{
+			desc:     "Credit card numbers need a valid check digit",
+			detector: "credit-card",
+			content:  "card 4111-1111-1111-1111, order 4111111111111112",
+			expected: []string{"4111-1111-1111-1111"},
+		},
+		{
+			desc:     "Email addresses are found in JSON and form bodies",
+			detector: "email",
+			content:  `{"email":"jane.doe+news@mail.example.co.uk"}&email=bob@example.com`,
+			expected: []string{"jane.doe+news@mail.example.co.uk", "bob@example.com"},
+		},
+		{
+			desc:     "Email-like strings which aren't addresses are left alone",
+			detector: "email",
+			content:  "lib@1.2.3 .jane@example.com jane..doe@example.com user@localhost",
+			expected: nil,
+		},
+		{
+			desc:     "E.164 phone numbers have a country code and up to 15 digits",
+			detector: "phone-e164",
+			content:  "+14155550142, +442079460958, +1234567, +1234567890123456",
+			expected: []string{"+14155550142", "+442079460958"},
+		},
+		{
+			desc:     "US phone numbers are found by default",
+			detector: "phone",
+			content:  "(212) 555-0142, +1 212.555.0142, 1-800-555-0199, 2125550142",
+			expected: []string{"(212) 555-0142", "+1 212.555.0142", "1-800-555-0199", "2125550142"},
+		},
+		{
+			desc:     "US phone numbers have valid area codes and exchanges",
+			detector: "phone",
+			locale:   "us",
+			content:  "112-555-0142, 212-155-0142, 92125550142000",
+			expected: nil,
+		},
+		{
+			desc:     "UK phone numbers are found with the gb locale",
+			detector: "phone",
+			locale:   "gb",
+			content:  "020 7946 0958, +44 7700 900123, +44 (0) 161 496 0000, 212-555-0142",
+			expected: []string{"020 7946 0958", "+44 7700 900123", "+44 (0) 161 496 0000"},
+		},
+		{
+			desc:     "Social Security numbers need consistent separators",
+			detector: "ssn",
+			content:  "123-45-6789, 123 45 6789, 123-45 6789, 123456789",
+			expected: []string{"123-45-6789", "123 45 6789"},
+		},
+		{
+			desc:     "Social Security numbers which are never issued are left alone",
+			detector: "ssn",
+			content:  "000-12-3456, 666-12-3456, 912-34-5678, 123-00-4567, 123-45-0000",
+			expected: nil,
+		},
+		{
+			desc:     "IBANs need the right length and check digits",
+			detector: "iban",
+			content:  "DE89 3704 0044 0532 0130 00, GB29NWBK60161331926819, DE88 3704 0044 0532 0130 00, GB29NWBK6016133192681",
+			expected: []string{"DE89 3704 0044 0532 0130 00", "GB29NWBK60161331926819"},
+		},
+		{
+			desc:     "IBANs can be restricted to a country",
+			detector: "iban",
+			locale:   "gb",
+			content:  "DE89 3704 0044 0532 0130 00, GB29NWBK60161331926819",
+			expected: []string{"GB29NWBK60161331926819"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		found, _, err := lookupDetector(testCase.detector, testCase.locale, "")
+		if err != nil {
+			t.Errorf("Test '%v': Error looking up detector: %v", testCase.desc, err)
+			continue
+		}
+		var detected []string
+		for _, match := range found.regexp.FindAll([]byte(testCase.content), -1) {
+			if found.validate == nil || found.validate(match) {
+				detected = append(detected, string(match))
+			}
+		}
+		if !reflect.DeepEqual(detected, testCase.expected) {
+			t.Errorf("Test '%v': Expected %q but got %q", testCase.desc, testCase.expected, detected)
+		}
+	}
+}
+
+func TestLookupDetector(t *testing.T) {
+	testCases := []struct {
+		detector string
+		locale   string
+		action   string
+		valid    bool
+	}{
+		{detector: "email", valid: true},
+		{detector: "phone", locale: "gb", action: "exclude", valid: true},
+		{detector: "iban", locale: "de", valid: true},
+		{detector: "passport", valid: false},
+		{detector: "email", locale: "us", valid: false},
+		{detector: "phone", locale: "fr", valid: false},
+		{detector: "phone", locale: "GB", valid: false},
+		{detector: "ssn", action: "replace", valid: false},
+	}
+
+	for _, testCase := range testCases {
+		_, _, err := lookupDetector(testCase.detector, testCase.locale, testCase.action)
+		if isValid := err == nil; isValid != testCase.valid {
+			t.Errorf("Test '%+v': Expected valid=%v but got error %v", testCase, testCase.valid, err)
+		}
+	}
+}
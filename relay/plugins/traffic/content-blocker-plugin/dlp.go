@@ -0,0 +1,277 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConfigImport names a file of rules exported from a DLP system, which are
+// converted to block rules when the relay starts. This lets security teams
+// maintain their rules in one place instead of copying them into the relay's
+// configuration.
+//
+// Two formats are understood. CSV files must start with a header row; JSON
+// files hold an array of rule objects, or an object with a "rules" property
+// holding one. In both, each rule has these fields, whose names are matched
+// case-insensitively:
+//
+//   - pattern (or regex, or expression): the regular expression to block.
+//     Required.
+//   - action: "mask" (or "redact"), "exclude" (or "remove"), "hash", or
+//     "tokenize". Defaults to the import's Action.
+//   - content: the kinds of content the rule applies to, like "body" or
+//     "header", separated by ';' or '|'. Defaults to the import's Content.
+//   - enabled: if false, the rule is skipped.
+//   - name: describes the rule in the relay's logs.
+//
+// Other fields are ignored, so vendor exports can be used as they are.
+type ConfigImport struct {
+	File    string
+	Format  string   // "csv" or "json". If empty, it's taken from the file's extension.
+	Action  string   // The action for rules which don't specify one. Defaults to "mask".
+	Content []string // The content kinds for rules which don't specify any. Defaults to ["body"].
+}
+
+const (
+	importFormatCSV  = "csv"
+	importFormatJSON = "json"
+)
+
+// importedRule is a rule read from a DLP export, before it's validated.
+type importedRule struct {
+	name    string
+	pattern string
+	action  string
+	content string
+	enabled string
+}
+
+// importRules reads the rules in an imported file and converts them to block
+// rules, grouped by content kind. Rules are kept in the order they appear in
+// the file.
+func importRules(source ConfigImport) (map[string][]ConfigBlockRule, error) {
+	if source.File == "" {
+		return nil, fmt.Errorf(`Import must include a File property`)
+	}
+
+	format := strings.ToLower(source.Format)
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(source.File)), ".")
+	}
+
+	data, err := os.ReadFile(source.File)
+	if err != nil {
+		return nil, fmt.Errorf(`Could not read rules from "%v": %v`, source.File, err)
+	}
+
+	var rules []importedRule
+	switch format {
+	case importFormatCSV:
+		rules, err = readCSVRules(data)
+	case importFormatJSON:
+		rules, err = readJSONRules(data)
+	default:
+		return nil, fmt.Errorf(`Unknown format for rules in "%v": must be "%v" or "%v"`, source.File, importFormatCSV, importFormatJSON)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`Could not read rules from "%v": %v`, source.File, err)
+	}
+
+	defaultAction := source.Action
+	if defaultAction == "" {
+		defaultAction = maskMode.String()
+	}
+	defaultContent := source.Content
+	if len(defaultContent) == 0 {
+		defaultContent = []string{"body"}
+	}
+
+	converted := map[string][]ConfigBlockRule{}
+	for i, rule := range rules {
+		describe := fmt.Sprintf("rule %v", i+1)
+		if rule.name != "" {
+			describe = fmt.Sprintf("rule %v (%v)", i+1, rule.name)
+		}
+
+		if rule.enabled != "" {
+			enabled, err := strconv.ParseBool(strings.TrimSpace(rule.enabled))
+			if err != nil {
+				return nil, fmt.Errorf(`Invalid enabled value "%v" for %v in "%v"`, rule.enabled, describe, source.File)
+			}
+			if !enabled {
+				continue
+			}
+		}
+
+		if rule.pattern == "" {
+			return nil, fmt.Errorf(`Missing pattern for %v in "%v"`, describe, source.File)
+		}
+
+		action := rule.action
+		if action == "" {
+			action = defaultAction
+		}
+		var blockRule ConfigBlockRule
+		switch strings.ToLower(strings.TrimSpace(action)) {
+		case "mask", "redact":
+			blockRule.Mask = rule.pattern
+		case "exclude", "remove":
+			blockRule.Exclude = rule.pattern
+		case "hash":
+			blockRule.Hash = rule.pattern
+		case "tokenize":
+			blockRule.Tokenize = rule.pattern
+		default:
+			return nil, fmt.Errorf(`Invalid action "%v" for %v in "%v": must be "mask", "exclude", "hash", or "tokenize"`, action, describe, source.File)
+		}
+
+		content := defaultContent
+		if rule.content != "" {
+			content = strings.FieldsFunc(rule.content, func(c rune) bool {
+				return c == ';' || c == '|'
+			})
+		}
+		for _, kind := range content {
+			kind = strings.ToLower(strings.TrimSpace(kind))
+			switch kind {
+			case "body", "header", "response-body", "response-header":
+				converted[kind] = append(converted[kind], blockRule)
+			default:
+				return nil, fmt.Errorf(`Invalid content kind "%v" for %v in "%v"`, kind, describe, source.File)
+			}
+		}
+	}
+
+	return converted, nil
+}
+
+// fieldAliases maps the names DLP exports use for each field to the field.
+var fieldAliases = map[string]string{
+	"name":       "name",
+	"pattern":    "pattern",
+	"regex":      "pattern",
+	"expression": "pattern",
+	"action":     "action",
+	"content":    "content",
+	"enabled":    "enabled",
+}
+
+func (rule *importedRule) set(field string, value string) {
+	switch fieldAliases[strings.ToLower(strings.TrimSpace(field))] {
+	case "name":
+		rule.name = value
+	case "pattern":
+		rule.pattern = value
+	case "action":
+		rule.action = value
+	case "content":
+		rule.content = value
+	case "enabled":
+		rule.enabled = value
+	}
+}
+
+func readCSVRules(data []byte) ([]importedRule, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Spreadsheet exports often start with a byte order mark.
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	rules := []importedRule{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rules, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rule := importedRule{}
+		for i, value := range record {
+			if i < len(header) {
+				rule.set(header[i], value)
+			}
+		}
+		rules = append(rules, rule)
+	}
+}
+
+func readJSONRules(data []byte) ([]importedRule, error) {
+	var objects []map[string]interface{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var document map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &document); err != nil {
+			return nil, err
+		}
+		var rules json.RawMessage
+		for key, value := range document {
+			if strings.EqualFold(key, "rules") {
+				rules = value
+			}
+		}
+		if rules == nil {
+			return nil, fmt.Errorf(`expected a "rules" property`)
+		}
+		data = rules
+	}
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, err
+	}
+
+	rules := []importedRule{}
+	for _, object := range objects {
+		rule := importedRule{}
+		for field, value := range object {
+			switch value := value.(type) {
+			case string:
+				rule.set(field, value)
+			case bool:
+				rule.set(field, strconv.FormatBool(value))
+			case []interface{}:
+				// Content kinds may be given as an array.
+				parts := []string{}
+				for _, part := range value {
+					parts = append(parts, fmt.Sprint(part))
+				}
+				rule.set(field, strings.Join(parts, ";"))
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,96 @@
+package content_blocker_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImportRules(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		file     string
+		contents string
+		source   ConfigImport
+		expected map[string][]ConfigBlockRule
+		isValid  bool
+	}{
+		{
+			desc: "CSV rules with actions and content kinds",
+			file: "rules.csv",
+			contents: "Name,Regex,Action,Content,Severity\n" +
+				"SSN,[0-9]{3}-[0-9]{2}-[0-9]{4},redact,,high\n" +
+				"Token,tok_[a-z]+,remove,body;header,low\n",
+			expected: map[string][]ConfigBlockRule{
+				"body":   {{Mask: "[0-9]{3}-[0-9]{2}-[0-9]{4}"}, {Exclude: "tok_[a-z]+"}},
+				"header": {{Exclude: "tok_[a-z]+"}},
+			},
+			isValid: true,
+		},
+		{
+			desc:     "Disabled CSV rules are skipped",
+			file:     "rules.csv",
+			contents: "pattern,enabled\na+,true\nb+,false\n",
+			expected: map[string][]ConfigBlockRule{"body": {{Mask: "a+"}}},
+			isValid:  true,
+		},
+		{
+			desc:     "Import defaults apply to rules without an action or content",
+			file:     "rules.csv",
+			contents: "pattern\na+\n",
+			source:   ConfigImport{Action: "exclude", Content: []string{"response-body"}},
+			expected: map[string][]ConfigBlockRule{"response-body": {{Exclude: "a+"}}},
+			isValid:  true,
+		},
+		{
+			desc:     "JSON array of rules",
+			file:     "rules.json",
+			contents: `[{"pattern": "a+", "content": ["header", "response-header"]}, {"pattern": "b+", "enabled": false}]`,
+			expected: map[string][]ConfigBlockRule{
+				"header":          {{Mask: "a+"}},
+				"response-header": {{Mask: "a+"}},
+			},
+			isValid: true,
+		},
+		{
+			desc:     "JSON object holding rules",
+			file:     "export",
+			contents: `{"version": 2, "Rules": [{"Expression": "a+", "Action": "exclude"}]}`,
+			source:   ConfigImport{Format: "json"},
+			expected: map[string][]ConfigBlockRule{"body": {{Exclude: "a+"}}},
+			isValid:  true,
+		},
+		{desc: "Unknown format", file: "rules.txt", contents: "a+", isValid: false},
+		{desc: "Missing pattern", file: "rules.csv", contents: "name,pattern\nempty,\n", isValid: false},
+		{desc: "Unknown action", file: "rules.csv", contents: "pattern,action\na+,quarantine\n", isValid: false},
+		{desc: "Unknown content kind", file: "rules.csv", contents: "pattern,content\na+,cookies\n", isValid: false},
+		{desc: "Invalid enabled value", file: "rules.csv", contents: "pattern,enabled\na+,sometimes\n", isValid: false},
+		{desc: "JSON object without rules", file: "rules.json", contents: `{"patterns": []}`, isValid: false},
+	}
+
+	for _, testCase := range testCases {
+		path := filepath.Join(t.TempDir(), testCase.file)
+		if err := os.WriteFile(path, []byte(testCase.contents), 0644); err != nil {
+			t.Errorf("Test '%v': Error writing rules: %v", testCase.desc, err)
+			continue
+		}
+		source := testCase.source
+		source.File = path
+
+		rules, err := importRules(source)
+		if isValid := err == nil; isValid != testCase.isValid {
+			t.Errorf("Test '%v': Expected valid=%v but got error %v", testCase.desc, testCase.isValid, err)
+			continue
+		}
+		if testCase.isValid && !reflect.DeepEqual(rules, testCase.expected) {
+			t.Errorf("Test '%v': Expected rules %v but got %v", testCase.desc, testCase.expected, rules)
+		}
+	}
+}
+
+func TestImportRulesMissingFile(t *testing.T) {
+	if _, err := importRules(ConfigImport{File: filepath.Join(t.TempDir(), "missing.csv")}); err == nil {
+		t.Errorf("Expected an error importing a missing file")
+	}
+}
@@ -0,0 +1,72 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// Bodies with an application/x-www-form-urlencoded Content-Type are made of
+// percent-encoded parameters, so regular expressions applied to the raw body
+// would miss most matches; an email address, for instance, arrives as
+// "jane%40example.com". Body rules are instead applied to the value of each
+// parameter once it's unescaped, and values which a rule changes are escaped
+// again. Names are left alone, and parameters which no rule changes are
+// forwarded exactly as the client encoded them.
+
+func isFormRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// blockForm applies the blockers to the value of each parameter in a form
+// body. It returns the blocked body, and the number of bytes of parameter
+// values which were excluded or masked.
+func blockForm(body []byte, blockers []*contentBlocker) ([]byte, int) {
+	if len(blockers) == 0 || len(body) == 0 {
+		return body, 0
+	}
+
+	total := 0
+	modified := false
+	params := bytes.Split(body, []byte("&"))
+	for i, param := range params {
+		rawName, rawValue, _ := bytes.Cut(param, []byte("="))
+		value, err := url.QueryUnescape(string(rawValue))
+		if err != nil {
+			value = string(rawValue)
+		}
+
+		blockedValue, count := applyBlockers([]byte(value), blockers)
+		total += count
+		if string(blockedValue) != value {
+			modified = true
+			params[i] = []byte(string(rawName) + "=" + escapeParam(string(blockedValue)))
+		}
+	}
+
+	if !modified {
+		return body, total
+	}
+	return bytes.Join(params, []byte("&")), total
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
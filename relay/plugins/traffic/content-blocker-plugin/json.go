@@ -0,0 +1,420 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ConfigJsonRule is a block rule for JSON request bodies. Exactly one of the
+// Exclude, Mask, Hash, or Classify properties must be set; the value is a path
+// selecting the JSON values the rule applies to.
+//
+// Paths use a dot-separated syntax similar to JSONPath, with an optional
+// leading '$'. For example, 'user.email' selects the 'email' property of the
+// top-level 'user' object, 'events[*].ip' selects the 'ip' property of every
+// element of the 'events' array, and 'events[0]' selects only the first
+// element. A '*' path component selects every property of an object.
+//
+// Rules may also tag the values they select with a data class, like "pii".
+// Classify rules only tag values, leaving them unchanged. The paths present in
+// each request, grouped by class, are listed in the DataClassesHeaderName
+// header, so that the target can apply different retention policies to each
+// class. Values removed by an Exclude rule aren't listed.
+type ConfigJsonRule struct {
+	Exclude  string
+	Mask     string
+	Hash     string
+	Classify string
+	Class    string
+}
+
+// DataClassesHeaderName is the header listing the classified JSON paths which
+// are present in a request body, as in "pii=user.email,user.phone;public=id".
+// Classes are listed in the order of DataClasses; paths are listed in the order
+// their rules were configured.
+var DataClassesHeaderName = "X-Relay-Data-Classes"
+
+// DataClasses are the supported data classes, in the order they're listed in
+// the DataClassesHeaderName header.
+var DataClasses = []string{"pii", "sensitive", "public"}
+
+func isDataClass(class string) bool {
+	for _, dataClass := range DataClasses {
+		if class == dataClass {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonBlockerAction int64
+
+const (
+	jsonExcludeAction jsonBlockerAction = iota
+	jsonMaskAction
+	jsonHashAction
+	jsonClassifyAction
+)
+
+func (action jsonBlockerAction) String() string {
+	switch action {
+	case jsonExcludeAction:
+		return "exclude"
+	case jsonMaskAction:
+		return "mask"
+	case jsonHashAction:
+		return "hash"
+	case jsonClassifyAction:
+		return "classify"
+	default:
+		return "(unknown action)"
+	}
+}
+
+type jsonPathSegmentKind int64
+
+const (
+	jsonKeySegment jsonPathSegmentKind = iota
+	jsonIndexSegment
+	jsonWildcardSegment
+)
+
+type jsonPathSegment struct {
+	kind  jsonPathSegmentKind
+	key   string
+	index int
+}
+
+func (segment jsonPathSegment) matchesKey(key string) bool {
+	return segment.kind == jsonWildcardSegment || (segment.kind == jsonKeySegment && segment.key == key)
+}
+
+func (segment jsonPathSegment) matchesIndex(index int) bool {
+	return segment.kind == jsonWildcardSegment || (segment.kind == jsonIndexSegment && segment.index == index)
+}
+
+// parseJsonPath parses a path such as 'user.email' or '$.events[*].ip'.
+func parseJsonPath(path string) ([]jsonPathSegment, error) {
+	remaining := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segments []jsonPathSegment
+
+	for remaining != "" {
+		switch remaining[0] {
+		case '.':
+			remaining = remaining[1:]
+			if remaining == "" || remaining[0] == '.' || remaining[0] == '[' {
+				return nil, fmt.Errorf(`Invalid JSON path "%v": empty property name`, path)
+			}
+		case '[':
+			end := strings.IndexByte(remaining, ']')
+			if end < 0 {
+				return nil, fmt.Errorf(`Invalid JSON path "%v": unterminated "["`, path)
+			}
+			selector := remaining[1:end]
+			remaining = remaining[end+1:]
+
+			if selector == "*" {
+				segments = append(segments, jsonPathSegment{kind: jsonWildcardSegment})
+			} else if unquoted, err := strconv.Unquote(strings.ReplaceAll(selector, "'", `"`)); err == nil {
+				segments = append(segments, jsonPathSegment{kind: jsonKeySegment, key: unquoted})
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				segments = append(segments, jsonPathSegment{kind: jsonIndexSegment, index: index})
+			} else {
+				return nil, fmt.Errorf(`Invalid JSON path "%v": bad selector "[%v]"`, path, selector)
+			}
+			continue
+		}
+
+		end := strings.IndexAny(remaining, ".[")
+		if end < 0 {
+			end = len(remaining)
+		}
+		name := remaining[:end]
+		remaining = remaining[end:]
+
+		if name == "*" {
+			segments = append(segments, jsonPathSegment{kind: jsonWildcardSegment})
+		} else if name != "" {
+			segments = append(segments, jsonPathSegment{kind: jsonKeySegment, key: name})
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf(`Invalid JSON path "%v": path selects the entire body`, path)
+	}
+	return segments, nil
+}
+
+// jsonBlocker applies a content blocking action to the JSON values selected by
+// a path.
+type jsonBlocker struct {
+	action jsonBlockerAction
+	path   string
+	parsed []jsonPathSegment
+	class  string // If non-empty, the data class of the selected values.
+}
+
+func newJsonBlocker(rule ConfigJsonRule) (*jsonBlocker, error) {
+	var actions []jsonBlockerAction
+	var paths []string
+	for action, path := range map[jsonBlockerAction]string{
+		jsonExcludeAction:  rule.Exclude,
+		jsonMaskAction:     rule.Mask,
+		jsonHashAction:     rule.Hash,
+		jsonClassifyAction: rule.Classify,
+	} {
+		if path != "" {
+			actions = append(actions, action)
+			paths = append(paths, path)
+		}
+	}
+	if len(actions) != 1 {
+		return nil, fmt.Errorf(`JSON block rule must include exactly one of the Exclude, Mask, Hash, or Classify properties`)
+	}
+	if rule.Class != "" && !isDataClass(rule.Class) {
+		return nil, fmt.Errorf(`Invalid data class "%v": must be one of %v`, rule.Class, strings.Join(DataClasses, ", "))
+	}
+	if actions[0] == jsonClassifyAction && rule.Class == "" {
+		return nil, fmt.Errorf(`JSON classify rule for "%v" must include a Class`, paths[0])
+	}
+
+	parsed, err := parseJsonPath(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	return &jsonBlocker{action: actions[0], path: paths[0], parsed: parsed, class: rule.Class}, nil
+}
+
+// Block applies the blocker to a decoded JSON document, returning the updated
+// document and the number of values it modified. Classify rules never modify
+// anything.
+func (b *jsonBlocker) Block(document interface{}) (interface{}, int) {
+	if b.action == jsonClassifyAction {
+		return document, 0
+	}
+	matched := 0
+	result, _ := b.apply(document, b.parsed, &matched)
+	return result, matched
+}
+
+// Present returns true if the blocker's path selects at least one value in a
+// decoded JSON document.
+func (b *jsonBlocker) Present(document interface{}) bool {
+	return jsonPathPresent(document, b.parsed)
+}
+
+func jsonPathPresent(value interface{}, path []jsonPathSegment) bool {
+	if len(path) == 0 {
+		return true
+	}
+	segment := path[0]
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typedValue {
+			if segment.matchesKey(key) && jsonPathPresent(child, path[1:]) {
+				return true
+			}
+		}
+	case []interface{}:
+		for index, child := range typedValue {
+			if segment.matchesIndex(index) && jsonPathPresent(child, path[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply applies the blocker to the values selected by path relative to value.
+// It returns the updated value, and true if the value should be removed from
+// its parent.
+func (b *jsonBlocker) apply(value interface{}, path []jsonPathSegment, matched *int) (interface{}, bool) {
+	if len(path) == 0 {
+		*matched++
+		switch b.action {
+		case jsonExcludeAction:
+			return nil, true
+		case jsonMaskAction:
+			return maskJsonValue(value), false
+		case jsonHashAction:
+			return hashJsonValue(value), false
+		default:
+			panic(fmt.Errorf("invalid JSON blocking action: %v", b.action))
+		}
+	}
+
+	segment := path[0]
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typedValue {
+			if !segment.matchesKey(key) {
+				continue
+			}
+			if updated, remove := b.apply(child, path[1:], matched); remove {
+				delete(typedValue, key)
+			} else {
+				typedValue[key] = updated
+			}
+		}
+		return typedValue, false
+	case []interface{}:
+		result := make([]interface{}, 0, len(typedValue))
+		for index, child := range typedValue {
+			if !segment.matchesIndex(index) {
+				result = append(result, child)
+				continue
+			}
+			if updated, remove := b.apply(child, path[1:], matched); !remove {
+				result = append(result, updated)
+			}
+		}
+		return result, false
+	default:
+		return value, false
+	}
+}
+
+// maskJsonValue replaces a value with asterisks. Scalars become a string of
+// asterisks as long as their JSON representation (excluding quotes), and
+// objects and arrays are masked recursively.
+func maskJsonValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typedValue {
+			typedValue[key] = maskJsonValue(child)
+		}
+		return typedValue
+	case []interface{}:
+		for index, child := range typedValue {
+			typedValue[index] = maskJsonValue(child)
+		}
+		return typedValue
+	case nil:
+		return nil
+	case string:
+		return strings.Repeat(string(maskSymbol), len(typedValue))
+	default:
+		return strings.Repeat(string(maskSymbol), len(fmt.Sprint(typedValue)))
+	}
+}
+
+// hashJsonValue replaces a value with the hex-encoded SHA-256 hash of its
+// contents, so that equal values can still be correlated. Strings are hashed
+// directly, and other values are hashed using their JSON encoding.
+func hashJsonValue(value interface{}) interface{} {
+	var content []byte
+	if str, ok := value.(string); ok {
+		content = []byte(str)
+	} else {
+		content, _ = encodeJson(value)
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// isJsonRequest returns true if the request's Content-Type is
+// application/json.
+func isJsonRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func decodeJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func encodeJson(document interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// blockJson applies the JSON blockers to a body, and returns it along with a
+// manifest of the data classes present in the result, suitable for the
+// DataClassesHeaderName header. The body is only re-encoded if at least one
+// value was modified; otherwise it's returned unchanged.
+func blockJson(body []byte, blockers []*jsonBlocker) ([]byte, string, error) {
+	document, err := decodeJson(body)
+	if err != nil {
+		return body, "", err
+	}
+
+	totalMatched := 0
+	for _, blocker := range blockers {
+		var matched int
+		document, matched = blocker.Block(document)
+		totalMatched += matched
+	}
+	manifest := classifyJson(document, blockers)
+	if totalMatched == 0 {
+		return body, manifest, nil
+	}
+
+	encoded, err := encodeJson(document)
+	return encoded, manifest, err
+}
+
+// classifyJson returns a manifest of the classified paths present in a
+// document, like "pii=user.email,user.phone;public=id", or "" if there are
+// none.
+func classifyJson(document interface{}, blockers []*jsonBlocker) string {
+	var classes []string
+	for _, class := range DataClasses {
+		var paths []string
+		for _, blocker := range blockers {
+			if blocker.class == class && blocker.Present(document) {
+				paths = append(paths, blocker.path)
+			}
+		}
+		if len(paths) > 0 {
+			classes = append(classes, class+"="+strings.Join(paths, ","))
+		}
+	}
+	return strings.Join(classes, ";")
+}
+
+// hasDataClasses returns true if any of the blockers classifies values.
+func hasDataClasses(blockers []*jsonBlocker) bool {
+	for _, blocker := range blockers {
+		if blocker.class != "" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
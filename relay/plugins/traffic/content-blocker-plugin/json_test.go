@@ -0,0 +1,97 @@
+package content_blocker_plugin
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseJsonPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected []jsonPathSegment
+		valid    bool
+	}{
+		{
+			path:     "user.email",
+			expected: []jsonPathSegment{{kind: jsonKeySegment, key: "user"}, {kind: jsonKeySegment, key: "email"}},
+			valid:    true,
+		},
+		{
+			path: "$.events[*].ip",
+			expected: []jsonPathSegment{
+				{kind: jsonKeySegment, key: "events"},
+				{kind: jsonWildcardSegment},
+				{kind: jsonKeySegment, key: "ip"},
+			},
+			valid: true,
+		},
+		{
+			path:     "items[2]['odd key']",
+			expected: []jsonPathSegment{{kind: jsonKeySegment, key: "items"}, {kind: jsonIndexSegment, index: 2}, {kind: jsonKeySegment, key: "odd key"}},
+			valid:    true,
+		},
+		{
+			path:     "*.secret",
+			expected: []jsonPathSegment{{kind: jsonWildcardSegment}, {kind: jsonKeySegment, key: "secret"}},
+			valid:    true,
+		},
+		{path: "$", valid: false},
+		{path: "user..email", valid: false},
+		{path: "events[*", valid: false},
+		{path: "events[-1]", valid: false},
+	}
+
+	for _, testCase := range testCases {
+		segments, err := parseJsonPath(testCase.path)
+		if (err == nil) != testCase.valid {
+			t.Errorf("Test '%v': Expected valid=%v but got error %v", testCase.path, testCase.valid, err)
+			continue
+		}
+		if testCase.valid && !reflect.DeepEqual(segments, testCase.expected) {
+			t.Errorf("Test '%v': Expected %+v but got %+v", testCase.path, testCase.expected, segments)
+		}
+	}
+}
+
+func TestJsonRulesRequireJsonContentType(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "application/json", expected: true},
+		{contentType: "application/json; charset=utf-8", expected: true},
+		{contentType: "text/plain", expected: false},
+		{contentType: "", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		request, _ := http.NewRequest("POST", "http://example.com", nil)
+		request.Header.Set("Content-Type", testCase.contentType)
+		if actual := isJsonRequest(request); actual != testCase.expected {
+			t.Errorf("Test '%v': Expected %v but got %v", testCase.contentType, testCase.expected, actual)
+		}
+	}
+}
+
+func TestJsonRuleValidation(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		rule    ConfigJsonRule
+		isValid bool
+	}{
+		{desc: "Action without a class", rule: ConfigJsonRule{Mask: "a"}, isValid: true},
+		{desc: "Action with a class", rule: ConfigJsonRule{Hash: "a", Class: "pii"}, isValid: true},
+		{desc: "Classify with a class", rule: ConfigJsonRule{Classify: "a", Class: "public"}, isValid: true},
+		{desc: "Classify without a class", rule: ConfigJsonRule{Classify: "a"}, isValid: false},
+		{desc: "Unknown class", rule: ConfigJsonRule{Mask: "a", Class: "secret"}, isValid: false},
+		{desc: "Two actions", rule: ConfigJsonRule{Mask: "a", Classify: "a", Class: "pii"}, isValid: false},
+	}
+
+	for _, testCase := range testCases {
+		_, err := newJsonBlocker(testCase.rule)
+		if isValid := err == nil; isValid != testCase.isValid {
+			t.Errorf("Test '%v': Expected valid=%v but got error %v", testCase.desc, testCase.isValid, err)
+		}
+	}
+}
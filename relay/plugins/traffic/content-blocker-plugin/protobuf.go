@@ -0,0 +1,248 @@
+package content_blocker_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Protobuf-encoded request bodies can't be blocked with regular expressions,
+// since their fields are binary. Instead, 'protobuf' rules name the fields to
+// block by their fully-qualified names, like "ingest.v1.User.email", and the
+// body is decoded using a compiled FileDescriptorSet, as produced by
+// 'protoc --descriptor_set_out --include_imports'. The 'protobuf-message'
+// option names the type of the body's top-level message. Fields are blocked
+// wherever they occur, including in nested and repeated messages.
+//
+// Protobuf rules are only applied to requests with a protobuf Content-Type,
+// like application/x-protobuf. Bodies which can't be decoded are relayed
+// without the rules being applied, like JSON bodies which can't be parsed.
+
+// ConfigProtobufRule is a block rule for protobuf request bodies. Exactly one
+// of the Clear or Hash properties must be set; the value is the
+// fully-qualified name of a field. Clear removes the field, while Hash
+// replaces it with the hex-encoded HMAC-SHA256 of its value, keyed by the
+// 'hash-key' option; only string and bytes fields can be hashed.
+type ConfigProtobufRule struct {
+	Clear string
+	Hash  string
+}
+
+type protobufBlockerAction int64
+
+const (
+	protobufClearAction protobufBlockerAction = iota
+	protobufHashAction
+)
+
+func (action protobufBlockerAction) String() string {
+	switch action {
+	case protobufClearAction:
+		return "clear"
+	case protobufHashAction:
+		return "hash"
+	default:
+		return "(unknown action)"
+	}
+}
+
+// protobufBlocker applies protobuf rules to messages of a single type.
+type protobufBlocker struct {
+	message protoreflect.MessageDescriptor
+	actions map[protoreflect.FullName]protobufBlockerAction
+	hashKey *secrets.Secret // The HMAC key, for Hash rules.
+}
+
+// newProtobufBlocker reads a FileDescriptorSet and checks that the message and
+// the fields named by the rules are defined in it.
+func newProtobufBlocker(descriptorSetFile string, messageName string, rules []ConfigProtobufRule, hashKey *secrets.Secret) (*protobufBlocker, error) {
+	data, err := os.ReadFile(descriptorSetFile)
+	if err != nil {
+		return nil, err
+	}
+	var descriptorSet descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &descriptorSet); err != nil {
+		return nil, fmt.Errorf(`Invalid descriptor set "%v": %v`, descriptorSetFile, err)
+	}
+	files, err := protodesc.NewFiles(&descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf(`Invalid descriptor set "%v": %v`, descriptorSetFile, err)
+	}
+
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf(`Unknown protobuf message "%v"`, messageName)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf(`"%v" is not a protobuf message`, messageName)
+	}
+
+	blocker := &protobufBlocker{
+		message: message,
+		actions: map[protoreflect.FullName]protobufBlockerAction{},
+		hashKey: hashKey,
+	}
+	for _, rule := range rules {
+		if (rule.Clear == "") == (rule.Hash == "") {
+			return nil, fmt.Errorf(`Protobuf block rule must include exactly one of the Clear or Hash properties`)
+		}
+		action, name := protobufClearAction, rule.Clear
+		if rule.Hash != "" {
+			action, name = protobufHashAction, rule.Hash
+		}
+
+		descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf(`Unknown protobuf field "%v"`, name)
+		}
+		field, ok := descriptor.(protoreflect.FieldDescriptor)
+		if !ok {
+			return nil, fmt.Errorf(`"%v" is not a protobuf field`, name)
+		}
+		if action == protobufHashAction {
+			if field.IsMap() || (field.Kind() != protoreflect.StringKind && field.Kind() != protoreflect.BytesKind) {
+				return nil, fmt.Errorf(`Protobuf field "%v" can't be hashed: only string and bytes fields can be`, name)
+			}
+			if hashKey == nil {
+				return nil, fmt.Errorf(`Hash block rules require the "hash-key" or "hash-key-file" option`)
+			}
+		}
+		blocker.actions[field.FullName()] = action
+	}
+	return blocker, nil
+}
+
+// Block applies the rules to an encoded message, returning the blocked message
+// and the number of fields it modified. If nothing was modified, the body is
+// returned unchanged, rather than encoded again.
+func (b *protobufBlocker) Block(body []byte) ([]byte, int, error) {
+	message := dynamicpb.NewMessage(b.message)
+	if err := proto.Unmarshal(body, message); err != nil {
+		return body, 0, err
+	}
+	count := b.blockMessage(message)
+	if count == 0 {
+		return body, 0, nil
+	}
+	blocked, err := proto.Marshal(message)
+	if err != nil {
+		return body, 0, err
+	}
+	return blocked, count, nil
+}
+
+func (b *protobufBlocker) blockMessage(message protoreflect.Message) int {
+	// Fields are collected first, since the message can't be modified while
+	// it's being ranged over.
+	var fields []protoreflect.FieldDescriptor
+	message.Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, field)
+		return true
+	})
+
+	count := 0
+	for _, field := range fields {
+		action, ok := b.actions[field.FullName()]
+		switch {
+		case ok && action == protobufClearAction:
+			message.Clear(field)
+			count++
+		case ok && action == protobufHashAction:
+			if field.IsList() {
+				list := message.Mutable(field).List()
+				for i := 0; i < list.Len(); i++ {
+					list.Set(i, b.hash(field, list.Get(i)))
+				}
+			} else {
+				message.Set(field, b.hash(field, message.Get(field)))
+			}
+			count++
+		case field.IsMap():
+			if field.MapValue().Message() == nil {
+				continue
+			}
+			message.Mutable(field).Map().Range(func(_ protoreflect.MapKey, value protoreflect.Value) bool {
+				count += b.blockMessage(value.Message())
+				return true
+			})
+		case field.Message() == nil:
+			continue
+		case field.IsList():
+			list := message.Mutable(field).List()
+			for i := 0; i < list.Len(); i++ {
+				count += b.blockMessage(list.Get(i).Message())
+			}
+		default:
+			count += b.blockMessage(message.Mutable(field).Message())
+		}
+	}
+	return count
+}
+
+// hash returns the hex-encoded HMAC-SHA256 of a string or bytes value.
+func (b *protobufBlocker) hash(field protoreflect.FieldDescriptor, value protoreflect.Value) protoreflect.Value {
+	key, err := b.hashKey.Value()
+	if err != nil {
+		// The last key read successfully is still returned.
+		logger.Errorf("Error reading hash key: %s", err)
+	}
+	var content []byte
+	if field.Kind() == protoreflect.BytesKind {
+		content = value.Bytes()
+	} else {
+		content = []byte(value.String())
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(content)
+	hashed := hex.EncodeToString(mac.Sum(nil))
+	if field.Kind() == protoreflect.BytesKind {
+		return protoreflect.ValueOfBytes([]byte(hashed))
+	}
+	return protoreflect.ValueOfString(hashed)
+}
+
+// isProtobufRequest returns true if the request's Content-Type is one of
+// those commonly used for protobuf bodies.
+func isProtobufRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
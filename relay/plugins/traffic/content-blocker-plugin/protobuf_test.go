@@ -0,0 +1,247 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestProtobufBlocker(t *testing.T) {
+	descriptorSetFile, files := writeTestDescriptorSet(t)
+	bundle, _ := files.FindDescriptorByName("ingest.v1.Bundle")
+	hashKey := secrets.FromValue("key")
+
+	testCases := []struct {
+		desc          string
+		rules         []ConfigProtobufRule
+		original      string
+		expected      string
+		expectedCount int
+	}{
+		{
+			desc: "Fields are cleared and hashed wherever they occur",
+			rules: []ConfigProtobufRule{
+				{Clear: "ingest.v1.User.email"},
+				{Hash: "ingest.v1.User.id"},
+			},
+			original: `{"org": "o1", "user": {"email": "jane@example.com", "id": "u1", "age": 42},
+			            "events": [{"kind": "click", "user": {"email": "bob@example.com", "id": "u2"}}]}`,
+			expected: `{"org": "o1", "user": {"id": "` + hmacHex("key", "u1") + `", "age": 42},
+			            "events": [{"kind": "click", "user": {"id": "` + hmacHex("key", "u2") + `"}}]}`,
+			expectedCount: 4,
+		},
+		{
+			desc:          "Repeated bytes fields are hashed element by element",
+			rules:         []ConfigProtobufRule{{Hash: "ingest.v1.User.tokens"}},
+			original:      `{"user": {"tokens": ["` + base64.StdEncoding.EncodeToString([]byte("a")) + `", "` + base64.StdEncoding.EncodeToString([]byte("b")) + `"]}}`,
+			expected:      `{"user": {"tokens": ["` + base64.StdEncoding.EncodeToString([]byte(hmacHex("key", "a"))) + `", "` + base64.StdEncoding.EncodeToString([]byte(hmacHex("key", "b"))) + `"]}}`,
+			expectedCount: 1,
+		},
+		{
+			desc:          "Messages without the fields are unchanged",
+			rules:         []ConfigProtobufRule{{Clear: "ingest.v1.User.email"}},
+			original:      `{"org": "o1", "events": [{"kind": "click"}]}`,
+			expected:      `{"org": "o1", "events": [{"kind": "click"}]}`,
+			expectedCount: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		blocker, err := newProtobufBlocker(descriptorSetFile, "ingest.v1.Bundle", testCase.rules, hashKey)
+		if err != nil {
+			t.Errorf("Test '%v': Error creating blocker: %v", testCase.desc, err)
+			continue
+		}
+
+		message := dynamicpb.NewMessage(bundle.(protoreflect.MessageDescriptor))
+		if err := protojson.Unmarshal([]byte(testCase.original), message); err != nil {
+			t.Fatalf("Test '%v': Error parsing original message: %v", testCase.desc, err)
+		}
+		body, _ := proto.Marshal(message)
+
+		blocked, count, err := blocker.Block(body)
+		if err != nil {
+			t.Errorf("Test '%v': Error blocking: %v", testCase.desc, err)
+			continue
+		}
+		if count != testCase.expectedCount {
+			t.Errorf("Test '%v': Expected %v fields to be blocked but got %v", testCase.desc, testCase.expectedCount, count)
+		}
+		if count == 0 && !bytes.Equal(blocked, body) {
+			t.Errorf("Test '%v': Expected the body to be relayed untouched", testCase.desc)
+		}
+
+		result := dynamicpb.NewMessage(bundle.(protoreflect.MessageDescriptor))
+		if err := proto.Unmarshal(blocked, result); err != nil {
+			t.Errorf("Test '%v': Error decoding blocked message: %v", testCase.desc, err)
+			continue
+		}
+		resultJson, _ := protojson.Marshal(result)
+		var actual, expected interface{}
+		json.Unmarshal(resultJson, &actual)
+		json.Unmarshal([]byte(testCase.expected), &expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Test '%v': Expected %v but got %v", testCase.desc, expected, actual)
+		}
+	}
+
+	blocker, _ := newProtobufBlocker(descriptorSetFile, "ingest.v1.Bundle", []ConfigProtobufRule{{Clear: "ingest.v1.User.email"}}, nil)
+	if _, _, err := blocker.Block([]byte{0xff, 0xff}); err == nil {
+		t.Errorf("Expected an error decoding an invalid body")
+	}
+}
+
+func TestProtobufGrpcMessages(t *testing.T) {
+	descriptorSetFile, files := writeTestDescriptorSet(t)
+	bundle, _ := files.FindDescriptorByName("ingest.v1.Bundle")
+	blocker, err := newProtobufBlocker(descriptorSetFile, "ingest.v1.Bundle", []ConfigProtobufRule{{Clear: "ingest.v1.User.email"}}, nil)
+	if err != nil {
+		t.Fatalf("Error creating blocker: %v", err)
+	}
+	plugin := contentBlockerPlugin{protobufBlocker: blocker}
+
+	message := dynamicpb.NewMessage(bundle.(protoreflect.MessageDescriptor))
+	protojson.Unmarshal([]byte(`{"user": {"email": "jane@example.com", "id": "u1"}}`), message)
+	payload, _ := proto.Marshal(message)
+
+	// Only the messages the client sends are blocked.
+	response := &traffic.GrpcMessage{Direction: traffic.TargetToClient, Payload: payload}
+	plugin.HandleGrpcMessage(nil, response)
+	if !bytes.Equal(response.Payload, payload) {
+		t.Errorf("Expected response message to be unchanged")
+	}
+
+	request := &traffic.GrpcMessage{Direction: traffic.ClientToTarget, Payload: payload}
+	plugin.HandleGrpcMessage(nil, request)
+	result := dynamicpb.NewMessage(bundle.(protoreflect.MessageDescriptor))
+	if err := proto.Unmarshal(request.Payload, result); err != nil {
+		t.Fatalf("Error decoding blocked message: %v", err)
+	}
+	if resultJson, _ := protojson.Marshal(result); bytes.Contains(resultJson, []byte("jane@example.com")) {
+		t.Errorf("Expected email to be cleared but got %s", resultJson)
+	}
+}
+
+func TestProtobufBlockerValidation(t *testing.T) {
+	descriptorSetFile, _ := writeTestDescriptorSet(t)
+	hashKey := secrets.FromValue("key")
+
+	testCases := []struct {
+		desc              string
+		descriptorSetFile string
+		message           string
+		rules             []ConfigProtobufRule
+		hashKey           *secrets.Secret
+	}{
+		{desc: "Missing descriptor set", descriptorSetFile: filepath.Join(t.TempDir(), "missing.binpb"), message: "ingest.v1.Bundle"},
+		{desc: "Unknown message", message: "ingest.v1.Batch"},
+		{desc: "Message which is a field", message: "ingest.v1.Bundle.org"},
+		{desc: "Unknown field", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{Clear: "ingest.v1.User.phone"}}},
+		{desc: "Field which is a message", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{Clear: "ingest.v1.User"}}},
+		{desc: "Neither clear nor hash", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{}}},
+		{desc: "Both clear and hash", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{Clear: "ingest.v1.User.id", Hash: "ingest.v1.User.id"}}},
+		{desc: "Hashing a number", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{Hash: "ingest.v1.User.age"}}, hashKey: hashKey},
+		{desc: "Hashing without a key", message: "ingest.v1.Bundle", rules: []ConfigProtobufRule{{Hash: "ingest.v1.User.id"}}},
+	}
+
+	for _, testCase := range testCases {
+		file := testCase.descriptorSetFile
+		if file == "" {
+			file = descriptorSetFile
+		}
+		if _, err := newProtobufBlocker(file, testCase.message, testCase.rules, testCase.hashKey); err == nil {
+			t.Errorf("Test '%v': Expected an error", testCase.desc)
+		}
+	}
+}
+
+// writeTestDescriptorSet writes a FileDescriptorSet describing a small ingest
+// API, returning its path along with the files it describes.
+func writeTestDescriptorSet(t *testing.T) (string, *protoregistry.Files) {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, repeated bool, typeName string) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		descriptor := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			descriptor.TypeName = proto.String(typeName)
+		}
+		return descriptor
+	}
+
+	descriptorSet := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("ingest.proto"),
+		Package: proto.String("ingest.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("User"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("email", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false, ""),
+					field("id", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, false, ""),
+					field("age", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32, false, ""),
+					field("tokens", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES, true, ""),
+				},
+			},
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("kind", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false, ""),
+					field("user", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, false, ".ingest.v1.User"),
+				},
+			},
+			{
+				Name: proto.String("Bundle"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("org", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false, ""),
+					field("user", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, false, ".ingest.v1.User"),
+					field("events", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, true, ".ingest.v1.Event"),
+				},
+			},
+		},
+	}}}
+
+	files, err := protodesc.NewFiles(descriptorSet)
+	if err != nil {
+		t.Fatalf("Error building descriptors: %v", err)
+	}
+	data, err := proto.Marshal(descriptorSet)
+	if err != nil {
+		t.Fatalf("Error encoding descriptor set: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ingest.binpb")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Error writing descriptor set: %v", err)
+	}
+	return path, files
+}
+
+func hmacHex(key string, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
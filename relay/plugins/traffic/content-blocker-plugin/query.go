@@ -0,0 +1,172 @@
+package content_blocker_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ConfigQueryRule is a block rule for URL query parameters. Exactly one
+// property must be set:
+//
+//   - ExcludeParam removes parameters whose names match a regular expression.
+//   - MaskParam masks the whole value of parameters whose names match.
+//   - Exclude removes content matching a regular expression from the values of
+//     every parameter.
+//   - Mask masks content matching a regular expression in the values of every
+//     parameter.
+//
+// Parameter names must match in full, so "email" doesn't match "email_hash".
+// Names and values are matched after they're unescaped, and parameters which
+// no rule changes are forwarded exactly as the client encoded them.
+type ConfigQueryRule struct {
+	Exclude      string
+	Mask         string
+	ExcludeParam string `yaml:"exclude-param"`
+	MaskParam    string `yaml:"mask-param"`
+}
+
+// queryBlocker applies a ConfigQueryRule to query parameters. If name is set,
+// the rule applies to whole parameters selected by name; otherwise, value
+// applies to the content of every parameter's value.
+type queryBlocker struct {
+	mode    contentBlockerMode
+	pattern string
+	name    *regexp.Regexp
+	value   *contentBlocker
+}
+
+func newQueryBlocker(rule ConfigQueryRule) (*queryBlocker, error) {
+	set := 0
+	for _, property := range []string{rule.Exclude, rule.Mask, rule.ExcludeParam, rule.MaskParam} {
+		if property != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf(`Query block rule must include exactly one of the Exclude, Mask, ExcludeParam, or MaskParam properties`)
+	}
+
+	blocker := &queryBlocker{}
+	switch {
+	case rule.ExcludeParam != "":
+		blocker.mode, blocker.pattern = excludeMode, rule.ExcludeParam
+	case rule.MaskParam != "":
+		blocker.mode, blocker.pattern = maskMode, rule.MaskParam
+	case rule.Exclude != "":
+		blocker.mode, blocker.pattern = excludeMode, rule.Exclude
+	default:
+		blocker.mode, blocker.pattern = maskMode, rule.Mask
+	}
+	pattern := blocker.pattern
+
+	if rule.ExcludeParam != "" || rule.MaskParam != "" {
+		name, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf(`could not compile regular expression "%v": %v`, pattern, err)
+		}
+		blocker.name = name
+		return blocker, nil
+	}
+
+	value, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf(`could not compile regular expression "%v": %v`, pattern, err)
+	}
+	blocker.value = &contentBlocker{mode: blocker.mode, regexp: value}
+	return blocker, nil
+}
+
+func (blocker *queryBlocker) String() string {
+	if blocker.name != nil {
+		return fmt.Sprintf("%s query parameters named \"%s\"", blocker.mode, blocker.pattern)
+	}
+	return fmt.Sprintf("%s query content matching \"%s\"", blocker.mode, blocker.pattern)
+}
+
+// blockQuery applies the blockers to the request's query parameters. It
+// returns the number of bytes of parameter values which were excluded or
+// masked; removing a parameter counts its whole value.
+func blockQuery(request *http.Request, blockers []*queryBlocker) int {
+	if len(blockers) == 0 || request.URL.RawQuery == "" {
+		return 0
+	}
+
+	total := 0
+	modified := false
+	params := strings.Split(request.URL.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		rawName, rawValue, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			value = rawValue
+		}
+
+		excluded := false
+		blockedValue := []byte(value)
+		for _, blocker := range blockers {
+			if blocker.name == nil {
+				var count int
+				blockedValue, count = blocker.value.BlockAndCount(blockedValue)
+				total += count
+				continue
+			}
+			if !blocker.name.MatchString(name) {
+				continue
+			}
+			total += len(blockedValue)
+			if blocker.mode == excludeMode {
+				excluded = true
+				break
+			}
+			blockedValue = []byte(strings.Repeat(string(maskSymbol), len(blockedValue)))
+		}
+
+		if excluded {
+			modified = true
+			continue
+		}
+		if string(blockedValue) != value {
+			modified = true
+			param = rawName + "=" + escapeParam(string(blockedValue))
+		}
+		kept = append(kept, param)
+	}
+
+	if modified {
+		request.URL.RawQuery = strings.Join(kept, "&")
+	}
+	return total
+}
+
+// escapeParam escapes a blocked parameter value. Asterisks needn't be escaped
+// in a query or a form, and masks are easier to recognize without escaping.
+func escapeParam(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "%2A", "*")
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
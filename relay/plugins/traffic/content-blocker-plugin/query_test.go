@@ -0,0 +1,106 @@
+package content_blocker_plugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBlockQuery(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		rules            []ConfigQueryRule
+		query            string
+		expectedQuery    string
+		expectedRedacted int
+	}{
+		{
+			desc:             "Parameters can be excluded by name",
+			rules:            []ConfigQueryRule{{ExcludeParam: "token|session"}},
+			query:            "a=1&token=abc&b=2&session=xyz",
+			expectedQuery:    "a=1&b=2",
+			expectedRedacted: 6,
+		},
+		{
+			desc:             "Parameter values can be masked by name",
+			rules:            []ConfigQueryRule{{MaskParam: "email"}},
+			query:            "email=jo%40example.com&email_hash=123",
+			expectedQuery:    "email=**************&email_hash=123",
+			expectedRedacted: 14,
+		},
+		{
+			desc:             "Content can be excluded from every value",
+			rules:            []ConfigQueryRule{{Exclude: `[0-9]{3}-[0-9]{4}`}},
+			query:            "q=call+555-1234+now&n=5",
+			expectedQuery:    "q=call++now&n=5",
+			expectedRedacted: 8,
+		},
+		{
+			desc:             "Content can be masked in every value",
+			rules:            []ConfigQueryRule{{Mask: `[a-z]+@[a-z.]+`}},
+			query:            "to=jo@example.com&flag",
+			expectedQuery:    "to=**************&flag",
+			expectedRedacted: 14,
+		},
+		{
+			desc:             "Untouched parameters keep their encoding",
+			rules:            []ConfigQueryRule{{ExcludeParam: "token"}},
+			query:            "path=%2Fa%2Fb&x=a+b&token=1",
+			expectedQuery:    "path=%2Fa%2Fb&x=a+b",
+			expectedRedacted: 1,
+		},
+		{
+			desc:             "Queries without matches are unchanged",
+			rules:            []ConfigQueryRule{{MaskParam: "email"}, {Exclude: "secret"}},
+			query:            "a=1;b=2&c",
+			expectedQuery:    "a=1;b=2&c",
+			expectedRedacted: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		blockers := []*queryBlocker{}
+		for _, rule := range testCase.rules {
+			blocker, err := newQueryBlocker(rule)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating blocker: %v", testCase.desc, err)
+				continue
+			}
+			blockers = append(blockers, blocker)
+		}
+
+		request, err := http.NewRequest("GET", "http://example.com/path?"+testCase.query, nil)
+		if err != nil {
+			t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+			continue
+		}
+		redacted := blockQuery(request, blockers)
+		if request.URL.RawQuery != testCase.expectedQuery {
+			t.Errorf("Test '%v': Expected query '%v' but got '%v'", testCase.desc, testCase.expectedQuery, request.URL.RawQuery)
+		}
+		if redacted != testCase.expectedRedacted {
+			t.Errorf("Test '%v': Expected %v bytes redacted but got %v", testCase.desc, testCase.expectedRedacted, redacted)
+		}
+	}
+}
+
+func TestQueryRuleValidation(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		rule    ConfigQueryRule
+		isValid bool
+	}{
+		{desc: "Exclude by name", rule: ConfigQueryRule{ExcludeParam: "token"}, isValid: true},
+		{desc: "Mask by value", rule: ConfigQueryRule{Mask: "[0-9]+"}, isValid: true},
+		{desc: "No properties", rule: ConfigQueryRule{}, isValid: false},
+		{desc: "Two properties", rule: ConfigQueryRule{MaskParam: "a", Exclude: "b"}, isValid: false},
+		{desc: "Invalid name expression", rule: ConfigQueryRule{MaskParam: "("}, isValid: false},
+		{desc: "Invalid value expression", rule: ConfigQueryRule{Exclude: "["}, isValid: false},
+	}
+
+	for _, testCase := range testCases {
+		_, err := newQueryBlocker(testCase.rule)
+		if isValid := err == nil; isValid != testCase.isValid {
+			t.Errorf("Test '%v': Expected valid=%v but got error %v", testCase.desc, testCase.isValid, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package content_blocker_plugin
+
+import (
+	"io"
+
+	"github.com/immersa-co/relay-core/relay/metrics"
+)
+
+// streamingBlocker applies content blockers to a body incrementally, so that
+// large bodies can be redacted with bounded memory.
+//
+// The body is read in chunks. Before a chunk is processed, the last 'overlap'
+// bytes are held back and prepended to the next chunk, so that matches which
+// span a chunk boundary are still found. The hold-back point is moved earlier
+// if it would split a match. This means that matches up to 'overlap' bytes
+// long are always found; longer matches may be missed if they happen to span
+// a boundary, so the overlap should be comfortably longer than the longest
+// content the rules are expected to match.
+type streamingBlocker struct {
+	source    io.ReadCloser
+	blockers  []*contentBlocker
+	chunkSize int
+	overlap   int
+	metrics   *metrics.PluginMetrics
+	size      int64 // The length of the output, or -1 if it's unknown.
+
+	pending []byte // Raw data which hasn't been processed yet.
+	output  []byte // Processed data which hasn't been returned yet.
+	err     error  // The error (usually io.EOF) returned by source, if any.
+
+	redacted int  // The number of bytes excluded or masked so far.
+	finished bool // True once metrics have been recorded.
+}
+
+func newStreamingBlocker(
+	source io.ReadCloser,
+	blockers []*contentBlocker,
+	chunkSize, overlap int,
+	metrics *metrics.PluginMetrics,
+) *streamingBlocker {
+	return &streamingBlocker{
+		source:    source,
+		blockers:  blockers,
+		chunkSize: chunkSize,
+		overlap:   overlap,
+		metrics:   metrics,
+		size:      -1,
+	}
+}
+
+// Size implements traffic.SizedBody, so that the relay can send the
+// Content-Length of bodies whose length blocking preserves.
+func (s *streamingBlocker) Size() int64 {
+	return s.size
+}
+
+func (s *streamingBlocker) Read(p []byte) (int, error) {
+	target := s.chunkSize + s.overlap
+	for len(s.output) == 0 {
+		if s.err != nil && len(s.pending) == 0 {
+			s.finish()
+			return 0, s.err
+		}
+		s.fill(target)
+		if !s.process() {
+			// A match spans all of the pending data; read another chunk.
+			target = len(s.pending) + s.chunkSize
+		}
+	}
+
+	n := copy(p, s.output)
+	s.output = s.output[n:]
+	return n, nil
+}
+
+func (s *streamingBlocker) Close() error {
+	return s.source.Close()
+}
+
+// fill reads from the source until at least target bytes are pending or the
+// source is exhausted.
+func (s *streamingBlocker) fill(target int) {
+	buffer := make([]byte, s.chunkSize)
+	for s.err == nil && len(s.pending) < target {
+		n, err := s.source.Read(buffer)
+		s.pending = append(s.pending, buffer[:n]...)
+		s.err = err
+	}
+}
+
+// process redacts as much pending data as can safely be processed and moves
+// the result to the output buffer. It returns false if no data could be
+// processed.
+func (s *streamingBlocker) process() bool {
+	end := len(s.pending)
+	if s.err == nil {
+		end = s.safeBoundary(len(s.pending) - s.overlap)
+	}
+	if end <= 0 {
+		return false
+	}
+
+	processed, redacted := applyBlockers(append([]byte{}, s.pending[:end]...), s.blockers)
+	s.redacted += redacted
+	s.output = append(s.output, processed...)
+	s.pending = append([]byte{}, s.pending[end:]...)
+	return true
+}
+
+// finish records metrics once the body has been completely processed.
+func (s *streamingBlocker) finish() {
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	if s.redacted > 0 {
+		s.metrics.BodyModified()
+		s.metrics.BytesRedacted(s.redacted)
+	}
+	if s.err != io.EOF {
+		s.metrics.Error()
+	}
+}
+
+// safeBoundary returns a position at or before 'boundary' at which the
+// pending data can be split without splitting a match for any blocker.
+func (s *streamingBlocker) safeBoundary(boundary int) int {
+	// Moving the boundary to the start of one match may cause it to split an
+	// earlier match for a different blocker, so repeat until nothing changes.
+	for changed := true; changed && boundary > 0; {
+		changed = false
+		for _, blocker := range s.blockers {
+			for _, match := range blocker.regexp.FindAllIndex(s.pending, -1) {
+				if match[0] < boundary && boundary < match[1] {
+					boundary = match[0]
+					changed = true
+				}
+			}
+		}
+	}
+
+	// If a single match covers everything we've read, we have no choice but
+	// to split it; otherwise memory use would be unbounded.
+	if boundary <= 0 && len(s.pending) >= 2*(s.chunkSize+s.overlap) {
+		return len(s.pending) - s.overlap
+	}
+	return boundary
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
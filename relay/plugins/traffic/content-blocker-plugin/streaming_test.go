@@ -0,0 +1,81 @@
+package content_blocker_plugin
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStreamingBlockerMatchesBufferedBlocking(t *testing.T) {
+	blockers := []*contentBlocker{
+		{mode: excludeMode, regexp: regexp.MustCompile(`(?i)secret-[a-z]+`)},
+		{mode: maskMode, regexp: regexp.MustCompile(`[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+`)},
+	}
+
+	var builder strings.Builder
+	for i := 0; i < 200; i++ {
+		builder.WriteString(`{"ip": "192.168.0.1", "token": "SECRET-abcdef", "note": "nothing to see"}`)
+	}
+	body := []byte(builder.String())
+
+	expected := body
+	for _, blocker := range blockers {
+		expected = blocker.Block(expected)
+	}
+
+	testCases := []struct {
+		desc      string
+		chunkSize int
+		overlap   int
+	}{
+		{desc: "Tiny chunks", chunkSize: 1, overlap: 16},
+		{desc: "Chunks smaller than matches", chunkSize: 5, overlap: 16},
+		{desc: "Chunks larger than matches", chunkSize: 100, overlap: 32},
+		{desc: "Chunks larger than the body", chunkSize: len(body) * 2, overlap: 16},
+	}
+
+	for _, testCase := range testCases {
+		reader := newStreamingBlocker(io.NopCloser(bytes.NewReader(body)), blockers, testCase.chunkSize, testCase.overlap, nil)
+		actual, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading: %v", testCase.desc, err)
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("Test '%v': Streamed output differs from buffered output", testCase.desc)
+		}
+	}
+}
+
+func TestStreamingBlockerBoundsMemory(t *testing.T) {
+	// A single match covering the entire body must still be processed in
+	// pieces rather than buffered indefinitely.
+	blockers := []*contentBlocker{
+		{mode: maskMode, regexp: regexp.MustCompile(`a+`)},
+	}
+	body := bytes.Repeat([]byte("a"), 10000)
+
+	reader := newStreamingBlocker(io.NopCloser(bytes.NewReader(body)), blockers, 64, 16, nil)
+	maxPending := 0
+	output := []byte{}
+	buffer := make([]byte, 32)
+	for {
+		n, err := reader.Read(buffer)
+		output = append(output, buffer[:n]...)
+		if len(reader.pending) > maxPending {
+			maxPending = len(reader.pending)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if maxPending > 4*(64+16) {
+		t.Errorf("Expected pending data to stay bounded but it reached %d bytes", maxPending)
+	}
+	if !bytes.Equal(output, bytes.Repeat([]byte("*"), len(body))) {
+		t.Errorf("Expected the entire body to be masked")
+	}
+}
@@ -1,15 +1,18 @@
 package content_enricher_plugin
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
 	"github.com/immersa-co/relay-core/relay/traffic"
 	"github.com/immersa-co/relay-core/relay/version"
 )
@@ -17,7 +20,7 @@ import (
 var (
 	Factory    contentEnricherPluginFactory
 	pluginName = "enrich-content"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 
 	PluginVersionHeaderName = "X-Relay-Content-Enricher-Version"
 )
@@ -25,6 +28,10 @@ var (
 type configStructure struct {
 	Body    map[string]interface{} `yaml:"body,omitempty"`
 	Headers map[string]string      `yaml:"headers,omitempty"`
+
+	ResponseHeaders map[string]string `yaml:"response-headers,omitempty"`
+
+	Annotations map[string]string `yaml:"annotations,omitempty"`
 }
 
 type contentEnricherPluginFactory struct{}
@@ -37,6 +44,10 @@ func (f contentEnricherPluginFactory) New(configSection *config.Section) (traffi
 	plugin := &contentEnricherPlugin{
 		bodyEnrichments:   make(map[string]interface{}),
 		headerEnrichments: make(map[string]string),
+
+		responseHeaderEnrichments: make(map[string]string),
+
+		annotations: make(map[string]string),
 	}
 
 	if err := config.ParseOptional(configSection, "body", func(_ string, value map[string]interface{}) error {
@@ -57,18 +68,54 @@ func (f contentEnricherPluginFactory) New(configSection *config.Section) (traffi
 		return nil, fmt.Errorf("error parsing header enrichments: %v", err)
 	}
 
-	if len(plugin.bodyEnrichments) == 0 && len(plugin.headerEnrichments) == 0 {
+	if err := config.ParseOptional(configSection, "response-headers", func(_ string, value map[string]string) error {
+		for k, v := range value {
+			plugin.responseHeaderEnrichments[k] = v
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error parsing response header enrichments: %v", err)
+	}
+
+	if err := config.ParseOptional(configSection, "annotations", func(_ string, value map[string]string) error {
+		for k, v := range value {
+			plugin.annotations[k] = v
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error parsing annotations: %v", err)
+	}
+
+	if len(plugin.bodyEnrichments) == 0 && len(plugin.headerEnrichments) == 0 && len(plugin.responseHeaderEnrichments) == 0 && len(plugin.annotations) == 0 {
 		logger.Println("No enrichments configured, plugin will not be loaded.")
 		return nil, nil
 	}
 
-	logger.Printf("Initialized with %d body enrichments and %d header enrichments", len(plugin.bodyEnrichments), len(plugin.headerEnrichments))
+	logger.Printf(
+		"Initialized with %d body enrichments, %d header enrichments, %d response header enrichments, and %d annotations",
+		len(plugin.bodyEnrichments),
+		len(plugin.headerEnrichments),
+		len(plugin.responseHeaderEnrichments),
+		len(plugin.annotations),
+	)
 	return plugin, nil
 }
 
 type contentEnricherPlugin struct {
 	bodyEnrichments   map[string]interface{}
 	headerEnrichments map[string]string
+
+	responseHeaderEnrichments map[string]string
+
+	// Annotations added to each request, for later plugins like access-log.
+	annotations map[string]string
+
+	metrics *metrics.PluginMetrics
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *contentEnricherPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
 }
 
 func (plug *contentEnricherPlugin) Name() string {
@@ -84,6 +131,12 @@ func (plug *contentEnricherPlugin) HandleRequest(
 		return false
 	}
 
+	if info.Annotations != nil {
+		for key, value := range plug.annotations {
+			info.Annotations.Set(key, value)
+		}
+	}
+
 	if serviced := plug.enrichHeaderContent(response, request); serviced {
 		return true
 	}
@@ -98,6 +151,13 @@ func (plug *contentEnricherPlugin) HandleRequest(
 	return false
 }
 
+// HandleResponse adds the configured headers to the target's response.
+func (plug *contentEnricherPlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	for header, value := range plug.responseHeaderEnrichments {
+		response.Header.Set(header, value)
+	}
+}
+
 func (plug *contentEnricherPlugin) enrichHeaderContent(response http.ResponseWriter, request *http.Request) bool {
 	if len(plug.headerEnrichments) == 0 {
 		return false
@@ -122,9 +182,10 @@ func (plug *contentEnricherPlugin) enrichBodyContent(response http.ResponseWrite
 	}
 
 	bodyBytes, err := io.ReadAll(request.Body)
-	request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	traffic.SetRequestBody(request, bodyBytes)
 	if err != nil {
-		logger.Printf("Error reading request body: %s", err)
+		plug.metrics.Error()
+		logger.Errorf("Error reading request body: %s", err)
 		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
 		return true
 	}
@@ -134,13 +195,39 @@ func (plug *contentEnricherPlugin) enrichBodyContent(response http.ResponseWrite
 		return false
 	}
 
+	if isFormRequest(request) {
+		if enrichedBodyBytes, modified := plug.enrichForm(bodyBytes); modified {
+			plug.metrics.BodyModified()
+			traffic.SetRequestBody(request, enrichedBodyBytes)
+		}
+		return false
+	}
+
 	var jsonBody map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &jsonBody); err != nil {
-		logger.Printf("Error parsing JSON body, cannot enrich: %s. Body: %s", err, string(bodyBytes))
-		request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		plug.metrics.Error()
+		logger.Errorf("Error parsing JSON body, cannot enrich: %s. Body: %s", err, string(bodyBytes))
+		traffic.SetRequestBody(request, bodyBytes)
 		return false
 	}
 
+	enrichedBodyBytes, err := plug.enrichJson(jsonBody)
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error marshaling enriched JSON: %s", err)
+		http.Error(response, fmt.Sprintf("Error marshaling enriched JSON: %s", err), http.StatusInternalServerError)
+		return true
+	}
+
+	plug.metrics.BodyModified()
+	traffic.SetRequestBody(request, enrichedBodyBytes)
+
+	return false
+}
+
+// enrichJson adds the body enrichments which aren't already present to a
+// parsed JSON object, and returns it encoded once more.
+func (plug *contentEnricherPlugin) enrichJson(jsonBody map[string]interface{}) ([]byte, error) {
 	for key, value := range plug.bodyEnrichments {
 		if _, exists := jsonBody[key]; !exists {
 			jsonBody[key] = value
@@ -148,19 +235,79 @@ func (plug *contentEnricherPlugin) enrichBodyContent(response http.ResponseWrite
 			logger.Printf("Skipping enrichment for body key '%s' because it already exists.", key)
 		}
 	}
+	return json.Marshal(jsonBody)
+}
+
+// HandleMessage implements traffic.WsPlugin. The body enrichments are added to
+// the text messages the client sends over a websocket connection which are
+// JSON objects, just as they're added to JSON request bodies. Other messages
+// are relayed unchanged.
+func (plug *contentEnricherPlugin) HandleMessage(direction traffic.WebsocketDirection, messageType traffic.WebsocketMessageType, payload []byte) ([]byte, bool) {
+	if len(plug.bodyEnrichments) == 0 || direction != traffic.ClientToTarget || messageType != traffic.WebsocketTextMessage {
+		return payload, false
+	}
 
-	enrichedBodyBytes, err := json.Marshal(jsonBody)
+	var jsonMessage map[string]interface{}
+	if err := json.Unmarshal(payload, &jsonMessage); err != nil {
+		// Websocket protocols often mix JSON and other messages.
+		return payload, false
+	}
+	enriched, err := plug.enrichJson(jsonMessage)
 	if err != nil {
-		logger.Printf("Error marshaling enriched JSON: %s", err)
-		http.Error(response, fmt.Sprintf("Error marshaling enriched JSON: %s", err), http.StatusInternalServerError)
-		return true
+		plug.metrics.Error()
+		logger.Errorf("Error marshaling enriched JSON: %s", err)
+		return payload, false
 	}
+	plug.metrics.BodyModified()
+	return enriched, false
+}
 
-	request.Body = io.NopCloser(bytes.NewBuffer(enrichedBodyBytes))
-	request.ContentLength = int64(len(enrichedBodyBytes))
-	request.Header.Set("Content-Length", fmt.Sprintf("%d", request.ContentLength))
+// enrichForm appends body enrichments which aren't already present to a
+// URL-encoded form body as new parameters. The existing parameters are left
+// exactly as the client encoded them. Enrichments with values that can't be
+// represented as a single form parameter, like lists and maps, are skipped.
+func (plug *contentEnricherPlugin) enrichForm(bodyBytes []byte) ([]byte, bool) {
+	// ParseQuery keeps the parameters it could parse even if it returns an
+	// error, which is all that's needed to check for existing keys.
+	form, _ := url.ParseQuery(string(bodyBytes))
+
+	keys := make([]string, 0, len(plug.bodyEnrichments))
+	for key := range plug.bodyEnrichments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	return false
+	var params []string
+	for _, key := range keys {
+		if form.Has(key) {
+			logger.Printf("Skipping enrichment for form key '%s' because it already exists.", key)
+			continue
+		}
+		var value string
+		switch typed := plug.bodyEnrichments[key].(type) {
+		case nil:
+		case map[string]interface{}, []interface{}:
+			logger.Printf("Skipping enrichment for form key '%s' because its value isn't a scalar.", key)
+			continue
+		default:
+			value = fmt.Sprint(typed)
+		}
+		params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(value))
+	}
+	if len(params) == 0 {
+		return bodyBytes, false
+	}
+
+	enriched := strings.TrimSuffix(string(bodyBytes), "&")
+	if enriched != "" {
+		enriched += "&"
+	}
+	return []byte(enriched + strings.Join(params, "&")), true
+}
+
+func isFormRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
 }
 
 /*
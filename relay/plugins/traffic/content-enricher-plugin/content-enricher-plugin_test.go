@@ -13,6 +13,7 @@ import (
 	"github.com/immersa-co/relay-core/relay/test"
 	"github.com/immersa-co/relay-core/relay/traffic"
 	"github.com/immersa-co/relay-core/relay/version"
+	"golang.org/x/net/websocket"
 )
 
 func TestContentEnriching(t *testing.T) {
@@ -55,14 +56,67 @@ func TestContentEnriching(t *testing.T) {
 				"newhead":          "newvalue",
 			},
 		},
+		{
+			desc: "Form bodies are enriched with new parameters",
+			config: `enrich-content:
+  body:
+    source: "relay proxy"
+    version: 2
+    name: "ignored"
+    tags: ["a", "b"]`,
+			originalHeaders: map[string]string{
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			originalBody: `name=Jane%20Doe&note=a%2Bb`,
+			expectedBody: `name=Jane%20Doe&note=a%2Bb&source=relay+proxy&version=2`,
+		},
 	}
 
 	for _, testCase := range testCases {
 		runContentEnricherTest(t, testCase, traffic.Identity)
 		runContentEnricherTest(t, testCase, traffic.Gzip)
+		runContentEnricherTest(t, testCase, traffic.Brotli)
+		runContentEnricherTest(t, testCase, traffic.Zstd)
 	}
 }
 
+func TestContentEnrichingWebsocketMessages(t *testing.T) {
+	config := `enrich-content:
+  body:
+    source: "relay"`
+	plugins := []traffic.PluginFactory{content_enricher_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		ws, err := websocket.Dial(relayService.WsUrl()+"/echo", "", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		defer ws.Close()
+
+		// The catcher echoes back whatever it receives, so the echoed messages
+		// show what the target saw.
+		for _, testCase := range []struct {
+			original string
+			expected string
+		}{
+			{`{"event":"click"}`, `{"event":"click","source":"relay"}`},
+			{`{"source":"client"}`, `{"source":"client"}`},
+			{`not JSON`, `not JSON`},
+		} {
+			if err := websocket.Message.Send(ws, testCase.original); err != nil {
+				t.Fatalf("Error sending websocket message: %v", err)
+			}
+			var received string
+			if err := websocket.Message.Receive(ws, &received); err != nil {
+				t.Fatalf("Error receiving websocket message: %v", err)
+			}
+			if received != testCase.expected {
+				t.Errorf("Expected websocket message '%v' but got '%v'", testCase.expected, received)
+			}
+		}
+	})
+}
+
 type contentEnricherTestCase struct {
 	desc            string
 	config          string
@@ -73,13 +127,7 @@ type contentEnricherTestCase struct {
 }
 
 func runContentEnricherTest(t *testing.T, testCase contentEnricherTestCase, encoding traffic.Encoding) {
-	var encodingStr string
-	switch encoding {
-	case traffic.Gzip:
-		encodingStr = "gzip"
-	case traffic.Identity:
-		encodingStr = ""
-	}
+	encodingStr := encoding.HeaderValue()
 
 	desc := fmt.Sprintf("%s (encoding: %v)", testCase.desc, encodingStr)
 
@@ -116,8 +164,8 @@ func runContentEnricherTest(t *testing.T, testCase contentEnricherTestCase, enco
 			return
 		}
 
-		if encoding == traffic.Gzip {
-			request.Header.Set("Content-Encoding", "gzip")
+		if encoding != traffic.Identity {
+			request.Header.Set("Content-Encoding", encodingStr)
 		}
 
 		request.Header.Set("Content-Type", "application/json")
@@ -203,3 +251,24 @@ func runContentEnricherTest(t *testing.T, testCase contentEnricherTestCase, enco
 		}
 	})
 }
+
+func TestResponseHeaderEnriching(t *testing.T) {
+	configYaml := `enrich-content:
+                     response-headers:
+                       X-Served-By: relay
+    `
+	plugins := []traffic.PluginFactory{content_enricher_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if servedBy := response.Header.Get("X-Served-By"); servedBy != "relay" {
+			t.Errorf("Expected X-Served-By response header to be 'relay' but got: %v", servedBy)
+		}
+	})
+}
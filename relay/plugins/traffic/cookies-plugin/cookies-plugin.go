@@ -8,19 +8,18 @@ package cookies_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var (
 	Factory    cookiesPluginFactory
 	pluginName = "cookies"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type cookiesPluginFactory struct{}
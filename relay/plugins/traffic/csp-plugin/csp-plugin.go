@@ -0,0 +1,210 @@
+// This plugin rewrites the Content-Security-Policy headers of responses from
+// the target, adding sources to their directives. When the relay fronts web
+// content, the origin's policy usually doesn't allow the scripts and
+// connections the relay introduces, like an injected snippet loaded from the
+// relay's own host; this lets them through without abandoning the policy.
+//
+// Sources are added to each configured directive which the policy contains. If
+// the policy omits a directive but has a 'default-src', the directive falls back
+// to 'default-src', so the plugin adds the directive with the 'default-src'
+// sources plus its own; this allows the configured sources without loosening
+// anything else. Policies which restrict neither are left alone, since they
+// already allow everything the directive covers.
+
+package csp_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    cspPluginFactory
+	pluginName = "csp"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// policyHeaders are the headers whose policies are rewritten.
+var policyHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+type cspPluginFactory struct{}
+
+func (f cspPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f cspPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &cspPlugin{}
+
+	if err := config.ParseOptional(configSection, "add-sources", func(key string, value map[string][]string) error {
+		for directive, sources := range value {
+			directive = strings.ToLower(directive)
+			if !strings.HasSuffix(directive, "-src") || directive == "default-src" {
+				return fmt.Errorf(`Invalid directive "%v": sources may only be added to fetch directives other than default-src`, directive)
+			}
+			for _, source := range sources {
+				if source == "" || strings.ContainsAny(source, " ;,") {
+					return fmt.Errorf(`Invalid source "%v" for directive "%v"`, source, directive)
+				}
+			}
+			if len(sources) > 0 {
+				plugin.additions = append(plugin.additions, sourceAddition{directive: directive, sources: sources})
+				logger.Printf(`Added rule: allow %v in "%v"`, strings.Join(sources, " "), directive)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(plugin.additions) == 0 {
+		return nil, nil
+	}
+
+	// Keep the order of rewritten directives deterministic.
+	sort.Slice(plugin.additions, func(i, j int) bool {
+		return plugin.additions[i].directive < plugin.additions[j].directive
+	})
+
+	return plugin, nil
+}
+
+type cspPlugin struct {
+	additions []sourceAddition
+}
+
+// sourceAddition lists sources to add to a directive.
+type sourceAddition struct {
+	directive string // Lowercase, e.g. "script-src".
+	sources   []string
+}
+
+func (plug *cspPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *cspPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	return false
+}
+
+// HandleResponse rewrites the policies in the target's response.
+func (plug *cspPlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	for _, header := range policyHeaders {
+		values := response.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		rewritten := make([]string, 0, len(values))
+		for _, value := range values {
+			// A header value may hold several comma-separated policies, all of
+			// which are enforced.
+			var policies []string
+			for _, policy := range strings.Split(value, ",") {
+				policies = append(policies, plug.rewritePolicy(policy))
+			}
+			rewritten = append(rewritten, strings.Join(policies, ", "))
+		}
+
+		response.Header.Del(header)
+		for _, value := range rewritten {
+			response.Header.Add(header, value)
+		}
+	}
+}
+
+// directive is a parsed policy directive.
+type directive struct {
+	name    string // Lowercase.
+	sources []string
+}
+
+// rewritePolicy adds the configured sources to a single policy.
+func (plug *cspPlugin) rewritePolicy(policy string) string {
+	var directives []*directive
+	byName := map[string]*directive{}
+	for _, text := range strings.Split(policy, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		parsed := &directive{name: strings.ToLower(fields[0]), sources: fields[1:]}
+		// Only the first occurrence of a directive is enforced; later ones are
+		// kept as they are.
+		if byName[parsed.name] == nil {
+			byName[parsed.name] = parsed
+		}
+		directives = append(directives, parsed)
+	}
+
+	for _, addition := range plug.additions {
+		existing := byName[addition.directive]
+		if existing == nil {
+			defaultSrc := byName["default-src"]
+			if defaultSrc == nil {
+				continue // Nothing restricts this directive.
+			}
+			existing = &directive{name: addition.directive, sources: append([]string{}, defaultSrc.sources...)}
+			byName[existing.name] = existing
+			directives = append(directives, existing)
+		}
+		existing.sources = addSources(existing.sources, addition.sources)
+	}
+
+	parts := make([]string, 0, len(directives))
+	for _, parsed := range directives {
+		parts = append(parts, strings.Join(append([]string{parsed.name}, parsed.sources...), " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// addSources returns sources with additions appended, skipping any which are
+// already present. A lone 'none' is replaced, since it can't be combined with
+// other sources.
+func addSources(sources []string, additions []string) []string {
+	if len(sources) == 1 && strings.EqualFold(sources[0], "'none'") {
+		sources = nil
+	}
+	for _, addition := range additions {
+		present := false
+		for _, source := range sources {
+			if strings.EqualFold(source, addition) {
+				present = true
+				break
+			}
+		}
+		if !present {
+			sources = append(sources, addition)
+		}
+	}
+	return sources
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
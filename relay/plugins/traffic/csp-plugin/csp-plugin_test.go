@@ -0,0 +1,148 @@
+package csp_plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	csp_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/csp-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+const testConfig = `csp:
+    add-sources:
+        script-src: [https://relay.example.test]
+        connect-src: [https://relay.example.test, wss://relay.example.test]
+`
+
+func TestCSPPlugin(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		header           string
+		originalPolicies []string
+		expectedPolicies []string
+	}{
+		{
+			desc:             "Sources are appended to existing directives",
+			header:           "Content-Security-Policy",
+			originalPolicies: []string{"script-src 'self' https://cdn.example.test; connect-src 'self'"},
+			expectedPolicies: []string{"script-src 'self' https://cdn.example.test https://relay.example.test; connect-src 'self' https://relay.example.test wss://relay.example.test"},
+		},
+		{
+			desc:             "Missing directives inherit default-src",
+			header:           "Content-Security-Policy",
+			originalPolicies: []string{"default-src 'self'; img-src *"},
+			expectedPolicies: []string{"default-src 'self'; img-src *; connect-src 'self' https://relay.example.test wss://relay.example.test; script-src 'self' https://relay.example.test"},
+		},
+		{
+			desc:             "Policies without default-src are only changed where they restrict",
+			header:           "Content-Security-Policy",
+			originalPolicies: []string{"frame-ancestors 'none'; SCRIPT-SRC 'none'"},
+			expectedPolicies: []string{"frame-ancestors 'none'; script-src https://relay.example.test"},
+		},
+		{
+			desc:             "Sources aren't duplicated",
+			header:           "Content-Security-Policy",
+			originalPolicies: []string{"connect-src https://RELAY.example.test"},
+			expectedPolicies: []string{"connect-src https://RELAY.example.test wss://relay.example.test"},
+		},
+		{
+			desc:             "Every policy is rewritten",
+			header:           "Content-Security-Policy",
+			originalPolicies: []string{"script-src 'self', connect-src 'none'", "default-src https:"},
+			expectedPolicies: []string{
+				"script-src 'self' https://relay.example.test, connect-src https://relay.example.test wss://relay.example.test",
+				"default-src https:; connect-src https: https://relay.example.test wss://relay.example.test; script-src https: https://relay.example.test",
+			},
+		},
+		{
+			desc:             "Report-only policies are rewritten",
+			header:           "Content-Security-Policy-Report-Only",
+			originalPolicies: []string{"script-src 'self'; report-uri /csp"},
+			expectedPolicies: []string{"script-src 'self' https://relay.example.test; report-uri /csp"},
+		},
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := request.Header.Get("X-Test-Policy-Header")
+		for _, policy := range request.Header.Values("X-Test-Policy") {
+			response.Header().Add(header, policy)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	configFile, err := config.NewFileFromYamlString(testConfig)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := csp_plugin.Factory.New(configFile.LookupOptionalSection("csp"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+	defer relayServer.Close()
+
+	for _, testCase := range testCases {
+		request, _ := http.NewRequest("GET", relayServer.URL, nil)
+		request.Header.Set("X-Test-Policy-Header", testCase.header)
+		for _, policy := range testCase.originalPolicies {
+			request.Header.Add("X-Test-Policy", policy)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+
+		if policies := response.Header.Values(testCase.header); !reflect.DeepEqual(policies, testCase.expectedPolicies) {
+			t.Errorf("Test '%v': Expected policies %q but got %q", testCase.desc, testCase.expectedPolicies, policies)
+		}
+	}
+}
+
+func TestCSPConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"add-sources:\n        default-src: [https://relay.example.test]",
+		"add-sources:\n        report-uri: [/csp]",
+		"add-sources:\n        script-src: ['https://a.example.test; script-src *']",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("csp:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := csp_plugin.Factory.New(configFile.LookupOptionalSection("csp")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
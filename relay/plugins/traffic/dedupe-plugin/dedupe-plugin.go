@@ -0,0 +1,242 @@
+// This plugin keeps retried requests from being relayed twice. Clients, like
+// SDKs which retry requests whose responses they didn't receive, identify each
+// request with a unique value in a configured header, like X-Request-Id; the
+// plugin remembers the values it has seen for 'ttl', and responds to requests
+// which repeat one with the status the target returned the first time,
+// instead of relaying them again.
+//
+// A repeated request which arrives while the first is still being handled is
+// rejected with a 409, since its outcome isn't known yet. Requests which fail
+// in a way that a retry might fix, with a 5xx, 408, or 429 status, are
+// forgotten, so that they can be retried. Requests without the header are
+// relayed as usual.
+//
+// Duplicates are answered with an empty body and the DuplicateHeaderName
+// header. Values are remembered in memory, so each relay instance only
+// deduplicates the requests it receives itself.
+
+package dedupe_plugin
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    dedupePluginFactory
+	pluginName = "dedupe"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// DuplicateHeaderName is the response header which marks responses to
+// duplicate requests, which weren't relayed.
+const DuplicateHeaderName = "X-Relay-Duplicate"
+
+const (
+	defaultTTL        = 10 * time.Minute
+	defaultMaxEntries = 100000
+)
+
+type dedupePluginFactory struct{}
+
+func (f dedupePluginFactory) Name() string {
+	return pluginName
+}
+
+func (f dedupePluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &dedupePlugin{
+		ttl:        defaultTTL,
+		maxEntries: defaultMaxEntries,
+		clock:      clock.Real,
+		entries:    map[string]*list.Element{},
+		pending:    map[*http.Request]*list.Element{},
+		order:      list.New(),
+	}
+
+	if ttl, err := config.LookupOptional[time.Duration](configSection, "ttl"); err != nil {
+		return nil, err
+	} else if ttl != nil {
+		if *ttl <= 0 {
+			return nil, fmt.Errorf(`Invalid ttl "%v": must be positive`, *ttl)
+		}
+		plugin.ttl = *ttl
+	}
+	if maxEntries, err := config.LookupOptional[int](configSection, "max-entries"); err != nil {
+		return nil, err
+	} else if maxEntries != nil {
+		if *maxEntries < 1 {
+			return nil, fmt.Errorf(`Invalid max-entries "%v": must be at least 1`, *maxEntries)
+		}
+		plugin.maxEntries = *maxEntries
+	}
+
+	if header, err := config.LookupOptional[string](configSection, "header"); err != nil {
+		return nil, err
+	} else if header == nil {
+		return nil, nil
+	} else {
+		plugin.header = http.CanonicalHeaderKey(*header)
+	}
+
+	logger.Printf(`Added rule: deduplicate requests by "%v" for %v`, plugin.header, plugin.ttl)
+	return plugin, nil
+}
+
+type dedupePlugin struct {
+	header     string // The header which identifies each request.
+	ttl        time.Duration
+	maxEntries int
+	clock      clock.Clock
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element        // Of *seenRequest, by header value.
+	pending map[*http.Request]*list.Element // Entries whose requests haven't completed.
+	order   *list.List                      // Of *seenRequest, oldest first.
+}
+
+// seenRequest is a request whose header value was seen.
+type seenRequest struct {
+	value   string
+	seen    time.Time
+	request *http.Request // The request being handled, until it completes.
+	status  int           // The status returned to the client, once it completes.
+}
+
+func (plug *dedupePlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *dedupePlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *dedupePlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+	value := request.Header.Get(plug.header)
+	if value == "" {
+		return false
+	}
+
+	status, pending, duplicate := plug.see(value, request)
+	if !duplicate {
+		return false
+	}
+
+	response.Header().Set(DuplicateHeaderName, "true")
+	if pending {
+		logger.Printf("%s %s: rejected: %s %q is already being handled", request.Method, request.URL.Path, plug.header, value)
+		http.Error(response, fmt.Sprintf("A request with this %s is already being handled", plug.header), http.StatusConflict)
+		return true
+	}
+	logger.Printf("%s %s: %s %q is a duplicate; responding with %v", request.Method, request.URL.Path, plug.header, value, status)
+	response.Header().Set("Content-Length", "0")
+	response.WriteHeader(status)
+	return true
+}
+
+// see records a header value. If it was already seen, it returns true, along
+// with the status returned for the first request, or true for pending if that
+// request hasn't completed.
+func (plug *dedupePlugin) see(value string, request *http.Request) (status int, pending bool, duplicate bool) {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	now := plug.clock.Now()
+	plug.expire(now)
+
+	if element := plug.entries[value]; element != nil {
+		seen := element.Value.(*seenRequest)
+		return seen.status, seen.request != nil, true
+	}
+
+	element := plug.order.PushBack(&seenRequest{value: value, seen: now, request: request})
+	plug.entries[value] = element
+	plug.pending[request] = element
+	for plug.order.Len() > plug.maxEntries {
+		plug.remove(plug.order.Front())
+	}
+	return 0, false, false
+}
+
+// HandleCompletion implements traffic.CompletionPlugin. It remembers the
+// status returned for each request whose header value was recorded, or
+// forgets the value if a retry might succeed.
+func (plug *dedupePlugin) HandleCompletion(completion *traffic.RequestCompletion) {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	// Duplicates, and requests rejected before they reached the plugin,
+	// weren't recorded.
+	element := plug.pending[completion.Request]
+	if element == nil {
+		return
+	}
+	if retryable(completion.Status) {
+		plug.remove(element)
+		return
+	}
+	delete(plug.pending, completion.Request)
+	seen := element.Value.(*seenRequest)
+	seen.request = nil
+	seen.status = completion.Status
+}
+
+// retryable returns true if a request which received status might succeed if
+// it were sent again.
+func retryable(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// expire forgets values which were seen more than the TTL ago. It must be
+// called with the mutex held.
+func (plug *dedupePlugin) expire(now time.Time) {
+	for element := plug.order.Front(); element != nil; element = plug.order.Front() {
+		if now.Sub(element.Value.(*seenRequest).seen) < plug.ttl {
+			return
+		}
+		plug.remove(element)
+	}
+}
+
+// remove forgets a value. It must be called with the mutex held.
+func (plug *dedupePlugin) remove(element *list.Element) {
+	seen := plug.order.Remove(element).(*seenRequest)
+	delete(plug.entries, seen.value)
+	if seen.request != nil {
+		delete(plug.pending, seen.request)
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
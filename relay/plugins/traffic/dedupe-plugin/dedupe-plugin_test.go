@@ -0,0 +1,215 @@
+package dedupe_plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	dedupe_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/dedupe-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type dedupeStep struct {
+	advance        time.Duration // How long to wait before sending the request.
+	requestID      string        // The X-Request-Id header.
+	targetStatus   int           // The status the target returns, if the request is relayed.
+	complete       bool          // Whether the request completes before the next step.
+	expectedStatus int           // The status of a duplicate, or 0 if the request should be relayed.
+}
+
+func TestDedupePlugin(t *testing.T) {
+	defaultConfig := "dedupe:\n    header: x-request-id\n"
+	testCases := []struct {
+		desc   string
+		config string
+		steps  []dedupeStep
+	}{
+		{
+			desc:   "Duplicates receive the first request's status",
+			config: defaultConfig,
+			steps: []dedupeStep{
+				{requestID: "a", targetStatus: http.StatusAccepted, complete: true},
+				{requestID: "a", expectedStatus: http.StatusAccepted},
+				{requestID: "b", targetStatus: http.StatusBadRequest, complete: true},
+				{requestID: "b", expectedStatus: http.StatusBadRequest},
+				{requestID: "a", expectedStatus: http.StatusAccepted},
+			},
+		},
+		{
+			desc:   "Requests without the header aren't deduplicated",
+			config: defaultConfig,
+			steps: []dedupeStep{
+				{targetStatus: http.StatusOK, complete: true},
+				{targetStatus: http.StatusOK, complete: true},
+			},
+		},
+		{
+			desc:   "Values are forgotten after the TTL",
+			config: defaultConfig + "    ttl: 1m\n",
+			steps: []dedupeStep{
+				{requestID: "a", targetStatus: http.StatusOK, complete: true},
+				{advance: 59 * time.Second, requestID: "a", expectedStatus: http.StatusOK},
+				{advance: time.Second, requestID: "a", targetStatus: http.StatusOK, complete: true},
+				{requestID: "a", expectedStatus: http.StatusOK},
+			},
+		},
+		{
+			desc:   "Requests which might succeed if retried are forgotten",
+			config: defaultConfig,
+			steps: []dedupeStep{
+				{requestID: "a", targetStatus: http.StatusBadGateway, complete: true},
+				{requestID: "a", targetStatus: http.StatusTooManyRequests, complete: true},
+				{requestID: "a", targetStatus: http.StatusRequestTimeout, complete: true},
+				{requestID: "a", targetStatus: http.StatusOK, complete: true},
+				{requestID: "a", expectedStatus: http.StatusOK},
+			},
+		},
+		{
+			desc:   "Duplicates of requests being handled are rejected",
+			config: defaultConfig,
+			steps: []dedupeStep{
+				{requestID: "a", targetStatus: http.StatusOK},
+				{requestID: "a", expectedStatus: http.StatusConflict},
+			},
+		},
+		{
+			desc:   "The oldest values are forgotten",
+			config: defaultConfig + "    max-entries: 2\n",
+			steps: []dedupeStep{
+				{requestID: "a", targetStatus: http.StatusOK, complete: true},
+				{requestID: "b", targetStatus: http.StatusOK, complete: true},
+				{requestID: "c", targetStatus: http.StatusOK, complete: true},
+				{requestID: "c", expectedStatus: http.StatusOK},
+				{requestID: "b", expectedStatus: http.StatusOK},
+				{requestID: "a", targetStatus: http.StatusOK, complete: true},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := dedupe_plugin.Factory.New(configFile.LookupOptionalSection("dedupe"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+		fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+		plugin.(traffic.ClockPlugin).SetClock(fakeClock)
+
+		for i, step := range testCase.steps {
+			fakeClock.Advance(step.advance)
+			request := httptest.NewRequest("POST", "http://relay/events", nil)
+			if step.requestID != "" {
+				request.Header.Set("X-Request-Id", step.requestID)
+			}
+			recorder := httptest.NewRecorder()
+			serviced := plugin.HandleRequest(recorder, request, traffic.RequestInfo{})
+
+			if step.expectedStatus == 0 {
+				if serviced {
+					t.Errorf("Test '%v': Step %v: Expected the request to be relayed, but got status %v", testCase.desc, i, recorder.Code)
+					continue
+				}
+				if step.complete {
+					plugin.(traffic.CompletionPlugin).HandleCompletion(&traffic.RequestCompletion{
+						Request: request,
+						Status:  step.targetStatus,
+					})
+				}
+				continue
+			}
+
+			if !serviced {
+				t.Errorf("Test '%v': Step %v: Expected the request not to be relayed", testCase.desc, i)
+				continue
+			}
+			if recorder.Code != step.expectedStatus {
+				t.Errorf("Test '%v': Step %v: Expected status %v but got %v", testCase.desc, i, step.expectedStatus, recorder.Code)
+			}
+			if recorder.Header().Get(dedupe_plugin.DuplicateHeaderName) == "" {
+				t.Errorf("Test '%v': Step %v: Expected the %v header", testCase.desc, i, dedupe_plugin.DuplicateHeaderName)
+			}
+		}
+	}
+}
+
+func TestDedupePluginRelaysOnce(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests <- request
+		response.WriteHeader(http.StatusCreated)
+	}))
+	defer target.Close()
+
+	configFile, err := config.NewFileFromYamlString("dedupe:\n    header: X-Request-Id\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := dedupe_plugin.Factory.New(configFile.LookupOptionalSection("dedupe"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = "http"
+	options.TargetHost = target.Listener.Addr().String()
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+	defer relayServer.Close()
+
+	send := func() *http.Response {
+		request, _ := http.NewRequest("POST", relayServer.URL+"/events", nil)
+		request.Header.Set("X-Request-Id", "a")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	if response := send(); response.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the first request to receive status %v but got %v", http.StatusCreated, response.StatusCode)
+	}
+
+	// The first request completes just after its response is sent, so a retry
+	// may briefly be rejected as a conflict.
+	var response *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if response = send(); response.StatusCode != http.StatusConflict {
+			break
+		}
+	}
+	if response.StatusCode != http.StatusCreated || response.Header.Get(dedupe_plugin.DuplicateHeaderName) == "" {
+		t.Errorf("Expected the retry to receive the cached status %v but got %v", http.StatusCreated, response.StatusCode)
+	}
+	if count := len(requests); count != 1 {
+		t.Errorf("Expected the target to receive 1 request but got %v", count)
+	}
+}
+
+func TestDedupeConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"header: [X-Request-Id]",
+		"header: X-Request-Id\n    ttl: soon",
+		"header: X-Request-Id\n    ttl: 0s",
+		"header: X-Request-Id\n    max-entries: 0",
+		"header: X-Request-Id\n    max-entries: many",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("dedupe:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := dedupe_plugin.Factory.New(configFile.LookupOptionalSection("dedupe")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
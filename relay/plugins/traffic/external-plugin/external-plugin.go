@@ -0,0 +1,336 @@
+// This plugin runs traffic plugins which are separate programs, so that users
+// can write their own plugins without building a custom relay. Each program
+// is listed in the 'plugins' option, with its command, arguments, environment,
+// and a 'config' map which is passed to it as is; the relay starts them all
+// when it starts, and stops them when it stops.
+//
+// Plugin programs are written with the relay/plugins/sdk package, and the
+// relay calls them over gRPC on a unix socket. Each request is sent to each
+// program in turn, which may modify it, tag it, or respond to it instead of
+// the target. A program which fails, or takes longer than its 'timeout',
+// causes the client to receive a 502, unless 'fail-open' is set, in which case
+// the request is relayed as though the program weren't configured. While any
+// program has exited, the relay reports that it isn't ready.
+
+package external_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/plugins/sdk"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"github.com/immersa-co/relay-core/relay/version"
+)
+
+var (
+	Factory    externalPluginFactory
+	pluginName = "external-plugins"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const defaultTimeout = time.Second
+
+// ConfigPlugin is a plugin program listed in the 'plugins' option.
+type ConfigPlugin struct {
+	Name     string
+	Command  string
+	Args     []string
+	Env      map[string]string
+	Config   map[string]interface{}
+	Timeout  time.Duration // How long each request may take. If zero, 1s is used.
+	FailOpen bool          `yaml:"fail-open"` // Relay requests unchanged if the program fails.
+}
+
+type externalPluginFactory struct{}
+
+func (f externalPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f externalPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	var configPlugins []ConfigPlugin
+	if err := config.ParseOptional(configSection, "plugins", func(key string, value []ConfigPlugin) error {
+		names := map[string]bool{}
+		for _, configPlugin := range value {
+			if configPlugin.Name == "" {
+				return fmt.Errorf(`Every plugin must have a "name"`)
+			}
+			if names[configPlugin.Name] {
+				return fmt.Errorf(`Invalid name "%v": plugin names must be unique`, configPlugin.Name)
+			}
+			names[configPlugin.Name] = true
+			if configPlugin.Command == "" {
+				return fmt.Errorf(`Plugin "%v" must have a "command"`, configPlugin.Name)
+			}
+			if configPlugin.Timeout < 0 {
+				return fmt.Errorf(`Invalid timeout "%v" for plugin "%v": must be positive`, configPlugin.Timeout, configPlugin.Name)
+			}
+		}
+		configPlugins = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(configPlugins) == 0 {
+		return nil, nil
+	}
+
+	plugin := &externalPlugin{}
+	for _, configPlugin := range configPlugins {
+		program, err := startProgram(configPlugin)
+		if err != nil {
+			plugin.Close()
+			return nil, fmt.Errorf(`Error starting plugin "%v": %v`, configPlugin.Name, err)
+		}
+		plugin.programs = append(plugin.programs, program)
+		logger.Printf(`Added rule: run plugin "%v" (%v)`, configPlugin.Name, configPlugin.Command)
+	}
+	return plugin, nil
+}
+
+// program is a running plugin program.
+type program struct {
+	name     string
+	client   *sdk.Client
+	info     sdk.Info
+	timeout  time.Duration
+	failOpen bool
+}
+
+func startProgram(configPlugin ConfigPlugin) (*program, error) {
+	env := []string{}
+	for key, value := range configPlugin.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+
+	client, err := sdk.Start(sdk.StartOptions{
+		Command: configPlugin.Command,
+		Args:    configPlugin.Args,
+		Env:     env,
+		Output: func(line string) {
+			logger.Printf("%v: %v", configPlugin.Name, line)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sdk.DefaultStartTimeout)
+	defer cancel()
+	info, err := client.Configure(ctx, configPlugin.Config)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Error configuring: %v", err)
+	}
+
+	timeout := configPlugin.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &program{
+		name:     configPlugin.Name,
+		client:   client,
+		info:     info,
+		timeout:  timeout,
+		failOpen: configPlugin.FailOpen,
+	}, nil
+}
+
+type externalPlugin struct {
+	programs []*program
+	metrics  *metrics.PluginMetrics
+}
+
+func (plug *externalPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *externalPlugin) SetPluginMetrics(pluginMetrics *metrics.PluginMetrics) {
+	plug.metrics = pluginMetrics
+}
+
+// Ready implements traffic.ReadinessPlugin. The relay isn't ready while any
+// program has exited.
+func (plug *externalPlugin) Ready() error {
+	for _, program := range plug.programs {
+		if err := program.client.Exited(); err != nil {
+			return fmt.Errorf(`Plugin "%v": %v`, program.name, err)
+		}
+	}
+	return nil
+}
+
+// Version implements traffic.VersionedPlugin, by listing the versions which
+// the programs report.
+func (plug *externalPlugin) Version() string {
+	versions := []string{}
+	for _, program := range plug.programs {
+		if program.info.Version != "" {
+			versions = append(versions, program.name+" "+program.info.Version)
+		}
+	}
+	if len(versions) == 0 {
+		return version.RelayRelease
+	}
+	return strings.Join(versions, ", ")
+}
+
+// Close implements io.Closer, by stopping every program.
+func (plug *externalPlugin) Close() error {
+	for _, program := range plug.programs {
+		program.client.Close()
+	}
+	return nil
+}
+
+func (plug *externalPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	for _, program := range plug.programs {
+		if serviced := plug.handleRequest(program, response, request, info); serviced {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRequest sends a request to a program, and applies its response.
+func (plug *externalPlugin) handleRequest(
+	program *program,
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	fail := func(err error) bool {
+		plug.metrics.Error()
+		if program.failOpen {
+			logger.Errorf(`%s %s: plugin "%v" failed, relaying the request anyway: %v`, request.Method, request.URL.Path, program.name, err)
+			return false
+		}
+		logger.Errorf(`%s %s: plugin "%v" failed: %v`, request.Method, request.URL.Path, program.name, err)
+		http.Error(response, "Error in relay plugin", http.StatusBadGateway)
+		return true
+	}
+
+	pluginRequest := &sdk.Request{
+		Method:     request.Method,
+		URL:        request.URL.RequestURI(),
+		Host:       request.Host,
+		Header:     request.Header,
+		RemoteAddr: request.RemoteAddr,
+	}
+	if info.Tags != nil {
+		pluginRequest.Tags = info.Tags.List()
+	}
+	if program.info.WantsBody {
+		body, err := readBody(request)
+		if err != nil {
+			return fail(fmt.Errorf("Error reading request body: %v", err))
+		}
+		pluginRequest.Body = body
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), program.timeout)
+	defer cancel()
+	pluginResponse, err := program.client.HandleRequest(ctx, pluginRequest)
+	if err != nil {
+		return fail(err)
+	}
+
+	if respond := pluginResponse.Respond; respond != nil {
+		for name, values := range respond.Header {
+			response.Header()[name] = values
+		}
+		status := respond.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response.WriteHeader(status)
+		response.Write(respond.Body)
+		return true
+	}
+
+	if pluginResponse.URL != "" {
+		target, err := url.ParseRequestURI(pluginResponse.URL)
+		if err != nil {
+			return fail(fmt.Errorf(`Invalid URL "%v": %v`, pluginResponse.URL, err))
+		}
+		request.URL.Path = target.Path
+		request.URL.RawPath = target.RawPath
+		request.URL.RawQuery = target.RawQuery
+	}
+	if pluginResponse.Method != "" {
+		request.Method = pluginResponse.Method
+	}
+	if pluginResponse.Header != nil {
+		request.Header = pluginResponse.Header
+	}
+	if pluginResponse.ReplaceBody {
+		traffic.SetRequestBody(request, pluginResponse.Body)
+		plug.metrics.BodyModified()
+	}
+	if info.Tags != nil {
+		for _, tag := range pluginResponse.AddTags {
+			info.Tags.Add(tag)
+		}
+	}
+	return false
+}
+
+// readBody returns a request's body without consuming it. Bodies which the
+// relay has buffered are reopened; any other body is read into memory and
+// replaced.
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+	if body, ok := request.Body.(*traffic.BodyReader); ok {
+		reader := body.Reopen()
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	traffic.SetRequestBody(request, body)
+	return body, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,337 @@
+package external_plugin_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/plugins/sdk"
+	external_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/external-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// testProgramEnv is set when the test binary is run as a plugin program.
+const testProgramEnv = "EXTERNAL_PLUGIN_TEST_PROGRAM"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testProgramEnv) != "" {
+		sdk.Serve(&testProgram{})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testProgram is a plugin program which behaves as its 'behavior' option
+// says.
+type testProgram struct {
+	behavior string
+	value    string
+}
+
+func (program *testProgram) Configure(config map[string]interface{}) (sdk.Info, error) {
+	program.behavior, _ = config["behavior"].(string)
+	program.value, _ = config["value"].(string)
+	if program.behavior == "reject-config" {
+		return sdk.Info{}, fmt.Errorf("Invalid configuration")
+	}
+	return sdk.Info{Version: "1.2.3", WantsBody: program.behavior == "uppercase-body"}, nil
+}
+
+func (program *testProgram) HandleRequest(request *sdk.Request) (*sdk.Response, error) {
+	switch program.behavior {
+	case "modify":
+		header := request.Header.Clone()
+		header.Set("X-External", program.value)
+		return &sdk.Response{
+			URL:     strings.Replace(request.URL, "/old", "/new", 1),
+			Header:  header,
+			AddTags: []string{"external"},
+		}, nil
+	case "respond":
+		return &sdk.Response{Respond: &sdk.ClientResponse{
+			Status: http.StatusForbidden,
+			Header: http.Header{"X-Blocked-By": {"external"}},
+			Body:   []byte("blocked by plugin"),
+		}}, nil
+	case "uppercase-body":
+		return &sdk.Response{Body: []byte(strings.ToUpper(string(request.Body))), ReplaceBody: true}, nil
+	case "fail":
+		return nil, fmt.Errorf("Something went wrong")
+	case "slow":
+		time.Sleep(500 * time.Millisecond)
+		return nil, nil
+	case "exit":
+		os.Exit(3)
+	}
+	return nil, nil
+}
+
+// pluginConfig returns the configuration of an external-plugins section which
+// runs the test binary as each of the provided programs.
+func pluginConfig(t *testing.T, programs ...string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Error finding the test binary: %v", err)
+	}
+	configYaml := "relay:\n    debug-headers: true\nexternal-plugins:\n    plugins:\n"
+	for i, program := range programs {
+		configYaml += fmt.Sprintf("        - name: program-%d\n", i)
+		configYaml += fmt.Sprintf("          command: %q\n", executable)
+		configYaml += fmt.Sprintf("          env: {%v: 'true'}\n", testProgramEnv)
+		configYaml += program
+	}
+	return configYaml
+}
+
+func TestExternalPlugin(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		programs         []string
+		path             string
+		body             string
+		expectedStatus   int
+		expectedBody     string // Of the response, if the request isn't relayed.
+		expectedPath     string // Of the relayed request, or "" if it shouldn't be relayed.
+		expectedHeader   string // The X-External header of the relayed request.
+		expectedTarget   string // The body of the relayed request.
+		expectedTags     string
+		expectedResponse http.Header
+	}{
+		{
+			desc:           "Programs may modify requests and tag them",
+			programs:       []string{"          config: {behavior: modify, value: hello}\n"},
+			path:           "/old/path?page=2",
+			body:           "unchanged",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/new/path?page=2",
+			expectedHeader: "hello",
+			expectedTarget: "unchanged",
+			expectedTags:   "external",
+		},
+		{
+			desc:           "Programs may replace bodies",
+			programs:       []string{"          config: {behavior: uppercase-body}\n"},
+			path:           "/events",
+			body:           "quiet",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/events",
+			expectedTarget: "QUIET",
+		},
+		{
+			desc:             "Programs may respond instead of the target",
+			programs:         []string{"          config: {behavior: respond}\n"},
+			path:             "/events",
+			expectedStatus:   http.StatusForbidden,
+			expectedBody:     "blocked by plugin",
+			expectedResponse: http.Header{"X-Blocked-By": {"external"}},
+		},
+		{
+			desc: "Programs run in order",
+			programs: []string{
+				"          config: {behavior: modify, value: first}\n",
+				"          config: {behavior: uppercase-body}\n",
+			},
+			path:           "/old",
+			body:           "quiet",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/new",
+			expectedHeader: "first",
+			expectedTarget: "QUIET",
+			expectedTags:   "external",
+		},
+		{
+			desc:           "Requests which a program fails to handle aren't relayed",
+			programs:       []string{"          config: {behavior: fail}\n"},
+			path:           "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay plugin\n",
+		},
+		{
+			desc:           "Requests which a program takes too long to handle aren't relayed",
+			programs:       []string{"          timeout: 50ms\n          config: {behavior: slow}\n"},
+			path:           "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay plugin\n",
+		},
+		{
+			desc: "Programs which fail open let requests through",
+			programs: []string{
+				"          fail-open: true\n          config: {behavior: fail}\n",
+				"          config: {behavior: modify, value: after}\n",
+			},
+			path:           "/events",
+			body:           "unchanged",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/events",
+			expectedHeader: "after",
+			expectedTarget: "unchanged",
+			expectedTags:   "external",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		external_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, pluginConfig(t, testCase.programs...), plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			response, err := http.Post(relayService.HttpUrl()+testCase.path, "text/plain", strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			for name := range testCase.expectedResponse {
+				if value := response.Header.Get(name); value != testCase.expectedResponse.Get(name) {
+					t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, name, testCase.expectedResponse.Get(name), value)
+				}
+			}
+			if tags := response.Header.Get(traffic.DebugTagsHeaderName); tags != testCase.expectedTags {
+				t.Errorf("Test '%v': Expected tags '%v' but got '%v'", testCase.desc, testCase.expectedTags, tags)
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if testCase.expectedPath == "" {
+				if string(body) != testCase.expectedBody {
+					t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+				}
+				if err == nil {
+					t.Errorf("Test '%v': Expected the request not to be relayed", testCase.desc)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if path := lastRequest.URL.RequestURI(); path != testCase.expectedPath {
+				t.Errorf("Test '%v': Expected the request to be relayed to %v but got %v", testCase.desc, testCase.expectedPath, path)
+			}
+			if header := lastRequest.Header.Get("X-External"); header != testCase.expectedHeader {
+				t.Errorf("Test '%v': Expected X-External '%v' but got '%v'", testCase.desc, testCase.expectedHeader, header)
+			}
+			if targetBody, _ := io.ReadAll(lastRequest.Body); string(targetBody) != testCase.expectedTarget {
+				t.Errorf("Test '%v': Expected the target to receive %q but got %q", testCase.desc, testCase.expectedTarget, targetBody)
+			}
+		})
+	}
+}
+
+func TestExternalPluginExit(t *testing.T) {
+	configFile, err := config.NewFileFromYamlString(pluginConfig(t, "          config: {behavior: exit}\n"))
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := external_plugin.Factory.New(configFile.LookupOptionalSection("external-plugins"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+	defer plugin.(io.Closer).Close()
+
+	if version := plugin.(traffic.VersionedPlugin).Version(); version != "program-0 1.2.3" {
+		t.Errorf("Expected version 'program-0 1.2.3' but got '%v'", version)
+	}
+	if err := plugin.(traffic.ReadinessPlugin).Ready(); err != nil {
+		t.Errorf("Expected the plugin to be ready, but got %v", err)
+	}
+
+	request := httptest.NewRequest("GET", "http://relay/events", nil)
+	recorder := httptest.NewRecorder()
+	if serviced := plugin.HandleRequest(recorder, request, traffic.RequestInfo{}); !serviced || recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected a 502 once the program exited, but got %v", recorder.Code)
+	}
+
+	// The program's exit is noticed once it's been waited for.
+	var readyErr error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if readyErr = plugin.(traffic.ReadinessPlugin).Ready(); readyErr != nil {
+			break
+		}
+	}
+	if readyErr == nil {
+		t.Errorf("Expected the plugin not to be ready once its program exited")
+	}
+}
+
+func TestExternalPluginSocket(t *testing.T) {
+	tempDir := t.TempDir()
+	configYaml := pluginConfig(t, "")
+	configYaml = strings.Replace(configYaml, "'true'}", fmt.Sprintf("'true', TMPDIR: %q}", tempDir), 1)
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := external_plugin.Factory.New(configFile.LookupOptionalSection("external-plugins"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+
+	// The program serves on a unix socket in a directory only its user can
+	// access, which is removed once it stops.
+	dirs, _ := filepath.Glob(filepath.Join(tempDir, "relay-plugin-*"))
+	if len(dirs) != 1 {
+		t.Fatalf("Expected one socket directory but got %v", dirs)
+	}
+	if info, err := os.Stat(dirs[0]); err != nil {
+		t.Errorf("Error checking the socket directory: %v", err)
+	} else if mode := info.Mode().Perm(); mode != 0o700 {
+		t.Errorf("Expected the socket directory to have mode 0700 but got %o", mode)
+	}
+	if info, err := os.Stat(filepath.Join(dirs[0], "plugin.sock")); err != nil {
+		t.Errorf("Error checking the socket: %v", err)
+	} else if info.Mode().Type() != os.ModeSocket {
+		t.Errorf("Expected a socket but got mode %v", info.Mode())
+	}
+
+	plugin.(io.Closer).Close()
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket directory to be removed once the program stopped, but got %v", err)
+	}
+}
+
+func TestExternalPluginConfigValidation(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Error finding the test binary: %v", err)
+	}
+	program := fmt.Sprintf("command: %q, env: {%v: 'true'}", executable, testProgramEnv)
+
+	invalidConfigs := []string{
+		"plugins: {name: a}",
+		"plugins: [{" + program + "}]",
+		"plugins: [{name: a}]",
+		"plugins: [{name: a, " + program + "}, {name: a, " + program + "}]",
+		"plugins: [{name: a, timeout: -1s, " + program + "}]",
+		"plugins: [{name: a, timeout: soon, " + program + "}]",
+		"plugins: [{name: a, " + program + ", config: {behavior: reject-config}}]",
+		"plugins: [{name: a, command: /nonexistent/plugin}]",
+		// The test binary only serves a plugin if it's asked to.
+		fmt.Sprintf("plugins: [{name: a, command: %q, args: [-test.run=^$]}]", executable),
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("external-plugins:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := external_plugin.Factory.New(configFile.LookupOptionalSection("external-plugins")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
@@ -4,18 +4,17 @@ package headers_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var (
 	Factory    headersPluginFactory
 	pluginName = "headers"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type headersPluginFactory struct{}
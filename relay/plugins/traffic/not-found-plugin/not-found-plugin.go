@@ -0,0 +1,145 @@
+// This plugin configures how the relay handles requests which the target isn't
+// meant to see, such as the browser's automatic requests for /favicon.ico. By
+// default, every request is forwarded to the target. Files in a static asset
+// directory can instead be served directly by the relay, and requests whose
+// paths match a list of patterns can be answered with a 404. Since plugins can
+// be configured per virtual host and SNI route, so can this behavior.
+
+package not_found_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    notFoundPluginFactory
+	pluginName = "not-found"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+type notFoundPluginFactory struct{}
+
+func (f notFoundPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f notFoundPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &notFoundPlugin{}
+
+	if err := config.ParseOptional(configSection, "static-dir", func(key string, dir string) error {
+		if info, err := os.Stat(dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf(`Static asset directory "%v" is not a directory`, dir)
+		}
+		logger.Printf(`Serving static assets from "%s"`, dir)
+		plugin.staticDir = http.Dir(dir)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			logger.Printf(`Added rule: respond to "%s" with 404`, match)
+			plugin.notFoundPaths = append(plugin.notFoundPaths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if plugin.staticDir == nil && len(plugin.notFoundPaths) == 0 {
+		return nil, nil
+	}
+
+	return plugin, nil
+}
+
+type notFoundPlugin struct {
+	staticDir     http.FileSystem  // If non-nil, files here are served instead of being forwarded.
+	notFoundPaths []*regexp.Regexp // Requests matching these are answered with a 404.
+}
+
+func (plug *notFoundPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *notFoundPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	// Match against the path the client requested, before other plugins had a
+	// chance to rewrite it.
+	path := info.OriginalURL.Path
+
+	if plug.staticDir != nil && (request.Method == http.MethodGet || request.Method == http.MethodHead) {
+		if plug.serveStaticFile(response, request, path) {
+			return true
+		}
+	}
+
+	for _, match := range plug.notFoundPaths {
+		if match.MatchString(path) {
+			http.NotFound(response, request)
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveStaticFile serves the file at path in the static asset directory, if
+// there is one. It returns false if there isn't, so that the request can be
+// forwarded.
+func (plug *notFoundPlugin) serveStaticFile(response http.ResponseWriter, request *http.Request, path string) bool {
+	// http.Dir rejects paths which would escape the directory.
+	file, err := plug.staticDir.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || !fileInfo.Mode().IsRegular() {
+		return false
+	}
+
+	http.ServeContent(response, request, fileInfo.Name(), fileInfo.ModTime(), file)
+	return true
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,178 @@
+package not_found_plugin_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	not_found_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/not-found-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestNotFoundPlugin(t *testing.T) {
+	staticDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(staticDir, "robots.txt"), []byte("User-agent: *"), 0644); err != nil {
+		t.Fatalf("Error writing static asset: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(staticDir, "assets"), 0755); err != nil {
+		t.Fatalf("Error creating static asset directory: %v", err)
+	}
+
+	configYaml := fmt.Sprintf(`not-found:
+    static-dir: %v
+    paths:
+        - ^/wp-admin(/|$)
+        - \.php$
+`, staticDir)
+
+	testCases := []struct {
+		desc             string
+		config           string
+		method           string
+		path             string
+		expectedStatus   int
+		expectedResponse string // If set, the request shouldn't be forwarded.
+	}{
+		{
+			desc:           "Everything is forwarded by default",
+			config:         "",
+			method:         "GET",
+			path:           "/robots.txt",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:             "Static assets are served by the relay",
+			config:           configYaml,
+			method:           "GET",
+			path:             "/robots.txt",
+			expectedStatus:   http.StatusOK,
+			expectedResponse: "User-agent: *",
+		},
+		{
+			desc:           "Only GET and HEAD requests are served from static assets",
+			config:         configYaml,
+			method:         "POST",
+			path:           "/robots.txt",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Missing static assets are forwarded",
+			config:         configYaml,
+			method:         "GET",
+			path:           "/sitemap.xml",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Directories aren't served",
+			config:         configYaml,
+			method:         "GET",
+			path:           "/assets/",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:             "Matching paths receive a 404",
+			config:           configYaml,
+			method:           "GET",
+			path:             "/wp-admin/setup.php",
+			expectedStatus:   http.StatusNotFound,
+			expectedResponse: "404 page not found\n",
+		},
+		{
+			desc:           "Paths must match a pattern to receive a 404",
+			config:         configYaml,
+			method:         "GET",
+			path:           "/wp-administrators",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		not_found_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response: %v", testCase.desc, err)
+				return
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if testCase.expectedResponse != "" {
+				if string(body) != testCase.expectedResponse {
+					t.Errorf("Test '%v': Expected response %q but got %q", testCase.desc, testCase.expectedResponse, body)
+				}
+				if err == nil {
+					t.Errorf("Test '%v': Expected the request not to be forwarded, but the catcher saw %v", testCase.desc, lastRequest.URL)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+			} else if lastRequest.URL.Path != testCase.path {
+				t.Errorf("Test '%v': Expected the catcher to see %v but got %v", testCase.desc, testCase.path, lastRequest.URL.Path)
+			}
+		})
+	}
+}
+
+func TestNotFoundConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"static-dir: /nonexistent/relay-static",
+		"static-dir: /dev/null",
+		"paths: ['(']",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("not-found:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := not_found_plugin.Factory.New(configFile.LookupOptionalSection("not-found")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
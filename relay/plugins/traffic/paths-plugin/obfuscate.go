@@ -0,0 +1,177 @@
+package paths_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/tokenize"
+)
+
+// The kinds of path segment which can be obfuscated.
+const (
+	idKindNumeric = "numeric"
+	idKindUUID    = "uuid"
+)
+
+const defaultTokenPrefix = "id_"
+
+var (
+	numericPattern = regexp.MustCompile(`^[0-9]+$`)
+	uuidPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// idObfuscator replaces ID-like path segments with tokens derived from an HMAC
+// of the ID, so the target never learns real resource IDs. The same ID always
+// produces the same token, so the target can still tell resources apart. The
+// IDs behind recent tokens are remembered in memory, and can be looked up via
+// the detokenization endpoint; see the tokenize package.
+type idObfuscator struct {
+	patterns []*regexp.Regexp // The patterns of the segments to obfuscate.
+	paths    []*regexp.Regexp // If non-empty, only paths matching one of these are obfuscated.
+	vault    *tokenize.Vault
+}
+
+// readObfuscator reads the ID obfuscation options, returning nil if
+// obfuscation isn't enabled.
+func readObfuscator(configSection *config.Section) (*idObfuscator, error) {
+	kinds, err := config.LookupOptional[[]string](configSection, "obfuscate-ids")
+	if err != nil {
+		return nil, err
+	} else if kinds == nil || len(*kinds) == 0 {
+		return nil, nil
+	}
+
+	obfuscator := &idObfuscator{}
+	for _, kind := range *kinds {
+		switch kind {
+		case idKindNumeric:
+			obfuscator.patterns = append(obfuscator.patterns, numericPattern)
+		case idKindUUID:
+			obfuscator.patterns = append(obfuscator.patterns, uuidPattern)
+		default:
+			return nil, fmt.Errorf(`Invalid ID kind "%v" in option "obfuscate-ids": must be "%v" or "%v"`, kind, idKindNumeric, idKindUUID)
+		}
+	}
+
+	tokenOptions := &tokenize.Options{Prefix: defaultTokenPrefix}
+	if tokenOptions.Key, err = secrets.Lookup(configSection, "obfuscation-key"); err != nil {
+		return nil, err
+	} else if tokenOptions.Key == nil {
+		return nil, fmt.Errorf(`Option "obfuscate-ids" requires "obfuscation-key" or "obfuscation-key-file"`)
+	}
+	if tokenOptions.DetokenizeToken, err = secrets.Lookup(configSection, "detokenize-token"); err != nil {
+		return nil, err
+	}
+
+	if prefix, err := config.LookupOptional[string](configSection, "obfuscation-prefix"); err != nil {
+		return nil, err
+	} else if prefix != nil {
+		if *prefix != url.PathEscape(*prefix) {
+			return nil, fmt.Errorf(`Invalid obfuscation-prefix "%v": must not need escaping in a URL path`, *prefix)
+		}
+		tokenOptions.Prefix = *prefix
+	}
+
+	if err := config.ParseOptional(configSection, "obfuscation-paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			obfuscator.paths = append(obfuscator.paths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	maxTokens := tokenize.DefaultMaxTokens
+	if value, err := config.LookupOptional[int](configSection, "max-tokens"); err != nil {
+		return nil, err
+	} else if value != nil {
+		if *value < 1 {
+			return nil, fmt.Errorf(`Invalid max-tokens "%v": must be at least 1`, *value)
+		}
+		maxTokens = *value
+	}
+	tokenOptions.Store = tokenize.NewMemoryStore(maxTokens)
+	obfuscator.vault = tokenize.NewVault(tokenOptions)
+
+	logger.Printf(`Added rule: obfuscate %v path segments with tokens prefixed by "%v"`, strings.Join(*kinds, " and "), tokenOptions.Prefix)
+	return obfuscator, nil
+}
+
+// obfuscate replaces the ID-like segments of the request's path with tokens.
+func (obfuscator *idObfuscator) obfuscate(request *http.Request) {
+	if len(obfuscator.paths) > 0 && !matchesAny(obfuscator.paths, request.URL.Path) {
+		return
+	}
+
+	// Segments are replaced in the escaped path, so that the encoding of the
+	// rest of the path is preserved.
+	segments := strings.Split(request.URL.EscapedPath(), "/")
+	modified := false
+	for i, segment := range segments {
+		if !matchesAny(obfuscator.patterns, segment) {
+			continue
+		}
+		token, err := obfuscator.vault.Tokenize([]byte(segment))
+		if err != nil {
+			logger.Errorf("Error obfuscating path segment: %v", err)
+			continue
+		}
+		segments[i] = token
+		modified = true
+	}
+	if !modified {
+		return
+	}
+
+	escapedPath := strings.Join(segments, "/")
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		logger.Errorf("Error obfuscating path: %v", err)
+		return
+	}
+	request.URL.Path = path
+	request.URL.RawPath = escapedPath
+}
+
+// AdminHandler implements traffic.AdminPlugin, serving the detokenization
+// endpoint.
+func (obfuscator *idObfuscator) AdminHandler() http.Handler {
+	return obfuscator.vault.Handler()
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -1,25 +1,30 @@
 // This plugin watches incoming traffic and optionally rewrites request URL
 // paths. The most common use is to remove or rewrite a path prefix.
+//
+// It can also replace numeric or UUID path segments with opaque tokens, for
+// targets which must not learn real resource IDs; see obfuscate.go.
+//
+// In test mode, the plugin logs how it would rewrite each request, but relays
+// requests unchanged, so that new rules can be tried out safely.
 
 package paths_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var (
 	Factory    pathsPluginFactory
 	pluginName = "paths"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type ConfigRouteRule struct {
@@ -78,10 +83,23 @@ func (f pathsPluginFactory) New(configSection *config.Section) (traffic.Plugin,
 		return nil, err
 	}
 
-	if len(plugin.rules) == 0 {
+	obfuscator, err := readObfuscator(configSection)
+	if err != nil {
+		return nil, err
+	}
+	plugin.obfuscator = obfuscator
+
+	if len(plugin.rules) == 0 && plugin.obfuscator == nil {
 		return nil, nil
 	}
 
+	if testMode, err := config.LookupOptional[bool](configSection, "test-mode"); err != nil {
+		return nil, err
+	} else if testMode != nil && *testMode {
+		plugin.testMode = true
+		logger.Printf("Test mode: rewrites will be logged but not applied")
+	}
+
 	return plugin, nil
 }
 
@@ -150,7 +168,9 @@ func (f pathsPluginFactory) addSpecialsRule(
 }
 
 type pathsPlugin struct {
-	rules []*pathRule
+	rules      []*pathRule
+	obfuscator *idObfuscator // If non-nil, ID-like path segments are replaced with tokens.
+	testMode   bool          // If true, the rules' rewrites are logged but not applied.
 }
 
 type pathRule struct {
@@ -190,11 +210,43 @@ func (plug pathsPlugin) HandleRequest(
 		return false
 	}
 
+	if plug.testMode {
+		// Route a copy of the request, so the decisions can be logged
+		// without changing where it's relayed.
+		preview := *request
+		previewURL := *request.URL
+		preview.URL = &previewURL
+		plug.route(&preview, true)
+		if preview.URL.String() != request.URL.String() {
+			logger.Printf("Test mode: %v %v would be relayed to %v", request.Method, request.URL, preview.URL)
+		} else {
+			logger.Printf("Test mode: %v %v matched no rules", request.Method, request.URL)
+		}
+	} else {
+		plug.route(request, false)
+	}
+
+	// IDs are obfuscated after the rules are applied, so that rules can still
+	// match them, and IDs which the rules move into the path are obfuscated
+	// too. Test mode only affects the rules: IDs are always obfuscated.
+	if plug.obfuscator != nil {
+		plug.obfuscator.obfuscate(request)
+	}
+	return false
+}
+
+// route applies the rules to the request's URL in order, each to the result
+// of the last. If logDecisions is true, each rule which matches is logged.
+func (plug pathsPlugin) route(request *http.Request, logDecisions bool) {
 	for _, rule := range plug.rules {
 		switch rule.target {
 		case pathTarget:
 			// If there's a match, replace the requested URL's path.
-			request.URL.Path = rule.match.ReplaceAllString(request.URL.Path, rule.replacement)
+			path := rule.match.ReplaceAllString(request.URL.Path, rule.replacement)
+			if logDecisions && rule.match.MatchString(request.URL.Path) {
+				logger.Printf(`Test mode: rule "%s" rewrites path "%v" to "%v"`, rule.match, request.URL.Path, path)
+			}
+			request.URL.Path = path
 
 		case urlTarget:
 			// If the rule matches the requested URL's path...
@@ -208,8 +260,11 @@ func (plug pathsPlugin) HandleRequest(
 			urlVal := rule.match.ReplaceAllString(request.URL.Path, rule.replacement)
 			newURL, err := url.Parse(urlVal)
 			if err != nil {
-				logger.Printf("Failed to create URL for path rule %v: %v", rule.match, err)
+				logger.Errorf("Failed to create URL for path rule %v: %v", rule.match, err)
 			} else {
+				if logDecisions {
+					logger.Printf(`Test mode: rule "%s" routes path "%v" to URL "%v"`, rule.match, request.URL.Path, urlVal)
+				}
 				request.URL.Scheme = newURL.Scheme
 				request.URL.Host = newURL.Host
 				request.Host = newURL.Host
@@ -217,8 +272,15 @@ func (plug pathsPlugin) HandleRequest(
 			}
 		}
 	}
+}
 
-	return false
+// AdminHandler implements traffic.AdminPlugin. If IDs are obfuscated, it
+// serves the detokenization endpoint at tokenize.DetokenizePath.
+func (plug pathsPlugin) AdminHandler() http.Handler {
+	if plug.obfuscator == nil {
+		return http.NotFoundHandler()
+	}
+	return plug.obfuscator.AdminHandler()
 }
 
 /*
@@ -1,14 +1,20 @@
 package paths_plugin_test
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/immersa-co/relay-core/catcher"
 	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
 	paths_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/paths-plugin"
 	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/tokenize"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
@@ -88,6 +94,39 @@ func TestPathRewriting(t *testing.T) {
 			originalUrl: `${RELAY_HTTP_URL}/football/baz`,
 			expectedUrl: `${TARGET_HTTP_URL}/xyz/tball/baz`,
 		},
+		{
+			desc: "Whole paths can be rewritten using capture groups",
+			config: `paths:
+                        routes:
+                          - path: '^/v1/(.*)$'
+                            target-path: '/api/v1/$1'
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/v1/users/42?x=y`,
+			expectedUrl: `${TARGET_HTTP_URL}/api/v1/users/42?x=y`,
+		},
+		{
+			desc: "Each route rewrites the result of the last",
+			config: `paths:
+                        routes:
+                          - path: '^/v1/(.*)$'
+                            target-path: '/api/v1/$1'
+                          - path: '^/api/v1/legacy/([a-z]+)$'
+                            target-path: '/api/v2/${1}s'
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/v1/legacy/user`,
+			expectedUrl: `${TARGET_HTTP_URL}/api/v2/users`,
+		},
+		{
+			desc: "Rewrites aren't applied in test mode",
+			config: `paths:
+                        test-mode: true
+                        routes:
+                          - path: '^/v1/(.*)$'
+                            target-path: '/api/v1/$1'
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/v1/users/42`,
+			expectedUrl: `${TARGET_HTTP_URL}/v1/users/42`,
+		},
 		{
 			desc: "TRAFFIC_PATHS_* variables work",
 			config: `paths:
@@ -223,6 +262,153 @@ func TestPathRewritingToFullUrl(t *testing.T) {
 	}
 }
 
+func TestIdObfuscation(t *testing.T) {
+	configYaml := `paths:
+                     obfuscate-ids: [numeric, uuid]
+                     obfuscation-key: test-key
+                     obfuscation-paths: ['^/users/']
+    `
+	plugins := []traffic.PluginFactory{paths_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+			t.Errorf("Error starting admin listener: %v", err)
+			return
+		}
+
+		testCases := []struct {
+			desc         string
+			path         string
+			expectedPath *regexp.Regexp
+			expectedIDs  []string
+		}{
+			{
+				desc:         "Numeric and UUID segments are replaced",
+				path:         "/users/12345/orders/0f8fad5b-d9cb-469f-a165-70867728950e/items",
+				expectedPath: regexp.MustCompile(`^/users/(id_[a-z2-7]{24})/orders/(id_[a-z2-7]{24})/items$`),
+				expectedIDs:  []string{"12345", "0f8fad5b-d9cb-469f-a165-70867728950e"},
+			},
+			{
+				desc:         "Other segments are preserved",
+				path:         "/users/abc123/a%2Fb/42",
+				expectedPath: regexp.MustCompile(`^/users/abc123/a%2Fb/(id_[a-z2-7]{24})$`),
+				expectedIDs:  []string{"42"},
+			},
+			{
+				desc:         "Paths which don't match aren't changed",
+				path:         "/orders/12345",
+				expectedPath: regexp.MustCompile(`^/orders/12345$`),
+			},
+		}
+
+		tokens := map[string]string{}
+		for _, testCase := range testCases {
+			response, err := http.Get(relayService.HttpUrl() + testCase.path)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				continue
+			}
+			match := testCase.expectedPath.FindStringSubmatch(lastRequest.URL.EscapedPath())
+			if match == nil {
+				t.Errorf("Test '%v': Expected path matching '%v' but got '%v'", testCase.desc, testCase.expectedPath, lastRequest.URL.EscapedPath())
+				continue
+			}
+			for i, id := range testCase.expectedIDs {
+				tokens[match[i+1]] = id
+			}
+		}
+
+		// The same ID always produces the same token.
+		if response, err := http.Get(relayService.HttpUrl() + "/users/12345"); err != nil {
+			t.Errorf("Error GETing: %v", err)
+		} else {
+			response.Body.Close()
+		}
+		if lastRequest, err := catcherService.LastRequest(); err != nil {
+			t.Errorf("Error reading last request from catcher: %v", err)
+		} else if token := strings.TrimPrefix(lastRequest.URL.Path, "/users/"); tokens[token] != "12345" {
+			t.Errorf("Expected ID 12345 to produce the same token but got '%v'", token)
+		}
+
+		query := url.Values{"token": {"id_unknown"}}
+		for token := range tokens {
+			query.Add("token", token)
+		}
+		response, err := http.Get(relayService.AdminUrl() + relay.PluginAdminPath("paths") + tokenize.DetokenizePath + "?" + query.Encode())
+		if err != nil {
+			t.Errorf("Error GETing detokenized IDs: %v", err)
+			return
+		}
+		defer response.Body.Close()
+		ids := map[string]string{}
+		if err := json.NewDecoder(response.Body).Decode(&ids); err != nil {
+			t.Errorf("Error decoding detokenized IDs: %v", err)
+		} else if !reflect.DeepEqual(ids, tokens) {
+			t.Errorf("Expected detokenized IDs %v but got %v", tokens, ids)
+		}
+	})
+}
+
+func TestIdObfuscationInTestMode(t *testing.T) {
+	configYaml := `paths:
+                     test-mode: true
+                     routes:
+                       - path: '^/v1/(.*)$'
+                         target-path: '/api/v1/$1'
+                     obfuscate-ids: [numeric]
+                     obfuscation-key: test-key
+    `
+	plugins := []traffic.PluginFactory{paths_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl() + "/v1/users/12345")
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		response.Body.Close()
+
+		lastRequest, err := catcherService.LastRequest()
+		if err != nil {
+			t.Errorf("Error reading last request from catcher: %v", err)
+			return
+		}
+		// The route isn't applied, but the ID is still obfuscated.
+		expectedPath := regexp.MustCompile(`^/v1/users/id_[a-z2-7]{24}$`)
+		if !expectedPath.MatchString(lastRequest.URL.Path) {
+			t.Errorf("Expected path matching '%v' but got '%v'", expectedPath, lastRequest.URL.Path)
+		}
+	})
+}
+
+func TestIdObfuscationConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"obfuscate-ids: [numeric]",
+		"obfuscate-ids: [emails]\n    obfuscation-key: k",
+		"obfuscate-ids: [uuid]\n    obfuscation-key: k\n    obfuscation-prefix: 'a/b'",
+		"obfuscate-ids: [uuid]\n    obfuscation-key: k\n    obfuscation-paths: ['(']",
+		"obfuscate-ids: [uuid]\n    obfuscation-key: k\n    max-tokens: 0",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("paths:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := paths_plugin.Factory.New(configFile.LookupOptionalSection("paths")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
 type pathsPluginTestCase struct {
 	desc        string
 	config      string
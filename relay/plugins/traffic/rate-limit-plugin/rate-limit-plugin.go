@@ -0,0 +1,207 @@
+// This plugin limits the rate at which each client may send requests, using a
+// token bucket per client. Each client's bucket holds up to 'burst' tokens and
+// refills at 'requests-per-second'; every request takes a token, and requests
+// which find the bucket empty are rejected with a 429 and a Retry-After header
+// instead of being relayed. Clients are identified by their IP address, or by
+// the value of a configured header, like an API key.
+
+package rate_limit_plugin
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    rateLimitPluginFactory
+	pluginName = "rate-limit"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// sweepInterval is how often buckets which have refilled completely are
+// discarded. A full bucket is indistinguishable from a new one, so this bounds
+// memory use without affecting any client's limit.
+const sweepInterval = time.Minute
+
+type rateLimitPluginFactory struct{}
+
+func (f rateLimitPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f rateLimitPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &rateLimitPlugin{
+		buckets: map[string]*bucket{},
+		clock:   clock.Real,
+	}
+
+	if rate, err := config.LookupOptional[float64](configSection, "requests-per-second"); err != nil {
+		return nil, err
+	} else if rate == nil {
+		return nil, nil
+	} else if *rate <= 0 {
+		return nil, fmt.Errorf(`Invalid requests-per-second "%v": must be positive`, *rate)
+	} else {
+		plugin.rate = *rate
+	}
+
+	// By default, clients may send a second's worth of requests at once.
+	plugin.burst = math.Max(1, math.Ceil(plugin.rate))
+	if burst, err := config.LookupOptional[int](configSection, "burst"); err != nil {
+		return nil, err
+	} else if burst != nil {
+		if *burst < 1 {
+			return nil, fmt.Errorf(`Invalid burst "%v": must be at least 1`, *burst)
+		}
+		plugin.burst = float64(*burst)
+	}
+
+	if keyHeader, err := config.LookupOptional[string](configSection, "key-header"); err != nil {
+		return nil, err
+	} else if keyHeader != nil {
+		plugin.keyHeader = http.CanonicalHeaderKey(*keyHeader)
+	}
+
+	if plugin.keyHeader != "" {
+		logger.Printf(`Added rule: limit each "%s" to %v requests per second, with bursts of %v`, plugin.keyHeader, plugin.rate, plugin.burst)
+	} else {
+		logger.Printf(`Added rule: limit each client IP to %v requests per second, with bursts of %v`, plugin.rate, plugin.burst)
+	}
+
+	return plugin, nil
+}
+
+type rateLimitPlugin struct {
+	rate      float64 // Tokens added to each bucket per second.
+	burst     float64 // The capacity of each bucket.
+	keyHeader string  // If set, clients are identified by this header rather than their IP.
+	clock     clock.Clock
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket is a client's token bucket. Rather than being refilled continuously,
+// it's refilled lazily, based on the time since it was last updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (plug *rateLimitPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *rateLimitPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *rateLimitPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	allowed, retryAfter := plug.take(plug.clientKey(request))
+	if allowed {
+		return false
+	}
+
+	response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(response, "Too many requests", http.StatusTooManyRequests)
+	return true
+}
+
+// clientKey identifies the client which sent a request. Requests without the
+// configured key header are identified by their IP instead.
+func (plug *rateLimitPlugin) clientKey(request *http.Request) string {
+	if plug.keyHeader != "" {
+		if value := request.Header.Get(plug.keyHeader); value != "" {
+			return "header:" + value
+		}
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + request.RemoteAddr
+}
+
+// take removes a token from the client's bucket. If the bucket is empty, it
+// returns false, along with how long the client must wait for a token.
+func (plug *rateLimitPlugin) take(key string) (bool, time.Duration) {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+
+	now := plug.clock.Now()
+	if now.Sub(plug.lastSweep) >= sweepInterval {
+		plug.sweep(now)
+	}
+
+	clientBucket := plug.buckets[key]
+	if clientBucket == nil {
+		clientBucket = &bucket{tokens: plug.burst, updated: now}
+		plug.buckets[key] = clientBucket
+	} else {
+		plug.refill(clientBucket, now)
+	}
+
+	if clientBucket.tokens < 1 {
+		return false, time.Duration((1 - clientBucket.tokens) / plug.rate * float64(time.Second))
+	}
+	clientBucket.tokens--
+	return true, 0
+}
+
+// refill adds the tokens a bucket has accumulated since it was last updated.
+func (plug *rateLimitPlugin) refill(clientBucket *bucket, now time.Time) {
+	if elapsed := now.Sub(clientBucket.updated); elapsed > 0 {
+		clientBucket.tokens = math.Min(plug.burst, clientBucket.tokens+elapsed.Seconds()*plug.rate)
+		clientBucket.updated = now
+	}
+}
+
+// sweep discards buckets which have refilled completely. It must be called
+// with the mutex held.
+func (plug *rateLimitPlugin) sweep(now time.Time) {
+	for key, clientBucket := range plug.buckets {
+		plug.refill(clientBucket, now)
+		if clientBucket.tokens >= plug.burst {
+			delete(plug.buckets, key)
+		}
+	}
+	plug.lastSweep = now
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,178 @@
+package rate_limit_plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	rate_limit_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/rate-limit-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type rateLimitStep struct {
+	advance            time.Duration // How long to wait before sending the request.
+	apiKey             string
+	expectedStatus     int
+	expectedRetryAfter string
+}
+
+func TestRateLimitPlugin(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+		steps  []rateLimitStep
+	}{
+		{
+			desc: "Bursts are allowed up to the limit",
+			config: `rate-limit:
+    requests-per-second: 1
+    burst: 2
+`,
+			steps: []rateLimitStep{
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{advance: 500 * time.Millisecond, expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{advance: 500 * time.Millisecond, expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+			},
+		},
+		{
+			desc: "Buckets refill up to the burst size",
+			config: `rate-limit:
+    requests-per-second: 10
+`,
+			steps: []rateLimitStep{
+				{advance: time.Hour, expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{advance: 100 * time.Millisecond, expectedStatus: http.StatusOK},
+			},
+		},
+		{
+			desc: "Slow rates produce long retry intervals",
+			config: `rate-limit:
+    requests-per-second: 0.1
+`,
+			steps: []rateLimitStep{
+				{expectedStatus: http.StatusOK},
+				{advance: 2 * time.Second, expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "8"},
+				{advance: 8 * time.Second, expectedStatus: http.StatusOK},
+			},
+		},
+		{
+			desc: "Clients can be identified by a header",
+			config: `rate-limit:
+    requests-per-second: 1
+    burst: 1
+    key-header: X-Api-Key
+`,
+			steps: []rateLimitStep{
+				{apiKey: "a", expectedStatus: http.StatusOK},
+				{apiKey: "a", expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{apiKey: "b", expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusOK},
+				{expectedStatus: http.StatusTooManyRequests, expectedRetryAfter: "1"},
+				{advance: 2 * time.Minute, apiKey: "a", expectedStatus: http.StatusOK},
+			},
+		},
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := rate_limit_plugin.Factory.New(configFile.LookupOptionalSection("rate-limit"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+
+		fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		options.Clock = fakeClock
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+
+		for i, step := range testCase.steps {
+			fakeClock.Advance(step.advance)
+			request, _ := http.NewRequest("GET", relayServer.URL, nil)
+			if step.apiKey != "" {
+				request.Header.Set("X-Api-Key", step.apiKey)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Step %v: Error GETing: %v", testCase.desc, i, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != step.expectedStatus {
+				t.Errorf("Test '%v': Step %v: Expected status %v but got %v", testCase.desc, i, step.expectedStatus, response.StatusCode)
+			}
+			if retryAfter := response.Header.Get("Retry-After"); retryAfter != step.expectedRetryAfter {
+				t.Errorf("Test '%v': Step %v: Expected Retry-After '%v' but got '%v'", testCase.desc, i, step.expectedRetryAfter, retryAfter)
+			}
+		}
+
+		relayServer.Close()
+	}
+}
+
+func TestRateLimitConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"requests-per-second: 0",
+		"requests-per-second: -1",
+		"requests-per-second: fast",
+		"requests-per-second: 1\n    burst: 0",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("rate-limit:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := rate_limit_plugin.Factory.New(configFile.LookupOptionalSection("rate-limit")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
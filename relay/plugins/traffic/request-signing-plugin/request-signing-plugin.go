@@ -0,0 +1,244 @@
+// This plugin signs relayed requests with an HMAC, so that targets which
+// require signed requests can authenticate the relay. The signature covers the
+// request's method, its path and query, a timestamp, and its body, and is sent
+// in a header along with the timestamp; targets compute the same HMAC with
+// their copy of the key and reject requests whose signatures don't match, or
+// whose timestamps are too old.
+//
+// The string which is signed is:
+//
+//	METHOD "\n" PATH-AND-QUERY "\n" TIMESTAMP "\n" BODY
+//
+// where the timestamp is in Unix seconds, and the body is the one which the
+// target receives once it has undone any Content-Encoding. The signature is
+// sent hex-encoded. The key is read via the secrets package, so it can be
+// supplied in a file and rotated.
+//
+// Requests are signed after every other plugin has modified them, including
+// body encryption, so the signature covers what the target receives. The
+// aggregate and batch-split plugins send bodies other than the ones which were
+// signed, so their requests can't be verified.
+
+package request_signing_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    requestSigningPluginFactory
+	pluginName = "sign-request"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	defaultAlgorithm       = "hmac-sha256"
+	defaultSignatureHeader = "X-Relay-Signature"
+	defaultTimestampHeader = "X-Relay-Timestamp"
+)
+
+// algorithms are the supported HMAC algorithms, by name.
+var algorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+// keyDecoders decode keys in each of the supported encodings.
+var keyDecoders = map[string]func(string) ([]byte, error){
+	"text":   func(key string) ([]byte, error) { return []byte(key), nil },
+	"hex":    hex.DecodeString,
+	"base64": base64.StdEncoding.DecodeString,
+}
+
+type requestSigningPluginFactory struct{}
+
+func (f requestSigningPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f requestSigningPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	key, err := secrets.Lookup(configSection, "key")
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &requestSigningPlugin{
+		key:             key,
+		algorithm:       defaultAlgorithm,
+		keyEncoding:     "text",
+		signatureHeader: defaultSignatureHeader,
+		timestampHeader: defaultTimestampHeader,
+		clock:           clock.Real,
+	}
+
+	if algorithm, err := config.LookupOptional[string](configSection, "algorithm"); err != nil {
+		return nil, err
+	} else if algorithm != nil {
+		if algorithms[*algorithm] == nil {
+			return nil, fmt.Errorf(`Unsupported algorithm "%v"; expected "hmac-sha256", "hmac-sha384", or "hmac-sha512"`, *algorithm)
+		}
+		plugin.algorithm = *algorithm
+	}
+	if keyEncoding, err := config.LookupOptional[string](configSection, "key-encoding"); err != nil {
+		return nil, err
+	} else if keyEncoding != nil {
+		if keyDecoders[*keyEncoding] == nil {
+			return nil, fmt.Errorf(`Unsupported key-encoding "%v"; expected "text", "hex", or "base64"`, *keyEncoding)
+		}
+		plugin.keyEncoding = *keyEncoding
+	}
+	if signatureHeader, err := config.LookupOptional[string](configSection, "signature-header"); err != nil {
+		return nil, err
+	} else if signatureHeader != nil {
+		plugin.signatureHeader = http.CanonicalHeaderKey(*signatureHeader)
+	}
+	if timestampHeader, err := config.LookupOptional[string](configSection, "timestamp-header"); err != nil {
+		return nil, err
+	} else if timestampHeader != nil {
+		plugin.timestampHeader = http.CanonicalHeaderKey(*timestampHeader)
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+	// Check the key now, so that a misconfigured key is reported at startup.
+	if _, err := plugin.keyBytes(); err != nil {
+		return nil, err
+	}
+
+	logger.Printf(`Signing requests with %v (%v) in "%v"`, plugin.algorithm, key, plugin.signatureHeader)
+	return plugin, nil
+}
+
+type requestSigningPlugin struct {
+	key             *secrets.Secret
+	algorithm       string // A key of algorithms.
+	keyEncoding     string // A key of keyDecoders.
+	signatureHeader string
+	timestampHeader string
+	clock           clock.Clock
+	metrics         *metrics.PluginMetrics
+}
+
+func (plug *requestSigningPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *requestSigningPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *requestSigningPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+func (plug *requestSigningPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	key, err := plug.keyBytes()
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error reading signing key: %v", err)
+		http.Error(response, "Request signing key unavailable", http.StatusBadGateway)
+		return true
+	}
+
+	timestamp := strconv.FormatInt(plug.clock.Now().Unix(), 10)
+	mac := hmac.New(algorithms[plug.algorithm], key)
+	io.WriteString(mac, request.Method+"\n"+request.URL.RequestURI()+"\n"+timestamp+"\n")
+	if err := writeBody(mac, request); err != nil {
+		plug.metrics.Error()
+		logger.Errorf("Error reading request body: %v", err)
+		http.Error(response, fmt.Sprintf("Error reading request body: %v", err), http.StatusInternalServerError)
+		request.Body = http.NoBody
+		return true
+	}
+
+	// Any signature the client sent is replaced.
+	request.Header.Set(plug.timestampHeader, timestamp)
+	request.Header.Set(plug.signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return false
+}
+
+// keyBytes returns the current value of the key, decoded.
+func (plug *requestSigningPlugin) keyBytes() ([]byte, error) {
+	value, err := plug.key.Value()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyDecoders[plug.keyEncoding](value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v signing key: %v", plug.keyEncoding, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Signing key is empty")
+	}
+	return key, nil
+}
+
+// writeBody writes a request's body to w without consuming it. Bodies which
+// the relay has buffered are reopened; any other body is read into memory and
+// replaced.
+func writeBody(w io.Writer, request *http.Request) error {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+	if body, ok := request.Body.(*traffic.BodyReader); ok {
+		reader := body.Reopen()
+		defer reader.Close()
+		_, err := io.Copy(w, reader)
+		return err
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	traffic.SetRequestBody(request, body)
+	_, err = w.Write(body)
+	return err
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,168 @@
+package request_signing_plugin_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	request_signing_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/request-signing-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestRequestSigningPlugin(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("6b6579\n"), 0o600); err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+
+	testCases := []struct {
+		desc            string
+		config          string
+		body            string
+		hash            func() hash.Hash
+		signatureHeader string
+		timestampHeader string
+	}{
+		{
+			desc: "Requests are signed with HMAC-SHA256 by default",
+			config: `sign-request:
+    key: key
+`,
+			body:            `{"event": "click"}`,
+			hash:            sha256.New,
+			signatureHeader: "X-Relay-Signature",
+			timestampHeader: "X-Relay-Timestamp",
+		},
+		{
+			desc: "Requests without bodies are signed",
+			config: `sign-request:
+    key: key
+`,
+			hash:            sha256.New,
+			signatureHeader: "X-Relay-Signature",
+			timestampHeader: "X-Relay-Timestamp",
+		},
+		{
+			desc: "The algorithm, key, and headers can be configured",
+			config: fmt.Sprintf(`sign-request:
+    algorithm: hmac-sha512
+    key-file: %v
+    key-encoding: hex
+    signature-header: x-signature
+    timestamp-header: x-signed-at
+`, keyFile),
+			body:            "hello",
+			hash:            sha512.New,
+			signatureHeader: "X-Signature",
+			timestampHeader: "X-Signed-At",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		request_signing_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("POST", relayService.HttpUrl()+"/events?v=2", strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			// The client can't supply its own signature.
+			request.Header.Set(testCase.signatureHeader, "forged")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			body, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request body from catcher: %v", testCase.desc, err)
+				return
+			}
+
+			timestamp := lastRequest.Header.Get(testCase.timestampHeader)
+			if timestamp == "" {
+				t.Errorf("Test '%v': Expected a %v header", testCase.desc, testCase.timestampHeader)
+			}
+			mac := hmac.New(testCase.hash, []byte("key"))
+			mac.Write([]byte("POST\n/events?v=2\n" + timestamp + "\n" + string(body)))
+			expected := hex.EncodeToString(mac.Sum(nil))
+			if signature := lastRequest.Header.Get(testCase.signatureHeader); signature != expected {
+				t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, testCase.signatureHeader, expected, signature)
+			}
+			if string(body) != testCase.body {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.body, body)
+			}
+		})
+	}
+}
+
+func TestRequestSigningPluginTimestamp(t *testing.T) {
+	configFile, err := config.NewFileFromYamlString("sign-request:\n    key: key\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugin, err := request_signing_plugin.Factory.New(configFile.LookupOptionalSection("sign-request"))
+	if err != nil || plugin == nil {
+		t.Fatalf("Error creating plugin: %v", err)
+	}
+	plugin.(traffic.ClockPlugin).SetClock(clock.NewFake(time.Unix(1700000000, 0)))
+
+	request := httptest.NewRequest("GET", "http://example.com/status", nil)
+	plugin.HandleRequest(httptest.NewRecorder(), request, traffic.RequestInfo{})
+
+	// printf 'GET\n/status\n1700000000\n' | openssl dgst -sha256 -hmac key
+	expected := "7c5ad27b2609c13375d749967092d09367bd46f6126108a963565f7931b71d62"
+	if timestamp := request.Header.Get("X-Relay-Timestamp"); timestamp != "1700000000" {
+		t.Errorf("Expected X-Relay-Timestamp '1700000000' but got '%v'", timestamp)
+	}
+	if signature := request.Header.Get("X-Relay-Signature"); signature != expected {
+		t.Errorf("Expected X-Relay-Signature '%v' but got '%v'", expected, signature)
+	}
+}
+
+func TestRequestSigningConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"algorithm: hmac-md5\n    key: key",
+		"key-encoding: base32\n    key: key",
+		"key-encoding: hex\n    key: not-hex",
+		"key: key\n    key-file: /run/secrets/key",
+		"key-file: /nonexistent/key",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("sign-request:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := request_signing_plugin.Factory.New(configFile.LookupOptionalSection("sign-request")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
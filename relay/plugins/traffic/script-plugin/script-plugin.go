@@ -0,0 +1,328 @@
+// This plugin runs a Lua script for each request, so that operators can
+// express one-off transformations in the configuration rather than in a Go
+// plugin. The script is given inline with 'source', or in a file with 'file',
+// and is compiled when the relay starts.
+//
+// The script runs with a global 'request' table, which has 'method', 'url'
+// (the path and query), 'host', and 'remote_addr' fields, and these methods:
+//
+//	request:header(name)            -- The header's value, or nil.
+//	request:set_header(name, value) -- Sets the header, or removes it if value is nil.
+//	request:body()                  -- The body, as a string.
+//	request:set_body(body)          -- Replaces the body.
+//	request:reject(status, message) -- Responds with an error, and stops the script.
+//
+// print writes to the relay's log. Only Lua's base, string, table, and math
+// libraries are available, without the functions which load files. Scripts
+// which fail, or run for longer than 'timeout', cause the client to receive a
+// 502. Each script runs in an interpreter reused between requests, so globals
+// a script sets may be seen by later requests; scripts shouldn't rely on
+// them.
+
+package script_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	Factory    scriptPluginFactory
+	pluginName = "script"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const defaultTimeout = 100 * time.Millisecond
+
+type scriptPluginFactory struct{}
+
+func (f scriptPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f scriptPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &scriptPlugin{
+		timeout: defaultTimeout,
+	}
+
+	if timeout, err := config.LookupOptional[time.Duration](configSection, "timeout"); err != nil {
+		return nil, err
+	} else if timeout != nil {
+		if *timeout <= 0 {
+			return nil, fmt.Errorf(`Invalid timeout "%v": must be positive`, *timeout)
+		}
+		plugin.timeout = *timeout
+	}
+
+	source, err := config.LookupOptional[string](configSection, "source")
+	if err != nil {
+		return nil, err
+	}
+	file, err := config.LookupOptional[string](configSection, "file")
+	if err != nil {
+		return nil, err
+	}
+	name := "source"
+	switch {
+	case source != nil && file != nil:
+		return nil, fmt.Errorf(`Options "source" and "file" can't both be set`)
+	case file != nil:
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, fmt.Errorf(`Error reading script "%v": %v`, *file, err)
+		}
+		name = *file
+		source = new(string)
+		*source = string(data)
+	case source == nil:
+		return nil, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(*source), name)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid script: %v", err)
+	}
+	if plugin.proto, err = lua.Compile(chunk, name); err != nil {
+		return nil, fmt.Errorf("Invalid script: %v", err)
+	}
+
+	logger.Printf(`Added rule: run script "%v"`, name)
+	return plugin, nil
+}
+
+type scriptPlugin struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	states  sync.Pool // Of *lua.LState.
+	metrics *metrics.PluginMetrics
+}
+
+func (plug *scriptPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *scriptPlugin) SetPluginMetrics(pluginMetrics *metrics.PluginMetrics) {
+	plug.metrics = pluginMetrics
+}
+
+func (plug *scriptPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	state, _ := plug.states.Get().(*lua.LState)
+	if state == nil {
+		state = newState()
+	}
+	run := &scriptRun{request: request}
+
+	ctx, cancel := context.WithTimeout(request.Context(), plug.timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	state.SetGlobal("request", run.table(state))
+	state.Push(state.NewFunctionFromProto(plug.proto))
+	err := state.PCall(0, lua.MultRet, nil)
+	state.RemoveContext()
+	state.SetTop(0)
+	state.SetGlobal("request", lua.LNil)
+	// Interpreters whose script was interrupted may have been left in an
+	// inconsistent state, so they're discarded.
+	if ctx.Err() == nil {
+		plug.states.Put(state)
+	} else {
+		state.Close()
+	}
+
+	if run.rejected {
+		logger.Printf("%s %s: rejected by script with %v", request.Method, request.URL.Path, run.status)
+		http.Error(response, run.message, run.status)
+		return true
+	}
+	if err != nil {
+		plug.metrics.Error()
+		logger.Errorf("%s %s: error running script: %v", request.Method, request.URL.Path, err)
+		http.Error(response, "Error in relay script", http.StatusBadGateway)
+		return true
+	}
+	if run.bodyReplaced {
+		plug.metrics.BodyModified()
+	}
+	return false
+}
+
+// newState returns an interpreter with only the libraries which scripts may
+// use.
+func newState() *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+	state.SetGlobal("print", state.NewFunction(func(state *lua.LState) int {
+		values := []string{}
+		for i := 1; i <= state.GetTop(); i++ {
+			values = append(values, state.ToStringMeta(state.Get(i)).String())
+		}
+		logger.Printf("%v", strings.Join(values, "\t"))
+		return 0
+	}))
+	return state
+}
+
+// scriptRun is the state of a script running for a request.
+type scriptRun struct {
+	request      *http.Request
+	body         []byte // The body, once it has been read.
+	bodyRead     bool
+	bodyReplaced bool
+
+	rejected bool
+	status   int
+	message  string
+}
+
+// table returns the 'request' table for a script.
+func (run *scriptRun) table(state *lua.LState) *lua.LTable {
+	table := state.NewTable()
+	table.RawSetString("method", lua.LString(run.request.Method))
+	table.RawSetString("url", lua.LString(run.request.URL.RequestURI()))
+	table.RawSetString("host", lua.LString(run.request.Host))
+	table.RawSetString("remote_addr", lua.LString(run.request.RemoteAddr))
+	state.SetFuncs(table, map[string]lua.LGFunction{
+		"header":     run.header,
+		"set_header": run.setHeader,
+		"body":       run.readBody,
+		"set_body":   run.setBody,
+		"reject":     run.reject,
+	})
+	return table
+}
+
+// The methods of the 'request' table receive the table itself as their first
+// argument.
+
+func (run *scriptRun) header(state *lua.LState) int {
+	values := run.request.Header.Values(state.CheckString(2))
+	if len(values) == 0 {
+		state.Push(lua.LNil)
+	} else {
+		state.Push(lua.LString(strings.Join(values, ", ")))
+	}
+	return 1
+}
+
+func (run *scriptRun) setHeader(state *lua.LState) int {
+	name := state.CheckString(2)
+	if state.Get(3) == lua.LNil {
+		run.request.Header.Del(name)
+	} else {
+		run.request.Header.Set(name, state.CheckString(3))
+	}
+	return 0
+}
+
+func (run *scriptRun) readBody(state *lua.LState) int {
+	if !run.bodyRead {
+		body, err := readBody(run.request)
+		if err != nil {
+			state.RaiseError("Error reading request body: %v", err)
+			return 0
+		}
+		run.body = body
+		run.bodyRead = true
+	}
+	state.Push(lua.LString(run.body))
+	return 1
+}
+
+func (run *scriptRun) setBody(state *lua.LState) int {
+	run.body = []byte(state.CheckString(2))
+	run.bodyRead = true
+	run.bodyReplaced = true
+	traffic.SetRequestBody(run.request, run.body)
+	return 0
+}
+
+func (run *scriptRun) reject(state *lua.LState) int {
+	status := state.CheckInt(2)
+	if status < 400 || status > 599 {
+		state.ArgError(2, "must be an error status")
+		return 0
+	}
+	run.rejected = true
+	run.status = status
+	run.message = state.OptString(3, http.StatusText(status))
+	// Raising an error stops the script.
+	state.RaiseError("request rejected")
+	return 0
+}
+
+// readBody returns a request's body without consuming it. Bodies which the
+// relay has buffered are reopened; any other body is read into memory and
+// replaced.
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+	if body, ok := request.Body.(*traffic.BodyReader); ok {
+		reader := body.Reopen()
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	traffic.SetRequestBody(request, body)
+	return body, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,202 @@
+package script_plugin_test
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	script_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/script-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestScriptPlugin(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		script         string
+		timeout        string
+		body           string
+		expectedStatus int
+		expectedBody   string // Of the response if the request isn't relayed, or of the request if it is.
+		expectedHeader http.Header
+		expectRelayed  bool
+	}{
+		{
+			desc: "Scripts may set and remove headers",
+			script: `
+				request:set_header("X-Method", request.method .. " " .. request.url)
+				request:set_header("X-Tenant", request:header("X-Tenant"):upper())
+				request:set_header("X-Secret", nil)
+			`,
+			body:           "hello",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello",
+			expectedHeader: http.Header{"X-Method": {"POST /events?page=2"}, "X-Tenant": {"ACME"}, "X-Secret": nil},
+			expectRelayed:  true,
+		},
+		{
+			desc:           "Scripts may replace bodies",
+			script:         `request:set_body((request:body():gsub("%d%d%d%d", "****")))`,
+			body:           `{"card": "4111 1111 1111 1111"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"card": "**** **** **** ****"}`,
+			expectRelayed:  true,
+		},
+		{
+			desc: "Scripts may reject requests",
+			script: `
+				if request:header("X-Secret") then
+					request:reject(403, "No secrets allowed")
+				end
+				request:set_header("X-Unreachable", "true")
+			`,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "No secrets allowed\n",
+		},
+		{
+			desc:           "Rejections have a default message",
+			script:         `request:reject(429)`,
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBody:   "Too Many Requests\n",
+		},
+		{
+			desc:           "Requests whose script fails aren't relayed",
+			script:         `error("oops")`,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay script\n",
+		},
+		{
+			desc:           "Rejections must have error statuses",
+			script:         `request:reject(200)`,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay script\n",
+		},
+		{
+			desc:           "Scripts which run too long are stopped",
+			script:         `while true do end`,
+			timeout:        "50ms",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay script\n",
+		},
+		{
+			desc:           "Scripts can't read files",
+			script:         `dofile("/etc/passwd")`,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay script\n",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		script_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		configYaml := "script:\n    source: |\n"
+		// YAML doesn't allow the tabs which indent the scripts above.
+		for _, line := range strings.Split(testCase.script, "\n") {
+			configYaml += "        " + strings.TrimSpace(line) + "\n"
+		}
+		if testCase.timeout != "" {
+			configYaml += "    timeout: " + testCase.timeout + "\n"
+		}
+
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, _ := http.NewRequest("POST", relayService.HttpUrl()+"/events?page=2", strings.NewReader(testCase.body))
+			request.Header.Set("X-Tenant", "acme")
+			request.Header.Set("X-Secret", "hunter2")
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if !testCase.expectRelayed {
+				if err == nil {
+					t.Errorf("Test '%v': Expected the request not to be relayed", testCase.desc)
+				}
+				if string(body) != testCase.expectedBody {
+					t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if targetBody, _ := io.ReadAll(lastRequest.Body); string(targetBody) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected the target to receive %q but got %q", testCase.desc, testCase.expectedBody, targetBody)
+			}
+			for name, values := range testCase.expectedHeader {
+				expected := ""
+				if len(values) > 0 {
+					expected = values[0]
+				}
+				if value := lastRequest.Header.Get(name); value != expected {
+					t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, name, expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestScriptFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "transform.lua")
+	if err := os.WriteFile(file, []byte(`request:set_header("X-Scripted", "true")`), 0644); err != nil {
+		t.Fatalf("Error writing script: %v", err)
+	}
+
+	plugins := []traffic.PluginFactory{
+		script_plugin.Factory,
+	}
+	test.WithCatcherAndRelay(t, "script:\n    file: "+file+"\n", plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		response.Body.Close()
+
+		lastRequest, err := catcherService.LastRequest()
+		if err != nil {
+			t.Errorf("Error reading last request from catcher: %v", err)
+			return
+		}
+		if value := lastRequest.Header.Get("X-Scripted"); value != "true" {
+			t.Errorf("Expected X-Scripted 'true' but got '%v'", value)
+		}
+	})
+}
+
+func TestScriptConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"source: 'request:set_header('",
+		"source: 'x = 1'\n    file: /etc/relay/transform.lua",
+		"file: /nonexistent/transform.lua",
+		"source: 'x = 1'\n    timeout: 0s",
+		"source: 'x = 1'\n    timeout: soon",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("script:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := script_plugin.Factory.New(configFile.LookupOptionalSection("script")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
@@ -2,24 +2,27 @@ package segment_proxy_plugin
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/immersa-co/relay-core/relay/clock"
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var (
 	Factory    segmentProxyPluginFactory
 	pluginName = "segment-proxy"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type segmentProxyPluginFactory struct{}
@@ -29,15 +32,70 @@ func (f segmentProxyPluginFactory) Name() string {
 }
 
 func (f segmentProxyPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
-	return &segmentProxyPlugin{
+	plugin := &segmentProxyPlugin{
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
-	}, nil
+		clock: clock.Real,
+	}
+
+	if compress, err := config.LookupOptional[bool](configSection, "compress-batches"); err != nil {
+		return nil, err
+	} else if compress != nil {
+		plugin.disableCompression = !*compress
+	}
+
+	if consume, err := config.LookupOptional[bool](configSection, "consume-bundles"); err != nil {
+		return nil, err
+	} else if consume != nil && *consume {
+		plugin.consumeBundles = true
+		logger.Println("Bundle requests will be consumed rather than relayed")
+	}
+
+	if err := config.ParseOptional(configSection, "context", func(key string, value ContextConfig) error {
+		plugin.context = value
+		logger.Printf("Context fields: %+v", value)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return plugin, nil
+}
+
+// ContextConfig determines which Segment context fields are added to the
+// events the plugin generates.
+type ContextConfig struct {
+	IP         bool `yaml:"ip"`          // The client's IP address.
+	TruncateIP bool `yaml:"truncate-ip"` // Zero the host portion of the IP address.
+	UserAgent  bool `yaml:"user-agent"`  // The client's User-Agent header.
+	Locale     bool `yaml:"locale"`      // The preferred language from Accept-Language.
+	Campaign   bool `yaml:"campaign"`    // UTM parameters parsed from the page URL.
 }
 
 type segmentProxyPlugin struct {
-	client *http.Client
+	client             *http.Client
+	context            ContextConfig
+	disableCompression bool // If true, batches are sent without gzip compression.
+	consumeBundles     bool // If true, bundle requests are not relayed to the target.
+	headerPolicy       *traffic.OutboundHeaderPolicy
+	metrics            *metrics.PluginMetrics
+	clock              clock.Clock
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *segmentProxyPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *segmentProxyPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+// SetOutboundHeaderPolicy implements traffic.OutboundHeaderPlugin.
+func (plug *segmentProxyPlugin) SetOutboundHeaderPolicy(policy *traffic.OutboundHeaderPolicy) {
+	plug.headerPolicy = policy
 }
 
 func (plug segmentProxyPlugin) Name() string {
@@ -70,120 +128,290 @@ func (plug segmentProxyPlugin) HandleRequest(
 		return false
 	}
 
+	plug.proxyBundle(request)
+
+	if plug.consumeBundles {
+		// Segment is the only consumer of bundles, so respond on the target's
+		// behalf rather than relaying the request.
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusOK)
+		response.Write([]byte("{}"))
+		return true
+	}
+
+	return false
+}
+
+// proxyBundle sends the navigation events in a bundle request to Segment. The
+// request body is left intact so that the request can still be relayed.
+func (plug segmentProxyPlugin) proxyBundle(request *http.Request) {
 	if request.Body == nil {
-		return false
+		return
 	}
 	
 	originalBodyBytes, err := io.ReadAll(request.Body)
 	if err != nil {
-		logger.Printf("Failed to read request body: %v", err)
-		return false
+		logger.Errorf("Failed to read request body: %v", err)
+		return
 	}
 	request.Body.Close()
-	request.Body = io.NopCloser(bytes.NewReader(originalBodyBytes))
+	traffic.SetRequestBody(request, originalBodyBytes)
 
-	var contentBytes []byte
+	// The relay decodes compressed bodies before plugins run, so the body is
+	// plain JSON regardless of its Content-Encoding.
+	var navigateEvent = 37
+	var segmentData SegmentData
+	if err := json.Unmarshal(originalBodyBytes, &segmentData); err != nil {
+		return
+	}
+	
+	userId := request.URL.Query().Get("UserId")
+	anonymousId := ""
 
-	if request.Header.Get("Content-Encoding") == "gzip" {
-		bodyReader := bytes.NewReader(originalBodyBytes)
-		reader, err := gzip.NewReader(bodyReader)
-		if err != nil {
-			logger.Printf("Failed to create gzip reader: %v", err)
-			return false
+	var messages []json.RawMessage
+	for _, event := range segmentData.Evts {
+		if event.Kind != navigateEvent {
+			continue
+		}
+
+		var args []string
+		if err := json.Unmarshal(event.Args, &args); err != nil {
+			continue
+		}
+		if len(args) == 0 {
+			continue
 		}
-		defer reader.Close()
 
-		contentBytes, err = io.ReadAll(reader)
+		url := args[0]
+		message := map[string]interface{}{
+			"type":      "page",
+			"timestamp": plug.clock.Now().Unix(),
+			"properties": map[string]interface{}{
+				"url": url,
+			},
+			"name": "track " + url,
+		}
+		plug.addIdentity(message, userId, &anonymousId)
+		if context := plug.buildContext(request, url); len(context) > 0 {
+			message["context"] = context
+		}
+
+		messageBytes, err := json.Marshal(message)
 		if err != nil {
-			logger.Printf("Failed to decompress gzip body: %v", err)
-			return false
+			logger.Errorf("Failed to marshal message: %v", err)
+			continue
+		}
+		if len(messageBytes) > maxMessageSize {
+			logger.Printf("Dropping page event: message size %d exceeds the %d byte limit", len(messageBytes), maxMessageSize)
+			continue
 		}
-	} else {
-		contentBytes = originalBodyBytes
+		messages = append(messages, messageBytes)
 	}
 
-	var navigateEvent = 37
-	var segmentData SegmentData
-	if err := json.Unmarshal(contentBytes, &segmentData); err != nil {
-		return false
+	if processedCount := plug.sendBatches(request, segmentData.WriteKey, messages); processedCount > 0 {
+		logger.Printf("Processed and proxied %d events from %s", processedCount, request.URL.Path)
 	}
-	
-	processedCount := 0
-	userId := request.URL.Query().Get("UserId")
-	
-	for _, event := range segmentData.Evts {
-		if event.Kind == navigateEvent {
-			var args []string
-			if err := json.Unmarshal(event.Args, &args); err != nil {
-				continue
-			}
-
-			if len(args) == 0 {
-				continue
-			}
-
-			url := args[0]
-			requestBody := map[string]interface{}{
-				"writeKey": segmentData.WriteKey,
-				"userId":   userId,
-				"timestamp": time.Now().Unix(),
-				"properties": map[string]interface{}{
-					"url": url,
-				},
-				"name": "track " + url,
-			}
-
-			jsonBody, err := json.Marshal(requestBody)
-			if err != nil {
-				logger.Printf("Failed to marshal request body: %v", err)
-				continue
-			}
-
-			targetURL := *request.URL
-			targetURL.Path = "/v1/page"
-			
-			if targetURL.Scheme == "" {
-				if request.TLS != nil {
-					targetURL.Scheme = "https"
-				} else {
-					targetURL.Scheme = "http"
-				}
-			}
-			
-			proxyReq, err := http.NewRequest("POST", targetURL.String(), bytes.NewReader(jsonBody))
-			if err != nil {
-				logger.Printf("Failed to create proxy request: %v", err)
-				continue
-			}
-			
-			for k, v := range request.Header {
-				if k != "Content-Length" {
-					proxyReq.Header[k] = v
-				}
-			}
-			
-			proxyReq.Header.Set("Content-Type", "application/json")
-			proxyReq.ContentLength = int64(len(jsonBody))
-			
-			logger.Printf("Proxying event to %s: %s", targetURL.Host, url)
-			
-			resp, err := plug.client.Do(proxyReq)
-			if err != nil {
-				logger.Printf("Failed to send proxy request: %v", err)
-				continue
-			}
-			
-			resp.Body.Close()
-			
-			processedCount++
+}
+
+// Segment's limits on the size of individual messages and of batch requests.
+const (
+	maxMessageSize = 32 * 1024
+	maxBatchSize   = 500 * 1024
+)
+
+// sendBatches sends the provided messages to Segment's /v1/batch endpoint,
+// splitting them into as many batches as necessary to respect maxBatchSize. It
+// returns the number of messages that were successfully sent.
+func (plug segmentProxyPlugin) sendBatches(request *http.Request, writeKey string, messages []json.RawMessage) int {
+	// Account for the JSON surrounding the messages: {"batch":[...],"writeKey":"..."}
+	batchOverhead := len(`{"batch":[],"writeKey":""}`) + len(writeKey)
+
+	sent := 0
+	var batch []json.RawMessage
+	batchSize := batchOverhead
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := plug.sendBatch(request, writeKey, batch); err != nil {
+			plug.metrics.Error()
+			logger.Errorf("Failed to send batch of %d events: %v", len(batch), err)
+		} else {
+			sent += len(batch)
 		}
+		batch = nil
+		batchSize = batchOverhead
 	}
-	
-	if processedCount > 0 {
-		logger.Printf("Processed and proxied %d events from %s", processedCount, request.URL.Path)
-		
-		return false
+
+	for _, message := range messages {
+		// Each message after the first is preceded by a comma.
+		if len(batch) > 0 && batchSize+len(message)+1 > maxBatchSize {
+			flush()
+		}
+		batch = append(batch, message)
+		batchSize += len(message) + 1
 	}
-	
-	return false
-} 
\ No newline at end of file
+	flush()
+
+	return sent
+}
+
+// sendBatch sends a single batch request, derived from the original request.
+func (plug segmentProxyPlugin) sendBatch(request *http.Request, writeKey string, batch []json.RawMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"batch":    batch,
+		"writeKey": writeKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !plug.disableCompression {
+		if body, err = traffic.EncodeData(body, traffic.Gzip); err != nil {
+			return err
+		}
+	}
+
+	targetURL := *request.URL
+	targetURL.Path = "/v1/batch"
+	if targetURL.Scheme == "" {
+		if request.TLS != nil {
+			targetURL.Scheme = "https"
+		} else {
+			targetURL.Scheme = "http"
+		}
+	}
+
+	proxyReq, err := http.NewRequest("POST", targetURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	plug.headerPolicy.Apply(proxyReq, request)
+	proxyReq.Header.Set("Content-Type", "application/json")
+	if !plug.disableCompression {
+		proxyReq.Header.Set("Content-Encoding", "gzip")
+	}
+	proxyReq.ContentLength = int64(len(body))
+
+	logger.Printf("Proxying batch of %d events to %s", len(batch), targetURL.Host)
+
+	resp, err := plug.client.Do(proxyReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// addIdentity sets the userId of an event. Segment requires either a userId or
+// an anonymousId, so if the request didn't identify the user, an anonymousId
+// is generated. The same anonymousId is used for every event in a bundle.
+func (plug segmentProxyPlugin) addIdentity(event map[string]interface{}, userId string, anonymousId *string) {
+	if userId != "" {
+		event["userId"] = userId
+		return
+	}
+	if *anonymousId == "" {
+		*anonymousId = newAnonymousId()
+	}
+	event["anonymousId"] = *anonymousId
+}
+
+// newAnonymousId returns a random version 4 UUID.
+func newAnonymousId() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// buildContext returns the Segment context object for an event describing a
+// navigation to pageURL, including only the fields enabled in the
+// configuration.
+func (plug segmentProxyPlugin) buildContext(request *http.Request, pageURL string) map[string]interface{} {
+	context := map[string]interface{}{}
+
+	if plug.context.IP {
+		if ip := clientIP(request, plug.context.TruncateIP); ip != "" {
+			context["ip"] = ip
+		}
+	}
+	if plug.context.UserAgent {
+		if userAgent := request.Header.Get("User-Agent"); userAgent != "" {
+			context["userAgent"] = userAgent
+		}
+	}
+	if plug.context.Locale {
+		if locale := preferredLocale(request.Header.Get("Accept-Language")); locale != "" {
+			context["locale"] = locale
+		}
+	}
+	if plug.context.Campaign {
+		if campaign := parseCampaign(pageURL); len(campaign) > 0 {
+			context["campaign"] = campaign
+		}
+	}
+
+	return context
+}
+
+// clientIP returns the IP address of the client that sent the request. If
+// truncate is true, the last octet of an IPv4 address, or the last 80 bits of
+// an IPv6 address, are zeroed.
+func clientIP(request *http.Request, truncate bool) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if !truncate {
+		return ip.String()
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// preferredLocale returns the first language tag in an Accept-Language header.
+func preferredLocale(acceptLanguage string) string {
+	first := strings.Split(acceptLanguage, ",")[0]
+	locale := strings.TrimSpace(strings.Split(first, ";")[0])
+	if locale == "*" {
+		return ""
+	}
+	return locale
+}
+
+// parseCampaign extracts the standard UTM parameters from a URL, using the
+// field names from the Segment spec.
+func parseCampaign(pageURL string) map[string]string {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+	query := parsedURL.Query()
+
+	campaign := map[string]string{}
+	for param, field := range map[string]string{
+		"utm_campaign": "name",
+		"utm_source":   "source",
+		"utm_medium":   "medium",
+		"utm_term":     "term",
+		"utm_content":  "content",
+	} {
+		if value := query.Get(param); value != "" {
+			campaign[field] = value
+		}
+	}
+	return campaign
+}
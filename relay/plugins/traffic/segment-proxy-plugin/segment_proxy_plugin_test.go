@@ -3,10 +3,16 @@ package segment_proxy_plugin
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/immersa-co/relay-core/relay/clock"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
@@ -20,6 +26,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 	// Create plugin with mocked HTTP client
 	plugin := &segmentProxyPlugin{
 		client: server.Client(),
+		clock:  clock.Real,
 	}
 
 	tests := []struct {
@@ -29,7 +36,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 		body              []byte
 		expectedStatus    int
 		shouldService     bool
-		expectedEventCount int
+		expectedRequestCount int
 	}{
 		{
 			name:              "single navigate event should be processed",
@@ -50,7 +57,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			}(),
 			expectedStatus:    http.StatusOK,
 			shouldService:     false, // Always return false to avoid "serviced" log
-			expectedEventCount: 1,
+			expectedRequestCount: 1,
 		},
 		{
 			name:              "multiple navigate events should be processed",
@@ -79,7 +86,8 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			}(),
 			expectedStatus:    http.StatusOK,
 			shouldService:     false,
-			expectedEventCount: 2,
+			expectedRequestCount: 1, // Events are sent in a single batch
+
 		},
 		{
 			name:              "path containing rec/bundle/v2 should be processed",
@@ -100,7 +108,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			}(),
 			expectedStatus:    http.StatusOK,
 			shouldService:     false,
-			expectedEventCount: 1,
+			expectedRequestCount: 1,
 		},
 		{
 			name:              "non-navigate event should not be processed",
@@ -120,7 +128,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			}(),
 			expectedStatus:    0, // No response status set
 			shouldService:     false,
-			expectedEventCount: 0,
+			expectedRequestCount: 0,
 		},
 		{
 			name:              "non-matching path should not be processed",
@@ -129,7 +137,7 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			body:              []byte(`{}`),
 			expectedStatus:    0,
 			shouldService:     false,
-			expectedEventCount: 0,
+			expectedRequestCount: 0,
 		},
 	}
 
@@ -158,8 +166,8 @@ func TestSegmentProxyPlugin(t *testing.T) {
 			}
 
 			// Check if the correct number of requests were made to the target
-			if requestsMade != tt.expectedEventCount {
-				t.Errorf("Expected %d requests to be made, but got %d", tt.expectedEventCount, requestsMade)
+			if requestsMade != tt.expectedRequestCount {
+				t.Errorf("Expected %d requests to be made, but got %d", tt.expectedRequestCount, requestsMade)
 			}
 
 			// Check if the response status is as expected
@@ -181,4 +189,222 @@ func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	t.callback()
 	// Forward to the underlying transport
 	return t.transport.RoundTrip(req)
-} 
\ No newline at end of file
+} 
+
+// newBatchCapturingServer returns a test server that records the messages in
+// each batch it receives.
+func newBatchCapturingServer(t *testing.T, batches *[][]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/batch" {
+			t.Errorf("Expected request to /v1/batch but got %v", r.URL.Path)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected gzip-compressed batch but got encoding '%v'", r.Header.Get("Content-Encoding"))
+		}
+
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := traffic.DecodeData(compressed, traffic.Gzip)
+		if err != nil {
+			t.Errorf("Error decompressing batch: %v", err)
+		}
+		if len(compressed) > maxBatchSize {
+			t.Errorf("Batch size %d exceeds limit", len(compressed))
+		}
+
+		var payload struct {
+			Batch    []map[string]interface{} `json:"batch"`
+			WriteKey string                   `json:"writeKey"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Error parsing batch: %v", err)
+		}
+		if len(body) > maxBatchSize {
+			t.Errorf("Uncompressed batch size %d exceeds limit", len(body))
+		}
+		*batches = append(*batches, payload.Batch)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestSegmentProxyPluginSplitsBatches(t *testing.T) {
+	var batches [][]map[string]interface{}
+	server := newBatchCapturingServer(t, &batches)
+	defer server.Close()
+
+	plugin := &segmentProxyPlugin{client: server.Client(), clock: clock.Real}
+
+	// Each message contains its URL twice, so it's about 24KB and 40 of them
+	// need two 500KB batches. The final event exceeds the 32KB message limit
+	// and should be dropped.
+	longPath := strings.Repeat("a", 12*1024)
+	var events []Event
+	for i := 0; i < 40; i++ {
+		events = append(events, Event{Kind: 37, Args: json.RawMessage(fmt.Sprintf(`["https://example.com/%s/%d"]`, longPath, i))})
+	}
+	events = append(events, Event{Kind: 37, Args: json.RawMessage(fmt.Sprintf(`["https://example.com/%s"]`, strings.Repeat("b", 40*1024)))})
+
+	body, _ := json.Marshal(SegmentData{WriteKey: "test-key", Evts: events})
+	req := httptest.NewRequest("POST", server.URL+"/rec/bundle/v2?UserId=user", bytes.NewReader(body))
+	plugin.HandleRequest(httptest.NewRecorder(), req, traffic.RequestInfo{})
+
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches but got %d", len(batches))
+	}
+	if total := len(batches[0]) + len(batches[1]); total != 40 {
+		t.Errorf("Expected 40 messages across batches but got %d", total)
+	}
+	if batches[0][0]["type"] != "page" || batches[0][0]["userId"] != "user" {
+		t.Errorf("Unexpected message: %v", batches[0][0]["type"])
+	}
+}
+
+func TestSegmentProxyPluginContextFields(t *testing.T) {
+	var batches [][]map[string]interface{}
+	server := newBatchCapturingServer(t, &batches)
+	defer server.Close()
+
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	plugin := &segmentProxyPlugin{
+		client: server.Client(),
+		clock:  clock.NewFake(now),
+		context: ContextConfig{
+			IP:         true,
+			TruncateIP: true,
+			UserAgent:  true,
+			Locale:     true,
+			Campaign:   true,
+		},
+	}
+
+	body, _ := json.Marshal(SegmentData{
+		WriteKey: "test-key",
+		Evts: []Event{
+			{Kind: 37, Args: json.RawMessage(`["https://example.com/?utm_source=news&utm_campaign=spring"]`)},
+			{Kind: 37, Args: json.RawMessage(`["https://example.com/about"]`)},
+		},
+	})
+	req := httptest.NewRequest("POST", server.URL+"/rec/bundle/v2", bytes.NewReader(body))
+	req.RemoteAddr = "203.0.113.77:4321"
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Accept-Language", "fr-CA,fr;q=0.9,en;q=0.8")
+
+	plugin.HandleRequest(httptest.NewRecorder(), req, traffic.RequestInfo{})
+
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Expected 1 batch of 2 messages but got %v", batches)
+	}
+	payloads := batches[0]
+
+	first := payloads[0]
+	for _, payload := range payloads {
+		if payload["timestamp"] != float64(now.Unix()) {
+			t.Errorf("Expected timestamp %v but got %v", now.Unix(), payload["timestamp"])
+		}
+	}
+	if _, ok := first["userId"]; ok {
+		t.Errorf("Expected no userId when UserId is absent: %v", first)
+	}
+	anonymousId, _ := first["anonymousId"].(string)
+	if anonymousId == "" || payloads[1]["anonymousId"] != anonymousId {
+		t.Errorf("Expected a shared anonymousId fallback: %v %v", first["anonymousId"], payloads[1]["anonymousId"])
+	}
+
+	context, _ := first["context"].(map[string]interface{})
+	expected := map[string]interface{}{
+		"ip":        "203.0.113.0",
+		"userAgent": "test-agent",
+		"locale":    "fr-CA",
+		"campaign": map[string]interface{}{
+			"name":   "spring",
+			"source": "news",
+		},
+	}
+	if !reflect.DeepEqual(context, expected) {
+		t.Errorf("Expected context %v but got %v", expected, context)
+	}
+
+	if _, ok := payloads[1]["context"].(map[string]interface{})["campaign"]; ok {
+		t.Errorf("Expected no campaign for a URL without UTM parameters: %v", payloads[1]["context"])
+	}
+}
+
+func TestSegmentProxyPluginConsumesBundles(t *testing.T) {
+	var batches [][]map[string]interface{}
+	server := newBatchCapturingServer(t, &batches)
+	defer server.Close()
+
+	plugin := &segmentProxyPlugin{client: server.Client(), clock: clock.Real, consumeBundles: true}
+
+	body, _ := json.Marshal(SegmentData{
+		WriteKey: "test-key",
+		Evts:     []Event{{Kind: 37, Args: json.RawMessage(`["https://example.com"]`)}},
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		expectServiced bool
+		expectBatches  int
+	}{
+		{name: "bundle requests are consumed", path: "/rec/bundle/v2", expectServiced: true, expectBatches: 1},
+		{name: "other requests are relayed", path: "/other/path", expectServiced: false, expectBatches: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches = nil
+			req := httptest.NewRequest("POST", server.URL+tt.path+"?UserId=user", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+
+			serviced := plugin.HandleRequest(w, req, traffic.RequestInfo{})
+			if serviced != tt.expectServiced {
+				t.Errorf("HandleRequest() returned %v, want %v", serviced, tt.expectServiced)
+			}
+			if tt.expectServiced && (w.Code != http.StatusOK || w.Body.String() != "{}") {
+				t.Errorf("Expected a synthetic 200 response but got %d %q", w.Code, w.Body.String())
+			}
+			if len(batches) != tt.expectBatches {
+				t.Errorf("Expected %d batches but got %d", tt.expectBatches, len(batches))
+			}
+		})
+	}
+}
+
+func TestSegmentProxyPluginAppliesOutboundHeaderPolicy(t *testing.T) {
+	var receivedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	plugin := &segmentProxyPlugin{client: server.Client(), clock: clock.Real}
+	plugin.SetOutboundHeaderPolicy(&traffic.OutboundHeaderPolicy{
+		Allowlist: []string{"User-Agent", "Cookie"},
+		Set:       map[string]string{"Authorization": "Basic injected"},
+	})
+
+	body, _ := json.Marshal(SegmentData{
+		WriteKey: "test-key",
+		Evts:     []Event{{Kind: 37, Args: json.RawMessage(`["https://example.com"]`)}},
+	})
+	req := httptest.NewRequest("POST", server.URL+"/rec/bundle/v2", bytes.NewReader(body))
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Other", "value")
+
+	plugin.HandleRequest(httptest.NewRecorder(), req, traffic.RequestInfo{})
+
+	if receivedHeaders == nil {
+		t.Fatalf("Expected a batch request to be sent")
+	}
+	if receivedHeaders.Get("User-Agent") != "test-agent" {
+		t.Errorf("Expected allowlisted User-Agent header but got %q", receivedHeaders.Get("User-Agent"))
+	}
+	if receivedHeaders.Get("Cookie") != "" || receivedHeaders.Get("X-Other") != "" {
+		t.Errorf("Expected Cookie and X-Other headers to be removed: %v", receivedHeaders)
+	}
+	if receivedHeaders.Get("Authorization") != "Basic injected" {
+		t.Errorf("Expected injected Authorization header but got %q", receivedHeaders.Get("Authorization"))
+	}
+}
@@ -0,0 +1,222 @@
+// This plugin serves static assets, like the bootstrap files that load a
+// recording SDK, directly from the relay, so that edge relays needn't proxy
+// every fetch of them to the target. Requests for the configured paths are
+// answered from a directory or, in builds of the relay which bundle the assets,
+// from an embedded file system. Assets are read when the relay starts, and are
+// served with a strong ETag and a Cache-Control header, so clients can cache
+// them and revalidate them cheaply.
+
+package static_assets_plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    staticAssetsPluginFactory
+	pluginName = "static-assets"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// EmbeddedAssets, if non-nil, is served when no 'dir' is configured. Builds of
+// the relay which bundle assets can set it to an embed.FS during
+// initialization.
+var EmbeddedAssets fs.FS
+
+const (
+	defaultCacheControl = "public, max-age=300"
+
+	// maxAssetsSize bounds the total size of the assets held in memory.
+	maxAssetsSize = 32 * 1024 * 1024
+)
+
+type staticAssetsPluginFactory struct{}
+
+func (f staticAssetsPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f staticAssetsPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &staticAssetsPlugin{
+		cacheControl: defaultCacheControl,
+		assets:       map[string]*asset{},
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, paths []string) error {
+		for _, assetPath := range paths {
+			if !strings.HasPrefix(assetPath, "/") {
+				return fmt.Errorf(`Invalid asset path "%v": must begin with "/"`, assetPath)
+			}
+			plugin.paths = append(plugin.paths, assetPath)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(plugin.paths) == 0 {
+		return nil, nil
+	}
+
+	if cacheControl, err := config.LookupOptional[string](configSection, "cache-control"); err != nil {
+		return nil, err
+	} else if cacheControl != nil {
+		plugin.cacheControl = *cacheControl
+	}
+
+	assets := EmbeddedAssets
+	source := "embedded assets"
+	if dir, err := config.LookupOptional[string](configSection, "dir"); err != nil {
+		return nil, err
+	} else if dir != nil {
+		if info, err := os.Stat(*dir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf(`Static asset directory "%v" is not a directory`, *dir)
+		}
+		assets = os.DirFS(*dir)
+		source = fmt.Sprintf(`"%v"`, *dir)
+	}
+	if assets == nil {
+		return nil, fmt.Errorf(`Option "dir" is required, since this build has no embedded assets`)
+	}
+
+	if err := plugin.load(assets); err != nil {
+		return nil, fmt.Errorf("Error loading static assets from %v: %v", source, err)
+	}
+	logger.Printf(`Serving %v static assets from %v at %v`, len(plugin.assets), source, strings.Join(plugin.paths, ", "))
+
+	return plugin, nil
+}
+
+type staticAssetsPlugin struct {
+	paths        []string // Paths served by the plugin; those ending in "/" are prefixes.
+	cacheControl string
+	assets       map[string]*asset // Keyed by URL path.
+}
+
+type asset struct {
+	content     []byte
+	etag        string
+	contentType string
+	modTime     time.Time // Zero for embedded assets.
+}
+
+// load reads every file in assets which is served at one of the plugin's
+// paths.
+func (plug *staticAssetsPlugin) load(assets fs.FS) error {
+	totalSize := 0
+	return fs.WalkDir(assets, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		urlPath := "/" + filePath
+		if !entry.Type().IsRegular() || !plug.serves(urlPath) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		content, err := fs.ReadFile(assets, filePath)
+		if err != nil {
+			return err
+		}
+		if totalSize += len(content); totalSize > maxAssetsSize {
+			return fmt.Errorf("Assets exceed %v bytes", maxAssetsSize)
+		}
+
+		hash := sha256.Sum256(content)
+		contentType := mime.TypeByExtension(path.Ext(filePath))
+		if contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+		plug.assets[urlPath] = &asset{
+			content:     content,
+			etag:        `"` + hex.EncodeToString(hash[:16]) + `"`,
+			contentType: contentType,
+			modTime:     info.ModTime(),
+		}
+		return nil
+	})
+}
+
+// serves returns true if urlPath is one of the plugin's paths.
+func (plug *staticAssetsPlugin) serves(urlPath string) bool {
+	for _, assetPath := range plug.paths {
+		if urlPath == assetPath || (strings.HasSuffix(assetPath, "/") && strings.HasPrefix(urlPath, assetPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (plug *staticAssetsPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *staticAssetsPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	urlPath := info.OriginalURL.Path
+	if !plug.serves(urlPath) {
+		return false
+	}
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		response.Header().Set("Allow", "GET, HEAD")
+		http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	servedAsset := plug.assets[urlPath]
+	if servedAsset == nil {
+		http.NotFound(response, request)
+		return true
+	}
+
+	response.Header().Set("Cache-Control", plug.cacheControl)
+	response.Header().Set("Content-Type", servedAsset.contentType)
+	response.Header().Set("ETag", servedAsset.etag)
+	http.ServeContent(response, request, urlPath, servedAsset.modTime, bytes.NewReader(servedAsset.content))
+	return true
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
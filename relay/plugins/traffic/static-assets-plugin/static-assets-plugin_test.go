@@ -0,0 +1,220 @@
+package static_assets_plugin_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	static_assets_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/static-assets-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestStaticAssetsPlugin(t *testing.T) {
+	assetsDir := t.TempDir()
+	for name, content := range map[string]string{
+		"sdk.js":             "window.sdk = {};",
+		"static/app.css":     "body {}",
+		"static/nested/a.js": "a();",
+		"other.txt":          "other",
+	} {
+		assetPath := filepath.Join(assetsDir, name)
+		if err := os.MkdirAll(filepath.Dir(assetPath), 0755); err != nil {
+			t.Fatalf("Error creating asset directory: %v", err)
+		}
+		if err := os.WriteFile(assetPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing asset: %v", err)
+		}
+	}
+
+	configYaml := fmt.Sprintf(`static-assets:
+    dir: %v
+    paths:
+        - /sdk.js
+        - /static/
+`, assetsDir)
+
+	testCases := []struct {
+		desc                 string
+		method               string
+		path                 string
+		headers              map[string]string
+		expectedStatus       int
+		expectedBody         string
+		expectedContentType  string
+		expectedCacheControl string
+		expectedForward      bool
+	}{
+		{
+			desc:                 "Assets are served with caching headers",
+			method:               "GET",
+			path:                 "/sdk.js",
+			expectedStatus:       http.StatusOK,
+			expectedBody:         "window.sdk = {};",
+			expectedContentType:  "text/javascript; charset=utf-8",
+			expectedCacheControl: "public, max-age=300",
+		},
+		{
+			desc:                 "Prefixes serve nested assets",
+			method:               "GET",
+			path:                 "/static/nested/a.js",
+			expectedStatus:       http.StatusOK,
+			expectedBody:         "a();",
+			expectedContentType:  "text/javascript; charset=utf-8",
+			expectedCacheControl: "public, max-age=300",
+		},
+		{
+			desc:                 "HEAD requests are supported",
+			method:               "HEAD",
+			path:                 "/static/app.css",
+			expectedStatus:       http.StatusOK,
+			expectedContentType:  "text/css; charset=utf-8",
+			expectedCacheControl: "public, max-age=300",
+		},
+		{
+			desc:           "Missing assets under served paths aren't forwarded",
+			method:         "GET",
+			path:           "/static/missing.js",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "404 page not found\n",
+		},
+		{
+			desc:           "Only GET and HEAD are allowed",
+			method:         "POST",
+			path:           "/sdk.js",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "Method not allowed\n",
+		},
+		{
+			desc:            "Other paths are forwarded, even if the file exists",
+			method:          "GET",
+			path:            "/other.txt",
+			expectedStatus:  http.StatusOK,
+			expectedForward: true,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{static_assets_plugin.Factory}
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, _ := http.NewRequest(testCase.method, relayService.HttpUrl()+testCase.path, nil)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if _, err := catcherService.LastRequest(); (err == nil) != testCase.expectedForward {
+				t.Errorf("Test '%v': Expected forwarding to be %v", testCase.desc, testCase.expectedForward)
+			}
+			if testCase.expectedForward {
+				return
+			}
+			if string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+			}
+			if contentType := response.Header.Get("Content-Type"); testCase.expectedContentType != "" && contentType != testCase.expectedContentType {
+				t.Errorf("Test '%v': Expected Content-Type '%v' but got '%v'", testCase.desc, testCase.expectedContentType, contentType)
+			}
+			if cacheControl := response.Header.Get("Cache-Control"); cacheControl != testCase.expectedCacheControl {
+				t.Errorf("Test '%v': Expected Cache-Control '%v' but got '%v'", testCase.desc, testCase.expectedCacheControl, cacheControl)
+			}
+		})
+	}
+}
+
+func TestStaticAssetsRevalidation(t *testing.T) {
+	static_assets_plugin.EmbeddedAssets = fstest.MapFS{
+		"sdk.js": &fstest.MapFile{Data: []byte("window.sdk = {};")},
+	}
+	defer func() { static_assets_plugin.EmbeddedAssets = nil }()
+
+	configYaml := `static-assets:
+    paths:
+        - /sdk.js
+    cache-control: public, max-age=60
+`
+	plugins := []traffic.PluginFactory{static_assets_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		get := func(etag string) *http.Response {
+			request, _ := http.NewRequest("GET", relayService.HttpUrl()+"/sdk.js", nil)
+			if etag != "" {
+				request.Header.Set("If-None-Match", etag)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("Error GETing: %v", err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			return response
+		}
+
+		response := get("")
+		etag := response.Header.Get("ETag")
+		if response.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("Expected an embedded asset with an ETag but got status %v and ETag '%v'", response.StatusCode, etag)
+		}
+		if cacheControl := response.Header.Get("Cache-Control"); cacheControl != "public, max-age=60" {
+			t.Errorf("Expected the configured Cache-Control but got '%v'", cacheControl)
+		}
+
+		if response := get(etag); response.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected a matching ETag to produce a 304 but got %v", response.StatusCode)
+		}
+		if response := get(`"stale"`); response.StatusCode != http.StatusOK {
+			t.Errorf("Expected a stale ETag to produce a 200 but got %v", response.StatusCode)
+		}
+	})
+}
+
+func TestStaticAssetsConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"paths: [sdk.js]\n    dir: /tmp",
+		"paths: [/sdk.js]\n    dir: /nonexistent/relay-assets",
+		"paths: [/sdk.js]\n    dir: /dev/null",
+		"paths: [/sdk.js]", // This build has no embedded assets.
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("static-assets:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := static_assets_plugin.Factory.New(configFile.LookupOptionalSection("static-assets")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,476 @@
+// This plugin accepts requests on behalf of the target: matching requests are
+// written to a queue on disk and answered immediately with a 202 Accepted, and
+// a background forwarder sends them to the target later, retrying with
+// exponential backoff until the target accepts them. This suits ingest
+// endpoints, where client latency matters more than learning whether the
+// target accepted the request.
+//
+// Queued requests survive restarts, since the forwarder resumes with whatever
+// is in the queue directory when the relay starts; each request is forwarded
+// to the target it was queued for. Requests are forwarded roughly in the
+// order they were accepted, but a request which is waiting to be retried
+// doesn't hold up the ones behind it. Requests which the target rejects with a
+// client error are dropped, since retrying them won't help.
+//
+// Each relay needs its own queue directory; relays sharing a directory would
+// forward the same requests. The requests are sent by the plugin itself, so it
+// should run after every other plugin which modifies requests.
+
+package store_forward_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    storeForwardPluginFactory
+	pluginName = "store-forward"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// QueuedIdHeaderName is the response header which identifies a queued
+// request, so that clients can correlate it with the target's records.
+const QueuedIdHeaderName = "X-Relay-Queued-Id"
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+	defaultMaxQueued      = 10000
+
+	// sendTimeout bounds the time spent sending each queued request.
+	sendTimeout = 30 * time.Second
+
+	// cleanupInterval is how often requests older than max-age are removed.
+	cleanupInterval = time.Minute
+)
+
+type storeForwardPluginFactory struct{}
+
+func (f storeForwardPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f storeForwardPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	if directory, err := config.LookupOptional[string](configSection, "directory"); err != nil {
+		return nil, err
+	} else if directory == nil {
+		return nil, nil
+	}
+
+	storageOptions, err := storage.ReadOptions(configSection)
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &storeForwardPlugin{
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		maxQueued:      defaultMaxQueued,
+		transport:      http.DefaultTransport,
+		wake:           make(chan struct{}, 1),
+		retries:        map[string]*retryState{},
+	}
+
+	if err := config.ParseOptional(configSection, "paths", func(key string, patterns []string) error {
+		for _, pattern := range patterns {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, pattern, err)
+			}
+			plugin.paths = append(plugin.paths, match)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if initialBackoff, err := config.LookupOptional[time.Duration](configSection, "initial-backoff"); err != nil {
+		return nil, err
+	} else if initialBackoff != nil {
+		if *initialBackoff <= 0 {
+			return nil, fmt.Errorf(`Invalid initial-backoff "%v": must be positive`, *initialBackoff)
+		}
+		plugin.initialBackoff = *initialBackoff
+		plugin.maxBackoff = max(plugin.maxBackoff, *initialBackoff)
+	}
+
+	if maxBackoff, err := config.LookupOptional[time.Duration](configSection, "max-backoff"); err != nil {
+		return nil, err
+	} else if maxBackoff != nil {
+		if *maxBackoff < plugin.initialBackoff {
+			return nil, fmt.Errorf(`Invalid max-backoff "%v": must be at least initial-backoff`, *maxBackoff)
+		}
+		plugin.maxBackoff = *maxBackoff
+	}
+
+	if maxAttempts, err := config.LookupOptional[int](configSection, "max-attempts"); err != nil {
+		return nil, err
+	} else if maxAttempts != nil {
+		if *maxAttempts < 1 {
+			return nil, fmt.Errorf(`Invalid max-attempts "%v": must be at least 1`, *maxAttempts)
+		}
+		plugin.maxAttempts = *maxAttempts
+	}
+
+	if maxQueued, err := config.LookupOptional[int](configSection, "max-queued"); err != nil {
+		return nil, err
+	} else if maxQueued != nil {
+		if *maxQueued < 1 {
+			return nil, fmt.Errorf(`Invalid max-queued "%v": must be at least 1`, *maxQueued)
+		}
+		plugin.maxQueued = *maxQueued
+	}
+
+	if plugin.store, err = storage.NewStore(storageOptions); err != nil {
+		return nil, err
+	}
+	queued, err := plugin.store.List()
+	if err != nil {
+		return nil, err
+	}
+	plugin.queued.Store(int64(len(queued)))
+	plugin.store.StartCleanup(cleanupInterval)
+
+	logger.Printf("Queueing requests in %v (encrypted: %v); %v requests already queued", storageOptions.Directory, plugin.store.Encrypted(), len(queued))
+	for _, match := range plugin.paths {
+		logger.Printf(`Added rule: queue requests sent to "%s"`, match)
+	}
+
+	return plugin, nil
+}
+
+type storeForwardPlugin struct {
+	paths          []*regexp.Regexp // If non-empty, only requests sent to matching paths are queued.
+	initialBackoff time.Duration    // The delay before the first retry.
+	maxBackoff     time.Duration    // The longest delay between retries.
+	maxAttempts    int              // If non-zero, requests are dropped after this many failed attempts.
+	maxQueued      int              // Requests are rejected with a 503 while this many are queued.
+	store          *storage.Store
+	transport      http.RoundTripper
+	metrics        *metrics.PluginMetrics
+
+	start    sync.Once
+	wake     chan struct{} // Signals the forwarder that a request was queued.
+	queued   atomic.Int64  // The number of queued requests.
+	sequence atomic.Uint64 // Distinguishes requests queued at the same time.
+
+	// retries tracks the requests which have failed, and is only used by
+	// the forwarder. It's kept in memory, so requests are retried right away
+	// after a restart.
+	retries map[string]*retryState
+}
+
+type retryState struct {
+	attempts    int
+	nextAttempt time.Time
+}
+
+// queuedRequest is the form in which a request is stored in the queue. The
+// body is stored decoded, and encoded again when it's forwarded.
+type queuedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+func (plug *storeForwardPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *storeForwardPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+// SetTransport implements traffic.TransportPlugin. The forwarder starts once
+// the plugin has a transport, which is as soon as the relay is set up.
+func (plug *storeForwardPlugin) SetTransport(transport http.RoundTripper) {
+	plug.start.Do(func() {
+		plug.transport = transport
+		go plug.forward()
+	})
+}
+
+func (plug *storeForwardPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced || !queueable(request) {
+		return false
+	}
+	if len(plug.paths) > 0 && !plug.matchesPath(info.OriginalURL.Path) {
+		return false
+	}
+
+	if plug.queued.Load() >= int64(plug.maxQueued) {
+		logger.Printf("Rejecting request to %v: the queue is full", info.OriginalURL.Path)
+		http.Error(response, "Too many requests are queued", http.StatusServiceUnavailable)
+		return true
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
+		return true
+	}
+
+	// The relay headers describe the client, so they're added now rather
+	// than when the request is forwarded.
+	traffic.AddRelayHeaders(request)
+	data, err := json.Marshal(&queuedRequest{
+		Method: request.Method,
+		URL:    request.URL.String(),
+		Host:   request.Host,
+		Header: request.Header,
+		Body:   body,
+	})
+	if err != nil {
+		logger.Errorf("Error encoding request: %s", err)
+		http.Error(response, "Error queueing request", http.StatusInternalServerError)
+		return true
+	}
+
+	// Names sort in the order requests were queued, as a tie breaker for
+	// requests written within the file system's timestamp resolution.
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), plug.sequence.Add(1)%1000000)
+	if err := plug.store.Write(name, data); err != nil {
+		logger.Errorf("Error queueing request: %s", err)
+		plug.metrics.Error()
+		http.Error(response, "Error queueing request", http.StatusInternalServerError)
+		return true
+	}
+	plug.queued.Add(1)
+
+	select {
+	case plug.wake <- struct{}{}:
+	default:
+	}
+
+	response.Header().Set(QueuedIdHeaderName, name)
+	response.WriteHeader(http.StatusAccepted)
+	return true
+}
+
+// queueable returns true for requests which can be answered before they've
+// been relayed. Reads and websocket handshakes need the target's response.
+func queueable(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return false
+	}
+	return request.Header.Get("Upgrade") == ""
+}
+
+func (plug *storeForwardPlugin) matchesPath(path string) bool {
+	for _, match := range plug.paths {
+		if match.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward sends queued requests to the target, forever. After each pass over
+// the queue it waits until a request is queued or a retry is due.
+func (plug *storeForwardPlugin) forward() {
+	for {
+		wait := plug.forwardQueued()
+		timer := time.NewTimer(wait)
+		select {
+		case <-plug.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// forwardQueued attempts to send each queued request which isn't waiting to
+// be retried, and returns how long to wait before the next retry is due.
+func (plug *storeForwardPlugin) forwardQueued() time.Duration {
+	wait := plug.maxBackoff
+	names, err := plug.store.List()
+	if err != nil {
+		logger.Errorf("Error listing queued requests: %s", err)
+		return plug.initialBackoff
+	}
+	plug.queued.Store(int64(len(names)))
+
+	pending := make(map[string]bool, len(names))
+	for _, name := range names {
+		pending[name] = true
+		retry := plug.retries[name]
+		if retry != nil {
+			if untilRetry := time.Until(retry.nextAttempt); untilRetry > 0 {
+				wait = min(wait, untilRetry)
+				continue
+			}
+		} else {
+			retry = &retryState{}
+		}
+
+		delivered, err := plug.send(name)
+		if delivered {
+			plug.remove(name)
+			delete(plug.retries, name)
+			continue
+		}
+
+		retry.attempts++
+		if plug.maxAttempts > 0 && retry.attempts >= plug.maxAttempts {
+			logger.Errorf("Dropping queued request %v after %v attempts: %s", name, retry.attempts, err)
+			plug.metrics.Error()
+			plug.remove(name)
+			delete(plug.retries, name)
+			continue
+		}
+		delay := plug.backoff(retry.attempts)
+		logger.Printf("Error forwarding queued request %v (attempt %v); retrying in %v: %s", name, retry.attempts, delay, err)
+		retry.nextAttempt = time.Now().Add(delay)
+		plug.retries[name] = retry
+		wait = min(wait, delay)
+	}
+
+	// Forget requests which were removed by cleanup.
+	for name := range plug.retries {
+		if !pending[name] {
+			delete(plug.retries, name)
+		}
+	}
+	return wait
+}
+
+// backoff returns the delay before the next attempt, which doubles after
+// each failed attempt.
+func (plug *storeForwardPlugin) backoff(attempts int) time.Duration {
+	delay := plug.initialBackoff
+	for i := 1; i < attempts && delay < plug.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, plug.maxBackoff)
+}
+
+func (plug *storeForwardPlugin) remove(name string) {
+	if err := plug.store.Delete(name); err != nil {
+		logger.Errorf("Error removing queued request %v: %s", name, err)
+		return
+	}
+	plug.queued.Add(-1)
+}
+
+// send sends a queued request to the target. It returns true if the request
+// no longer needs to be sent, either because the target accepted it or
+// because the target rejected it with a client error, and otherwise returns
+// the reason it should be retried.
+func (plug *storeForwardPlugin) send(name string) (bool, error) {
+	data, err := plug.store.Read(name)
+	if err != nil {
+		return false, err
+	}
+	var queued queuedRequest
+	if err := json.Unmarshal(data, &queued); err != nil {
+		logger.Errorf("Dropping unreadable queued request %v: %s", name, err)
+		plug.metrics.Error()
+		return true, nil
+	}
+
+	request, err := queued.request()
+	if err != nil {
+		logger.Errorf("Dropping invalid queued request %v: %s", name, err)
+		plug.metrics.Error()
+		return true, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	targetResponse, err := plug.transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	io.Copy(io.Discard, targetResponse.Body)
+	targetResponse.Body.Close()
+
+	switch status := targetResponse.StatusCode; {
+	case status >= 200 && status <= 299:
+		return true, nil
+	case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+		return false, fmt.Errorf("Target responded with status %v", status)
+	case status >= 400 && status <= 499:
+		logger.Errorf("Dropping queued request %v: target responded with status %v", name, status)
+		plug.metrics.Error()
+		return true, nil
+	default:
+		return false, fmt.Errorf("Target responded with status %v", status)
+	}
+}
+
+// request reconstructs the request to send, encoding the body as the client
+// did.
+func (queued *queuedRequest) request() (*http.Request, error) {
+	targetURL, err := url.Parse(queued.URL)
+	if err != nil {
+		return nil, err
+	}
+	request := &http.Request{
+		Method:     queued.Method,
+		URL:        targetURL,
+		Host:       queued.Host,
+		Header:     queued.Header,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+
+	body := queued.Body
+	encoding, err := traffic.GetContentEncoding(request)
+	if err != nil {
+		return nil, err
+	}
+	if encoding != traffic.Identity && len(body) > 0 {
+		if body, err = traffic.EncodeData(body, encoding); err != nil {
+			return nil, err
+		}
+	}
+	traffic.SetRequestBody(request, body)
+	return request, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,348 @@
+package store_forward_plugin_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	store_forward_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/store-forward-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type forwardRequest struct {
+	method string
+	path   string
+	body   string
+	gzip   bool
+}
+
+func TestStoreForwardPlugin(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		config         string
+		requests       []forwardRequest // Sent in order.
+		failures       int              // The number of requests the target fails before succeeding.
+		expectedStatus []int
+		expectedBodies []string // The bodies the target receives, in order.
+		expectedQueued int      // The number of requests left in the queue.
+	}{
+		{
+			desc:   "Requests are accepted and forwarded",
+			config: "",
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "one"},
+				{method: "PUT", path: "/ingest", body: "two"},
+			},
+			expectedStatus: []int{http.StatusAccepted, http.StatusAccepted},
+			expectedBodies: []string{"one", "two"},
+		},
+		{
+			desc:   "Reads are relayed as is",
+			config: "",
+			requests: []forwardRequest{
+				{method: "GET", path: "/ingest"},
+			},
+			expectedStatus: []int{http.StatusOK},
+			expectedBodies: []string{""},
+		},
+		{
+			desc: "Requests to other paths are relayed as is",
+			config: `
+    paths:
+        - ^/ingest$
+`,
+			requests: []forwardRequest{
+				{method: "POST", path: "/other", body: "one"},
+			},
+			expectedStatus: []int{http.StatusOK},
+			expectedBodies: []string{"one"},
+		},
+		{
+			desc:   "Encoded bodies are forwarded encoded",
+			config: "",
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "compressed", gzip: true},
+			},
+			expectedStatus: []int{http.StatusAccepted},
+			expectedBodies: []string{"compressed"},
+		},
+		{
+			desc: "Failed requests are retried",
+			config: `
+    initial-backoff: 10ms
+`,
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "retried"},
+			},
+			failures:       2,
+			expectedStatus: []int{http.StatusAccepted},
+			expectedBodies: []string{"retried", "retried", "retried"},
+		},
+		{
+			desc: "Requests are dropped after max-attempts",
+			config: `
+    initial-backoff: 10ms
+    max-attempts: 2
+`,
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "dropped"},
+			},
+			failures:       5,
+			expectedStatus: []int{http.StatusAccepted},
+			expectedBodies: []string{"dropped", "dropped"},
+		},
+		{
+			desc:   "Requests rejected by the target are dropped",
+			config: "",
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "reject"},
+			},
+			expectedStatus: []int{http.StatusAccepted},
+			expectedBodies: []string{"reject"},
+		},
+		{
+			desc: "Requests are rejected once the queue is full",
+			config: `
+    initial-backoff: 1h
+    max-queued: 1
+`,
+			requests: []forwardRequest{
+				{method: "POST", path: "/ingest", body: "queued"},
+				{method: "POST", path: "/ingest", body: "rejected"},
+			},
+			failures:       1,
+			expectedStatus: []int{http.StatusAccepted, http.StatusServiceUnavailable},
+			expectedBodies: []string{"queued"},
+			expectedQueued: 1,
+		},
+	}
+
+	var mutex sync.Mutex
+	var receivedBodies []string
+	var failures int
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		encoding, _ := traffic.GetContentEncoding(request)
+		reader, err := traffic.WrapReader(request, encoding)
+		if err != nil {
+			t.Errorf("Error decoding request body: %v", err)
+			return
+		}
+		body, _ := io.ReadAll(reader)
+		mutex.Lock()
+		defer mutex.Unlock()
+		receivedBodies = append(receivedBodies, string(body))
+
+		if request.Header.Get(traffic.RelayVersionHeaderName) == "" {
+			t.Errorf("Expected every request to carry the relay headers")
+		}
+		if string(body) == "reject" {
+			response.WriteHeader(http.StatusBadRequest)
+		} else if failures > 0 {
+			failures--
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		directory := t.TempDir()
+		configFile, err := config.NewFileFromYamlString("store-forward:\n    directory: " + directory + "\n" + testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		plugin, err := store_forward_plugin.Factory.New(configFile.LookupOptionalSection("store-forward"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			continue
+		}
+
+		mutex.Lock()
+		receivedBodies = nil
+		failures = testCase.failures
+		mutex.Unlock()
+
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+
+		for i, forwardRequest := range testCase.requests {
+			body := []byte(forwardRequest.body)
+			if forwardRequest.gzip {
+				body = gzipData(body)
+			}
+			request, _ := http.NewRequest(forwardRequest.method, relayServer.URL+forwardRequest.path, bytes.NewReader(body))
+			if forwardRequest.gzip {
+				request.Header.Set("Content-Encoding", "gzip")
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus[i] {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus[i], response.StatusCode)
+			}
+			queuedId := response.Header.Get(store_forward_plugin.QueuedIdHeaderName)
+			if (response.StatusCode == http.StatusAccepted) != (queuedId != "") {
+				t.Errorf("Test '%v': Expected %v header only on accepted requests, but got '%v'", testCase.desc, store_forward_plugin.QueuedIdHeaderName, queuedId)
+			}
+		}
+
+		// Wait for the forwarder to finish with the queue.
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			mutex.Lock()
+			received := len(receivedBodies)
+			mutex.Unlock()
+			if received >= len(testCase.expectedBodies) && queueLength(t, directory) == testCase.expectedQueued {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		relayServer.Close()
+
+		mutex.Lock()
+		if !reflect.DeepEqual(receivedBodies, testCase.expectedBodies) {
+			t.Errorf("Test '%v': Expected target to receive %v but got %v", testCase.desc, testCase.expectedBodies, receivedBodies)
+		}
+		mutex.Unlock()
+		if queued := queueLength(t, directory); queued != testCase.expectedQueued {
+			t.Errorf("Test '%v': Expected %v queued requests but found %v", testCase.desc, testCase.expectedQueued, queued)
+		}
+	}
+}
+
+func TestStoreForwardResumesQueue(t *testing.T) {
+	directory := t.TempDir()
+	configYaml := "store-forward:\n    directory: " + directory + "\n    initial-backoff: 1h\n"
+
+	// The target fails the first attempt, so the request stays queued.
+	var attempts atomic.Int32
+	received := make(chan string, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		received <- string(body)
+		if attempts.Add(1) == 1 {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	newRelay := func() *httptest.Server {
+		configFile, err := config.NewFileFromYamlString(configYaml)
+		if err != nil {
+			t.Fatalf("Error parsing configuration YAML: %v", err)
+		}
+		plugin, err := store_forward_plugin.Factory.New(configFile.LookupOptionalSection("store-forward"))
+		if err != nil || plugin == nil {
+			t.Fatalf("Error creating plugin: %v", err)
+		}
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		return httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+	}
+
+	expectForwarded := func(when string) {
+		select {
+		case body := <-received:
+			if body != "persisted" {
+				t.Errorf("Expected target to receive 'persisted' %v but got '%v'", when, body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected the queued request to be forwarded %v", when)
+		}
+	}
+
+	firstRelay := newRelay()
+	response, err := http.Post(firstRelay.URL+"/ingest", "text/plain", strings.NewReader("persisted"))
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected status %v but got %v", http.StatusAccepted, response.StatusCode)
+	}
+	expectForwarded("before restarting")
+	firstRelay.Close()
+
+	// A relay started with the same directory forwards it again.
+	secondRelay := newRelay()
+	defer secondRelay.Close()
+	expectForwarded("after restarting")
+}
+
+func TestStoreForwardConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"paths:\n        - \"[\"",
+		"initial-backoff: 0s",
+		"max-backoff: soon",
+		"initial-backoff: 1m\n    max-backoff: 1s",
+		"max-attempts: 0",
+		"max-queued: -1",
+		"encryption-key: not-a-key",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("store-forward:\n    directory: " + t.TempDir() + "\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := store_forward_plugin.Factory.New(configFile.LookupOptionalSection("store-forward")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func gzipData(data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(data)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func queueLength(t *testing.T, directory string) int {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Errorf("Error reading queue directory: %v", err)
+	}
+	return len(entries)
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
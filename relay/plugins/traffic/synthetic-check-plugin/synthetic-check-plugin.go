@@ -0,0 +1,362 @@
+// This plugin monitors the target by sending it a synthetic request at a
+// regular interval and checking the response against expectations: its status,
+// its headers, and its body. The result of the most recent checks is reported
+// on the admin listener's readiness endpoint, so that a relay whose target is
+// failing is taken out of rotation, and as metrics.
+//
+// The plugin doesn't handle client requests at all; its checks are sent using
+// the relay's transport, so they're dialed and secured like relayed requests,
+// but they don't pass through the relay's other plugins.
+
+package synthetic_check_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"github.com/immersa-co/relay-core/relay/version"
+)
+
+var (
+	Factory    syntheticCheckPluginFactory
+	pluginName = "synthetic-check"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// UserAgent identifies the relay's synthetic checks to the target.
+const UserAgent = "relay-synthetic-check"
+
+const (
+	defaultInterval = 30 * time.Second
+	defaultTimeout  = 5 * time.Second
+
+	// maxBodySize bounds the amount of the response body matched against
+	// 'expect-body'.
+	maxBodySize = 1 << 20
+)
+
+type syntheticCheckPluginFactory struct{}
+
+func (f syntheticCheckPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f syntheticCheckPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	path, err := config.LookupOptional[string](configSection, "path")
+	if err != nil {
+		return nil, err
+	} else if path == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(*path, "/") {
+		return nil, fmt.Errorf(`Invalid path "%v": must start with '/'`, *path)
+	}
+	reference, err := url.Parse(*path)
+	if err != nil {
+		return nil, fmt.Errorf(`Invalid path "%v": %v`, *path, err)
+	}
+
+	plugin := &syntheticCheckPlugin{
+		path:             reference,
+		method:           http.MethodGet,
+		headers:          http.Header{},
+		interval:         defaultInterval,
+		timeout:          defaultTimeout,
+		expectStatus:     http.StatusOK,
+		failureThreshold: 1,
+		transport:        http.DefaultTransport,
+		stop:             make(chan struct{}),
+	}
+
+	if method, err := config.LookupOptional[string](configSection, "method"); err != nil {
+		return nil, err
+	} else if method != nil {
+		plugin.method = strings.ToUpper(*method)
+	}
+
+	if err := config.ParseOptional(configSection, "headers", func(_ string, value map[string]string) error {
+		for name, headerValue := range value {
+			plugin.headers.Set(name, headerValue)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if interval, err := config.LookupOptional[time.Duration](configSection, "interval"); err != nil {
+		return nil, err
+	} else if interval != nil {
+		if *interval <= 0 {
+			return nil, fmt.Errorf(`Invalid interval "%v": must be positive`, *interval)
+		}
+		plugin.interval = *interval
+	}
+
+	if timeout, err := config.LookupOptional[time.Duration](configSection, "timeout"); err != nil {
+		return nil, err
+	} else if timeout != nil {
+		if *timeout <= 0 {
+			return nil, fmt.Errorf(`Invalid timeout "%v": must be positive`, *timeout)
+		}
+		plugin.timeout = *timeout
+	}
+
+	if failureThreshold, err := config.LookupOptional[int](configSection, "failure-threshold"); err != nil {
+		return nil, err
+	} else if failureThreshold != nil {
+		if *failureThreshold < 1 {
+			return nil, fmt.Errorf(`Invalid failure-threshold "%v": must be at least 1`, *failureThreshold)
+		}
+		plugin.failureThreshold = *failureThreshold
+	}
+
+	if expectStatus, err := config.LookupOptional[int](configSection, "expect-status"); err != nil {
+		return nil, err
+	} else if expectStatus != nil {
+		if *expectStatus < 100 || *expectStatus > 599 {
+			return nil, fmt.Errorf(`Invalid expect-status "%v": must be an HTTP status code`, *expectStatus)
+		}
+		plugin.expectStatus = *expectStatus
+	}
+
+	if err := config.ParseOptional(configSection, "expect-headers", func(_ string, value map[string]string) error {
+		for name, pattern := range value {
+			match, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf(`Could not compile regular expression "%v" for header "%v": %v`, pattern, name, err)
+			}
+			plugin.expectHeaders = append(plugin.expectHeaders, headerExpectation{
+				name:  http.CanonicalHeaderKey(name),
+				match: match,
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// Headers are checked in a consistent order, so that a failing check
+	// always reports the same header.
+	sort.Slice(plugin.expectHeaders, func(i, j int) bool {
+		return plugin.expectHeaders[i].name < plugin.expectHeaders[j].name
+	})
+
+	if expectBody, err := config.LookupOptional[string](configSection, "expect-body"); err != nil {
+		return nil, err
+	} else if expectBody != nil {
+		match, err := regexp.Compile(*expectBody)
+		if err != nil {
+			return nil, fmt.Errorf(`Could not compile expect-body regular expression "%v": %v`, *expectBody, err)
+		}
+		plugin.expectBody = match
+	}
+
+	logger.Printf("Checking %v %v every %v, expecting status %v", plugin.method, plugin.path, plugin.interval, plugin.expectStatus)
+	return plugin, nil
+}
+
+type syntheticCheckPlugin struct {
+	path             *url.URL    // The path (and query) of the synthetic request.
+	method           string      // The method of the synthetic request.
+	headers          http.Header // Headers to add to the synthetic request.
+	interval         time.Duration
+	timeout          time.Duration
+	failureThreshold int // The number of consecutive failures before the relay isn't ready.
+
+	expectStatus  int
+	expectHeaders []headerExpectation
+	expectBody    *regexp.Regexp // If non-nil, the response body must match.
+
+	target    *url.URL
+	transport http.RoundTripper
+	metrics   *metrics.PluginMetrics
+	start     sync.Once
+	stop      chan struct{} // Closed when the plugin is closed.
+	stopOnce  sync.Once
+
+	mutex               sync.Mutex
+	checked             bool  // True once a check has completed.
+	consecutiveFailures int   // The number of checks which have failed since one passed.
+	lastError           error // The reason the most recent check failed, if it did.
+}
+
+// headerExpectation is a regular expression which a response header must
+// match. Missing headers are matched as empty.
+type headerExpectation struct {
+	name  string
+	match *regexp.Regexp
+}
+
+func (plug *syntheticCheckPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *syntheticCheckPlugin) SetPluginMetrics(metrics *metrics.PluginMetrics) {
+	plug.metrics = metrics
+}
+
+// SetTarget implements traffic.TargetPlugin.
+func (plug *syntheticCheckPlugin) SetTarget(target *url.URL) {
+	plug.target = target
+}
+
+// SetTransport implements traffic.TransportPlugin. Checks start once the
+// plugin has a transport, which is as soon as the relay is set up.
+func (plug *syntheticCheckPlugin) SetTransport(transport http.RoundTripper) {
+	plug.start.Do(func() {
+		plug.transport = transport
+		go plug.run()
+	})
+}
+
+func (plug *syntheticCheckPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	return false
+}
+
+// Ready implements traffic.ReadinessPlugin. The relay isn't ready until the
+// first check has completed, or while failure-threshold checks in a row have
+// failed.
+func (plug *syntheticCheckPlugin) Ready() error {
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+	if !plug.checked {
+		return errors.New("The first synthetic check hasn't completed")
+	}
+	if plug.consecutiveFailures >= plug.failureThreshold {
+		return fmt.Errorf("%v synthetic checks in a row failed; the last failed with: %v", plug.consecutiveFailures, plug.lastError)
+	}
+	return nil
+}
+
+// Close implements io.Closer, stopping the checks.
+func (plug *syntheticCheckPlugin) Close() error {
+	plug.stopOnce.Do(func() {
+		close(plug.stop)
+	})
+	return nil
+}
+
+// run checks the target right away, and then every interval, until the
+// plugin is closed.
+func (plug *syntheticCheckPlugin) run() {
+	ticker := time.NewTicker(plug.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := plug.check()
+		select {
+		case <-plug.stop:
+			return
+		default:
+		}
+		plug.record(err, time.Since(start))
+
+		select {
+		case <-plug.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (plug *syntheticCheckPlugin) record(err error, latency time.Duration) {
+	plug.metrics.SyntheticCheck(err == nil, latency)
+
+	plug.mutex.Lock()
+	defer plug.mutex.Unlock()
+	plug.checked = true
+	if err == nil {
+		if plug.consecutiveFailures > 0 {
+			logger.Printf("Synthetic check passed after %v failures", plug.consecutiveFailures)
+		}
+		plug.consecutiveFailures = 0
+		plug.lastError = nil
+		return
+	}
+	plug.consecutiveFailures++
+	plug.lastError = err
+	logger.Warnf("Synthetic check failed: %v", err)
+}
+
+// check sends the synthetic request to the target, and returns an error if
+// the response doesn't meet expectations.
+func (plug *syntheticCheckPlugin) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), plug.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-plug.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	request, err := http.NewRequestWithContext(ctx, plug.method, plug.target.ResolveReference(plug.path).String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header = plug.headers.Clone()
+	request.Header.Set("User-Agent", UserAgent)
+	request.Header.Set(traffic.RelayVersionHeaderName, version.RelayRelease)
+
+	response, err := plug.transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != plug.expectStatus {
+		return fmt.Errorf("Expected status %v but got %v", plug.expectStatus, response.StatusCode)
+	}
+	for _, expectation := range plug.expectHeaders {
+		if value := response.Header.Get(expectation.name); !expectation.match.MatchString(value) {
+			return fmt.Errorf(`Expected header %v to match "%s" but got "%v"`, expectation.name, expectation.match, value)
+		}
+	}
+	if plug.expectBody != nil {
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxBodySize))
+		if err != nil {
+			return fmt.Errorf("Error reading response body: %v", err)
+		}
+		if !plug.expectBody.Match(body) {
+			return fmt.Errorf(`Expected body to match "%s"`, plug.expectBody)
+		}
+	}
+	return nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,297 @@
+package synthetic_check_plugin_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	synthetic_check_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/synthetic-check-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+type targetResponse struct {
+	status      int
+	contentType string
+	body        string
+}
+
+func TestSyntheticCheckPlugin(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		config         string
+		response       targetResponse
+		expectedReady  bool
+		expectedResult string // The result the checks are counted as.
+		expectedError  string // A substring of the readiness error.
+	}{
+		{
+			desc:           "Passing checks leave the relay ready",
+			config:         "",
+			response:       targetResponse{status: 200, body: "ok"},
+			expectedReady:  true,
+			expectedResult: "passed",
+		},
+		{
+			desc:           "An unexpected status fails",
+			config:         "",
+			response:       targetResponse{status: 502},
+			expectedReady:  false,
+			expectedResult: "failed",
+			expectedError:  "Expected status 200 but got 502",
+		},
+		{
+			desc:           "The expected status can be configured",
+			config:         "expect-status: 204\n",
+			response:       targetResponse{status: 204},
+			expectedReady:  true,
+			expectedResult: "passed",
+		},
+		{
+			desc:           "Headers must match",
+			config:         "expect-headers:\n    content-type: ^application/json\n",
+			response:       targetResponse{status: 200, contentType: "text/html"},
+			expectedReady:  false,
+			expectedResult: "failed",
+			expectedError:  `Expected header Content-Type to match "^application/json" but got "text/html"`,
+		},
+		{
+			desc:           "Matching headers pass",
+			config:         "expect-headers:\n    content-type: ^application/json\n",
+			response:       targetResponse{status: 200, contentType: "application/json; charset=utf-8"},
+			expectedReady:  true,
+			expectedResult: "passed",
+		},
+		{
+			desc:           "The body must match",
+			config:         `expect-body: '"status":\s*"ok"'` + "\n",
+			response:       targetResponse{status: 200, body: `{"status": "degraded"}`},
+			expectedReady:  false,
+			expectedResult: "failed",
+			expectedError:  "Expected body to match",
+		},
+		{
+			desc:           "A matching body passes",
+			config:         `expect-body: '"status":\s*"ok"'` + "\n",
+			response:       targetResponse{status: 200, body: `{"status": "ok"}`},
+			expectedReady:  true,
+			expectedResult: "passed",
+		},
+		{
+			desc:           "Failures are tolerated up to the threshold",
+			config:         "failure-threshold: 1000\n",
+			response:       targetResponse{status: 500},
+			expectedReady:  true,
+			expectedResult: "failed",
+		},
+	}
+
+	var mutex sync.Mutex
+	var response targetResponse
+	var received []*http.Request
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, r)
+		if response.contentType != "" {
+			w.Header().Set("Content-Type", response.contentType)
+		}
+		w.WriteHeader(response.status)
+		io.WriteString(w, response.body)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range testCases {
+		mutex.Lock()
+		response = testCase.response
+		received = nil
+		mutex.Unlock()
+
+		relayService, ok := startRelay(t, targetURL, "synthetic-check:\n    path: /healthz?deep=true\n    interval: 10ms\n    headers:\n        Authorization: Bearer token\n"+indent(testCase.config))
+		if !ok {
+			continue
+		}
+
+		status, body := waitForReadiness(t, relayService, testCase.expectedReady)
+		if expectedStatus := map[bool]int{true: 200, false: 503}[testCase.expectedReady]; status != expectedStatus {
+			t.Errorf("Test '%v': Expected readiness status %v but got %v: %v", testCase.desc, expectedStatus, status, body)
+		}
+		if !strings.Contains(body, testCase.expectedError) {
+			t.Errorf("Test '%v': Expected readiness body to contain '%v' but got '%v'", testCase.desc, testCase.expectedError, body)
+		}
+
+		metrics := test.ReadMetrics(t, relayService)
+		if metrics.Value("relay_synthetic_checks_total", "result", testCase.expectedResult) == 0 {
+			t.Errorf("Test '%v': Expected synthetic checks to be counted as %v", testCase.desc, testCase.expectedResult)
+		}
+
+		mutex.Lock()
+		if len(received) == 0 {
+			t.Errorf("Test '%v': Expected the target to receive synthetic checks", testCase.desc)
+		} else {
+			request := received[0]
+			if request.URL.String() != "/healthz?deep=true" {
+				t.Errorf("Test '%v': Expected a check of /healthz?deep=true but got %v", testCase.desc, request.URL)
+			}
+			if request.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("Test '%v': Expected the configured headers but got %v", testCase.desc, request.Header)
+			}
+			if request.Header.Get("User-Agent") != synthetic_check_plugin.UserAgent {
+				t.Errorf("Test '%v': Expected User-Agent %v but got %v", testCase.desc, synthetic_check_plugin.UserAgent, request.Header.Get("User-Agent"))
+			}
+		}
+		mutex.Unlock()
+
+		relayService.Close()
+	}
+}
+
+func TestSyntheticCheckPluginRecovers(t *testing.T) {
+	var mutex sync.Mutex
+	status := http.StatusServiceUnavailable
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	relayService, ok := startRelay(t, targetURL, "synthetic-check:\n    path: /healthz\n    interval: 10ms\n")
+	if !ok {
+		return
+	}
+	defer relayService.Close()
+
+	if status, body := waitForReadiness(t, relayService, false); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the relay not to be ready while checks fail but got %v: %v", status, body)
+	}
+
+	mutex.Lock()
+	status = http.StatusOK
+	mutex.Unlock()
+
+	if status, body := waitForReadiness(t, relayService, true); status != http.StatusOK {
+		t.Errorf("Expected the relay to be ready once checks pass but got %v: %v", status, body)
+	}
+	if passing := test.ReadMetrics(t, relayService).Value("relay_synthetic_check_passing"); passing != 1 {
+		t.Errorf("Expected relay_synthetic_check_passing to be 1 but got %v", passing)
+	}
+}
+
+func TestSyntheticCheckPluginConfig(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+	}{
+		{desc: "Relative path", config: "path: healthz\n"},
+		{desc: "Negative interval", config: "path: /healthz\ninterval: -1s\n"},
+		{desc: "Zero timeout", config: "path: /healthz\ntimeout: 0s\n"},
+		{desc: "Zero failure threshold", config: "path: /healthz\nfailure-threshold: 0\n"},
+		{desc: "Invalid status", config: "path: /healthz\nexpect-status: 1000\n"},
+		{desc: "Invalid header expression", config: "path: /healthz\nexpect-headers:\n    Content-Type: '('\n"},
+		{desc: "Invalid body expression", config: "path: /healthz\nexpect-body: '('\n"},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString("synthetic-check:\n" + indent(testCase.config))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		if _, err := synthetic_check_plugin.Factory.New(configFile.LookupOptionalSection("synthetic-check")); err == nil {
+			t.Errorf("Test '%v': Expected an error", testCase.desc)
+		}
+	}
+
+	configFile, _ := config.NewFileFromYamlString("synthetic-check:\n    path:\n")
+	if plugin, err := synthetic_check_plugin.Factory.New(configFile.LookupOptionalSection("synthetic-check")); plugin != nil || err != nil {
+		t.Errorf("Expected the plugin to be inactive without a path, but got %v, %v", plugin, err)
+	}
+}
+
+// startRelay starts a relay with the synthetic-check plugin and an admin
+// listener.
+func startRelay(t *testing.T, targetURL *url.URL, configYaml string) (*relay.Service, bool) {
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Errorf("Error parsing configuration YAML: %v", err)
+		return nil, false
+	}
+	plugin, err := synthetic_check_plugin.Factory.New(configFile.LookupOptionalSection("synthetic-check"))
+	if err != nil || plugin == nil {
+		t.Errorf("Error creating plugin: %v", err)
+		return nil, false
+	}
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	relayService := relay.NewService(options, []traffic.Plugin{plugin})
+	if err := relayService.StartAdmin("localhost", 0, configFile); err != nil {
+		t.Errorf("Error starting admin listener: %v", err)
+		return nil, false
+	}
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Errorf("Error starting relay: %v", err)
+		relayService.Close()
+		return nil, false
+	}
+	return relayService, true
+}
+
+// waitForReadiness polls the readiness endpoint until it reports the expected
+// readiness, or a deadline passes, and returns its last status and body.
+func waitForReadiness(t *testing.T, relayService *relay.Service, ready bool) (int, string) {
+	var status int
+	var body string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		response, err := http.Get(relayService.AdminUrl() + relay.ReadyPath)
+		if err != nil {
+			t.Errorf("Error GETing %v: %v", relay.ReadyPath, err)
+			return 0, ""
+		}
+		data, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		status, body = response.StatusCode, string(data)
+		// Before the first check completes, the relay isn't ready either.
+		if (status == http.StatusOK) == ready && !strings.Contains(body, "hasn't completed") {
+			break
+		}
+	}
+	return status, body
+}
+
+func indent(yaml string) string {
+	if yaml == "" {
+		return ""
+	}
+	return "    " + strings.ReplaceAll(strings.TrimSuffix(yaml, "\n"), "\n", "\n    ") + "\n"
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
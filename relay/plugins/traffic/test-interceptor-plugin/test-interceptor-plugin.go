@@ -5,30 +5,40 @@ package test_interceptor_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var (
 	Factory    testInterceptorPluginFactory
 	pluginName = "test-interceptor"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type HandleRequestListener func(request *http.Request)
 
+// ConnectionListener is invoked with a connection event ("connect" or
+// "disconnect") and information about the connection.
+type ConnectionListener func(event string, info traffic.ConnectionInfo)
+
 func NewFactoryWithListener(listener HandleRequestListener) traffic.PluginFactory {
 	return testInterceptorPluginFactory{
 		listener: listener,
 	}
 }
 
+func NewFactoryWithConnectionListener(listener ConnectionListener) traffic.PluginFactory {
+	return testInterceptorPluginFactory{
+		connectionListener: listener,
+	}
+}
+
 type testInterceptorPluginFactory struct {
-	listener HandleRequestListener
+	listener           HandleRequestListener
+	connectionListener ConnectionListener
 }
 
 func (f testInterceptorPluginFactory) Name() string {
@@ -37,12 +47,14 @@ func (f testInterceptorPluginFactory) Name() string {
 
 func (f testInterceptorPluginFactory) New(configFile *config.Section) (traffic.Plugin, error) {
 	return &testInterceptorPlugin{
-		listener: f.listener,
+		listener:           f.listener,
+		connectionListener: f.connectionListener,
 	}, nil
 }
 
 type testInterceptorPlugin struct {
-	listener HandleRequestListener
+	listener           HandleRequestListener
+	connectionListener ConnectionListener
 }
 
 func (plug testInterceptorPlugin) Name() string {
@@ -54,10 +66,24 @@ func (plug testInterceptorPlugin) HandleRequest(
 	request *http.Request,
 	info traffic.RequestInfo,
 ) bool {
-	plug.listener(request)
+	if plug.listener != nil {
+		plug.listener(request)
+	}
 	return false
 }
 
+func (plug testInterceptorPlugin) OnConnect(info traffic.ConnectionInfo) {
+	if plug.connectionListener != nil {
+		plug.connectionListener("connect", info)
+	}
+}
+
+func (plug testInterceptorPlugin) OnDisconnect(info traffic.ConnectionInfo) {
+	if plug.connectionListener != nil {
+		plug.connectionListener("disconnect", info)
+	}
+}
+
 /*
 Copyright 2022 FullStory, Inc.
 
@@ -0,0 +1,294 @@
+// This plugin makes sure relayed requests carry trace context headers, so that
+// the target's observability systems can correlate them with the rest of a
+// trace. It can start a new trace for requests which arrive without one, by
+// adding a W3C traceparent header, and translate between the W3C traceparent
+// header and Zipkin's B3 headers, for targets which only understand one of
+// them.
+//
+// Trace context which the client sent is never replaced; translation only adds
+// the headers of the other format when they're missing.
+
+package tracing_headers_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    tracingHeadersPluginFactory
+	pluginName = "tracing-headers"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+// The directions in which trace context can be translated.
+const (
+	translateB3ToW3C = "b3-to-w3c"
+	translateW3CToB3 = "w3c-to-b3"
+	translateBoth    = "both"
+)
+
+// The formats in which B3 headers are written.
+const (
+	b3Multi  = "multi"
+	b3Single = "single"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	b3Header          = "b3"
+	b3TraceIDHeader   = "X-B3-TraceId"
+	b3SpanIDHeader    = "X-B3-SpanId"
+	b3SampledHeader   = "X-B3-Sampled"
+	b3FlagsHeader     = "X-B3-Flags"
+)
+
+type tracingHeadersPluginFactory struct{}
+
+func (f tracingHeadersPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f tracingHeadersPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &tracingHeadersPlugin{sampleInjected: true, b3Format: b3Multi}
+
+	if inject, err := config.LookupOptional[bool](configSection, "inject"); err != nil {
+		return nil, err
+	} else if inject != nil {
+		plugin.inject = *inject
+	}
+
+	if sampled, err := config.LookupOptional[bool](configSection, "sampled"); err != nil {
+		return nil, err
+	} else if sampled != nil {
+		plugin.sampleInjected = *sampled
+	}
+
+	if err := config.ParseOptional(configSection, "translate", func(key string, value string) error {
+		switch value {
+		case translateB3ToW3C:
+			plugin.b3ToW3C = true
+		case translateW3CToB3:
+			plugin.w3cToB3 = true
+		case translateBoth:
+			plugin.b3ToW3C = true
+			plugin.w3cToB3 = true
+		default:
+			return fmt.Errorf(`Invalid value "%v" for option "translate": must be "%v", "%v", or "%v"`, value, translateB3ToW3C, translateW3CToB3, translateBoth)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "b3-format", func(key string, value string) error {
+		if value != b3Multi && value != b3Single {
+			return fmt.Errorf(`Invalid value "%v" for option "b3-format": must be "%v" or "%v"`, value, b3Multi, b3Single)
+		}
+		plugin.b3Format = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if !plugin.inject && !plugin.b3ToW3C && !plugin.w3cToB3 {
+		return nil, nil
+	}
+
+	if plugin.inject {
+		logger.Printf("Added rule: start traces for requests without trace context (sampled: %v)", plugin.sampleInjected)
+	}
+	if plugin.b3ToW3C {
+		logger.Printf("Added rule: translate B3 headers to traceparent")
+	}
+	if plugin.w3cToB3 {
+		logger.Printf("Added rule: translate traceparent to %v B3 headers", plugin.b3Format)
+	}
+	return plugin, nil
+}
+
+type tracingHeadersPlugin struct {
+	inject         bool
+	sampleInjected bool
+	b3ToW3C        bool
+	w3cToB3        bool
+	b3Format       string
+}
+
+// traceContext identifies a span within a trace.
+type traceContext struct {
+	traceID string // 32 lowercase hex digits.
+	spanID  string // 16 lowercase hex digits.
+	sampled bool
+}
+
+func (plug *tracingHeadersPlugin) Name() string {
+	return pluginName
+}
+
+func (plug *tracingHeadersPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	w3c := parseTraceparent(request.Header)
+	b3 := parseB3(request.Header)
+
+	if w3c == nil && b3 != nil && plug.b3ToW3C {
+		setTraceparent(request.Header, b3)
+	}
+	if b3 == nil && w3c != nil && plug.w3cToB3 {
+		plug.setB3(request.Header, w3c)
+	}
+	if w3c == nil && b3 == nil && plug.inject {
+		context, err := newTraceContext(plug.sampleInjected)
+		if err != nil {
+			logger.Errorf("Error starting trace: %s", err)
+			return false
+		}
+		setTraceparent(request.Header, context)
+		if plug.w3cToB3 {
+			plug.setB3(request.Header, context)
+		}
+	}
+	return false
+}
+
+// parseTraceparent returns the trace context in the W3C traceparent header,
+// or nil if it's missing or invalid.
+func parseTraceparent(header http.Header) *traceContext {
+	values := header.Values(traceparentHeader)
+	if len(values) != 1 {
+		return nil
+	}
+	fields := strings.Split(strings.TrimSpace(values[0]), "-")
+	if len(fields) < 4 || !isHex(fields[0], 2) || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return nil
+	}
+	if !isHex(fields[1], 32) || !isHex(fields[2], 16) || !isHex(fields[3], 2) {
+		return nil
+	}
+	if isZero(fields[1]) || isZero(fields[2]) {
+		return nil
+	}
+	flags, _ := hex.DecodeString(fields[3])
+	return &traceContext{traceID: fields[1], spanID: fields[2], sampled: flags[0]&1 == 1}
+}
+
+// parseB3 returns the trace context in the single b3 header or the multiple
+// X-B3-* headers, or nil if neither is present and valid. 64-bit trace IDs
+// are padded to 128 bits, as W3C trace context requires.
+func parseB3(header http.Header) *traceContext {
+	if single := header.Get(b3Header); single != "" {
+		fields := strings.Split(strings.TrimSpace(single), "-")
+		if len(fields) < 2 {
+			// Sampling decisions without IDs can't be translated.
+			return nil
+		}
+		sampled := len(fields) > 2 && (fields[2] == "1" || fields[2] == "d")
+		return newB3Context(fields[0], fields[1], sampled)
+	}
+
+	traceID := header.Get(b3TraceIDHeader)
+	spanID := header.Get(b3SpanIDHeader)
+	if traceID == "" || spanID == "" {
+		return nil
+	}
+	sampled := header.Get(b3SampledHeader)
+	debug := header.Get(b3FlagsHeader) == "1"
+	return newB3Context(traceID, spanID, debug || sampled == "1" || strings.EqualFold(sampled, "true"))
+}
+
+func newB3Context(traceID string, spanID string, sampled bool) *traceContext {
+	traceID = strings.ToLower(traceID)
+	spanID = strings.ToLower(spanID)
+	if isHex(traceID, 16) {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || isZero(traceID) || isZero(spanID) {
+		return nil
+	}
+	return &traceContext{traceID: traceID, spanID: spanID, sampled: sampled}
+}
+
+// newTraceContext starts a new trace with random IDs.
+func newTraceContext(sampled bool) (*traceContext, error) {
+	ids := make([]byte, 24)
+	if _, err := rand.Read(ids); err != nil {
+		return nil, err
+	}
+	return &traceContext{
+		traceID: hex.EncodeToString(ids[:16]),
+		spanID:  hex.EncodeToString(ids[16:]),
+		sampled: sampled,
+	}, nil
+}
+
+func setTraceparent(header http.Header, context *traceContext) {
+	flags := "00"
+	if context.sampled {
+		flags = "01"
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%v-%v-%v", context.traceID, context.spanID, flags))
+}
+
+func (plug *tracingHeadersPlugin) setB3(header http.Header, context *traceContext) {
+	sampled := "0"
+	if context.sampled {
+		sampled = "1"
+	}
+	if plug.b3Format == b3Single {
+		header.Set(b3Header, fmt.Sprintf("%v-%v-%v", context.traceID, context.spanID, sampled))
+		return
+	}
+	header.Set(b3TraceIDHeader, context.traceID)
+	header.Set(b3SpanIDHeader, context.spanID)
+	header.Set(b3SampledHeader, sampled)
+}
+
+// isHex returns true if value is length lowercase hexadecimal digits.
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(value string) bool {
+	return strings.Trim(value, "0") == ""
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
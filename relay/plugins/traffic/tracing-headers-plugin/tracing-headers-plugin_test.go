@@ -0,0 +1,222 @@
+package tracing_headers_plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	tracing_headers_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/tracing-headers-plugin"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var relayedHeaders = []string{"Traceparent", "B3", "X-B3-Traceid", "X-B3-Spanid", "X-B3-Sampled"}
+
+func TestTracingHeadersPlugin(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		headers  map[string]string
+		expected map[string]string // Regular expressions matching the relayed headers; missing headers must be absent.
+	}{
+		{
+			desc:    "Traces are started for requests without trace context",
+			config:  "inject: true",
+			headers: map[string]string{},
+			expected: map[string]string{
+				"Traceparent": "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$",
+			},
+		},
+		{
+			desc:    "Injected traces may be unsampled",
+			config:  "inject: true\n    sampled: false",
+			headers: map[string]string{},
+			expected: map[string]string{
+				"Traceparent": "^00-[0-9a-f]{32}-[0-9a-f]{16}-00$",
+			},
+		},
+		{
+			desc:    "Existing trace context is passed through",
+			config:  "inject: true",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			expected: map[string]string{
+				"Traceparent": "^00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01$",
+			},
+		},
+		{
+			desc:    "Invalid trace context is replaced",
+			config:  "inject: true",
+			headers: map[string]string{"Traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+			expected: map[string]string{
+				"Traceparent": "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$",
+			},
+		},
+		{
+			desc:    "Requests with B3 headers aren't given a new trace",
+			config:  "inject: true",
+			headers: map[string]string{"X-B3-Traceid": "80f198ee56343ba864fe8b2a57d3eff7", "X-B3-Spanid": "e457b5a2e4d86bd1"},
+			expected: map[string]string{
+				"X-B3-Traceid": "^80f198ee56343ba864fe8b2a57d3eff7$",
+				"X-B3-Spanid":  "^e457b5a2e4d86bd1$",
+			},
+		},
+		{
+			desc:   "Multiple B3 headers are translated to traceparent",
+			config: "translate: b3-to-w3c",
+			headers: map[string]string{
+				"X-B3-Traceid": "80F198EE56343BA864FE8B2A57D3EFF7",
+				"X-B3-Spanid":  "e457b5a2e4d86bd1",
+				"X-B3-Sampled": "1",
+			},
+			expected: map[string]string{
+				"Traceparent":  "^00-80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-01$",
+				"X-B3-Traceid": "^80F198EE56343BA864FE8B2A57D3EFF7$",
+				"X-B3-Spanid":  "^e457b5a2e4d86bd1$",
+				"X-B3-Sampled": "^1$",
+			},
+		},
+		{
+			desc:    "Single B3 headers with 64-bit trace IDs are translated to traceparent",
+			config:  "translate: both",
+			headers: map[string]string{"B3": "64fe8b2a57d3eff7-e457b5a2e4d86bd1-d"},
+			expected: map[string]string{
+				"Traceparent": "^00-000000000000000064fe8b2a57d3eff7-e457b5a2e4d86bd1-01$",
+				"B3":          "^64fe8b2a57d3eff7-e457b5a2e4d86bd1-d$",
+			},
+		},
+		{
+			desc:    "Sampling-only B3 headers aren't translated",
+			config:  "translate: b3-to-w3c",
+			headers: map[string]string{"B3": "0"},
+			expected: map[string]string{
+				"B3": "^0$",
+			},
+		},
+		{
+			desc:    "Traceparent is translated to multiple B3 headers",
+			config:  "translate: w3c-to-b3",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+			expected: map[string]string{
+				"Traceparent":  "^00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00$",
+				"X-B3-Traceid": "^4bf92f3577b34da6a3ce929d0e0e4736$",
+				"X-B3-Spanid":  "^00f067aa0ba902b7$",
+				"X-B3-Sampled": "^0$",
+			},
+		},
+		{
+			desc:    "Traceparent is translated to a single B3 header",
+			config:  "translate: w3c-to-b3\n    b3-format: single",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			expected: map[string]string{
+				"Traceparent": "^00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01$",
+				"B3":          "^4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1$",
+			},
+		},
+		{
+			desc:    "Injected traces are also written as B3 headers",
+			config:  "inject: true\n    translate: w3c-to-b3\n    b3-format: single",
+			headers: map[string]string{},
+			expected: map[string]string{
+				"Traceparent": "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$",
+				"B3":          "^[0-9a-f]{32}-[0-9a-f]{16}-1$",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		var relayed http.Header
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			relayed = request.Header.Clone()
+		}))
+		targetURL, _ := url.Parse(target.URL)
+
+		configFile, err := config.NewFileFromYamlString("tracing-headers:\n    " + testCase.config + "\n")
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			target.Close()
+			continue
+		}
+		plugin, err := tracing_headers_plugin.Factory.New(configFile.LookupOptionalSection("tracing-headers"))
+		if err != nil || plugin == nil {
+			t.Errorf("Test '%v': Error creating plugin: %v", testCase.desc, err)
+			target.Close()
+			continue
+		}
+
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		handler := traffic.NewHandler(options, []traffic.Plugin{plugin})
+
+		request := httptest.NewRequest("GET", "http://relay.example/", nil)
+		for name, value := range testCase.headers {
+			request.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		target.Close()
+
+		for _, name := range relayedHeaders {
+			value := relayed.Get(name)
+			pattern, ok := testCase.expected[name]
+			if !ok {
+				if value != "" {
+					t.Errorf("Test '%v': Expected no %v header but got %q", testCase.desc, name, value)
+				}
+				continue
+			}
+			if !regexp.MustCompile(pattern).MatchString(value) {
+				t.Errorf("Test '%v': Expected %v header matching %v but got %q", testCase.desc, name, pattern, value)
+			}
+		}
+	}
+}
+
+func TestTracingHeadersPluginDisabled(t *testing.T) {
+	configFile, err := config.NewFileFromYamlString("tracing-headers:\n    inject: false\n    translate:\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	if plugin, err := tracing_headers_plugin.Factory.New(configFile.LookupOptionalSection("tracing-headers")); plugin != nil || err != nil {
+		t.Errorf("Expected the plugin to be disabled but got %v (%v)", plugin, err)
+	}
+}
+
+func TestTracingHeadersConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"translate: zipkin",
+		"inject: true\n    b3-format: compact",
+		"inject: sometimes",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("tracing-headers:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := tracing_headers_plugin.Factory.New(configFile.LookupOptionalSection("tracing-headers")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
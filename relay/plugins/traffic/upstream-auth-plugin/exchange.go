@@ -0,0 +1,190 @@
+package upstream_auth_plugin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+// Token type and grant type URIs from RFC 8693 section 3.
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// maxExchangedTokens bounds the number of exchanged tokens which are cached,
+// so that a flood of distinct subject tokens can't exhaust memory.
+const maxExchangedTokens = 10000
+
+// unauthenticatedError indicates that the client's own credentials are
+// missing or were rejected, so the client, rather than the relay, is at fault.
+type unauthenticatedError struct {
+	reason string
+}
+
+func (err *unauthenticatedError) Error() string {
+	return err.reason
+}
+
+// tokenExchangeSource exchanges the bearer token sent by the client for a
+// token scoped to the target, using OAuth2 token exchange (RFC 8693). The
+// client's token is never relayed to the target. Exchanged tokens are cached
+// per subject token until shortly before they expire; since each source has
+// a single audience, this caches them per subject and audience.
+type tokenExchangeSource struct {
+	tokenURL     string
+	audience     string
+	scopes       string // Space-separated, as in the "scope" parameter.
+	clientID     string // If set, the relay authenticates to the token endpoint.
+	clientSecret *secrets.Secret
+	client       *http.Client
+	clock        clock.Clock
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]*exchangedToken // Keyed by a hash of the subject token.
+}
+
+type exchangedToken struct {
+	token     string
+	refreshAt time.Time
+}
+
+func readTokenExchangeSource(configSection *config.Section) (*tokenExchangeSource, error) {
+	tokenURL, err := config.LookupOptional[string](configSection, "token-exchange-url")
+	if err != nil || tokenURL == nil {
+		return nil, err
+	}
+	if parsedURL, err := url.Parse(*tokenURL); err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return nil, fmt.Errorf(`Invalid token-exchange-url "%v"`, *tokenURL)
+	}
+
+	source := &tokenExchangeSource{
+		tokenURL: *tokenURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		clock:    clock.Real,
+		cache:    map[[sha256.Size]byte]*exchangedToken{},
+	}
+
+	for key, value := range map[string]*string{
+		"token-exchange-audience":  &source.audience,
+		"token-exchange-scopes":    &source.scopes,
+		"token-exchange-client-id": &source.clientID,
+	} {
+		if optionValue, err := config.LookupOptional[string](configSection, key); err != nil {
+			return nil, err
+		} else if optionValue != nil {
+			*value = *optionValue
+		}
+	}
+
+	if source.clientSecret, err = secrets.Lookup(configSection, "token-exchange-client-secret"); err != nil {
+		return nil, err
+	}
+	if (source.clientID == "") != (source.clientSecret == nil) {
+		return nil, fmt.Errorf(`Options "token-exchange-client-id" and "token-exchange-client-secret" must be specified together`)
+	}
+
+	return source, nil
+}
+
+func (source *tokenExchangeSource) credentials(request *http.Request) (string, error) {
+	subjectToken, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || subjectToken == "" {
+		return "", &unauthenticatedError{"A bearer token is required"}
+	}
+	key := sha256.Sum256([]byte(subjectToken))
+	now := source.clock.Now()
+
+	source.mutex.Lock()
+	cached := source.cache[key]
+	source.mutex.Unlock()
+	if cached != nil && now.Before(cached.refreshAt) {
+		return "Bearer " + cached.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrantType},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+	}
+	if source.audience != "" {
+		form.Set("audience", source.audience)
+	}
+	if source.scopes != "" {
+		form.Set("scope", source.scopes)
+	}
+
+	token, lifetime, err := requestToken(source.client, source.tokenURL, form, source.clientID, source.clientSecret)
+	var endpointError *tokenError
+	if errors.As(err, &endpointError) && endpointError.code == "invalid_grant" {
+		// The subject token is invalid or expired.
+		return "", &unauthenticatedError{"The bearer token was rejected"}
+	} else if err != nil {
+		return "", err
+	}
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if len(source.cache) >= maxExchangedTokens {
+		source.evict(now)
+	}
+	source.cache[key] = &exchangedToken{
+		token:     token,
+		refreshAt: now.Add(lifetime - min(tokenRefreshMargin, lifetime/2)),
+	}
+	return "Bearer " + token, nil
+}
+
+// evict makes room in the cache by removing tokens which are due to be
+// refreshed, or, if there are none, every token. It must be called with the
+// mutex held.
+func (source *tokenExchangeSource) evict(now time.Time) {
+	for key, cached := range source.cache {
+		if !now.Before(cached.refreshAt) {
+			delete(source.cache, key)
+		}
+	}
+	if len(source.cache) >= maxExchangedTokens {
+		clear(source.cache)
+	}
+}
+
+func (source *tokenExchangeSource) setClock(clock clock.Clock) {
+	source.clock = clock
+}
+
+func (source *tokenExchangeSource) describe() string {
+	if source.audience != "" {
+		return fmt.Sprintf(`the client's token exchanged for audience "%v" at %v`, source.audience, source.tokenURL)
+	}
+	return fmt.Sprintf(`the client's token exchanged at %v`, source.tokenURL)
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
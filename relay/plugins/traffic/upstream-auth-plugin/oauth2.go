@@ -0,0 +1,162 @@
+package upstream_auth_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+// oauth2Source sends an access token obtained using the OAuth2 client
+// credentials grant (RFC 6749 section 4.4).
+type oauth2Source struct {
+	tokenURL     string
+	clientID     string
+	clientSecret *secrets.Secret
+	scopes       string // Space-separated, as in the "scope" parameter.
+	client       *http.Client
+	clock        clock.Clock
+
+	mutex     sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+func (source *oauth2Source) credentials(request *http.Request) (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	now := source.clock.Now()
+	if source.token == "" || !now.Before(source.refreshAt) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if source.scopes != "" {
+			form.Set("scope", source.scopes)
+		}
+		token, lifetime, err := requestToken(source.client, source.tokenURL, form, source.clientID, source.clientSecret)
+		if err != nil {
+			return "", err
+		}
+		logger.Printf("Obtained access token from %v, valid for %v", source.tokenURL, lifetime)
+		source.token = token
+		source.refreshAt = now.Add(lifetime - min(tokenRefreshMargin, lifetime/2))
+	}
+	return "Bearer " + source.token, nil
+}
+
+func (source *oauth2Source) setClock(clock clock.Clock) {
+	source.clock = clock
+}
+
+// invalidate discards the cached access token.
+func (source *oauth2Source) invalidate() {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.token = ""
+}
+
+func (source *oauth2Source) describe() string {
+	return fmt.Sprintf(`OAuth2 access token for "%v" from %v`, source.clientID, source.tokenURL)
+}
+
+// tokenError is an error response from a token endpoint (RFC 6749 section
+// 5.2).
+type tokenError struct {
+	status      int
+	code        string // e.g. "invalid_grant"
+	description string
+}
+
+func (err *tokenError) Error() string {
+	if err.description != "" {
+		return fmt.Sprintf("Token endpoint returned %v (%v): %v", err.status, err.code, err.description)
+	}
+	return fmt.Sprintf("Token endpoint returned %v (%v)", err.status, err.code)
+}
+
+// requestToken posts a token request to a token endpoint and returns the
+// access token it issues, along with the token's lifetime. If clientID is
+// non-empty, the client authenticates using basic authentication.
+func requestToken(
+	client *http.Client,
+	tokenURL string,
+	form url.Values,
+	clientID string,
+	clientSecret *secrets.Secret,
+) (string, time.Duration, error) {
+	request, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if clientID != "" {
+		secret, err := clientSecret.Value()
+		if err != nil {
+			return "", 0, err
+		}
+		// Client credentials are form-encoded before being used in basic
+		// authentication (RFC 6749 section 2.3.1).
+		request.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	var tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil && response.StatusCode == http.StatusOK {
+		return "", 0, fmt.Errorf("Invalid token response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", 0, &tokenError{
+			status:      response.StatusCode,
+			code:        tokenResponse.Error,
+			description: tokenResponse.ErrorDescription,
+		}
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", 0, fmt.Errorf("Token endpoint returned no access token")
+	}
+	if tokenResponse.TokenType != "" && !strings.EqualFold(tokenResponse.TokenType, "bearer") {
+		return "", 0, fmt.Errorf(`Unsupported token type "%v"`, tokenResponse.TokenType)
+	}
+
+	lifetime := defaultTokenLifetime
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResponse.ExpiresIn) * time.Second
+	}
+	return tokenResponse.AccessToken, lifetime, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,269 @@
+// This plugin attaches credentials for the target to relayed requests, so that
+// clients never need to hold them. Any credentials sent by the client are
+// replaced. The credentials may be a static bearer token, a username and
+// password for basic authentication, or an access token obtained from an
+// OAuth2 token endpoint using the client credentials grant, which is refreshed
+// before it expires. Alternatively, the client's own bearer token may be
+// exchanged for one scoped to the target, using OAuth2 token exchange, so that
+// the target never sees the client's token. Tokens, passwords, and client secrets are read via the
+// secrets package, so they can be supplied in files and rotated.
+
+package upstream_auth_plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    upstreamAuthPluginFactory
+	pluginName = "upstream-auth"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	defaultHeader = "Authorization"
+
+	// Access tokens are refreshed this long before they expire, or halfway
+	// through their lifetime if that's sooner, so that requests in flight
+	// don't reach the target with an expired token.
+	tokenRefreshMargin = time.Minute
+
+	// How long to use an access token whose lifetime the token endpoint
+	// didn't specify.
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+type upstreamAuthPluginFactory struct{}
+
+func (f upstreamAuthPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f upstreamAuthPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	var sources []credentialSource
+
+	if token, err := secrets.Lookup(configSection, "bearer-token"); err != nil {
+		return nil, err
+	} else if token != nil {
+		sources = append(sources, &bearerSource{token: token})
+	}
+
+	if username, err := config.LookupOptional[string](configSection, "basic-username"); err != nil {
+		return nil, err
+	} else if password, err := secrets.Lookup(configSection, "basic-password"); err != nil {
+		return nil, err
+	} else if username != nil || password != nil {
+		if username == nil || password == nil {
+			return nil, fmt.Errorf(`Options "basic-username" and "basic-password" must be specified together`)
+		}
+		sources = append(sources, &basicSource{username: *username, password: password})
+	}
+
+	if oauth2, err := readOAuth2Source(configSection); err != nil {
+		return nil, err
+	} else if oauth2 != nil {
+		sources = append(sources, oauth2)
+	}
+
+	if exchange, err := readTokenExchangeSource(configSection); err != nil {
+		return nil, err
+	} else if exchange != nil {
+		sources = append(sources, exchange)
+	}
+
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf(`Only one of bearer, basic, OAuth2, and token exchange credentials may be configured`)
+	}
+
+	plugin := &upstreamAuthPlugin{
+		header: defaultHeader,
+		source: sources[0],
+	}
+	if header, err := config.LookupOptional[string](configSection, "header"); err != nil {
+		return nil, err
+	} else if header != nil {
+		plugin.header = http.CanonicalHeaderKey(*header)
+	}
+
+	logger.Printf(`Added rule: set "%s" to %s`, plugin.header, plugin.source.describe())
+	return plugin, nil
+}
+
+func readOAuth2Source(configSection *config.Section) (*oauth2Source, error) {
+	tokenURL, err := config.LookupOptional[string](configSection, "oauth2-token-url")
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := config.LookupOptional[string](configSection, "oauth2-client-id")
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := secrets.Lookup(configSection, "oauth2-client-secret")
+	if err != nil {
+		return nil, err
+	}
+	scopes, err := config.LookupOptional[string](configSection, "oauth2-scopes")
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenURL == nil && clientID == nil && clientSecret == nil {
+		return nil, nil
+	}
+	if tokenURL == nil || clientID == nil || clientSecret == nil {
+		return nil, fmt.Errorf(`Options "oauth2-token-url", "oauth2-client-id", and "oauth2-client-secret" must be specified together`)
+	}
+	if parsedURL, err := url.Parse(*tokenURL); err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return nil, fmt.Errorf(`Invalid oauth2-token-url "%v"`, *tokenURL)
+	}
+
+	source := &oauth2Source{
+		tokenURL:     *tokenURL,
+		clientID:     *clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		clock:        clock.Real,
+	}
+	if scopes != nil {
+		source.scopes = *scopes
+	}
+	return source, nil
+}
+
+type upstreamAuthPlugin struct {
+	header string // The header in which credentials are sent to the target.
+	source credentialSource
+}
+
+func (plug *upstreamAuthPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *upstreamAuthPlugin) SetClock(clock clock.Clock) {
+	if source, ok := plug.source.(clockedSource); ok {
+		source.setClock(clock)
+	}
+}
+
+func (plug *upstreamAuthPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	credentials, err := plug.source.credentials(request)
+	var unauthenticated *unauthenticatedError
+	if errors.As(err, &unauthenticated) {
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(response, unauthenticated.Error(), http.StatusUnauthorized)
+		return true
+	} else if err != nil {
+		logger.Errorf("Error obtaining upstream credentials: %v", err)
+		http.Error(response, "Upstream credentials unavailable", http.StatusBadGateway)
+		return true
+	}
+
+	if _, ok := plug.source.(*tokenExchangeSource); ok {
+		// The client's token must never reach the target.
+		request.Header.Del("Authorization")
+	}
+	request.Header.Set(plug.header, credentials)
+	return false
+}
+
+// HandleResponse implements traffic.ResponsePlugin. If the target rejects the
+// credentials, a cached access token is discarded, so that the next request
+// obtains a new one rather than failing until the token expires.
+func (plug *upstreamAuthPlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	if response.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	if oauth2, ok := plug.source.(*oauth2Source); ok {
+		oauth2.invalidate()
+	}
+}
+
+// clockedSource is implemented by credential sources which cache tokens until
+// they expire.
+type clockedSource interface {
+	setClock(clock clock.Clock)
+}
+
+// credentialSource produces the credentials sent to the target with a
+// request.
+type credentialSource interface {
+	credentials(request *http.Request) (string, error)
+	describe() string // A description which doesn't reveal the credentials.
+}
+
+// bearerSource sends a static bearer token.
+type bearerSource struct {
+	token *secrets.Secret
+}
+
+func (source *bearerSource) credentials(request *http.Request) (string, error) {
+	token, err := source.token.Value()
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+func (source *bearerSource) describe() string {
+	return fmt.Sprintf("bearer token (%v)", source.token)
+}
+
+// basicSource sends a username and password using basic authentication.
+type basicSource struct {
+	username string
+	password *secrets.Secret
+}
+
+func (source *basicSource) credentials(request *http.Request) (string, error) {
+	password, err := source.password.Value()
+	if err != nil {
+		return "", err
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(source.username+":"+password)), nil
+}
+
+func (source *basicSource) describe() string {
+	return fmt.Sprintf(`basic credentials for "%v" (%v)`, source.username, source.password)
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,268 @@
+package wasm_filter_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// fakeModule stands in for a compiled module, so that the handling of its
+// output can be tested without the WASM runtime.
+type fakeModule struct {
+	output string        // The JSON the module returns.
+	err    error         // The error the module returns instead.
+	delay  time.Duration // How long the module takes, unless the context is done first.
+	input  *filterInput  // The input of the last call.
+}
+
+func (fake *fakeModule) filter(ctx context.Context, input []byte) ([]byte, error) {
+	fake.input = &filterInput{}
+	if err := json.Unmarshal(input, fake.input); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(fake.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	return []byte(fake.output), nil
+}
+
+func (fake *fakeModule) Close() error {
+	return nil
+}
+
+func TestFilter(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		modules        []*fakeModule
+		failOpen       bool
+		maxBodyBytes   int64
+		url            string
+		body           string
+		expectedStatus int    // If the request isn't relayed.
+		expectedBody   string // Of the response if the request isn't relayed, or of the request if it is.
+		expectedURL    string
+		expectedHeader http.Header
+		expectOmitted  bool // Whether the first module's input omits the body.
+	}{
+		{
+			desc:         "Requests are let through unchanged without output",
+			modules:      []*fakeModule{{output: ""}},
+			url:          "/events?page=2",
+			body:         "hello",
+			expectedBody: "hello",
+			expectedURL:  "/events?page=2",
+		},
+		{
+			desc:         "Modules may continue explicitly",
+			modules:      []*fakeModule{{output: `{"verdict": "continue"}`}},
+			url:          "/events",
+			body:         "hello",
+			expectedBody: "hello",
+			expectedURL:  "/events",
+		},
+		{
+			desc: "Modules may change the URL, headers, and body",
+			modules: []*fakeModule{{output: `{
+				"url": "/scrubbed?page=2",
+				"set_headers": {"X-Scrubbed": "true"},
+				"remove_headers": ["X-Secret"],
+				"body": "` + base64("[redacted]") + `"
+			}`}},
+			url:            "/events",
+			body:           "secret@example.com",
+			expectedBody:   "[redacted]",
+			expectedURL:    "/scrubbed?page=2",
+			expectedHeader: http.Header{"X-Scrubbed": {"true"}, "X-Secret": nil},
+		},
+		{
+			desc:           "Modules may reject requests",
+			modules:        []*fakeModule{{output: `{"verdict": "reject", "status": 422, "reason": "Contains a card number"}`}},
+			url:            "/events",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedBody:   "Contains a card number\n",
+		},
+		{
+			desc:           "Rejections are 403s by default",
+			modules:        []*fakeModule{{output: `{"verdict": "reject"}`}},
+			url:            "/events",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Forbidden\n",
+		},
+		{
+			desc: "Modules run in order, and see earlier changes",
+			modules: []*fakeModule{
+				{output: `{"body": "` + base64("first") + `"}`},
+				{output: `{"verdict": "reject", "reason": "second"}`},
+			},
+			url:            "/events",
+			body:           "original",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "second\n",
+		},
+		{
+			desc:           "Requests which a module fails to filter aren't relayed",
+			modules:        []*fakeModule{{err: fmt.Errorf("unreachable")}},
+			url:            "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay filter\n",
+		},
+		{
+			desc:           "Invalid output is a failure",
+			modules:        []*fakeModule{{output: `{"verdict": "maybe"}`}},
+			url:            "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay filter\n",
+		},
+		{
+			desc:           "Rejections must have error statuses",
+			modules:        []*fakeModule{{output: `{"verdict": "reject", "status": 200}`}},
+			url:            "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay filter\n",
+		},
+		{
+			desc:           "Modules which take too long fail",
+			modules:        []*fakeModule{{delay: time.Second}},
+			url:            "/events",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay filter\n",
+		},
+		{
+			desc: "Failures let requests through if failing open",
+			modules: []*fakeModule{
+				{err: fmt.Errorf("unreachable")},
+				{output: `{"set_headers": {"X-Scrubbed": "true"}}`},
+			},
+			failOpen:       true,
+			url:            "/events",
+			body:           "hello",
+			expectedBody:   "hello",
+			expectedURL:    "/events",
+			expectedHeader: http.Header{"X-Scrubbed": {"true"}},
+		},
+		{
+			desc:          "Large bodies are omitted",
+			modules:       []*fakeModule{{output: ""}},
+			maxBodyBytes:  4,
+			url:           "/events",
+			body:          "hello",
+			expectedBody:  "hello",
+			expectedURL:   "/events",
+			expectOmitted: true,
+		},
+		{
+			desc:           "Omitted bodies can't be replaced",
+			modules:        []*fakeModule{{output: `{"body": ""}`}},
+			maxBodyBytes:   4,
+			url:            "/events",
+			body:           "hello",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Error in relay filter\n",
+			expectOmitted:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		plugin := &wasmFilterPlugin{
+			timeout:      50 * time.Millisecond,
+			maxBodyBytes: defaultMaxBodyBytes,
+			failOpen:     testCase.failOpen,
+		}
+		if testCase.maxBodyBytes != 0 {
+			plugin.maxBodyBytes = testCase.maxBodyBytes
+		}
+		for i, module := range testCase.modules {
+			plugin.modules = append(plugin.modules, &filterModule{
+				name:   fmt.Sprintf("module-%d", i),
+				module: module,
+				config: map[string]interface{}{"index": i},
+			})
+		}
+
+		request := httptest.NewRequest("POST", "http://relay.example.com"+testCase.url, strings.NewReader(testCase.body))
+		request.Header.Set("X-Secret", "hunter2")
+		recorder := httptest.NewRecorder()
+		serviced := plugin.HandleRequest(recorder, request, traffic.RequestInfo{})
+
+		if input := testCase.modules[0].input; input != nil && input.BodyOmitted != testCase.expectOmitted {
+			t.Errorf("Test '%v': Expected the body to be omitted: %v, but got %v", testCase.desc, testCase.expectOmitted, input.BodyOmitted)
+		}
+		if testCase.expectedStatus != 0 {
+			if !serviced || recorder.Code != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, recorder.Code)
+			}
+			if body := recorder.Body.String(); body != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+			}
+			continue
+		}
+
+		if serviced {
+			t.Errorf("Test '%v': Expected the request to be relayed, but got status %v", testCase.desc, recorder.Code)
+			continue
+		}
+		if body, _ := io.ReadAll(request.Body); string(body) != testCase.expectedBody {
+			t.Errorf("Test '%v': Expected the request body %q but got %q", testCase.desc, testCase.expectedBody, body)
+		}
+		if url := request.URL.RequestURI(); url != testCase.expectedURL {
+			t.Errorf("Test '%v': Expected URL %v but got %v", testCase.desc, testCase.expectedURL, url)
+		}
+		for name, values := range testCase.expectedHeader {
+			if value := request.Header.Get(name); len(values) == 0 && value != "" || len(values) > 0 && value != values[0] {
+				t.Errorf("Test '%v': Expected %v %v but got '%v'", testCase.desc, name, values, value)
+			}
+		}
+	}
+}
+
+func TestFilterInput(t *testing.T) {
+	module := &fakeModule{}
+	plugin := &wasmFilterPlugin{
+		modules:      []*filterModule{{name: "module", module: module, config: map[string]interface{}{"mode": "strict"}}},
+		timeout:      time.Second,
+		maxBodyBytes: defaultMaxBodyBytes,
+	}
+
+	request := httptest.NewRequest("PUT", "http://relay.example.com/events?page=2", strings.NewReader("hello"))
+	request.Header.Set("X-Tenant", "acme")
+	plugin.HandleRequest(httptest.NewRecorder(), request, traffic.RequestInfo{})
+
+	input := module.input
+	if input == nil {
+		t.Fatalf("Expected the module to be called")
+	}
+	if input.Method != "PUT" || input.URL != "/events?page=2" || input.Host != "relay.example.com" {
+		t.Errorf("Expected PUT relay.example.com /events?page=2 but got %v %v %v", input.Method, input.Host, input.URL)
+	}
+	if tenant := input.Headers["X-Tenant"]; len(tenant) != 1 || tenant[0] != "acme" {
+		t.Errorf("Expected X-Tenant [acme] but got %v", tenant)
+	}
+	if string(input.Body) != "hello" || input.BodyOmitted {
+		t.Errorf("Expected the body 'hello' but got %q (omitted: %v)", input.Body, input.BodyOmitted)
+	}
+	if input.Config["mode"] != "strict" {
+		t.Errorf("Expected the module's config but got %v", input.Config)
+	}
+	// The body can still be relayed.
+	if body, _ := io.ReadAll(request.Body); string(body) != "hello" {
+		t.Errorf("Expected the request body to be preserved but got %q", body)
+	}
+}
+
+func base64(value string) string {
+	encoded, _ := json.Marshal([]byte(value))
+	return strings.Trim(string(encoded), `"`)
+}
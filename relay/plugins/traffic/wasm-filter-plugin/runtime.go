@@ -0,0 +1,119 @@
+package wasm_filter_plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wazeroModule is a module compiled by wazero. Each call instantiates it
+// afresh, so that modules can't keep state between requests, and so that
+// calls can run concurrently.
+type wazeroModule struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+func compileModule(name string, wasm []byte) (module, error) {
+	ctx := context.Background()
+	// Calls are abandoned once their context is done, so that the timeout
+	// applies to modules which never return.
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	compiled, err := compile(ctx, runtime, name, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	return &wazeroModule{name: name, runtime: runtime, compiled: compiled}, nil
+}
+
+func compile(ctx context.Context, runtime wazero.Runtime, name string, wasm []byte) (wazero.CompiledModule, error) {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		return nil, err
+	}
+	if _, err := runtime.NewHostModuleBuilder(hostModuleName).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, caller api.Module, ptr uint32, size uint32) {
+			if message, ok := caller.Memory().Read(ptr, size); ok {
+				logger.Printf("%v: %s", name, message)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx); err != nil {
+		return nil, err
+	}
+
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, err
+	}
+	if len(compiled.ExportedMemories()) == 0 {
+		return nil, fmt.Errorf("Module doesn't export its memory")
+	}
+	exports := compiled.ExportedFunctions()
+	for _, export := range []string{allocExport, filterExport} {
+		if _, ok := exports[export]; !ok {
+			return nil, fmt.Errorf(`Module doesn't export "%v"`, export)
+		}
+	}
+	return compiled, nil
+}
+
+func (wasm *wazeroModule) filter(ctx context.Context, input []byte) ([]byte, error) {
+	// Modules are instantiated anonymously, so that instances for concurrent
+	// requests don't conflict. Only reactor modules' initialization function
+	// is run; a command module's _start would exit once main returned.
+	instance, err := wasm.runtime.InstantiateModule(ctx, wasm.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStderr(&logWriter{name: wasm.name}))
+	if err != nil {
+		return nil, err
+	}
+	defer instance.Close(context.Background())
+
+	results, err := instance.ExportedFunction(allocExport).Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("Error calling %v: %v", allocExport, err)
+	}
+	inputPtr := uint32(results[0])
+	if !instance.Memory().Write(inputPtr, input) {
+		return nil, fmt.Errorf("%v returned an address outside of the module's memory", allocExport)
+	}
+
+	results, err = instance.ExportedFunction(filterExport).Call(ctx, uint64(inputPtr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("Error calling %v: %v", filterExport, err)
+	}
+	outputPtr, outputLen := uint32(results[0]>>32), uint32(results[0])
+	if outputLen == 0 {
+		return nil, nil
+	}
+	output, ok := instance.Memory().Read(outputPtr, outputLen)
+	if !ok {
+		return nil, fmt.Errorf("%v returned an address outside of the module's memory", filterExport)
+	}
+	// The memory is released when the instance is closed.
+	return bytes.Clone(output), nil
+}
+
+func (wasm *wazeroModule) Close() error {
+	return wasm.runtime.Close(context.Background())
+}
+
+// logWriter logs what a module writes to stderr.
+type logWriter struct {
+	name string
+}
+
+func (writer *logWriter) Write(data []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		logger.Printf("%v: %s", writer.name, line)
+	}
+	return len(data), nil
+}
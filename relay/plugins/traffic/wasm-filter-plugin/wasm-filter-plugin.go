@@ -0,0 +1,385 @@
+// This plugin runs request filters compiled to WebAssembly, so that custom
+// sanitization logic can be deployed as .wasm files rather than as a custom
+// relay. Each module listed in 'modules' is loaded when the relay starts, and
+// every request is passed to each in turn; a module may let the request
+// through, change its URL, headers, or body, or reject it.
+//
+// Modules implement a small ABI. They must export their memory and two
+// functions:
+//
+//	relay_alloc(size i32) -> i32
+//	relay_filter(ptr i32, len i32) -> i64
+//
+// The relay calls relay_alloc for a buffer of 'size' bytes, writes a JSON
+// filterInput describing the request into it, and calls relay_filter with its
+// address and length. relay_filter returns the address of a JSON filterOutput
+// in its upper 32 bits and its length in the lower 32; a length of zero lets
+// the request through unchanged. Modules may import relay.log(ptr i32, len
+// i32) to log a message, and the WASI preview 1 functions, whose stderr is
+// logged; they have no access to the filesystem or network.
+//
+// Each request gets a fresh instance of each module, so modules can't keep
+// state between requests. Modules which fail, or take longer than 'timeout',
+// cause the client to receive a 502, unless 'fail-open' is set. Bodies larger
+// than 'max-body-bytes' aren't passed to modules.
+
+package wasm_filter_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    wasmFilterPluginFactory
+	pluginName = "wasm-filter"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	defaultTimeout      = 100 * time.Millisecond
+	defaultMaxBodyBytes = 1 << 20
+)
+
+// The names of the functions which modules import and export.
+const (
+	hostModuleName = "relay"
+	allocExport    = "relay_alloc"
+	filterExport   = "relay_filter"
+)
+
+// ConfigModule is a module listed in the 'modules' option. Its Config is
+// passed to it with every request.
+type ConfigModule struct {
+	Name   string // If empty, the file's name is used.
+	Path   string
+	Config map[string]interface{}
+}
+
+// filterInput is the JSON which describes a request to a module.
+type filterInput struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"` // The path and query.
+	Host    string              `json:"host"`
+	Headers map[string][]string `json:"headers"`
+	// Body is base64-encoded, and omitted if the request is larger than
+	// 'max-body-bytes'.
+	Body        []byte                 `json:"body"`
+	BodyOmitted bool                   `json:"body_omitted,omitempty"`
+	Config      map[string]interface{} `json:"config,omitempty"`
+}
+
+// filterOutput is the JSON with which a module tells the relay what to do
+// with a request.
+type filterOutput struct {
+	// Verdict is "continue", the default, or "reject", to respond to the
+	// client with Status and Reason instead of relaying the request.
+	Verdict string `json:"verdict"`
+	Status  int    `json:"status"` // If zero, rejected requests receive a 403.
+	Reason  string `json:"reason"`
+
+	URL           string            `json:"url"` // If set, the path and query to relay the request to.
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+	// Body, if present, replaces the request's body. It's base64-encoded, so
+	// an empty string removes the body.
+	Body []byte `json:"body"`
+}
+
+const (
+	verdictContinue = "continue"
+	verdictReject   = "reject"
+)
+
+// module is a compiled filter module. It's implemented by runtime.go, using
+// the wazero runtime.
+type module interface {
+	// filter calls the module's relay_filter function with input, and
+	// returns its output, or nil if it returned none.
+	filter(ctx context.Context, input []byte) ([]byte, error)
+	Close() error
+}
+
+type wasmFilterPluginFactory struct{}
+
+func (f wasmFilterPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f wasmFilterPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	plugin := &wasmFilterPlugin{
+		timeout:      defaultTimeout,
+		maxBodyBytes: defaultMaxBodyBytes,
+	}
+
+	if timeout, err := config.LookupOptional[time.Duration](configSection, "timeout"); err != nil {
+		return nil, err
+	} else if timeout != nil {
+		if *timeout <= 0 {
+			return nil, fmt.Errorf(`Invalid timeout "%v": must be positive`, *timeout)
+		}
+		plugin.timeout = *timeout
+	}
+	if maxBodyBytes, err := config.LookupOptional[int64](configSection, "max-body-bytes"); err != nil {
+		return nil, err
+	} else if maxBodyBytes != nil {
+		if *maxBodyBytes < 0 {
+			return nil, fmt.Errorf(`Invalid max-body-bytes "%v": must not be negative`, *maxBodyBytes)
+		}
+		plugin.maxBodyBytes = *maxBodyBytes
+	}
+	if failOpen, err := config.LookupOptional[bool](configSection, "fail-open"); err != nil {
+		return nil, err
+	} else if failOpen != nil {
+		plugin.failOpen = *failOpen
+	}
+
+	var configModules []ConfigModule
+	if err := config.ParseOptional(configSection, "modules", func(key string, value []ConfigModule) error {
+		for _, configModule := range value {
+			if configModule.Path == "" {
+				return fmt.Errorf(`Every module must have a "path"`)
+			}
+		}
+		configModules = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(configModules) == 0 {
+		return nil, nil
+	}
+
+	for _, configModule := range configModules {
+		name := configModule.Name
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(configModule.Path), ".wasm")
+		}
+		wasm, err := os.ReadFile(configModule.Path)
+		if err != nil {
+			plugin.Close()
+			return nil, fmt.Errorf(`Error reading module "%v": %v`, name, err)
+		}
+		compiled, err := compileModule(name, wasm)
+		if err != nil {
+			plugin.Close()
+			return nil, fmt.Errorf(`Error loading module "%v": %v`, name, err)
+		}
+		plugin.modules = append(plugin.modules, &filterModule{
+			name:   name,
+			module: compiled,
+			config: configModule.Config,
+		})
+		logger.Printf(`Added rule: filter requests with module "%v" (%v)`, name, configModule.Path)
+	}
+	return plugin, nil
+}
+
+// filterModule is a loaded module, with its configuration.
+type filterModule struct {
+	name   string
+	module module
+	config map[string]interface{}
+}
+
+type wasmFilterPlugin struct {
+	modules      []*filterModule
+	timeout      time.Duration
+	maxBodyBytes int64
+	failOpen     bool
+	metrics      *metrics.PluginMetrics
+}
+
+func (plug *wasmFilterPlugin) Name() string {
+	return pluginName
+}
+
+// SetPluginMetrics implements traffic.MetricsPlugin.
+func (plug *wasmFilterPlugin) SetPluginMetrics(pluginMetrics *metrics.PluginMetrics) {
+	plug.metrics = pluginMetrics
+}
+
+// Close implements io.Closer, by releasing every module.
+func (plug *wasmFilterPlugin) Close() error {
+	for _, filterModule := range plug.modules {
+		filterModule.module.Close()
+	}
+	return nil
+}
+
+func (plug *wasmFilterPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	if info.Serviced {
+		return false
+	}
+
+	for _, filterModule := range plug.modules {
+		if serviced := plug.filter(filterModule, response, request); serviced {
+			return true
+		}
+	}
+	return false
+}
+
+// filter passes a request to a module, and applies its output.
+func (plug *wasmFilterPlugin) filter(
+	filterModule *filterModule,
+	response http.ResponseWriter,
+	request *http.Request,
+) bool {
+	fail := func(err error) bool {
+		plug.metrics.Error()
+		if plug.failOpen {
+			logger.Errorf(`%s %s: module "%v" failed, relaying the request anyway: %v`, request.Method, request.URL.Path, filterModule.name, err)
+			return false
+		}
+		logger.Errorf(`%s %s: module "%v" failed: %v`, request.Method, request.URL.Path, filterModule.name, err)
+		http.Error(response, "Error in relay filter", http.StatusBadGateway)
+		return true
+	}
+
+	body, omitted, err := plug.readBody(request)
+	if err != nil {
+		return fail(fmt.Errorf("Error reading request body: %v", err))
+	}
+	input, err := json.Marshal(&filterInput{
+		Method:      request.Method,
+		URL:         request.URL.RequestURI(),
+		Host:        request.Host,
+		Headers:     request.Header,
+		Body:        body,
+		BodyOmitted: omitted,
+		Config:      filterModule.config,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), plug.timeout)
+	defer cancel()
+	outputJson, err := filterModule.module.filter(ctx, input)
+	if err != nil {
+		return fail(err)
+	}
+	if len(outputJson) == 0 {
+		return false
+	}
+	output := &filterOutput{}
+	if err := json.Unmarshal(outputJson, output); err != nil {
+		return fail(fmt.Errorf("Invalid output: %v", err))
+	}
+
+	switch output.Verdict {
+	case "", verdictContinue:
+	case verdictReject:
+		status := output.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		if status < 400 || status > 599 {
+			return fail(fmt.Errorf(`Invalid status %v: must be an error status`, status))
+		}
+		logger.Printf(`%s %s: rejected by module "%v" with %v`, request.Method, request.URL.Path, filterModule.name, status)
+		reason := output.Reason
+		if reason == "" {
+			reason = http.StatusText(status)
+		}
+		http.Error(response, reason, status)
+		return true
+	default:
+		return fail(fmt.Errorf(`Invalid verdict "%v": must be "%v" or "%v"`, output.Verdict, verdictContinue, verdictReject))
+	}
+
+	if output.URL != "" {
+		target, err := url.ParseRequestURI(output.URL)
+		if err != nil {
+			return fail(fmt.Errorf(`Invalid URL "%v": %v`, output.URL, err))
+		}
+		request.URL.Path = target.Path
+		request.URL.RawPath = target.RawPath
+		request.URL.RawQuery = target.RawQuery
+	}
+	for _, name := range output.RemoveHeaders {
+		request.Header.Del(name)
+	}
+	for name, value := range output.SetHeaders {
+		request.Header.Set(name, value)
+	}
+	if output.Body != nil {
+		if omitted {
+			return fail(fmt.Errorf("Can't replace a body which was omitted"))
+		}
+		traffic.SetRequestBody(request, output.Body)
+		plug.metrics.BodyModified()
+	}
+	return false
+}
+
+// readBody returns a request's body without consuming it, unless it's larger
+// than the maximum, in which case it returns true for omitted.
+func (plug *wasmFilterPlugin) readBody(request *http.Request) (body []byte, omitted bool, err error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, false, nil
+	}
+	if reader, ok := request.Body.(*traffic.BodyReader); ok {
+		if reader.Size() > plug.maxBodyBytes {
+			return nil, true, nil
+		}
+		reopened := reader.Reopen()
+		defer reopened.Close()
+		body, err := io.ReadAll(reopened)
+		return body, false, err
+	}
+
+	// Other bodies are read up to the maximum, and are streamed as usual if
+	// they're larger.
+	body, err = io.ReadAll(io.LimitReader(request.Body, plug.maxBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > plug.maxBodyBytes {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return nil, true, nil
+	}
+	traffic.SetRequestBody(request, body)
+	return body, false, nil
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
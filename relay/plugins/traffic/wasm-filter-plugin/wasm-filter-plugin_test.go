@@ -0,0 +1,204 @@
+package wasm_filter_plugin_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	wasm_filter_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/wasm-filter-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestWasmFilterConfigValidation(t *testing.T) {
+	// Files which aren't WASM modules can't be loaded, and neither can modules
+	// which don't implement the ABI.
+	withoutFilter := filepath.Join(t.TempDir(), "without-filter.wasm")
+	if err := os.WriteFile(withoutFilter, filterModule("", false), 0644); err != nil {
+		t.Fatalf("Error writing module: %v", err)
+	}
+	notWasm := filepath.Join(t.TempDir(), "filter.wasm")
+	if err := os.WriteFile(notWasm, []byte("not a module"), 0644); err != nil {
+		t.Fatalf("Error writing module: %v", err)
+	}
+
+	invalidConfigs := []string{
+		"modules: {path: " + notWasm + "}",
+		"modules: [{name: filter}]",
+		"modules: [{path: /nonexistent/filter.wasm}]",
+		"modules: [{path: " + notWasm + "}]",
+		"modules: [{path: " + withoutFilter + "}]",
+		"modules: [{path: " + notWasm + "}]\n    timeout: 0s",
+		"modules: [{path: " + notWasm + "}]\n    timeout: soon",
+		"modules: [{path: " + notWasm + "}]\n    max-body-bytes: -1",
+		"modules: [{path: " + notWasm + "}]\n    fail-open: maybe",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("wasm-filter:\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := wasm_filter_plugin.Factory.New(configFile.LookupOptionalSection("wasm-filter")); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+
+	// Without modules, the plugin is inactive.
+	configFile, _ := config.NewFileFromYamlString("wasm-filter:\n    timeout: 50ms\n")
+	if plugin, err := wasm_filter_plugin.Factory.New(configFile.LookupOptionalSection("wasm-filter")); err != nil || plugin != nil {
+		t.Errorf("Expected no plugin without modules, but got %v, %v", plugin, err)
+	}
+}
+
+func TestWasmFilterModules(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		output         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			desc:           "Modules may let requests through",
+			output:         "",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Modules may reject requests",
+			output:         `{"verdict": "reject", "status": 451, "reason": "Blocked by filter"}`,
+			expectedStatus: http.StatusUnavailableForLegalReasons,
+			expectedBody:   "Blocked by filter\n",
+		},
+		{
+			desc:           "Modules may change requests",
+			output:         `{"url": "/filtered", "set_headers": {"X-Filtered": "true"}}`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		var logs bytes.Buffer
+		logging.Configure(&logging.Options{Sinks: []logging.Sink{logging.NewWriterSink(&logs)}})
+
+		path := filepath.Join(t.TempDir(), "filter.wasm")
+		if err := os.WriteFile(path, filterModule(testCase.output, true), 0644); err != nil {
+			t.Fatalf("Error writing module: %v", err)
+		}
+		configYaml := "wasm-filter:\n    modules: [{path: " + path + "}]\n"
+
+		test.WithCatcherAndRelay(t, configYaml, []traffic.PluginFactory{wasm_filter_plugin.Factory}, func(catcherService *catcher.Service, relayService *relay.Service) {
+			response, err := http.Post(relayService.HttpUrl()+"/events", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+			}
+
+			if testCase.expectedStatus == http.StatusOK {
+				lastRequest, err := catcherService.LastRequest()
+				if err != nil {
+					t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+					return
+				}
+				filtered := lastRequest.URL.Path == "/filtered" && lastRequest.Header.Get("X-Filtered") == "true"
+				if expectFiltered := testCase.output != ""; filtered != expectFiltered {
+					t.Errorf("Test '%v': Expected the request to be changed: %v, but the target received %v %v", testCase.desc, expectFiltered, lastRequest.URL, lastRequest.Header)
+				}
+			}
+		})
+
+		// The module logs its input with relay.log, so the log shows that
+		// the request was written to the buffer it allocated.
+		logging.Configure(&logging.Options{})
+		if !strings.Contains(logs.String(), `filter: {"method":"POST","url":"/events"`) {
+			t.Errorf("Test '%v': Expected the module to log its input, but got logs:\n%s", testCase.desc, logs.String())
+		}
+	}
+}
+
+// filterModule assembles a minimal WASM module which implements the filter
+// ABI. Its relay_alloc always returns the same buffer, and its relay_filter
+// passes its input to relay.log and returns output, which is stored in the
+// module's data. If withFilter is false, relay_filter isn't exported.
+func filterModule(output string, withFilter bool) []byte {
+	const (
+		outputPtr = 1024
+		inputPtr  = 4096
+	)
+	i32, i64 := byte(0x7f), byte(0x7e)
+	section := func(id byte, contents ...[]byte) []byte {
+		joined := bytes.Join(contents, nil)
+		return append(append([]byte{id}, leb128(uint64(len(joined)))...), joined...)
+	}
+	name := func(name string) []byte {
+		return append(leb128(uint64(len(name))), name...)
+	}
+	function := func(code ...byte) []byte {
+		// Each function is preceded by its size, and has no locals.
+		return append(leb128(uint64(len(code)+1)), append([]byte{0x00}, code...)...)
+	}
+
+	result := uint64(outputPtr)<<32 | uint64(len(output))
+	if output == "" {
+		result = 0
+	}
+	// Exports: the memory, relay_alloc, and maybe relay_filter.
+	exports := [][]byte{{2}, name("memory"), {0x02, 0}, name("relay_alloc"), {0x00, 1}}
+	if withFilter {
+		exports[0][0]++
+		exports = append(exports, name("relay_filter"), []byte{0x00, 2})
+	}
+
+	return bytes.Join([][]byte{
+		[]byte("\x00asm\x01\x00\x00\x00"),
+		// Types: (i32) -> i32, (i32, i32) -> i64, and (i32, i32) -> ().
+		section(1, []byte{3, 0x60, 1, i32, 1, i32, 0x60, 2, i32, i32, 1, i64, 0x60, 2, i32, i32, 0}),
+		// Imports: relay.log.
+		section(2, []byte{1}, name("relay"), name("log"), []byte{0x00, 2}),
+		// Functions: relay_alloc and relay_filter.
+		section(3, []byte{2, 0, 1}),
+		// Memory: one page.
+		section(5, []byte{1, 0x00, 1}),
+		section(7, exports...),
+		section(10, []byte{2},
+			function(append([]byte{0x41}, append(sleb128(inputPtr), 0x0b)...)...),
+			// local.get 0, local.get 1, call relay.log, i64.const result.
+			function(append([]byte{0x20, 0, 0x20, 1, 0x10, 0, 0x42}, append(sleb128(int64(result)), 0x0b)...)...),
+		),
+		// Data: the output, at outputPtr.
+		section(11, []byte{1, 0x00, 0x41}, sleb128(outputPtr), []byte{0x0b}, name(output)),
+	}, nil)
+}
+
+func leb128(value uint64) []byte {
+	return binary.AppendUvarint(nil, value)
+}
+
+func sleb128(value int64) []byte {
+	var encoded []byte
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			return append(encoded, b)
+		}
+		encoded = append(encoded, b|0x80)
+	}
+}
@@ -0,0 +1,236 @@
+// This plugin records relayed websocket connections, frame by frame, so that
+// sessions can be inspected or replayed later. Frames are recorded as they're
+// sent, after other plugins (like content-blocker) have rewritten them, so
+// recordings never contain content which was blocked from the target.
+//
+// Each connection is written to storage as a single JSON document when it
+// closes. Text payloads are recorded as text; binary payloads, which blocking
+// rules don't apply to, are only recorded if 'record-binary' is enabled.
+
+package websocket_recorder_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+var (
+	Factory    websocketRecorderPluginFactory
+	pluginName = "websocket-recorder"
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
+)
+
+const (
+	// RecordingVersion is the version of the recording format written by this
+	// plugin.
+	RecordingVersion = 1
+
+	defaultMaxSize int64 = 16 * 1024 * 1024 // 16MB
+)
+
+// Websocket frame opcodes, from RFC 6455 section 5.2.
+const (
+	textOpcode   = 0x1
+	binaryOpcode = 0x2
+)
+
+// Recording is the format in which a websocket connection is stored.
+type Recording struct {
+	Version   int       `json:"version"`
+	URL       string    `json:"url"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	Truncated bool      `json:"truncated,omitempty"` // True if frames were dropped because the recording reached max-size.
+	Frames    []*Frame  `json:"frames"`
+}
+
+// Frame is a recorded websocket frame. Replaying the frames of a recording in
+// order, with the recorded delays between them, reproduces the session as the
+// target and client saw it.
+type Frame struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // "client-to-target" or "target-to-client".
+	Opcode    byte      `json:"opcode"`
+	Fin       bool      `json:"fin"`
+	Length    int       `json:"length"`         // The payload length, even if the payload wasn't recorded.
+	Text      string    `json:"text,omitempty"` // The payload of text frames.
+	Data      []byte    `json:"data,omitempty"` // The payload of other frames, if recorded.
+}
+
+type websocketRecorderPluginFactory struct{}
+
+func (f websocketRecorderPluginFactory) Name() string {
+	return pluginName
+}
+
+func (f websocketRecorderPluginFactory) New(configSection *config.Section) (traffic.Plugin, error) {
+	if directory, err := config.LookupOptional[string](configSection, "directory"); err != nil {
+		return nil, err
+	} else if directory == nil {
+		return nil, nil
+	}
+
+	storageOptions, err := storage.ReadOptions(configSection)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.NewStore(storageOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &websocketRecorderPlugin{
+		store:   store,
+		maxSize: defaultMaxSize,
+		clock:   clock.Real,
+	}
+
+	if recordBinary, err := config.LookupOptional[bool](configSection, "record-binary"); err != nil {
+		return nil, err
+	} else if recordBinary != nil {
+		plugin.recordBinary = *recordBinary
+	}
+
+	if maxSize, err := config.LookupOptional[int64](configSection, "max-size"); err != nil {
+		return nil, err
+	} else if maxSize != nil {
+		if *maxSize <= 0 {
+			return nil, fmt.Errorf(`Invalid max-size "%v": must be positive`, *maxSize)
+		}
+		plugin.maxSize = *maxSize
+	}
+
+	logger.Printf("Recording websocket connections to %v (encrypted: %v)", storageOptions.Directory, store.Encrypted())
+	return plugin, nil
+}
+
+type websocketRecorderPlugin struct {
+	store        *storage.Store
+	recordBinary bool  // If true, the payloads of non-text frames are recorded.
+	maxSize      int64 // The maximum total payload size of a recording.
+	clock        clock.Clock
+	sequence     atomic.Uint64 // Distinguishes recordings which start at the same time.
+}
+
+func (plug *websocketRecorderPlugin) Name() string {
+	return pluginName
+}
+
+// SetClock implements traffic.ClockPlugin.
+func (plug *websocketRecorderPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *websocketRecorderPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	info traffic.RequestInfo,
+) bool {
+	return false
+}
+
+// RecordWebsocket implements traffic.WebsocketRecorderPlugin.
+func (plug *websocketRecorderPlugin) RecordWebsocket(request *http.Request) traffic.WebsocketRecording {
+	started := plug.clock.Now()
+	return &websocketRecording{
+		plugin: plug,
+		name:   fmt.Sprintf("websocket-%d-%d", started.UnixNano(), plug.sequence.Add(1)),
+		recording: Recording{
+			Version: RecordingVersion,
+			URL:     request.URL.String(),
+			Started: started,
+			Frames:  []*Frame{},
+		},
+	}
+}
+
+type websocketRecording struct {
+	plugin    *websocketRecorderPlugin
+	name      string
+	mutex     sync.Mutex
+	size      int64 // The total size of the recorded payloads.
+	recording Recording
+}
+
+func (rec *websocketRecording) RecordFrame(frame *traffic.RecordedWebsocketFrame) {
+	recordedFrame := &Frame{
+		Time:      frame.Time,
+		Direction: frame.Direction.String(),
+		Opcode:    frame.Opcode,
+		Fin:       frame.Fin,
+		Length:    len(frame.Payload),
+	}
+
+	// Text messages are reassembled by the relay before they're sent, so
+	// every text frame holds a complete message.
+	var payloadSize int64
+	if frame.Opcode == textOpcode {
+		recordedFrame.Text = string(frame.Payload)
+		payloadSize = int64(len(frame.Payload))
+	} else if frame.Opcode != binaryOpcode || rec.plugin.recordBinary {
+		recordedFrame.Data = append([]byte{}, frame.Payload...)
+		payloadSize = int64(len(frame.Payload))
+	}
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.recording.Truncated || rec.size+payloadSize > rec.plugin.maxSize {
+		rec.recording.Truncated = true
+		return
+	}
+	rec.size += payloadSize
+	rec.recording.Frames = append(rec.recording.Frames, recordedFrame)
+}
+
+func (rec *websocketRecording) Close() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	// Connections whose upgrade was refused have nothing worth keeping.
+	if len(rec.recording.Frames) == 0 && !rec.recording.Truncated {
+		return
+	}
+
+	rec.recording.Ended = rec.plugin.clock.Now()
+	data, err := json.Marshal(&rec.recording)
+	if err != nil {
+		logger.Errorf("Error encoding websocket recording %v: %v", rec.name, err)
+		return
+	}
+	if err := rec.plugin.store.Write(rec.name, data); err != nil {
+		logger.Errorf("Error writing websocket recording %v: %v", rec.name, err)
+		return
+	}
+	if _, err := rec.plugin.store.Cleanup(); err != nil {
+		logger.Errorf("Error cleaning up websocket recordings: %v", err)
+	}
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,172 @@
+package websocket_recorder_plugin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
+	websocket_recorder_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/websocket-recorder-plugin"
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebsocketRecorderPlugin(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		recordBinary   bool
+		maxSize        int64
+		expectedFrames []websocket_recorder_plugin.Frame
+		expectedTrunc  bool
+	}{
+		{
+			desc: "Frames are recorded after blocking, without binary payloads",
+			expectedFrames: []websocket_recorder_plugin.Frame{
+				{Direction: "client-to-target", Opcode: 1, Fin: true, Length: 14, Text: `ip ***********`},
+				{Direction: "target-to-client", Opcode: 1, Fin: true, Length: 14, Text: `ip ***********`},
+				{Direction: "client-to-target", Opcode: 2, Fin: true, Length: 3},
+				{Direction: "target-to-client", Opcode: 1, Fin: true, Length: 3, Text: "\x01\x02\x03"},
+			},
+		},
+		{
+			desc:         "Binary payloads can be recorded",
+			recordBinary: true,
+			expectedFrames: []websocket_recorder_plugin.Frame{
+				{Direction: "client-to-target", Opcode: 1, Fin: true, Length: 14, Text: `ip ***********`},
+				{Direction: "target-to-client", Opcode: 1, Fin: true, Length: 14, Text: `ip ***********`},
+				{Direction: "client-to-target", Opcode: 2, Fin: true, Length: 3, Data: []byte{1, 2, 3}},
+				{Direction: "target-to-client", Opcode: 1, Fin: true, Length: 3, Text: "\x01\x02\x03"},
+			},
+		},
+		{
+			desc:    "Recordings are truncated at max-size",
+			maxSize: 20,
+			expectedFrames: []websocket_recorder_plugin.Frame{
+				{Direction: "client-to-target", Opcode: 1, Fin: true, Length: 14, Text: `ip ***********`},
+			},
+			expectedTrunc: true,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		content_blocker_plugin.Factory,
+		websocket_recorder_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		directory := t.TempDir()
+		config := fmt.Sprintf(`block-content:
+    body:
+        - mask: '[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+'
+websocket-recorder:
+    directory: %v
+    record-binary: %v
+`, directory, testCase.recordBinary)
+		if testCase.maxSize != 0 {
+			config += fmt.Sprintf("    max-size: %v\n", testCase.maxSize)
+		}
+
+		test.WithCatcherAndRelay(t, config, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+
+			// The catcher echoes back whatever it receives, always as text.
+			for _, message := range []interface{}{"ip 192.168.0.1", []byte{1, 2, 3}} {
+				if err := websocket.Message.Send(ws, message); err != nil {
+					t.Errorf("Test '%v': Error sending websocket message: %v", testCase.desc, err)
+					return
+				}
+				var received []byte
+				if err := websocket.Message.Receive(ws, &received); err != nil {
+					t.Errorf("Test '%v': Error receiving websocket message: %v", testCase.desc, err)
+					return
+				}
+			}
+			ws.Close()
+
+			recording, err := waitForRecording(directory)
+			if err != nil {
+				t.Errorf("Test '%v': %v", testCase.desc, err)
+				return
+			}
+
+			if recording.Version != websocket_recorder_plugin.RecordingVersion || recording.URL == "" {
+				t.Errorf("Test '%v': Unexpected recording metadata: %+v", testCase.desc, recording)
+			}
+			if recording.Truncated != testCase.expectedTrunc {
+				t.Errorf("Test '%v': Expected truncated to be %v", testCase.desc, testCase.expectedTrunc)
+			}
+
+			// The client's close frame may or may not be relayed before the
+			// connection is torn down, so only compare the data frames.
+			var frames []websocket_recorder_plugin.Frame
+			for _, frame := range recording.Frames {
+				if frame.Time.IsZero() {
+					t.Errorf("Test '%v': Frame has no timestamp: %+v", testCase.desc, frame)
+				}
+				if frame.Opcode == 1 || frame.Opcode == 2 {
+					frame.Time = time.Time{}
+					frames = append(frames, *frame)
+				}
+			}
+			if fmt.Sprint(frames) != fmt.Sprint(testCase.expectedFrames) {
+				t.Errorf("Test '%v': Expected frames %+v but got %+v", testCase.desc, testCase.expectedFrames, frames)
+			}
+		})
+	}
+}
+
+// waitForRecording waits for a recording to be written to the directory, since
+// recordings are written after the connection closes.
+func waitForRecording(directory string) (*websocket_recorder_plugin.Recording, error) {
+	store, err := storage.NewStore(&storage.Options{Directory: directory})
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < 100; attempt++ {
+		names, err := store.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			data, err := store.Read(names[0])
+			if err != nil {
+				return nil, err
+			}
+			recording := &websocket_recorder_plugin.Recording{}
+			if err := json.Unmarshal(data, recording); err != nil {
+				return nil, err
+			}
+			return recording, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("No recording was written")
+}
+
+/*
+Copyright 2022 FullStory, Inc.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+and associated documentation files (the "Software"), to deal in the Software without restriction,
+including without limitation the rights to use, copy, modify, merge, publish, distribute,
+sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or
+substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// readOnlyGuard rejects requests which might modify data on the target with a
+// 405 while the service is read-only, so that writes can be frozen during an
+// incident without touching the target. Websocket upgrades are GET requests,
+// so they're still allowed.
+type readOnlyGuard struct {
+	handler http.Handler
+	enabled atomic.Bool
+}
+
+// readOnlyMethods are the methods allowed while the service is read-only.
+var readOnlyMethods = "GET, HEAD, OPTIONS"
+
+func (guard *readOnlyGuard) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if guard.enabled.Load() {
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			logger.Printf("Rejecting %s %s %s: the relay is read-only", request.Method, request.Host, request.URL)
+			response.Header().Set("Allow", readOnlyMethods)
+			http.Error(response, "The relay is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+	guard.handler.ServeHTTP(response, request)
+}
+
+// SetReadOnly sets whether the service is read-only. While it is, only GET,
+// HEAD and OPTIONS requests are relayed; other requests receive a 405. It may
+// be called at any time.
+func (service *Service) SetReadOnly(readOnly bool) {
+	if service.readOnly.enabled.Swap(readOnly) != readOnly {
+		if readOnly {
+			logger.Printf("Read-only: only %v requests will be relayed\n", readOnlyMethods)
+		} else {
+			logger.Printf("Read-only: disabled\n")
+		}
+	}
+}
+
+// ReadOnly returns true if the service is read-only.
+func (service *Service) ReadOnly() bool {
+	return service.readOnly.enabled.Load()
+}
@@ -1,8 +1,7 @@
 package relay
 
 import (
-	"log"
-	"os"
+	"github.com/immersa-co/relay-core/relay/logging"
 )
 
-var logger = log.New(os.Stdout, "[relay] ", 0)
+var logger = logging.New("relay")
@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// ReloadReport describes the most recent Reload, for the admin listener's
+// ReloadPath. Secrets in the changes are redacted.
+type ReloadReport struct {
+	Time    time.Time        `json:"time"`
+	Changes []*config.Change `json:"changes"`
+}
+
+// Reload replaces the service's plugins with those of a new configuration,
+// which loadPlugins creates, as for NewFromConfig. Virtual hosts and SNI
+// routes which inherit the default plugins get the new ones, and routes with
+// plugin sections of their own load them again, substituted into the new
+// configuration. The replaced plugins are closed, and so are the replaced
+// traffic handlers, once the requests they're handling have completed.
+//
+// Only plugins are reloaded: changes to other sections, like the relay's
+// target, routes, listeners, and TLS certificates, take effect when the relay
+// restarts, and connections are still passed to the ConnectionPlugins the
+// service started with. If the new plugins can't be loaded, the service is
+// left as it was.
+//
+// The differences from the previous configuration are logged, with secrets
+// redacted, and served on the admin listener's ReloadPath.
+func (service *Service) Reload(
+	configFile *config.File,
+	loadPlugins func(configFile *config.File) ([]traffic.Plugin, error),
+) ([]*config.Change, error) {
+	trafficPlugins, err := loadPlugins(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	service.lock.RLock()
+	previousConfigFile := service.configFile
+	previousPlugins := service.trafficPlugins
+	previousRoutes := service.routes
+	service.lock.RUnlock()
+	previousHandlers := service.router.handlers()
+
+	// Build the new handlers alongside the current ones, so that requests are
+	// relayed as before until they're all ready.
+	relayConfig := *service.relayConfig
+	relayConfig.Metrics = service.metrics
+	next := &Service{
+		router:  &hostRouter{defaultHandler: traffic.NewHandler(&relayConfig, trafficPlugins)},
+		metrics: service.metrics,
+	}
+	for _, route := range previousRoutes {
+		reloaded := &serviceRoute{
+			sni:         route.sni,
+			pattern:     route.pattern,
+			relayConfig: route.relayConfig,
+			options:     route.options,
+			plugins:     route.plugins,
+		}
+		switch {
+		case route.options == nil:
+			// The route was added with fixed plugins.
+			reloaded.pluginConfig = route.pluginConfig
+		case route.options.PluginConfig == nil:
+			reloaded.plugins = trafficPlugins
+		default:
+			reloaded.pluginConfig = route.options.PluginConfig
+			if route.options.pluginOverrides != nil {
+				reloaded.pluginConfig = configFile.WithOverrides(route.options.pluginOverrides)
+			}
+			if reloaded.plugins, err = loadPlugins(reloaded.pluginConfig); err != nil {
+				closePlugins(trafficPlugins)
+				closeHandlers(next.router.handlers())
+				for _, loaded := range next.routes {
+					if loaded.options != nil {
+						closePlugins(loaded.ownPlugins())
+					}
+				}
+				return nil, fmt.Errorf(`Route "%v": %v`, route.pattern, err)
+			}
+		}
+		next.addRoute(reloaded)
+	}
+
+	changes := []*config.Change{}
+	if previousConfigFile != nil {
+		changes = append(changes, config.Diff(previousConfigFile, configFile)...)
+	}
+
+	service.router.replace(next.router)
+	service.lock.Lock()
+	service.trafficPlugins = trafficPlugins
+	service.routes = next.routes
+	service.configFile = configFile
+	service.lastReload = &ReloadReport{Time: service.clock.Now(), Changes: changes}
+	service.pluginAdmin = service.newPluginAdminHandler()
+	service.lock.Unlock()
+
+	// Requests which are still being handled may be using the replaced
+	// plugins, but nothing new will reach them. The replaced handlers are
+	// closed once those requests have completed, since they may still queue
+	// copies for the mirror target.
+	closePlugins(previousPlugins)
+	for _, route := range previousRoutes {
+		if route.options != nil {
+			closePlugins(route.ownPlugins())
+		}
+	}
+	go func() {
+		service.requests.wait()
+		closeHandlers(previousHandlers)
+	}()
+
+	logger.Printf("Configuration reloaded with %v changes\n", len(changes))
+	pluginNames := map[string]bool{}
+	for _, plugins := range [][]traffic.Plugin{previousPlugins, trafficPlugins} {
+		for _, plugin := range plugins {
+			pluginNames[plugin.Name()] = true
+		}
+	}
+	for _, change := range changes {
+		if pluginNames[change.Section] {
+			logger.Printf("\t%v\n", change)
+		} else {
+			logger.Printf("\t%v (takes effect on restart)\n", change)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,353 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	"gopkg.in/yaml.v3"
+)
+
+// RouteOptions describes how traffic matching a route differs from the default
+// configuration. Anything a route doesn't override is inherited.
+type RouteOptions struct {
+	// If set, the certificate presented for this route. Otherwise the default
+	// certificate is used.
+	CertFile string
+	KeyFile  string
+
+	// If set, the target to which this route's traffic is relayed. Otherwise
+	// the default target is used.
+	TargetScheme string
+	TargetHost   string
+
+	// If non-nil, the configuration from which this route's plugins should be
+	// loaded. It contains the relay's configuration, with the route's plugin
+	// sections substituted. If nil, the route uses the default plugins.
+	PluginConfig *config.File
+
+	// The route's own plugin sections, if it was read from a configuration
+	// file, so that Reload can substitute them into a new configuration.
+	pluginOverrides *config.File
+}
+
+// VirtualHostOptions describes traffic which should be handled differently
+// based on the request's Host header. This allows one relay to front several
+// domains, even when it isn't terminating TLS itself.
+type VirtualHostOptions struct {
+	// The host to match: either an exact host name or a wildcard like
+	// "*.example.com", which matches a single label. Any port in the Host
+	// header is ignored.
+	Host string
+	RouteOptions
+}
+
+// routeConfig is the YAML structure of a route.
+type routeConfig struct {
+	CertFile string    `yaml:"cert-file"`
+	KeyFile  string    `yaml:"key-file"`
+	Target   string    `yaml:"target"`
+	Plugins  yaml.Node `yaml:"plugins"`
+}
+
+// readRouteOptions validates a route's configuration. Plugin sections in the
+// route override those in configFile.
+func readRouteOptions(value *routeConfig, configFile *config.File) (RouteOptions, error) {
+	route := RouteOptions{CertFile: value.CertFile, KeyFile: value.KeyFile}
+	if (route.CertFile == "") != (route.KeyFile == "") {
+		return route, fmt.Errorf(`"cert-file" and "key-file" must be specified together`)
+	}
+
+	if value.Target != "" {
+		targetURL, err := url.Parse(value.Target)
+		if err != nil || targetURL.Scheme == "" || targetURL.Host == "" {
+			return route, fmt.Errorf("Invalid or relative target URL")
+		}
+		route.TargetScheme = targetURL.Scheme
+		route.TargetHost = targetURL.Host
+	}
+
+	if !value.Plugins.IsZero() {
+		overrides, err := config.NewFileFromYamlNode(value.Plugins)
+		if err != nil {
+			return route, fmt.Errorf("Invalid plugin configuration: %v", err)
+		}
+		route.PluginConfig = configFile.WithOverrides(overrides)
+		route.pluginOverrides = overrides
+	}
+
+	return route, nil
+}
+
+// readVirtualHosts reads the virtual hosts configured in the relay section.
+// They come from two options: 'hosts', a map from host patterns to the routes
+// which should handle them, and 'host-targets', a space-separated list of
+// "pattern=target" pairs which is convenient to set from an environment
+// variable when a host only needs its own target.
+func readVirtualHosts(configSection *config.Section, configFile *config.File) ([]*VirtualHostOptions, error) {
+	values := map[string]*routeConfig{}
+	addHost := func(pattern string, value *routeConfig) error {
+		pattern = strings.ToLower(pattern)
+		if pattern == "" {
+			return fmt.Errorf("Virtual hosts must have a non-empty host pattern")
+		}
+		if _, ok := values[pattern]; ok {
+			return fmt.Errorf(`Host "%v" is configured more than once`, pattern)
+		}
+		if value == nil {
+			value = &routeConfig{}
+		}
+		values[pattern] = value
+		return nil
+	}
+
+	if err := config.ParseOptional(configSection, "hosts", func(key string, hosts map[string]*routeConfig) error {
+		for pattern, value := range hosts {
+			if err := addHost(pattern, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "host-targets", func(key string, hostTargets string) error {
+		for _, hostTarget := range strings.Fields(hostTargets) {
+			pattern, target, ok := strings.Cut(hostTarget, "=")
+			if !ok || target == "" {
+				return fmt.Errorf(`Expected "host=target" but got "%v"`, hostTarget)
+			}
+			if err := addHost(pattern, &routeConfig{Target: target}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Sort the hosts so that they're logged and matched in a consistent order.
+	patterns := make([]string, 0, len(values))
+	for pattern := range values {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	var hosts []*VirtualHostOptions
+	for _, pattern := range patterns {
+		route, err := readRouteOptions(values[pattern], configFile)
+		if err != nil {
+			return nil, fmt.Errorf(`Host "%v": %v`, pattern, err)
+		}
+
+		logger.Printf("Virtual host: %v\n", pattern)
+		hosts = append(hosts, &VirtualHostOptions{Host: pattern, RouteOptions: route})
+	}
+	return hosts, nil
+}
+
+// hostPatternValue associates a value with a host name pattern: either an exact
+// host name or a wildcard like "*.example.com".
+type hostPatternValue[T any] struct {
+	pattern string
+	value   T
+}
+
+// matchHostPattern returns the value whose pattern best matches host. Exact
+// matches take precedence over wildcards, and otherwise the first match wins.
+// A wildcard matches exactly one label, as in certificates, so
+// "*.example.com" matches "a.example.com" but not "a.b.example.com" or
+// "example.com".
+func matchHostPattern[T any](candidates []hostPatternValue[T], host string) (T, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, candidate := range candidates {
+		if candidate.pattern == host {
+			return candidate.value, true
+		}
+	}
+	for _, candidate := range candidates {
+		suffix, isWildcard := strings.CutPrefix(candidate.pattern, "*")
+		if !isWildcard || !strings.HasPrefix(suffix, ".") {
+			continue
+		}
+		if label, ok := strings.CutSuffix(host, suffix); ok && label != "" && !strings.Contains(label, ".") {
+			return candidate.value, true
+		}
+	}
+	var zeroValue T
+	return zeroValue, false
+}
+
+// hostRouter dispatches requests to the handler of the matching route. SNI
+// routes, which match the server name the client requested during the TLS
+// handshake, take precedence over virtual hosts, which match the Host header.
+// Requests matching neither go to the default handler.
+type hostRouter struct {
+	lock           sync.RWMutex // Guards the handlers, which Reload replaces.
+	defaultHandler http.Handler
+	sniRoutes      []hostPatternValue[http.Handler]
+	hostRoutes     []hostPatternValue[http.Handler]
+}
+
+func (router *hostRouter) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	router.handlerFor(request).ServeHTTP(response, request)
+}
+
+// replace replaces the router's handlers with those of another router.
+func (router *hostRouter) replace(other *hostRouter) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.defaultHandler = other.defaultHandler
+	router.sniRoutes = other.sniRoutes
+	router.hostRoutes = other.hostRoutes
+}
+
+// handlers returns the default handler and those of the routes.
+func (router *hostRouter) handlers() []http.Handler {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	handlers := []http.Handler{router.defaultHandler}
+	for _, routes := range [][]hostPatternValue[http.Handler]{router.sniRoutes, router.hostRoutes} {
+		for _, route := range routes {
+			handlers = append(handlers, route.value)
+		}
+	}
+	return handlers
+}
+
+func (router *hostRouter) handlerFor(request *http.Request) http.Handler {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	if request.TLS != nil {
+		if handler, ok := matchHostPattern(router.sniRoutes, request.TLS.ServerName); ok {
+			return handler
+		}
+	}
+	if len(router.hostRoutes) > 0 {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if handler, ok := matchHostPattern(router.hostRoutes, host); ok {
+			return handler
+		}
+	}
+	return router.defaultHandler
+}
+
+// newRouteHandler returns a traffic handler for the route with the provided
+// pattern, which records metrics in the service's registry.
+func (service *Service) newRouteHandler(pattern string, relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plugin) http.Handler {
+	handlerConfig := *relayConfig
+	handlerConfig.Metrics = service.metrics
+	handlerConfig.Route = pattern
+	return traffic.NewHandler(&handlerConfig, trafficPlugins)
+}
+
+// resolve returns the relay options and plugins for a route, inheriting
+// relayConfig and defaultPlugins unless the route overrides the target or
+// plugins. Overridden plugins are created by calling loadPlugins with the
+// route's plugin configuration.
+func (route *RouteOptions) resolve(
+	relayConfig *traffic.RelayOptions,
+	defaultPlugins []traffic.Plugin,
+	loadPlugins func(configFile *config.File) ([]traffic.Plugin, error),
+) (*traffic.RelayOptions, []traffic.Plugin, error) {
+	resolved := *relayConfig
+	if route.TargetHost != "" {
+		resolved.TargetScheme = route.TargetScheme
+		resolved.TargetHost = route.TargetHost
+	}
+
+	if route.PluginConfig == nil {
+		return &resolved, defaultPlugins, nil
+	}
+	routePlugins, err := loadPlugins(route.PluginConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resolved, routePlugins, nil
+}
+
+// serviceRoute describes a route which was added to the service.
+type serviceRoute struct {
+	sni         bool
+	pattern     string
+	relayConfig *traffic.RelayOptions // The route's resolved relay options.
+	handler     http.Handler
+
+	// The options the route was read from, if it was added by AddVirtualHosts
+	// or AddSNIRoutes rather than with fixed plugins. Reload only replaces the
+	// plugins of such routes.
+	options *RouteOptions
+
+	// If the route loaded its own plugins, they and the configuration they
+	// were loaded from. They're closed, checked for readiness, listed, and
+	// served on the admin listener like the service's own plugins.
+	plugins      []traffic.Plugin
+	pluginConfig *config.File
+}
+
+// ownPlugins returns the plugins which the route loaded itself, if any.
+func (route *serviceRoute) ownPlugins() []traffic.Plugin {
+	if route.pluginConfig == nil {
+		return nil
+	}
+	return route.plugins
+}
+
+// addRoute adds a route with a new traffic handler to the service.
+func (service *Service) addRoute(route *serviceRoute) {
+	route.pattern = strings.ToLower(route.pattern)
+	route.handler = service.newRouteHandler(route.pattern, route.relayConfig, route.plugins)
+	value := hostPatternValue[http.Handler]{pattern: route.pattern, value: route.handler}
+
+	service.router.lock.Lock()
+	if route.sni {
+		service.router.sniRoutes = append(service.router.sniRoutes, value)
+	} else {
+		service.router.hostRoutes = append(service.router.hostRoutes, value)
+	}
+	service.router.lock.Unlock()
+
+	service.lock.Lock()
+	service.routes = append(service.routes, route)
+	service.lock.Unlock()
+}
+
+// AddVirtualHost routes requests whose Host header matches a pattern to a
+// separate traffic handler, configured with its own relay options and plugins.
+func (service *Service) AddVirtualHost(host string, relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plugin) {
+	service.addRoute(&serviceRoute{pattern: host, relayConfig: relayConfig, plugins: trafficPlugins})
+}
+
+// AddVirtualHosts adds a route for each of the provided virtual hosts. See
+// AddSNIRoutes for details on how routes are configured.
+func (service *Service) AddVirtualHosts(
+	hosts []*VirtualHostOptions,
+	relayConfig *traffic.RelayOptions,
+	defaultPlugins []traffic.Plugin,
+	loadPlugins func(configFile *config.File) ([]traffic.Plugin, error),
+) error {
+	for _, host := range hosts {
+		hostConfig, hostPlugins, err := host.resolve(relayConfig, defaultPlugins, loadPlugins)
+		if err != nil {
+			return fmt.Errorf(`Host "%v": %v`, host.Host, err)
+		}
+		service.addRoute(&serviceRoute{
+			pattern:      host.Host,
+			relayConfig:  hostConfig,
+			options:      &host.RouteOptions,
+			plugins:      hostPlugins,
+			pluginConfig: host.PluginConfig,
+		})
+	}
+	return nil
+}
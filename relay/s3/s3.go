@@ -0,0 +1,293 @@
+// Package s3 stores buffered request bodies in Amazon S3, or a compatible
+// object store, so that uploads larger than the relay's memory and disk can
+// pass through plugins which need to buffer them. Bodies are written using
+// multipart uploads, a part at a time, so only one part is ever held in
+// memory.
+package s3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// DefaultPartSize is the size of the parts in which bodies are uploaded.
+const DefaultPartSize int64 = 16 * 1024 * 1024
+
+// MinPartSize is the smallest part size S3 accepts, except for the last part.
+const MinPartSize int64 = 5 * 1024 * 1024
+
+// Options configures a BodyStore.
+type Options struct {
+	Bucket          string
+	Region          string
+	Endpoint        string // If non-empty, such as "http://minio:9000", path-style requests are sent here instead of to AWS.
+	Prefix          string // Prepended to the keys of stored bodies.
+	AccessKeyID     *secrets.Secret
+	SecretAccessKey *secrets.Secret
+	SessionToken    *secrets.Secret // Optional; needed for temporary credentials.
+	PartSize        int64           // If zero, DefaultPartSize is used.
+}
+
+// BodyStore is a traffic.BodyStore which holds bodies as S3 objects. Objects
+// are deleted once the request has been handled; a bucket lifecycle rule
+// which aborts incomplete multipart uploads and expires old objects cleans up
+// after relays which exit while handling requests.
+type BodyStore struct {
+	options *Options
+	client  *http.Client
+}
+
+func NewBodyStore(options *Options) *BodyStore {
+	return &BodyStore{
+		options: options,
+		client:  &http.Client{},
+	}
+}
+
+func (store *BodyStore) partSize() int64 {
+	if store.options.PartSize > 0 {
+		return store.options.PartSize
+	}
+	return DefaultPartSize
+}
+
+// Create starts a multipart upload for a new body.
+func (store *BodyStore) Create() (traffic.StoredBody, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key := store.options.Prefix + "relay-body-" + hex.EncodeToString(id)
+
+	response, err := store.send(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting upload of request body to S3: %v", err)
+	}
+	defer response.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return nil, fmt.Errorf("Invalid response starting upload of request body to S3: %v", err)
+	}
+	return &storedBody{store: store, key: key, uploadID: result.UploadID}, nil
+}
+
+// storedBody is a body being uploaded to, or held in, S3.
+type storedBody struct {
+	store     *BodyStore
+	key       string
+	uploadID  string
+	part      bytes.Buffer
+	parts     []completedPart
+	completed bool
+	removed   bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (body *storedBody) Write(p []byte) (int, error) {
+	body.part.Write(p)
+	partSize := int(body.store.partSize())
+	for body.part.Len() >= partSize {
+		if err := body.uploadPart(body.part.Next(partSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (body *storedBody) uploadPart(data []byte) error {
+	number := len(body.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {body.uploadID}}
+	response, err := body.store.send(http.MethodPut, body.key, query, data)
+	if err != nil {
+		return fmt.Errorf("Error uploading request body to S3: %v", err)
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	body.parts = append(body.parts, completedPart{PartNumber: number, ETag: response.Header.Get("ETag")})
+	return nil
+}
+
+// Finish uploads the last part and completes the upload.
+func (body *storedBody) Finish() error {
+	if body.part.Len() > 0 || len(body.parts) == 0 {
+		if err := body.uploadPart(body.part.Bytes()); err != nil {
+			return err
+		}
+		body.part = bytes.Buffer{}
+	}
+
+	request, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: body.parts})
+	if err != nil {
+		return err
+	}
+	response, err := body.store.send(http.MethodPost, body.key, url.Values{"uploadId": {body.uploadID}}, request)
+	if err != nil {
+		return fmt.Errorf("Error completing upload of request body to S3: %v", err)
+	}
+	defer response.Body.Close()
+	// S3 may report an error in the body of a 200 response.
+	if err := readError(response.Body); err != nil {
+		return fmt.Errorf("Error completing upload of request body to S3: %v", err)
+	}
+	body.completed = true
+	return nil
+}
+
+// Open returns a reader which downloads the body once it's first read.
+func (body *storedBody) Open() io.ReadCloser {
+	return &objectReader{store: body.store, key: body.key}
+}
+
+// Remove deletes the object, or aborts the upload if it wasn't completed.
+func (body *storedBody) Remove() error {
+	if body.removed {
+		return nil
+	}
+	body.removed = true
+	body.part = bytes.Buffer{}
+
+	var response *http.Response
+	var err error
+	if body.completed {
+		response, err = body.store.send(http.MethodDelete, body.key, nil, nil)
+	} else {
+		response, err = body.store.send(http.MethodDelete, body.key, url.Values{"uploadId": {body.uploadID}}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("Error removing request body from S3: %v", err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+// objectReader downloads an object when it's first read.
+type objectReader struct {
+	store    *BodyStore
+	key      string
+	response *http.Response
+	err      error
+}
+
+func (reader *objectReader) Read(p []byte) (int, error) {
+	if reader.response == nil && reader.err == nil {
+		reader.response, reader.err = reader.store.send(http.MethodGet, reader.key, nil, nil)
+		if reader.err != nil {
+			reader.err = fmt.Errorf("Error reading request body from S3: %v", reader.err)
+		}
+	}
+	if reader.err != nil {
+		return 0, reader.err
+	}
+	return reader.response.Body.Read(p)
+}
+
+func (reader *objectReader) Close() error {
+	if reader.response != nil {
+		return reader.response.Body.Close()
+	}
+	return nil
+}
+
+// send sends a signed request concerning the object with the provided key. If
+// S3 responds with an error status, the error it describes is returned.
+func (store *BodyStore) send(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, store.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		request.Body = http.NoBody
+	}
+
+	credentials, err := store.credentials()
+	if err != nil {
+		return nil, err
+	}
+	sign(request, body, credentials, store.options.Region, time.Now())
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		if err := readError(response.Body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("S3 responded with status %v", response.StatusCode)
+	}
+	return response, nil
+}
+
+// credentials reads the current credentials, which may have been rotated.
+func (store *BodyStore) credentials() (*credentials, error) {
+	var err error
+	credentials := &credentials{}
+	if credentials.accessKeyID, err = store.options.AccessKeyID.Value(); err != nil {
+		return nil, err
+	}
+	if credentials.secretAccessKey, err = store.options.SecretAccessKey.Value(); err != nil {
+		return nil, err
+	}
+	if store.options.SessionToken != nil {
+		if credentials.sessionToken, err = store.options.SessionToken.Value(); err != nil {
+			return nil, err
+		}
+	}
+	return credentials, nil
+}
+
+func (store *BodyStore) objectURL(key string, query url.Values) string {
+	objectURL := &url.URL{RawQuery: canonicalQuery(query)}
+	if store.options.Endpoint != "" {
+		endpoint, _ := url.Parse(store.options.Endpoint)
+		objectURL.Scheme = endpoint.Scheme
+		objectURL.Host = endpoint.Host
+		objectURL.Path = "/" + store.options.Bucket + "/" + key
+	} else {
+		objectURL.Scheme = "https"
+		objectURL.Host = fmt.Sprintf("%v.s3.%v.amazonaws.com", store.options.Bucket, store.options.Region)
+		objectURL.Path = "/" + key
+	}
+	return objectURL.String()
+}
+
+// readError returns the error described by an S3 error document, if the body
+// is one.
+func readError(body io.Reader) error {
+	var document struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(body, 64*1024)).Decode(&document); err != nil {
+		return nil
+	}
+	if document.XMLName.Local != "Error" {
+		return nil
+	}
+	return errors.New(strings.TrimSpace(document.Code + ": " + document.Message))
+}
@@ -0,0 +1,192 @@
+package s3_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/s3"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+// fakeS3 implements the parts of the S3 API which BodyStore uses, for a
+// single bucket, using path-style URLs.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	uploads map[string]map[int]string // Parts by upload ID.
+	objects map[string]string
+	aborted int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{uploads: map[string]map[int]string{}, objects: map[string]string{}}
+}
+
+func (fake *fakeS3) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if !strings.HasPrefix(request.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(response, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(request.URL.Path, "/bucket/")
+	query := request.URL.Query()
+	body, _ := io.ReadAll(request.Body)
+
+	switch {
+	case request.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := fmt.Sprintf("upload-%v", len(fake.uploads)+1)
+		fake.uploads[uploadID] = map[int]string{}
+		fmt.Fprintf(response, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case request.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		fake.uploads[query.Get("uploadId")][number] = string(body)
+		response.Header().Set("ETag", fmt.Sprintf(`"etag-%v"`, number))
+	case request.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		parts := fake.uploads[query.Get("uploadId")]
+		var object strings.Builder
+		for _, part := range complete.Parts {
+			if part.ETag != fmt.Sprintf(`"etag-%v"`, part.PartNumber) {
+				fmt.Fprint(response, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object.WriteString(parts[part.PartNumber])
+		}
+		fake.objects[key] = object.String()
+		delete(fake.uploads, query.Get("uploadId"))
+		fmt.Fprint(response, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case request.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(fake.uploads, query.Get("uploadId"))
+		fake.aborted++
+		response.WriteHeader(http.StatusNoContent)
+	case request.Method == http.MethodGet:
+		object, ok := fake.objects[key]
+		if !ok {
+			http.Error(response, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(response, object)
+	case request.Method == http.MethodDelete:
+		delete(fake.objects, key)
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(response, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func (fake *fakeS3) keys() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var keys []string
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestStore(server *httptest.Server, accessKeyID string) *s3.BodyStore {
+	return s3.NewBodyStore(&s3.Options{
+		Bucket:          "bucket",
+		Region:          "us-east-1",
+		Endpoint:        server.URL,
+		Prefix:          "uploads/",
+		AccessKeyID:     secrets.FromValue(accessKeyID),
+		SecretAccessKey: secrets.FromValue("test-secret"),
+		PartSize:        5,
+	})
+}
+
+func TestBodyStore(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestStore(server, "test-key")
+
+	testCases := []struct {
+		desc string
+		body string
+	}{
+		{desc: "Empty bodies are stored", body: ""},
+		{desc: "Bodies smaller than a part are stored", body: "abc"},
+		{desc: "Bodies are uploaded in parts", body: "0123456789abcdef"},
+	}
+	for _, testCase := range testCases {
+		body, err := store.Create()
+		if err != nil {
+			t.Errorf("Test '%v': Error creating body: %v", testCase.desc, err)
+			continue
+		}
+		// Write in uneven pieces, to exercise partial parts.
+		for i := 0; i < len(testCase.body); i += 3 {
+			if _, err := body.Write([]byte(testCase.body[i:min(i+3, len(testCase.body))])); err != nil {
+				t.Errorf("Test '%v': Error writing body: %v", testCase.desc, err)
+			}
+		}
+		if err := body.Finish(); err != nil {
+			t.Errorf("Test '%v': Error finishing body: %v", testCase.desc, err)
+			continue
+		}
+
+		for i := 0; i < 2; i++ {
+			reader := body.Open()
+			read, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(read) != testCase.body {
+				t.Errorf("Test '%v': Expected to read %q but got %q (%v)", testCase.desc, testCase.body, read, err)
+			}
+		}
+
+		keys := fake.keys()
+		if len(keys) != 1 || !strings.HasPrefix(keys[0], "uploads/relay-body-") {
+			t.Errorf("Test '%v': Expected one object with the prefix but found %v", testCase.desc, keys)
+		}
+		if err := body.Remove(); err != nil {
+			t.Errorf("Test '%v': Error removing body: %v", testCase.desc, err)
+		}
+		if err := body.Remove(); err != nil {
+			t.Errorf("Test '%v': Error removing body again: %v", testCase.desc, err)
+		}
+		if keys := fake.keys(); len(keys) != 0 {
+			t.Errorf("Test '%v': Expected the object to be deleted but found %v", testCase.desc, keys)
+		}
+	}
+
+	// Bodies removed before they're finished are aborted.
+	body, err := store.Create()
+	if err != nil {
+		t.Fatalf("Error creating body: %v", err)
+	}
+	body.Write([]byte("0123456789"))
+	if err := body.Remove(); err != nil {
+		t.Errorf("Error removing unfinished body: %v", err)
+	}
+	if fake.aborted != 1 || len(fake.uploads) != 0 {
+		t.Errorf("Expected the upload to be aborted but found %v aborted, %v in progress", fake.aborted, len(fake.uploads))
+	}
+}
+
+func TestBodyStoreErrors(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+	store := newTestStore(server, "wrong-key")
+
+	if _, err := store.Create(); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Expected an AccessDenied error but got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Package secrets reads credentials, like API tokens and passwords, from the
+// configuration. A secret can be given inline, which is normally done via an
+// environment variable substitution, or as the path to a file, such as a
+// mounted Kubernetes or Docker secret. Secrets read from files are re-read
+// when the file changes, so rotated credentials take effect without a restart.
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+)
+
+// Secret is a credential which is either fixed or read from a file. It's safe
+// for concurrent use.
+type Secret struct {
+	value string // The inline value, or the cached contents of the file.
+	path  string // If non-empty, the file from which the value is read.
+
+	mutex   sync.Mutex
+	modTime time.Time // The modification time of the file when it was last read.
+}
+
+// Lookup reads the secret named key from a configuration section. The secret
+// is given either inline, as the value of key, or as a path in the value of
+// key + "-file"; specifying both is an error. If neither is present, nil is
+// returned. Files are read immediately, so missing files are reported at
+// startup.
+func Lookup(section *config.Section, key string) (*Secret, error) {
+	value, err := config.LookupOptional[string](section, key)
+	if err != nil {
+		return nil, err
+	}
+	fileKey := key + "-file"
+	path, err := config.LookupOptional[string](section, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case value != nil && path != nil:
+		return nil, fmt.Errorf(`Only one of "%v" and "%v" may be specified`, key, fileKey)
+	case value != nil:
+		return FromValue(*value), nil
+	case path != nil:
+		secret := &Secret{path: *path}
+		if _, err := secret.Value(); err != nil {
+			return nil, err
+		}
+		return secret, nil
+	default:
+		return nil, nil
+	}
+}
+
+// FromValue returns a Secret with a fixed value.
+func FromValue(value string) *Secret {
+	return &Secret{value: value}
+}
+
+// Value returns the secret's current value. Leading and trailing whitespace,
+// like the newline that usually ends a file, is removed from values read from
+// files. If the file can no longer be read, the error is returned along with
+// the last value which was read successfully.
+func (secret *Secret) Value() (string, error) {
+	if secret.path == "" {
+		return secret.value, nil
+	}
+
+	secret.mutex.Lock()
+	defer secret.mutex.Unlock()
+
+	info, err := os.Stat(secret.path)
+	if err != nil {
+		return secret.value, fmt.Errorf("Error reading secret: %v", err)
+	}
+	if !info.ModTime().Equal(secret.modTime) || secret.modTime.IsZero() {
+		contents, err := os.ReadFile(secret.path)
+		if err != nil {
+			return secret.value, fmt.Errorf("Error reading secret: %v", err)
+		}
+		secret.value = strings.TrimSpace(string(contents))
+		secret.modTime = info.ModTime()
+	}
+	return secret.value, nil
+}
+
+// String returns a description of the secret which doesn't reveal its value,
+// so that secrets can be logged safely.
+func (secret *Secret) String() string {
+	if secret.path != "" {
+		return fmt.Sprintf("secret from %v", secret.path)
+	}
+	return "inline secret"
+}
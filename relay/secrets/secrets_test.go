@@ -0,0 +1,111 @@
+package secrets_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+func TestLookup(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("Error writing secret file: %v", err)
+	}
+
+	testCases := []struct {
+		desc          string
+		config        string
+		expectedValue string
+		expectedNil   bool
+		expectedError bool
+	}{
+		{
+			desc:          "Secrets can be given inline",
+			config:        "token: inline-value",
+			expectedValue: "inline-value",
+		},
+		{
+			desc:          "Secrets can be read from files",
+			config:        "token-file: " + path,
+			expectedValue: "from-file",
+		},
+		{
+			desc:        "Empty options are treated as absent",
+			config:      "token:\ntoken-file:",
+			expectedNil: true,
+		},
+		{
+			desc:          "Inline and file secrets can't be combined",
+			config:        "token: inline-value\ntoken-file: " + path,
+			expectedError: true,
+		},
+		{
+			desc:          "Missing files are reported",
+			config:        "token-file: " + filepath.Join(directory, "missing"),
+			expectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString("test:\n    " + strings.ReplaceAll(testCase.config, "\n", "\n    ") + "\n")
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+
+		secret, err := secrets.Lookup(configFile.LookupOptionalSection("test"), "token")
+		if testCase.expectedError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error", testCase.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Unexpected error: %v", testCase.desc, err)
+			continue
+		}
+		if testCase.expectedNil {
+			if secret != nil {
+				t.Errorf("Test '%v': Expected no secret but got %v", testCase.desc, secret)
+			}
+			continue
+		}
+		if value, err := secret.Value(); err != nil || value != testCase.expectedValue {
+			t.Errorf("Test '%v': Expected value %q but got %q, %v", testCase.desc, testCase.expectedValue, value, err)
+		}
+	}
+}
+
+func TestFileSecretsAreReloaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first"), 0o600); err != nil {
+		t.Fatalf("Error writing secret file: %v", err)
+	}
+	section := config.NewSection("test")
+	section.Set("token-file", path)
+	secret, err := secrets.Lookup(section, "token")
+	if err != nil {
+		t.Fatalf("Error looking up secret: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("second"), 0o600); err != nil {
+		t.Fatalf("Error rewriting secret file: %v", err)
+	}
+	// Make sure the modification time changes even on coarse filesystems.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if value, err := secret.Value(); err != nil || value != "second" {
+		t.Errorf("Expected the rotated value but got %q, %v", value, err)
+	}
+
+	os.Remove(path)
+	if value, err := secret.Value(); err == nil || value != "second" {
+		t.Errorf("Expected an error along with the last value but got %q, %v", value, err)
+	}
+}
@@ -1,22 +1,46 @@
 package relay
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/journal"
+	"github.com/immersa-co/relay-core/relay/metrics"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 var MonitorPath = "/__relay__up__/"
 
+// MetricsPath is the path at which metrics are served on the metrics listener.
+var MetricsPath = "/metrics"
+
 // ServiceOptions contains configuration options for the relay network service.
 //
 // See also traffic.RelayOptions, which provides options for the actual relay
 // functionality.
 type ServiceOptions struct {
-	Port int // The port that the relay service should listen on.
+	Port        int                   // The port that the relay service should listen on.
+	MetricsPort int                   // If non-zero, the port on which metrics are served.
+	AdminPort   int                   // If non-zero, the port on which the admin endpoints are served.
+	TLS         *TLSOptions           // If non-nil, the service terminates TLS.
+	Hosts       []*VirtualHostOptions // Routes selected by the request's Host header.
+
+	// If non-zero, requests beyond this many at once are rejected with a 503.
+	MaxConcurrentRequests int
+	// If non-zero, requests whose headers exceed roughly this many bytes are
+	// rejected with a 431. Otherwise, net/http's default of 1MB applies.
+	MaxHeaderBytes int
+	// If true, only GET, HEAD and OPTIONS requests are relayed; see
+	// Service.SetReadOnly.
+	ReadOnly bool
 }
 
 func NewDefaultServiceOptions() *ServiceOptions {
@@ -26,8 +50,30 @@ func NewDefaultServiceOptions() *ServiceOptions {
 // Service implements the relay service, exposing both the traffic handler and
 // the monitoring page.
 type Service struct {
-	listener net.Listener
-	mux      *http.ServeMux
+	server            *http.Server
+	listener          net.Listener
+	metricsListener   net.Listener
+	adminListener     net.Listener
+	ready             atomic.Bool // True while the service is accepting traffic.
+	mux               *http.ServeMux
+	router            *hostRouter
+	limiter           *concurrencyLimiter
+	readOnly          *readOnlyGuard
+	requests          *requestTracker
+	maxHeaderBytes    int
+	tlsConfig         *tls.Config
+	metrics           *metrics.Registry
+	clock             clock.Clock
+	connectionPlugins []traffic.ConnectionPlugin
+	journal           *journal.Journal
+	relayConfig       *traffic.RelayOptions // The default route's relay options.
+
+	lock           sync.RWMutex // Guards the fields below, which Reload replaces.
+	trafficPlugins []traffic.Plugin
+	routes         []*serviceRoute
+	configFile     *config.File
+	lastReload     *ReloadReport
+	pluginAdmin    http.Handler // Serves the plugins' admin endpoints.
 }
 
 func NewService(relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plugin) *Service {
@@ -41,13 +87,63 @@ func NewService(relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plug
 	})
 
 	// Set up the traffic handler.
-	mux.Handle("/", traffic.NewHandler(relayConfig, trafficPlugins))
+	handler := traffic.NewHandler(relayConfig, trafficPlugins)
+	router := &hostRouter{defaultHandler: handler}
+	limiter := &concurrencyLimiter{handler: router}
+	readOnly := &readOnlyGuard{handler: limiter}
+	requests := newRequestTracker(readOnly, clock.OrReal(relayConfig.Clock))
+	mux.Handle("/", requests)
+
+	// Plugins may optionally observe client connections.
+	var connectionPlugins []traffic.ConnectionPlugin
+	for _, trafficPlugin := range trafficPlugins {
+		if connectionPlugin, ok := traffic.UnwrapPlugin(trafficPlugin).(traffic.ConnectionPlugin); ok {
+			connectionPlugins = append(connectionPlugins, connectionPlugin)
+		}
+	}
 
 	return &Service{
-		mux: mux,
+		mux:               mux,
+		router:            router,
+		limiter:           limiter,
+		readOnly:          readOnly,
+		requests:          requests,
+		metrics:           handler.Metrics(),
+		clock:             clock.OrReal(relayConfig.Clock),
+		connectionPlugins: connectionPlugins,
+		journal:           relayConfig.Journal,
+		relayConfig:       relayConfig,
+		trafficPlugins:    trafficPlugins,
 	}
 }
 
+// NewFromConfig creates a service from options read by ReadOptions, applying
+// its request limits, read-only mode, virtual hosts, and TLS routes. Routes
+// with plugin configurations of their own create their plugins by calling
+// loadPlugins with them.
+func NewFromConfig(
+	options *Options,
+	trafficPlugins []traffic.Plugin,
+	loadPlugins func(configFile *config.File) ([]traffic.Plugin, error),
+) (*Service, error) {
+	service := NewService(options.Relay, trafficPlugins)
+	service.configFile = options.ConfigFile
+	service.SetRequestLimits(options.Service)
+	service.SetReadOnly(options.Service.ReadOnly)
+	if err := service.AddVirtualHosts(options.Service.Hosts, options.Relay, trafficPlugins, loadPlugins); err != nil {
+		return nil, err
+	}
+	if tlsOptions := options.Service.TLS; tlsOptions != nil {
+		if err := service.AddSNIRoutes(tlsOptions, options.Relay, trafficPlugins, loadPlugins); err != nil {
+			return nil, err
+		}
+		if err := service.EnableTLS(tlsOptions); err != nil {
+			return nil, err
+		}
+	}
+	return service, nil
+}
+
 func (service *Service) Address() string {
 	if service.listener == nil {
 		return ""
@@ -55,14 +151,92 @@ func (service *Service) Address() string {
 	return service.listener.Addr().(*net.TCPAddr).String()
 }
 
+// Close stops the service from accepting traffic, and closes the plugins,
+// including those of its routes, which implement io.Closer, such as to stop
+// their background work. The traffic handlers' background work is stopped
+// too.
 func (service *Service) Close() error {
+	service.ready.Store(false)
+	service.lock.RLock()
+	closePlugins(service.trafficPlugins)
+	for _, route := range service.routes {
+		closePlugins(route.ownPlugins())
+	}
+	service.lock.RUnlock()
+	closeHandlers(service.router.handlers())
+	if service.metricsListener != nil {
+		service.metricsListener.Close()
+	}
+	if service.adminListener != nil {
+		service.adminListener.Close()
+	}
 	if service.listener == nil {
 		return nil
 	}
 	return service.listener.Close()
 }
 
+func closePlugins(trafficPlugins []traffic.Plugin) {
+	for _, plugin := range trafficPlugins {
+		if closer, ok := traffic.UnwrapPlugin(plugin).(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Errorf("Error closing plugin %v: %v", plugin.Name(), err)
+			}
+		}
+	}
+}
+
+// closeHandlers stops the background work of traffic handlers, like sending
+// copies of requests to the mirror target.
+func closeHandlers(handlers []http.Handler) {
+	for _, handler := range handlers {
+		if closer, ok := handler.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Metrics returns the registry in which the service records metrics.
+func (service *Service) Metrics() *metrics.Registry {
+	return service.metrics
+}
+
+// MetricsUrl returns the URL of the metrics endpoint, or "" if the metrics
+// listener hasn't been started.
+func (service *Service) MetricsUrl() string {
+	if service.metricsListener == nil {
+		return ""
+	}
+	return fmt.Sprintf("http://%v%v", service.metricsListener.Addr().String(), MetricsPath)
+}
+
+// StartMetrics starts a separate listener which serves metrics in the
+// Prometheus text format at MetricsPath. Metrics are served on their own port
+// so that they aren't exposed to the clients whose traffic is being relayed.
+func (service *Service) StartMetrics(host string, port int) error {
+	address := fmt.Sprintf("%v:%v", host, port)
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, service.metrics.Handler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	service.metricsListener = listener
+
+	go server.Serve(listener)
+
+	return nil
+}
+
 func (service *Service) HttpUrl() string {
+	if service.tlsConfig != nil {
+		return fmt.Sprintf("https://%v", service.Address())
+	}
 	return fmt.Sprintf("http://%v", service.Address())
 }
 
@@ -79,24 +253,37 @@ func (service *Service) Start(host string, port int) error {
 		Addr:              address,
 		Handler:           service.mux,
 		ReadHeaderTimeout: 2 * time.Second,
+		MaxHeaderBytes:    service.maxHeaderBytes,
+		ConnContext:       withConn,
 	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
 	service.listener = listener
+	service.server = server
+
+	serviceListener := newConnectionTrackingListener(
+		TcpKeepAliveListener{listener.(*net.TCPListener)},
+		service.connectionPlugins,
+		service.clock,
+	)
+	if service.tlsConfig != nil {
+		serviceListener = newTLSListener(serviceListener, service.tlsConfig)
+	}
+
+	service.ready.Store(true)
 
 	go func() {
-		server.Serve(
-			TcpKeepAliveListener{
-				listener.(*net.TCPListener),
-			},
-		)
+		server.Serve(serviceListener)
 	}()
 
 	return nil
 }
 
 func (service *Service) WsUrl() string {
+	if service.tlsConfig != nil {
+		return fmt.Sprintf("wss://%v", service.Address())
+	}
 	return fmt.Sprintf("ws://%v", service.Address())
 }
@@ -0,0 +1,355 @@
+// Package storage provides at-rest persistence for relay features that write
+// traffic to disk, like spooling, recording, and dead-letter capture. Payloads
+// can be encrypted with AES-GCM, and files older than a configurable age are
+// cleaned up automatically, so that persisted traffic meets the same privacy
+// bar as relayed traffic.
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+var logger = logging.New("relay-storage")
+
+// Every stored file begins with a short header identifying its format, so that
+// files written before encryption was enabled (or after it was disabled) can
+// still be read.
+var (
+	plaintextMagic = []byte("RLY0")
+	encryptedMagic = []byte("RLY1")
+)
+
+// fileSuffix is appended to the names of all stored files. Files without this
+// suffix are ignored, so a storage directory can safely be shared with other
+// data.
+const fileSuffix = ".rly"
+
+// Options contains configuration options for a Store.
+type Options struct {
+	Directory     string        // The directory in which files are stored.
+	EncryptionKey []byte        // If non-empty, an AES key (16, 24, or 32 bytes) used to encrypt files.
+	MaxAge        time.Duration // If non-zero, files older than this are deleted by Cleanup.
+	Clock         clock.Clock   // The source of the current time. If nil, the real time is used.
+}
+
+// ReadOptions reads storage options from a configuration section. Features
+// which persist traffic embed these options in their own configuration
+// section, so the same keys are used everywhere:
+//
+//   - directory: where files are stored (required)
+//   - encryption-key: a base64-encoded AES key
+//   - encryption-key-file: a file containing a base64-encoded AES key
+//   - max-age: how long files are kept, like "24h"
+//
+// Keys are normally supplied via environment variable substitution or a
+// mounted secret file rather than written directly into the configuration.
+func ReadOptions(section *config.Section) (*Options, error) {
+	options := &Options{}
+
+	directory, err := config.LookupRequired[string](section, "directory")
+	if err != nil {
+		return nil, err
+	}
+	options.Directory = directory
+
+	if options.EncryptionKey, err = ReadKey(section, "encryption-key"); err != nil {
+		return nil, err
+	}
+
+	if maxAge, err := config.LookupOptional[time.Duration](section, "max-age"); err != nil {
+		return nil, err
+	} else if maxAge != nil {
+		options.MaxAge = *maxAge
+	}
+
+	return options, nil
+}
+
+// ReadKey reads an encryption key from a configuration section. Like other
+// secrets, the base64-encoded key is given either as the value of key, or in
+// the file named by key + "-file". If neither is present, nil is returned.
+func ReadKey(section *config.Section, key string) ([]byte, error) {
+	secret, err := secrets.Lookup(section, key)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	value, err := secret.Value()
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, err := decodeKey(value)
+	if err != nil {
+		return nil, fmt.Errorf(`Error parsing configuration option "%v" in section "%v": %v`, key, section.Name, err)
+	}
+	return encryptionKey, nil
+}
+
+func decodeKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("Encryption key is not valid base64: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Encryption key must be 16, 24, or 32 bytes long; got %d", len(key))
+	}
+}
+
+// Store persists named payloads as files in a directory.
+type Store struct {
+	options *Options
+	aead    cipher.AEAD
+	mutex   sync.Mutex
+	stop    chan struct{}
+}
+
+// NewStore creates a Store, creating its directory if necessary.
+func NewStore(options *Options) (*Store, error) {
+	if options.Directory == "" {
+		return nil, errors.New("Storage directory must be specified")
+	}
+	if err := os.MkdirAll(options.Directory, 0o700); err != nil {
+		return nil, err
+	}
+
+	store := &Store{options: options}
+	if len(options.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(options.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		store.aead = aead
+	}
+
+	return store, nil
+}
+
+// Encrypted returns true if this Store encrypts the files it writes.
+func (store *Store) Encrypted() bool {
+	return store.aead != nil
+}
+
+// Write stores data under the provided name, replacing any existing data. The
+// file is written atomically, so readers never observe a partial file.
+func (store *Store) Write(name string, data []byte) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	var contents []byte
+	if store.aead != nil {
+		nonce := make([]byte, store.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		contents = append(contents, encryptedMagic...)
+		contents = append(contents, nonce...)
+		// The name is used as additional authenticated data so that encrypted
+		// files can't be swapped with one another undetected.
+		contents = store.aead.Seal(contents, nonce, data, []byte(name))
+	} else {
+		contents = append(append(contents, plaintextMagic...), data...)
+	}
+
+	tempFile, err := os.CreateTemp(store.options.Directory, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(contents); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// Read returns the data stored under the provided name.
+func (store *Store) Read(name string) ([]byte, error) {
+	reader, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// decrypt returns the data in the contents of a file written by Write, after
+// its header.
+func (store *Store) decrypt(name string, contents []byte) ([]byte, error) {
+	if store.aead == nil {
+		return nil, fmt.Errorf(`Stored file "%v" is encrypted, but no encryption key is configured`, name)
+	}
+	nonceSize := store.aead.NonceSize()
+	if len(contents) < nonceSize {
+		return nil, fmt.Errorf(`Stored file "%v" is truncated`, name)
+	}
+	data, err := store.aead.Open(nil, contents[:nonceSize], contents[nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf(`Could not decrypt stored file "%v": %v`, name, err)
+	}
+	return data, nil
+}
+
+// Delete removes the data stored under the provided name. Deleting a name
+// that doesn't exist is not an error.
+func (store *Store) Delete(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the names of all stored files, oldest first.
+func (store *Store) List() ([]string, error) {
+	entries, err := store.entries()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names, nil
+}
+
+// Cleanup deletes files older than Options.MaxAge and returns the number of
+// files deleted. If MaxAge is zero, nothing is deleted.
+func (store *Store) Cleanup() (int, error) {
+	if store.options.MaxAge <= 0 {
+		return 0, nil
+	}
+
+	entries, err := store.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := clock.OrReal(store.options.Clock).Now().Add(-store.options.MaxAge)
+	deleted := 0
+	for _, entry := range entries {
+		if entry.modTime.After(cutoff) {
+			break // Entries are sorted oldest first.
+		}
+		if err := store.Delete(entry.name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// StartCleanup runs Cleanup periodically in the background until Close is
+// called.
+func (store *Store) StartCleanup(interval time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.stop != nil || store.options.MaxAge <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	store.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if deleted, err := store.Cleanup(); err != nil {
+					logger.Errorf("Error cleaning up %v: %v", store.options.Directory, err)
+				} else if deleted > 0 {
+					logger.Printf("Deleted %d expired files from %v", deleted, store.options.Directory)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background cleanup, if it was started.
+func (store *Store) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.stop != nil {
+		close(store.stop)
+		store.stop = nil
+	}
+	return nil
+}
+
+type storeEntry struct {
+	name    string
+	modTime time.Time
+}
+
+func (store *Store) entries() ([]storeEntry, error) {
+	dirEntries, err := os.ReadDir(store.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []storeEntry
+	for _, dirEntry := range dirEntries {
+		fileName := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasSuffix(fileName, fileSuffix) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue // The file was removed concurrently.
+		}
+		entries = append(entries, storeEntry{
+			name:    strings.TrimSuffix(fileName, fileSuffix),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].modTime.Equal(entries[j].modTime) {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	return entries, nil
+}
+
+// path returns the path of the file for the provided name. Names must not
+// contain path separators, so a Store can never write outside its directory.
+func (store *Store) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf(`Invalid stored file name "%v"`, name)
+	}
+	return filepath.Join(store.options.Directory, name+fileSuffix), nil
+}
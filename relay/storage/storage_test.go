@@ -0,0 +1,244 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestStoreRoundTrip(t *testing.T) {
+	testCases := []struct {
+		desc string
+		key  []byte
+	}{
+		{desc: "Plaintext"},
+		{desc: "Encrypted", key: testKey},
+	}
+
+	for _, testCase := range testCases {
+		directory := t.TempDir()
+		store, err := storage.NewStore(&storage.Options{
+			Directory:     directory,
+			EncryptionKey: testCase.key,
+		})
+		if err != nil {
+			t.Errorf("Test '%v': Error creating store: %v", testCase.desc, err)
+			continue
+		}
+
+		payload := []byte(`{"secret": "value"}`)
+		if err := store.Write("request-1", payload); err != nil {
+			t.Errorf("Test '%v': Error writing: %v", testCase.desc, err)
+			continue
+		}
+
+		data, err := store.Read("request-1")
+		if err != nil {
+			t.Errorf("Test '%v': Error reading: %v", testCase.desc, err)
+			continue
+		}
+		if !bytes.Equal(data, payload) {
+			t.Errorf("Test '%v': Expected '%s' but got '%s'", testCase.desc, payload, data)
+		}
+
+		raw, _ := os.ReadFile(filepath.Join(directory, "request-1.rly"))
+		if encrypted := !bytes.Contains(raw, payload); encrypted != (testCase.key != nil) {
+			t.Errorf("Test '%v': Unexpected on-disk contents: %q", testCase.desc, raw)
+		}
+	}
+}
+
+func TestStoreRejectsTamperedFiles(t *testing.T) {
+	directory := t.TempDir()
+	store, _ := storage.NewStore(&storage.Options{Directory: directory, EncryptionKey: testKey})
+	store.Write("a", []byte("payload a"))
+	store.Write("b", []byte("payload b"))
+
+	// Swapping encrypted files should be detected.
+	raw, _ := os.ReadFile(filepath.Join(directory, "a.rly"))
+	os.WriteFile(filepath.Join(directory, "b.rly"), raw, 0o600)
+	if _, err := store.Read("b"); err == nil {
+		t.Errorf("Expected reading a swapped file to fail")
+	}
+
+	// So should reading an encrypted file without a key.
+	plainStore, _ := storage.NewStore(&storage.Options{Directory: directory})
+	if _, err := plainStore.Read("a"); err == nil {
+		t.Errorf("Expected reading an encrypted file without a key to fail")
+	}
+
+	if err := store.Write("../escape", []byte("x")); err == nil {
+		t.Errorf("Expected names containing path separators to be rejected")
+	}
+}
+
+func TestStoreCleanup(t *testing.T) {
+	directory := t.TempDir()
+	store, _ := storage.NewStore(&storage.Options{Directory: directory, MaxAge: time.Hour})
+	store.Write("old", []byte("old"))
+	store.Write("new", []byte("new"))
+
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(directory, "old.rly"), past, past)
+
+	deleted, err := store.Cleanup()
+	if err != nil {
+		t.Fatalf("Error cleaning up: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 file to be deleted but got %v", deleted)
+	}
+
+	names, _ := store.List()
+	if len(names) != 1 || names[0] != "new" {
+		t.Errorf("Unexpected remaining files: %v", names)
+	}
+}
+
+func TestStoreCleanupUsesClock(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	store, _ := storage.NewStore(&storage.Options{Directory: t.TempDir(), MaxAge: time.Hour, Clock: fakeClock})
+	store.Write("file", []byte("data"))
+
+	if deleted, _ := store.Cleanup(); deleted != 0 {
+		t.Errorf("Expected no files to be deleted before they expire but got %v", deleted)
+	}
+
+	fakeClock.Advance(2 * time.Hour)
+	if deleted, _ := store.Cleanup(); deleted != 1 {
+		t.Errorf("Expected 1 file to be deleted after it expired but got %v", deleted)
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	encodedKey := base64.StdEncoding.EncodeToString(testKey)
+	configFile, err := config.NewFileFromYamlString(`spool:
+    directory: /tmp/spool
+    encryption-key: ` + encodedKey + `
+    max-age: 24h
+`)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	options, err := storage.ReadOptions(configFile.GetOrAddSection("spool"))
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	if options.Directory != "/tmp/spool" || !bytes.Equal(options.EncryptionKey, testKey) || options.MaxAge != 24*time.Hour {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+
+	badSection := config.NewSection("spool")
+	badSection.Set("directory", "/tmp/spool")
+	badSection.Set("encryption-key", "c2hvcnQ=")
+	if _, err := storage.ReadOptions(badSection); err == nil {
+		t.Errorf("Expected a short key to be rejected")
+	}
+}
+
+func TestStoreStreams(t *testing.T) {
+	testCases := []struct {
+		desc string
+		key  []byte
+	}{
+		{desc: "Plaintext"},
+		{desc: "Encrypted", key: testKey},
+	}
+
+	// Large enough to span several chunks.
+	payload := bytes.Repeat([]byte(`{"secret": "value"}`), 10000)
+
+	for _, testCase := range testCases {
+		directory := t.TempDir()
+		store, _ := storage.NewStore(&storage.Options{Directory: directory, EncryptionKey: testCase.key})
+
+		writer, err := store.Create("stream")
+		if err != nil {
+			t.Errorf("Test '%v': Error creating: %v", testCase.desc, err)
+			continue
+		}
+		for i := 0; i < len(payload); i += 1000 {
+			writer.Write(payload[i:min(i+1000, len(payload))])
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("Test '%v': Error closing: %v", testCase.desc, err)
+			continue
+		}
+
+		reader, err := store.Open("stream")
+		if err != nil {
+			t.Errorf("Test '%v': Error opening: %v", testCase.desc, err)
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Errorf("Test '%v': Expected to read the payload back but got %v bytes (%v)", testCase.desc, len(data), err)
+		}
+		if data, err := store.Read("stream"); err != nil || !bytes.Equal(data, payload) {
+			t.Errorf("Test '%v': Expected Read to return the payload but got %v bytes (%v)", testCase.desc, len(data), err)
+		}
+
+		raw, _ := os.ReadFile(filepath.Join(directory, "stream.rly"))
+		if encrypted := !bytes.Contains(raw, payload[:100]); encrypted != (testCase.key != nil) {
+			t.Errorf("Test '%v': Unexpected on-disk contents: %q", testCase.desc, raw[:100])
+		}
+	}
+}
+
+func TestStoreRejectsTamperedStreams(t *testing.T) {
+	directory := t.TempDir()
+	store, _ := storage.NewStore(&storage.Options{Directory: directory, EncryptionKey: testKey})
+	payload := bytes.Repeat([]byte("payload "), 20000)
+	writer, _ := store.Create("a")
+	writer.Write(payload)
+	writer.Close()
+	raw, _ := os.ReadFile(filepath.Join(directory, "a.rly"))
+
+	// Files which end early, even at the end of a chunk, are truncated.
+	os.WriteFile(filepath.Join(directory, "b.rly"), raw[:len(raw)-1], 0o600)
+	if _, err := store.Read("b"); err == nil {
+		t.Errorf("Expected reading a truncated file to fail")
+	}
+	os.WriteFile(filepath.Join(directory, "c.rly"), raw[:4+8+5+64*1024+16], 0o600)
+	if _, err := store.Read("c"); err == nil {
+		t.Errorf("Expected reading a file truncated after a chunk to fail")
+	}
+
+	// So are files which were never closed, though what was flushed can be
+	// read first.
+	unclosed, _ := store.Create("d")
+	unclosed.Write([]byte("flushed"))
+	unclosed.Flush()
+	data, err := store.Read("d")
+	if string(data) != "flushed" || !errors.Is(err, storage.ErrUnfinished) {
+		t.Errorf("Expected to read what was flushed and then fail, but got %q (%v)", data, err)
+	}
+	unclosed.Close()
+	if data, err := store.Read("d"); string(data) != "flushed" || err != nil {
+		t.Errorf("Expected to read what was written once closed, but got %q (%v)", data, err)
+	}
+
+	// Swapped files are detected, as with Write.
+	os.WriteFile(filepath.Join(directory, "e.rly"), raw, 0o600)
+	if _, err := store.Read("e"); err == nil {
+		t.Errorf("Expected reading a swapped file to fail")
+	}
+
+	plainStore, _ := storage.NewStore(&storage.Options{Directory: directory})
+	if _, err := plainStore.Open("a"); err == nil {
+		t.Errorf("Expected opening an encrypted file without a key to fail")
+	}
+}
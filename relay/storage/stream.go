@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Files written with Store.Create are encrypted in chunks, so that payloads
+// too large to hold in memory can be written and read as streams. Each chunk
+// is sealed separately, with a nonce made of a random prefix and the chunk's
+// number, so chunks can't be reordered. Every chunk is marked as either final
+// or not, and the mark is authenticated, so a truncated file is detected
+// rather than read as a shorter payload.
+var streamMagic = []byte("RLY2")
+
+// ErrUnfinished is reported by readers of encrypted files written with Create
+// which end before the Writer was closed: either it's still being written, or
+// the relay stopped without closing it. Everything before the end of the last
+// chunk which was written is read first.
+var ErrUnfinished = errors.New("Stored file is unfinished")
+
+const (
+	streamChunkSize  = 64 * 1024
+	streamChunkMore  = 0
+	streamChunkFinal = 1
+)
+
+// Writer writes a payload to a Store as it's produced. It's returned by
+// Store.Create.
+type Writer struct {
+	file   *os.File
+	name   string
+	aead   cipher.AEAD // Nil if the file isn't encrypted.
+	nonce  []byte      // The random prefix, followed by the chunk number.
+	chunk  []byte      // Data which hasn't been sealed yet.
+	chunks uint32
+	err    error
+}
+
+// Create returns a Writer which stores data under the provided name as it's
+// written, replacing any existing data. Unlike Write, the file is visible while
+// it's written, and is subject to Cleanup; readers of encrypted files report
+// ErrUnfinished until the Writer has been closed.
+func (store *Store) Create(name string) (*Writer, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{file: file, name: name, aead: store.aead}
+	header := plaintextMagic
+	if store.aead != nil {
+		// The last four bytes of the nonce hold the chunk number.
+		writer.nonce = make([]byte, store.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, writer.nonce[:len(writer.nonce)-4]); err != nil {
+			file.Close()
+			return nil, err
+		}
+		header = append(append([]byte{}, streamMagic...), writer.nonce[:len(writer.nonce)-4]...)
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write adds data to the file. Encrypted data is buffered until a whole chunk
+// is available, or Flush or Close is called.
+func (writer *Writer) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	if writer.aead == nil {
+		n, err := writer.file.Write(p)
+		writer.err = err
+		return n, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), streamChunkSize-len(writer.chunk))
+		writer.chunk = append(writer.chunk, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(writer.chunk) == streamChunkSize {
+			if err := writer.seal(streamChunkMore); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush writes any buffered data to the file, so that it's read back even if
+// the relay stops before Close is called.
+func (writer *Writer) Flush() error {
+	if writer.err != nil || writer.aead == nil || len(writer.chunk) == 0 {
+		return writer.err
+	}
+	return writer.seal(streamChunkMore)
+}
+
+// Close writes the end of the file and closes it.
+func (writer *Writer) Close() error {
+	if writer.file == nil {
+		return writer.err
+	}
+	if writer.aead != nil && writer.err == nil {
+		writer.seal(streamChunkFinal)
+	}
+	if err := writer.file.Close(); writer.err == nil {
+		writer.err = err
+	}
+	writer.file = nil
+	if writer.err == nil {
+		// Later writes fail, but repeated calls to Close succeed.
+		writer.err = os.ErrClosed
+		return nil
+	}
+	return writer.err
+}
+
+// seal encrypts the buffered data as a chunk. Each chunk is written with its
+// mark and length; the name and mark are used as additional authenticated
+// data.
+func (writer *Writer) seal(mark byte) error {
+	binary.BigEndian.PutUint32(writer.nonce[len(writer.nonce)-4:], writer.chunks)
+	writer.chunks++
+
+	contents := make([]byte, 5, 5+len(writer.chunk)+writer.aead.Overhead())
+	contents[0] = mark
+	contents = writer.aead.Seal(contents, writer.nonce, writer.chunk, append([]byte{mark}, writer.name...))
+	binary.BigEndian.PutUint32(contents[1:5], uint32(len(contents)-5))
+	writer.chunk = writer.chunk[:0]
+	if _, err := writer.file.Write(contents); err != nil {
+		writer.err = err
+	}
+	return writer.err
+}
+
+// Open returns a reader for the data stored under the provided name, which may
+// have been written by Write or Create. Data is decrypted as it's read, and
+// errors, like a file which was tampered with or never closed, are reported by
+// Read.
+func (store *Store) Open(name string) (io.ReadCloser, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := store.newReader(name, bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}, nil
+}
+
+func (store *Store) newReader(name string, source *bufio.Reader) (io.Reader, error) {
+	magic := make([]byte, len(plaintextMagic))
+	if _, err := io.ReadFull(source, magic); err != nil {
+		return nil, fmt.Errorf(`Stored file "%v" has an unknown format`, name)
+	}
+
+	switch string(magic) {
+	case string(plaintextMagic):
+		return source, nil
+
+	case string(encryptedMagic):
+		// Files written by Write are sealed whole, so they're decrypted whole.
+		contents, err := io.ReadAll(source)
+		if err != nil {
+			return nil, err
+		}
+		data, err := store.decrypt(name, contents)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+
+	case string(streamMagic):
+		if store.aead == nil {
+			return nil, fmt.Errorf(`Stored file "%v" is encrypted, but no encryption key is configured`, name)
+		}
+		reader := &streamReader{source: source, name: name, aead: store.aead}
+		reader.nonce = make([]byte, store.aead.NonceSize())
+		if _, err := io.ReadFull(source, reader.nonce[:len(reader.nonce)-4]); err != nil {
+			return nil, fmt.Errorf(`Stored file "%v" is truncated`, name)
+		}
+		return reader, nil
+
+	default:
+		return nil, fmt.Errorf(`Stored file "%v" has an unknown format`, name)
+	}
+}
+
+// streamReader decrypts a file written by a Writer, one chunk at a time.
+type streamReader struct {
+	source *bufio.Reader
+	name   string
+	aead   cipher.AEAD
+	nonce  []byte
+	chunk  []byte // Decrypted data which hasn't been read yet.
+	chunks uint32
+	final  bool // True once the final chunk has been decrypted.
+	err    error
+}
+
+func (reader *streamReader) Read(p []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.final {
+			reader.err = io.EOF
+			if _, err := reader.source.Peek(1); err != io.EOF {
+				reader.err = fmt.Errorf(`Stored file "%v" has data after its end`, reader.name)
+			}
+			continue
+		}
+		reader.err = reader.open()
+	}
+	n := copy(p, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (reader *streamReader) open() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader.source, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf(`%w: "%v"`, ErrUnfinished, reader.name)
+		}
+		return err
+	}
+	mark := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+	if mark > streamChunkFinal || length > uint32(streamChunkSize+reader.aead.Overhead()) {
+		return fmt.Errorf(`Stored file "%v" is corrupt`, reader.name)
+	}
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(reader.source, contents); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf(`%w: "%v"`, ErrUnfinished, reader.name)
+		}
+		return err
+	}
+
+	binary.BigEndian.PutUint32(reader.nonce[len(reader.nonce)-4:], reader.chunks)
+	reader.chunks++
+	data, err := reader.aead.Open(contents[:0], reader.nonce, contents, append([]byte{mark}, reader.name...))
+	if err != nil {
+		return fmt.Errorf(`Could not decrypt stored file "%v": %v`, reader.name, err)
+	}
+	reader.chunk = data
+	reader.final = mark == streamChunkFinal
+	return nil
+}
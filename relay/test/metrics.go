@@ -0,0 +1,54 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/metrics"
+)
+
+// idleTimeout bounds how long Metrics waits for the relay to finish handling
+// requests.
+const idleTimeout = 5 * time.Second
+
+// Metrics reads a relay's metrics, so that tests can make exact assertions,
+// like the number of bytes a plugin redacted, rather than only inspecting what
+// the catcher received.
+type Metrics struct {
+	t        *testing.T
+	registry *metrics.Registry
+}
+
+// ReadMetrics returns the relay's metrics once it has finished handling every
+// request in progress. Plugins may record metrics after the client has
+// received the response, so waiting makes assertions deterministic.
+func ReadMetrics(t *testing.T, relayService *relay.Service) *Metrics {
+	for start := time.Now(); len(relayService.DrainReport().Active) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > idleTimeout {
+			t.Errorf("Timed out waiting for the relay to finish handling requests")
+			break
+		}
+	}
+	return &Metrics{t: t, registry: relayService.Metrics()}
+}
+
+// Value returns the current value of the metric with the provided name and
+// labels, which are given as alternating names and values.
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	labelMap := map[string]string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelMap[labels[i]] = labels[i+1]
+	}
+	value, err := m.registry.Value(name, labelMap)
+	if err != nil {
+		m.t.Errorf("Error reading metric %v: %v", name, err)
+	}
+	return value
+}
+
+// Plugin returns the current value of one of a plugin's metrics, named
+// without the "relay_plugin_" prefix, like "bytes_redacted_total".
+func (m *Metrics) Plugin(plugin string, name string) float64 {
+	return m.Value("relay_plugin_"+name, "plugin", plugin)
+}
@@ -1,7 +1,19 @@
 package test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/immersa-co/relay-core/catcher"
 	"github.com/immersa-co/relay-core/relay"
@@ -54,6 +66,116 @@ func WithCatcherAndRelay(
 	action(catcherService, relayService)
 }
 
+// WithCatcherAndRelayMetrics is like WithCatcherAndRelay, but once the action
+// function returns, and the relay has finished handling its requests, check is
+// invoked with the relay's metrics.
+func WithCatcherAndRelayMetrics(
+	t *testing.T,
+	configYaml string,
+	pluginFactories []traffic.PluginFactory,
+	action func(catcherService *catcher.Service, relayService *relay.Service),
+	check func(metrics *Metrics),
+) {
+	WithCatcherAndRelay(t, configYaml, pluginFactories, func(catcherService *catcher.Service, relayService *relay.Service) {
+		action(catcherService, relayService)
+		check(ReadMetrics(t, relayService))
+	})
+}
+
+// CatcherHost returns the host name which WithMultiCatcherAndRelay routes to
+// the catcher with the provided index.
+func CatcherHost(index int) string {
+	return fmt.Sprintf("catcher-%d.test", index)
+}
+
+// WithMultiCatcherAndRelay is like WithCatcherAndRelay, but starts
+// catcherCount catcher services, for tests which need several targets. The
+// relay's default target is the first catcher, and, unless the configuration
+// defines virtual hosts itself, requests whose Host is CatcherHost(i) are
+// routed to the catcher at index i. The configuration may refer to the URL of
+// the catcher at index i as ${CATCHER_URL_i}, e.g. to make it the mirror
+// target.
+func WithMultiCatcherAndRelay(
+	t *testing.T,
+	catcherCount int,
+	configYaml string,
+	pluginFactories []traffic.PluginFactory,
+	action func(catcherServices []*catcher.Service, relayService *relay.Service),
+) {
+	var catcherServices []*catcher.Service
+	var replacements []string
+	var hostTargets []string
+	for i := 0; i < catcherCount; i++ {
+		catcherService := catcher.NewService()
+		if err := catcherService.Start("localhost", 0); err != nil {
+			t.Errorf("Error starting catcher: %v", err)
+			return
+		}
+		defer catcherService.Close()
+		catcherServices = append(catcherServices, catcherService)
+		replacements = append(replacements, fmt.Sprintf("${CATCHER_URL_%d}", i), catcherService.HttpUrl())
+		hostTargets = append(hostTargets, fmt.Sprintf("%v=%v", CatcherHost(i), catcherService.HttpUrl()))
+	}
+
+	configFile, err := config.NewFileFromYamlString(strings.NewReplacer(replacements...).Replace(configYaml))
+	if err != nil {
+		t.Errorf("Error parsing configuration YAML: %v", err)
+		return
+	}
+
+	relaySection := configFile.GetOrAddSection("relay")
+	relaySection.Set("port", 0)
+	relaySection.Set("target", catcherServices[0].HttpUrl())
+	hosts, _ := config.LookupOptional[any](relaySection, "hosts")
+	configuredHostTargets, _ := config.LookupOptional[any](relaySection, "host-targets")
+	if hosts == nil && configuredHostTargets == nil {
+		relaySection.Set("host-targets", strings.Join(hostTargets, " "))
+	}
+
+	relayService, err := setupRelay(configFile, pluginFactories)
+	if err != nil {
+		t.Errorf("Error setting up relay: %v", err)
+		return
+	}
+
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Errorf("Error starting relay: %v", err)
+		return
+	}
+	defer relayService.Close()
+
+	action(catcherServices, relayService)
+}
+
+// WithRelayOptions starts a relay with pre-built options and plugins, rather
+// than reading them from a configuration, and invokes the provided action
+// function. Virtual hosts and TLS routes with plugin configurations of their
+// own load them from the default plugins. The relay listens on an arbitrary
+// port, whatever options.Service.Port is.
+func WithRelayOptions(
+	t *testing.T,
+	options *relay.Options,
+	trafficPlugins []traffic.Plugin,
+	action func(relayService *relay.Service),
+) {
+	loadPlugins := func(routeConfigFile *config.File) ([]traffic.Plugin, error) {
+		return plugin_loader.Load(plugin_loader.DefaultPlugins, routeConfigFile)
+	}
+	relayService, err := relay.NewFromConfig(options, trafficPlugins, loadPlugins)
+	if err != nil {
+		t.Errorf("Error setting up relay: %v", err)
+		return
+	}
+
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Errorf("Error starting relay: %v", err)
+		return
+	}
+	defer relayService.Close()
+
+	action(relayService)
+}
+
 func setupRelay(
 	configFile *config.File,
 	pluginFactories []traffic.PluginFactory,
@@ -68,5 +190,48 @@ func setupRelay(
 		return nil, err
 	}
 
-	return relay.NewService(options.Relay, trafficPlugins), nil
+	loadPlugins := func(routeConfigFile *config.File) ([]traffic.Plugin, error) {
+		return plugin_loader.Load(pluginFactories, routeConfigFile)
+	}
+	return relay.NewFromConfig(options, trafficPlugins, loadPlugins)
+}
+
+// WriteSelfSignedCertificate generates a self-signed certificate valid for the
+// provided DNS names and writes it and its private key, in PEM format, to a
+// temporary directory which is removed when the test completes. It returns the
+// paths of the certificate and key files.
+func WriteSelfSignedCertificate(t *testing.T, dnsNames ...string) (certFile string, keyFile string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating private key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Error encoding private key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}), 0600); err != nil {
+		t.Fatalf("Error writing private key: %v", err)
+	}
+	return certFile, keyFile
 }
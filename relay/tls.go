@@ -0,0 +1,328 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay/acme"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+// TLSOptions configures TLS termination. When it's enabled, the relay serves
+// HTTPS rather than HTTP.
+type TLSOptions struct {
+	CertFile  string             // The default certificate, in PEM format.
+	KeyFile   string             // The default certificate's private key, in PEM format.
+	SNIRoutes []*SNIRouteOptions // Routes selected by the client's SNI server name.
+
+	// Additional certificates, such as those of virtual hosts, which are
+	// presented when the client's SNI server name matches their pattern.
+	Certificates []*CertificateOptions
+
+	// If non-nil, certificates for these domains are obtained automatically
+	// from an ACME certificate authority. Certificates configured explicitly
+	// take precedence.
+	ACME *acme.Options
+
+	// If true, clients may only use HTTP/1.1. Otherwise, clients may
+	// negotiate HTTP/2.
+	DisableHTTP2 bool
+}
+
+// covers returns true if a certificate will be available for the server name
+// even without a default certificate.
+func (options *TLSOptions) covers(serverName string) bool {
+	return options.CertFile != "" || (options.ACME != nil && options.ACME.Covers(serverName))
+}
+
+// CertificateOptions names a certificate to present for server names matching
+// a pattern.
+type CertificateOptions struct {
+	Pattern  string
+	CertFile string
+	KeyFile  string
+}
+
+// SNIRouteOptions describes traffic which should be handled differently based
+// on the server name the client requested during the TLS handshake. This
+// allows one relay to front several domains, each with its own target and
+// plugins.
+type SNIRouteOptions struct {
+	// The server name to match: either an exact host name or a wildcard like
+	// "*.example.com", which matches a single label.
+	ServerName string
+	RouteOptions
+}
+
+// tlsConfig is the YAML structure of the 'tls' option.
+type tlsConfig struct {
+	CertFile     string           `yaml:"cert-file"`
+	KeyFile      string           `yaml:"key-file"`
+	SNIRoutes    []sniRouteConfig `yaml:"sni-routes"`
+	ACME         acmeConfig       `yaml:"acme"`
+	DisableHTTP2 bool             `yaml:"disable-http2"`
+}
+
+type acmeConfig struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	DirectoryURL string   `yaml:"directory-url"`
+	CacheDir     string   `yaml:"cache-dir"`
+}
+
+// targetTLSConfig is the YAML structure of the 'target-tls' option.
+type targetTLSConfig struct {
+	CertFile   string `yaml:"cert-file"`
+	KeyFile    string `yaml:"key-file"`
+	CAFile     string `yaml:"ca-file"`
+	ServerName string `yaml:"server-name"`
+}
+
+type sniRouteConfig struct {
+	ServerName  string `yaml:"server-name"`
+	routeConfig `yaml:",inline"`
+}
+
+// readTLSOptions reads the 'tls' option from the relay section. It returns nil
+// if TLS termination isn't configured.
+func readTLSOptions(configSection *config.Section, configFile *config.File) (*TLSOptions, error) {
+	value, err := config.LookupOptional[tlsConfig](configSection, "tls")
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if value.CertFile == "" && value.KeyFile == "" && len(value.SNIRoutes) == 0 && len(value.ACME.Domains) == 0 {
+		return nil, nil // All of the options were left empty.
+	}
+
+	options := &TLSOptions{CertFile: value.CertFile, KeyFile: value.KeyFile, DisableHTTP2: value.DisableHTTP2}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf(`TLS options "cert-file" and "key-file" must be specified together`)
+	}
+
+	if len(value.ACME.Domains) > 0 {
+		options.ACME = &acme.Options{
+			Email:        value.ACME.Email,
+			DirectoryURL: value.ACME.DirectoryURL,
+			CacheDir:     value.ACME.CacheDir,
+		}
+		for _, domain := range value.ACME.Domains {
+			options.ACME.Domains = append(options.ACME.Domains, strings.ToLower(domain))
+		}
+		if err := options.ACME.Validate(); err != nil {
+			return nil, err
+		}
+		logger.Printf("ACME domains: %v\n", strings.Join(options.ACME.Domains, ", "))
+	}
+
+	for _, routeValue := range value.SNIRoutes {
+		serverName := strings.ToLower(routeValue.ServerName)
+		if serverName == "" {
+			return nil, fmt.Errorf(`SNI routes must specify a "server-name"`)
+		}
+		route, err := readRouteOptions(&routeValue.routeConfig, configFile)
+		if err != nil {
+			return nil, fmt.Errorf(`SNI route "%v": %v`, serverName, err)
+		}
+		if route.CertFile == "" && !options.covers(serverName) {
+			return nil, fmt.Errorf(`SNI route "%v" has no certificate, and there's no default certificate`, serverName)
+		}
+
+		logger.Printf("SNI route: %v\n", serverName)
+		options.SNIRoutes = append(options.SNIRoutes, &SNIRouteOptions{ServerName: serverName, RouteOptions: route})
+	}
+
+	return options, nil
+}
+
+// readTargetTLSConfig reads the 'target-tls' option from the relay section,
+// which configures TLS connections to the target: a client certificate to
+// present to targets which require mutual TLS, a bundle of CA certificates to
+// trust instead of the system's, and the server name to verify. It returns nil
+// if none of these are configured.
+func readTargetTLSConfig(configSection *config.Section) (*tls.Config, error) {
+	value, err := config.LookupOptional[targetTLSConfig](configSection, "target-tls")
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if *value == (targetTLSConfig{}) {
+		return nil, nil // All of the options were left empty.
+	}
+
+	tlsConfig := &tls.Config{ServerName: value.ServerName}
+	if (value.CertFile == "") != (value.KeyFile == "") {
+		return nil, fmt.Errorf(`Target TLS options "cert-file" and "key-file" must be specified together`)
+	}
+	if value.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(value.CertFile, value.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading target TLS client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+		logger.Printf("Target TLS client certificate: %v\n", value.CertFile)
+	}
+
+	if value.CAFile != "" {
+		caBundle, err := os.ReadFile(value.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading target TLS CA bundle: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf(`Target TLS CA bundle "%v" contains no PEM certificates`, value.CAFile)
+		}
+		logger.Printf("Target TLS CA bundle: %v\n", value.CAFile)
+	}
+
+	if value.ServerName != "" {
+		logger.Printf("Target TLS server name: %v\n", value.ServerName)
+	}
+	return tlsConfig, nil
+}
+
+// addVirtualHostCertificates adds the certificates of virtual hosts to the TLS
+// options, enabling TLS if any virtual host has a certificate. It returns the
+// updated options, which are nil if TLS remains disabled.
+func addVirtualHostCertificates(options *TLSOptions, hosts []*VirtualHostOptions) (*TLSOptions, error) {
+	for _, host := range hosts {
+		if host.CertFile == "" {
+			continue
+		}
+		if options == nil {
+			options = &TLSOptions{}
+		}
+		options.Certificates = append(options.Certificates, &CertificateOptions{
+			Pattern:  host.Host,
+			CertFile: host.CertFile,
+			KeyFile:  host.KeyFile,
+		})
+	}
+
+	if options != nil {
+		for _, host := range hosts {
+			if host.CertFile == "" && !options.covers(host.Host) {
+				return nil, fmt.Errorf(`Host "%v" has no certificate, and there's no default certificate`, host.Host)
+			}
+		}
+	}
+	return options, nil
+}
+
+// buildTLSConfig loads the certificates named in the TLS options and returns a
+// tls.Config which presents the right one for each server name. If ACME is
+// enabled, certificates for its domains are obtained on demand. Unless it's
+// disabled, HTTP/2 is offered to clients.
+func buildTLSConfig(options *TLSOptions) (*tls.Config, error) {
+	var defaultCertificate *tls.Certificate
+	if options.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading TLS certificate: %v", err)
+		}
+		defaultCertificate = &certificate
+	}
+
+	certificateOptions := options.Certificates
+	for _, route := range options.SNIRoutes {
+		if route.CertFile != "" {
+			certificateOptions = append(certificateOptions, &CertificateOptions{
+				Pattern:  route.ServerName,
+				CertFile: route.CertFile,
+				KeyFile:  route.KeyFile,
+			})
+		}
+	}
+
+	var certificates []hostPatternValue[*tls.Certificate]
+	for _, certificateOption := range certificateOptions {
+		certificate, err := tls.LoadX509KeyPair(certificateOption.CertFile, certificateOption.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf(`Error loading TLS certificate for "%v": %v`, certificateOption.Pattern, err)
+		}
+		certificates = append(certificates, hostPatternValue[*tls.Certificate]{certificateOption.Pattern, &certificate})
+	}
+
+	var acmeManager *acme.Manager
+	if options.ACME != nil {
+		var err error
+		if acmeManager, err = acme.NewManager(options.ACME); err != nil {
+			return nil, fmt.Errorf("Error setting up ACME: %v", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if acmeManager != nil && acme.IsChallenge(hello) {
+				return acmeManager.GetCertificate(hello)
+			}
+			if certificate, ok := matchHostPattern(certificates, hello.ServerName); ok {
+				return certificate, nil
+			}
+			if acmeManager != nil && acmeManager.Covers(hello.ServerName) {
+				return acmeManager.GetCertificate(hello)
+			}
+			if defaultCertificate == nil {
+				return nil, fmt.Errorf("No certificate for server name %q", hello.ServerName)
+			}
+			return defaultCertificate, nil
+		},
+	}
+	if !options.DisableHTTP2 {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2")
+	}
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "http/1.1")
+	if acmeManager != nil {
+		// The certificate authority validates domains by connecting with only
+		// the acme-tls/1 protocol, so it must be advertised alongside HTTP.
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	return tlsConfig, nil
+}
+
+// AddSNIRoute routes TLS connections for a server name to a separate traffic
+// handler, configured with its own relay options and plugins. The handler
+// records metrics in the service's registry.
+func (service *Service) AddSNIRoute(serverName string, relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plugin) {
+	service.addRoute(&serviceRoute{sni: true, pattern: serverName, relayConfig: relayConfig, plugins: trafficPlugins})
+}
+
+// AddSNIRoutes adds a route for each of the SNI routes in options. Routes
+// inherit relayConfig and defaultPlugins unless they override the target or
+// plugins; overridden plugins are created by calling loadPlugins with the
+// route's plugin configuration.
+func (service *Service) AddSNIRoutes(
+	options *TLSOptions,
+	relayConfig *traffic.RelayOptions,
+	defaultPlugins []traffic.Plugin,
+	loadPlugins func(configFile *config.File) ([]traffic.Plugin, error),
+) error {
+	for _, route := range options.SNIRoutes {
+		routeConfig, routePlugins, err := route.resolve(relayConfig, defaultPlugins, loadPlugins)
+		if err != nil {
+			return fmt.Errorf(`SNI route "%v": %v`, route.ServerName, err)
+		}
+		service.addRoute(&serviceRoute{
+			sni:          true,
+			pattern:      route.ServerName,
+			relayConfig:  routeConfig,
+			options:      &route.RouteOptions,
+			plugins:      routePlugins,
+			pluginConfig: route.PluginConfig,
+		})
+	}
+	return nil
+}
+
+// EnableTLS configures the service to terminate TLS using the certificates
+// named in options. It must be called before Start.
+func (service *Service) EnableTLS(options *TLSOptions) error {
+	tlsConfig, err := buildTLSConfig(options)
+	if err != nil {
+		return err
+	}
+	service.tlsConfig = tlsConfig
+	return nil
+}
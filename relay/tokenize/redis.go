@@ -0,0 +1,229 @@
+package tokenize
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/secrets"
+)
+
+const (
+	DefaultRedisKeyPrefix = "relay:token:"
+	DefaultRedisTimeout   = time.Second
+)
+
+// RedisOptions configures a Redis store.
+type RedisOptions struct {
+	Address   string          // The host and port of the Redis server.
+	Password  *secrets.Secret // If non-nil, sent with AUTH when connecting.
+	DB        int             // If non-zero, selected with SELECT when connecting.
+	KeyPrefix string          // Prepended to tokens to form Redis keys.
+	TTL       time.Duration   // If non-zero, tokens expire this long after they're last stored.
+	Timeout   time.Duration   // How long to wait for the server to respond to each command.
+}
+
+func readRedisOptions(section *config.Section) (*RedisOptions, error) {
+	options := &RedisOptions{
+		KeyPrefix: DefaultRedisKeyPrefix,
+		Timeout:   DefaultRedisTimeout,
+	}
+
+	var err error
+	if options.Address, err = config.LookupRequired[string](section, "redis-address"); err != nil {
+		return nil, err
+	}
+	if options.Password, err = secrets.Lookup(section, "redis-password"); err != nil {
+		return nil, err
+	}
+	if db, err := config.LookupOptional[int](section, "redis-db"); err != nil {
+		return nil, err
+	} else if db != nil {
+		if *db < 0 {
+			return nil, fmt.Errorf(`Invalid redis-db "%v": must not be negative`, *db)
+		}
+		options.DB = *db
+	}
+	if keyPrefix, err := config.LookupOptional[string](section, "redis-key-prefix"); err != nil {
+		return nil, err
+	} else if keyPrefix != nil {
+		options.KeyPrefix = *keyPrefix
+	}
+	for _, option := range []struct {
+		key         string
+		destination *time.Duration
+	}{
+		{"max-age", &options.TTL},
+		{"redis-timeout", &options.Timeout},
+	} {
+		if value, err := config.LookupOptional[time.Duration](section, option.key); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 0 {
+				return nil, fmt.Errorf(`Invalid %v "%v": must not be negative`, option.key, *value)
+			}
+			*option.destination = *value
+		}
+	}
+	return options, nil
+}
+
+// RedisStore is a Store which keeps tokens in Redis, so that they're shared
+// by every relay instance and survive restarts. It uses a single connection,
+// which is reopened if a command fails.
+type RedisStore struct {
+	options *RedisOptions
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisStore creates a RedisStore. The connection is opened when it's
+// first needed.
+func NewRedisStore(options *RedisOptions) *RedisStore {
+	return &RedisStore{options: options}
+}
+
+func (store *RedisStore) Put(token string, value string) error {
+	args := []string{"SET", store.options.KeyPrefix + token, value}
+	if store.options.TTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(store.options.TTL.Milliseconds(), 10))
+	}
+	_, _, err := store.command(args...)
+	return err
+}
+
+func (store *RedisStore) Get(token string) (string, bool, error) {
+	value, ok, err := store.command("GET", store.options.KeyPrefix+token)
+	return value, ok, err
+}
+
+// Close closes the connection to the server, if it's open.
+func (store *RedisStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.disconnect()
+}
+
+// command sends a command to the server and returns its reply. The boolean is
+// false if the reply was nil, as it is from GET when the key doesn't exist.
+func (store *RedisStore) command(args ...string) (string, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.conn == nil {
+		if err := store.connect(); err != nil {
+			return "", false, err
+		}
+	}
+	reply, ok, err := store.roundTrip(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be in an unknown state, so start afresh.
+		store.disconnect()
+	}
+	return reply, ok, err
+}
+
+func (store *RedisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", store.options.Address, store.options.Timeout)
+	if err != nil {
+		return fmt.Errorf("Error connecting to Redis: %v", err)
+	}
+	store.conn = conn
+	store.reader = bufio.NewReader(conn)
+
+	if store.options.Password != nil {
+		password, err := store.options.Password.Value()
+		if err != nil {
+			// The last password read successfully is still returned.
+			logger.Errorf("Error reading Redis password: %v", err)
+		}
+		if _, _, err := store.roundTrip([]string{"AUTH", password}); err != nil {
+			store.disconnect()
+			return fmt.Errorf("Error authenticating with Redis: %v", err)
+		}
+	}
+	if store.options.DB != 0 {
+		if _, _, err := store.roundTrip([]string{"SELECT", strconv.Itoa(store.options.DB)}); err != nil {
+			store.disconnect()
+			return fmt.Errorf("Error selecting Redis database: %v", err)
+		}
+	}
+	return nil
+}
+
+func (store *RedisStore) disconnect() error {
+	if store.conn == nil {
+		return nil
+	}
+	err := store.conn.Close()
+	store.conn = nil
+	store.reader = nil
+	return err
+}
+
+// roundTrip writes a command as an array of bulk strings and reads the reply.
+func (store *RedisStore) roundTrip(args []string) (string, bool, error) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	store.conn.SetDeadline(time.Now().Add(store.options.Timeout))
+	if _, err := io.WriteString(store.conn, command.String()); err != nil {
+		return "", false, err
+	}
+	return readReply(store.reader)
+}
+
+// redisError is an error reply from the server. The connection remains usable
+// after one.
+type redisError string
+
+func (err redisError) Error() string {
+	return "Redis error: " + string(err)
+}
+
+// readReply reads a simple string, error, integer, or bulk string reply.
+func readReply(reader *bufio.Reader) (string, bool, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", false, fmt.Errorf("Malformed Redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], true, nil
+	case '-':
+		return "", false, redisError(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("Malformed Redis reply: %q", line)
+		}
+		if length < 0 {
+			return "", false, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", false, err
+		}
+		return string(data[:length]), true, nil
+	default:
+		return "", false, fmt.Errorf("Unexpected Redis reply: %q", line)
+	}
+}
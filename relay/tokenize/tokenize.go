@@ -0,0 +1,370 @@
+// Package tokenize replaces sensitive values with stable tokens, and remembers
+// which value each token replaced, so that redacted traffic can still be
+// audited. Tokens are derived from an HMAC of the value, so the same value
+// always produces the same token, and the target can tell values apart
+// without learning them. The HMAC can't be reversed; instead, the value behind
+// each token is kept in a Store, which can be in memory, on disk, or in Redis,
+// and looked up via the detokenization endpoint served by Handler.
+package tokenize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+var logger = logging.New("relay-tokenize")
+
+// DetokenizePath is the path of the detokenization endpoint served by
+// Handler. A GET with one or more 'token' query parameters returns a JSON
+// object mapping each token which the store knows to the value it replaced.
+// Unknown tokens are omitted.
+var DetokenizePath = "/detokenize"
+
+// The kinds of Store which ReadOptions can configure.
+const (
+	MemoryStoreKind = "memory"
+	FileStoreKind   = "file"
+	RedisStoreKind  = "redis"
+)
+
+const (
+	DefaultPrefix    = "tok_"
+	DefaultMaxTokens = 100000
+
+	// tokenBytes is the number of bytes of the HMAC used in tokens.
+	tokenBytes = 15
+
+	// cleanupInterval is how often tokens older than max-age are removed from
+	// file stores.
+	cleanupInterval = time.Minute
+)
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Store remembers the value behind each token. Implementations must be safe
+// for concurrent use.
+type Store interface {
+	// Put records that token replaced value.
+	Put(token string, value string) error
+	// Get returns the value which token replaced, and false if it's unknown.
+	Get(token string) (string, bool, error)
+}
+
+// Options contains configuration options for a Vault.
+type Options struct {
+	Key    *secrets.Secret // The HMAC key from which tokens are derived.
+	Prefix string          // Prepended to tokens, so they're recognizable.
+	Store  Store
+
+	// If non-nil, requests to the detokenization endpoint must carry this
+	// bearer token in their Authorization header.
+	DetokenizeToken *secrets.Secret
+}
+
+// ReadOptions reads tokenization options from a configuration section,
+// returning nil if 'token-key' isn't set. Features which tokenize values embed
+// these options in their own configuration section:
+//
+//   - token-key, token-key-file: the HMAC key (required)
+//   - token-prefix: prepended to tokens; "tok_" by default
+//   - token-store: "memory" (the default), "file", or "redis"
+//   - max-tokens: how many tokens a memory store remembers; once it's full,
+//     the oldest are forgotten first
+//   - directory, encryption-key, encryption-key-file, max-age: where and how
+//     a file store keeps tokens; see storage.ReadOptions
+//   - redis-address, redis-password, redis-password-file, redis-db,
+//     redis-key-prefix, redis-timeout, max-age: the Redis server in which a
+//     redis store keeps tokens, and how long they're kept; see RedisOptions
+//   - detokenize-token, detokenize-token-file: the bearer token which
+//     requests to the detokenization endpoint must carry
+func ReadOptions(section *config.Section) (*Options, error) {
+	key, err := secrets.Lookup(section, "token-key")
+	if err != nil {
+		return nil, err
+	} else if key == nil {
+		return nil, nil
+	}
+
+	options := &Options{Key: key, Prefix: DefaultPrefix}
+	if prefix, err := config.LookupOptional[string](section, "token-prefix"); err != nil {
+		return nil, err
+	} else if prefix != nil {
+		if *prefix != url.PathEscape(*prefix) || strings.Contains(*prefix, ".") {
+			return nil, fmt.Errorf(`Invalid token-prefix "%v": may only contain letters, digits, and "-", "_", or "~"`, *prefix)
+		}
+		options.Prefix = *prefix
+	}
+
+	if options.DetokenizeToken, err = secrets.Lookup(section, "detokenize-token"); err != nil {
+		return nil, err
+	}
+
+	kind := MemoryStoreKind
+	if value, err := config.LookupOptional[string](section, "token-store"); err != nil {
+		return nil, err
+	} else if value != nil {
+		kind = *value
+	}
+	switch kind {
+	case MemoryStoreKind:
+		maxTokens := DefaultMaxTokens
+		if value, err := config.LookupOptional[int](section, "max-tokens"); err != nil {
+			return nil, err
+		} else if value != nil {
+			if *value < 1 {
+				return nil, fmt.Errorf(`Invalid max-tokens "%v": must be at least 1`, *value)
+			}
+			maxTokens = *value
+		}
+		options.Store = NewMemoryStore(maxTokens)
+
+	case FileStoreKind:
+		storageOptions, err := storage.ReadOptions(section)
+		if err != nil {
+			return nil, err
+		}
+		store, err := storage.NewStore(storageOptions)
+		if err != nil {
+			return nil, err
+		}
+		store.StartCleanup(cleanupInterval)
+		options.Store = NewFileStore(store)
+
+	case RedisStoreKind:
+		redisOptions, err := readRedisOptions(section)
+		if err != nil {
+			return nil, err
+		}
+		options.Store = NewRedisStore(redisOptions)
+
+	default:
+		return nil, fmt.Errorf(`Invalid token-store "%v": must be "%v", "%v", or "%v"`, kind, MemoryStoreKind, FileStoreKind, RedisStoreKind)
+	}
+
+	logger.Printf(`Tokenizing values with tokens prefixed by "%v", kept in a %v store`, options.Prefix, kind)
+	return options, nil
+}
+
+// Vault replaces values with tokens, and looks up the values behind tokens.
+type Vault struct {
+	options *Options
+
+	// recent remembers tokens which were recently stored, so that values
+	// which recur don't need to be stored again. It's nil for memory stores.
+	recent *MemoryStore
+}
+
+// NewVault creates a Vault.
+func NewVault(options *Options) *Vault {
+	vault := &Vault{options: options}
+	if _, ok := options.Store.(*MemoryStore); !ok {
+		vault.recent = NewMemoryStore(DefaultMaxTokens)
+	}
+	return vault
+}
+
+// Tokenize returns the token which replaces value, and stores the value so
+// that the token can be detokenized later. If the value can't be stored, the
+// token is returned along with the error; since tokens are deterministic, the
+// value will be stored the next time it's seen if the store has recovered.
+func (vault *Vault) Tokenize(value []byte) (string, error) {
+	key, err := vault.options.Key.Value()
+	if err != nil {
+		// The last key read successfully is still returned.
+		logger.Errorf("Error reading token key: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(value)
+	token := vault.options.Prefix + strings.ToLower(tokenEncoding.EncodeToString(mac.Sum(nil)[:tokenBytes]))
+
+	if vault.recent != nil {
+		if _, ok, _ := vault.recent.Get(token); ok {
+			return token, nil
+		}
+	}
+	if err := vault.options.Store.Put(token, string(value)); err != nil {
+		return token, fmt.Errorf("Error storing token: %v", err)
+	}
+	if vault.recent != nil {
+		vault.recent.Put(token, string(value))
+	}
+	return token, nil
+}
+
+// Detokenize returns the value which token replaced, and false if it's
+// unknown.
+func (vault *Vault) Detokenize(token string) (string, bool, error) {
+	if !vault.validToken(token) {
+		return "", false, nil
+	}
+	if vault.recent != nil {
+		if value, ok, _ := vault.recent.Get(token); ok {
+			return value, true, nil
+		}
+	}
+	return vault.options.Store.Get(token)
+}
+
+// validToken returns true if token has the form of the vault's tokens, so
+// that arbitrary strings from the detokenization endpoint never reach the
+// store.
+func (vault *Vault) validToken(token string) bool {
+	encoded, ok := strings.CutPrefix(token, vault.options.Prefix)
+	if !ok || len(encoded) != tokenEncoding.EncodedLen(tokenBytes) {
+		return false
+	}
+	_, err := tokenEncoding.DecodeString(strings.ToUpper(encoded))
+	return err == nil && encoded == strings.ToLower(encoded)
+}
+
+// Handler serves the detokenization endpoint at DetokenizePath. If
+// Options.DetokenizeToken is set, requests without it are rejected with a
+// 401.
+func (vault *Vault) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DetokenizePath, func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			response.Header().Set("Allow", "GET, HEAD")
+			http.Error(response, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if !vault.authorized(request) {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(response, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		tokens := request.URL.Query()["token"]
+		if len(tokens) == 0 {
+			http.Error(response, `Missing "token" query parameter`, http.StatusBadRequest)
+			return
+		}
+
+		values := map[string]string{}
+		for _, token := range tokens {
+			value, ok, err := vault.Detokenize(token)
+			if err != nil {
+				logger.Errorf("Error detokenizing: %v", err)
+				http.Error(response, "Error looking up tokens", http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				values[token] = value
+			}
+		}
+		logger.Printf("Detokenized %d of %d tokens for %v", len(values), len(tokens), request.RemoteAddr)
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(values); err != nil {
+			logger.Errorf("Error writing detokenized values: %v", err)
+		}
+	})
+	return mux
+}
+
+func (vault *Vault) authorized(request *http.Request) bool {
+	if vault.options.DetokenizeToken == nil {
+		return true
+	}
+	expected, err := vault.options.DetokenizeToken.Value()
+	if err != nil {
+		logger.Errorf("Error reading detokenize token: %v", err)
+	}
+	provided, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) == 1
+}
+
+// Close releases the resources held by the vault's store.
+func (vault *Vault) Close() error {
+	if closer, ok := vault.options.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// MemoryStore is a Store which keeps the most recently stored tokens in
+// memory. Once it's full, the oldest tokens are forgotten first.
+type MemoryStore struct {
+	mutex  sync.Mutex
+	limit  int
+	values map[string]string
+	order  []string // Tokens, oldest first.
+}
+
+// NewMemoryStore creates a MemoryStore which remembers up to limit tokens.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{limit: limit, values: map[string]string{}}
+}
+
+func (store *MemoryStore) Put(token string, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if existing, ok := store.values[token]; ok {
+		if existing != value {
+			logger.Errorf("Token collision: two values produced token %v", token)
+		}
+		return nil
+	}
+	store.values[token] = value
+	store.order = append(store.order, token)
+	if len(store.order) > store.limit {
+		delete(store.values, store.order[0])
+		store.order = store.order[1:]
+	}
+	return nil
+}
+
+func (store *MemoryStore) Get(token string) (string, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	value, ok := store.values[token]
+	return value, ok, nil
+}
+
+// fileStore is a Store which keeps each token in a file, named after the
+// token, in a storage.Store.
+type fileStore struct {
+	store *storage.Store
+}
+
+// NewFileStore creates a Store which keeps tokens in a storage.Store, so they
+// can be encrypted at rest and expire after the store's maximum age.
+func NewFileStore(store *storage.Store) Store {
+	return &fileStore{store: store}
+}
+
+func (store *fileStore) Put(token string, value string) error {
+	return store.store.Write(token, []byte(value))
+}
+
+func (store *fileStore) Get(token string) (string, bool, error) {
+	value, err := store.store.Read(token)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (store *fileStore) Close() error {
+	return store.store.Close()
+}
@@ -0,0 +1,349 @@
+package tokenize_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/secrets"
+	"github.com/immersa-co/relay-core/relay/tokenize"
+)
+
+var tokenPattern = regexp.MustCompile(`^tok_[a-z2-7]{24}$`)
+
+func TestVault(t *testing.T) {
+	stores := map[string]func(t *testing.T) tokenize.Store{
+		"memory": func(t *testing.T) tokenize.Store {
+			return tokenize.NewMemoryStore(10)
+		},
+		"file": func(t *testing.T) tokenize.Store {
+			return readStore(t, fmt.Sprintf("token-store: file\ndirectory: %v\n", t.TempDir()))
+		},
+		"redis": func(t *testing.T) tokenize.Store {
+			server := newFakeRedis(t, "secret")
+			return readStore(t, fmt.Sprintf("token-store: redis\nredis-address: %v\nredis-password: secret\nredis-db: 2\n", server.address))
+		},
+	}
+
+	for kind, newStore := range stores {
+		vault := tokenize.NewVault(&tokenize.Options{
+			Key:    secrets.FromValue("key"),
+			Prefix: tokenize.DefaultPrefix,
+			Store:  newStore(t),
+		})
+
+		first, err := vault.Tokenize([]byte("123-45-6789"))
+		if err != nil {
+			t.Errorf("Test '%v': Error tokenizing: %v", kind, err)
+			continue
+		}
+		if !tokenPattern.MatchString(first) {
+			t.Errorf("Test '%v': Unexpected token format: %v", kind, first)
+		}
+		if again, _ := vault.Tokenize([]byte("123-45-6789")); again != first {
+			t.Errorf("Test '%v': Expected the same value to produce token %v but got %v", kind, first, again)
+		}
+		second, _ := vault.Tokenize([]byte("987-65-4321"))
+		if second == first {
+			t.Errorf("Test '%v': Expected different values to produce different tokens", kind)
+		}
+
+		for token, expected := range map[string]string{first: "123-45-6789", second: "987-65-4321"} {
+			value, ok, err := vault.Detokenize(token)
+			if err != nil || !ok || value != expected {
+				t.Errorf("Test '%v': Expected %v to detokenize to %v but got %v, %v, %v", kind, token, expected, value, ok, err)
+			}
+		}
+		for _, token := range []string{"tok_aaaaaaaaaaaaaaaaaaaaaaaa", "unknown", "../../etc/passwd"} {
+			if value, ok, err := vault.Detokenize(token); ok || err != nil {
+				t.Errorf("Test '%v': Expected %v to be unknown but got %v, %v, %v", kind, token, value, ok, err)
+			}
+		}
+		vault.Close()
+	}
+}
+
+func TestStoresSurviveNewVaults(t *testing.T) {
+	// Tokens in file and Redis stores can be detokenized by other relays,
+	// which don't share the in-memory cache of recent tokens.
+	directory := t.TempDir()
+	server := newFakeRedis(t, "")
+	for _, configYaml := range []string{
+		fmt.Sprintf("token-key: key\ntoken-store: file\ndirectory: %v\nencryption-key: %v\n", directory, strings.Repeat("A", 43)+"="),
+		fmt.Sprintf("token-key: key\ntoken-store: redis\nredis-address: %v\nmax-age: 1h\n", server.address),
+	} {
+		options := readOptions(t, configYaml)
+		token, _ := tokenize.NewVault(options).Tokenize([]byte("value"))
+
+		options = readOptions(t, configYaml)
+		value, ok, err := tokenize.NewVault(options).Detokenize(token)
+		if err != nil || !ok || value != "value" {
+			t.Errorf("Expected a new vault to detokenize %v using %q but got %v, %v, %v", token, configYaml, value, ok, err)
+		}
+	}
+
+	if ttl := server.lastSetArgs(); len(ttl) != 5 || ttl[3] != "PX" || ttl[4] != "3600000" {
+		t.Errorf("Expected tokens to be stored in Redis with a one hour TTL but got %v", ttl)
+	}
+}
+
+func TestMemoryStoreForgetsOldestTokens(t *testing.T) {
+	store := tokenize.NewMemoryStore(2)
+	store.Put("a", "1")
+	store.Put("b", "2")
+	store.Put("c", "3")
+	for token, expected := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, ok, _ := store.Get(token); ok != expected {
+			t.Errorf("Expected token %v to be known: %v", token, expected)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	vault := tokenize.NewVault(&tokenize.Options{
+		Key:             secrets.FromValue("key"),
+		Prefix:          tokenize.DefaultPrefix,
+		Store:           tokenize.NewMemoryStore(10),
+		DetokenizeToken: secrets.FromValue("let-me-in"),
+	})
+	token, _ := vault.Tokenize([]byte("alice@example.com"))
+	server := httptest.NewServer(vault.Handler())
+	defer server.Close()
+
+	testCases := []struct {
+		desc           string
+		method         string
+		query          string
+		authorization  string
+		expectedStatus int
+		expectedValues map[string]string
+	}{
+		{
+			desc:           "Known tokens are detokenized",
+			method:         "GET",
+			query:          "?token=" + token + "&token=tok_unknown",
+			authorization:  "Bearer let-me-in",
+			expectedStatus: http.StatusOK,
+			expectedValues: map[string]string{token: "alice@example.com"},
+		},
+		{
+			desc:           "Requests without a bearer token are rejected",
+			method:         "GET",
+			query:          "?token=" + token,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "Requests with the wrong bearer token are rejected",
+			method:         "GET",
+			query:          "?token=" + token,
+			authorization:  "Bearer let-me-in-please",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "A token must be given",
+			method:         "GET",
+			authorization:  "Bearer let-me-in",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "Only GET is allowed",
+			method:         "POST",
+			query:          "?token=" + token,
+			authorization:  "Bearer let-me-in",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		request, _ := http.NewRequest(testCase.method, server.URL+tokenize.DetokenizePath+testCase.query, nil)
+		if testCase.authorization != "" {
+			request.Header.Set("Authorization", testCase.authorization)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+			continue
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			continue
+		}
+		if testCase.expectedValues == nil {
+			continue
+		}
+		var values map[string]string
+		if err := json.Unmarshal(body, &values); err != nil {
+			t.Errorf("Test '%v': Error decoding response %q: %v", testCase.desc, body, err)
+		} else if fmt.Sprint(values) != fmt.Sprint(testCase.expectedValues) {
+			t.Errorf("Test '%v': Expected %v but got %v", testCase.desc, testCase.expectedValues, values)
+		}
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	if options := readOptions(t, "token-prefix: x_\n"); options != nil {
+		t.Errorf("Expected no options without a token key but got %+v", options)
+	}
+
+	invalidConfigs := []string{
+		"token-key: key\ntoken-store: mongodb\n",
+		"token-key: key\ntoken-prefix: a/b\n",
+		"token-key: key\nmax-tokens: 0\n",
+		"token-key: key\ntoken-store: file\n",
+		"token-key: key\ntoken-store: redis\n",
+		"token-key: key\ntoken-store: redis\nredis-address: localhost:6379\nredis-db: -1\n",
+		"token-key: key\ntoken-key-file: /run/secrets/key\n",
+	}
+	for _, configYaml := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("section:\n" + indent(configYaml))
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", configYaml, err)
+			continue
+		}
+		if _, err := tokenize.ReadOptions(configFile.LookupOptionalSection("section")); err == nil {
+			t.Errorf("Expected an error for configuration %q", configYaml)
+		}
+	}
+}
+
+func readOptions(t *testing.T, configYaml string) *tokenize.Options {
+	configFile, err := config.NewFileFromYamlString("section:\n" + indent(configYaml))
+	if err != nil {
+		t.Fatalf("Error parsing %q: %v", configYaml, err)
+	}
+	options, err := tokenize.ReadOptions(configFile.LookupOptionalSection("section"))
+	if err != nil {
+		t.Fatalf("Error reading %q: %v", configYaml, err)
+	}
+	return options
+}
+
+func readStore(t *testing.T, configYaml string) tokenize.Store {
+	return readOptions(t, "token-key: key\n"+configYaml).Store
+}
+
+func indent(configYaml string) string {
+	lines := strings.Split(strings.TrimSpace(configYaml), "\n")
+	return "    " + strings.Join(lines, "\n    ") + "\n"
+}
+
+// fakeRedis understands just enough of the Redis protocol to serve AUTH,
+// SELECT, SET, and GET.
+type fakeRedis struct {
+	address  string
+	password string
+
+	mutex   sync.Mutex
+	values  map[string]string
+	lastSet []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeRedis{address: listener.Addr().String(), password: password, values: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := server.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		server.mutex.Lock()
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[1] == server.password
+			if authenticated {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT":
+			reply = "+OK\r\n"
+		case args[0] == "SET":
+			server.values[args[1]] = args[2]
+			server.lastSet = args
+			reply = "+OK\r\n"
+		case args[0] == "GET":
+			if value, ok := server.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		server.mutex.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (server *fakeRedis) lastSetArgs() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.lastSet
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
@@ -0,0 +1,101 @@
+// Package tracing sets up the export of OpenTelemetry traces, which describe
+// how the relay handled each request: how long each plugin took, and how long
+// the target took to respond.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/immersa-co/relay-core/relay/version"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// The supported exporters, which send spans to an OpenTelemetry collector
+// using OTLP.
+const (
+	ExporterGRPC = "otlp-grpc"
+	ExporterHTTP = "otlp-http"
+)
+
+const DefaultServiceName = "relay"
+
+// Options configures how traces are exported.
+type Options struct {
+	Exporter    string  // ExporterGRPC or ExporterHTTP.
+	Endpoint    string  // The collector's host and port. If empty, OTEL_EXPORTER_OTLP_ENDPOINT or the exporter's default is used.
+	Insecure    bool    // If true, the collector is contacted without TLS.
+	SampleRatio float64 // The fraction of requests traced, unless the client says whether to trace them.
+	ServiceName string  // If empty, DefaultServiceName is used.
+}
+
+// ParseExporter validates the name of an exporter.
+func ParseExporter(value string) (string, error) {
+	switch value {
+	case ExporterGRPC, ExporterHTTP:
+		return value, nil
+	default:
+		return "", fmt.Errorf(`Invalid tracing exporter "%v": must be "%v" or "%v"`, value, ExporterGRPC, ExporterHTTP)
+	}
+}
+
+// NewTracerProvider returns a provider whose spans are batched and sent to the
+// configured collector in the background. Requests which arrive with a
+// traceparent header are traced if the client sampled them, so that the
+// relay's spans join the client's traces; others are sampled according to
+// SampleRatio.
+func NewTracerProvider(options *Options) (*sdktrace.TracerProvider, error) {
+	exporter, err := newExporter(options)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := options.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	relayResource := resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version.RelayRelease),
+	)
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(relayResource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	), nil
+}
+
+func newExporter(options *Options) (*otlptrace.Exporter, error) {
+	// Exporters connect lazily, so creating one doesn't fail if the collector
+	// is unavailable.
+	ctx := context.Background()
+	switch options.Exporter {
+	case ExporterGRPC:
+		var exporterOptions []otlptracegrpc.Option
+		if options.Endpoint != "" {
+			exporterOptions = append(exporterOptions, otlptracegrpc.WithEndpoint(options.Endpoint))
+		}
+		if options.Insecure {
+			exporterOptions = append(exporterOptions, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, exporterOptions...)
+	case ExporterHTTP:
+		var exporterOptions []otlptracehttp.Option
+		if options.Endpoint != "" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithEndpoint(options.Endpoint))
+		}
+		if options.Insecure {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, exporterOptions...)
+	default:
+		_, err := ParseExporter(options.Exporter)
+		return nil, err
+	}
+}
@@ -0,0 +1,78 @@
+package traffic
+
+import (
+	"sort"
+)
+
+// Annotations are key/value pairs (like "tenant=acme") attached to a request
+// as it passes through the plugin chain. Like Tags, they let plugins pass
+// information along without inventing private headers; a plugin which learns
+// something about a request can annotate it, and later plugins, including
+// CompletionPlugins like access-log, can read or record the annotation.
+//
+// Keys are case-sensitive. A single Annotations value is shared by every
+// plugin that handles a request; it is not safe for concurrent use.
+type Annotations struct {
+	values map[string]string
+}
+
+// NewAnnotations returns an empty set of annotations.
+func NewAnnotations() *Annotations {
+	return &Annotations{values: map[string]string{}}
+}
+
+// Set sets the value of an annotation, replacing any previous value. Empty
+// keys are ignored.
+func (annotations *Annotations) Set(key string, value string) {
+	if key == "" {
+		return
+	}
+	annotations.values[key] = value
+}
+
+// Delete removes an annotation, if present.
+func (annotations *Annotations) Delete(key string) {
+	delete(annotations.values, key)
+}
+
+// Get returns the value of an annotation, and whether it's present.
+func (annotations *Annotations) Get(key string) (string, bool) {
+	if annotations == nil {
+		return "", false
+	}
+	value, ok := annotations.values[key]
+	return value, ok
+}
+
+// Len returns the number of annotations.
+func (annotations *Annotations) Len() int {
+	if annotations == nil {
+		return 0
+	}
+	return len(annotations.values)
+}
+
+// Keys returns the annotations' keys in sorted order.
+func (annotations *Annotations) Keys() []string {
+	if annotations == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(annotations.values))
+	for key := range annotations.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Map returns a copy of the annotations.
+func (annotations *Annotations) Map() map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	values := make(map[string]string, len(annotations.values))
+	for key, value := range annotations.values {
+		values[key] = value
+	}
+	return values
+}
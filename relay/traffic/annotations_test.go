@@ -0,0 +1,40 @@
+package traffic_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestAnnotations(t *testing.T) {
+	annotations := traffic.NewAnnotations()
+	annotations.Set("tenant", "acme")
+	annotations.Set("Plan", "free")
+	annotations.Set("", "ignored")
+
+	if !reflect.DeepEqual(annotations.Keys(), []string{"Plan", "tenant"}) {
+		t.Errorf("Unexpected keys: %v", annotations.Keys())
+	}
+	if value, ok := annotations.Get("tenant"); !ok || value != "acme" {
+		t.Errorf("Expected tenant 'acme' but got '%v' (present: %v)", value, ok)
+	}
+	if _, ok := annotations.Get("plan"); ok {
+		t.Errorf("Expected annotation keys to be case-sensitive")
+	}
+
+	values := annotations.Map()
+	annotations.Set("Plan", "paid")
+	annotations.Delete("tenant")
+	if !reflect.DeepEqual(values, map[string]string{"Plan": "free", "tenant": "acme"}) {
+		t.Errorf("Expected Map to return a copy, but got %v", values)
+	}
+	if !reflect.DeepEqual(annotations.Map(), map[string]string{"Plan": "paid"}) {
+		t.Errorf("Unexpected annotations after update: %v", annotations.Map())
+	}
+
+	var nilAnnotations *traffic.Annotations
+	if _, ok := nilAnnotations.Get("tenant"); ok || nilAnnotations.Len() != 0 || nilAnnotations.Keys() != nil {
+		t.Errorf("Expected nil Annotations to behave as an empty set")
+	}
+}
@@ -0,0 +1,276 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+// AuditOptions configures the audit log, which records the metadata of each
+// request as the client sent it, along with a summary of what the relay and
+// its plugins changed before relaying it. It's meant for privacy reviews, such
+// as quantifying what the relay strips while traffic is migrated to it.
+//
+// Only names and sizes are recorded: never header, cookie, or query parameter
+// values, and never bodies. Entries are written in batches, as JSON lines, to
+// a storage directory, which can encrypt them at rest.
+type AuditOptions struct {
+	Store         *storage.Store
+	FlushInterval time.Duration // How often batches are written. If zero, DefaultAuditFlushInterval is used.
+}
+
+const DefaultAuditFlushInterval = 10 * time.Second
+
+// maxAuditBatch is the number of entries after which a batch is written
+// without waiting for the flush interval.
+const maxAuditBatch = 1000
+
+// AuditEntry records what the client sent and what the relay changed.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	QueryParams []string  `json:"query_params,omitempty"` // Names only.
+	Headers     []string  `json:"headers,omitempty"`      // Names only; cookies are listed separately.
+	Cookies     []string  `json:"cookies,omitempty"`      // Names only.
+	BodyBytes   int64     `json:"body_bytes"`             // The Content-Length as received, or -1 if unknown.
+	Status      int       `json:"status"`                 // The status returned to the client.
+	Plugins     []string  `json:"plugins,omitempty"`      // Each plugin's decision, as in DebugPluginsHeaderName.
+	Changes     AuditDiff `json:"changes"`
+}
+
+// AuditDiff summarizes how the relayed request differed from the original. If
+// the request wasn't relayed, it describes the request as the plugins left it.
+type AuditDiff struct {
+	MethodChanged       bool     `json:"method_changed,omitempty"`
+	PathChanged         bool     `json:"path_changed,omitempty"`
+	HeadersRemoved      []string `json:"headers_removed,omitempty"`
+	HeadersAdded        []string `json:"headers_added,omitempty"`
+	HeadersModified     []string `json:"headers_modified,omitempty"`
+	QueryParamsRemoved  []string `json:"query_params_removed,omitempty"`
+	QueryParamsAdded    []string `json:"query_params_added,omitempty"`
+	QueryParamsModified []string `json:"query_params_modified,omitempty"`
+	CookiesRemoved      []string `json:"cookies_removed,omitempty"`
+	BodyModified        bool     `json:"body_modified,omitempty"`
+	RelayedBodyBytes    int64    `json:"relayed_body_bytes"` // -1 if unknown.
+}
+
+// auditSnapshot holds the original metadata of a request.
+type auditSnapshot struct {
+	time    time.Time
+	method  string
+	host    string
+	path    string
+	query   url.Values
+	header  http.Header
+	cookies []string
+	bytes   int64
+}
+
+func snapshotForAudit(request *http.Request, now time.Time) *auditSnapshot {
+	return &auditSnapshot{
+		time:    now,
+		method:  request.Method,
+		host:    request.Host,
+		path:    request.URL.Path,
+		query:   request.URL.Query(),
+		header:  request.Header.Clone(),
+		cookies: cookieNames(request),
+		bytes:   request.ContentLength,
+	}
+}
+
+// auditLog buffers audit entries and writes them to the store in batches.
+type auditLog struct {
+	store *storage.Store
+
+	mutex   sync.Mutex
+	batch   bytes.Buffer
+	entries int
+}
+
+func newAuditLog(options *AuditOptions) *auditLog {
+	if options == nil {
+		return nil
+	}
+	log := &auditLog{store: options.Store}
+	interval := options.FlushInterval
+	if interval <= 0 {
+		interval = DefaultAuditFlushInterval
+	}
+	go func() {
+		for range time.Tick(interval) {
+			log.flush()
+		}
+	}()
+	return log
+}
+
+// record adds an entry describing a request which has been handled.
+func (log *auditLog) record(original *auditSnapshot, request *http.Request, trace *debugTrace, status int) {
+	entry := &AuditEntry{
+		Time:        original.time,
+		Method:      original.method,
+		Host:        original.host,
+		Path:        original.path,
+		QueryParams: sortedKeys(original.query),
+		Headers:     sortedKeys(withoutCookies(original.header)),
+		Cookies:     original.cookies,
+		BodyBytes:   original.bytes,
+		Status:      status,
+		Plugins:     trace.decisions,
+		Changes: AuditDiff{
+			MethodChanged:    request.Method != original.method,
+			PathChanged:      request.URL.Path != original.path,
+			BodyModified:     trace.bodyModified,
+			RelayedBodyBytes: request.ContentLength,
+		},
+	}
+	diff := &entry.Changes
+	// The relay keeps Content-Length consistent with the body, whose changes
+	// are reported separately.
+	diff.HeadersRemoved, diff.HeadersAdded, diff.HeadersModified = diffKeys(
+		withoutHeader(withoutCookies(original.header), "Content-Length"),
+		withoutHeader(withoutCookies(request.Header), "Content-Length"),
+	)
+	diff.QueryParamsRemoved, diff.QueryParamsAdded, diff.QueryParamsModified = diffKeys(original.query, request.URL.Query())
+	diff.CookiesRemoved, _, _ = diffKeys(namesToValues(original.cookies), namesToValues(cookieNames(request)))
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf("Error encoding audit entry: %s", err)
+		return
+	}
+
+	log.mutex.Lock()
+	log.batch.Write(encoded)
+	log.batch.WriteByte('\n')
+	log.entries++
+	full := log.entries >= maxAuditBatch
+	log.mutex.Unlock()
+
+	if full {
+		log.flush()
+	}
+}
+
+// flush writes the buffered entries to the store.
+func (log *auditLog) flush() {
+	log.mutex.Lock()
+	if log.entries == 0 {
+		log.mutex.Unlock()
+		return
+	}
+	data := append([]byte{}, log.batch.Bytes()...)
+	log.batch.Reset()
+	log.entries = 0
+	log.mutex.Unlock()
+
+	name := fmt.Sprintf("audit-%020d", time.Now().UnixNano())
+	if err := log.store.Write(name, data); err != nil {
+		logger.Errorf("Error writing audit entries: %s", err)
+	}
+}
+
+// ReadAuditEntries reads the audit entries in the batch stored under the
+// provided name.
+func ReadAuditEntries(store *storage.Store, name string) ([]*AuditEntry, error) {
+	data, err := store.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*AuditEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		entry := &AuditEntry{}
+		if err := decoder.Decode(entry); err != nil {
+			return nil, fmt.Errorf(`Audit batch "%v" is invalid: %v`, name, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func cookieNames(request *http.Request) []string {
+	var names []string
+	for _, cookie := range request.Cookies() {
+		names = append(names, cookie.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func withoutCookies(header http.Header) http.Header {
+	return withoutHeader(header, "Cookie")
+}
+
+// withoutHeader returns header without the omitted header, whose name must be
+// canonical. The header is only copied if it has the omitted header.
+func withoutHeader(header http.Header, omitted string) http.Header {
+	if _, ok := header[omitted]; !ok {
+		return header
+	}
+	filtered := http.Header{}
+	for name, values := range header {
+		if name != omitted {
+			filtered[name] = values
+		}
+	}
+	return filtered
+}
+
+func namesToValues(names []string) map[string][]string {
+	values := map[string][]string{}
+	for _, name := range names {
+		values[name] = nil
+	}
+	return values
+}
+
+func sortedKeys(values map[string][]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffKeys compares two multimaps, returning the sorted keys which were
+// removed, added, and whose values changed.
+func diffKeys(original map[string][]string, relayed map[string][]string) (removed []string, added []string, modified []string) {
+	for key, originalValues := range original {
+		relayedValues, ok := relayed[key]
+		if !ok {
+			removed = append(removed, key)
+			continue
+		}
+		if len(originalValues) != len(relayedValues) {
+			modified = append(modified, key)
+			continue
+		}
+		for i := range originalValues {
+			if originalValues[i] != relayedValues[i] {
+				modified = append(modified, key)
+				break
+			}
+		}
+	}
+	for key := range relayed {
+		if _, ok := original[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	sort.Strings(modified)
+	return removed, added, modified
+}
@@ -0,0 +1,249 @@
+package traffic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+)
+
+// BodyReader is a request body which the relay has buffered so that it can be
+// read more than once. Small bodies are held in memory, while bodies larger
+// than RelayOptions.SpoolThreshold are written to an encrypted temporary file,
+// or to another BodyStore configured in RelayOptions.BodyStores, so that large
+// payloads don't exhaust the relay's memory. The relay removes the stored body
+// once the request has been handled.
+//
+// When spooling is enabled, request bodies are always BodyReaders when plugins
+// receive them. Plugins which need to inspect a body without consuming it can
+// check whether request.Body is a *BodyReader and use Reopen. Plugins which
+// replace the body may use any reader, though SetRequestBody is best, so that
+// the length of the new body is known; see length.go.
+type BodyReader struct {
+	memory []byte     // The body, if it's held in memory.
+	stored StoredBody // The body, if it was spooled to a store.
+	size   int64
+	reader io.ReadCloser // Read's current position.
+}
+
+// Read reads from the body, like any other request body.
+func (body *BodyReader) Read(p []byte) (int, error) {
+	return body.reader.Read(p)
+}
+
+// Close does nothing; the body remains readable until the request has been
+// handled, even after the transport has closed it.
+func (body *BodyReader) Close() error {
+	return nil
+}
+
+// Size returns the length of the body in bytes.
+func (body *BodyReader) Size() int64 {
+	return body.size
+}
+
+// Spooled returns true if the body was written to a store, rather than held in
+// memory.
+func (body *BodyReader) Spooled() bool {
+	return body.stored != nil
+}
+
+// Reopen returns a new reader positioned at the start of the body. Reading
+// from it doesn't affect Read, and vice versa.
+func (body *BodyReader) Reopen() io.ReadCloser {
+	if body.stored != nil {
+		return body.stored.Open()
+	}
+	return io.NopCloser(bytes.NewReader(body.memory))
+}
+
+// Rewind moves Read back to the start of the body.
+func (body *BodyReader) Rewind() {
+	if body.reader != nil {
+		body.reader.Close()
+	}
+	body.reader = body.Reopen()
+}
+
+// release removes the body from its store, if it was spooled. It's safe to
+// call more than once.
+func (body *BodyReader) release() {
+	if body.stored == nil {
+		return
+	}
+	body.reader.Close()
+	if err := body.stored.Remove(); err != nil {
+		logger.Errorf("Error removing spooled request body: %s", err)
+	}
+	body.stored = nil
+	body.reader = io.NopCloser(bytes.NewReader(nil))
+}
+
+// errBodyTooLarge is returned when a body exceeds the spooler's limit.
+var errBodyTooLarge = errors.New("Request body is too large")
+
+// spooler creates BodyReaders, spooling them to a store once they exceed its
+// threshold, and refusing those which exceed the limit.
+type spooler struct {
+	tiers []BodyStoreTier // Ordered by increasing threshold.
+	limit int64           // Bodies larger than this are refused.
+}
+
+// newSpooler returns a spooler for the relay options. If spooling is
+// disabled, bodies are always held in memory, without a limit.
+func newSpooler(config *RelayOptions) *spooler {
+	var tiers []BodyStoreTier
+	if config.SpoolThreshold > 0 {
+		tiers = append(tiers, BodyStoreTier{
+			Threshold: config.SpoolThreshold,
+			Store: &TempFileBodyStore{
+				Dir:           config.SpoolDir,
+				EncryptionKey: config.SpoolEncryptionKey,
+				MaxAge:        config.SpoolMaxAge,
+			},
+		})
+	}
+	tiers = append(tiers, config.BodyStores...)
+	if len(tiers) == 0 {
+		return &spooler{limit: math.MaxInt64}
+	}
+	return &spooler{tiers: tiers, limit: config.MaxBodySize}
+}
+
+func (spooler *spooler) enabled() bool {
+	return len(spooler.tiers) > 0
+}
+
+// buffer reads source into a new BodyReader.
+func (spooler *spooler) buffer(source io.Reader) (*BodyReader, error) {
+	buffer := &bodyBuffer{spooler: spooler}
+	if _, err := io.Copy(buffer, source); err != nil {
+		buffer.discard()
+		return nil, err
+	}
+	return buffer.finish()
+}
+
+// decode decodes the encoded data read from source into a new BodyReader.
+func (spooler *spooler) decode(source io.Reader, encoding Encoding) (*BodyReader, error) {
+	decoder, err := newDecoder(source, encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return spooler.buffer(decoder)
+}
+
+// encode encodes the data read from source into a new BodyReader. Encoded
+// bodies aren't limited, since the body was already limited before it was
+// encoded.
+func (spooler *spooler) encode(source io.Reader, encoding Encoding) (*BodyReader, error) {
+	unlimited := *spooler
+	unlimited.limit = math.MaxInt64
+	buffer := &bodyBuffer{spooler: &unlimited}
+	encoder, err := newEncoder(buffer, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(encoder, source); err != nil {
+		buffer.discard()
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		buffer.discard()
+		return nil, err
+	}
+	return buffer.finish()
+}
+
+// bodyBuffer is a writer which accumulates a body in memory until it exceeds
+// the first tier's threshold, and then moves it to that tier's store, and so
+// on through the tiers.
+type bodyBuffer struct {
+	spooler *spooler
+	memory  bytes.Buffer
+	stored  StoredBody
+	tier    int // The number of tiers whose thresholds the body has exceeded.
+	size    int64
+}
+
+func (buffer *bodyBuffer) Write(p []byte) (int, error) {
+	if int64(len(p)) > buffer.spooler.limit-buffer.size {
+		return 0, errBodyTooLarge
+	}
+	buffer.size += int64(len(p))
+
+	tiers := buffer.spooler.tiers
+	tier := buffer.tier
+	for tier < len(tiers) && buffer.size > tiers[tier].Threshold {
+		tier++
+	}
+	if tier > buffer.tier {
+		// Skip straight to the last tier whose threshold was exceeded.
+		if err := buffer.moveTo(tiers[tier-1].Store); err != nil {
+			return 0, err
+		}
+		buffer.tier = tier
+	}
+
+	if buffer.stored != nil {
+		return buffer.stored.Write(p)
+	}
+	return buffer.memory.Write(p)
+}
+
+// moveTo copies what's been written so far to a new body in store.
+func (buffer *bodyBuffer) moveTo(store BodyStore) error {
+	stored, err := store.Create()
+	if err != nil {
+		return err
+	}
+
+	if buffer.stored == nil {
+		_, err = buffer.memory.WriteTo(stored)
+		buffer.memory = bytes.Buffer{}
+	} else if err = buffer.stored.Finish(); err == nil {
+		previous := buffer.stored.Open()
+		_, err = io.Copy(stored, previous)
+		previous.Close()
+	}
+	if err != nil {
+		stored.Remove()
+		return err
+	}
+
+	if buffer.stored != nil {
+		if err := buffer.stored.Remove(); err != nil {
+			logger.Errorf("Error removing spooled request body: %s", err)
+		}
+	}
+	buffer.stored = stored
+	return nil
+}
+
+func (buffer *bodyBuffer) finish() (*BodyReader, error) {
+	if buffer.stored != nil {
+		if err := buffer.stored.Finish(); err != nil {
+			buffer.discard()
+			return nil, err
+		}
+	}
+	body := &BodyReader{
+		memory: buffer.memory.Bytes(),
+		stored: buffer.stored,
+		size:   buffer.size,
+	}
+	body.Rewind()
+	return body, nil
+}
+
+// discard removes anything stored so far.
+func (buffer *bodyBuffer) discard() {
+	if buffer.stored == nil {
+		return
+	}
+	if err := buffer.stored.Remove(); err != nil {
+		logger.Errorf("Error removing spooled request body: %s", err)
+	}
+	buffer.stored = nil
+}
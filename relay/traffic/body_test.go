@@ -0,0 +1,228 @@
+package traffic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+func TestSpooler(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		body            string
+		expectedSpooled bool
+		expectedErr     error
+	}{
+		{
+			desc:            "Bodies up to the threshold are held in memory",
+			body:            "0123456789",
+			expectedSpooled: false,
+		},
+		{
+			desc:            "Bodies over the threshold are spooled",
+			body:            "0123456789abcdef",
+			expectedSpooled: true,
+		},
+		{
+			desc:        "Bodies over the limit are refused",
+			body:        strings.Repeat("x", 21),
+			expectedErr: errBodyTooLarge,
+		},
+	}
+
+	dir := t.TempDir()
+	spooler := &spooler{
+		tiers: []BodyStoreTier{{Threshold: 10, Store: &TempFileBodyStore{Dir: dir}}},
+		limit: 20,
+	}
+	for _, testCase := range testCases {
+		body, err := spooler.buffer(strings.NewReader(testCase.body))
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("Test '%v': Expected error %v but got %v", testCase.desc, testCase.expectedErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if body.Spooled() != testCase.expectedSpooled {
+			t.Errorf("Test '%v': Expected Spooled() to be %v", testCase.desc, testCase.expectedSpooled)
+		}
+		if body.Size() != int64(len(testCase.body)) {
+			t.Errorf("Test '%v': Expected size %v but got %v", testCase.desc, len(testCase.body), body.Size())
+		}
+
+		// Reopened readers are independent of Read, and of each other.
+		first := make([]byte, 4)
+		if _, err := io.ReadFull(body, first); err != nil || string(first) != testCase.body[:4] {
+			t.Errorf("Test '%v': Expected to read %q but got %q (%v)", testCase.desc, testCase.body[:4], first, err)
+		}
+		if reopened, _ := io.ReadAll(body.Reopen()); string(reopened) != testCase.body {
+			t.Errorf("Test '%v': Expected to reread %q but got %q", testCase.desc, testCase.body, reopened)
+		}
+		if rest, _ := io.ReadAll(body); string(rest) != testCase.body[4:] {
+			t.Errorf("Test '%v': Expected the rest of the body %q but got %q", testCase.desc, testCase.body[4:], rest)
+		}
+		body.Rewind()
+		if rewound, _ := io.ReadAll(body); string(rewound) != testCase.body {
+			t.Errorf("Test '%v': Expected to read %q after rewinding but got %q", testCase.desc, testCase.body, rewound)
+		}
+
+		body.release()
+		body.release()
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) > 0 {
+		t.Errorf("Expected spooled bodies to be removed but found %v (%v)", entries, err)
+	}
+}
+
+// memoryBodyStore is a BodyStore which records the bodies it holds.
+type memoryBodyStore struct {
+	bodies map[*memoryBody]bool
+}
+
+type memoryBody struct {
+	bytes.Buffer
+	store *memoryBodyStore
+}
+
+func (store *memoryBodyStore) Create() (StoredBody, error) {
+	body := &memoryBody{store: store}
+	store.bodies[body] = true
+	return body, nil
+}
+
+func (body *memoryBody) Finish() error {
+	return nil
+}
+
+func (body *memoryBody) Open() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(body.Bytes()))
+}
+
+func (body *memoryBody) Remove() error {
+	delete(body.store.bodies, body)
+	return nil
+}
+
+func TestSpoolerTiers(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		body             string
+		chunkSize        int
+		expectedTempFile bool
+		expectedInStore  bool
+	}{
+		{
+			desc:      "Small bodies are held in memory",
+			body:      "0123",
+			chunkSize: 1,
+		},
+		{
+			desc:             "Bodies over the first threshold are written to temporary files",
+			body:             "0123456789",
+			chunkSize:        1,
+			expectedTempFile: true,
+		},
+		{
+			desc:            "Bodies over the second threshold are moved to its store",
+			body:            "0123456789abcdef",
+			chunkSize:       1,
+			expectedInStore: true,
+		},
+		{
+			desc:            "Bodies which exceed both thresholds at once skip the first store",
+			body:            "0123456789abcdef",
+			chunkSize:       16,
+			expectedInStore: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		dir := t.TempDir()
+		store := &memoryBodyStore{bodies: map[*memoryBody]bool{}}
+		spooler := &spooler{
+			tiers: []BodyStoreTier{
+				{Threshold: 4, Store: &TempFileBodyStore{Dir: dir}},
+				{Threshold: 12, Store: store},
+			},
+			limit: 100,
+		}
+
+		buffer := &bodyBuffer{spooler: spooler}
+		for i := 0; i < len(testCase.body); i += testCase.chunkSize {
+			if _, err := buffer.Write([]byte(testCase.body[i:min(i+testCase.chunkSize, len(testCase.body))])); err != nil {
+				t.Fatalf("Test '%v': Error writing body: %v", testCase.desc, err)
+			}
+		}
+		body, err := buffer.finish()
+		if err != nil {
+			t.Fatalf("Test '%v': Error finishing body: %v", testCase.desc, err)
+		}
+
+		if entries, _ := os.ReadDir(dir); (len(entries) > 0) != testCase.expectedTempFile {
+			t.Errorf("Test '%v': Expected temporary file: %v, but found %v", testCase.desc, testCase.expectedTempFile, entries)
+		}
+		if (len(store.bodies) > 0) != testCase.expectedInStore {
+			t.Errorf("Test '%v': Expected body in store: %v, but found %v", testCase.desc, testCase.expectedInStore, len(store.bodies))
+		}
+		if read, _ := io.ReadAll(body); string(read) != testCase.body {
+			t.Errorf("Test '%v': Expected to read %q but got %q", testCase.desc, testCase.body, read)
+		}
+
+		body.release()
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 || len(store.bodies) > 0 {
+			t.Errorf("Test '%v': Expected the body to be removed but found %v and %v", testCase.desc, entries, store.bodies)
+		}
+	}
+}
+
+func TestTempFileBodyStore(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	store := &TempFileBodyStore{Dir: dir, EncryptionKey: key, MaxAge: time.Hour}
+
+	// Files older than MaxAge, like those left by a crash, are deleted.
+	stale := filepath.Join(dir, "relay-body-stale.rly")
+	os.WriteFile(stale, []byte("RLY0stale"), 0o600)
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale, past, past)
+
+	payload := strings.Repeat("secret payload ", 10000)
+	body, err := store.Create()
+	if err != nil {
+		t.Fatalf("Error creating body: %v", err)
+	}
+	defer body.Remove()
+	io.WriteString(body, payload)
+	if err := body.Finish(); err != nil {
+		t.Fatalf("Error finishing body: %v", err)
+	}
+	if read, err := io.ReadAll(body.Open()); string(read) != payload || err != nil {
+		t.Errorf("Expected to read the body back but got %v bytes (%v)", len(read), err)
+	}
+
+	// Bodies are encrypted with the key.
+	name := body.(*tempFileBody).name
+	raw, _ := os.ReadFile(filepath.Join(dir, name+".rly"))
+	if bytes.Contains(raw, []byte("secret payload")) {
+		t.Errorf("Expected the spooled body to be encrypted")
+	}
+	keyStore, _ := storage.NewStore(&storage.Options{Directory: dir, EncryptionKey: key})
+	if read, err := keyStore.Read(name); string(read) != payload || err != nil {
+		t.Errorf("Expected the body to be readable with the key but got %v bytes (%v)", len(read), err)
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(stale); errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	t.Errorf("Expected the stale body to be deleted")
+}
@@ -0,0 +1,166 @@
+package traffic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+// BodyStore holds buffered request bodies which are too large to keep in
+// memory. Bodies start out in memory and move to a store once they exceed its
+// threshold; see BodyStoreTier. The relay creates a body in a store, writes
+// the whole body to it, and then reads it back any number of times before
+// removing it.
+type BodyStore interface {
+	// Create returns a new, empty body.
+	Create() (StoredBody, error)
+}
+
+// StoredBody is a body held in a BodyStore.
+type StoredBody interface {
+	io.Writer
+
+	// Finish is called once the whole body has been written.
+	Finish() error
+
+	// Open returns a reader positioned at the start of the body. It may only
+	// be called once Finish has succeeded. Errors are reported by Read.
+	Open() io.ReadCloser
+
+	// Remove deletes the body. It may be called at any time, and more than
+	// once.
+	Remove() error
+}
+
+// BodyStoreTier selects a BodyStore for bodies larger than Threshold bytes.
+type BodyStoreTier struct {
+	Threshold int64
+	Store     BodyStore
+}
+
+// TempFileBodyStore holds bodies in temporary files. Like other traffic the
+// relay persists, the files are encrypted with AES-GCM, and any left behind,
+// for example by a crash, are deleted once they're older than MaxAge. Since
+// spooled bodies are only ever read by the relay which wrote them, a random
+// key is used unless EncryptionKey is set.
+type TempFileBodyStore struct {
+	Dir           string        // Where the files are written. If empty, a "relay-spool" directory in the default temporary directory is used.
+	EncryptionKey []byte        // An AES key (16, 24, or 32 bytes). If empty, a random key is used.
+	MaxAge        time.Duration // How long files are kept. If zero, DefaultSpoolMaxAge is used.
+
+	once        sync.Once
+	store       *storage.Store
+	err         error
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+// DefaultSpoolMaxAge is how long spooled bodies are kept by default. Bodies are
+// removed as soon as their requests have been handled, so only those left
+// behind are ever this old.
+const DefaultSpoolMaxAge = 24 * time.Hour
+
+// spoolCleanupInterval is how often TempFileBodyStore looks for expired files.
+const spoolCleanupInterval = time.Minute
+
+func (store *TempFileBodyStore) Create() (StoredBody, error) {
+	store.once.Do(store.open)
+	if store.err != nil {
+		return nil, store.err
+	}
+	store.cleanup()
+
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return nil, err
+	}
+	body := &tempFileBody{store: store.store, name: "relay-body-" + hex.EncodeToString(name)}
+	writer, err := store.store.Create(body.name)
+	if err != nil {
+		return nil, err
+	}
+	body.writer = writer
+	return body, nil
+}
+
+func (store *TempFileBodyStore) open() {
+	options := &storage.Options{
+		Directory:     store.Dir,
+		EncryptionKey: store.EncryptionKey,
+		MaxAge:        store.MaxAge,
+	}
+	if options.Directory == "" {
+		options.Directory = filepath.Join(os.TempDir(), "relay-spool")
+	}
+	if len(options.EncryptionKey) == 0 {
+		options.EncryptionKey = make([]byte, 32)
+		if _, err := rand.Read(options.EncryptionKey); err != nil {
+			store.err = err
+			return
+		}
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = DefaultSpoolMaxAge
+	}
+	store.store, store.err = storage.NewStore(options)
+}
+
+// cleanup deletes expired files in the background, at most once per
+// spoolCleanupInterval.
+func (store *TempFileBodyStore) cleanup() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if time.Since(store.lastCleanup) < spoolCleanupInterval {
+		return
+	}
+	store.lastCleanup = time.Now()
+	go func() {
+		if deleted, err := store.store.Cleanup(); err != nil {
+			logger.Errorf("Error deleting expired spooled request bodies: %s", err)
+		} else if deleted > 0 {
+			logger.Warnf("Deleted %d expired spooled request bodies", deleted)
+		}
+	}()
+}
+
+type tempFileBody struct {
+	store  *storage.Store
+	name   string
+	writer *storage.Writer
+}
+
+func (body *tempFileBody) Write(p []byte) (int, error) {
+	return body.writer.Write(p)
+}
+
+func (body *tempFileBody) Finish() error {
+	return body.writer.Close()
+}
+
+func (body *tempFileBody) Open() io.ReadCloser {
+	reader, err := body.store.Open(body.name)
+	if err != nil {
+		return io.NopCloser(&failedReader{err: err})
+	}
+	return reader
+}
+
+func (body *tempFileBody) Remove() error {
+	body.writer.Close()
+	return body.store.Delete(body.name)
+}
+
+// failedReader reports an error when it's read.
+type failedReader struct {
+	err error
+}
+
+func (reader *failedReader) Read(p []byte) (int, error) {
+	return 0, reader.err
+}
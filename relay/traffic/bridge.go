@@ -0,0 +1,303 @@
+package traffic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// The websocket bridge lets clients send requests over a single long-lived
+// websocket, rather than as many short POSTs, which can be faster on
+// high-latency networks. Each text message the client sends describes a POST,
+// which is relayed as if it had arrived on its own, passing through every
+// plugin; the response is sent back over the websocket. Messages are handled
+// one at a time, in the order they arrive, so recording bundles reach the
+// target in order.
+//
+// A request message looks like:
+//
+//	{"id": "1", "path": "/rec/bundle?Seq=1", "headers": {"Content-Type": "application/json"}, "body": "..."}
+//
+// If "base64" is true, the body is base64-encoded, which allows binary bodies
+// such as compressed ones. The response message carries the same "id":
+//
+//	{"id": "1", "status": 200, "headers": {"Content-Type": "text/plain"}, "body": "..."}
+//
+// Response bodies which aren't valid UTF-8 are base64-encoded, and "base64" is
+// true. Messages which can't be relayed are answered with a 400 status and an
+// "error".
+
+// WebsocketBridgeOptions configures the websocket bridge.
+type WebsocketBridgeOptions struct {
+	Path string // Websocket upgrades to this path are handled by the bridge. If empty, the bridge is disabled.
+}
+
+func (options WebsocketBridgeOptions) enabled() bool {
+	return options.Path != ""
+}
+
+// bridgeRequest is a message sent by a client over the bridge, describing a
+// POST to relay.
+type bridgeRequest struct {
+	Id      string            `json:"id"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+	Base64  bool              `json:"base64,omitempty"`
+}
+
+// bridgeResponse is the message sent back to the client once a bridgeRequest
+// has been relayed.
+type bridgeResponse struct {
+	Id      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+	Base64  bool              `json:"base64,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// websocketAcceptGuid is appended to a client's key to compute the
+// Sec-WebSocket-Accept header, as described in RFC 6455 section 4.2.2.
+const websocketAcceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Websocket close status codes, from RFC 6455 section 7.4.1.
+const (
+	websocketCloseNormal          = 1000
+	websocketCloseProtocolError   = 1002
+	websocketCloseUnsupportedData = 1003
+	websocketCloseMessageTooBig   = 1009
+)
+
+const (
+	websocketPingFrame = 0x9
+	websocketPongFrame = 0xa
+)
+
+// isBridgeUpgrade returns true if the request should be handled by the
+// websocket bridge.
+func (handler *Handler) isBridgeUpgrade(request *http.Request) bool {
+	return handler.config.WebsocketBridge.enabled() &&
+		request.URL.Path == handler.config.WebsocketBridge.Path &&
+		strings.EqualFold(request.Header.Get("Upgrade"), "websocket")
+}
+
+// serveBridge completes the websocket handshake itself, rather than relaying
+// it to the target, and then relays the requests the client sends until the
+// websocket is closed.
+func (handler *Handler) serveBridge(response http.ResponseWriter, upgrade *http.Request) {
+	key := upgrade.Header.Get("Sec-WebSocket-Key")
+	if key == "" || upgrade.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(response, "Invalid websocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := response.(http.Hijacker)
+	if !ok {
+		http.Error(response, "Does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		logger.Errorf("Cannot hijack connection: %v", err)
+		http.Error(response, "Could not hijack", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(key + websocketAcceptGuid))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, handshake); err != nil {
+		logger.Errorf("Error completing websocket bridge handshake: %v", err)
+		return
+	}
+
+	logger.Printf("Bridging websocket from %v", upgrade.RemoteAddr)
+	status, err := handler.bridgeMessages(conn, buffer.Reader, upgrade)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		logger.Errorf("Error bridging websocket from %v: %v", upgrade.RemoteAddr, err)
+	}
+	if status != 0 {
+		closePayload := binary.BigEndian.AppendUint16(nil, uint16(status))
+		writeWebsocketFrame(conn, &websocketFrame{fin: true, opcode: websocketCloseFrame, payload: closePayload}, false)
+	}
+}
+
+// bridgeMessages reads messages from the client and answers each of them. It
+// returns when the websocket should be closed, along with the status code to
+// close it with, or 0 if the connection is already unusable.
+func (handler *Handler) bridgeMessages(conn net.Conn, reader *bufio.Reader, upgrade *http.Request) (int, error) {
+	// Bodies may be base64-encoded, so messages may be somewhat larger than
+	// the bodies they carry.
+	maxMessageSize := handler.config.MaxBodySize * 2
+
+	var message []byte
+	messageOpcode := byte(0)
+	for {
+		frame, err := readWebsocketFrame(reader, maxMessageSize)
+		if errors.Is(err, errWebsocketFrameTooLarge) {
+			return websocketCloseMessageTooBig, err
+		} else if err != nil {
+			return 0, err
+		}
+		if frame.rsv != 0 {
+			return websocketCloseProtocolError, fmt.Errorf("websocket frame has RSV bits set")
+		}
+
+		switch frame.opcode {
+		case websocketCloseFrame:
+			return websocketCloseNormal, nil
+		case websocketPingFrame:
+			pong := &websocketFrame{fin: true, opcode: websocketPongFrame, payload: frame.payload}
+			if err := writeWebsocketFrame(conn, pong, false); err != nil {
+				return 0, err
+			}
+			continue
+		case websocketPongFrame:
+			continue
+		case websocketContinuationFrame:
+			if messageOpcode == 0 {
+				return websocketCloseProtocolError, fmt.Errorf("unexpected websocket continuation frame")
+			}
+		default:
+			if messageOpcode != 0 {
+				return websocketCloseProtocolError, fmt.Errorf("websocket message interrupted by a new message")
+			}
+			messageOpcode = frame.opcode
+		}
+
+		message = append(message, frame.payload...)
+		if int64(len(message)) > maxMessageSize {
+			return websocketCloseMessageTooBig, errWebsocketFrameTooLarge
+		}
+		if !frame.fin {
+			continue
+		}
+		if messageOpcode != websocketTextFrame {
+			return websocketCloseUnsupportedData, fmt.Errorf("websocket bridge messages must be text")
+		}
+
+		reply, err := json.Marshal(handler.bridgeMessage(message, upgrade))
+		if err != nil {
+			return 0, err
+		}
+		if err := writeWebsocketFrame(conn, &websocketFrame{fin: true, opcode: websocketTextFrame, payload: reply}, false); err != nil {
+			return 0, err
+		}
+		message = nil
+		messageOpcode = 0
+	}
+}
+
+// bridgeMessage relays the request described by a message, and returns the
+// message to send back to the client.
+func (handler *Handler) bridgeMessage(message []byte, upgrade *http.Request) *bridgeResponse {
+	var bridged bridgeRequest
+	if err := json.Unmarshal(message, &bridged); err != nil {
+		return &bridgeResponse{Status: http.StatusBadRequest, Error: fmt.Sprintf("Invalid message: %v", err)}
+	}
+	if !strings.HasPrefix(bridged.Path, "/") {
+		return &bridgeResponse{Id: bridged.Id, Status: http.StatusBadRequest, Error: "Message path must start with '/'"}
+	}
+
+	body := []byte(bridged.Body)
+	if bridged.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(bridged.Body)
+		if err != nil {
+			return &bridgeResponse{Id: bridged.Id, Status: http.StatusBadRequest, Error: fmt.Sprintf("Invalid base64 body: %v", err)}
+		}
+		body = decoded
+	}
+	if int64(len(body)) > handler.config.MaxBodySize {
+		return &bridgeResponse{Id: bridged.Id, Status: http.StatusRequestEntityTooLarge, Error: errBodyTooLarge.Error()}
+	}
+
+	request, err := http.NewRequestWithContext(upgrade.Context(), http.MethodPost, bridged.Path, bytes.NewReader(body))
+	if err != nil {
+		return &bridgeResponse{Id: bridged.Id, Status: http.StatusBadRequest, Error: fmt.Sprintf("Invalid message path: %v", err)}
+	}
+	request.Proto, request.ProtoMajor, request.ProtoMinor = "HTTP/1.1", 1, 1
+	request.Host = upgrade.Host
+	request.RequestURI = bridged.Path
+	request.RemoteAddr = upgrade.RemoteAddr
+	request.TLS = upgrade.TLS
+
+	// Requests carry the upgrade request's headers, like User-Agent and
+	// Origin, as well as their own.
+	request.Header = upgrade.Header.Clone()
+	for name := range request.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Sec-Websocket-") {
+			request.Header.Del(name)
+		}
+	}
+	for name, value := range bridged.Headers {
+		request.Header.Set(name, value)
+	}
+	for _, name := range []string{"Connection", "Upgrade", "Content-Length", "Transfer-Encoding"} {
+		request.Header.Del(name)
+	}
+
+	recorder := &bridgeResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(recorder, request)
+
+	reply := &bridgeResponse{
+		Id:      bridged.Id,
+		Status:  recorder.statusOrDefault(),
+		Headers: make(map[string]string, len(recorder.header)),
+	}
+	for name := range recorder.header {
+		reply.Headers[name] = recorder.header.Get(name)
+	}
+	if utf8.Valid(recorder.body.Bytes()) {
+		reply.Body = recorder.body.String()
+	} else {
+		reply.Body = base64.StdEncoding.EncodeToString(recorder.body.Bytes())
+		reply.Base64 = true
+	}
+	return reply
+}
+
+// bridgeResponseWriter buffers the response to a bridged request, so that it
+// can be sent back over the websocket.
+type bridgeResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (writer *bridgeResponseWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *bridgeResponseWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+}
+
+func (writer *bridgeResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.body.Write(data)
+}
+
+func (writer *bridgeResponseWriter) statusOrDefault() int {
+	if writer.status == 0 {
+		return http.StatusOK
+	}
+	return writer.status
+}
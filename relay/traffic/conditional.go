@@ -0,0 +1,142 @@
+package traffic
+
+import (
+	"net/http"
+)
+
+// RequestCondition decides which requests a ConditionalPlugin handles.
+type RequestCondition interface {
+	// Matches returns true if the plugin should handle the request. It's
+	// called for every request, so it should return quickly.
+	Matches(request *http.Request) bool
+}
+
+// ConditionalPlugin wraps a plugin so that it only handles the requests which
+// match a condition. The plugin loader wraps the plugins whose configuration
+// section has a 'when' section, so that plugins needn't each implement their
+// own matching.
+//
+// The relay finds the wrapped plugin's optional interfaces as usual. Requests
+// which don't match are neither passed to the plugin's HandleRequest nor, once
+// they've been relayed, to its HandleResponse or HandleCompletion, and their
+// gRPC messages, server-sent events, and websocket messages aren't passed to
+// it either; a WsPlugin only handles the messages of websocket connections
+// whose upgrade request matches. Later hooks are matched against the request
+// as it was relayed, after every plugin has handled it. Hooks which aren't
+// specific to a request, like ConnectionPlugin's, are unaffected.
+type ConditionalPlugin struct {
+	Plugin
+	Condition RequestCondition
+}
+
+func (plug *ConditionalPlugin) HandleRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	requestInfo RequestInfo,
+) bool {
+	if !plug.Condition.Matches(request) {
+		return false
+	}
+	return plug.Plugin.HandleRequest(response, request, requestInfo)
+}
+
+// UnwrapPlugin returns the plugin which a ConditionalPlugin wraps, or the
+// plugin itself if it isn't wrapped. Code which looks for a plugin's optional
+// interfaces should use it, since the wrapper doesn't implement them.
+func UnwrapPlugin(plugin Plugin) Plugin {
+	if conditional, ok := plugin.(*ConditionalPlugin); ok {
+		return conditional.Plugin
+	}
+	return plugin
+}
+
+// pluginCondition returns the condition with which a plugin was wrapped, or
+// nil if it applies to every request.
+func pluginCondition(plugin Plugin) RequestCondition {
+	if conditional, ok := plugin.(*ConditionalPlugin); ok {
+		return conditional.Condition
+	}
+	return nil
+}
+
+// The hooks of conditional plugins are wrapped so that they're only invoked
+// for matching requests.
+
+type conditionalResponsePlugin struct {
+	ResponsePlugin
+	condition RequestCondition
+}
+
+func (plug conditionalResponsePlugin) HandleResponse(response *http.Response, info RequestInfo) {
+	if plug.condition.Matches(response.Request) {
+		plug.ResponsePlugin.HandleResponse(response, info)
+	}
+}
+
+type conditionalCompletionPlugin struct {
+	CompletionPlugin
+	condition RequestCondition
+}
+
+func (plug conditionalCompletionPlugin) HandleCompletion(completion *RequestCompletion) {
+	if plug.condition.Matches(completion.Request) {
+		plug.CompletionPlugin.HandleCompletion(completion)
+	}
+}
+
+type conditionalGrpcPlugin struct {
+	GrpcPlugin
+	condition RequestCondition
+}
+
+func (plug conditionalGrpcPlugin) HandleGrpcMessage(request *http.Request, message *GrpcMessage) {
+	if plug.condition.Matches(request) {
+		plug.GrpcPlugin.HandleGrpcMessage(request, message)
+	}
+}
+
+type conditionalEventPlugin struct {
+	ServerSentEventPlugin
+	condition RequestCondition
+}
+
+func (plug conditionalEventPlugin) HandleServerSentEvent(request *http.Request, event *ServerSentEvent) {
+	if plug.condition.Matches(request) {
+		plug.ServerSentEventPlugin.HandleServerSentEvent(request, event)
+	}
+}
+
+type conditionalRecorderPlugin struct {
+	WebsocketRecorderPlugin
+	condition RequestCondition
+}
+
+func (plug conditionalRecorderPlugin) RecordWebsocket(request *http.Request) WebsocketRecording {
+	if !plug.condition.Matches(request) {
+		return nil
+	}
+	return plug.WebsocketRecorderPlugin.RecordWebsocket(request)
+}
+
+// WsPlugins aren't passed the request, so their condition is matched once per
+// connection, against the upgrade request, by matchingMessagePlugins.
+type conditionalMessagePlugin struct {
+	WsPlugin
+	condition RequestCondition
+}
+
+// matchingMessagePlugins returns the WsPlugins which should handle the
+// messages of the websocket connection upgraded by a request.
+func matchingMessagePlugins(plugins []WsPlugin, request *http.Request) []WsPlugin {
+	var matching []WsPlugin
+	for _, plugin := range plugins {
+		if conditional, ok := plugin.(conditionalMessagePlugin); ok {
+			if !conditional.condition.Matches(request) {
+				continue
+			}
+			plugin = conditional.WsPlugin
+		}
+		matching = append(matching, plugin)
+	}
+	return matching
+}
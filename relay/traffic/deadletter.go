@@ -0,0 +1,257 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"github.com/immersa-co/relay-core/relay/storage"
+)
+
+// DeadLetterOptions configures the capture of requests which the relay
+// couldn't deliver to the target: those for which the target couldn't be
+// reached, or responded with a 502, 503, or 504, even after any retries. Such
+// requests are written to a storage directory, POSTed to a webhook, or both,
+// so that they can be re-driven once the target recovers.
+//
+// Dead letters are captured after plugins have processed the request, so
+// they're sanitized just like relayed requests; credential headers, and any
+// listed in RedactHeaders, are removed as well.
+type DeadLetterOptions struct {
+	Store         *storage.Store // If non-nil, dead letters are written here.
+	WebhookURL    string         // If non-empty, dead letters are POSTed here as JSON.
+	RedactHeaders []string       // Additional headers which are removed from dead letters.
+}
+
+// DeadLetter is a request which the relay couldn't deliver to the target, in
+// the form in which it's stored and sent to webhooks.
+type DeadLetter struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body,omitempty"` // Encoded as described by the Content-Encoding header.
+	Attempts int         `json:"attempts"`
+	Status   int         `json:"status,omitempty"` // The target's last response status, if it responded.
+	Error    string      `json:"error,omitempty"`  // Why the target couldn't be reached, if it couldn't.
+}
+
+// deadLetterRemovedHeaders are never captured in dead letters, since they
+// carry credentials.
+var deadLetterRemovedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// deadLetterWebhookTimeout bounds the time spent sending each dead letter to
+// the webhook.
+const deadLetterWebhookTimeout = 10 * time.Second
+
+// Request reconstructs the request which couldn't be delivered.
+func (letter *DeadLetter) Request() (*http.Request, error) {
+	request, err := http.NewRequest(letter.Method, letter.URL, bytes.NewReader(letter.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Host = letter.Host
+	for name, values := range letter.Header {
+		request.Header[name] = append([]string{}, values...)
+	}
+	request.ContentLength = int64(len(letter.Body))
+	if len(letter.Body) > 0 {
+		request.Header.Set("Content-Length", strconv.Itoa(len(letter.Body)))
+	}
+	return request, nil
+}
+
+// deadLetters captures requests which couldn't be delivered.
+type deadLetters struct {
+	options  *DeadLetterOptions
+	client   *http.Client
+	metrics  *metrics.Registry
+	sequence atomic.Uint64 // Distinguishes dead letters captured at the same time.
+}
+
+func newDeadLetters(options *DeadLetterOptions, metricsRegistry *metrics.Registry) *deadLetters {
+	if options == nil {
+		return nil
+	}
+	return &deadLetters{
+		options: options,
+		client:  &http.Client{Timeout: deadLetterWebhookTimeout},
+		metrics: metricsRegistry,
+	}
+}
+
+// preserveRequestBody makes sure the request's body can be read again once
+// it's been sent, and returns a function which returns it. Spooled bodies are
+// reopened; others are read into memory and replaced with an equivalent
+// reader.
+func preserveRequestBody(request *http.Request) func() ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return func() ([]byte, error) { return nil, nil }
+	}
+	if body, ok := request.Body.(*BodyReader); ok {
+		return func() ([]byte, error) {
+			reader := body.Reopen()
+			defer reader.Close()
+			return io.ReadAll(reader)
+		}
+	}
+
+	// If the body can't be read, the truncated body is sent, and the
+	// transport reports that it doesn't match the request's Content-Length.
+	body, err := io.ReadAll(request.Body)
+	request.Body.Close()
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	return func() ([]byte, error) { return body, err }
+}
+
+// capture records a request which couldn't be delivered, along with the
+// target's response status or the error which prevented delivery. Dead
+// letters are stored before capture returns; webhooks are called in the
+// background.
+func (letters *deadLetters) capture(request *http.Request, readBody func() ([]byte, error), attempts int, status int, deliveryErr error) {
+	body, err := readBody()
+	if err != nil {
+		logger.Errorf("Error reading body of dead letter: %s", err)
+		letters.metrics.DeadLetter("failed")
+		return
+	}
+
+	letter := &DeadLetter{
+		Time:     time.Now(),
+		Method:   request.Method,
+		URL:      request.URL.String(),
+		Host:     request.Host,
+		Header:   request.Header.Clone(),
+		Body:     body,
+		Attempts: attempts,
+		Status:   status,
+	}
+	if deliveryErr != nil {
+		letter.Error = deliveryErr.Error()
+	}
+	for _, name := range deadLetterRemovedHeaders {
+		letter.Header.Del(name)
+	}
+	for _, name := range letters.options.RedactHeaders {
+		letter.Header.Del(name)
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		logger.Errorf("Error encoding dead letter: %s", err)
+		letters.metrics.DeadLetter("failed")
+		return
+	}
+
+	if store := letters.options.Store; store != nil {
+		name := fmt.Sprintf("%020d-%06d", letter.Time.UnixNano(), letters.sequence.Add(1)%1000000)
+		if err := store.Write(name, data); err != nil {
+			logger.Errorf("Error storing dead letter: %s", err)
+			letters.metrics.DeadLetter("failed")
+		} else {
+			logger.Printf("%s %s: stored as dead letter %v", request.Method, request.URL, name)
+			letters.metrics.DeadLetter("stored")
+		}
+	}
+	if letters.options.WebhookURL != "" {
+		go letters.sendWebhook(data)
+	}
+}
+
+func (letters *deadLetters) sendWebhook(data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterWebhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, letters.options.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		logger.Errorf("Error sending dead letter to webhook: %s", err)
+		letters.metrics.DeadLetter("failed")
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := letters.client.Do(request)
+	if err != nil {
+		logger.Errorf("Error sending dead letter to webhook: %s", err)
+		letters.metrics.DeadLetter("failed")
+		return
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logger.Errorf("Error sending dead letter to webhook: status %v", response.StatusCode)
+		letters.metrics.DeadLetter("failed")
+		return
+	}
+	letters.metrics.DeadLetter("webhook")
+}
+
+// ReadDeadLetter reads the dead letter stored under the provided name.
+func ReadDeadLetter(store *storage.Store, name string) (*DeadLetter, error) {
+	data, err := store.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(data, letter); err != nil {
+		return nil, fmt.Errorf(`Dead letter "%v" is invalid: %v`, name, err)
+	}
+	return letter, nil
+}
+
+// RedriveDeadLetters sends each dead letter in the store again, oldest first,
+// and deletes those which the target accepts with a 2xx response. If target is
+// non-nil, its scheme and host replace those the requests were originally
+// sent to. It returns the number of dead letters delivered and the number
+// which remain; failures to deliver individual dead letters are logged.
+func RedriveDeadLetters(store *storage.Store, client *http.Client, target *url.URL) (delivered int, remaining int, err error) {
+	names, err := store.List()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, name := range names {
+		if err := redriveDeadLetter(store, client, target, name); err != nil {
+			logger.Errorf("Error redriving dead letter %v: %s", name, err)
+			remaining++
+			continue
+		}
+		delivered++
+	}
+	return delivered, remaining, nil
+}
+
+func redriveDeadLetter(store *storage.Store, client *http.Client, target *url.URL, name string) error {
+	letter, err := ReadDeadLetter(store, name)
+	if err != nil {
+		return err
+	}
+	request, err := letter.Request()
+	if err != nil {
+		return err
+	}
+	if target != nil {
+		request.URL.Scheme = target.Scheme
+		request.URL.Host = target.Host
+		request.Host = target.Host
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Target responded with status %v", response.StatusCode)
+	}
+	return store.Delete(name)
+}
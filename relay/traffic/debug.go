@@ -0,0 +1,193 @@
+package traffic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"strings"
+)
+
+// Debug headers summarize how plugins handled a request, to make it easier to
+// see why a request was relayed the way it was. They're added to every
+// response if RelayOptions.DebugHeaders is true, and otherwise only to
+// responses to clients in RelayOptions.DebugNetworks which ask for them by
+// sending DebugHeaderName.
+const (
+	// DebugHeaderName is the request header with which trusted clients ask for
+	// debug headers. It's never relayed to the target.
+	DebugHeaderName = "X-Relay-Debug"
+
+	// DebugPluginsHeaderName lists each plugin which handled the request, in
+	// order, with its decision: "passed" if it left the request alone,
+	// "modified(...)" with the parts of the request it changed, or
+	// "serviced" if it responded to the client. Plugins whose 'when'
+	// conditions didn't match the request are listed as "skipped".
+	DebugPluginsHeaderName = "X-Relay-Debug-Plugins"
+
+	// DebugTagsHeaderName lists the tags plugins attached to the request.
+	DebugTagsHeaderName = "X-Relay-Debug-Tags"
+)
+
+// debugHeadersRequested returns true if debug headers should be added to the
+// response to a request.
+func (handler *Handler) debugHeadersRequested(request *http.Request) bool {
+	if len(handler.config.DebugNetworks) == 0 {
+		return handler.config.DebugHeaders
+	}
+
+	requested := request.Header.Get(DebugHeaderName) != ""
+	request.Header.Del(DebugHeaderName)
+	if handler.config.DebugHeaders {
+		return true
+	} else if !requested {
+		return false
+	}
+
+	addrPort, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, network := range handler.config.DebugNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugTrace records the decisions plugins make about a request, so that they
+// can be reported in debug headers and the audit log.
+type debugTrace struct {
+	decisions    []string
+	running      string // The plugin handling the request, if any.
+	tags         *Tags
+	bodyModified bool // True if any plugin replaced the body.
+}
+
+// start records that a plugin is about to handle the request, and returns a
+// snapshot of the request to compare against once it's done.
+func (trace *debugTrace) start(plugin string, request *http.Request) *requestSnapshot {
+	trace.running = plugin
+	return snapshotRequest(request)
+}
+
+// finish records the decision of the plugin which just handled the request.
+func (trace *debugTrace) finish(serviced bool, snapshot *requestSnapshot, request *http.Request) {
+	decision := "passed"
+	if serviced {
+		decision = "serviced"
+	} else if changes := snapshot.changes(request); len(changes) > 0 {
+		decision = fmt.Sprintf("modified(%v)", strings.Join(changes, ","))
+		for _, change := range changes {
+			trace.bodyModified = trace.bodyModified || change == "body"
+		}
+	}
+	trace.decisions = append(trace.decisions, fmt.Sprintf("%v=%v", trace.running, decision))
+	trace.running = ""
+}
+
+// skip records that a plugin didn't handle the request because its condition
+// didn't match.
+func (trace *debugTrace) skip(plugin string) {
+	trace.decisions = append(trace.decisions, fmt.Sprintf("%v=skipped", plugin))
+}
+
+// addHeaders adds the debug headers to a response. The response is being sent
+// while the plugin that's running, if any, handles the request, so it's the
+// one servicing it; plugins which haven't run yet aren't listed.
+func (trace *debugTrace) addHeaders(header http.Header) {
+	decisions := trace.decisions
+	if trace.running != "" {
+		decisions = append(decisions[:len(decisions):len(decisions)], trace.running+"=serviced")
+	}
+	header.Set(DebugPluginsHeaderName, strings.Join(decisions, ", "))
+	header.Set(DebugTagsHeaderName, trace.tags.String())
+}
+
+// requestSnapshot holds the parts of a request which plugins commonly change.
+type requestSnapshot struct {
+	method     string
+	url        string
+	host       string
+	header     http.Header
+	body       io.ReadCloser
+	remoteAddr string
+}
+
+func snapshotRequest(request *http.Request) *requestSnapshot {
+	return &requestSnapshot{
+		method:     request.Method,
+		url:        request.URL.String(),
+		host:       request.Host,
+		header:     request.Header.Clone(),
+		body:       request.Body,
+		remoteAddr: request.RemoteAddr,
+	}
+}
+
+// changes returns the names of the parts of a request which differ from the
+// snapshot. Bodies are compared by identity, so a plugin which rewrites the
+// body in place isn't noticed, but one which replaces it is.
+func (snapshot *requestSnapshot) changes(request *http.Request) []string {
+	var changes []string
+	if request.Method != snapshot.method {
+		changes = append(changes, "method")
+	}
+	if request.URL.String() != snapshot.url || request.Host != snapshot.host {
+		changes = append(changes, "url")
+	}
+	if !reflect.DeepEqual(request.Header, snapshot.header) && (len(request.Header) > 0 || len(snapshot.header) > 0) {
+		changes = append(changes, "header")
+	}
+	if request.Body != snapshot.body {
+		changes = append(changes, "body")
+	}
+	if request.RemoteAddr != snapshot.remoteAddr {
+		changes = append(changes, "remote-addr")
+	}
+	return changes
+}
+
+// debugResponseWriter adds debug headers to a response just before its
+// headers are sent.
+type debugResponseWriter struct {
+	http.ResponseWriter
+	trace       *debugTrace
+	wroteHeader bool
+}
+
+func (writer *debugResponseWriter) WriteHeader(status int) {
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+		writer.trace.addHeaders(writer.ResponseWriter.Header())
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *debugResponseWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+// Hijack implements http.Hijacker, so that websocket upgrades still work.
+// Debug headers aren't added to the handshake response.
+func (writer *debugResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+	writer.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+func (writer *debugResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
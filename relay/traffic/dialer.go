@@ -0,0 +1,222 @@
+package traffic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+// IPFamilyPreference determines which address family the relay tries first
+// when the target host resolves to both IPv4 and IPv6 addresses.
+type IPFamilyPreference string
+
+const (
+	// PreferAnyFamily uses the order returned by the resolver, which is
+	// Go's default behavior.
+	PreferAnyFamily IPFamilyPreference = ""
+	PreferIPv4      IPFamilyPreference = "ipv4"
+	PreferIPv6      IPFamilyPreference = "ipv6"
+)
+
+// ParseIPFamilyPreference converts a configuration value into an
+// IPFamilyPreference.
+func ParseIPFamilyPreference(value string) (IPFamilyPreference, error) {
+	switch preference := IPFamilyPreference(value); preference {
+	case PreferAnyFamily, PreferIPv4, PreferIPv6:
+		return preference, nil
+	default:
+		return PreferAnyFamily, fmt.Errorf(`Unknown IP family preference "%v"; expected "ipv4" or "ipv6"`, value)
+	}
+}
+
+// DialOptions controls how the relay connects to the target when the target
+// is reachable over both IPv4 and IPv6. The relay races the two families
+// ("Happy Eyeballs", RFC 8305): addresses from the preferred family are dialed
+// first, and if no connection has been established after FallbackDelay, the
+// other family is dialed in parallel. The first connection to succeed wins.
+//
+// It also controls how the target host is resolved: by default, using the
+// system's resolver for every connection.
+type DialOptions struct {
+	Preference    IPFamilyPreference // Which address family to try first.
+	FallbackDelay time.Duration      // How long to wait before racing the other family. Zero uses the default.
+	IPv4Timeout   time.Duration      // Total time allowed for dialing IPv4 addresses. Zero means no limit.
+	IPv6Timeout   time.Duration      // Total time allowed for dialing IPv6 addresses. Zero means no limit.
+	DNSServers    []string           // If non-empty, hosts are resolved by querying these servers (host:port) in turn.
+	DNSCacheTTL   time.Duration      // If non-zero, resolved addresses are cached for this long, whatever their records' TTLs.
+}
+
+const DefaultDialFallbackDelay = 300 * time.Millisecond
+
+// dialer implements dual-stack dialing according to DialOptions.
+type dialer struct {
+	options  DialOptions
+	resolver ipResolver
+}
+
+func newDialer(options DialOptions, clock clock.Clock) *dialer {
+	return &dialer{
+		options:  options,
+		resolver: newResolver(options, clock),
+	}
+}
+
+// DialContext has the same signature as net.Dialer#DialContext, so that it
+// can be used with http.Transport.
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Literal IP addresses don't need any special handling.
+	if ip := net.ParseIP(host); ip != nil {
+		return d.dialFamily(ctx, network, []net.IP{ip}, port, d.timeoutFor(ip))
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv4, ipv6 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ipv4 = append(ipv4, addr.IP)
+		} else {
+			ipv6 = append(ipv6, addr.IP)
+		}
+	}
+
+	primary, fallback := ipv4, ipv6
+	primaryTimeout, fallbackTimeout := d.options.IPv4Timeout, d.options.IPv6Timeout
+	preferIPv6 := d.options.Preference == PreferIPv6 ||
+		(d.options.Preference == PreferAnyFamily && len(addrs) > 0 && addrs[0].IP.To4() == nil)
+	if preferIPv6 {
+		primary, fallback = ipv6, ipv4
+		primaryTimeout, fallbackTimeout = d.options.IPv6Timeout, d.options.IPv4Timeout
+	}
+
+	if len(primary) == 0 {
+		return d.dialFamily(ctx, network, fallback, port, fallbackTimeout)
+	}
+	if len(fallback) == 0 {
+		return d.dialFamily(ctx, network, primary, port, primaryTimeout)
+	}
+
+	return d.race(ctx, network, port, primary, primaryTimeout, fallback, fallbackTimeout)
+}
+
+// race dials the primary addresses immediately and the fallback addresses
+// after the fallback delay, returning the first connection to succeed.
+func (d *dialer) race(
+	ctx context.Context,
+	network, port string,
+	primary []net.IP, primaryTimeout time.Duration,
+	fallback []net.IP, fallbackTimeout time.Duration,
+) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	startDial := func(ips []net.IP, timeout time.Duration, isPrimary bool) {
+		go func() {
+			conn, err := d.dialFamily(ctx, network, ips, port, timeout)
+			select {
+			case results <- dialResult{conn: conn, err: err, primary: isPrimary}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	fallbackDelay := d.options.FallbackDelay
+	if fallbackDelay <= 0 {
+		fallbackDelay = DefaultDialFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	startDial(primary, primaryTimeout, true)
+	fallbackStarted := false
+	var firstErr error
+	for pending := 1; ; {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				startDial(fallback, fallbackTimeout, false)
+			}
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if firstErr == nil || result.primary {
+				firstErr = result.err
+			}
+
+			// If the primary family failed quickly, don't wait for the timer
+			// before trying the fallback family.
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				startDial(fallback, fallbackTimeout, false)
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialFamily dials the provided addresses in order, returning the first
+// connection that succeeds. The timeout, if non-zero, bounds the total time
+// spent on all of the addresses.
+func (d *dialer) dialFamily(
+	ctx context.Context,
+	network string,
+	ips []net.IP,
+	port string,
+	timeout time.Duration,
+) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	netDialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	err := errors.New("no addresses to dial")
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = netDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (d *dialer) timeoutFor(ip net.IP) time.Duration {
+	if ip.To4() != nil {
+		return d.options.IPv4Timeout
+	}
+	return d.options.IPv6Timeout
+}
@@ -0,0 +1,87 @@
+package traffic
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+func TestDialerFallsBackFromUnreachableFamily(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	d := newDialer(DialOptions{
+		FallbackDelay: 50 * time.Millisecond,
+		IPv6Timeout:   5 * time.Second,
+	}, clock.Real)
+
+	// 192.0.2.1 is reserved for documentation (RFC 5737) and should never
+	// answer, standing in for an unreachable address in the preferred family.
+	start := time.Now()
+	conn, err := d.race(
+		context.Background(),
+		"tcp",
+		port,
+		[]net.IP{net.ParseIP("192.0.2.1")}, 5*time.Second,
+		[]net.IP{net.ParseIP("127.0.0.1")}, time.Second,
+	)
+	if err != nil {
+		t.Fatalf("Expected fallback connection to succeed: %v", err)
+	}
+	defer conn.Close()
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Fallback took too long: %v", elapsed)
+	}
+	if remote := conn.RemoteAddr().(*net.TCPAddr).IP.String(); remote != "127.0.0.1" {
+		t.Errorf("Expected connection to 127.0.0.1 but got %v", remote)
+	}
+}
+
+func TestDialerFamilyTimeout(t *testing.T) {
+	d := newDialer(DialOptions{IPv4Timeout: 100 * time.Millisecond}, clock.Real)
+
+	start := time.Now()
+	_, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if err == nil {
+		t.Fatalf("Expected dialing an unreachable address to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("IPv4 dial timeout was not respected: %v", elapsed)
+	}
+}
+
+func TestParseIPFamilyPreference(t *testing.T) {
+	for value, expected := range map[string]IPFamilyPreference{
+		"":     PreferAnyFamily,
+		"ipv4": PreferIPv4,
+		"ipv6": PreferIPv6,
+	} {
+		if preference, err := ParseIPFamilyPreference(value); err != nil {
+			t.Errorf("Unexpected error parsing '%v': %v", value, err)
+		} else if preference != expected {
+			t.Errorf("Expected '%v' to parse as '%v' but got '%v'", value, expected, preference)
+		}
+	}
+
+	if _, err := ParseIPFamilyPreference("ipv5"); err == nil {
+		t.Errorf("Expected an error for an unknown preference")
+	}
+}
@@ -0,0 +1,70 @@
+package traffic
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DuplicateHeaderPolicy determines how the relay handles request headers
+// which the client sent more than once. Servers disagree about how to
+// interpret repeated headers, so if the relay and the target disagree, a
+// client can show plugins one value and the target another. Normalizing
+// repeated headers before plugins run ensures that both see the same value.
+type DuplicateHeaderPolicy string
+
+const (
+	// KeepDuplicateHeaders relays repeated headers as they were sent.
+	KeepDuplicateHeaders DuplicateHeaderPolicy = ""
+	// FoldDuplicateHeaders combines repeated headers into one, separating
+	// their values with commas (RFC 9110 section 5.3), or, for Cookie, with
+	// semicolons (RFC 6265 section 5.4).
+	FoldDuplicateHeaders DuplicateHeaderPolicy = "fold"
+	// FirstDuplicateHeader keeps only the first of the repeated headers.
+	FirstDuplicateHeader DuplicateHeaderPolicy = "first"
+	// LastDuplicateHeader keeps only the last of the repeated headers.
+	LastDuplicateHeader DuplicateHeaderPolicy = "last"
+	// RejectDuplicateHeaders responds to requests with repeated headers with
+	// a 400.
+	RejectDuplicateHeaders DuplicateHeaderPolicy = "reject"
+)
+
+// ParseDuplicateHeaderPolicy converts a configuration value into a
+// DuplicateHeaderPolicy.
+func ParseDuplicateHeaderPolicy(value string) (DuplicateHeaderPolicy, error) {
+	switch policy := DuplicateHeaderPolicy(value); policy {
+	case KeepDuplicateHeaders, FoldDuplicateHeaders, FirstDuplicateHeader, LastDuplicateHeader, RejectDuplicateHeaders:
+		return policy, nil
+	default:
+		return KeepDuplicateHeaders, fmt.Errorf(`Unknown duplicate header policy "%v"; expected "fold", "first", "last", or "reject"`, value)
+	}
+}
+
+// apply normalizes the repeated headers in header according to the policy. It
+// returns an error naming a repeated header if the policy
+// rejects them.
+func (policy DuplicateHeaderPolicy) apply(header http.Header) error {
+	if policy == KeepDuplicateHeaders {
+		return nil
+	}
+	for name, values := range header {
+		if len(values) < 2 {
+			continue
+		}
+		switch policy {
+		case FoldDuplicateHeaders:
+			separator := ", "
+			if name == "Cookie" {
+				separator = "; "
+			}
+			header[name] = []string{strings.Join(values, separator)}
+		case FirstDuplicateHeader:
+			header[name] = values[:1]
+		case LastDuplicateHeader:
+			header[name] = values[len(values)-1:]
+		case RejectDuplicateHeaders:
+			return fmt.Errorf("Header %v was sent %v times", name, len(values))
+		}
+	}
+	return nil
+}
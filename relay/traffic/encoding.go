@@ -8,6 +8,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Encoding int
@@ -16,8 +19,25 @@ const (
 	Unsupported Encoding = iota
 	Identity
 	Gzip
+	Brotli
+	Zstd
 )
 
+// HeaderValue returns the Content-Encoding header value corresponding to this
+// encoding. Identity corresponds to an absent header, so it returns "".
+func (encoding Encoding) HeaderValue() string {
+	switch encoding {
+	case Gzip:
+		return "gzip"
+	case Brotli:
+		return "br"
+	case Zstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
 func GetContentEncoding(request *http.Request) (Encoding, error) {
 	// NOTE: This is a workaround for a bug in post-Go 1.17. See golang.org/issue/25192.
 	// Our algorithm differs from the logic of AllowQuerySemicolons by replacing semicolons with encoded semicolons instead
@@ -37,9 +57,19 @@ func GetContentEncoding(request *http.Request) (Encoding, error) {
 		encoding = request.Header.Get("Content-Encoding")
 	}
 
+	return ParseEncoding(encoding)
+}
+
+// ParseEncoding returns the Encoding corresponding to a Content-Encoding
+// header value.
+func ParseEncoding(encoding string) (Encoding, error) {
 	switch encoding {
 	case "gzip":
 		return Gzip, nil
+	case "br":
+		return Brotli, nil
+	case "zstd":
+		return Zstd, nil
 	case "":
 		return Identity, nil
 	default:
@@ -47,19 +77,79 @@ func GetContentEncoding(request *http.Request) (Encoding, error) {
 	}
 }
 
+// MalformedBodyPolicy determines how the relay handles request bodies which
+// can't be decoded using their declared Content-Encoding, such as a body
+// labeled gzip which isn't valid gzip. Bodies are decoded before plugins run,
+// so the policy applies uniformly, regardless of which plugins are active.
+type MalformedBodyPolicy string
+
+const (
+	// RejectMalformedBodies responds to requests with malformed bodies with a
+	// 400. This is the default.
+	RejectMalformedBodies MalformedBodyPolicy = "reject"
+	// ForwardMalformedBodies relays malformed bodies to the target untouched,
+	// along with their Content-Encoding. Plugins can't process them, so they
+	// see an empty body.
+	ForwardMalformedBodies MalformedBodyPolicy = "forward"
+	// IdentityMalformedBodies treats malformed bodies as if they weren't
+	// encoded: the Content-Encoding is removed, and plugins and the target
+	// receive the body as is. This suits clients which mislabel plain bodies.
+	IdentityMalformedBodies MalformedBodyPolicy = "identity"
+)
+
+// ParseMalformedBodyPolicy converts a configuration value into a
+// MalformedBodyPolicy.
+func ParseMalformedBodyPolicy(value string) (MalformedBodyPolicy, error) {
+	switch policy := MalformedBodyPolicy(value); policy {
+	case RejectMalformedBodies, ForwardMalformedBodies, IdentityMalformedBodies:
+		return policy, nil
+	default:
+		return RejectMalformedBodies, fmt.Errorf(`Unknown malformed body policy "%v"; expected "reject", "forward", or "identity"`, value)
+	}
+}
+
 // WrapReader returns a wrapped request.Body for the encoding provided.
 func WrapReader(request *http.Request, encoding Encoding) (io.ReadCloser, error) {
 	if request.Body == nil {
 		return nil, nil
 	}
+	if encoding == Identity {
+		// If the content is not compressed, return the original request body
+		return request.Body, nil
+	}
+	return newDecoder(request.Body, encoding)
+}
 
+// newDecoder returns a reader which decodes the encoded data read from reader.
+func newDecoder(reader io.Reader, encoding Encoding) (io.ReadCloser, error) {
 	switch encoding {
 	case Gzip:
-		// Create a new gzip.Reader to decompress the request body
-		return gzip.NewReader(request.Body)
+		return gzip.NewReader(reader)
+	case Brotli:
+		return io.NopCloser(brotli.NewReader(reader)), nil
+	case Zstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
 	case Identity:
-		// If the content is not gzip-compressed, return the original request body
-		return request.Body, nil
+		return io.NopCloser(reader), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %v", encoding)
+	}
+}
+
+// newEncoder returns a writer which encodes the data written to it and writes
+// the result to writer. The encoded data is incomplete until it's closed.
+func newEncoder(writer io.Writer, encoding Encoding) (io.WriteCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewWriter(writer), nil
+	case Brotli:
+		return brotli.NewWriter(writer), nil
+	case Zstd:
+		return zstd.NewWriter(writer, zstd.WithZeroFrames(true))
 	default:
 		return nil, fmt.Errorf("unsupported encoding: %v", encoding)
 	}
@@ -83,6 +173,28 @@ func EncodeData(data []byte, encoding Encoding) ([]byte, error) {
 
 		compressedData := buf.Bytes()
 		return compressedData, nil
+	case Brotli:
+		var buf bytes.Buffer
+		writer := brotli.NewWriter(&buf)
+
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case Zstd:
+		// Zero frames ensure that even an empty body is encoded as a valid
+		// zstd frame, rather than as zero bytes.
+		encoder, err := zstd.NewWriter(nil, zstd.WithZeroFrames(true))
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+
+		return encoder.EncodeAll(data, nil), nil
 	case Identity:
 		return data, nil
 	default:
@@ -104,6 +216,16 @@ func DecodeData(data []byte, encoding Encoding) ([]byte, error) {
 		}
 
 		return decodedData, nil
+	case Brotli:
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	case Zstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+
+		return decoder.DecodeAll(data, nil)
 	case Identity:
 		return data, nil
 	default:
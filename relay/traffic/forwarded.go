@@ -0,0 +1,107 @@
+package traffic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// When the relay runs behind load balancers or other proxies, the address
+// which a request came from is the last proxy's, and the client's own is the
+// first in the X-Forwarded-For chain which those proxies built. Since clients
+// can send any X-Forwarded-For they like, the chain is only believed as far as
+// it was built by proxies in RelayOptions.TrustedProxies.
+//
+// Once TrustedProxies is configured, requests from a trusted proxy have their
+// RemoteAddr replaced by the client's address, as found in the chain, so that
+// plugins and logs see the real client, and the relay appends the proxy's
+// address to the chain it forwards to the target. Requests from anywhere else
+// have their X-Forwarded-For replaced with their own address.
+
+// forwardedPeerKey is the context key under which the address of the peer
+// which sent a request, before RemoteAddr was replaced, is stored.
+type forwardedPeerKey struct{}
+
+// resolveClientAddress finds the client which sent a request through any
+// trusted proxies, returning the request to handle in its place. Requests
+// which were already resolved, like those sent over the websocket bridge, are
+// returned as they are.
+func (handler *Handler) resolveClientAddress(request *http.Request) *http.Request {
+	if len(handler.config.TrustedProxies) == 0 {
+		return request
+	}
+	if _, ok := request.Context().Value(forwardedPeerKey{}).(netip.Addr); ok {
+		return request
+	}
+	peer, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		return request
+	}
+	peerAddr := peer.Addr().Unmap()
+
+	var chain []string
+	if handler.trustsProxy(peerAddr) {
+		chain = forwardedForChain(request.Header)
+		// The client is the last address which wasn't added by a trusted
+		// proxy, reading back from the proxy which sent the request.
+		client := peerAddr
+		for i := len(chain) - 1; i >= 0 && handler.trustsProxy(client); i-- {
+			addr, err := netip.ParseAddr(chain[i])
+			if err != nil {
+				break
+			}
+			client = addr.Unmap()
+		}
+		if client != peerAddr {
+			request.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		}
+	}
+
+	request.Header.Del("X-Forwarded-For")
+	if len(chain) > 0 {
+		request.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	return request.WithContext(context.WithValue(request.Context(), forwardedPeerKey{}, peerAddr))
+}
+
+// trustsProxy returns true if addr is one of the trusted proxies.
+func (handler *Handler) trustsProxy(addr netip.Addr) bool {
+	for _, prefix := range handler.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedForChain returns the addresses in a request's X-Forwarded-For
+// headers, in order.
+func forwardedForChain(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	}
+	return chain
+}
+
+// addForwardedFor adds the X-Forwarded-For and X-Forwarded-Port headers for
+// a request whose client address was resolved, appending the peer which sent
+// it to the chain. It returns false if the request wasn't resolved.
+func addForwardedFor(request *http.Request) bool {
+	peer, ok := request.Context().Value(forwardedPeerKey{}).(netip.Addr)
+	if !ok {
+		return false
+	}
+	chain := append(forwardedForChain(request.Header), peer.String())
+	request.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	if _, port, err := net.SplitHostPort(request.RemoteAddr); err == nil && port != "0" {
+		request.Header.Add("X-Forwarded-Port", port)
+	}
+	return true
+}
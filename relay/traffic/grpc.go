@@ -0,0 +1,199 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// gRPC requests and responses carry a stream of length-prefixed messages,
+// rather than a single body. Each message is preceded by a 5-byte header: a
+// flag which is 1 if the message is compressed, and the message's length as a
+// big-endian uint32. Compressed messages use the algorithm named by the
+// grpc-encoding header of the request or response which carries them.
+//
+// When any active plugin implements GrpcPlugin, the relay splits the request
+// and response bodies of gRPC calls into messages as they're streamed, and
+// passes each message to the plugins, so that long-lived streaming calls
+// needn't be buffered. The gRPC status, which the target sends in the
+// response's trailers, is relayed to the client along with them.
+
+// GrpcMessage is a single message sent in a gRPC call. Payload is always
+// uncompressed, and is typically an encoded protobuf message.
+type GrpcMessage struct {
+	// ClientToTarget for the messages of the request, and TargetToClient for
+	// those of the response.
+	Direction WebsocketDirection
+	Payload   []byte
+}
+
+// GrpcPlugin is an optional interface which plugins may implement to inspect
+// and rewrite the individual messages of gRPC calls. Messages compressed using
+// a grpc-encoding the relay doesn't support are relayed unchanged, without
+// being passed to plugins.
+//
+// Plugins still see gRPC requests in HandleRequest, before any messages are
+// sent; they shouldn't read or replace the body of a gRPC request there.
+type GrpcPlugin interface {
+	// HandleGrpcMessage is invoked for each message. The request is the gRPC
+	// call's request, after all plugins have handled it. Plugins may modify
+	// message.Payload.
+	HandleGrpcMessage(request *http.Request, message *GrpcMessage)
+}
+
+// grpcMessageHeaderSize is the length of the prefix of each gRPC message.
+const grpcMessageHeaderSize = 5
+
+var errGrpcMessageTooLarge = errors.New("gRPC message exceeds maximum size")
+
+// IsGrpcRequest returns true if the request is a gRPC call, as identified by
+// its Content-Type. Plugins which handle request bodies should leave those of
+// gRPC calls to HandleGrpcMessage.
+func IsGrpcRequest(request *http.Request) bool {
+	return isGrpcContentType(request.Header.Get("Content-Type"))
+}
+
+// isGrpcContentType returns true for application/grpc, and for its variants
+// which name the message format, like application/grpc+proto. gRPC-Web, which
+// carries trailers in the body, isn't included.
+func isGrpcContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// parseGrpcEncoding returns the Encoding corresponding to a grpc-encoding
+// header value. gRPC names the absence of compression "identity".
+func parseGrpcEncoding(value string) Encoding {
+	if value == "identity" {
+		return Identity
+	}
+	encoding, err := ParseEncoding(value)
+	if err != nil {
+		return Unsupported
+	}
+	return encoding
+}
+
+// grpcMessageReader reads the gRPC messages from a body, passes each through
+// the plugins, and returns them framed once more. Messages are read one at a
+// time, as the reader is read, so calls are never buffered in full.
+type grpcMessageReader struct {
+	source         io.ReadCloser
+	request        *http.Request
+	plugins        []GrpcPlugin
+	direction      WebsocketDirection
+	encoding       Encoding
+	maxMessageSize int64
+
+	pending bytes.Buffer // The framed messages which haven't been read yet.
+	err     error        // The error which ended the source, once it has.
+}
+
+func newGrpcMessageReader(
+	source io.ReadCloser,
+	request *http.Request,
+	plugins []GrpcPlugin,
+	direction WebsocketDirection,
+	encoding string,
+	maxMessageSize int64,
+) *grpcMessageReader {
+	return &grpcMessageReader{
+		source:         source,
+		request:        request,
+		plugins:        plugins,
+		direction:      direction,
+		encoding:       parseGrpcEncoding(encoding),
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+func (reader *grpcMessageReader) Read(p []byte) (int, error) {
+	for reader.pending.Len() == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		reader.err = reader.next()
+	}
+	return reader.pending.Read(p)
+}
+
+func (reader *grpcMessageReader) Close() error {
+	return reader.source.Close()
+}
+
+// next reads the next message from the source and appends it, once plugins
+// have handled it, to the pending output. It returns io.EOF once the source
+// ends between messages.
+func (reader *grpcMessageReader) next() error {
+	var header [grpcMessageHeaderSize]byte
+	if _, err := io.ReadFull(reader.source, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("truncated gRPC message header: %w", err)
+		}
+		return err
+	}
+	compressed := header[0]&0x1 != 0
+	length := binary.BigEndian.Uint32(header[1:])
+	if reader.maxMessageSize > 0 && int64(length) > reader.maxMessageSize {
+		return errGrpcMessageTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader.source, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("truncated gRPC message: %w", err)
+	}
+
+	if compressed && (reader.encoding == Identity || reader.encoding == Unsupported) {
+		// The message can't be decompressed, so it's relayed as it is.
+		reader.pending.Write(header[:])
+		reader.pending.Write(payload)
+		return nil
+	}
+
+	message := &GrpcMessage{Direction: reader.direction, Payload: payload}
+	if compressed {
+		decoded, err := DecodeData(payload, reader.encoding)
+		if err != nil {
+			return fmt.Errorf("error decompressing gRPC message: %w", err)
+		}
+		message.Payload = decoded
+	}
+	for _, plugin := range reader.plugins {
+		plugin.HandleGrpcMessage(reader.request, message)
+	}
+	if compressed {
+		encoded, err := EncodeData(message.Payload, reader.encoding)
+		if err != nil {
+			return fmt.Errorf("error compressing gRPC message: %w", err)
+		}
+		message.Payload = encoded
+	}
+
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message.Payload)))
+	reader.pending.Write(header[:])
+	reader.pending.Write(message.Payload)
+	return nil
+}
+
+// copyResponseTrailers relays the trailers which the target sent after the
+// response body, such as the grpc-status of a gRPC call. It must be called
+// once the body has been read in full and written to the client.
+func copyResponseTrailers(clientResponse http.ResponseWriter, targetResponse *http.Response) {
+	for key, values := range targetResponse.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		clientResponse.Header()[http.TrailerPrefix+key] = values
+	}
+}
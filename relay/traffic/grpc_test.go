@@ -0,0 +1,105 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func (upperCasePlugin) HandleGrpcMessage(request *http.Request, message *GrpcMessage) {
+	message.Payload = bytes.ToUpper(message.Payload)
+}
+
+// appendGrpcMessage appends a framed gRPC message to data.
+func appendGrpcMessage(data []byte, compressed bool, payload []byte) []byte {
+	var flag byte
+	if compressed {
+		flag = 1
+	}
+	data = append(data, flag)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+	return append(data, payload...)
+}
+
+func TestGrpcMessageReader(t *testing.T) {
+	gzipped, err := EncodeData([]byte("compressed"), Gzip)
+	if err != nil {
+		t.Fatalf("Error compressing message: %v", err)
+	}
+
+	testCases := []struct {
+		desc     string
+		encoding string
+		input    []byte
+		expected []byte
+	}{
+		{
+			desc:     "Messages are handled one by one",
+			input:    appendGrpcMessage(appendGrpcMessage(nil, false, []byte("hello")), false, []byte("world")),
+			expected: appendGrpcMessage(appendGrpcMessage(nil, false, []byte("HELLO")), false, []byte("WORLD")),
+		},
+		{
+			desc:     "Empty messages are relayed",
+			input:    appendGrpcMessage(nil, false, nil),
+			expected: appendGrpcMessage(nil, false, nil),
+		},
+		{
+			desc:     "Compressed messages are decompressed for plugins",
+			encoding: "gzip",
+			input:    appendGrpcMessage(nil, true, gzipped),
+		},
+		{
+			desc:     "Messages in unsupported encodings are relayed unchanged",
+			encoding: "snappy",
+			input:    appendGrpcMessage(nil, true, []byte("opaque")),
+			expected: appendGrpcMessage(nil, true, []byte("opaque")),
+		},
+	}
+
+	for _, testCase := range testCases {
+		reader := newGrpcMessageReader(io.NopCloser(bytes.NewReader(testCase.input)), nil,
+			[]GrpcPlugin{upperCasePlugin{}}, ClientToTarget, testCase.encoding, 0)
+		output, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading messages: %v", testCase.desc, err)
+			continue
+		}
+
+		if testCase.expected != nil {
+			if !bytes.Equal(output, testCase.expected) {
+				t.Errorf("Test '%v': Expected %q but got %q", testCase.desc, testCase.expected, output)
+			}
+			continue
+		}
+
+		// Compressed output needn't match byte for byte.
+		if len(output) < grpcMessageHeaderSize || output[0] != 1 {
+			t.Errorf("Test '%v': Expected a compressed message but got %q", testCase.desc, output)
+			continue
+		}
+		if decoded, err := DecodeData(output[grpcMessageHeaderSize:], Gzip); err != nil {
+			t.Errorf("Test '%v': Error decompressing message: %v", testCase.desc, err)
+		} else if string(decoded) != "COMPRESSED" {
+			t.Errorf("Test '%v': Expected message %q but got %q", testCase.desc, "COMPRESSED", decoded)
+		}
+	}
+}
+
+func TestGrpcMessageReaderErrors(t *testing.T) {
+	truncated := appendGrpcMessage(nil, false, []byte("hello"))
+	truncated = truncated[:len(truncated)-2]
+
+	reader := newGrpcMessageReader(io.NopCloser(bytes.NewReader(truncated)), nil, nil, ClientToTarget, "", 0)
+	if _, err := io.ReadAll(reader); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected truncated message to be rejected but got: %v", err)
+	}
+
+	oversized := appendGrpcMessage(nil, false, []byte("1234567890"))
+	reader = newGrpcMessageReader(io.NopCloser(bytes.NewReader(oversized)), nil, nil, ClientToTarget, "", 8)
+	if _, err := io.ReadAll(reader); err != errGrpcMessageTooLarge {
+		t.Errorf("Expected oversized message to be rejected but got: %v", err)
+	}
+}
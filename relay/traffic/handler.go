@@ -1,48 +1,326 @@
 package traffic
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/immersa-co/relay-core/relay/accesslog"
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/journal"
+	"github.com/immersa-co/relay-core/relay/logging"
+	"github.com/immersa-co/relay-core/relay/metrics"
 	"github.com/immersa-co/relay-core/relay/version"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const RelayVersionHeaderName = "X-Relay-Version"
 
-var logger = log.New(os.Stdout, "[relay-traffic] ", 0)
+// ResponseTruncatedHeaderName is added to responses which were truncated
+// because they exceeded RelayOptions.MaxResponseSize.
+const ResponseTruncatedHeaderName = "X-Relay-Response-Truncated"
+
+var logger = logging.New("relay-traffic")
 
 // Handler handles HTTP traffic sent to the relay. It handles the core relaying
 // process itself, and can be extended using plugins to add additional
 // functionality.
 type Handler struct {
-	config    *RelayOptions
-	plugins   []Plugin
-	transport *http.Transport
+	config            *RelayOptions
+	plugins           []Plugin
+	messagePlugins    []WsPlugin
+	grpcPlugins       []GrpcPlugin
+	eventPlugins      []ServerSentEventPlugin
+	recorderPlugins   []WebsocketRecorderPlugin
+	completionPlugins []CompletionPlugin
+	responsePlugins   []ResponsePlugin
+	bufferResponses   bool // True if a response plugin needs the response body.
+	clock             clock.Clock
+	accessLog         *accesslog.Logger
+	journal           *journal.Journal
+	metrics           *metrics.Registry
+	pluginMetrics     []*metrics.PluginMetrics // Parallel to plugins.
+	dialer            *dialer
+	transport         *http.Transport
+	mirror            *mirror // Nil unless a mirror target is configured.
+	spooler           *spooler
+	deadLetters       *deadLetters // Nil unless dead letters are configured.
+	audit             *auditLog    // Nil unless the audit log is configured.
+	recorder          *Recorder    // Nil unless recording is configured.
+	tracer            trace.Tracer // Nil unless tracing is configured.
 }
 
 func NewHandler(config *RelayOptions, trafficPlugins []Plugin) *Handler {
+	relayClock := clock.OrReal(config.Clock)
+	dialer := newDialer(config.Dial, relayClock)
+
+	var accessLog *accesslog.Logger
+	if config.AccessLog != nil {
+		accessLog = accesslog.NewLogger(config.AccessLog)
+	}
+
+	metricsRegistry := config.Metrics
+	if metricsRegistry == nil {
+		metricsRegistry = metrics.NewRegistry()
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:   targetTLSConfig(config),
+		ForceAttemptHTTP2: config.TargetHTTP2,
+		Proxy:             upstreamProxy(config),
+		DialContext:       dialer.DialContext,
+		IdleConnTimeout:   2 * time.Second, // TODO set from configs
+	}
+
+	var messagePlugins []WsPlugin
+	var grpcPlugins []GrpcPlugin
+	var eventPlugins []ServerSentEventPlugin
+	var recorderPlugins []WebsocketRecorderPlugin
+	var responsePlugins []ResponsePlugin
+	var completionPlugins []CompletionPlugin
+	bufferResponses := false
+	var pluginMetrics []*metrics.PluginMetrics
+	for _, wrappedPlugin := range trafficPlugins {
+		// Conditional plugins' optional interfaces are those of the plugin
+		// they wrap, and their hooks are wrapped in turn.
+		trafficPlugin, condition := UnwrapPlugin(wrappedPlugin), pluginCondition(wrappedPlugin)
+		metricsForPlugin := metricsRegistry.Plugin(trafficPlugin.Name())
+		pluginMetrics = append(pluginMetrics, metricsForPlugin)
+		if metricsPlugin, ok := trafficPlugin.(MetricsPlugin); ok {
+			metricsPlugin.SetPluginMetrics(metricsForPlugin)
+		}
+		if clockPlugin, ok := trafficPlugin.(ClockPlugin); ok {
+			clockPlugin.SetClock(relayClock)
+		}
+		if targetPlugin, ok := trafficPlugin.(TargetPlugin); ok {
+			targetPlugin.SetTarget(&url.URL{Scheme: config.TargetScheme, Host: config.TargetHost})
+		}
+		if transportPlugin, ok := trafficPlugin.(TransportPlugin); ok {
+			transportPlugin.SetTransport(transport)
+		}
+
+		if messagePlugin, ok := trafficPlugin.(WsPlugin); ok {
+			if condition != nil {
+				messagePlugin = conditionalMessagePlugin{messagePlugin, condition}
+			}
+			messagePlugins = append(messagePlugins, messagePlugin)
+		}
+		if grpcPlugin, ok := trafficPlugin.(GrpcPlugin); ok {
+			if condition != nil {
+				grpcPlugin = conditionalGrpcPlugin{grpcPlugin, condition}
+			}
+			grpcPlugins = append(grpcPlugins, grpcPlugin)
+		}
+		if eventPlugin, ok := trafficPlugin.(ServerSentEventPlugin); ok {
+			if condition != nil {
+				eventPlugin = conditionalEventPlugin{eventPlugin, condition}
+			}
+			eventPlugins = append(eventPlugins, eventPlugin)
+		}
+		if recorderPlugin, ok := trafficPlugin.(WebsocketRecorderPlugin); ok {
+			if condition != nil {
+				recorderPlugin = conditionalRecorderPlugin{recorderPlugin, condition}
+			}
+			recorderPlugins = append(recorderPlugins, recorderPlugin)
+		}
+		if completionPlugin, ok := trafficPlugin.(CompletionPlugin); ok {
+			if condition != nil {
+				completionPlugin = conditionalCompletionPlugin{completionPlugin, condition}
+			}
+			completionPlugins = append(completionPlugins, completionPlugin)
+		}
+		if responsePlugin, ok := trafficPlugin.(ResponsePlugin); ok {
+			if condition != nil {
+				responsePlugin = conditionalResponsePlugin{responsePlugin, condition}
+			}
+			responsePlugins = append(responsePlugins, responsePlugin)
+			if bodyPlugin, ok := trafficPlugin.(ResponseBodyPlugin); ok && bodyPlugin.NeedsResponseBody() {
+				bufferResponses = true
+			}
+		}
+	}
+
+	var requestMirror *mirror
+	if config.Mirror.enabled() {
+		requestMirror = newMirror(config.Mirror, transport, metricsRegistry)
+	}
+
+	var tracer trace.Tracer
+	if config.TracerProvider != nil {
+		tracer = config.TracerProvider.Tracer(tracerName)
+	}
+
 	return &Handler{
-		config:  config,
-		plugins: trafficPlugins,
-		transport: &http.Transport{
-			TLSClientConfig: &tls.Config{},
-			Proxy:           http.ProxyFromEnvironment,
-			IdleConnTimeout: 2 * time.Second, // TODO set from configs
-		},
+		config:            config,
+		plugins:           trafficPlugins,
+		messagePlugins:    messagePlugins,
+		grpcPlugins:       grpcPlugins,
+		eventPlugins:      eventPlugins,
+		recorderPlugins:   recorderPlugins,
+		completionPlugins: completionPlugins,
+		responsePlugins:   responsePlugins,
+		bufferResponses:   bufferResponses,
+		clock:             relayClock,
+		accessLog:         accessLog,
+		journal:           config.Journal,
+		metrics:           metricsRegistry,
+		pluginMetrics:     pluginMetrics,
+		dialer:            dialer,
+		transport:         transport,
+		mirror:            requestMirror,
+		spooler:           newSpooler(config),
+		deadLetters:       newDeadLetters(config.DeadLetters, metricsRegistry),
+		audit:             newAuditLog(config.Audit),
+		recorder:          config.Recorder,
+		tracer:            tracer,
+	}
+}
+
+// Metrics returns the registry in which the handler records metrics.
+func (handler *Handler) Metrics() *metrics.Registry {
+	return handler.metrics
+}
+
+// Close stops the handler's background work: the mirror target's workers
+// exit once they've sent the copies already queued, and idle connections to
+// the target are closed. It should be called once the handler is no longer
+// handling requests; any it handles later aren't mirrored. Options shared with
+// other handlers, like the recorder and dead letters, are left open.
+func (handler *Handler) Close() error {
+	if handler.mirror != nil {
+		handler.mirror.close()
 	}
+	handler.transport.CloseIdleConnections()
+	return nil
 }
 
 func (handler *Handler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	request = handler.resolveClientAddress(request)
+	if handler.isBridgeUpgrade(request) {
+		// Each request sent over the bridge is handled by ServeHTTP in turn.
+		handler.serveBridge(response, request)
+		return
+	}
+
+	serviced := false
+	start := handler.clock.Now()
+	requestID := newRequestID()
+	tags := NewTags()
+	annotations := NewAnnotations()
+
+	if handler.tracer != nil {
+		var span trace.Span
+		request, span = handler.startRequestSpan(request)
+		tracedResponse := &recordingResponseWriter{ResponseWriter: response}
+		response = tracedResponse
+		defer func() {
+			endRequestSpan(span, tracedResponse.statusOrDefault(), serviced)
+		}()
+	}
+
+	var pluginDecisions []journal.PluginDecision
+
+	// Plugins' decisions are traced for debug headers and the audit log.
+	var trace *debugTrace
+	var auditSnapshot *auditSnapshot
+	if handler.audit != nil {
+		trace = &debugTrace{tags: tags}
+		auditSnapshot = snapshotForAudit(request, handler.clock.Now())
+	}
+
+	if handler.accessLog != nil || handler.journal != nil || len(handler.completionPlugins) > 0 || handler.audit != nil {
+		recordingResponse := &recordingResponseWriter{ResponseWriter: response}
+		host := request.Host
+		originalURL := *request.URL
+		path := request.URL.Path
+		requestBytes := request.ContentLength
+		defer func() {
+			if handler.accessLog != nil {
+				handler.logAccess(recordingResponse, request, start, path, requestBytes, serviced, tags)
+			}
+			if handler.audit != nil {
+				handler.audit.record(auditSnapshot, request, trace, recordingResponse.statusOrDefault())
+			}
+			if len(handler.completionPlugins) > 0 {
+				completion := &RequestCompletion{
+					Request:       request,
+					OriginalURL:   &originalURL,
+					OriginalHost:  host,
+					Start:         start,
+					Duration:      handler.clock.Since(start),
+					Status:        recordingResponse.statusOrDefault(),
+					RequestBytes:  requestBytes,
+					ResponseBytes: recordingResponse.written,
+					Serviced:      serviced,
+					Tags:          tags.List(),
+					ID:            requestID,
+					Route:         handler.config.Route,
+					Annotations:   annotations.Map(),
+				}
+				for _, completionPlugin := range handler.completionPlugins {
+					completionPlugin.HandleCompletion(completion)
+				}
+			}
+			if handler.journal != nil {
+				entry := journal.Entry{
+					Time:     start,
+					Method:   request.Method,
+					Host:     host,
+					Path:     path,
+					Status:   recordingResponse.statusOrDefault(),
+					Duration: journal.Duration(handler.clock.Since(start)),
+					Serviced: serviced,
+					Plugins:  pluginDecisions,
+					Tags:     tags.List(),
+				}
+				// Dump the journal if handling the request panicked, then let
+				// the panic continue on to net/http as usual.
+				if panicValue := recover(); panicValue != nil {
+					entry.Panic = fmt.Sprint(panicValue)
+					handler.journal.Record(entry)
+					if panicValue != http.ErrAbortHandler {
+						handler.dumpJournal(panicValue)
+					}
+					panic(panicValue)
+				}
+				handler.journal.Record(entry)
+			}
+		}()
+		response = recordingResponse
+	}
+
+	if handler.debugHeadersRequested(request) {
+		if trace == nil {
+			trace = &debugTrace{tags: tags}
+		}
+		response = &debugResponseWriter{ResponseWriter: response, trace: trace}
+	}
+
+	if request.Body != nil && request.Body != http.NoBody && request.ContentLength >= 0 {
+		handler.metrics.ObserveRequestBodySize(request.ContentLength)
+	}
+
+	if err := handler.config.DuplicateHeaders.apply(request.Header); err != nil {
+		logger.Printf("%s %s %s: rejected: %s", request.Method, request.Host, request.URL, err)
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Drop all cookies; because the relay generally runs in a first-party
 	// context, the risk of receiving cookies intended for other services is
 	// high, so relaying them is a potential privacy and security risk. (In
@@ -65,47 +343,212 @@ func (handler *Handler) ServeHTTP(response http.ResponseWriter, request *http.Re
 		return
 	}
 
-	if err := handler.prepareRequestBody(request, encoding); err != nil {
-		http.Error(response, fmt.Sprintf("Error setting up clientRequest body reader: %s", err), 500)
+	encoding, untouchedBody, ok := handler.decodeRequestBody(response, request, encoding)
+	if !ok {
 		request.Body = http.NoBody
 		return
 	}
+	if decodedBody, ok := request.Body.(*BodyReader); ok {
+		defer decodedBody.release()
+		// Plugins see the length of the decoded body.
+		setRequestLength(request, decodedBody.Size())
+	}
+	if untouchedBody != nil {
+		defer untouchedBody.release()
+	}
+	pluginBody, pluginBodyLength := request.Body, request.ContentLength
 
-	serviced := false
-	for _, trafficPlugin := range handler.plugins {
-		if trafficPlugin.HandleRequest(response, request, RequestInfo{
+	requestInfo := func() RequestInfo {
+		return RequestInfo{
+			ID:                    requestID,
+			Route:                 handler.config.Route,
+			Start:                 start,
 			OriginalCookieHeaders: originalCookieHeaders,
 			OriginalURL:           &originalURL,
 			Serviced:              serviced,
-		}) {
+			Tags:                  tags,
+			Annotations:           annotations,
+		}
+	}
+	for i, trafficPlugin := range handler.plugins {
+		if condition := pluginCondition(trafficPlugin); condition != nil {
+			if !condition.Matches(request) {
+				if trace != nil {
+					trace.skip(trafficPlugin.Name())
+				}
+				continue
+			}
+			trafficPlugin = UnwrapPlugin(trafficPlugin)
+		}
+
+		var pluginStart time.Time
+		if handler.journal != nil {
+			pluginStart = handler.clock.Now()
+		}
+		var snapshot *requestSnapshot
+		if trace != nil {
+			snapshot = trace.start(trafficPlugin.Name(), request)
+		}
+		endPluginSpan := handler.startPluginSpan(request, trafficPlugin)
+		pluginServiced := trafficPlugin.HandleRequest(response, request, requestInfo())
+		endPluginSpan(pluginServiced)
+		handler.pluginMetrics[i].RequestHandled(pluginServiced)
+		if trace != nil {
+			trace.finish(pluginServiced, snapshot, request)
+		}
+		if handler.journal != nil {
+			pluginDecisions = append(pluginDecisions, journal.PluginDecision{
+				Plugin:   trafficPlugin.Name(),
+				Serviced: pluginServiced,
+				Duration: journal.Duration(handler.clock.Since(pluginStart)),
+			})
+		}
+		if pluginServiced {
 			serviced = true
 		}
 	}
 
-	if handler.HandleRequest(response, request, serviced, encoding) {
+	if untouchedBody != nil {
+		request.Body = untouchedBody
+	}
+	reconcileRequestLength(request, pluginBody, pluginBodyLength)
+	if handler.HandleRequest(response, request, requestInfo(), encoding) {
 		serviced = true
 	}
 
+	tagSuffix := ""
+	if tags.Len() > 0 {
+		tagSuffix = fmt.Sprintf(" [%v]", tags)
+	}
+
 	if serviced {
-		logger.Printf("%s %s %s: serviced", request.Method, request.Host, request.URL)
+		logger.Printf("%s %s %s: serviced%s", request.Method, request.Host, request.URL, tagSuffix)
 	} else {
-		logger.Printf("%s %s %s: not serviced", request.Method, request.Host, request.URL)
+		logger.Printf("%s %s %s: not serviced%s", request.Method, request.Host, request.URL, tagSuffix)
 		http.NotFound(response, request)
 	}
 }
 
-// prepareRequestBody wraps the request Body with a reader that will decode the content if necessary.
-func (handler *Handler) prepareRequestBody(clientRequest *http.Request, encoding Encoding) error {
-	if reader, err := WrapReader(clientRequest, encoding); err != nil {
-		return err
-	} else if reader != nil && reader != http.NoBody {
-		clientRequest.Body = reader
+// logAccess writes an access log entry for a request once it's been handled.
+func (handler *Handler) logAccess(
+	response *recordingResponseWriter,
+	request *http.Request,
+	start time.Time,
+	path string,
+	requestBytes int64,
+	serviced bool,
+	tags *Tags,
+) {
+	entry := accesslog.Entry{
+		Time:          start,
+		Method:        request.Method,
+		Host:          request.Host,
+		Path:          path,
+		Status:        response.statusOrDefault(),
+		RequestBytes:  requestBytes,
+		ResponseBytes: response.written,
+		Duration:      handler.clock.Since(start),
+		Serviced:      serviced,
+		Tags:          tags.List(),
 	}
-	return nil
+	handler.accessLog.Log(&entry)
 }
 
-func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, clientRequest *http.Request, serviced bool, encoding Encoding) bool {
-	if serviced {
+// newRequestID returns a random ID for a request, as 32 hex digits.
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// dumpJournal writes the request journal to disk after a request handler
+// panicked, logging where it was written along with the panic's stack trace.
+func (handler *Handler) dumpJournal(panicValue any) {
+	path, err := handler.journal.Dump(handler.clock.Now())
+	if err != nil {
+		logger.Errorf("Panic while handling request: %v; error dumping request journal: %v\n%s", panicValue, err, debug.Stack())
+		return
+	}
+	logger.Errorf("Panic while handling request: %v; request journal dumped to %v\n%s", panicValue, path, debug.Stack())
+}
+
+// decodeRequestBody replaces an encoded request body with its decoded
+// contents, so that plugins see plaintext. Decoding the whole body before
+// plugins run means that a malformed body is detected before any plugin reads
+// it, and is handled according to the MalformedBodies policy. If spooling is
+// enabled, plain bodies are buffered too, so that plugins always receive a
+// BodyReader.
+//
+// It returns the encoding with which the body should be relayed and, if the
+// body should be relayed untouched, the body; it returns false if it responded
+// to the client. Any BodyReader it creates is left in the request, or
+// returned, for the caller to release.
+func (handler *Handler) decodeRequestBody(response http.ResponseWriter, clientRequest *http.Request, encoding Encoding) (Encoding, *BodyReader, bool) {
+	if clientRequest.Body == nil || clientRequest.Body == http.NoBody {
+		return encoding, nil, true
+	}
+	if encoding == Identity && !handler.spooler.enabled() {
+		// Plain bodies are streamed unless they're to be spooled.
+		return encoding, nil, true
+	}
+
+	encodedBody, err := handler.spooler.buffer(clientRequest.Body)
+	if err != nil {
+		handler.bodyError(response, err)
+		return encoding, nil, false
+	}
+	if encoding == Identity {
+		clientRequest.Body = encodedBody
+		return encoding, nil, true
+	}
+
+	decodedBody, err := handler.spooler.decode(encodedBody.Reopen(), encoding)
+	if err == nil {
+		encodedBody.release()
+		clientRequest.Body = decodedBody
+		return encoding, nil, true
+	} else if errors.Is(err, errBodyTooLarge) || errors.As(err, new(*fs.PathError)) {
+		encodedBody.release()
+		handler.bodyError(response, err)
+		return encoding, nil, false
+	}
+
+	handler.metrics.MalformedRequestBody(encoding.HeaderValue())
+	switch handler.config.MalformedBodies {
+	case ForwardMalformedBodies:
+		logger.Printf("Forwarding malformed %v request body untouched: %s", encoding.HeaderValue(), err)
+		// The body is restored once plugins have run. It's relayed as is,
+		// rather than re-encoded.
+		clientRequest.Body = http.NoBody
+		return Identity, encodedBody, true
+	case IdentityMalformedBodies:
+		logger.Printf("Treating malformed %v request body as unencoded: %s", encoding.HeaderValue(), err)
+		clientRequest.Header.Del("Content-Encoding")
+		if query := clientRequest.URL.Query(); query.Has("ContentEncoding") {
+			query.Del("ContentEncoding")
+			clientRequest.URL.RawQuery = query.Encode()
+		}
+		clientRequest.Body = encodedBody
+		return Identity, nil, true
+	default:
+		encodedBody.release()
+		http.Error(response, fmt.Sprintf("Malformed %v request body: %s", encoding.HeaderValue(), err), http.StatusBadRequest)
+		return encoding, nil, false
+	}
+}
+
+// bodyError responds to a request whose body couldn't be buffered.
+func (handler *Handler) bodyError(response http.ResponseWriter, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		http.Error(response, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	logger.Errorf("Error buffering request body: %s", err)
+	http.Error(response, fmt.Sprintf("Error reading request body: %s", err), http.StatusInternalServerError)
+}
+
+func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, clientRequest *http.Request, info RequestInfo, encoding Encoding) bool {
+	if info.Serviced {
 		return false
 	}
 
@@ -114,60 +557,66 @@ func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, client
 		return true
 	}
 
-	handler.ensureBodyContentEncoding(clientRequest, encoding)
-	handler.addRelayHeaders(clientRequest)
+	if encodedBody := handler.ensureBodyContentEncoding(clientRequest, encoding); encodedBody != nil {
+		defer encodedBody.release()
+	}
+	AddRelayHeaders(clientRequest)
 
-	if clientRequest.Header.Get("Upgrade") == "websocket" {
+	if handler.config.DryRun {
+		return handler.handleDryRun(clientResponse, clientRequest)
+	} else if clientRequest.Header.Get("Upgrade") == "websocket" {
 		return handler.handleUpgrade(clientResponse, clientRequest)
 	} else {
-		return handler.handleHttp(clientResponse, clientRequest)
+		var comparison *mirrorComparison
+		if handler.mirror != nil {
+			comparison = handler.mirror.enqueue(clientRequest)
+		}
+		if len(handler.grpcPlugins) > 0 && IsGrpcRequest(clientRequest) {
+			// Plugins may change the length of each message.
+			clientRequest.Body = newGrpcMessageReader(clientRequest.Body, clientRequest, handler.grpcPlugins,
+				ClientToTarget, clientRequest.Header.Get("Grpc-Encoding"), handler.config.MaxBodySize)
+			setRequestLength(clientRequest, -1)
+		}
+		return handler.handleHttp(clientResponse, clientRequest, info, comparison)
 	}
 }
 
 // ensureBodyContentEncoding operates on the assumption that the downstream proxy target will be using the same
-// encoding as what the relay received and ensures we proxy the content encoded correctly.
-func (handler *Handler) ensureBodyContentEncoding(clientRequest *http.Request, encoding Encoding) {
+// encoding as what the relay received and ensures we proxy the content encoded correctly. It returns the encoded
+// body, which the caller should release once the request has been relayed.
+func (handler *Handler) ensureBodyContentEncoding(clientRequest *http.Request, encoding Encoding) *BodyReader {
 	switch encoding {
 	case Unsupported:
-		logger.Println("Error unsupported content-encoding")
-		return
+		logger.Errorf("Error unsupported content-encoding")
+		return nil
 	case Identity:
-		return
-	case Gzip:
-		servicedBody, err := io.ReadAll(clientRequest.Body)
-		if err != nil {
-			logger.Printf("Error reading request body: %s", err)
-			clientRequest.Body = http.NoBody
-			return
-		}
-
-		if encodedData, err := EncodeData(servicedBody, encoding); err != nil {
-			logger.Printf("Error encoding request body: %s", err)
-			clientRequest.Body = http.NoBody
-			return
-		} else {
-			servicedBody = encodedData
-		}
-
-		// If the length of the body has changed, we should update the
-		// Content-Length header too.
-		contentLength := int64(len(servicedBody))
-		if contentLength != clientRequest.ContentLength {
-			clientRequest.ContentLength = contentLength
-			clientRequest.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
-		}
+		return nil
+	}
 
-		clientRequest.Body = io.NopCloser(bytes.NewBuffer(servicedBody))
+	encodedBody, err := handler.spooler.encode(clientRequest.Body, encoding)
+	if err != nil {
+		logger.Errorf("Error encoding request body: %s", err)
+		clientRequest.Body = http.NoBody
+		return nil
 	}
 
+	clientRequest.Body = encodedBody
+	setRequestLength(clientRequest, encodedBody.Size())
+	return encodedBody
 }
 
-func (handler *Handler) addRelayHeaders(clientRequest *http.Request) {
-	// Add X-Forwarded-* headers
-	remoteAddrTokens := strings.Split(clientRequest.RemoteAddr, ":")
-	clientRequest.Header.Add("X-Forwarded-For", remoteAddrTokens[0])
-	if len(remoteAddrTokens) > 0 {
-		clientRequest.Header.Add("X-Forwarded-Port", remoteAddrTokens[1])
+// AddRelayHeaders adds the X-Forwarded-* and X-Relay-Version headers which the
+// relay sends to the target with each relayed request. Plugins which relay
+// requests themselves should call it before sending them.
+func AddRelayHeaders(clientRequest *http.Request) {
+	// Add X-Forwarded-* headers. Plugins may clear RemoteAddr to keep the
+	// client's address from being forwarded.
+	if clientRequest.RemoteAddr != "" && !addForwardedFor(clientRequest) {
+		remoteAddrTokens := strings.Split(clientRequest.RemoteAddr, ":")
+		clientRequest.Header.Add("X-Forwarded-For", remoteAddrTokens[0])
+		if len(remoteAddrTokens) > 1 {
+			clientRequest.Header.Add("X-Forwarded-Port", remoteAddrTokens[1])
+		}
 	}
 	clientRequest.Header.Add("X-Forwarded-Proto", strings.ToLower(strings.Split(clientRequest.Proto, "/")[0]))
 
@@ -175,67 +624,454 @@ func (handler *Handler) addRelayHeaders(clientRequest *http.Request) {
 	clientRequest.Header.Add(RelayVersionHeaderName, version.RelayRelease)
 }
 
-func (handler *Handler) handleHttp(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
-	targetResponse, err := handler.transport.RoundTrip(clientRequest)
+// handleDryRun responds with the request that would have been relayed to the
+// target, after every plugin has processed it, in HTTP/1.1 wire format. This
+// shows exactly how the relay's configuration transforms real client traffic.
+func (handler *Handler) handleDryRun(response http.ResponseWriter, clientRequest *http.Request) bool {
+	var preview bytes.Buffer
+	if err := clientRequest.Write(&preview); err != nil {
+		http.Error(response, fmt.Sprintf("Error previewing request: %v", err), http.StatusInternalServerError)
+		return true
+	}
+
+	response.Header().Set("Content-Type", "message/http")
+	response.Header().Set("Content-Length", strconv.Itoa(preview.Len()))
+	response.Write(preview.Bytes())
+	return true
+}
+
+// handleHttp relays the request to the target, and the target's response to
+// the client. If comparison is non-nil, the target's response is given to it
+// to compare with the mirror target's.
+func (handler *Handler) handleHttp(response http.ResponseWriter, clientRequest *http.Request, info RequestInfo, comparison *mirrorComparison) bool {
+	var readBody func() ([]byte, error)
+	if handler.deadLetters != nil || handler.recorder != nil {
+		readBody = preserveRequestBody(clientRequest)
+	}
+
+	requestStart := handler.clock.Now()
+	targetResponse, attempts, err := handler.roundTrip(clientRequest)
+	if handler.recorder != nil {
+		status := 0
+		if err == nil {
+			status = targetResponse.StatusCode
+		}
+		handler.recorder.record(clientRequest, readBody, requestStart, handler.clock.Since(requestStart), status, err)
+	}
+	if handler.deadLetters != nil && clientRequest.Context().Err() == nil {
+		// Requests which the client gave up on weren't necessarily undeliverable.
+		if err != nil {
+			handler.deadLetters.capture(clientRequest, readBody, attempts, 0, err)
+		} else if isRetryableStatus(targetResponse.StatusCode) {
+			handler.deadLetters.capture(clientRequest, readBody, attempts, targetResponse.StatusCode, nil)
+		}
+	}
 	if err != nil {
-		logger.Printf("Cannot read response from server %v", err)
+		logger.Errorf("Cannot read response from server %v", err)
+		comparison.abandon()
+		if handler.config.Retries.enabled() {
+			response.Header().Set(AttemptsHeaderName, strconv.Itoa(attempts))
+		}
 		return false
 	}
 	defer targetResponse.Body.Close()
+	defer comparison.watchPrimary(targetResponse)()
+	if handler.config.Retries.enabled() {
+		targetResponse.Header.Set(AttemptsHeaderName, strconv.Itoa(attempts))
+	}
+	handler.metrics.ObserveUpstreamLatency(handler.clock.Since(requestStart))
 
-	// Set the relayed headers
-	for key, values := range targetResponse.Header {
-		for _, value := range values {
-			clientResponse.Header().Add(key, value)
-		}
+	clientResponse := &countingResponseWriter{ResponseWriter: response}
+	defer func() {
+		handler.metrics.ObserveResponseBodySize(clientResponse.written)
+	}()
+
+	if len(handler.grpcPlugins) > 0 && isGrpcContentType(targetResponse.Header.Get("Content-Type")) {
+		targetResponse.Body = newGrpcMessageReader(targetResponse.Body, clientRequest, handler.grpcPlugins,
+			TargetToClient, targetResponse.Header.Get("Grpc-Encoding"), handler.config.MaxBodySize)
+		targetResponse.ContentLength = -1
+		targetResponse.Header.Del("Content-Length")
+	}
+
+	// Partial responses, like those to Range requests for large media, carry
+	// fragments of a body, which can't be decoded or inspected, so they're
+	// streamed as the target sent them.
+	partial := targetResponse.StatusCode == http.StatusPartialContent && !handler.config.InspectPartialResponses
+	// Event streams stay open indefinitely, so they're streamed too.
+	eventStream := !partial && isEventStream(targetResponse)
+
+	if err := handler.runResponsePlugins(targetResponse, info, partial || eventStream); err != nil {
+		logger.Errorf("Error running response plugins: %s", err)
+		http.Error(clientResponse, "Error processing response from target", http.StatusBadGateway)
+		return true
 	}
 
+	if partial {
+		return handler.relayPartialResponse(clientResponse, targetResponse)
+	}
+	if eventStream {
+		return handler.relayEventStream(clientResponse, targetResponse)
+	}
+	if handler.config.MaxResponseSize > 0 {
+		return handler.relayCappedResponse(clientResponse, targetResponse)
+	}
+
+	copyResponseHeaders(clientResponse, targetResponse)
+
 	if targetResponse.ContentLength > handler.config.MaxBodySize {
 		clientResponse.WriteHeader(http.StatusServiceUnavailable)
 		clientResponse.Write([]byte("Response body content-length was too large"))
 	} else if targetResponse.ContentLength > 0 {
 		clientResponse.WriteHeader(targetResponse.StatusCode)
-		if _, err := io.CopyN(clientResponse, targetResponse.Body, targetResponse.ContentLength); err != nil {
-			logger.Printf("Error relaying response body to client: %s", err)
+		if copied, err := streamResponseBody(clientResponse, targetResponse.Body, targetResponse.ContentLength); err != nil {
+			logger.Errorf("Error relaying response body to client: %s", err)
+		} else if copied < targetResponse.ContentLength {
+			logger.Errorf("Error relaying response body to client: %s", io.ErrUnexpectedEOF)
 		}
 	} else if targetResponse.ContentLength < 0 {
+		// It's common for the target to respond without a Content-Length,
+		// especially to mobile traffic; the body is then relayed until the
+		// target finishes it or it reaches the maximum size.
 		clientResponse.WriteHeader(targetResponse.StatusCode)
-		if _, err := io.CopyN(clientResponse, targetResponse.Body, handler.config.MaxBodySize); err != nil {
-			// NOTE: it is highly likely the server would come back without a content-length especially with
-			// mobile traffic. In this case, full copy happens but we get an EOF error that can be safely
-			// ignored. See this example: https://go.dev/play/p/xotsgkwhJis
-			if !errors.Is(err, io.EOF) {
-				logger.Printf("Error relaying response body with unknown content-length: %s", err)
-			}
+		if _, err := streamResponseBody(clientResponse, targetResponse.Body, handler.config.MaxBodySize); err != nil {
+			logger.Errorf("Error relaying response body with unknown content-length: %s", err)
 		}
 	} else {
 		clientResponse.WriteHeader(targetResponse.StatusCode)
 	}
+	copyResponseTrailers(clientResponse, targetResponse)
+	return true
+}
+
+// streamResponseBody copies up to limit bytes of the target's response body to
+// the client, flushing after every write so that the client receives data as
+// soon as the target sends it. It returns the number of bytes copied.
+func streamResponseBody(clientResponse http.ResponseWriter, body io.Reader, limit int64) (int64, error) {
+	controller := http.NewResponseController(clientResponse)
+	flush := func() {
+		if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logger.Debugf("Error flushing response: %s", err)
+		}
+	}
+
+	// Send the headers right away, even if the target is slow to send the
+	// body.
+	flush()
+
+	buffer := make([]byte, streamingBufferSize)
+	reader := io.LimitReader(body, limit)
+	var copied int64
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			written, writeErr := clientResponse.Write(buffer[:n])
+			copied += int64(written)
+			if writeErr != nil {
+				return copied, writeErr
+			}
+			flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return copied, nil
+		} else if err != nil {
+			return copied, err
+		}
+	}
+}
+
+// streamingBufferSize is the size of the reads made from the target's response
+// body while it's streamed to the client.
+const streamingBufferSize = 32 * 1024
+
+// runResponsePlugins passes the target's response through the response
+// plugins. If any plugin needs the response body, the body is buffered and
+// decoded so that plugins see plaintext, and encoded again once they're done,
+// unless they left it unchanged, in which case the target's encoded body is
+// relayed as it was; otherwise, the body is left to be streamed. If streamed is
+// true, plugins see the response without its body, and can't replace it.
+func (handler *Handler) runResponsePlugins(targetResponse *http.Response, info RequestInfo, streamed bool) error {
+	if len(handler.responsePlugins) == 0 {
+		return nil
+	}
+
+	if streamed {
+		body, length, transferEncoding := targetResponse.Body, targetResponse.ContentLength, targetResponse.TransferEncoding
+		lengthHeader := targetResponse.Header.Values("Content-Length")
+		targetResponse.Body = http.NoBody
+		for _, plugin := range handler.responsePlugins {
+			plugin.HandleResponse(targetResponse, info)
+		}
+		targetResponse.Body, targetResponse.ContentLength, targetResponse.TransferEncoding = body, length, transferEncoding
+		targetResponse.Header["Content-Length"] = lengthHeader
+		if lengthHeader == nil {
+			targetResponse.Header.Del("Content-Length")
+		}
+		return nil
+	}
+
+	hasBody := hasResponseBody(targetResponse) && targetResponse.ContentLength != 0
+	if !hasBody || !handler.bufferResponses {
+		for _, plugin := range handler.responsePlugins {
+			plugin.HandleResponse(targetResponse, info)
+		}
+		return nil
+	}
+
+	encoding, err := ParseEncoding(targetResponse.Header.Get("Content-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(targetResponse.Body, handler.config.MaxBodySize+1))
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if int64(len(body)) > handler.config.MaxBodySize {
+		return fmt.Errorf("response body exceeds maximum size %d", handler.config.MaxBodySize)
+	}
+	encodedBody := body
+	if body, err = DecodeData(body, encoding); err != nil {
+		return fmt.Errorf("error decoding response body: %v", err)
+	}
+	decodedBody := body
+
+	SetResponseBody(targetResponse, body)
+	targetResponse.Header.Del("Content-Encoding")
+
+	for _, plugin := range handler.responsePlugins {
+		plugin.HandleResponse(targetResponse, info)
+	}
+
+	if body, err = io.ReadAll(targetResponse.Body); err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if encoding != Identity && bytes.Equal(body, decodedBody) {
+		// Re-encoding would only cost time, and might not reproduce the
+		// target's bytes exactly.
+		body = encodedBody
+	} else if body, err = EncodeData(body, encoding); err != nil {
+		return fmt.Errorf("error encoding response body: %v", err)
+	}
+	SetResponseBody(targetResponse, body)
+	if encoding != Identity {
+		targetResponse.Header.Set("Content-Encoding", encoding.HeaderValue())
+	}
+
+	return nil
+}
+
+// relayPartialResponse streams a partial response to the client without
+// buffering it. Its body is a fragment of a larger one, so MaxBodySize, which
+// limits whole bodies, doesn't apply. MaxResponseSize still does, but an
+// oversized partial response is always rejected, rather than truncated, since
+// truncating it would corrupt the ranges it carries.
+func (handler *Handler) relayPartialResponse(clientResponse http.ResponseWriter, targetResponse *http.Response) bool {
+	limit := handler.config.MaxResponseSize
+	if limit > 0 && targetResponse.ContentLength > limit {
+		logger.Printf("Partial response content-length %d exceeds maximum response size %d", targetResponse.ContentLength, limit)
+		http.Error(clientResponse, "Response body was too large", http.StatusBadGateway)
+		return true
+	}
+	if targetResponse.ContentLength >= 0 {
+		limit = targetResponse.ContentLength
+	} else if limit <= 0 {
+		limit = math.MaxInt64
+	}
+
+	copyResponseHeaders(clientResponse, targetResponse)
+	clientResponse.WriteHeader(targetResponse.StatusCode)
+	if copied, err := streamResponseBody(clientResponse, targetResponse.Body, limit); err != nil {
+		logger.Errorf("Error relaying partial response body to client: %s", err)
+	} else if targetResponse.ContentLength >= 0 && copied < targetResponse.ContentLength {
+		logger.Errorf("Error relaying partial response body to client: %s", io.ErrUnexpectedEOF)
+	}
+	return true
+}
+
+// relayCappedResponse relays the target response to the client while
+// enforcing RelayOptions.MaxResponseSize. The body is streamed, and counted as
+// it is. A response whose Content-Length exceeds the limit is rejected with a
+// 502 before anything is written to the client; if TruncateOversizedResponses
+// is set, the body is instead cut off at the limit and flagged using
+// ResponseTruncatedHeaderName. Without a Content-Length, a body is only known
+// to be oversized once the limit has been relayed, so the response is aborted,
+// and the client can't mistake it for a whole one, or, if truncating, ended
+// and flagged with a trailer instead.
+func (handler *Handler) relayCappedResponse(clientResponse http.ResponseWriter, targetResponse *http.Response) bool {
+	limit := handler.config.MaxResponseSize
+	truncate := handler.config.TruncateOversizedResponses
+
+	if !hasResponseBody(targetResponse) {
+		copyResponseHeaders(clientResponse, targetResponse)
+		clientResponse.WriteHeader(targetResponse.StatusCode)
+		return true
+	}
+
+	// If the target told us the length up front, there's no need to read the
+	// body to know that it's too large.
+	length := targetResponse.ContentLength
+	if length > limit && !truncate {
+		logger.Printf("Response body content-length %d exceeds maximum response size %d", length, limit)
+		http.Error(clientResponse, "Response body was too large", http.StatusBadGateway)
+		return true
+	}
+
+	copyResponseHeaders(clientResponse, targetResponse)
+	if length > limit {
+		clientResponse.Header().Set(ResponseTruncatedHeaderName, "true")
+		clientResponse.Header().Set("Content-Length", strconv.FormatInt(limit, 10))
+	}
+	clientResponse.WriteHeader(targetResponse.StatusCode)
+
+	if length >= 0 {
+		expected := min(length, limit)
+		if copied, err := streamResponseBody(clientResponse, targetResponse.Body, expected); err != nil {
+			logger.Errorf("Error relaying response body to client: %s", err)
+		} else if copied < expected {
+			logger.Errorf("Error relaying response body to client: %s", io.ErrUnexpectedEOF)
+		} else if length <= limit {
+			copyResponseTrailers(clientResponse, targetResponse)
+		}
+		return true
+	}
+
+	copied, err := streamResponseBody(clientResponse, targetResponse.Body, limit)
+	if err != nil {
+		logger.Errorf("Error relaying response body with unknown content-length: %s", err)
+		return true
+	}
+	if copied == limit {
+		// Any more of the body makes it oversized.
+		if _, err := io.ReadFull(targetResponse.Body, make([]byte, 1)); err == nil {
+			if !truncate {
+				logger.Printf("Response body exceeds maximum response size %d, so the response was aborted", limit)
+				panic(http.ErrAbortHandler)
+			}
+			clientResponse.Header().Set(http.TrailerPrefix+ResponseTruncatedHeaderName, "true")
+			return true
+		}
+	}
+	copyResponseTrailers(clientResponse, targetResponse)
 	return true
 }
 
+// hasResponseBody returns false for responses which never have a body, even
+// if they have a Content-Length: those to HEAD requests, and those with some
+// status codes.
+func hasResponseBody(response *http.Response) bool {
+	return response.Request.Method != http.MethodHead &&
+		response.StatusCode != http.StatusNoContent &&
+		response.StatusCode != http.StatusNotModified &&
+		(response.StatusCode < 100 || response.StatusCode >= 200)
+}
+
+// countingResponseWriter counts the bytes of response body written.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (writer *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := writer.ResponseWriter.Write(data)
+	writer.written += int64(n)
+	return n, err
+}
+
+func (writer *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// recordingResponseWriter records the status and body size of a response for
+// the access log and the request journal.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// statusOrDefault returns the status written to the response, or 200 if none
+// was written explicitly.
+func (writer *recordingResponseWriter) statusOrDefault() int {
+	if writer.status == 0 {
+		return http.StatusOK
+	}
+	return writer.status
+}
+
+func (writer *recordingResponseWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *recordingResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.written += int64(n)
+	return n, err
+}
+
+// Hijack allows websocket upgrades to take over the underlying connection.
+func (writer *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+	writer.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (writer *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// copyResponseHeaders copies the headers of the target response to the client
+// response.
+func copyResponseHeaders(clientResponse http.ResponseWriter, targetResponse *http.Response) {
+	for key, values := range targetResponse.Header {
+		for _, value := range values {
+			clientResponse.Header().Add(key, value)
+		}
+	}
+}
+
 func (handler *Handler) handleUpgrade(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
 	logger.Println("Upgrading to websocket:", clientRequest.URL)
 
-	// Connect to the target WS service
-	var targetConn net.Conn
-	var err error
-	if clientRequest.URL.Scheme == "https" {
-		targetConn, err = tls.Dial("tcp", clientRequest.URL.Host, &tls.Config{})
-		if err != nil {
-			logger.Println("Error setting up target tls websocket", err)
-			http.Error(clientResponse, fmt.Sprintf("Could not dial connect %v: %v", clientRequest.URL.Host, err), 404)
-			return true
+	var recordings []WebsocketRecording
+	for _, recorderPlugin := range handler.recorderPlugins {
+		if recording := recorderPlugin.RecordWebsocket(clientRequest); recording != nil {
+			recordings = append(recordings, recording)
 		}
-	} else {
-		targetConn, err = net.Dial("tcp", clientRequest.URL.Host)
-		if err != nil {
-			logger.Println("Error setting up target websocket", err)
-			http.Error(clientResponse, fmt.Sprintf("Could not dial connect %v: %v", clientRequest.URL.Host, err), 404)
-			return true
+	}
+	defer closeWebsocketRecordings(recordings)
+	messagePlugins := matchingMessagePlugins(handler.messagePlugins, clientRequest)
+
+	// If plugins need to see websocket messages, or the relay sends its own
+	// pings, make sure the client and target can only negotiate
+	// permessage-deflate, since the relay can't see through any other
+	// extension.
+	inspectMessages := len(messagePlugins) > 0 || len(recordings) > 0 ||
+		handler.config.Websocket.PingInterval > 0
+	if inspectMessages {
+		if offers := filterWebsocketExtensionOffers(clientRequest.Header.Values("Sec-WebSocket-Extensions")); offers != "" {
+			clientRequest.Header.Set("Sec-WebSocket-Extensions", offers)
+		} else {
+			clientRequest.Header.Del("Sec-WebSocket-Extensions")
 		}
 	}
 
+	// Connect to the target WS service
+	targetConn, err := handler.dialTarget(clientRequest)
+	if err != nil {
+		logger.Errorf("Error setting up target websocket: %v", err)
+		http.Error(clientResponse, fmt.Sprintf("Could not dial connect %v: %v", clientRequest.URL.Host, err), 404)
+		return true
+	}
+
 	// Write the original client request to the target
 	requestLine := fmt.Sprintf("%v %v %v\r\nHost: %v\r\n", clientRequest.Method, clientRequest.URL.String(), clientRequest.Proto, clientRequest.Host)
 	if _, err := io.WriteString(targetConn, requestLine); err != nil {
@@ -269,19 +1105,165 @@ func (handler *Handler) handleUpgrade(clientResponse http.ResponseWriter, client
 		return true
 	}
 
-	clientConn, _, err := hij.Hijack()
+	clientConn, clientBuffer, err := hij.Hijack()
 	if err != nil {
-		logger.Println("Cannot hijack connection ", err)
+		logger.Errorf("Cannot hijack connection: %v", err)
 		http.Error(clientResponse, "Could not hijack", 500)
 		return true
 	}
 
+	session := handler.startWebsocketSession(clientConn, targetConn)
+	defer session.end()
+	clientConn, targetConn = session.wrap(clientConn), session.wrap(targetConn)
+
+	if inspectMessages {
+		// Frames which the client sent along with the upgrade request may
+		// already have been buffered.
+		clientReader := io.Reader(clientConn)
+		if buffered := clientBuffer.Reader.Buffered(); buffered > 0 {
+			data, _ := clientBuffer.Reader.Peek(buffered)
+			clientReader = io.MultiReader(bytes.NewReader(data), clientConn)
+		}
+		handler.relayWebsocketMessages(clientRequest, clientConn, clientReader, targetConn, messagePlugins, recordings)
+		return true
+	}
+
 	// And then relay everything between the client and target
 	go transfer(targetConn, clientConn)
 	transfer(clientConn, targetConn)
 	return true
 }
 
+// relayWebsocketMessages relays an upgraded websocket connection frame by
+// frame, so that websocket plugins, and the WsPlugins which match the
+// connection, can inspect and rewrite messages and recordings can capture the
+// frames. Messages compressed with
+// permessage-deflate are decompressed first. If keepalive pings are enabled,
+// they're sent alongside the relayed frames. It returns once both directions
+// are finished.
+func (handler *Handler) relayWebsocketMessages(
+	clientRequest *http.Request,
+	clientConn net.Conn,
+	clientReader io.Reader,
+	targetConn net.Conn,
+	messagePlugins []WsPlugin,
+	recordings []WebsocketRecording,
+) {
+	targetReader := bufio.NewReader(targetConn)
+	handshake, err := readWebsocketHandshakeResponse(targetReader)
+	if err != nil {
+		clientConn.Close()
+		targetConn.Close()
+		return
+	}
+
+	var deflates [2]*websocketDeflate // Indexed by direction.
+	if handshake.upgraded {
+		deflates[ClientToTarget], deflates[TargetToClient], err = negotiateWebsocketDeflate(handshake.extensions)
+		if err != nil {
+			logger.Errorf("Error negotiating websocket extensions with target: %v", err)
+			io.WriteString(clientConn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			clientConn.Close()
+			targetConn.Close()
+			return
+		}
+	}
+
+	if _, err := clientConn.Write(handshake.raw); err != nil || !handshake.upgraded {
+		// The target refused the upgrade; relay whatever else it sent as-is.
+		if err == nil {
+			io.Copy(clientConn, targetReader)
+		}
+		clientConn.Close()
+		targetConn.Close()
+		return
+	}
+
+	newRelay := func(direction WebsocketDirection) *websocketMessageRelay {
+		return &websocketMessageRelay{
+			messagePlugins: messagePlugins,
+			recordings:     recordings,
+			clock:          handler.clock,
+			direction:      direction,
+			maxMessageSize: handler.config.MaxBodySize,
+			deflate:        deflates[direction],
+			keepalive:      handler.config.Websocket.PingInterval > 0,
+		}
+	}
+	logError := func(direction WebsocketDirection, err error) {
+		// Timeouts are logged once the session ends.
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Errorf("Error relaying websocket messages (%v): %v", direction, err)
+		}
+	}
+
+	clientToTarget, targetToClient := newRelay(ClientToTarget), newRelay(TargetToClient)
+	if interval := handler.config.Websocket.PingInterval; interval > 0 {
+		stopPinging := make(chan struct{})
+		defer close(stopPinging)
+		go keepWebsocketAlive(interval, stopPinging, clientToTarget, targetToClient, targetConn, clientConn)
+	}
+
+	clientToTargetDone := make(chan struct{})
+	go func() {
+		defer close(clientToTargetDone)
+		logError(ClientToTarget, clientToTarget.run(targetConn, clientReader))
+		clientConn.Close()
+	}()
+	logError(TargetToClient, targetToClient.run(clientConn, targetReader))
+	targetConn.Close()
+	<-clientToTargetDone
+}
+
+// dialTarget opens a raw connection to the host of the provided request,
+// wrapping it in TLS if the request uses https.
+func (handler *Handler) dialTarget(clientRequest *http.Request) (net.Conn, error) {
+	address := clientRequest.URL.Host
+	if clientRequest.URL.Port() == "" {
+		if clientRequest.URL.Scheme == "https" {
+			address = net.JoinHostPort(clientRequest.URL.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(clientRequest.URL.Hostname(), "80")
+		}
+	}
+
+	conn, err := handler.dialUpstream(clientRequest.Context(), address)
+	if err != nil {
+		return nil, err
+	}
+	if clientRequest.URL.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConfig := targetTLSConfig(handler.config)
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = clientRequest.URL.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(clientRequest.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upstreamProxy returns the transport's proxy function: the configured
+// upstream proxy, or the one named by the environment.
+func upstreamProxy(config *RelayOptions) func(*http.Request) (*url.URL, error) {
+	if config.UpstreamProxy != nil {
+		return http.ProxyURL(config.UpstreamProxy)
+	}
+	return http.ProxyFromEnvironment
+}
+
+// targetTLSConfig returns a new tls.Config for connections to the target.
+func targetTLSConfig(config *RelayOptions) *tls.Config {
+	if config.TargetTLS == nil {
+		return &tls.Config{}
+	}
+	return config.TargetTLS.Clone()
+}
+
 func transfer(destination io.WriteCloser, source io.ReadCloser) {
 	defer destination.Close()
 	defer source.Close()
@@ -0,0 +1,84 @@
+package traffic
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// The relay keeps each request's ContentLength and Content-Length header
+// consistent with its body, so that plugins needn't. While plugins run, they
+// describe the decoded body which plugins see, rather than the encoded body
+// which the client sent; once plugins have run, they're updated to describe
+// the body as it will be relayed, after it's been encoded again using the
+// original Content-Encoding.
+//
+// Plugins which replace a request body should use SetRequestBody, or give the
+// request a SizedBody. If a plugin replaces the body with any other reader,
+// its length can't be known in advance, so it's relayed using chunked transfer
+// encoding, unless the plugin set ContentLength itself.
+
+// SizedBody is a request body which knows its length in advance, like a
+// BodyReader. Size returns -1 if the length isn't known after all.
+type SizedBody interface {
+	io.ReadCloser
+	Size() int64
+}
+
+// SetRequestBody replaces the body of a request with data, and updates its
+// length to match.
+func SetRequestBody(request *http.Request, data []byte) {
+	body := &BodyReader{memory: data, size: int64(len(data))}
+	body.Rewind()
+	request.Body = body
+	setRequestLength(request, body.size)
+}
+
+// SetResponseBody replaces the body of a response with data, and updates its
+// length to match.
+func SetResponseBody(response *http.Response, data []byte) {
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	response.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	response.TransferEncoding = nil
+}
+
+// setRequestLength sets a request's ContentLength and Content-Length header.
+// A length of -1 means that it's unknown, and the body should be chunked.
+func setRequestLength(request *http.Request, length int64) {
+	request.ContentLength = length
+	if length < 0 {
+		request.Header.Del("Content-Length")
+		return
+	}
+	request.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	request.TransferEncoding = nil
+}
+
+// reconcileRequestLength makes a request's length consistent with its body
+// once plugins have run. original and originalLength are the body and
+// ContentLength which plugins received.
+func reconcileRequestLength(request *http.Request, original io.ReadCloser, originalLength int64) {
+	if request.Body == nil || request.Body == http.NoBody {
+		if request.ContentLength != 0 {
+			request.ContentLength = 0
+			request.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	if sized, ok := request.Body.(SizedBody); ok && sized.Size() >= 0 {
+		if sized.Size() != request.ContentLength || request.Header.Get("Content-Length") == "" {
+			setRequestLength(request, sized.Size())
+		}
+		return
+	}
+
+	if request.Body != original && request.ContentLength == originalLength {
+		// The body was replaced, but its length wasn't updated.
+		setRequestLength(request, -1)
+	} else if request.ContentLength >= 0 && request.Header.Get("Content-Length") != strconv.FormatInt(request.ContentLength, 10) {
+		setRequestLength(request, request.ContentLength)
+	}
+}
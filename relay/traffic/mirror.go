@@ -0,0 +1,305 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/metrics"
+)
+
+// MirrorOptions configures a second target which receives a copy of each
+// request relayed to the target, after plugins have processed it. Copies are
+// sent in the background, and the mirror target's responses are discarded, so
+// it can't affect clients; if it falls behind, copies are dropped rather than
+// queued without bound.
+//
+// If Compare is set, the mirror target's response to each copy is compared
+// with the target's response to the original: their statuses, the values of
+// CompareHeaders, and a hash of their bodies. Mismatches are logged and
+// counted, so that a migration to a new backend can be validated against
+// real traffic before clients are switched over to it.
+type MirrorOptions struct {
+	TargetScheme   string   // The scheme ('http' or 'https') of the mirror target. Mirroring is disabled if empty.
+	TargetHost     string   // The host of the mirror target.
+	QueueSize      int      // The number of copies which may wait to be sent. Zero uses the default.
+	Compare        bool     // If true, responses from the target and the mirror target are compared.
+	CompareHeaders []string // Response headers whose values are compared, if Compare is true.
+}
+
+const DefaultMirrorQueueSize = 100
+
+const (
+	// mirrorWorkers is the number of copies which may be sent concurrently.
+	mirrorWorkers = 4
+
+	// mirrorTimeout bounds the time spent sending each copy.
+	mirrorTimeout = 10 * time.Second
+)
+
+func (options *MirrorOptions) enabled() bool {
+	return options.TargetScheme != ""
+}
+
+// mirror sends copies of requests to the mirror target.
+type mirror struct {
+	options   MirrorOptions
+	queue     chan *mirrorCopy
+	transport http.RoundTripper
+	metrics   *metrics.Registry
+
+	lock   sync.RWMutex // Guards closed, so that nothing is queued once the queue is closed.
+	closed bool
+}
+
+// mirrorCopy is a copy of a request waiting to be sent to the mirror target.
+type mirrorCopy struct {
+	request    *http.Request
+	comparison *mirrorComparison // Nil unless responses are compared.
+}
+
+func newMirror(options MirrorOptions, transport http.RoundTripper, metricsRegistry *metrics.Registry) *mirror {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultMirrorQueueSize
+	}
+	mirror := &mirror{
+		options:   options,
+		queue:     make(chan *mirrorCopy, queueSize),
+		transport: transport,
+		metrics:   metricsRegistry,
+	}
+	for i := 0; i < mirrorWorkers; i++ {
+		go mirror.run()
+	}
+	return mirror
+}
+
+// enqueue queues a copy of the request for the mirror target. The request's
+// body is read into memory so that it can be sent twice, and replaced with an
+// equivalent reader. If responses are compared, it returns the comparison to
+// which the target's response should be given; otherwise, it returns nil.
+func (mirror *mirror) enqueue(clientRequest *http.Request) *mirrorComparison {
+	var body []byte
+	if clientRequest.Body != nil && clientRequest.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(clientRequest.Body)
+		clientRequest.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			logger.Errorf("Error reading request body for mirror: %s", err)
+			mirror.metrics.MirrorRequest("failed")
+			return nil
+		}
+	}
+
+	// The copy is sent after the client's request has finished, so it can't
+	// use the request's context.
+	mirrorRequest := clientRequest.Clone(context.Background())
+	mirrorRequest.URL.Scheme = mirror.options.TargetScheme
+	mirrorRequest.URL.Host = mirror.options.TargetHost
+	mirrorRequest.Host = mirror.options.TargetHost
+	mirrorRequest.Body = io.NopCloser(bytes.NewReader(body))
+	if body == nil {
+		mirrorRequest.Body = http.NoBody
+	}
+
+	mirrored := &mirrorCopy{request: mirrorRequest}
+	if mirror.options.Compare {
+		mirrored.comparison = &mirrorComparison{
+			method:  clientRequest.Method,
+			path:    clientRequest.URL.Path,
+			headers: mirror.options.CompareHeaders,
+			primary: make(chan *responseSummary, 1),
+		}
+	}
+
+	mirror.lock.RLock()
+	defer mirror.lock.RUnlock()
+	if mirror.closed {
+		mirror.metrics.MirrorRequest("dropped")
+		return nil
+	}
+	select {
+	case mirror.queue <- mirrored:
+		return mirrored.comparison
+	default:
+		mirror.metrics.MirrorRequest("dropped")
+		return nil
+	}
+}
+
+// close stops the workers once they've sent the copies which are already
+// queued. Later copies are dropped.
+func (mirror *mirror) close() {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+	if !mirror.closed {
+		mirror.closed = true
+		close(mirror.queue)
+	}
+}
+
+func (mirror *mirror) run() {
+	for mirrored := range mirror.queue {
+		mirror.send(mirrored)
+	}
+}
+
+func (mirror *mirror) send(mirrored *mirrorCopy) {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+
+	response, err := mirror.transport.RoundTrip(mirrored.request.WithContext(ctx))
+	if err != nil {
+		logger.Debugf("Error sending request to mirror target: %s", err)
+		mirror.metrics.MirrorRequest("failed")
+		if mirrored.comparison != nil {
+			mirror.metrics.MirrorComparison("skipped")
+		}
+		return
+	}
+	body := newHashingReader(response.Body)
+	_, err = io.Copy(io.Discard, body)
+	response.Body.Close()
+	mirror.metrics.MirrorRequest("sent")
+
+	if mirrored.comparison != nil {
+		if err != nil {
+			logger.Debugf("Error reading response from mirror target: %s", err)
+			mirror.metrics.MirrorComparison("skipped")
+			return
+		}
+		mirrored.comparison.compare(ctx, summarizeResponse(response, body), mirror.metrics)
+	}
+}
+
+// responseSummary is what's compared of each response.
+type responseSummary struct {
+	status   int
+	header   http.Header
+	bodyHash string
+}
+
+func summarizeResponse(response *http.Response, body *hashingReader) *responseSummary {
+	return &responseSummary{
+		status:   response.StatusCode,
+		header:   response.Header.Clone(),
+		bodyHash: body.sum(),
+	}
+}
+
+// mirrorComparison compares the target's response to a request with the
+// mirror target's response to its copy. Its methods are safe to call on a
+// nil comparison, so that callers needn't check whether responses are
+// compared.
+type mirrorComparison struct {
+	method  string
+	path    string
+	headers []string
+
+	// primary receives a summary of the target's response, or nil if there
+	// was none to compare.
+	primary chan *responseSummary
+}
+
+// watchPrimary arranges for the target's response to be summarized as it's
+// relayed. Its status and headers are captured now, before response plugins
+// can modify them, and its body is hashed as it's read. The returned function
+// must be called once the response has been relayed.
+func (comparison *mirrorComparison) watchPrimary(response *http.Response) func() {
+	if comparison == nil {
+		return func() {}
+	}
+	body := newHashingReader(response.Body)
+	body.complete = response.Body == http.NoBody
+	response.Body = body
+	summary := &responseSummary{status: response.StatusCode, header: response.Header.Clone()}
+	return func() {
+		if !body.complete {
+			// Only part of the body was relayed, so its hash means nothing.
+			comparison.abandon()
+			return
+		}
+		summary.bodyHash = body.sum()
+		comparison.primary <- summary
+	}
+}
+
+// abandon gives up on the comparison, because the target didn't respond.
+func (comparison *mirrorComparison) abandon() {
+	if comparison != nil {
+		comparison.primary <- nil
+	}
+}
+
+// compare waits for a summary of the target's response and compares it with
+// the mirror target's.
+func (comparison *mirrorComparison) compare(ctx context.Context, shadow *responseSummary, metricsRegistry *metrics.Registry) {
+	var primary *responseSummary
+	select {
+	case primary = <-comparison.primary:
+	case <-ctx.Done():
+	}
+	if primary == nil {
+		metricsRegistry.MirrorComparison("skipped")
+		return
+	}
+
+	differences := []string{}
+	if primary.status != shadow.status {
+		metricsRegistry.MirrorMismatch("status")
+		differences = append(differences, fmt.Sprintf("status %d != %d", primary.status, shadow.status))
+	}
+	for _, name := range comparison.headers {
+		primaryValue := strings.Join(primary.header.Values(name), ", ")
+		shadowValue := strings.Join(shadow.header.Values(name), ", ")
+		if primaryValue != shadowValue {
+			metricsRegistry.MirrorMismatch("header")
+			differences = append(differences, fmt.Sprintf("%s %q != %q", http.CanonicalHeaderKey(name), primaryValue, shadowValue))
+		}
+	}
+	if primary.bodyHash != shadow.bodyHash {
+		metricsRegistry.MirrorMismatch("body")
+		differences = append(differences, fmt.Sprintf("body %s != %s", primary.bodyHash, shadow.bodyHash))
+	}
+
+	if len(differences) == 0 {
+		metricsRegistry.MirrorComparison("match")
+		return
+	}
+	metricsRegistry.MirrorComparison("mismatch")
+	logger.Printf("Mirror mismatch for %s %s: %s", comparison.method, comparison.path, strings.Join(differences, "; "))
+}
+
+// hashingReader hashes a response body as it's read.
+type hashingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	complete bool // True once the whole body has been read.
+}
+
+func newHashingReader(body io.ReadCloser) *hashingReader {
+	return &hashingReader{ReadCloser: body, hash: sha256.New()}
+}
+
+func (reader *hashingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.hash.Write(p[:n])
+	if err == io.EOF {
+		reader.complete = true
+	}
+	return n, err
+}
+
+// sum returns an abbreviated hex encoding of the hash of the body read so far.
+func (reader *hashingReader) sum() string {
+	return hex.EncodeToString(reader.hash.Sum(nil)[:8])
+}
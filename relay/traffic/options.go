@@ -1,14 +1,58 @@
 package traffic
 
+import (
+	"crypto/tls"
+	"io"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/journal"
+	"github.com/immersa-co/relay-core/relay/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
 // RelayOptions contains configuration options for the core relay code.
 //
 // It's preferable to keep the core relay code simple; before adding a new
 // option here, consider whether you could implement the same functionality as a
 // plugin.
 type RelayOptions struct {
-	MaxBodySize  int64  // Maximum length in bytes of relayed bodies.
-	TargetHost   string // The host to relay traffic to. (e.g. 192.168.0.1:1234)
-	TargetScheme string // The scheme ('http' or 'https') to use to communicate with the target host.
+	MaxBodySize                int64  // Maximum length in bytes of relayed bodies.
+	MaxResponseSize            int64  // If non-zero, responses larger than this are rejected with a 502.
+	TruncateOversizedResponses bool   // If true, responses exceeding MaxResponseSize are truncated instead.
+	InspectPartialResponses    bool   // If true, 206 responses are buffered and limited like others, rather than streamed untouched.
+	TargetHost                 string // The host to relay traffic to. (e.g. 192.168.0.1:1234)
+	TargetScheme               string // The scheme ('http' or 'https') to use to communicate with the target host.
+	Route                      string // The pattern of the SNI route or virtual host whose traffic this is, reported to plugins. Empty for the default route.
+	Dial                       DialOptions
+	Retries                    RetryOptions
+	DuplicateHeaders           DuplicateHeaderPolicy // How request headers sent more than once are handled before plugins run.
+	Mirror                     MirrorOptions
+	WebsocketBridge            WebsocketBridgeOptions
+	Websocket                  WebsocketOptions     // Deadlines and keepalive pings for relayed websocket connections.
+	MalformedBodies            MalformedBodyPolicy  // How bodies which can't be decoded are handled. Empty means reject.
+	SpoolThreshold             int64                // If non-zero, request bodies are buffered, and those larger than this are written to disk.
+	SpoolDir                   string               // Where spooled request bodies are written. If empty, a directory in the default temporary directory is used.
+	SpoolEncryptionKey         []byte               // The AES key with which spooled request bodies are encrypted. If empty, a random key is used.
+	SpoolMaxAge                time.Duration        // How long spooled request bodies left behind are kept. If zero, DefaultSpoolMaxAge is used.
+	BodyStores                 []BodyStoreTier      // Further stores for bodies larger than SpoolThreshold, ordered by threshold.
+	TargetTLS                  *tls.Config          // If non-nil, used for TLS connections to the target, e.g. to present a client certificate.
+	TargetHTTP2                bool                 // If true, HTTP/2 is used with https targets which support it.
+	UpstreamProxy              *url.URL             // If non-nil, connections to the target, including websockets, go through this proxy.
+	DryRun                     bool                 // If true, requests are answered with the request that would have been relayed, instead of being relayed.
+	DebugHeaders               bool                 // If true, every response carries headers describing how plugins handled the request.
+	DebugNetworks              []netip.Prefix       // Clients in these networks may ask for debug headers by sending X-Relay-Debug.
+	TrustedProxies             []netip.Prefix       // Requests from these networks are believed about the clients they were forwarded for.
+	DeadLetters                *DeadLetterOptions   // If non-nil, requests which can't be delivered to the target are captured as dead letters.
+	Audit                      *AuditOptions        // If non-nil, each request's original metadata, and what was changed, is recorded.
+	Recorder                   *Recorder            // If non-nil, each request sent to the target is recorded, for inspection or replay.
+	TracerProvider             trace.TracerProvider // If non-nil, requests are traced using OpenTelemetry.
+	Clock                      clock.Clock          // The source of the current time. If nil, the real time is used.
+	AccessLog                  io.Writer            // If non-nil, a JSON access log entry is written here for each request.
+	Metrics                    *metrics.Registry    // If non-nil, metrics are recorded here rather than in a new registry.
+	Journal                    *journal.Journal     // If non-nil, a summary of each request is recorded here.
 }
 
 const DefaultMaxBodySize int64 = 1024 * 2048 // 2MB
@@ -0,0 +1,121 @@
+package traffic
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/immersa-co/relay-core/relay/config"
+)
+
+// OutboundHeaderPolicy controls the headers sent on HTTP requests which
+// plugins originate themselves, as opposed to the requests relayed to the
+// target. Such requests are often derived from an inbound request, and copying
+// the inbound headers wholesale risks leaking cookies and credentials to third
+// parties.
+//
+// The policy is configured once, in the top-level 'outbound-headers' section of
+// the configuration file, and shared by every plugin.
+type OutboundHeaderPolicy struct {
+	// If non-empty, only these inbound headers are copied. Otherwise, every
+	// inbound header is copied except those which are always removed.
+	Allowlist []string `yaml:"allowlist"`
+
+	// Headers set on every outbound request, after inbound headers have been
+	// copied. This is typically used to inject credentials for the service the
+	// plugin is calling.
+	Set map[string]string `yaml:"set"`
+}
+
+// OutboundHeaderPlugin is an optional interface which plugins that originate
+// their own HTTP requests may implement to receive the shared outbound header
+// policy. SetOutboundHeaderPolicy is called once, after the plugin is created.
+type OutboundHeaderPlugin interface {
+	SetOutboundHeaderPolicy(policy *OutboundHeaderPolicy)
+}
+
+// outboundRemovedHeaders are never copied from inbound requests, even if they
+// appear in the allowlist. Cookies and credentials are meant for the relay's
+// target, the Content-* headers describe the inbound body rather than the
+// outbound one, and the remainder are hop-by-hop headers.
+var outboundRemovedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Cookie":              true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Set-Cookie":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// ReadOutboundHeaderPolicy reads the outbound header policy from the
+// 'outbound-headers' section of the configuration file. If the section is
+// absent, an empty policy is returned; it still removes cookies and
+// credentials.
+func ReadOutboundHeaderPolicy(configFile *config.File) (*OutboundHeaderPolicy, error) {
+	policy := &OutboundHeaderPolicy{}
+	section := configFile.LookupOptionalSection("outbound-headers")
+	if section == nil {
+		return policy, nil
+	}
+
+	if err := config.ParseOptional(section, "allowlist", func(key string, value []string) error {
+		policy.Allowlist = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := config.ParseOptional(section, "set", func(key string, value map[string]string) error {
+		for header := range value {
+			if http.CanonicalHeaderKey(header) == "Cookie" {
+				return fmt.Errorf(`Outbound header policy may not set the Cookie header`)
+			}
+		}
+		policy.Set = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Apply copies the permitted headers from an inbound request to an outbound
+// request, and then sets the policy's configured headers. A nil policy behaves
+// like an empty one.
+func (policy *OutboundHeaderPolicy) Apply(outbound *http.Request, inbound *http.Request) {
+	var allowlist []string
+	var set map[string]string
+	if policy != nil {
+		allowlist = policy.Allowlist
+		set = policy.Set
+	}
+
+	copyHeader := func(header string) {
+		if outboundRemovedHeaders[header] {
+			return
+		}
+		if values, ok := inbound.Header[header]; ok {
+			outbound.Header[header] = append([]string{}, values...)
+		}
+	}
+	if len(allowlist) > 0 {
+		for _, header := range allowlist {
+			copyHeader(http.CanonicalHeaderKey(header))
+		}
+	} else {
+		for header := range inbound.Header {
+			copyHeader(header)
+		}
+	}
+
+	for header, value := range set {
+		outbound.Header.Set(header, value)
+	}
+}
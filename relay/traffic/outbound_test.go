@@ -0,0 +1,89 @@
+package traffic_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestOutboundHeaderPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		expected http.Header
+	}{
+		{
+			desc:   "Without configuration, everything but cookies and credentials is copied",
+			config: ``,
+			expected: http.Header{
+				"User-Agent":      {"test-agent"},
+				"Accept-Language": {"en"},
+				"X-Custom":        {"a", "b"},
+			},
+		},
+		{
+			desc: "The allowlist restricts which headers are copied",
+			config: `outbound-headers:
+                        allowlist:
+                          - user-agent
+                          - cookie
+            `,
+			expected: http.Header{
+				"User-Agent": {"test-agent"},
+			},
+		},
+		{
+			desc: "Configured headers are injected",
+			config: `outbound-headers:
+                        allowlist:
+                          - X-Custom
+                        set:
+                          Authorization: Bearer secret
+                          X-Custom: replaced
+            `,
+			expected: http.Header{
+				"Authorization": {"Bearer secret"},
+				"X-Custom":      {"replaced"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing config: %v", testCase.desc, err)
+			continue
+		}
+		policy, err := traffic.ReadOutboundHeaderPolicy(configFile)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading policy: %v", testCase.desc, err)
+			continue
+		}
+
+		inbound, _ := http.NewRequest("POST", "http://relay.example.com", nil)
+		inbound.Header.Set("User-Agent", "test-agent")
+		inbound.Header.Set("Accept-Language", "en")
+		inbound.Header.Set("Cookie", "session=abc")
+		inbound.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		inbound.Header.Set("Content-Length", "10")
+		inbound.Header["X-Custom"] = []string{"a", "b"}
+
+		outbound, _ := http.NewRequest("POST", "http://api.example.com", nil)
+		policy.Apply(outbound, inbound)
+
+		if !reflect.DeepEqual(outbound.Header, testCase.expected) {
+			t.Errorf("Test '%v': Expected headers %v but got %v", testCase.desc, testCase.expected, outbound.Header)
+		}
+	}
+
+	configFile, _ := config.NewFileFromYamlString(`outbound-headers:
+    set:
+        cookie: injected=1
+`)
+	if _, err := traffic.ReadOutboundHeaderPolicy(configFile); err == nil {
+		t.Errorf("Expected setting the Cookie header to be rejected")
+	}
+}
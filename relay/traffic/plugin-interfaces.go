@@ -1,10 +1,15 @@
 package traffic
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/immersa-co/relay-core/relay/clock"
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/metrics"
 )
 
 // PluginFactory is the interface that the relay uses to create plugin
@@ -35,7 +40,9 @@ type Plugin interface {
 	// HTTP request.
 	//
 	// Plugins may ignore an incoming request, alter it in some way, or service
-	// the request and return a response to the client.
+	// the request and return a response to the client. Plugins which replace
+	// the request body should use SetRequestBody, so that its length is
+	// updated to match.
 	//
 	// HandleRequest should return true if a response has been sent to the
 	// client.
@@ -46,8 +53,213 @@ type Plugin interface {
 	) bool
 }
 
-// RequestInfo provides additional information about incoming requests.
+// ResponsePlugin is an optional interface which plugins may implement to
+// inspect and modify the responses returned by the target before they're
+// relayed to the client. Responses serviced by a plugin, and websocket
+// handshakes, aren't passed to response plugins.
+//
+// Responses are streamed to the client by default, so HandleResponse may only
+// inspect and modify the status and headers; the body hasn't been read yet and
+// is still encoded. Plugins which need the body must also implement
+// ResponseBodyPlugin.
+//
+// Partial (206) responses carry fragments of a body, which can't be decoded
+// or inspected, so they're passed to plugins with http.NoBody as their body,
+// and relayed with the target's body even if a plugin replaces it. Plugins may
+// still modify their status and headers. Setting
+// RelayOptions.InspectPartialResponses disables this.
+//
+// Server-Sent Events streams (text/event-stream) never end, so they're passed
+// to plugins the same way, and streamed to the client. Plugins which need
+// their events must implement ServerSentEventPlugin.
+type ResponsePlugin interface {
+	// HandleResponse is invoked with the target's response to a request. The
+	// RequestInfo is the same as that passed to HandleRequest, and the
+	// original request is available as response.Request.
+	HandleResponse(response *http.Response, info RequestInfo)
+}
+
+// ResponseBodyPlugin is an optional interface which response plugins may
+// implement to declare that they need the full response body. If any active
+// plugin needs it, the body is buffered before HandleResponse is invoked,
+// which delays the response until the target has sent all of it.
+//
+// The buffered body is decoded before HandleResponse is invoked, and encoded
+// again afterwards using the original Content-Encoding, so plugins always see
+// plaintext; the Content-Encoding header is absent while plugins run. If no
+// plugin changes the body, the target's encoded body is relayed untouched.
+// Plugins which replace the body should use SetResponseBody, so that its
+// length is updated to match.
+type ResponseBodyPlugin interface {
+	// NeedsResponseBody returns true if the plugin reads or modifies response
+	// bodies. It's called once, when the relay is set up.
+	NeedsResponseBody() bool
+}
+
+// CompletionPlugin is an optional interface which plugins may implement to
+// observe each request once the relay has finished handling it, such as to log
+// it. It's invoked for every request, whether it was relayed, serviced by a
+// plugin, or rejected by the relay.
+type CompletionPlugin interface {
+	// HandleCompletion is invoked synchronously once the response has been
+	// sent, so it should return quickly.
+	HandleCompletion(completion *RequestCompletion)
+}
+
+// MetricsPlugin is an optional interface which plugins may implement to
+// report their own metrics, such as the number of bodies they modified. The
+// relay counts the requests passed to every plugin regardless.
+type MetricsPlugin interface {
+	// SetPluginMetrics is called once, when the relay is set up, with the
+	// metrics for this plugin.
+	SetPluginMetrics(metrics *metrics.PluginMetrics)
+}
+
+// ClockPlugin is an optional interface which plugins may implement if they
+// generate timestamps or otherwise depend on the current time. Plugins should
+// use the real clock until SetClock is called, so tests can inject a fake one.
+type ClockPlugin interface {
+	// SetClock is called once, when the relay is set up, with the clock
+	// configured in RelayOptions.
+	SetClock(clock clock.Clock)
+}
+
+// TransportPlugin is an optional interface which plugins may implement if they
+// relay requests to the target themselves, rather than leaving that to the
+// relay. Using the relay's transport means those requests are dialed, secured,
+// and pooled exactly like the requests the relay sends.
+type TransportPlugin interface {
+	// SetTransport is called once, when the relay is set up, with the
+	// transport used for requests to the target.
+	SetTransport(transport http.RoundTripper)
+}
+
+// TargetPlugin is an optional interface which plugins may implement if they
+// send requests of their own to the target, such as synthetic checks, rather
+// than relaying the requests clients send.
+type TargetPlugin interface {
+	// SetTarget is called once, when the relay is set up, with the target's
+	// scheme and host. It's called before SetTransport.
+	SetTarget(target *url.URL)
+}
+
+// Plugins which do background work, like sending requests of their own, may
+// also implement io.Closer to stop it; relay.Service closes them when it's
+// closed.
+
+// ReadinessPlugin is an optional interface which plugins may implement to
+// affect the relay's readiness, as reported on the admin listener's readiness
+// endpoint. The relay is reported as not ready while any plugin returns an
+// error.
+type ReadinessPlugin interface {
+	// Ready returns nil if the plugin is ready, or an error describing why it
+	// isn't. It's called for every readiness check, so it should return
+	// quickly.
+	Ready() error
+}
+
+// VersionedPlugin is an optional interface which plugins may implement to
+// report their own version on the admin endpoint. Plugins which don't
+// implement it are reported with the relay's version, since they're built into
+// the relay.
+type VersionedPlugin interface {
+	Version() string
+}
+
+// AdminPlugin is an optional interface which plugins may implement to serve
+// their own endpoints on the admin listener, such as to let operators query
+// the plugin's state. The handler is mounted at "/plugins/<name>/", with that
+// prefix removed from the request path. Like the rest of the admin listener,
+// it isn't exposed to the clients whose traffic is being relayed.
+type AdminPlugin interface {
+	AdminHandler() http.Handler
+}
+
+// ConnectionPlugin is an optional interface which plugins may implement to
+// observe client connections, independent of the requests sent over them. This
+// is useful for plugins that need connection-scoped state, like rate limiters
+// or abuse detectors.
+//
+// OnConnect is invoked synchronously on the connection's goroutine, rather
+// than the one accepting connections, so a slow hook only delays the requests
+// on its own connection. OnDisconnect is invoked by whatever closes the
+// connection. Both should return quickly.
+type ConnectionPlugin interface {
+	// OnConnect is invoked when a client connection is accepted, before
+	// anything is read from it. Duration, BytesRead, and BytesWritten are
+	// always zero at this point, and TLS is nil, since the handshake hasn't
+	// happened yet.
+	OnConnect(info ConnectionInfo)
+
+	// OnDisconnect is invoked once when a client connection is closed.
+	OnDisconnect(info ConnectionInfo)
+}
+
+// ConnectionInfo provides information about a client connection.
+type ConnectionInfo struct {
+	// The addresses of the client and of the relay's end of the connection.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// The TLS state of the connection, or nil if the connection doesn't use
+	// TLS.
+	TLS *tls.ConnectionState
+
+	// When the connection was accepted, and (on disconnect) how long it was
+	// open.
+	ConnectedAt time.Time
+	Duration    time.Duration
+
+	// The number of bytes read from and written to the client so far.
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// RequestCompletion describes a request which the relay has finished handling.
+type RequestCompletion struct {
+	// The request, as modified by plugins. Its URL and Host point at the
+	// target, and its body has been consumed.
+	Request *http.Request
+	// The URL and Host header the client requested.
+	OriginalURL  *url.URL
+	OriginalHost string
+	// When the request was received, and how long it took to handle.
+	Start    time.Time
+	Duration time.Duration
+	// The status code returned to the client.
+	Status int
+	// The request Content-Length as received, or -1 if unknown, and the number
+	// of response body bytes written to the client.
+	RequestBytes  int64
+	ResponseBytes int64
+	// True if the relay or a plugin serviced the request.
+	Serviced bool
+	// Tags attached to the request by plugins.
+	Tags []string
+	// The request's ID and route, as in RequestInfo, and a copy of the
+	// annotations plugins attached to it.
+	ID          string
+	Route       string
+	Annotations map[string]string
+}
+
+// RequestInfo provides additional information about incoming requests. The
+// same information is passed to every plugin which handles a request, and to
+// their HandleResponse.
 type RequestInfo struct {
+	// A unique ID, generated by the relay when it received the request. It's
+	// also reported to CompletionPlugins, so it can be used to correlate a
+	// plugin's logs with the access log.
+	ID string
+
+	// The route which matched the request: the server name pattern of the SNI
+	// route, or the host pattern of the virtual host, like "*.example.com".
+	// It's empty for requests handled by the default route.
+	Route string
+
+	// When the relay received the request.
+	Start time.Time
+
 	// The original cookie headers included in the client request. For security
 	// and privacy reasons, these are automatically removed from the client
 	// request before plugins get an opportunity to handle it.
@@ -59,6 +271,16 @@ type RequestInfo struct {
 
 	// If true, a response has already been sent to the client.
 	Serviced bool
+
+	// Classification tags attached to this request. The same Tags value is
+	// shared by every plugin in the chain, so tags added by one plugin are
+	// visible to the plugins that run after it.
+	Tags *Tags
+
+	// Key/value annotations attached to this request. Like Tags, the same
+	// value is shared by every plugin in the chain, so plugins may use it to
+	// pass information to the plugins that run after them.
+	Annotations *Annotations
 }
 
 /*
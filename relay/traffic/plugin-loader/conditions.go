@@ -0,0 +1,184 @@
+package plugin_loader
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/immersa-co/relay-core/relay/config"
+)
+
+// ConfigCondition is the 'when' section which any plugin's configuration may
+// have, restricting the plugin to the requests it matches. A request matches
+// if it matches every option which is set; an option which lists several
+// values matches a request which has any of them.
+type ConfigCondition struct {
+	PathPrefix   string `yaml:"path-prefix"`
+	Path         string // A regular expression.
+	Methods      []string
+	Headers      []ConfigHeaderCondition
+	ContentTypes []string `yaml:"content-types"`
+}
+
+// ConfigHeaderCondition matches requests with a header whose value either
+// equals a string or matches a regular expression. A condition which sets
+// neither matches requests which have the header.
+type ConfigHeaderCondition struct {
+	Name    string
+	Equals  string
+	Matches string
+}
+
+// readCondition reads a plugin's 'when' section, returning nil if it has
+// none.
+func readCondition(configSection *config.Section) (*requestCondition, error) {
+	var condition *requestCondition
+	err := config.ParseOptional(configSection, "when", func(_ string, when ConfigCondition) error {
+		condition = &requestCondition{
+			pathPrefix: when.PathPrefix,
+		}
+
+		if when.Path != "" {
+			path, err := regexp.Compile(when.Path)
+			if err != nil {
+				return fmt.Errorf(`Could not compile path regular expression "%v": %v`, when.Path, err)
+			}
+			condition.path = path
+		}
+
+		for _, method := range when.Methods {
+			if method == "" || strings.ContainsAny(method, " \t") {
+				return fmt.Errorf(`Invalid method "%v": must be an HTTP method`, method)
+			}
+			condition.methods = append(condition.methods, strings.ToUpper(method))
+		}
+
+		for _, header := range when.Headers {
+			if header.Name == "" {
+				return fmt.Errorf("Header conditions must have a name")
+			}
+			if header.Equals != "" && header.Matches != "" {
+				return fmt.Errorf(`Header condition for "%v" can't have both "equals" and "matches"`, header.Name)
+			}
+			headerCondition := &headerCondition{
+				name:   http.CanonicalHeaderKey(header.Name),
+				equals: header.Equals,
+			}
+			if header.Matches != "" {
+				matches, err := regexp.Compile(header.Matches)
+				if err != nil {
+					return fmt.Errorf(`Could not compile regular expression "%v" for header "%v": %v`, header.Matches, header.Name, err)
+				}
+				headerCondition.matches = matches
+			}
+			condition.headers = append(condition.headers, headerCondition)
+		}
+
+		for _, contentType := range when.ContentTypes {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				return fmt.Errorf(`Invalid content type "%v": %v`, contentType, err)
+			}
+			condition.contentTypes = append(condition.contentTypes, mediaType)
+		}
+
+		if condition.pathPrefix == "" && condition.path == nil && condition.methods == nil &&
+			condition.headers == nil && condition.contentTypes == nil {
+			return fmt.Errorf("Must have at least one condition")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return condition, nil
+}
+
+// requestCondition implements traffic.RequestCondition for a 'when' section.
+type requestCondition struct {
+	pathPrefix   string
+	path         *regexp.Regexp
+	methods      []string
+	headers      []*headerCondition
+	contentTypes []string // Media types, without parameters, like "application/json".
+}
+
+type headerCondition struct {
+	name    string
+	equals  string
+	matches *regexp.Regexp
+}
+
+func (condition *requestCondition) Matches(request *http.Request) bool {
+	if condition.pathPrefix != "" && !strings.HasPrefix(request.URL.Path, condition.pathPrefix) {
+		return false
+	}
+	if condition.path != nil && !condition.path.MatchString(request.URL.Path) {
+		return false
+	}
+	if condition.methods != nil && !slices.Contains(condition.methods, request.Method) {
+		return false
+	}
+	for _, header := range condition.headers {
+		if !header.matchesAny(request.Header.Values(header.name)) {
+			return false
+		}
+	}
+	if condition.contentTypes != nil {
+		mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+		if err != nil || !slices.Contains(condition.contentTypes, mediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the condition for the log.
+func (condition *requestCondition) String() string {
+	parts := []string{}
+	if condition.pathPrefix != "" {
+		parts = append(parts, fmt.Sprintf(`path starts with "%v"`, condition.pathPrefix))
+	}
+	if condition.path != nil {
+		parts = append(parts, fmt.Sprintf(`path matches "%v"`, condition.path))
+	}
+	if condition.methods != nil {
+		parts = append(parts, fmt.Sprintf("method is %v", strings.Join(condition.methods, " or ")))
+	}
+	for _, header := range condition.headers {
+		switch {
+		case header.matches != nil:
+			parts = append(parts, fmt.Sprintf(`%v matches "%v"`, header.name, header.matches))
+		case header.equals != "":
+			parts = append(parts, fmt.Sprintf(`%v is "%v"`, header.name, header.equals))
+		default:
+			parts = append(parts, fmt.Sprintf("%v is present", header.name))
+		}
+	}
+	if condition.contentTypes != nil {
+		parts = append(parts, fmt.Sprintf("content type is %v", strings.Join(condition.contentTypes, " or ")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matchesAny returns true if any of a header's values match.
+func (header *headerCondition) matchesAny(values []string) bool {
+	for _, value := range values {
+		switch {
+		case header.matches != nil:
+			if header.matches.MatchString(value) {
+				return true
+			}
+		case header.equals != "":
+			if value == header.equals {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
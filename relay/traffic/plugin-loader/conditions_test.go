@@ -0,0 +1,243 @@
+package plugin_loader_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/immersa-co/relay-core/catcher"
+	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/config"
+	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
+	not_found_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/not-found-plugin"
+	"github.com/immersa-co/relay-core/relay/test"
+	"github.com/immersa-co/relay-core/relay/traffic"
+	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
+	"golang.org/x/net/websocket"
+)
+
+func TestConditions(t *testing.T) {
+	// The not-found plugin rejects every request it handles, so requests are
+	// only relayed if its conditions don't match.
+	testCases := []struct {
+		desc           string
+		when           string
+		method         string
+		path           string
+		header         http.Header
+		expectRejected bool
+	}{
+		{
+			desc:           "Path prefixes match",
+			when:           "path-prefix: /ingest/",
+			path:           "/ingest/events",
+			expectRejected: true,
+		},
+		{
+			desc: "Path prefixes don't match other paths",
+			when: "path-prefix: /ingest/",
+			path: "/ingestion",
+		},
+		{
+			desc:           "Path expressions match",
+			when:           `path: '^/v\d+/events$'`,
+			path:           "/v2/events",
+			expectRejected: true,
+		},
+		{
+			desc: "Path expressions don't match other paths",
+			when: `path: '^/v\d+/events$'`,
+			path: "/v2/events/1",
+		},
+		{
+			desc:           "Methods match in any case",
+			when:           "methods: [put, POST]",
+			method:         "POST",
+			expectRejected: true,
+		},
+		{
+			desc:   "Methods don't match other methods",
+			when:   "methods: [PUT, POST]",
+			method: "GET",
+		},
+		{
+			desc:           "Headers may equal a value",
+			when:           "headers: [{name: x-tenant, equals: acme}]",
+			header:         http.Header{"X-Tenant": {"acme"}},
+			expectRejected: true,
+		},
+		{
+			desc:   "Headers must equal the value exactly",
+			when:   "headers: [{name: X-Tenant, equals: acme}]",
+			header: http.Header{"X-Tenant": {"acme-staging"}},
+		},
+		{
+			desc:           "Headers may match an expression",
+			when:           "headers: [{name: User-Agent, matches: '(?i)bot'}]",
+			header:         http.Header{"User-Agent": {"ExampleBot/1.0"}},
+			expectRejected: true,
+		},
+		{
+			desc:           "Headers may just be present",
+			when:           "headers: [{name: X-Debug}]",
+			header:         http.Header{"X-Debug": {""}},
+			expectRejected: true,
+		},
+		{
+			desc: "Missing headers don't match",
+			when: "headers: [{name: X-Debug}]",
+		},
+		{
+			desc:           "Content types match without parameters",
+			when:           "content-types: [application/json, text/plain]",
+			method:         "POST",
+			header:         http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			expectRejected: true,
+		},
+		{
+			desc:   "Content types don't match other types",
+			when:   "content-types: [application/json]",
+			method: "POST",
+			header: http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			desc:           "Every condition must match",
+			when:           "path-prefix: /ingest/\n        methods: [POST]",
+			method:         "POST",
+			path:           "/ingest/events",
+			expectRejected: true,
+		},
+		{
+			desc:   "Requests which match some conditions don't match",
+			when:   "path-prefix: /ingest/\n        methods: [POST]",
+			method: "GET",
+			path:   "/ingest/events",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		not_found_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		configYaml := strings.Join([]string{
+			"relay:",
+			"    debug-headers: true",
+			"not-found:",
+			"    paths: ['.*']",
+			"    when:",
+			"        " + testCase.when,
+		}, "\n")
+
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			method := testCase.method
+			if method == "" {
+				method = "GET"
+			}
+			request, _ := http.NewRequest(method, relayService.HttpUrl()+testCase.path, strings.NewReader("{}"))
+			for name, values := range testCase.header {
+				request.Header[name] = values
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if rejected := response.StatusCode == http.StatusNotFound; rejected != testCase.expectRejected {
+				t.Errorf("Test '%v': Expected the plugin to handle the request: %v, but got status %v", testCase.desc, testCase.expectRejected, response.StatusCode)
+			}
+			expectedDecision := "not-found=skipped"
+			if testCase.expectRejected {
+				expectedDecision = "not-found=serviced"
+			}
+			if decision := response.Header.Get(traffic.DebugPluginsHeaderName); decision != expectedDecision {
+				t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, traffic.DebugPluginsHeaderName, expectedDecision, decision)
+			}
+		})
+	}
+}
+
+func TestConditionsApplyToWebsocketConnections(t *testing.T) {
+	// block-content handles websocket messages as a WsPlugin, so its
+	// condition is matched against the upgrade request of the catcher's /echo
+	// endpoint.
+	testCases := []struct {
+		desc     string
+		when     string
+		expected string
+	}{
+		{
+			desc:     "Matching connections are handled",
+			when:     "path-prefix: /echo",
+			expected: "****** content",
+		},
+		{
+			desc:     "Other connections aren't handled",
+			when:     "path-prefix: /ingest/",
+			expected: "SECRET content",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		content_blocker_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		configYaml := strings.Join([]string{
+			"block-content:",
+			"    body:",
+			"        - mask: SECRET",
+			"    when:",
+			"        " + testCase.when,
+		}, "\n")
+
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+
+			if err := websocket.Message.Send(ws, "SECRET content"); err != nil {
+				t.Errorf("Test '%v': Error sending websocket message: %v", testCase.desc, err)
+				return
+			}
+			var received string
+			if err := websocket.Message.Receive(ws, &received); err != nil {
+				t.Errorf("Test '%v': Error receiving websocket message: %v", testCase.desc, err)
+				return
+			}
+			if received != testCase.expected {
+				t.Errorf("Test '%v': Expected websocket message '%v' but got '%v'", testCase.desc, testCase.expected, received)
+			}
+		})
+	}
+}
+
+func TestConditionConfigValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"when: /ingest/",
+		"when: {}",
+		"when: {path: '('}",
+		"when: {methods: ['GET POST']}",
+		"when: {headers: [{equals: acme}]}",
+		"when: {headers: [{name: X-Tenant, equals: acme, matches: acme}]}",
+		"when: {headers: [{name: X-Tenant, matches: '('}]}",
+		"when: {content-types: ['application json']}",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString("not-found:\n    paths: ['.*']\n    " + invalidConfig + "\n")
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := plugin_loader.LoadPlugin(not_found_plugin.Factory, configFile, &traffic.OutboundHeaderPolicy{}); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
@@ -2,44 +2,81 @@ package plugin_loader
 
 import (
 	"fmt"
-	"log"
-	"os"
 
 	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/logging"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
-var logger = log.New(os.Stdout, "[traffic-plugin-loader] ", 0)
+var logger = logging.New("traffic-plugin-loader")
 
 // Load creates and configures a set of traffic plugins.
 func Load(
 	pluginFactories []traffic.PluginFactory,
 	configFile *config.File,
 ) ([]traffic.Plugin, error) {
+	outboundHeaderPolicy, err := traffic.ReadOutboundHeaderPolicy(configFile)
+	if err != nil {
+		return nil, err
+	}
+
 	trafficPlugins := []traffic.Plugin{}
 
 	for _, factory := range pluginFactories {
-		logger.Printf("Loading plugin: %s\n", factory.Name())
-
-		if !pluginFactoryIsRegistered(factory) {
-			return nil, fmt.Errorf(`Traffic plugin "%v" is not registered; add it to registry.go.`, factory.Name())
-		}
-
-		plugin, err := factory.New(configFile.GetOrAddSection(factory.Name()))
+		plugin, err := LoadPlugin(factory, configFile, outboundHeaderPolicy)
 		if err != nil {
-			return nil, fmt.Errorf("Traffic plugin \"%v\" configuration error: %v", factory.Name(), err)
+			return nil, err
 		}
 
 		if plugin == nil {
 			continue // This plugin is inactive.
 		}
-
 		trafficPlugins = append(trafficPlugins, plugin)
 	}
 
 	return trafficPlugins, nil
 }
 
+// LoadPlugin creates and configures a single traffic plugin, returning nil if
+// the plugin is inactive given the configuration.
+func LoadPlugin(
+	factory traffic.PluginFactory,
+	configFile *config.File,
+	outboundHeaderPolicy *traffic.OutboundHeaderPolicy,
+) (traffic.Plugin, error) {
+	logger.Printf("Loading plugin: %s\n", factory.Name())
+
+	if !pluginFactoryIsRegistered(factory) {
+		return nil, fmt.Errorf(`Traffic plugin "%v" is not registered; add it to registry.go.`, factory.Name())
+	}
+
+	configSection := configFile.GetOrAddSection(factory.Name())
+	condition, err := readCondition(configSection)
+	if err != nil {
+		return nil, fmt.Errorf("Traffic plugin \"%v\" configuration error: %v", factory.Name(), err)
+	}
+
+	plugin, err := factory.New(configSection)
+	if err != nil {
+		return nil, fmt.Errorf("Traffic plugin \"%v\" configuration error: %v", factory.Name(), err)
+	}
+
+	if plugin == nil {
+		return nil, nil
+	}
+	if outboundPlugin, ok := plugin.(traffic.OutboundHeaderPlugin); ok {
+		outboundPlugin.SetOutboundHeaderPolicy(outboundHeaderPolicy)
+	}
+
+	// Plugins with a 'when' section only handle the requests it matches.
+	if condition != nil {
+		logger.Printf("Plugin %s only handles requests where %v\n", factory.Name(), condition)
+		return &traffic.ConditionalPlugin{Plugin: plugin, Condition: condition}, nil
+	}
+
+	return plugin, nil
+}
+
 // pluginFactoryIsRegistered returns true if the provided plugin factory appears
 // in one of the groups of traffic plugins in registry.go. Checking this helps
 // ensure that newly-developed plugins get registered and are available for use
@@ -1,26 +1,89 @@
 package plugin_loader
 
 import (
+	access_log_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/access-log-plugin"
+	aggregate_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/aggregate-plugin"
+	anomaly_alert_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/anomaly-alert-plugin"
+	anonymous_id_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/anonymous-id-plugin"
+	api_keys_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/api-keys-plugin"
+	batch_split_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/batch-split-plugin"
+	body_encryption_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/body-encryption-plugin"
+	cache_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/cache-plugin"
 	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
 	content_enricher_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-enricher-plugin"
 	cookies_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/cookies-plugin"
+	csp_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/csp-plugin"
+	dedupe_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/dedupe-plugin"
+	external_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/external-plugin"
 	headers_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/headers-plugin"
+	not_found_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/not-found-plugin"
 	paths_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/paths-plugin"
+	rate_limit_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/rate-limit-plugin"
+	request_signing_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/request-signing-plugin"
+	script_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/script-plugin"
 	segment_proxy_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/segment-proxy-plugin"
+	static_assets_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/static-assets-plugin"
+	store_forward_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/store-forward-plugin"
+	synthetic_check_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/synthetic-check-plugin"
 	test_interceptor_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/test-interceptor-plugin"
+	tracing_headers_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/tracing-headers-plugin"
+	upstream_auth_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/upstream-auth-plugin"
+	wasm_filter_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/wasm-filter-plugin"
+	websocket_recorder_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/websocket-recorder-plugin"
 	"github.com/immersa-co/relay-core/relay/traffic"
 )
 
 // DefaultPlugins is a plugin registry containing all traffic plugins that
 // should be available in production. These are the plugins that the relay loads
-// on startup.
+// on startup. Plugins handle requests in this order.
 var DefaultPlugins = []traffic.PluginFactory{
+	// Rate limiting comes first, so that rejected requests cost as little as
+	// possible, and so that it sees client addresses before anonymous-id can
+	// remove them.
+	rate_limit_plugin.Factory,
+	// API keys are checked next, after rate limiting has seen the key header,
+	// and before any plugin does work for clients without a valid key.
+	api_keys_plugin.Factory,
+	// Duplicates are answered before any plugin does work for them, but only
+	// requests which were allowed are remembered.
+	dedupe_plugin.Factory,
+	access_log_plugin.Factory,
+	anomaly_alert_plugin.Factory,
+	anonymous_id_plugin.Factory,
 	content_blocker_plugin.Factory,
 	content_enricher_plugin.Factory,
 	cookies_plugin.Factory,
+	csp_plugin.Factory,
 	headers_plugin.Factory,
+	not_found_plugin.Factory,
 	paths_plugin.Factory,
 	segment_proxy_plugin.Factory,
+	static_assets_plugin.Factory,
+	synthetic_check_plugin.Factory,
+	tracing_headers_plugin.Factory,
+	upstream_auth_plugin.Factory,
+	websocket_recorder_plugin.Factory,
+	// Scripts, external plugins, and WASM filters run after the built-in
+	// plugins which modify requests, and before any which encrypt or sign
+	// them, so that they see and can change what the target will receive.
+	script_plugin.Factory,
+	external_plugin.Factory,
+	wasm_filter_plugin.Factory,
+	// Body encryption comes after every plugin which reads or modifies bodies,
+	// so that they see plaintext.
+	body_encryption_plugin.Factory,
+	// Requests are signed once every plugin which modifies them has run, so
+	// the signature covers what the target receives.
+	request_signing_plugin.Factory,
+	// Responses are cached by the request which would be relayed, once every
+	// plugin which modifies requests has run.
+	cache_plugin.Factory,
+	// Aggregation, batch splitting, and store-and-forward send requests to the
+	// target themselves, so they come last, after every other plugin has
+	// modified the request.
+	aggregate_plugin.Factory,
+	batch_split_plugin.Factory,
+	store_forward_plugin.Factory,
 }
 
 // TestPlugins is a plugin registry containing test-only traffic plugins. These
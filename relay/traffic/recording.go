@@ -0,0 +1,549 @@
+package traffic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/immersa-co/relay-core/relay/storage"
+	"github.com/immersa-co/relay-core/relay/version"
+)
+
+// RecordingFormat is the format of a file to which relayed requests are
+// recorded.
+type RecordingFormat string
+
+const (
+	// RecordingFramed files hold one frame per request: a line giving the
+	// sizes of the request's metadata and body, the metadata as JSON, the
+	// body as it was sent, and a newline. They can be appended to cheaply,
+	// and hold binary bodies as they are.
+	RecordingFramed RecordingFormat = "framed"
+	// RecordingHAR files are HTTP Archives, which browsers' developer tools
+	// and many other tools can open. They're complete once the Recorder is
+	// closed.
+	RecordingHAR RecordingFormat = "har"
+)
+
+// ParseRecordingFormat returns the recording format with the provided name.
+func ParseRecordingFormat(name string) (RecordingFormat, error) {
+	switch format := RecordingFormat(name); format {
+	case RecordingFramed, RecordingHAR:
+		return format, nil
+	}
+	return "", fmt.Errorf(`Invalid recording format "%v": must be "framed" or "har"`, name)
+}
+
+// RecorderOptions configures a Recorder.
+type RecorderOptions struct {
+	Store         *storage.Store  // Where recordings are written, encrypted if it's configured to. Each Recorder writes a new one.
+	Format        RecordingFormat // If empty, RecordingFramed is used.
+	RedactHeaders []string        // Additional headers which are removed from recorded requests.
+	MaxBodyBytes  int64           // Longer bodies are truncated. If zero, DefaultRecordingMaxBodyBytes is used.
+}
+
+const DefaultRecordingMaxBodyBytes int64 = 1024 * 1024 // 1MB
+
+// RecordedRequest is a request which the relay sent to the target, along with
+// the outcome.
+type RecordedRequest struct {
+	Time          time.Time     `json:"time"`
+	Duration      time.Duration `json:"duration"` // How long the target took to respond, including any retries.
+	Method        string        `json:"method"`
+	URL           string        `json:"url"`
+	Host          string        `json:"host"`
+	Header        http.Header   `json:"header"`
+	Body          []byte        `json:"-"` // Encoded as described by the Content-Encoding header.
+	BodyTruncated bool          `json:"body_truncated,omitempty"`
+	Status        int           `json:"status,omitempty"` // The target's response status, if it responded.
+	Error         string        `json:"error,omitempty"`  // Why the target couldn't be reached, if it couldn't.
+}
+
+// Request reconstructs the recorded request.
+func (record *RecordedRequest) Request() (*http.Request, error) {
+	request, err := http.NewRequest(record.Method, record.URL, bytes.NewReader(record.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Host = record.Host
+	for name, values := range record.Header {
+		request.Header[name] = append([]string{}, values...)
+	}
+	request.ContentLength = int64(len(record.Body))
+	request.Header.Del("Content-Length")
+	if len(record.Body) > 0 {
+		request.Header.Set("Content-Length", strconv.Itoa(len(record.Body)))
+	}
+	return request, nil
+}
+
+// Recorder records requests as the relay sends them to the target, after
+// plugins have processed them, so that they can be inspected or replayed
+// later. Like dead letters, recorded requests are sanitized: credential
+// headers, and any listed in RedactHeaders, are removed. A Recorder may be
+// shared by several handlers.
+type Recorder struct {
+	options RecorderOptions
+	name    string
+
+	mutex      sync.Mutex
+	writer     *storage.Writer
+	harEntries bool // True if the HAR file already holds entries.
+}
+
+const (
+	framePrefix         = "relay-record"
+	harHeader           = `{"log":{"version":"1.2","creator":{"name":"relay","version":"%s"},"entries":[`
+	harTrailer          = "\n]}}\n"
+	recordingTimeFormat = "20060102T150405.000000000Z"
+)
+
+// NewRecorder creates a new recording in the store, named for the time at
+// which it was created. Each request is flushed to the store as it's recorded,
+// so a recording can be read while it's being written, or after the relay
+// stopped without closing it; see ReadRecording.
+func NewRecorder(options RecorderOptions) (*Recorder, error) {
+	if options.Format == "" {
+		options.Format = RecordingFramed
+	}
+	if options.MaxBodyBytes == 0 {
+		options.MaxBodyBytes = DefaultRecordingMaxBodyBytes
+	}
+	recorder := &Recorder{
+		options: options,
+		name:    "requests-" + time.Now().UTC().Format(recordingTimeFormat),
+	}
+
+	writer, err := options.Store.Create(recorder.name)
+	if err != nil {
+		return nil, fmt.Errorf(`Couldn't create recording "%v": %v`, recorder.name, err)
+	}
+	if options.Format == RecordingHAR {
+		if _, err := fmt.Fprintf(writer, harHeader, version.RelayRelease); err != nil {
+			writer.Close()
+			return nil, fmt.Errorf(`Couldn't create recording "%v": %v`, recorder.name, err)
+		}
+	}
+	recorder.writer = writer
+	return recorder, nil
+}
+
+// Name returns the name under which the recording is stored.
+func (recorder *Recorder) Name() string {
+	return recorder.name
+}
+
+// Close completes the recording. Requests which are sent afterwards aren't
+// recorded.
+func (recorder *Recorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.options.Format == RecordingHAR {
+		if _, err := io.WriteString(recorder.writer, harTrailer); err != nil {
+			recorder.writer.Close()
+			return err
+		}
+	}
+	return recorder.writer.Close()
+}
+
+// record adds a request which was sent to the target, along with its response
+// status or the error which prevented it from being delivered.
+func (recorder *Recorder) record(request *http.Request, readBody func() ([]byte, error), start time.Time, duration time.Duration, status int, deliveryErr error) {
+	record := &RecordedRequest{
+		Time:     start,
+		Duration: duration,
+		Method:   request.Method,
+		URL:      request.URL.String(),
+		Host:     request.Host,
+		Header:   request.Header.Clone(),
+		Status:   status,
+	}
+	if deliveryErr != nil {
+		record.Error = deliveryErr.Error()
+	}
+	for _, name := range deadLetterRemovedHeaders {
+		record.Header.Del(name)
+	}
+	for _, name := range recorder.options.RedactHeaders {
+		record.Header.Del(name)
+	}
+
+	if body, err := recorder.readBody(request, readBody); err != nil {
+		logger.Errorf("Error reading body of recorded request: %s", err)
+		record.BodyTruncated = true
+	} else if int64(len(body)) > recorder.options.MaxBodyBytes {
+		record.Body = body[:recorder.options.MaxBodyBytes]
+		record.BodyTruncated = true
+	} else {
+		record.Body = body
+	}
+
+	var err error
+	if recorder.options.Format == RecordingHAR {
+		err = recorder.writeHAR(record)
+	} else {
+		err = recorder.writeFrame(record)
+	}
+	if err != nil {
+		logger.Errorf("Error recording request: %s", err)
+	}
+}
+
+// readBody returns the request's body. Only as much of spooled bodies as is
+// recorded is read, since they may be too large to hold in memory; others
+// already are.
+func (recorder *Recorder) readBody(request *http.Request, readBody func() ([]byte, error)) ([]byte, error) {
+	body, ok := request.Body.(*BodyReader)
+	if !ok || request.ContentLength <= recorder.options.MaxBodyBytes {
+		return readBody()
+	}
+	reader := body.Reopen()
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, recorder.options.MaxBodyBytes+1))
+}
+
+func (recorder *Recorder) writeFrame(record *RecordedRequest) error {
+	metadata, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var frame bytes.Buffer
+	fmt.Fprintf(&frame, "%s %d %d\n", framePrefix, len(metadata), len(record.Body))
+	frame.Write(metadata)
+	frame.Write(record.Body)
+	frame.WriteByte('\n')
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if _, err := recorder.writer.Write(frame.Bytes()); err != nil {
+		return err
+	}
+	return recorder.writer.Flush()
+}
+
+func (recorder *Recorder) writeHAR(record *RecordedRequest) error {
+	entry, err := json.Marshal(newHAREntry(record))
+	if err != nil {
+		return err
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	var data bytes.Buffer
+	if recorder.harEntries {
+		data.WriteByte(',')
+	}
+	data.WriteByte('\n')
+	data.Write(entry)
+	if _, err := recorder.writer.Write(data.Bytes()); err != nil {
+		return err
+	}
+	recorder.harEntries = true
+	return recorder.writer.Flush()
+}
+
+// The subset of the HAR 1.2 format which recordings use. Fields which HAR
+// doesn't define begin with an underscore, as the format requires.
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // In milliseconds.
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"` // "base64" for bodies which aren't UTF-8 text.
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newHAREntry(record *RecordedRequest) *harEntry {
+	milliseconds := float64(record.Duration) / float64(time.Millisecond)
+	entry := &harEntry{
+		StartedDateTime: record.Time,
+		Time:            milliseconds,
+		Request: harRequest{
+			Method:      record.Method,
+			URL:         record.URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{{Name: "Host", Value: record.Host}},
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(record.Body),
+		},
+		Response: harResponse{
+			Status:      record.Status,
+			StatusText:  http.StatusText(record.Status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Wait: milliseconds},
+		Error:   record.Error,
+	}
+	for name, values := range record.Header {
+		for _, value := range values {
+			entry.Request.Headers = append(entry.Request.Headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	if parsedURL, err := url.Parse(record.URL); err == nil {
+		for name, values := range parsedURL.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	if len(record.Body) > 0 || record.BodyTruncated {
+		postData := &harPostData{
+			MimeType:  record.Header.Get("Content-Type"),
+			Truncated: record.BodyTruncated,
+		}
+		if utf8.Valid(record.Body) && record.Header.Get("Content-Encoding") == "" {
+			postData.Text = string(record.Body)
+		} else {
+			postData.Text = base64.StdEncoding.EncodeToString(record.Body)
+			postData.Encoding = "base64"
+		}
+		entry.Request.PostData = postData
+	}
+	return entry
+}
+
+func (entry *harEntry) recordedRequest() (*RecordedRequest, error) {
+	record := &RecordedRequest{
+		Time:     entry.StartedDateTime,
+		Duration: time.Duration(entry.Time * float64(time.Millisecond)),
+		Method:   entry.Request.Method,
+		URL:      entry.Request.URL,
+		Header:   http.Header{},
+		Status:   entry.Response.Status,
+		Error:    entry.Error,
+	}
+	for _, header := range entry.Request.Headers {
+		if http.CanonicalHeaderKey(header.Name) == "Host" {
+			record.Host = header.Value
+			continue
+		}
+		record.Header.Add(header.Name, header.Value)
+	}
+	if postData := entry.Request.PostData; postData != nil {
+		record.BodyTruncated = postData.Truncated
+		if postData.Encoding == "base64" {
+			body, err := base64.StdEncoding.DecodeString(postData.Text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid body for %v %v: %v", record.Method, record.URL, err)
+			}
+			record.Body = body
+		} else {
+			record.Body = []byte(postData.Text)
+		}
+	}
+	return record, nil
+}
+
+// ReadRecording reads a recording in either format, calling handle with each
+// request in turn. Framed recordings are read as they're handled; HAR files
+// are read in full first. Recordings which are still being written, or which
+// the relay stopped without closing, are read as far as they go, and then
+// storage.ErrUnfinished is returned.
+func ReadRecording(reader io.Reader, handle func(*RecordedRequest) error) error {
+	buffered := bufio.NewReader(reader)
+	first, err := buffered.Peek(1)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if first[0] == '{' {
+		data, readErr := io.ReadAll(buffered)
+		if readErr != nil && !errors.Is(readErr, storage.ErrUnfinished) {
+			return readErr
+		}
+		har := &harFile{}
+		if err := json.Unmarshal(data, har); err != nil {
+			// Unfinished HAR files lack the trailer which the Recorder
+			// writes when it's closed.
+			if json.Unmarshal(append(data, harTrailer...), har) != nil {
+				return fmt.Errorf("Invalid HAR recording: %v", err)
+			}
+			readErr = storage.ErrUnfinished
+		}
+		for i := range har.Log.Entries {
+			record, err := har.Log.Entries[i].recordedRequest()
+			if err != nil {
+				return err
+			}
+			if err := handle(record); err != nil {
+				return err
+			}
+		}
+		return readErr
+	}
+
+	for {
+		record, err := readFrame(buffered)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := handle(record); err != nil {
+			return err
+		}
+	}
+}
+
+func readFrame(reader *bufio.Reader) (*RecordedRequest, error) {
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	} else if errors.Is(err, storage.ErrUnfinished) && line == "" {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid recording: %w", err)
+	}
+	var metadataSize, bodySize int
+	if _, err := fmt.Sscanf(line, framePrefix+" %d %d\n", &metadataSize, &bodySize); err != nil || metadataSize < 0 || bodySize < 0 {
+		return nil, fmt.Errorf("Invalid recording frame %q", line)
+	}
+
+	frame := make([]byte, metadataSize+bodySize+1)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, fmt.Errorf("Invalid recording: truncated frame: %w", err)
+	}
+	record := &RecordedRequest{}
+	if err := json.Unmarshal(frame[:metadataSize], record); err != nil {
+		return nil, fmt.Errorf("Invalid recording: %v", err)
+	}
+	record.Body = frame[metadataSize : metadataSize+bodySize]
+	return record, nil
+}
+
+// ReplayOptions configures ReplayRecording.
+type ReplayOptions struct {
+	Client *http.Client
+	Target *url.URL // If non-nil, its scheme and host replace those the requests were originally sent to.
+	Speed  float64  // How many times faster than they were recorded requests are sent. If zero, they're sent without pauses.
+
+	// If non-nil, Report is called with each request once it has been sent,
+	// along with the status with which the target responded, or the error
+	// which prevented it from being sent.
+	Report func(record *RecordedRequest, status int, err error)
+}
+
+// ReplayRecording sends each request in a recording again, in order, pausing
+// between them as they were originally spaced, divided by the speed. It returns
+// the number of requests sent and the number which couldn't be; failures to
+// send individual requests are reported rather than returned.
+func ReplayRecording(reader io.Reader, options ReplayOptions) (sent int, failed int, err error) {
+	var firstTime time.Time
+	var start time.Time
+	err = ReadRecording(reader, func(record *RecordedRequest) error {
+		if start.IsZero() {
+			firstTime = record.Time
+			start = time.Now()
+		} else if options.Speed > 0 {
+			due := start.Add(time.Duration(float64(record.Time.Sub(firstTime)) / options.Speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		status, err := replayRequest(record, options)
+		if err != nil {
+			failed++
+		} else {
+			sent++
+		}
+		if options.Report != nil {
+			options.Report(record, status, err)
+		}
+		return nil
+	})
+	return sent, failed, err
+}
+
+func replayRequest(record *RecordedRequest, options ReplayOptions) (int, error) {
+	request, err := record.Request()
+	if err != nil {
+		return 0, err
+	}
+	if options.Target != nil {
+		request.URL.Scheme = options.Target.Scheme
+		request.URL.Host = options.Target.Host
+		request.Host = options.Target.Host
+	}
+
+	response, err := options.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	return response.StatusCode, nil
+}
@@ -0,0 +1,126 @@
+package traffic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+// ipResolver looks up the addresses of a host. *net.Resolver implements it.
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ParseDNSServer converts a configured DNS server, an IP address with an
+// optional port, into an address to dial. The port defaults to 53.
+func ParseDNSServer(value string) (string, error) {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.String(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return "", fmt.Errorf(`Invalid DNS server "%v"; expected an IP address, with an optional port`, value)
+	}
+	return netip.AddrPortFrom(addr, 53).String(), nil
+}
+
+// newResolver returns the resolver described by the DialOptions: the system's
+// resolver, or one which queries the DNS servers in options.DNSServers, with
+// its answers cached for options.DNSCacheTTL if that's set.
+func newResolver(options DialOptions, clock clock.Clock) ipResolver {
+	var resolver ipResolver = net.DefaultResolver
+	if len(options.DNSServers) > 0 {
+		resolver = newServerResolver(options.DNSServers)
+	}
+	if options.DNSCacheTTL > 0 {
+		resolver = newCachingResolver(resolver, options.DNSCacheTTL, clock)
+	}
+	return resolver
+}
+
+// newServerResolver returns a resolver which sends its queries to the provided
+// DNS servers rather than those the system is configured with. Each query
+// goes to the next server in turn, so when a query to one server times out,
+// the resolver's retry goes to another.
+func newServerResolver(servers []string) *net.Resolver {
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			var netDialer net.Dialer
+			return netDialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// cachingResolver caches the addresses which another resolver finds for each
+// host, for a fixed TTL, since Go's resolver doesn't report the TTLs of the
+// records it finds. Concurrent lookups of the same host share one query, and
+// failed lookups aren't cached.
+type cachingResolver struct {
+	resolver ipResolver
+	ttl      time.Duration
+	clock    clock.Clock
+
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ready   chan struct{} // Closed once the lookup has finished.
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+func newCachingResolver(resolver ipResolver, ttl time.Duration, clock clock.Clock) *cachingResolver {
+	return &cachingResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		clock:    clock,
+		entries:  map[string]*dnsCacheEntry{},
+	}
+}
+
+func (cache *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	cache.mutex.Lock()
+	entry := cache.entries[host]
+	if entry == nil || cache.stale(entry) {
+		entry = &dnsCacheEntry{ready: make(chan struct{})}
+		cache.entries[host] = entry
+		cache.mutex.Unlock()
+
+		// The query is shared, so it isn't canceled along with the request
+		// which happened to start it.
+		entry.addrs, entry.err = cache.resolver.LookupIPAddr(context.WithoutCancel(ctx), host)
+		entry.expires = cache.clock.Now().Add(cache.ttl)
+		close(entry.ready)
+	} else {
+		cache.mutex.Unlock()
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stale returns true if an entry's lookup has finished, and either failed or
+// expired. The mutex must be held.
+func (cache *cachingResolver) stale(entry *dnsCacheEntry) bool {
+	select {
+	case <-entry.ready:
+		return entry.err != nil || !cache.clock.Now().Before(entry.expires)
+	default:
+		return false
+	}
+}
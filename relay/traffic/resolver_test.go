@@ -0,0 +1,189 @@
+package traffic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// countingResolver answers every lookup with 192.0.2.1, or with err if it's
+// set, and counts the lookups. If block is non-nil, lookups wait for it to be
+// closed.
+type countingResolver struct {
+	mutex   sync.Mutex
+	lookups int
+	err     error
+	block   chan struct{}
+}
+
+func (resolver *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	resolver.mutex.Lock()
+	resolver.lookups++
+	err, block := resolver.err, resolver.block
+	resolver.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func (resolver *countingResolver) count() int {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	return resolver.lookups
+}
+
+func TestCachingResolver(t *testing.T) {
+	fakeClock := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	upstream := &countingResolver{}
+	cache := newCachingResolver(upstream, time.Minute, fakeClock)
+
+	lookup := func(host string) error {
+		addrs, err := cache.LookupIPAddr(context.Background(), host)
+		if err == nil && (len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.1") {
+			t.Errorf("Unexpected addresses for %v: %v", host, addrs)
+		}
+		return err
+	}
+
+	lookup("example.com")
+	lookup("example.com")
+	if count := upstream.count(); count != 1 {
+		t.Errorf("Expected 1 lookup while cached but got %v", count)
+	}
+
+	lookup("example.org")
+	if count := upstream.count(); count != 2 {
+		t.Errorf("Expected each host to be looked up but got %v lookups", count)
+	}
+
+	fakeClock.Advance(time.Minute)
+	lookup("example.com")
+	if count := upstream.count(); count != 3 {
+		t.Errorf("Expected an expired entry to be looked up again but got %v lookups", count)
+	}
+
+	upstream.err = errors.New("no such host")
+	fakeClock.Advance(time.Minute)
+	if err := lookup("example.com"); err == nil {
+		t.Errorf("Expected the failed lookup's error")
+	}
+	upstream.err = nil
+	if err := lookup("example.com"); err != nil {
+		t.Errorf("Expected failed lookups not to be cached but got: %v", err)
+	}
+}
+
+func TestCachingResolverSharesConcurrentLookups(t *testing.T) {
+	upstream := &countingResolver{block: make(chan struct{})}
+	cache := newCachingResolver(upstream, time.Minute, clock.Real)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := cache.LookupIPAddr(context.Background(), "example.com"); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+
+	// A waiting lookup gives up when its context does.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for upstream.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := cache.LookupIPAddr(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the lookup to time out but got: %v", err)
+	}
+
+	close(upstream.block)
+	wait.Wait()
+	if count := upstream.count(); count != 1 {
+		t.Errorf("Expected concurrent lookups to share a query but got %v", count)
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	for value, expected := range map[string]string{
+		"10.0.0.2":        "10.0.0.2:53",
+		"10.0.0.2:5353":   "10.0.0.2:5353",
+		"2001:db8::1":     "[2001:db8::1]:53",
+		"[2001:db8::1]:5": "[2001:db8::1]:5",
+	} {
+		if server, err := ParseDNSServer(value); err != nil {
+			t.Errorf("Unexpected error parsing '%v': %v", value, err)
+		} else if server != expected {
+			t.Errorf("Expected '%v' to parse as '%v' but got '%v'", value, expected, server)
+		}
+	}
+	if _, err := ParseDNSServer("dns.example.com"); err == nil {
+		t.Errorf("Expected a host name to be rejected")
+	}
+}
+
+// serveDNS answers A queries on a local UDP port with 192.0.2.53, and any
+// other queries with no records, returning the server's address.
+func serveDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			question := query.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			if question.Type == dnsmessage.TypeA {
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}},
+				}}
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestServerResolver(t *testing.T) {
+	resolver := newResolver(DialOptions{DNSServers: []string{serveDNS(t)}}, clock.Real)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, "target.example.test")
+	if err != nil {
+		t.Fatalf("Error resolving: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.53" {
+		t.Errorf("Expected the configured server's answer but got %v", addrs)
+	}
+}
@@ -0,0 +1,121 @@
+package traffic
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// AttemptsHeaderName is added to responses to requests which the relay was
+// configured to retry, recording how many times the request was sent to the
+// target.
+const AttemptsHeaderName = "X-Relay-Attempts"
+
+// RetryOptions controls how the relay retries idempotent requests which fail
+// because the target couldn't be reached or responded with a 502, 503, or 504.
+// Only GET and HEAD requests without bodies are retried. The delay before each
+// retry doubles, starting from InitialBackoff, up to MaxBackoff; a random
+// jitter of up to half the delay is subtracted, so that clients which failed
+// together don't retry together.
+type RetryOptions struct {
+	MaxAttempts    int           // Total attempts per request, including the first. Retries are disabled if this is less than 2.
+	InitialBackoff time.Duration // The delay before the first retry.
+	MaxBackoff     time.Duration // The maximum delay between attempts.
+	MaxElapsed     time.Duration // If non-zero, no attempt starts after this much time has passed since the first. Zero means no limit.
+}
+
+const (
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 2 * time.Second
+)
+
+func (options *RetryOptions) enabled() bool {
+	return options.MaxAttempts > 1
+}
+
+// backoff returns the delay before the given retry, where the first retry is
+// retry 1.
+func (options *RetryOptions) backoff(retry int) time.Duration {
+	initialBackoff := options.InitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = DefaultRetryInitialBackoff
+	}
+	maxBackoff := options.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+
+	delay := initialBackoff
+	for i := 1; i < retry && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxBackoff)
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryable returns true if the request may safely be sent to the target
+// more than once.
+func isRetryable(request *http.Request) bool {
+	return (request.Method == http.MethodGet || request.Method == http.MethodHead) && request.ContentLength == 0
+}
+
+// isRetryableStatus returns true for statuses which indicate that the target,
+// or a proxy in front of it, was temporarily unable to handle the request.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// roundTrip sends the request to the target, retrying it according to the
+// retry options if it's idempotent. It returns the target's final response or
+// error, along with the number of attempts made. Backoff delays are measured
+// using the real time, since they're spent actually waiting.
+func (handler *Handler) roundTrip(clientRequest *http.Request) (*http.Response, int, error) {
+	options := &handler.config.Retries
+	if !options.enabled() || !isRetryable(clientRequest) {
+		response, err := handler.sendToTarget(clientRequest, 1)
+		return response, 1, err
+	}
+
+	// The body is empty, but it may have been wrapped while the relay was
+	// preparing it; replace it so that it can be sent again.
+	clientRequest.Body = http.NoBody
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		response, err := handler.sendToTarget(clientRequest, attempt)
+		if err == nil && !isRetryableStatus(response.StatusCode) {
+			return response, attempt, nil
+		}
+		if attempt >= options.MaxAttempts || clientRequest.Context().Err() != nil {
+			// Don't retry requests which the client has given up on.
+			return response, attempt, err
+		}
+
+		delay := options.backoff(attempt)
+		if options.MaxElapsed > 0 && time.Since(start)+delay > options.MaxElapsed {
+			return response, attempt, err
+		}
+
+		if err != nil {
+			logger.Printf("Retrying %v %v after error: %v", clientRequest.Method, clientRequest.URL, err)
+		} else {
+			logger.Printf("Retrying %v %v after status %v", clientRequest.Method, clientRequest.URL, response.StatusCode)
+			// Read the body so that the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(response.Body, handler.config.MaxBodySize))
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-clientRequest.Context().Done():
+			timer.Stop()
+			return nil, attempt, clientRequest.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package traffic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Server-Sent Events responses (text/event-stream) stay open for as long as
+// the target has events to send, so they can't be buffered, decoded, or held
+// to MaxBodySize and MaxResponseSize like other responses. They're always
+// streamed to the client as the target sends them, and response plugins see
+// them without their body, as they do partial responses.
+//
+// Plugins which need to inspect or redact the events themselves may implement
+// ServerSentEventPlugin. The stream is then parsed into events, which are
+// passed to plugins and relayed one at a time, so only a single event is
+// buffered at once.
+
+// ServerSentEvent is a single event from a text/event-stream response.
+type ServerSentEvent struct {
+	// The event's lines, in order and without their line endings, like
+	// "event: update" or "data: {...}". Comments, which start with a colon,
+	// are included. Plugins may modify, remove, or add lines.
+	Lines []string
+
+	// If a plugin sets Drop, the event isn't relayed to the client.
+	Drop bool
+}
+
+// ServerSentEventPlugin is an optional interface which plugins may implement
+// to filter the events of text/event-stream responses. Streams compressed with
+// a Content-Encoding are decoded as they're read, and relayed to the client
+// without it; if the relay can't decode them, the client receives a 502.
+type ServerSentEventPlugin interface {
+	// HandleServerSentEvent is invoked for each event. The request is the one
+	// relayed to the target, after all plugins have handled it.
+	HandleServerSentEvent(request *http.Request, event *ServerSentEvent)
+}
+
+// isEventStream returns true if the response is a stream of Server-Sent
+// Events.
+func isEventStream(response *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+var errServerSentEventTooLarge = errors.New("server-sent event exceeds maximum size")
+
+// relayEventStream streams a text/event-stream response to the client. If any
+// plugin filters events, they're passed through the plugins one at a time, and
+// each must fit within MaxBodySize.
+func (handler *Handler) relayEventStream(clientResponse http.ResponseWriter, targetResponse *http.Response) bool {
+	if len(handler.eventPlugins) == 0 {
+		copyResponseHeaders(clientResponse, targetResponse)
+		limit := targetResponse.ContentLength
+		if limit < 0 {
+			limit = math.MaxInt64
+		}
+		clientResponse.WriteHeader(targetResponse.StatusCode)
+		if _, err := streamResponseBody(clientResponse, targetResponse.Body, limit); err != nil {
+			logger.Errorf("Error relaying event stream to client: %s", err)
+		}
+		return true
+	}
+
+	encoding, err := ParseEncoding(targetResponse.Header.Get("Content-Encoding"))
+	if err != nil {
+		logger.Errorf("Error filtering event stream: %s", err)
+		http.Error(clientResponse, "Error processing response from target", http.StatusBadGateway)
+		return true
+	}
+	body, err := newDecoder(targetResponse.Body, encoding)
+	if err != nil {
+		logger.Errorf("Error decoding event stream: %s", err)
+		http.Error(clientResponse, "Error processing response from target", http.StatusBadGateway)
+		return true
+	}
+	defer body.Close()
+
+	// Plugins may change the length of the stream, which is relayed decoded.
+	copyResponseHeaders(clientResponse, targetResponse)
+	clientResponse.Header().Del("Content-Length")
+	clientResponse.Header().Del("Content-Encoding")
+	clientResponse.WriteHeader(targetResponse.StatusCode)
+	if err := handler.filterEventStream(clientResponse, body, targetResponse.Request); err != nil {
+		logger.Errorf("Error relaying event stream to client: %s", err)
+	}
+	return true
+}
+
+// filterEventStream reads events from the target's stream, passes each through
+// the plugins, and writes those which weren't dropped to the client, flushing
+// after each one.
+func (handler *Handler) filterEventStream(clientResponse http.ResponseWriter, body io.Reader, request *http.Request) error {
+	controller := http.NewResponseController(clientResponse)
+	flush := func() {
+		if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logger.Debugf("Error flushing response: %s", err)
+		}
+	}
+	flush()
+
+	reader := bufio.NewReaderSize(body, streamingBufferSize)
+	for {
+		event, err := readServerSentEvent(reader, handler.config.MaxBodySize)
+		if event != nil {
+			for _, plugin := range handler.eventPlugins {
+				plugin.HandleServerSentEvent(request, event)
+			}
+			if !event.Drop && len(event.Lines) > 0 {
+				if _, err := io.WriteString(clientResponse, formatServerSentEvent(event)); err != nil {
+					return err
+				}
+				flush()
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// readServerSentEvent reads lines up to the blank line which ends an event. It
+// returns the event, if the stream contained any more lines, along with
+// io.EOF once the stream ends. Lines may end in "\n" or "\r\n".
+func readServerSentEvent(reader *bufio.Reader, maxSize int64) (*ServerSentEvent, error) {
+	var lines []string
+	var size int64
+	for {
+		limit := int64(-1)
+		if maxSize > 0 {
+			limit = maxSize - size
+		}
+		line, err := readServerSentEventLine(reader, limit)
+		size += int64(len(line))
+		if errors.Is(err, errServerSentEventTooLarge) {
+			return nil, err
+		}
+		ended := strings.HasSuffix(line, "\n")
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if ended && line == "" {
+			if len(lines) == 0 {
+				// Extra blank lines between events are meaningless.
+				continue
+			}
+			return &ServerSentEvent{Lines: lines}, nil
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			if len(lines) == 0 {
+				return nil, err
+			}
+			if errors.Is(err, io.EOF) {
+				// An event which the stream didn't finish is still relayed.
+				return &ServerSentEvent{Lines: lines}, io.EOF
+			}
+			return nil, fmt.Errorf("error reading event stream: %w", err)
+		}
+	}
+}
+
+// readServerSentEventLine reads a line, including its line ending, returning
+// errServerSentEventTooLarge rather than reading more than limit bytes, unless
+// limit is negative.
+func readServerSentEventLine(reader *bufio.Reader, limit int64) (string, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		line = append(line, fragment...)
+		if limit >= 0 && int64(len(line)) > limit {
+			return "", errServerSentEventTooLarge
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return string(line), err
+		}
+	}
+}
+
+// formatServerSentEvent returns an event's lines, followed by the blank line
+// which ends it.
+func formatServerSentEvent(event *ServerSentEvent) string {
+	var builder strings.Builder
+	for _, line := range event.Lines {
+		builder.WriteString(line)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	return builder.String()
+}
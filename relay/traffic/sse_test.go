@@ -0,0 +1,50 @@
+package traffic
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadServerSentEvent(t *testing.T) {
+	stream := "event: update\r\ndata: one\r\ndata: two\r\n\r\n\n\n: comment\ndata: three\n\ndata: unfinished"
+	reader := bufio.NewReader(strings.NewReader(stream))
+
+	expected := [][]string{
+		{"event: update", "data: one", "data: two"},
+		{": comment", "data: three"},
+		{"data: unfinished"},
+	}
+	for i, expectedLines := range expected {
+		event, err := readServerSentEvent(reader, 0)
+		if i == len(expected)-1 {
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("Expected EOF with the last event but got: %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Error reading event %v: %v", i, err)
+		}
+		if event == nil || !reflect.DeepEqual(event.Lines, expectedLines) {
+			t.Errorf("Expected event %v to have lines %q but got %+v", i, expectedLines, event)
+		}
+	}
+
+	if event, err := readServerSentEvent(reader, 0); event != nil || !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF after the last event but got %+v, %v", event, err)
+	}
+}
+
+func TestReadServerSentEventEnforcesMaxSize(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("data: 12345\ndata: 67890\n\n"))
+	if _, err := readServerSentEvent(reader, 16); err != errServerSentEventTooLarge {
+		t.Errorf("Expected oversized event to be rejected but got: %v", err)
+	}
+
+	reader = bufio.NewReader(strings.NewReader("data: 12345\n\n"))
+	if _, err := readServerSentEvent(reader, 13); err != nil {
+		t.Errorf("Expected event which fits to be read but got: %v", err)
+	}
+}
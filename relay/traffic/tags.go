@@ -0,0 +1,79 @@
+package traffic
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tags is a set of classification tags (like "bot", "internal", or
+// "beta-sdk") attached to a request as it passes through the plugin chain.
+// Earlier plugins can classify a request by adding tags, and later plugins can
+// make decisions based on them, which avoids inventing private headers to pass
+// information between plugins.
+//
+// Tags are case-insensitive and are stored in lower case. A single Tags value
+// is shared by every plugin that handles a request; it is not safe for
+// concurrent use.
+type Tags struct {
+	tags map[string]bool
+}
+
+// NewTags returns a Tags set containing the provided tags.
+func NewTags(tags ...string) *Tags {
+	result := &Tags{tags: map[string]bool{}}
+	for _, tag := range tags {
+		result.Add(tag)
+	}
+	return result
+}
+
+// Add adds a tag to the set. Empty tags are ignored.
+func (tags *Tags) Add(tag string) {
+	tag = normalizeTag(tag)
+	if tag == "" {
+		return
+	}
+	tags.tags[tag] = true
+}
+
+// Remove removes a tag from the set, if present.
+func (tags *Tags) Remove(tag string) {
+	delete(tags.tags, normalizeTag(tag))
+}
+
+// Has returns true if the set contains the provided tag.
+func (tags *Tags) Has(tag string) bool {
+	if tags == nil {
+		return false
+	}
+	return tags.tags[normalizeTag(tag)]
+}
+
+// Len returns the number of tags in the set.
+func (tags *Tags) Len() int {
+	if tags == nil {
+		return 0
+	}
+	return len(tags.tags)
+}
+
+// List returns the tags in the set in sorted order.
+func (tags *Tags) List() []string {
+	if tags == nil {
+		return nil
+	}
+	list := make([]string, 0, len(tags.tags))
+	for tag := range tags.tags {
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (tags *Tags) String() string {
+	return strings.Join(tags.List(), ",")
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
@@ -0,0 +1,33 @@
+package traffic_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/immersa-co/relay-core/relay/traffic"
+)
+
+func TestTags(t *testing.T) {
+	tags := traffic.NewTags("Bot", " internal ", "")
+
+	if !reflect.DeepEqual(tags.List(), []string{"bot", "internal"}) {
+		t.Errorf("Unexpected tags: %v", tags.List())
+	}
+	if !tags.Has("BOT") {
+		t.Errorf("Expected tag lookups to be case-insensitive")
+	}
+
+	tags.Add("beta-sdk")
+	tags.Remove("internal")
+	if !reflect.DeepEqual(tags.List(), []string{"beta-sdk", "bot"}) {
+		t.Errorf("Unexpected tags after update: %v", tags.List())
+	}
+	if tags.String() != "beta-sdk,bot" {
+		t.Errorf("Unexpected string form: %v", tags.String())
+	}
+
+	var nilTags *traffic.Tags
+	if nilTags.Has("bot") || nilTags.Len() != 0 {
+		t.Errorf("Expected nil Tags to behave as an empty set")
+	}
+}
@@ -0,0 +1,100 @@
+package traffic
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the instrumentation which produced the relay's spans.
+const tracerName = "github.com/immersa-co/relay-core/relay/traffic"
+
+// tracePropagator reads and writes W3C traceparent and tracestate headers.
+var tracePropagator = propagation.TraceContext{}
+
+// startRequestSpan starts the span which covers the relay's handling of a
+// request. If the client sent a traceparent header, the span is a child of the
+// client's span. The returned request carries the span in its context, so that
+// spans for plugins and for the upstream call are its children.
+func (handler *Handler) startRequestSpan(request *http.Request) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := handler.tracer.Start(ctx, "relay "+request.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(request.Method),
+			semconv.URLPath(request.URL.Path),
+			semconv.ServerAddress(request.Host),
+		),
+	)
+	return request.WithContext(ctx), span
+}
+
+// endRequestSpan ends a span started by startRequestSpan, once the relay has
+// responded to the client.
+func endRequestSpan(span trace.Span, status int, serviced bool) {
+	span.SetAttributes(
+		semconv.HTTPResponseStatusCode(status),
+		attribute.Bool("relay.serviced", serviced),
+	)
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startPluginSpan starts a span covering a plugin's handling of a request, and
+// returns a function which ends it once the plugin has decided whether it
+// serviced the request. If tracing is disabled, the function does nothing.
+func (handler *Handler) startPluginSpan(request *http.Request, trafficPlugin Plugin) func(serviced bool) {
+	if handler.tracer == nil {
+		return func(bool) {}
+	}
+	_, span := handler.tracer.Start(request.Context(), "plugin "+trafficPlugin.Name(),
+		trace.WithAttributes(attribute.String("relay.plugin", trafficPlugin.Name())),
+	)
+	return func(serviced bool) {
+		span.SetAttributes(attribute.Bool("relay.plugin.serviced", serviced))
+		span.End()
+	}
+}
+
+// sendToTarget makes one attempt at sending a request to the target, where the
+// first attempt is attempt 1. If tracing is enabled, the attempt is covered by
+// a span which ends once the target's response headers arrive, and the span is
+// propagated to the target in the traceparent header, replacing any the
+// client sent.
+func (handler *Handler) sendToTarget(request *http.Request, attempt int) (*http.Response, error) {
+	if handler.tracer == nil {
+		return handler.transport.RoundTrip(request)
+	}
+
+	ctx, span := handler.tracer.Start(request.Context(), "upstream "+request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(request.Method),
+			semconv.ServerAddress(request.URL.Host),
+			semconv.URLPath(request.URL.Path),
+		),
+	)
+	defer span.End()
+	if attempt > 1 {
+		span.SetAttributes(semconv.HTTPRequestResendCount(attempt - 1))
+	}
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	response, err := handler.transport.RoundTrip(request)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return response, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+	if response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
+	}
+	return response, nil
+}
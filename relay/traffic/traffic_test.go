@@ -1,21 +1,47 @@
 package traffic_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/immersa-co/relay-core/catcher"
 	"github.com/immersa-co/relay-core/relay"
+	"github.com/immersa-co/relay-core/relay/clock"
+	"github.com/immersa-co/relay-core/relay/config"
+	"github.com/immersa-co/relay-core/relay/journal"
+	"github.com/immersa-co/relay-core/relay/logging"
+	content_blocker_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/content-blocker-plugin"
 	test_interceptor_plugin "github.com/immersa-co/relay-core/relay/plugins/traffic/test-interceptor-plugin"
+	"github.com/immersa-co/relay-core/relay/storage"
 	"github.com/immersa-co/relay-core/relay/test"
 	"github.com/immersa-co/relay-core/relay/traffic"
+	plugin_loader "github.com/immersa-co/relay-core/relay/traffic/plugin-loader"
 	"github.com/immersa-co/relay-core/relay/version"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/net/websocket"
 )
 
@@ -132,133 +158,4416 @@ func TestRelayedHeaders(t *testing.T) {
 	}
 }
 
+func TestConnectionHooks(t *testing.T) {
+	var mutex sync.Mutex
+	events := []string{}
+	var disconnectInfo traffic.ConnectionInfo
+	disconnected := make(chan struct{})
+
+	plugins := []traffic.PluginFactory{
+		test_interceptor_plugin.NewFactoryWithConnectionListener(func(event string, info traffic.ConnectionInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+			if event == "disconnect" {
+				disconnectInfo = info
+				close(disconnected)
+			}
+		}),
+	}
+
+	test.WithCatcherAndRelay(t, "", plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		response, err := client.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		io.ReadAll(response.Body)
+		response.Body.Close()
+
+		select {
+		case <-disconnected:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Timed out waiting for disconnect")
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reflect.DeepEqual(events, []string{"connect", "disconnect"}) {
+			t.Errorf("Unexpected connection events: %v", events)
+		}
+		if disconnectInfo.BytesRead == 0 || disconnectInfo.BytesWritten == 0 {
+			t.Errorf("Expected byte counts to be recorded: %+v", disconnectInfo)
+		}
+		if disconnectInfo.RemoteAddr == nil || disconnectInfo.Duration <= 0 {
+			t.Errorf("Expected connection metadata to be recorded: %+v", disconnectInfo)
+		}
+	})
+}
+
+func TestSlowConnectionHooks(t *testing.T) {
+	// The first connection's OnConnect blocks until the test ends.
+	release := make(chan struct{})
+	var connections atomic.Int32
+	plugins := []traffic.PluginFactory{
+		test_interceptor_plugin.NewFactoryWithConnectionListener(func(event string, info traffic.ConnectionInfo) {
+			if event == "connect" && connections.Add(1) == 1 {
+				<-release
+			}
+		}),
+	}
+
+	test.WithCatcherAndRelay(t, "", plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		defer close(release)
+		blocked, err := net.Dial("tcp", relayService.Address())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer blocked.Close()
+		for deadline := time.Now().Add(5 * time.Second); connections.Load() == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Other connections are still accepted and served.
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+		response, err := client.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing while another connection's hook was blocked: %v", err)
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 but got %v", response.StatusCode)
+		}
+	})
+}
+
+// redactingResponsePlugin replaces "secret" in response bodies and marks the
+// responses it handles with a header.
+type redactingResponsePlugin struct{}
+
+func (plug redactingResponsePlugin) Name() string {
+	return "redacting-response"
+}
+
+func (plug redactingResponsePlugin) HandleRequest(http.ResponseWriter, *http.Request, traffic.RequestInfo) bool {
+	return false
+}
+
+func (plug redactingResponsePlugin) NeedsResponseBody() bool {
+	return true
+}
+
+func (plug redactingResponsePlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	body, _ := io.ReadAll(response.Body)
+	body = bytes.ReplaceAll(body, []byte("secret"), []byte("[redacted]"))
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	response.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	response.Header.Set("X-Redacted", "true")
+}
+
+func TestResponsePlugins(t *testing.T) {
+	for _, encoding := range []traffic.Encoding{traffic.Identity, traffic.Gzip, traffic.Brotli, traffic.Zstd} {
+		desc := fmt.Sprintf("encoding: %v", encoding.HeaderValue())
+
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := traffic.EncodeData([]byte("a secret message"), encoding)
+			if encoding != traffic.Identity {
+				w.Header().Set("Content-Encoding", encoding.HeaderValue())
+			}
+			w.Write(body)
+		}))
+		targetURL, _ := url.Parse(target.URL)
+
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{redactingResponsePlugin{}}))
+
+		// Ask for the encoding explicitly; otherwise the relay's transport
+		// would request and transparently decode gzip itself.
+		request, _ := http.NewRequest("GET", relayServer.URL, nil)
+		if encoding != traffic.Identity {
+			request.Header.Set("Accept-Encoding", encoding.HeaderValue())
+		}
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", desc, err)
+		} else {
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+
+			if response.Header.Get("Content-Encoding") != encoding.HeaderValue() {
+				t.Errorf("Test '%v': Unexpected Content-Encoding %q", desc, response.Header.Get("Content-Encoding"))
+			}
+			if response.ContentLength != int64(len(body)) {
+				t.Errorf("Test '%v': Content-Length is %v but body length is %v", desc, response.ContentLength, len(body))
+			}
+			if decoded, err := traffic.DecodeData(body, encoding); err != nil || string(decoded) != "a [redacted] message" {
+				t.Errorf("Test '%v': Unexpected body %q (error: %v)", desc, decoded, err)
+			}
+			if response.Header.Get("X-Redacted") != "true" {
+				t.Errorf("Test '%v': Expected header added by response plugin", desc)
+			}
+		}
+
+		relayServer.Close()
+		target.Close()
+	}
+}
+
+func TestResponsePluginsRelayUnchangedBodiesUntouched(t *testing.T) {
+	// The target's gzip stream carries a comment, which the relay wouldn't
+	// reproduce if it re-encoded the body.
+	var encoded bytes.Buffer
+	writer := gzip.NewWriter(&encoded)
+	writer.Comment = "from the target"
+	writer.Write([]byte("a public message"))
+	writer.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded.Bytes())
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{redactingResponsePlugin{}}))
+	defer relayServer.Close()
+
+	request, _ := http.NewRequest("GET", relayServer.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Error GETing: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if !bytes.Equal(body, encoded.Bytes()) {
+		t.Errorf("Expected the target's encoded body to be relayed untouched but got %q", body)
+	}
+	if response.Header.Get("X-Redacted") != "true" {
+		t.Errorf("Expected header added by response plugin")
+	}
+}
+
+// headerResponsePlugin marks the responses it handles with a header, without
+// needing their bodies.
+type headerResponsePlugin struct{}
+
+func (plug headerResponsePlugin) Name() string {
+	return "header-response"
+}
+
+func (plug headerResponsePlugin) HandleRequest(http.ResponseWriter, *http.Request, traffic.RequestInfo) bool {
+	return false
+}
+
+func (plug headerResponsePlugin) HandleResponse(response *http.Response, info traffic.RequestInfo) {
+	response.Header.Set("X-Handled", "true")
+}
+
+func TestResponseStreaming(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{headerResponsePlugin{}}))
+	defer relayServer.Close()
+
+	// The start of the body should reach the client while the target is
+	// still sending the rest of it.
+	type result struct {
+		response *http.Response
+		first    []byte
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get(relayServer.URL)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		first := make([]byte, len("first,"))
+		_, err = io.ReadFull(response.Body, first)
+		results <- result{response: response, first: first, err: err}
+	}()
+
+	var streamed result
+	select {
+	case streamed = <-results:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("Timed out waiting for the start of the response body")
+	}
+	close(release)
+	if streamed.err != nil {
+		t.Fatalf("Error reading response: %v", streamed.err)
+	}
+	defer streamed.response.Body.Close()
+
+	if string(streamed.first) != "first," {
+		t.Errorf("Unexpected start of body %q", streamed.first)
+	}
+	if rest, _ := io.ReadAll(streamed.response.Body); string(rest) != "second" {
+		t.Errorf("Unexpected end of body %q", rest)
+	}
+	if streamed.response.Header.Get("X-Handled") != "true" {
+		t.Errorf("Expected header added by response plugin")
+	}
+}
+
+// pathCondition matches requests for a single path.
+type pathCondition string
+
+func (condition pathCondition) Matches(request *http.Request) bool {
+	return request.URL.Path == string(condition)
+}
+
+func TestConditionalPlugins(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.DebugHeaders = true
+	plugin := &traffic.ConditionalPlugin{Plugin: headerResponsePlugin{}, Condition: pathCondition("/ingest")}
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{plugin}))
+	defer relayServer.Close()
+
+	testCases := []struct {
+		path             string
+		expectedHandled  string
+		expectedDecision string
+	}{
+		{path: "/ingest", expectedHandled: "true", expectedDecision: "header-response=passed"},
+		{path: "/other", expectedHandled: "", expectedDecision: "header-response=skipped"},
+	}
+	for _, testCase := range testCases {
+		response, err := http.Get(relayServer.URL + testCase.path)
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.path, err)
+			continue
+		}
+		response.Body.Close()
+
+		if handled := response.Header.Get("X-Handled"); handled != testCase.expectedHandled {
+			t.Errorf("Test '%v': Expected X-Handled '%v' but got '%v'", testCase.path, testCase.expectedHandled, handled)
+		}
+		if decision := response.Header.Get(traffic.DebugPluginsHeaderName); decision != testCase.expectedDecision {
+			t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.path, traffic.DebugPluginsHeaderName, testCase.expectedDecision, decision)
+		}
+	}
+}
+
+// eventFilterPlugin drops Server-Sent Events of the "secret" type, and
+// upper-cases the data of the others.
+type eventFilterPlugin struct{}
+
+func (plug eventFilterPlugin) Name() string {
+	return "event-filter"
+}
+
+func (plug eventFilterPlugin) HandleRequest(http.ResponseWriter, *http.Request, traffic.RequestInfo) bool {
+	return false
+}
+
+func (plug eventFilterPlugin) HandleServerSentEvent(request *http.Request, event *traffic.ServerSentEvent) {
+	for i, line := range event.Lines {
+		if line == "event: secret" {
+			event.Drop = true
+		}
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			event.Lines[i] = "data:" + strings.ToUpper(data)
+		}
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("event: secret\ndata: x\n\nid: 3\ndata: last\n\n"))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	// The stream outlasts the maximum body size, and a plugin which needs
+	// response bodies doesn't keep it from being streamed.
+	options.MaxBodySize = 24
+	plugins := []traffic.Plugin{redactingResponsePlugin{}, eventFilterPlugin{}}
+	relayServer := httptest.NewServer(traffic.NewHandler(options, plugins))
+	defer relayServer.Close()
+
+	type result struct {
+		response *http.Response
+		first    []byte
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get(relayServer.URL)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		first := make([]byte, len("data: FIRST\n\n"))
+		_, err = io.ReadFull(response.Body, first)
+		results <- result{response: response, first: first, err: err}
+	}()
+
+	var streamed result
+	select {
+	case streamed = <-results:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("Timed out waiting for the first event")
+	}
+	close(release)
+	if streamed.err != nil {
+		t.Fatalf("Error reading response: %v", streamed.err)
+	}
+	defer streamed.response.Body.Close()
+
+	if string(streamed.first) != "data: FIRST\n\n" {
+		t.Errorf("Unexpected first event %q", streamed.first)
+	}
+	if rest, _ := io.ReadAll(streamed.response.Body); string(rest) != "id: 3\ndata: LAST\n\n" {
+		t.Errorf("Unexpected remaining events %q", rest)
+	}
+	if streamed.response.Header.Get("X-Redacted") != "true" {
+		t.Errorf("Expected header added by response plugin")
+	}
+}
+
+// timestampingPlugin stamps requests with the time reported by its clock.
+type timestampingPlugin struct {
+	clock clock.Clock
+}
+
+func (plug *timestampingPlugin) Name() string {
+	return "timestamping"
+}
+
+func (plug *timestampingPlugin) SetClock(clock clock.Clock) {
+	plug.clock = clock
+}
+
+func (plug *timestampingPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	response.Header().Set("X-Timestamp", plug.clock.Now().Format(time.RFC3339))
+	response.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func TestClockPlugins(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	options := traffic.NewDefaultRelayOptions()
+	options.Clock = clock.NewFake(now)
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{&timestampingPlugin{}}))
+	defer relayServer.Close()
+
+	response, err := http.Get(relayServer.URL)
+	if err != nil {
+		t.Fatalf("Error GETing: %v", err)
+	}
+	response.Body.Close()
+
+	if timestamp := response.Header.Get("X-Timestamp"); timestamp != "2024-05-06T07:08:09Z" {
+		t.Errorf("Expected the plugin to use the configured clock but got timestamp %q", timestamp)
+	}
+}
+
+// annotatingPlugin records the RequestInfo and RequestCompletion of each
+// request, and annotates requests with the annotations it's seen.
+type annotatingPlugin struct {
+	name        string
+	infos       []traffic.RequestInfo
+	completions []*traffic.RequestCompletion
+}
+
+func (plug *annotatingPlugin) Name() string {
+	return plug.name
+}
+
+func (plug *annotatingPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	plug.infos = append(plug.infos, info)
+	info.Annotations.Set(plug.name, strings.Join(info.Annotations.Keys(), "+"))
+	return false
+}
+
+func (plug *annotatingPlugin) HandleCompletion(completion *traffic.RequestCompletion) {
+	plug.completions = append(plug.completions, completion)
+}
+
+func TestRequestInfo(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	options := traffic.NewDefaultRelayOptions()
+	options.Clock = clock.NewFake(now)
+	options.Route = "*.example.test"
+	first, second := &annotatingPlugin{name: "first"}, &annotatingPlugin{name: "second"}
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{first, second}))
+
+	for i := 0; i < 2; i++ {
+		response, err := http.Get(relayServer.URL)
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+	}
+	// Closing the server waits for the requests' completions.
+	relayServer.Close()
+
+	if len(first.infos) != 2 || len(second.infos) != 2 || len(second.completions) != 2 {
+		t.Fatalf("Expected each plugin to handle two requests, but got %v and %v", len(first.infos), len(second.infos))
+	}
+	for i, info := range second.infos {
+		if info.ID == "" || info.ID != first.infos[i].ID {
+			t.Errorf("Expected both plugins to see the same request ID, but got '%v' and '%v'", first.infos[i].ID, info.ID)
+		}
+		if info.Route != "*.example.test" {
+			t.Errorf("Expected route '*.example.test' but got '%v'", info.Route)
+		}
+		if !info.Start.Equal(now) {
+			t.Errorf("Expected start time %v but got %v", now, info.Start)
+		}
+		if info.Annotations != first.infos[i].Annotations {
+			t.Errorf("Expected both plugins to share the request's annotations")
+		}
+
+		completion := second.completions[i]
+		if completion.ID != info.ID || completion.Route != info.Route {
+			t.Errorf("Expected completion ID '%v' and route '%v' but got '%v' and '%v'", info.ID, info.Route, completion.ID, completion.Route)
+		}
+		expectedAnnotations := map[string]string{"first": "", "second": "first"}
+		if !reflect.DeepEqual(completion.Annotations, expectedAnnotations) {
+			t.Errorf("Expected annotations %v but got %v", expectedAnnotations, completion.Annotations)
+		}
+	}
+	if first.infos[0].ID == first.infos[1].ID {
+		t.Errorf("Expected each request to have its own ID, but both had '%v'", first.infos[0].ID)
+	}
+}
+
+// panickingPlugin panics when handling requests for "/panic".
+type panickingPlugin struct{}
+
+func (plug panickingPlugin) Name() string {
+	return "panicking"
+}
+
+func (plug panickingPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	if request.URL.Path == "/panic" {
+		panic("plugin failure")
+	}
+	return false
+}
+
+func TestJournal(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	dumpDir := t.TempDir()
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.Journal = journal.New(10, dumpDir)
+	options.Clock = clock.NewFake(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	handler := traffic.NewHandler(options, []traffic.Plugin{panickingPlugin{}})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://relay.example/events", nil))
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != "plugin failure" {
+				t.Errorf("Expected the panic to propagate but got %v", recovered)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://relay.example/panic", nil))
+	}()
+
+	expected := []journal.Entry{
+		{
+			Time:     time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+			Method:   "POST",
+			Host:     "relay.example",
+			Path:     "/events",
+			Status:   http.StatusAccepted,
+			Serviced: true,
+			Plugins:  []journal.PluginDecision{{Plugin: "panicking"}},
+			Tags:     []string{},
+		},
+		{
+			Time:   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+			Method: "GET",
+			Host:   "relay.example",
+			Path:   "/panic",
+			Status: http.StatusOK,
+			Tags:   []string{},
+			Panic:  "plugin failure",
+		},
+	}
+	if entries := options.Journal.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected journal entries:\n%+v\nbut got:\n%+v", expected, entries)
+	}
+
+	dumps, err := filepath.Glob(filepath.Join(dumpDir, "relay-journal-*.json"))
+	if err != nil || len(dumps) != 1 {
+		t.Fatalf("Expected one journal dump but found %v (%v)", dumps, err)
+	}
+	content, err := os.ReadFile(dumps[0])
+	if err != nil {
+		t.Fatalf("Error reading journal dump: %v", err)
+	}
+	if !strings.Contains(string(content), `"panic": "plugin failure"`) {
+		t.Errorf("Expected the dump to include the panicking request:\n%s", content)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	var accessLog bytes.Buffer
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.Clock = clock.NewFake(now)
+	options.AccessLog = &accessLog
+	relayServer := httptest.NewServer(traffic.NewHandler(options, nil))
+
+	response, err := http.Post(relayServer.URL+"/some/path?query", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Error POSTing: %v", err)
+	}
+	io.ReadAll(response.Body)
+	response.Body.Close()
+
+	// Closing the server waits for the handler, and so the log entry, to finish.
+	relayServer.Close()
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(accessLog.Bytes(), &entry); err != nil {
+		t.Fatalf("Error decoding access log %q: %v", accessLog.String(), err)
+	}
+	expected := map[string]interface{}{
+		"time":           "2024-05-06T07:08:09Z",
+		"method":         "POST",
+		"host":           targetURL.Host,
+		"path":           "/some/path",
+		"status":         float64(http.StatusCreated),
+		"request_bytes":  float64(5),
+		"response_bytes": float64(7),
+		"duration_ms":    float64(0),
+		"serviced":       true,
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Expected access log entry %v but got %v", expected, entry)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	plugins := []traffic.PluginFactory{test_interceptor_plugin.Factory}
+
+	test.WithCatcherAndRelay(t, "", plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if err := relayService.StartMetrics("localhost", 0); err != nil {
+			t.Errorf("Error starting metrics listener: %v", err)
+			return
+		}
+
+		response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Errorf("Error POSTing: %v", err)
+			return
+		}
+		io.ReadAll(response.Body)
+		response.Body.Close()
+
+		metricsResponse, err := http.Get(relayService.MetricsUrl())
+		if err != nil {
+			t.Errorf("Error GETing metrics: %v", err)
+			return
+		}
+		defer metricsResponse.Body.Close()
+		body, _ := io.ReadAll(metricsResponse.Body)
+
+		for _, expected := range []string{
+			`relay_plugin_requests_total{plugin="test-interceptor"} 1`,
+			`relay_upstream_latency_seconds_count 1`,
+			`relay_request_body_size_bytes_sum 5`,
+			`relay_response_body_size_bytes_count 1`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Errorf("Expected metrics to contain %q:\n%s", expected, body)
+			}
+		}
+	})
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	configYaml := "relay:\n    port: 0\n    target: http://localhost\ntest-interceptor:\n    option: value\n"
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	plugins, err := plugin_loader.Load([]traffic.PluginFactory{test_interceptor_plugin.Factory}, configFile)
+	if err != nil {
+		t.Fatalf("Error loading plugins: %v", err)
+	}
+
+	relayOptions := traffic.NewDefaultRelayOptions()
+	relayOptions.Journal = journal.New(5, t.TempDir())
+	relayService := relay.NewService(relayOptions, plugins)
+	if err := relayService.StartAdmin("localhost", 0, configFile); err != nil {
+		t.Fatalf("Error starting admin listener: %v", err)
+	}
+	defer relayService.Close()
+
+	getStatus := func(path string) int {
+		response, err := http.Get(relayService.AdminUrl() + path)
+		if err != nil {
+			t.Errorf("Error GETing %v: %v", path, err)
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if status := getStatus(relay.HealthPath); status != http.StatusOK {
+		t.Errorf("Expected health check to return 200 but got %v", status)
+	}
+	if status := getStatus(relay.ReadyPath); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness check to return 503 before starting but got %v", status)
+	}
+
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting relay: %v", err)
+	}
+	if status := getStatus(relay.ReadyPath); status != http.StatusOK {
+		t.Errorf("Expected readiness check to return 200 after starting but got %v", status)
+	}
+
+	response, err := http.Get(relayService.AdminUrl() + relay.PluginsPath)
+	if err != nil {
+		t.Fatalf("Error GETing plugins: %v", err)
+	}
+	defer response.Body.Close()
+	var pluginsResponse relay.PluginsResponse
+	if err := json.NewDecoder(response.Body).Decode(&pluginsResponse); err != nil {
+		t.Fatalf("Error decoding plugins: %v", err)
+	}
+
+	expectedSection, _ := config.NewFileFromYamlString("test-interceptor:\n    option:   value\n")
+	expected := relay.PluginsResponse{
+		RelayVersion: version.RelayRelease,
+		Plugins: []*relay.PluginStatus{{
+			Name:       "test-interceptor",
+			Version:    version.RelayRelease,
+			ConfigHash: expectedSection.LookupOptionalSection("test-interceptor").Hash(),
+		}},
+	}
+	if !reflect.DeepEqual(pluginsResponse, expected) {
+		t.Errorf("Expected plugins %+v but got %+v", expected, pluginsResponse)
+	}
+
+	if status := getStatus(relay.JournalPath); status != http.StatusOK {
+		t.Errorf("Expected the journal to be served but got status %v", status)
+	}
+	dumpResponse, err := http.Post(relayService.AdminUrl()+relay.JournalDumpPath, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Error dumping journal: %v", err)
+	}
+	dumpPath, _ := io.ReadAll(dumpResponse.Body)
+	dumpResponse.Body.Close()
+	if _, err := os.Stat(strings.TrimSpace(string(dumpPath))); err != nil {
+		t.Errorf("Expected the journal to be dumped to %q: %v", dumpPath, err)
+	}
+}
+
+// routeAdminPlugin implements the optional interfaces which the admin listener
+// and Service.Close use.
+type routeAdminPlugin struct {
+	notReady error
+	closed   bool
+}
+
+func (plug *routeAdminPlugin) Name() string {
+	return "route-admin"
+}
+
+func (plug *routeAdminPlugin) HandleRequest(http.ResponseWriter, *http.Request, traffic.RequestInfo) bool {
+	return false
+}
+
+func (plug *routeAdminPlugin) Ready() error {
+	return plug.notReady
+}
+
+func (plug *routeAdminPlugin) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(response, request.URL.Path)
+	})
+}
+
+func (plug *routeAdminPlugin) Close() error {
+	plug.closed = true
+	return nil
+}
+
+func TestRoutePluginsOnAdminListener(t *testing.T) {
+	routeConfig, err := config.NewFileFromYamlString("route-admin:\n    option: value\n")
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	routePlugin := &routeAdminPlugin{notReady: errors.New("warming up")}
+	loadPlugins := func(configFile *config.File) ([]traffic.Plugin, error) {
+		return []traffic.Plugin{routePlugin}, nil
+	}
+
+	relayService := relay.NewService(traffic.NewDefaultRelayOptions(), nil)
+	hosts := []*relay.VirtualHostOptions{{
+		Host:         "A.example.test",
+		RouteOptions: relay.RouteOptions{PluginConfig: routeConfig},
+	}}
+	if err := relayService.AddVirtualHosts(hosts, traffic.NewDefaultRelayOptions(), nil, loadPlugins); err != nil {
+		t.Fatalf("Error adding virtual hosts: %v", err)
+	}
+	if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+		t.Fatalf("Error starting admin listener: %v", err)
+	}
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting relay: %v", err)
+	}
+
+	get := func(path string) (int, string) {
+		response, err := http.Get(relayService.AdminUrl() + path)
+		if err != nil {
+			t.Errorf("Error GETing %v: %v", path, err)
+			return 0, ""
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	if status, body := get(relay.ReadyPath); status != http.StatusServiceUnavailable || !strings.Contains(body, "a.example.test: route-admin: warming up") {
+		t.Errorf("Expected readiness check to report the route's plugin but got %v: %q", status, body)
+	}
+
+	var pluginsResponse relay.PluginsResponse
+	if status, body := get(relay.PluginsPath); status != http.StatusOK {
+		t.Errorf("Expected plugins to be listed but got status %v", status)
+	} else if err := json.Unmarshal([]byte(body), &pluginsResponse); err != nil {
+		t.Errorf("Error decoding plugins: %v", err)
+	}
+	expectedPlugins := []*relay.PluginStatus{{
+		Name:       "route-admin",
+		Version:    version.RelayRelease,
+		ConfigHash: routeConfig.LookupOptionalSection("route-admin").Hash(),
+		Route:      "a.example.test",
+	}}
+	if !reflect.DeepEqual(pluginsResponse.Plugins, expectedPlugins) {
+		t.Errorf("Expected plugins %+v but got %+v", expectedPlugins, pluginsResponse.Plugins)
+	}
+
+	if status, body := get(relay.RoutePluginAdminPath("a.example.test", "route-admin") + "/status"); status != http.StatusOK || body != "/status" {
+		t.Errorf("Expected the route's plugin to serve /status but got %v: %q", status, body)
+	}
+
+	routePlugin.notReady = nil
+	if status, _ := get(relay.ReadyPath); status != http.StatusOK {
+		t.Errorf("Expected readiness check to return 200 once the route's plugin is ready but got %v", status)
+	}
+
+	relayService.Close()
+	if !routePlugin.closed {
+		t.Errorf("Expected the route's plugin to be closed with the service")
+	}
+}
+
+func TestReload(t *testing.T) {
+	var logs bytes.Buffer
+	logging.Configure(&logging.Options{Sinks: []logging.Sink{logging.NewWriterSink(&logs)}})
+	defer logging.Configure(&logging.Options{})
+
+	configYaml := "block-content:\n    body:\n        - mask: SECRET\nexample:\n    api-key: first-key\n"
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	loadPlugins := func(configFile *config.File) ([]traffic.Plugin, error) {
+		return plugin_loader.Load(plugins, configFile)
+	}
+
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+			t.Fatalf("Error starting admin listener: %v", err)
+		}
+		getReloadReport := func() (int, *relay.ReloadReport) {
+			response, err := http.Get(relayService.AdminUrl() + relay.ReloadPath)
+			if err != nil {
+				t.Fatalf("Error GETing reload report: %v", err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				return response.StatusCode, nil
+			}
+			report := &relay.ReloadReport{}
+			if err := json.NewDecoder(response.Body).Decode(report); err != nil {
+				t.Errorf("Error decoding reload report: %v", err)
+			}
+			return response.StatusCode, report
+		}
+		relayBody := func(body string) string {
+			response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("Error POSTing: %v", err)
+			}
+			response.Body.Close()
+			caughtBody, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Fatalf("Error reading caught body: %v", err)
+			}
+			return string(caughtBody)
+		}
+
+		if status, _ := getReloadReport(); status != http.StatusNotFound {
+			t.Errorf("Expected no reload report before reloading but got status %v", status)
+		}
+		if caughtBody := relayBody("SECRET TOKEN"); caughtBody != "****** TOKEN" {
+			t.Errorf("Expected the original rules to apply but got %q", caughtBody)
+		}
+
+		configFile, err := config.NewFileFromYamlString("block-content:\n    body:\n        - mask: TOKEN\nexample:\n    api-key: second-key\n")
+		if err != nil {
+			t.Fatalf("Error parsing configuration YAML: %v", err)
+		}
+		relaySection := configFile.GetOrAddSection("relay")
+		relaySection.Set("port", 0)
+		relaySection.Set("target", catcherService.HttpUrl())
+		if _, err := relayService.Reload(configFile, loadPlugins); err != nil {
+			t.Fatalf("Error reloading: %v", err)
+		}
+
+		if caughtBody := relayBody("SECRET TOKEN"); caughtBody != "SECRET *****" {
+			t.Errorf("Expected the reloaded rules to apply but got %q", caughtBody)
+		}
+
+		status, report := getReloadReport()
+		if status != http.StatusOK {
+			t.Fatalf("Expected a reload report but got status %v", status)
+		}
+		expectedChanges := []*config.Change{
+			{
+				Section:         "block-content",
+				Key:             "body",
+				Kind:            config.Changed,
+				AddedElements:   []interface{}{map[string]interface{}{"mask": "TOKEN"}},
+				RemovedElements: []interface{}{map[string]interface{}{"mask": "SECRET"}},
+			},
+			{
+				Section: "example",
+				Key:     "api-key",
+				Kind:    config.Changed,
+				Old:     config.RedactedValue,
+				New:     config.RedactedValue,
+			},
+		}
+		if !reflect.DeepEqual(report.Changes, expectedChanges) {
+			encoded, _ := json.Marshal(report.Changes)
+			t.Errorf("Unexpected changes in reload report: %s", encoded)
+		}
+	})
+
+	// Stop writing to the buffer before reading it.
+	logging.Configure(&logging.Options{})
+	for _, expected := range []string{
+		"block-content.body: changed +{mask: TOKEN} -{mask: SECRET}",
+		"example.api-key: changed '[redacted]' -> '[redacted]' (takes effect on restart)",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Expected the reload to log %q, but logged:\n%v", expected, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "first-key") || strings.Contains(logs.String(), "second-key") {
+		t.Errorf("Expected secrets to be redacted from the log, but logged:\n%v", logs.String())
+	}
+}
+
+func TestReloadClosesReplacedHandlers(t *testing.T) {
+	configYaml := "relay:\n    mirror-target: ${CATCHER_URL_1}\n"
+	test.WithMultiCatcherAndRelay(t, 2, configYaml, nil, func(catcherServices []*catcher.Service, relayService *relay.Service) {
+		configFile, err := config.NewFileFromYamlString("")
+		if err != nil {
+			t.Fatalf("Error parsing configuration YAML: %v", err)
+		}
+		loadPlugins := func(configFile *config.File) ([]traffic.Plugin, error) {
+			return nil, nil
+		}
+
+		// Each handler starts workers to send copies to the mirror target,
+		// which exit once it's replaced.
+		goroutines := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			if _, err := relayService.Reload(configFile, loadPlugins); err != nil {
+				t.Fatalf("Error reloading: %v", err)
+			}
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if runtime.NumGoroutine() <= goroutines {
+				break
+			}
+		}
+		if count := runtime.NumGoroutine(); count > goroutines {
+			t.Errorf("Expected at most %v goroutines after reloading but got %v", goroutines, count)
+		}
+
+		// The current handler still mirrors requests.
+		response, err := http.Post(relayService.HttpUrl()+"/events", "text/plain", strings.NewReader("mirrored"))
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		response.Body.Close()
+		var mirrored []*http.Request
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if mirrored, _ = catcherServices[1].Requests(); len(mirrored) >= 1 {
+				break
+			}
+		}
+		if len(mirrored) != 1 {
+			t.Errorf("Expected the mirror catcher to receive 1 request but got %v", len(mirrored))
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		arrived <- struct{}{}
+		<-request.Context().Done()
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	relayOptions := traffic.NewDefaultRelayOptions()
+	relayOptions.TargetScheme = targetURL.Scheme
+	relayOptions.TargetHost = targetURL.Host
+	relayService := relay.NewService(relayOptions, nil)
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting relay: %v", err)
+	}
+	if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+		t.Fatalf("Error starting admin listener: %v", err)
+	}
+	defer relayService.Close()
+
+	adminRequest := func(method string, path string) (int, string) {
+		request, _ := http.NewRequest(method, relayService.AdminUrl()+path, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error sending %v %v: %v", method, path, err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, strings.TrimSpace(string(body))
+	}
+	getReport := func(method string) *relay.DrainReport {
+		status, body := adminRequest(method, relay.DrainPath)
+		if status != http.StatusOK {
+			t.Fatalf("Expected %v %v to return 200 but got %v", method, relay.DrainPath, status)
+		}
+		var report relay.DrainReport
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatalf("Error decoding drain report: %v", err)
+		}
+		return &report
+	}
+
+	clientError := make(chan error, 1)
+	go func() {
+		response, err := http.Get(relayService.HttpUrl() + "/slow")
+		if err == nil {
+			response.Body.Close()
+		}
+		clientError <- err
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the request to reach the target")
+	}
+
+	if report := getReport("GET"); report.Draining || report.Requests != 1 || report.Websockets != 0 || len(report.Active) != 1 || report.Active[0].Path != "/slow" {
+		t.Errorf("Expected one active request before draining but got %+v", report)
+	}
+	if report := getReport("POST"); !report.Draining || report.Requests != 1 {
+		t.Errorf("Expected the relay to be draining with one active request but got %+v", report)
+	}
+	if status, _ := adminRequest("GET", relay.ReadyPath); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness check to return 503 while draining but got %v", status)
+	}
+
+	if status, _ := adminRequest("POST", relay.DrainClosePath+"?older-than=soon"); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid age to be rejected but got status %v", status)
+	}
+	if _, closed := adminRequest("POST", relay.DrainClosePath+"?older-than=1h"); closed != "0" {
+		t.Errorf("Expected no requests older than an hour to be closed but got %v", closed)
+	}
+	if _, closed := adminRequest("POST", relay.DrainClosePath); closed != "1" {
+		t.Errorf("Expected the active request to be closed but got %v", closed)
+	}
+	select {
+	case err := <-clientError:
+		if err == nil {
+			t.Errorf("Expected the closed request to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the closed request to fail")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for report := getReport("GET"); report.Requests != 0; report = getReport("GET") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no active requests after closing but got %+v", report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestMaxBodySize(t *testing.T) {
 	configYaml := `relay:
-                      max-body-size: 5
-    `
+                      max-body-size: 5
+    `
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+		if response.StatusCode != 503 {
+			t.Errorf("Expected 503 response for surpassing max body size: %v", response)
+			return
+		}
+	})
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	configYaml := `relay:
+    max-header-bytes: 1024
+`
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for _, testCase := range []struct {
+			desc           string
+			headerSize     int
+			expectedStatus int
+		}{
+			{"Small headers are allowed", 512, http.StatusOK},
+			{"Large headers are rejected", 16 * 1024, http.StatusRequestHeaderFieldsTooLarge},
+		} {
+			request, _ := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			request.Header.Set("X-Large", strings.Repeat("x", testCase.headerSize))
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+		}
+	})
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	configYaml := `relay:
+    max-concurrent-requests: 1
+`
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		// An open websocket connection occupies the only slot.
+		ws, err := websocket.Dial(relayService.WsUrl()+"/echo", "", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		if err := testEcho(ws, "Hold the line"); err != nil {
+			t.Fatalf("Error in echo: %v", err)
+		}
+
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 but got %v", response.StatusCode)
+		}
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "1" {
+			t.Errorf("Expected Retry-After '1' but got '%v'", retryAfter)
+		}
+
+		// Once the websocket closes, its slot is released.
+		ws.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Fatalf("Error GETing: %v", err)
+			}
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the slot to be released, but requests still receive %v", response.StatusCode)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	configYaml := `relay:
+    read-only: true
+`
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if err := relayService.StartAdmin("localhost", 0, nil); err != nil {
+			t.Fatalf("Error starting admin listener: %v", err)
+		}
+
+		sendRequest := func(method string, url string) (*http.Response, string) {
+			request, _ := http.NewRequest(method, url, nil)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("Error sending %v %v: %v", method, url, err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			return response, strings.TrimSpace(string(body))
+		}
+
+		for _, testCase := range []struct {
+			desc           string
+			method         string
+			expectedStatus int
+		}{
+			{"GET is relayed", "GET", http.StatusOK},
+			{"HEAD is relayed", "HEAD", http.StatusOK},
+			{"OPTIONS is relayed", "OPTIONS", http.StatusOK},
+			{"POST is rejected", "POST", http.StatusMethodNotAllowed},
+			{"PUT is rejected", "PUT", http.StatusMethodNotAllowed},
+			{"DELETE is rejected", "DELETE", http.StatusMethodNotAllowed},
+		} {
+			response, _ := sendRequest(testCase.method, relayService.HttpUrl())
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if testCase.expectedStatus == http.StatusMethodNotAllowed {
+				if allow := response.Header.Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+					t.Errorf("Test '%v': Expected Allow 'GET, HEAD, OPTIONS' but got '%v'", testCase.desc, allow)
+				}
+			}
+		}
+
+		if _, body := sendRequest("GET", relayService.AdminUrl()+relay.ReadOnlyPath); body != "true" {
+			t.Errorf("Expected the relay to report being read-only but got '%v'", body)
+		}
+		if response, _ := sendRequest("POST", relayService.AdminUrl()+relay.ReadOnlyPath+"?enabled=maybe"); response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected an invalid 'enabled' value to be rejected but got status %v", response.StatusCode)
+		}
+		if _, body := sendRequest("POST", relayService.AdminUrl()+relay.ReadOnlyPath+"?enabled=false"); body != "false" {
+			t.Errorf("Expected read-only mode to be disabled but got '%v'", body)
+		}
+		if response, _ := sendRequest("POST", relayService.HttpUrl()); response.StatusCode != http.StatusOK {
+			t.Errorf("Expected POST to be relayed once read-only mode is disabled but got status %v", response.StatusCode)
+		}
+		if _, body := sendRequest("POST", relayService.AdminUrl()+relay.ReadOnlyPath); body != "true" {
+			t.Errorf("Expected read-only mode to be enabled but got '%v'", body)
+		}
+		if response, _ := sendRequest("POST", relayService.HttpUrl()); response.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected POST to be rejected once read-only mode is enabled again but got status %v", response.StatusCode)
+		}
+	})
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	testCases := []struct {
+		desc               string
+		config             string
+		expectedStatusCode int
+		expectedBodyLength int
+		expectedTruncated  string
+	}{
+		{
+			desc: "Oversized responses are rejected",
+			config: `relay:
+                        max-response-size: 5
+            `,
+			expectedStatusCode: 502,
+			expectedBodyLength: -1,
+		},
+		{
+			desc: "Oversized responses can be truncated",
+			config: `relay:
+                        max-response-size: 5
+                        truncate-oversized-responses: true
+            `,
+			expectedStatusCode: 200,
+			expectedBodyLength: 5,
+			expectedTruncated:  "true",
+		},
+		{
+			desc: "Responses within the limit are relayed unchanged",
+			config: `relay:
+                        max-response-size: 1000000
+            `,
+			expectedStatusCode: 200,
+			expectedBodyLength: len(catcher.IndexHTML),
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatusCode {
+				t.Errorf("Test '%v': Expected %v response: %v", testCase.desc, testCase.expectedStatusCode, response)
+				return
+			}
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+			if testCase.expectedBodyLength >= 0 && len(body) != testCase.expectedBodyLength {
+				t.Errorf("Test '%v': Expected body length %v but got %v", testCase.desc, testCase.expectedBodyLength, len(body))
+			}
+
+			truncated := response.Header.Get(traffic.ResponseTruncatedHeaderName)
+			if truncated != testCase.expectedTruncated {
+				t.Errorf("Test '%v': Expected truncated header '%v' but got '%v'", testCase.desc, testCase.expectedTruncated, truncated)
+			}
+		})
+	}
+}
+
+func TestMaxResponseSizeStreaming(t *testing.T) {
+	// The target streams its body without a Content-Length, and waits for
+	// the first chunk to reach the client before sending the rest.
+	firstChunkRelayed := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/empty":
+			response.Header().Set("Content-Length", "100")
+			response.WriteHeader(http.StatusNoContent)
+			return
+		case "/head":
+			response.Header().Set("Content-Length", "100")
+			return
+		}
+		response.Write([]byte("01234"))
+		response.(http.Flusher).Flush()
+		select {
+		case <-firstChunkRelayed:
+		case <-time.After(5 * time.Second):
+		}
+		response.Write([]byte(strings.TrimPrefix(request.URL.Path, "/")))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc              string
+		method            string
+		path              string
+		truncate          bool
+		expectedStatus    int
+		expectedBody      string
+		expectedError     bool
+		expectedLength    string
+		expectedTruncated string
+	}{
+		{
+			desc:           "Responses within the limit are streamed",
+			method:         "GET",
+			path:           "/56789",
+			expectedStatus: 200,
+			expectedBody:   "0123456789",
+		},
+		{
+			desc:           "Oversized responses are aborted",
+			method:         "GET",
+			path:           "/56789abc",
+			expectedStatus: 200,
+			expectedError:  true,
+		},
+		{
+			desc:              "Oversized responses are truncated and flagged with a trailer",
+			method:            "GET",
+			path:              "/56789abc",
+			truncate:          true,
+			expectedStatus:    200,
+			expectedBody:      "0123456789",
+			expectedTruncated: "true",
+		},
+		{
+			desc:           "Responses to HEAD requests keep their Content-Length",
+			method:         "HEAD",
+			path:           "/head",
+			expectedStatus: 200,
+			expectedLength: "100",
+		},
+		{
+			desc:           "Responses with no body are relayed",
+			method:         "GET",
+			path:           "/empty",
+			expectedStatus: 204,
+		},
+	}
+
+	targetURL, _ := url.Parse(target.URL)
+	for _, testCase := range testCases {
+		relayOptions := traffic.NewDefaultRelayOptions()
+		relayOptions.TargetScheme = targetURL.Scheme
+		relayOptions.TargetHost = targetURL.Host
+		relayOptions.MaxResponseSize = 10
+		relayOptions.TruncateOversizedResponses = testCase.truncate
+		relayService := relay.NewService(relayOptions, nil)
+		if err := relayService.Start("localhost", 0); err != nil {
+			t.Fatalf("Test '%v': Error starting relay: %v", testCase.desc, err)
+		}
+
+		request, _ := http.NewRequest(testCase.method, relayService.HttpUrl()+testCase.path, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+			relayService.Close()
+			continue
+		}
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+		if length := response.Header.Get("Content-Length"); length != testCase.expectedLength {
+			t.Errorf("Test '%v': Expected Content-Length '%v' but got '%v'", testCase.desc, testCase.expectedLength, length)
+		}
+
+		// The first chunk arrives before the target has sent the rest.
+		if testCase.method == "GET" && testCase.expectedStatus == 200 {
+			chunk := make([]byte, 5)
+			read := make(chan error, 1)
+			go func() {
+				_, err := io.ReadFull(response.Body, chunk)
+				read <- err
+			}()
+			select {
+			case err := <-read:
+				if err != nil || string(chunk) != "01234" {
+					t.Errorf("Test '%v': Expected the first chunk '01234' but got %q (%v)", testCase.desc, chunk, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("Test '%v': Expected the first chunk to be streamed before the target sent the rest", testCase.desc)
+				<-read
+			}
+			firstChunkRelayed <- struct{}{}
+		}
+		rest, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if testCase.expectedError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected the response to be aborted, but read it whole", testCase.desc)
+			}
+		} else if err != nil {
+			t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+		} else if body := strings.TrimPrefix(testCase.expectedBody, "01234"); string(rest) != body {
+			t.Errorf("Test '%v': Expected the rest of the body to be %q but got %q", testCase.desc, body, rest)
+		}
+		if truncated := response.Trailer.Get(traffic.ResponseTruncatedHeaderName); truncated != testCase.expectedTruncated {
+			t.Errorf("Test '%v': Expected truncated trailer '%v' but got '%v'", testCase.desc, testCase.expectedTruncated, truncated)
+		}
+		relayService.Close()
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	content := "SECRET" + strings.Repeat("0123456789", 100)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("ETag", `"v1"`)
+		response.Header().Set("X-Secret", "SECRET")
+		http.ServeContent(response, request, "media.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc                string
+		inspect             bool
+		headers             map[string]string
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			desc:           "Ranges are relayed without inspecting their bodies",
+			headers:        map[string]string{"Range": "bytes=0-9"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   content[:10],
+		},
+		{
+			desc:           "Partial responses aren't limited by max-body-size",
+			headers:        map[string]string{"Range": "bytes=0-"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   content,
+		},
+		{
+			desc:                "Multipart ranges are relayed",
+			headers:             map[string]string{"Range": "bytes=0-1,10-11"},
+			expectedStatus:      http.StatusPartialContent,
+			expectedContentType: "multipart/byteranges",
+		},
+		{
+			desc:           "If-Range is relayed",
+			headers:        map[string]string{"Range": "bytes=6-9", "If-Range": `"v1"`},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   content[6:10],
+		},
+		{
+			desc:           "Partial responses can be inspected like others",
+			inspect:        true,
+			headers:        map[string]string{"Range": "bytes=0-9"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "******" + content[6:10],
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+    max-body-size: 100
+    inspect-partial-responses: %v
+block-content:
+    response-body:
+        - mask: SECRET
+    response-header:
+        - mask: SECRET
+`, target.URL, testCase.inspect))
+		if err != nil {
+			t.Fatalf("Error parsing configuration YAML: %v", err)
+		}
+		options, err := relay.ReadOptions(configFile)
+		if err != nil {
+			t.Fatalf("Error reading options: %v", err)
+		}
+		plugins, err := plugin_loader.Load([]traffic.PluginFactory{content_blocker_plugin.Factory}, configFile)
+		if err != nil {
+			t.Fatalf("Error loading plugins: %v", err)
+		}
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, plugins))
+
+		request, _ := http.NewRequest("GET", relayServer.URL+"/media.txt", nil)
+		for header, value := range testCase.headers {
+			request.Header.Set(header, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			relayServer.Close()
+			continue
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		relayServer.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			continue
+		}
+		if secret := response.Header.Get("X-Secret"); secret != "******" {
+			t.Errorf("Test '%v': Expected response header rules to apply but got %q", testCase.desc, secret)
+		}
+		if testCase.expectedContentType != "" {
+			if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, testCase.expectedContentType) {
+				t.Errorf("Test '%v': Expected Content-Type %v but got %v", testCase.desc, testCase.expectedContentType, contentType)
+			} else if !strings.Contains(string(body), "Content-Range: bytes 10-11/") {
+				t.Errorf("Test '%v': Expected both ranges but got %q", testCase.desc, body)
+			}
+			continue
+		}
+		if string(body) != testCase.expectedBody {
+			t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+		}
+	}
+}
+
+func TestRelaySupportsContentEncoding(t *testing.T) {
+	testCases := map[string]struct {
+		encoding       traffic.Encoding
+		bodyContentStr string
+		headers        map[string]string
+		customUrl      func(relayServiceURL string) string
+	}{
+		"identity": {
+			encoding:       traffic.Identity,
+			bodyContentStr: "Hello, world!",
+		},
+		"gzip - with header": {
+			encoding:       traffic.Gzip,
+			bodyContentStr: "Hello, world!",
+			headers: map[string]string{
+				"Content-Encoding": "gzip",
+			},
+		},
+		"brotli - with header": {
+			encoding:       traffic.Brotli,
+			bodyContentStr: "Hello, world!",
+			headers: map[string]string{
+				"Content-Encoding": "br",
+			},
+		},
+		"brotli - with query param": {
+			encoding:       traffic.Brotli,
+			bodyContentStr: "Hello, world!",
+			customUrl: func(relayServiceURL string) string {
+				return fmt.Sprintf("%v?ContentEncoding=br", relayServiceURL)
+			},
+		},
+		"zstd - with header": {
+			encoding:       traffic.Zstd,
+			bodyContentStr: "Hello, world!",
+			headers: map[string]string{
+				"Content-Encoding": "zstd",
+			},
+		},
+		"gzip - with query param": {
+			encoding:       traffic.Gzip,
+			bodyContentStr: "Hello, world!",
+			customUrl: func(relayServiceURL string) string {
+				return fmt.Sprintf("%v?ContentEncoding=gzip", relayServiceURL)
+			},
+		},
+	}
+
+	for desc, testCase := range testCases {
+		test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			// convert the body content to a reader with the proper content encoding applied
+			var body io.Reader
+			switch testCase.encoding {
+			case traffic.Gzip, traffic.Brotli, traffic.Zstd:
+				b, err := traffic.EncodeData([]byte(testCase.bodyContentStr), testCase.encoding)
+				if err != nil {
+					t.Errorf("Test %s - Error encoding data: %v", desc, err)
+					return
+				}
+				body = bytes.NewReader(b)
+			case traffic.Identity:
+				body = strings.NewReader(testCase.bodyContentStr)
+			}
+
+			requestURL := relayService.HttpUrl()
+			if testCase.customUrl != nil {
+				requestURL = testCase.customUrl(requestURL)
+			}
+			request, err := http.NewRequest("POST", requestURL, body)
+			if err != nil {
+				t.Errorf("Test %s - Error GETing: %v", desc, err)
+				return
+			}
+
+			for header, headerValue := range testCase.headers {
+				request.Header.Set(header, headerValue)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test %s - Error POSTing: %v", desc, err)
+				return
+			}
+
+			defer response.Body.Close()
+
+			if response.StatusCode != 200 {
+				t.Errorf("Test %s - Expected 200 response: %v", desc, response)
+				return
+			}
+
+			lastRequest, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test %s - Error reading last request body from catcher: %v", desc, err)
+				return
+			}
+
+			switch testCase.encoding {
+			case traffic.Gzip, traffic.Brotli, traffic.Zstd:
+				decodedData, err := traffic.DecodeData(lastRequest, testCase.encoding)
+				if err != nil {
+					t.Errorf("Test %s - Error decoding data: %v", desc, err)
+					return
+				}
+				if string(decodedData) != testCase.bodyContentStr {
+					t.Errorf("Test %s - Expected body '%v' but got: %v", desc, testCase.bodyContentStr, string(decodedData))
+				}
+			case traffic.Identity:
+				if string(lastRequest) != testCase.bodyContentStr {
+					t.Errorf("Test %s - Expected body '%v' but got: %v", desc, testCase.bodyContentStr, string(lastRequest))
+				}
+			}
+		})
+	}
+}
+
+// lengthPlugin reports the request length it sees, and replaces the body with
+// its upper-cased contents, either using SetRequestBody or, if the request
+// asks it to, with a reader whose length the relay can't know.
+type lengthPlugin struct{}
+
+func (plug lengthPlugin) Name() string {
+	return "length"
+}
+
+func (plug lengthPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	request.Header.Set("X-Seen-Length", strconv.FormatInt(request.ContentLength, 10))
+	body, _ := io.ReadAll(request.Body)
+	if request.Header.Get("X-Unknown-Length") != "" {
+		request.Body = io.NopCloser(bytes.NewReader(bytes.ToUpper(body)))
+	} else {
+		traffic.SetRequestBody(request, bytes.ToUpper(body))
+	}
+	return false
+}
+
+func TestRequestBodyLength(t *testing.T) {
+	type receivedRequest struct {
+		body          string
+		contentLength int64
+		seenLength    string
+	}
+	received := make(chan receivedRequest, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		if encoding, _ := traffic.GetContentEncoding(request); encoding != traffic.Identity {
+			if int64(len(body)) != request.ContentLength {
+				t.Errorf("Expected an encoded body of %v bytes but got %v", request.ContentLength, len(body))
+			}
+			body, _ = traffic.DecodeData(body, encoding)
+		}
+		received <- receivedRequest{
+			body:          string(body),
+			contentLength: request.ContentLength,
+			seenLength:    request.Header.Get("X-Seen-Length"),
+		}
+	}))
+	defer target.Close()
+
+	gzipped, _ := traffic.EncodeData([]byte("hello, world"), traffic.Gzip)
+	testCases := []struct {
+		desc     string
+		body     []byte
+		headers  map[string]string
+		expected receivedRequest
+	}{
+		{
+			desc:     "Bodies replaced using SetRequestBody have their length updated",
+			body:     []byte("hello, world"),
+			expected: receivedRequest{body: "HELLO, WORLD", contentLength: 12, seenLength: "12"},
+		},
+		{
+			desc:     "Bodies replaced without updating their length are chunked",
+			body:     []byte("hello, world"),
+			headers:  map[string]string{"X-Unknown-Length": "true"},
+			expected: receivedRequest{body: "HELLO, WORLD", contentLength: -1, seenLength: "12"},
+		},
+		{
+			desc:     "Plugins see the length of decoded bodies, and encoded bodies are relayed with their encoded length",
+			body:     gzipped,
+			headers:  map[string]string{"Content-Encoding": "gzip"},
+			expected: receivedRequest{body: "HELLO, WORLD", seenLength: "12"},
+		},
+	}
+
+	configFile, err := config.NewFileFromYamlString(fmt.Sprintf("relay:\n    port: 0\n    target: %v\n", target.URL))
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, []traffic.Plugin{lengthPlugin{}}))
+	defer relayServer.Close()
+
+	for _, testCase := range testCases {
+		request, _ := http.NewRequest("POST", relayServer.URL, bytes.NewReader(testCase.body))
+		for name, value := range testCase.headers {
+			request.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+			continue
+		}
+
+		actual := <-received
+		if testCase.headers["Content-Encoding"] != "" {
+			// The encoded length is checked by the target.
+			actual.contentLength = 0
+		}
+		if actual != testCase.expected {
+			t.Errorf("Test '%v': Expected the target to receive %+v but got %+v", testCase.desc, testCase.expected, actual)
+		}
+	}
+}
+
+func TestRelayNotFound(t *testing.T) {
+	test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		faviconURL := fmt.Sprintf("%v/favicon.ico", relayService.HttpUrl())
+		response, err := http.Get(faviconURL)
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		if response.StatusCode != 404 {
+			t.Errorf("Should have received 404: %v", response)
+			return
+		}
+	})
+}
+
+func TestSNIRouting(t *testing.T) {
+	defaultCertFile, defaultKeyFile := test.WriteSelfSignedCertificate(t, "default.example.test")
+	routeCertFile, routeKeyFile := test.WriteSelfSignedCertificate(t, "a.example.test")
+
+	routeTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("route target"))
+	}))
+	defer routeTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+    tls:
+        cert-file: %v
+        key-file: %v
+        sni-routes:
+            - server-name: a.example.test
+              cert-file: %v
+              key-file: %v
+              target: %v
+            - server-name: '*.b.example.test'
+              plugins:
+                  block-content:
+                      body:
+                          - mask: SECRET
+`, defaultCertFile, defaultKeyFile, routeCertFile, routeKeyFile, routeTarget.URL)
+
+	testCases := []struct {
+		desc                string
+		serverName          string
+		expectedCertificate string
+		expectedResponse    string // If set, the request shouldn't reach the catcher.
+		expectedCaughtBody  string
+	}{
+		{
+			desc:                "Exact match with its own target and certificate",
+			serverName:          "a.example.test",
+			expectedCertificate: "a.example.test",
+			expectedResponse:    "route target",
+		},
+		{
+			desc:                "Wildcard match with its own plugins",
+			serverName:          "x.B.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "******",
+		},
+		{
+			desc:                "Wildcards only match a single label",
+			serverName:          "x.y.b.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "SECRET",
+		},
+		{
+			desc:                "Unmatched server names use the default route",
+			serverName:          "other.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "SECRET",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if !strings.HasPrefix(relayService.HttpUrl(), "https://") {
+			t.Errorf("Expected an HTTPS URL but got %v", relayService.HttpUrl())
+			return
+		}
+
+		for _, testCase := range testCases {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: testCase.serverName, InsecureSkipVerify: true},
+			}}
+			response, err := client.Post(relayService.HttpUrl(), "text/plain", strings.NewReader("SECRET"))
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				continue
+			}
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response: %v", testCase.desc, err)
+				continue
+			}
+
+			if certificate := response.TLS.PeerCertificates[0].Subject.CommonName; certificate != testCase.expectedCertificate {
+				t.Errorf("Test '%v': Expected certificate for %v but got %v", testCase.desc, testCase.expectedCertificate, certificate)
+			}
+
+			if testCase.expectedResponse != "" {
+				if string(body) != testCase.expectedResponse {
+					t.Errorf("Test '%v': Expected response %q but got %q", testCase.desc, testCase.expectedResponse, body)
+				}
+				continue
+			}
+
+			caughtBody, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading caught body: %v", testCase.desc, err)
+				continue
+			}
+			if string(caughtBody) != testCase.expectedCaughtBody {
+				t.Errorf("Test '%v': Expected caught body %q but got %q", testCase.desc, testCase.expectedCaughtBody, caughtBody)
+			}
+		}
+	})
+}
+
+func TestVirtualHosts(t *testing.T) {
+	defaultCertFile, defaultKeyFile := test.WriteSelfSignedCertificate(t, "default.example.test")
+	hostCertFile, hostKeyFile := test.WriteSelfSignedCertificate(t, "a.example.test")
+
+	hostTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("host target"))
+	}))
+	defer hostTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+    tls:
+        cert-file: %v
+        key-file: %v
+    hosts:
+        a.example.test:
+            cert-file: %v
+            key-file: %v
+            target: %v
+        '*.b.example.test':
+            plugins:
+                block-content:
+                    body:
+                        - mask: SECRET
+`, defaultCertFile, defaultKeyFile, hostCertFile, hostKeyFile, hostTarget.URL)
+
+	testCases := []struct {
+		desc                string
+		host                string
+		expectedCertificate string
+		expectedResponse    string // If set, the request shouldn't reach the catcher.
+		expectedCaughtBody  string
+	}{
+		{
+			desc:                "Exact match with its own target and certificate",
+			host:                "a.example.test",
+			expectedCertificate: "a.example.test",
+			expectedResponse:    "host target",
+		},
+		{
+			desc:                "Wildcard match with its own plugins",
+			host:                "x.B.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "******",
+		},
+		{
+			desc:                "Wildcards only match a single label",
+			host:                "x.y.b.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "SECRET",
+		},
+		{
+			desc:                "Unmatched hosts use the default route",
+			host:                "other.example.test",
+			expectedCertificate: "default.example.test",
+			expectedCaughtBody:  "SECRET",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for _, testCase := range testCases {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: testCase.host, InsecureSkipVerify: true},
+			}}
+			request, err := http.NewRequest("POST", relayService.HttpUrl(), strings.NewReader("SECRET"))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			// Include the port, as browsers do for non-default ports.
+			request.Host = fmt.Sprintf("%v:%v", testCase.host, relayService.Port())
+
+			response, err := client.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				continue
+			}
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response: %v", testCase.desc, err)
+				continue
+			}
+
+			if certificate := response.TLS.PeerCertificates[0].Subject.CommonName; certificate != testCase.expectedCertificate {
+				t.Errorf("Test '%v': Expected certificate for %v but got %v", testCase.desc, testCase.expectedCertificate, certificate)
+			}
+
+			if testCase.expectedResponse != "" {
+				if string(body) != testCase.expectedResponse {
+					t.Errorf("Test '%v': Expected response %q but got %q", testCase.desc, testCase.expectedResponse, body)
+				}
+				continue
+			}
+
+			caughtBody, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading caught body: %v", testCase.desc, err)
+				continue
+			}
+			if string(caughtBody) != testCase.expectedCaughtBody {
+				t.Errorf("Test '%v': Expected caught body %q but got %q", testCase.desc, testCase.expectedCaughtBody, caughtBody)
+			}
+		}
+	})
+}
+
+func TestHostTargets(t *testing.T) {
+	newTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Write([]byte(name))
+		}))
+	}
+	shopTarget := newTarget("shop")
+	defer shopTarget.Close()
+	customersTarget := newTarget("customers")
+	defer customersTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+    host-targets: shop.example.test=%v *.customers.example.test=%v
+`, shopTarget.URL, customersTarget.URL)
+
+	testCases := []struct {
+		desc             string
+		host             string
+		expectedResponse string
+	}{
+		{desc: "Exact host", host: "shop.example.test", expectedResponse: "shop"},
+		{desc: "Host with port", host: "SHOP.example.test:8990", expectedResponse: "shop"},
+		{desc: "Wildcard host", host: "acme.customers.example.test", expectedResponse: "customers"},
+		{desc: "Unmatched host", host: "other.example.test", expectedResponse: ""},
+	}
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for _, testCase := range testCases {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			request.Host = testCase.host
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				continue
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+
+			if testCase.expectedResponse == "" {
+				// Unmatched hosts are relayed to the catcher.
+				if _, err := catcherService.LastRequest(); err != nil {
+					t.Errorf("Test '%v': Expected the request to reach the catcher: %v", testCase.desc, err)
+				}
+			} else if string(body) != testCase.expectedResponse {
+				t.Errorf("Test '%v': Expected response %q but got %q", testCase.desc, testCase.expectedResponse, body)
+			}
+		}
+	})
+
+	for _, invalidYaml := range []string{
+		"relay:\n    port: 0\n    target: http://localhost\n    host-targets: shop.example.test\n",
+		"relay:\n    port: 0\n    target: http://localhost\n    host-targets: a.test=http://a a.test=http://b\n",
+		"relay:\n    port: 0\n    target: http://localhost\n    host-targets: a.test=http://a\n    hosts:\n        A.test:\n",
+	} {
+		configFile, err := config.NewFileFromYamlString(invalidYaml)
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error reading configuration:\n%v", invalidYaml)
+		}
+	}
+}
+
+func TestACMEOptions(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		tls           string
+		expectedError bool
+	}{
+		{
+			desc: "ACME domains enable TLS",
+			tls: `
+        acme:
+            domains: [Relay.Example.test]
+            cache-dir: /tmp/relay-acme`,
+		},
+		{
+			desc: "SNI routes for ACME domains don't need certificates",
+			tls: `
+        acme:
+            domains: [relay.example.test]
+            cache-dir: /tmp/relay-acme
+        sni-routes:
+            - server-name: relay.example.test
+              target: http://localhost:1234`,
+		},
+		{
+			desc: "SNI routes for other domains still need certificates",
+			tls: `
+        acme:
+            domains: [relay.example.test]
+            cache-dir: /tmp/relay-acme
+        sni-routes:
+            - server-name: other.example.test
+              target: http://localhost:1234`,
+			expectedError: true,
+		},
+		{
+			desc: "ACME requires a cache directory",
+			tls: `
+        acme:
+            domains: [relay.example.test]`,
+			expectedError: true,
+		},
+		{
+			desc: "ACME doesn't support wildcards",
+			tls: `
+        acme:
+            domains: ['*.example.test']
+            cache-dir: /tmp/relay-acme`,
+			expectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString("relay:\n    port: 0\n    target: http://localhost\n    tls:" + testCase.tls + "\n")
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if testCase.expectedError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error", testCase.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+		} else if options.Service.TLS == nil || options.Service.TLS.ACME == nil {
+			t.Errorf("Test '%v': Expected ACME to be enabled", testCase.desc)
+		} else if !options.Service.TLS.ACME.Covers("relay.example.test") {
+			t.Errorf("Test '%v': Expected ACME to cover relay.example.test", testCase.desc)
+		}
+	}
+}
+
+func TestTargetTLS(t *testing.T) {
+	targetCertFile, targetKeyFile := test.WriteSelfSignedCertificate(t, "target.example.test")
+	clientCertFile, clientKeyFile := test.WriteSelfSignedCertificate(t, "relay.example.test")
+
+	targetCertificate, err := tls.LoadX509KeyPair(targetCertFile, targetKeyFile)
+	if err != nil {
+		t.Fatalf("Error loading target certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if clientCert, err := os.ReadFile(clientCertFile); err != nil || !clientCAs.AppendCertsFromPEM(clientCert) {
+		t.Fatalf("Error loading client certificate: %v", err)
+	}
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(request.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	target.TLS = &tls.Config{
+		Certificates: []tls.Certificate{targetCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		targetTLS        string
+		expectedStatus   int // Requests that can't be relayed aren't serviced.
+		expectedResponse string
+		expectedError    bool
+	}{
+		{
+			desc: "Client certificate and CA bundle",
+			targetTLS: fmt.Sprintf(`
+        cert-file: %v
+        key-file: %v
+        ca-file: %v
+        server-name: target.example.test`, clientCertFile, clientKeyFile, targetCertFile),
+			expectedStatus:   http.StatusOK,
+			expectedResponse: "relay.example.test",
+		},
+		{
+			desc: "No client certificate",
+			targetTLS: fmt.Sprintf(`
+        ca-file: %v
+        server-name: target.example.test`, targetCertFile),
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			desc: "Target not signed by the CA bundle",
+			targetTLS: fmt.Sprintf(`
+        cert-file: %v
+        key-file: %v
+        ca-file: %v
+        server-name: target.example.test`, clientCertFile, clientKeyFile, clientCertFile),
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			desc: "Certificate without a key",
+			targetTLS: fmt.Sprintf(`
+        cert-file: %v`, clientCertFile),
+			expectedError: true,
+		},
+		{
+			desc: "CA bundle without certificates",
+			targetTLS: fmt.Sprintf(`
+        ca-file: %v`, clientKeyFile),
+			expectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf("relay:\n    port: 0\n    target: %v\n    target-tls:%v\n", target.URL, testCase.targetTLS))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if testCase.expectedError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error", testCase.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+		response, err := http.Get(relayServer.URL)
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			relayServer.Close()
+			continue
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		relayServer.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		} else if testCase.expectedResponse != "" && string(body) != testCase.expectedResponse {
+			t.Errorf("Test '%v': Expected response %q but got %q", testCase.desc, testCase.expectedResponse, body)
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	certFile, keyFile := test.WriteSelfSignedCertificate(t, "relay.example.test")
+
+	configYaml := fmt.Sprintf(`relay:
+    tls:
+        cert-file: %v
+        key-file: %v
+block-content:
+    body:
+        - mask: SECRET
+`, certFile, keyFile)
+
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+
+		// Plugins see decoded bodies, whichever protocol the client uses.
+		body, err := traffic.EncodeData([]byte("The secret is SECRET"), traffic.Gzip)
+		if err != nil {
+			t.Fatalf("Error encoding body: %v", err)
+		}
+		request, _ := http.NewRequest("POST", relayService.HttpUrl(), bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", "gzip")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2 but got %v", response.Proto)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 but got %v", response.StatusCode)
+		}
+
+		caughtBody, err := catcherService.LastRequestBody()
+		if err != nil {
+			t.Fatalf("Error reading caught body: %v", err)
+		}
+		if decodedBody, err := traffic.DecodeData(caughtBody, traffic.Gzip); err != nil {
+			t.Errorf("Error decoding caught body: %v", err)
+		} else if string(decodedBody) != "The secret is ******" {
+			t.Errorf("Expected caught body %q but got %q", "The secret is ******", decodedBody)
+		}
+
+		// Websockets fall back to HTTP/1.1.
+		wsConfig, err := websocket.NewConfig(relayService.WsUrl()+"/echo", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error configuring websocket: %v", err)
+		}
+		wsConfig.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+		ws, err := websocket.DialConfig(wsConfig)
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		defer ws.Close()
+		if err := testEcho(ws, "Over"); err != nil {
+			t.Errorf("Error in echo: %v", err)
+		}
+	})
+}
+
+func TestTargetHTTP2(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(request.Proto))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("Error writing CA bundle: %v", err)
+	}
+
+	testCases := []struct {
+		desc          string
+		targetHTTP2   string
+		expectedProto string
+	}{
+		{
+			desc:          "HTTP/1.1 by default",
+			targetHTTP2:   "",
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			desc:          "HTTP/2 when enabled",
+			targetHTTP2:   "true",
+			expectedProto: "HTTP/2.0",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+    target-http2: %v
+    target-tls:
+        ca-file: %v
+`, target.URL, testCase.targetHTTP2, caFile))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+		if proto := string(getBody(relayServer.URL, t)); proto != testCase.expectedProto {
+			t.Errorf("Test '%v': Expected the target to see %v but got %v", testCase.desc, testCase.expectedProto, proto)
+		}
+		relayServer.Close()
+	}
+}
+
+// upperCaseGrpcPlugin upper-cases the messages of gRPC calls.
+type upperCaseGrpcPlugin struct{}
+
+func (plug upperCaseGrpcPlugin) Name() string {
+	return "upper-case-grpc"
+}
+
+func (plug upperCaseGrpcPlugin) HandleRequest(http.ResponseWriter, *http.Request, traffic.RequestInfo) bool {
+	return false
+}
+
+func (plug upperCaseGrpcPlugin) HandleGrpcMessage(request *http.Request, message *traffic.GrpcMessage) {
+	message.Payload = bytes.ToUpper(message.Payload)
+}
+
+// grpcFrame returns a gRPC message framed with its length prefix.
+func grpcFrame(payload string) []byte {
+	frame := []byte{0, 0, 0, 0, byte(len(payload))}
+	return append(frame, payload...)
+}
+
+func TestGrpc(t *testing.T) {
+	var caughtBody []byte
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		caughtBody, _ = io.ReadAll(request.Body)
+		response.Header().Set("Content-Type", "application/grpc")
+		response.Header().Set("Trailer", "Grpc-Status")
+		response.Write(grpcFrame("pong"))
+		response.Write(grpcFrame("done"))
+		response.Header().Set("Grpc-Status", "0")
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("Error writing CA bundle: %v", err)
+	}
+	configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+    target-http2: true
+    target-tls:
+        ca-file: %v
+`, target.URL, caFile))
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+
+	relayServer := httptest.NewUnstartedServer(traffic.NewHandler(options.Relay, []traffic.Plugin{upperCaseGrpcPlugin{}}))
+	relayServer.EnableHTTP2 = true
+	relayServer.StartTLS()
+	defer relayServer.Close()
+
+	requestBody := append(grpcFrame("ping"), grpcFrame("again")...)
+	request, _ := http.NewRequest("POST", relayServer.URL+"/test.v1.Service/Call", bytes.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	response, err := relayServer.Client().Do(request)
+	if err != nil {
+		t.Fatalf("Error calling relay: %v", err)
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	if expected := append(grpcFrame("PING"), grpcFrame("AGAIN")...); !bytes.Equal(caughtBody, expected) {
+		t.Errorf("Expected the target to receive %q but got %q", expected, caughtBody)
+	}
+	if expected := append(grpcFrame("PONG"), grpcFrame("DONE")...); !bytes.Equal(responseBody, expected) {
+		t.Errorf("Expected response %q but got %q", expected, responseBody)
+	}
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected Grpc-Status trailer 0 but got %q", status)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	configYaml := `relay:
+    dry-run: true
+block-content:
+    body:
+        - mask: SECRET
+`
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		request, _ := http.NewRequest("POST", relayService.HttpUrl()+"/events?id=1", strings.NewReader("The secret is SECRET"))
+		request.Header.Set("Cookie", "session=abc")
+		request.Header.Set("X-Custom", "custom")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 but got %v", response.StatusCode)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "message/http" {
+			t.Errorf("Expected Content-Type message/http but got %v", contentType)
+		}
+
+		preview, err := http.ReadRequest(bufio.NewReader(response.Body))
+		if err != nil {
+			t.Fatalf("Error parsing previewed request: %v", err)
+		}
+		catcherURL, _ := url.Parse(catcherService.HttpUrl())
+		if preview.Method != "POST" || preview.Host != catcherURL.Host || preview.RequestURI != "/events?id=1" {
+			t.Errorf("Unexpected previewed request line: %v %v %v", preview.Method, preview.Host, preview.RequestURI)
+		}
+		for header, expectedValue := range map[string]string{
+			"Cookie":          "",
+			"X-Custom":        "custom",
+			"X-Forwarded-For": "127.0.0.1",
+			"X-Relay-Version": version.RelayRelease,
+		} {
+			if actualValue := preview.Header.Get(header); actualValue != expectedValue {
+				t.Errorf("Expected previewed header '%v' to be '%v' but got '%v'", header, expectedValue, actualValue)
+			}
+		}
+		if body, err := io.ReadAll(preview.Body); err != nil {
+			t.Errorf("Error reading previewed body: %v", err)
+		} else if string(body) != "The secret is ******" {
+			t.Errorf("Expected previewed body %q but got %q", "The secret is ******", body)
+		}
+
+		if _, err := catcherService.LastRequest(); err == nil {
+			t.Errorf("Expected the request not to be relayed")
+		}
+	})
+}
+
+func TestDuplicateHeaderPolicy(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		policy         string
+		expectedStatus int
+		expectedValues []string
+	}{
+		{
+			desc:           "Repeated headers are relayed as is by default",
+			policy:         "",
+			expectedStatus: http.StatusOK,
+			expectedValues: []string{"a", "b", "c"},
+		},
+		{
+			desc:           "Repeated headers can be folded",
+			policy:         "fold",
+			expectedStatus: http.StatusOK,
+			expectedValues: []string{"a, b, c"},
+		},
+		{
+			desc:           "The first repeated header can be kept",
+			policy:         "first",
+			expectedStatus: http.StatusOK,
+			expectedValues: []string{"a"},
+		},
+		{
+			desc:           "The last repeated header can be kept",
+			policy:         "last",
+			expectedStatus: http.StatusOK,
+			expectedValues: []string{"c"},
+		},
+		{
+			desc:           "Requests with repeated headers can be rejected",
+			policy:         "reject",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+    duplicate-header-policy: %v
+`, testCase.policy)
+		test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, _ := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			request.Header.Set("X-Single", "single")
+			for _, value := range []string{"a", "b", "c"} {
+				request.Header.Add("X-Repeated", value)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if testCase.expectedValues == nil {
+				if err == nil {
+					t.Errorf("Test '%v': Expected the request not to be relayed", testCase.desc)
+				}
+				return
+			} else if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if values := lastRequest.Header.Values("X-Repeated"); !reflect.DeepEqual(values, testCase.expectedValues) {
+				t.Errorf("Test '%v': Expected X-Repeated values %q but got %q", testCase.desc, testCase.expectedValues, values)
+			}
+			if value := lastRequest.Header.Get("X-Single"); value != "single" {
+				t.Errorf("Test '%v': Expected X-Single to be relayed unchanged but got %q", testCase.desc, value)
+			}
+		})
+	}
+}
+
+func TestMalformedBodyPolicy(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		policy           string
+		encoding         string
+		expectedStatus   int
+		expectedBody     string // The body the target receives, if the request is relayed.
+		expectedEncoding string
+	}{
+		{
+			desc:           "Malformed bodies are rejected by default",
+			policy:         "",
+			encoding:       "gzip",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "Malformed bodies can be rejected explicitly",
+			policy:         "reject",
+			encoding:       "zstd",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:             "Malformed bodies can be forwarded untouched",
+			policy:           "forward",
+			encoding:         "gzip",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "The secret is SECRET",
+			expectedEncoding: "gzip",
+		},
+		{
+			desc:             "Malformed bodies can be treated as unencoded",
+			policy:           "identity",
+			encoding:         "gzip",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "The secret is ******",
+			expectedEncoding: "",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+    malformed-body-policy: %v
+block-content:
+    body:
+        - mask: SECRET
+`, testCase.policy)
+		plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, _ := http.NewRequest("POST", relayService.HttpUrl(), strings.NewReader("The secret is SECRET"))
+			request.Header.Set("Content-Encoding", testCase.encoding)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if testCase.expectedBody == "" {
+				if err == nil {
+					t.Errorf("Test '%v': Expected the request not to be relayed", testCase.desc)
+				}
+				return
+			} else if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if encoding := lastRequest.Header.Get("Content-Encoding"); encoding != testCase.expectedEncoding {
+				t.Errorf("Test '%v': Expected Content-Encoding '%v' but got '%v'", testCase.desc, testCase.expectedEncoding, encoding)
+			}
+			if body, err := catcherService.LastRequestBody(); err != nil {
+				t.Errorf("Test '%v': Error reading last request body from catcher: %v", testCase.desc, err)
+			} else if string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected the target to receive %q but got %q", testCase.desc, testCase.expectedBody, body)
+			}
+		})
+	}
+}
+
+// peekingPlugin reads request bodies without consuming them, and reports what
+// it found to the target in headers.
+type peekingPlugin struct{}
+
+func (plug peekingPlugin) Name() string {
+	return "peeking"
+}
+
+func (plug peekingPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	if body, ok := request.Body.(*traffic.BodyReader); ok {
+		peeked, _ := io.ReadAll(body.Reopen())
+		request.Header.Set("X-Peeked", strconv.Itoa(len(peeked)))
+		request.Header.Set("X-Spooled", strconv.FormatBool(body.Spooled()))
+	}
+	return false
+}
+
+func TestSpooledBodies(t *testing.T) {
+	type receivedRequest struct {
+		body    string
+		peeked  string
+		spooled string
+	}
+	received := make(chan receivedRequest, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		encoding, _ := traffic.GetContentEncoding(request)
+		if decoded, err := traffic.DecodeData(body, encoding); err == nil {
+			body = decoded
+		}
+		received <- receivedRequest{
+			body:    string(body),
+			peeked:  request.Header.Get("X-Peeked"),
+			spooled: request.Header.Get("X-Spooled"),
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	testCases := []struct {
+		desc            string
+		body            string
+		encoding        string
+		expectedStatus  int
+		expectedSpooled string
+	}{
+		{
+			desc:            "Small bodies are held in memory",
+			body:            "small",
+			expectedStatus:  http.StatusOK,
+			expectedSpooled: "false",
+		},
+		{
+			desc:            "Large bodies are spooled",
+			body:            strings.Repeat("large ", 20),
+			expectedStatus:  http.StatusOK,
+			expectedSpooled: "true",
+		},
+		{
+			desc:            "Compressed bodies are spooled once decoded",
+			body:            strings.Repeat("compressed ", 50),
+			encoding:        "gzip",
+			expectedStatus:  http.StatusOK,
+			expectedSpooled: "true",
+		},
+		{
+			desc:           "Bodies larger than the maximum are rejected",
+			body:           strings.Repeat("huge ", 500),
+			encoding:       "gzip",
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	spoolDir := t.TempDir()
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.MaxBodySize = 1024
+	options.SpoolThreshold = 16
+	options.SpoolDir = spoolDir
+	relayServer := httptest.NewServer(traffic.NewHandler(options, []traffic.Plugin{peekingPlugin{}}))
+	defer relayServer.Close()
+
+	for _, testCase := range testCases {
+		body := []byte(testCase.body)
+		if testCase.encoding != "" {
+			encoding, _ := traffic.ParseEncoding(testCase.encoding)
+			body, _ = traffic.EncodeData(body, encoding)
+		}
+		request, _ := http.NewRequest("POST", relayServer.URL, bytes.NewReader(body))
+		if testCase.encoding != "" {
+			request.Header.Set("Content-Encoding", testCase.encoding)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+
+		if testCase.expectedStatus == http.StatusOK {
+			request := <-received
+			expected := receivedRequest{
+				body:    testCase.body,
+				peeked:  strconv.Itoa(len(testCase.body)),
+				spooled: testCase.expectedSpooled,
+			}
+			if request != expected {
+				t.Errorf("Test '%v': Expected the target to receive %+v but got %+v", testCase.desc, expected, request)
+			}
+		}
+
+		// Bodies are removed once the handler returns, which may be just
+		// after the client receives the response.
+		var entries []os.DirEntry
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if entries, err = os.ReadDir(spoolDir); err != nil || len(entries) == 0 {
+				break
+			}
+		}
+		if err != nil || len(entries) > 0 {
+			t.Errorf("Test '%v': Expected spooled bodies to be removed but found %v (%v)", testCase.desc, entries, err)
+		}
+	}
+}
+
+func TestSpoolOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"spool-threshold: 0",
+		"spool-threshold: 4096\n    max-body-size: 1024",
+		"spool-threshold: 16\n    spool-dir: /nonexistent/spool",
+		"spool-threshold: 16\n    spool-encryption-key: c2hvcnQ=",
+		"spool-threshold: 16\n    spool-max-age: 0s",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestMirrorTarget(t *testing.T) {
+	type mirroredRequest struct {
+		method  string
+		path    string
+		body    string
+		version string
+	}
+	mirrored := make(chan mirroredRequest, 1)
+	release := make(chan struct{})
+	mirrorTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		mirrored <- mirroredRequest{
+			method:  request.Method,
+			path:    request.URL.Path,
+			body:    string(body),
+			version: request.Header.Get(traffic.RelayVersionHeaderName),
+		}
+		// Keep the mirror busy, to show that clients don't wait for it.
+		<-release
+		response.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mirrorTarget.Close()
+	defer close(release)
+
+	configYaml := fmt.Sprintf(`relay:
+    mirror-target: %v
+block-content:
+    body:
+        - mask: SECRET
+`, mirrorTarget.URL)
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Post(relayService.HttpUrl()+"/events", "text/plain", strings.NewReader("The secret is SECRET"))
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 but got %v", response.StatusCode)
+		}
+		if body, err := catcherService.LastRequestBody(); err != nil {
+			t.Errorf("Error reading last request from catcher: %v", err)
+		} else if string(body) != "The secret is ******" {
+			t.Errorf("Expected the target to receive %q but got %q", "The secret is ******", body)
+		}
+
+		select {
+		case request := <-mirrored:
+			expected := mirroredRequest{
+				method:  "POST",
+				path:    "/events",
+				body:    "The secret is ******",
+				version: version.RelayRelease,
+			}
+			if request != expected {
+				t.Errorf("Expected the mirror target to receive %+v but got %+v", expected, request)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Timed out waiting for the mirrored request")
+		}
+	})
+}
+
+func TestMultipleCatchers(t *testing.T) {
+	configYaml := `relay:
+    mirror-target: ${CATCHER_URL_2}
+`
+	test.WithMultiCatcherAndRelay(t, 3, configYaml, nil, func(catcherServices []*catcher.Service, relayService *relay.Service) {
+		for _, host := range []string{"", test.CatcherHost(0), test.CatcherHost(1)} {
+			request, _ := http.NewRequest("POST", relayService.HttpUrl()+"/events", strings.NewReader(host))
+			if host != "" {
+				request.Host = host
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("Error POSTing: %v", err)
+			}
+			response.Body.Close()
+		}
+
+		expected := [][]string{
+			{"", test.CatcherHost(0)},
+			{test.CatcherHost(1)},
+		}
+		for i, expectedBodies := range expected {
+			requests, err := catcherServices[i].Requests()
+			if err != nil {
+				t.Errorf("Error reading requests from catcher %v: %v", i, err)
+				continue
+			}
+			var bodies []string
+			for _, request := range requests {
+				body, _ := io.ReadAll(request.Body)
+				bodies = append(bodies, string(body))
+			}
+			if !reflect.DeepEqual(bodies, expectedBodies) {
+				t.Errorf("Expected catcher %v to receive %q but got %q", i, expectedBodies, bodies)
+			}
+		}
+
+		// Virtual hosts inherit the mirror target, so every request is
+		// mirrored.
+		var mirrored []*http.Request
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if mirrored, _ = catcherServices[2].Requests(); len(mirrored) >= 3 {
+				break
+			}
+		}
+		if len(mirrored) != 3 {
+			t.Errorf("Expected the mirror catcher to receive 3 requests but got %v", len(mirrored))
+		}
+	})
+}
+
+func TestRelayOptions(t *testing.T) {
+	catcherService := catcher.NewService()
+	if err := catcherService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting catcher: %v", err)
+	}
+	defer catcherService.Close()
+	catcherURL, _ := url.Parse(catcherService.HttpUrl())
+
+	options := &relay.Options{Service: relay.NewDefaultServiceOptions(), Relay: traffic.NewDefaultRelayOptions()}
+	options.Relay.TargetScheme = catcherURL.Scheme
+	options.Relay.TargetHost = catcherURL.Host
+	options.Relay.DryRun = true
+	test.WithRelayOptions(t, options, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl() + "/events")
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+		if contentType := response.Header.Get("Content-Type"); contentType != "message/http" {
+			t.Errorf("Expected a dry run preview but got Content-Type '%v'", contentType)
+		}
+		if _, err := catcherService.LastRequest(); err == nil {
+			t.Errorf("Expected the dry run not to reach the target")
+		}
+	})
+}
+
+func TestMirrorComparison(t *testing.T) {
+	// The mirror target behaves like the catcher, except at /changed.
+	mirrorTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/changed" {
+			http.Error(response, "Not implemented yet", http.StatusNotImplemented)
+			return
+		}
+		response.Write([]byte(catcher.IndexHTML))
+	}))
+	defer mirrorTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+    mirror-target: %v
+    mirror-compare: true
+    mirror-compare-headers: [Content-Type]
+`, mirrorTarget.URL)
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for _, path := range []string{"/unchanged", "/changed"} {
+			response, err := http.Get(relayService.HttpUrl() + path)
+			if err != nil {
+				t.Fatalf("Error GETing: %v", err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		// Responses are compared in the background.
+		value := func(name string, labels ...string) float64 {
+			return test.ReadMetrics(t, relayService).Value(name, labels...)
+		}
+		for start := time.Now(); value("relay_mirror_comparisons_total", "result", "match")+value("relay_mirror_comparisons_total", "result", "mismatch") < 2; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Timed out waiting for responses to be compared")
+			}
+		}
+
+		expected := []struct {
+			name  string
+			label string
+			value string
+			count float64
+		}{
+			{"relay_mirror_comparisons_total", "result", "match", 1},
+			{"relay_mirror_comparisons_total", "result", "mismatch", 1},
+			{"relay_mirror_mismatches_total", "field", "status", 1},
+			{"relay_mirror_mismatches_total", "field", "header", 1},
+			{"relay_mirror_mismatches_total", "field", "body", 1},
+		}
+		for _, metric := range expected {
+			if count := value(metric.name, metric.label, metric.value); count != metric.count {
+				t.Errorf("Expected %v{%v=%q} to be %v but got %v", metric.name, metric.label, metric.value, metric.count, count)
+			}
+		}
+	})
+}
+
+func TestMirrorOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"mirror-target: /relative",
+		"mirror-target: http://mirror.example\n    mirror-queue-size: 0",
+		"mirror-target: http://mirror.example\n    mirror-queue-size: many",
+		"mirror-compare: true",
+		"mirror-target: http://mirror.example\n    mirror-compare-headers: [Content-Type]",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestWebsocketBridge(t *testing.T) {
+	configYaml := `relay:
+    websocket-bridge-path: /bridge
+block-content:
+    body:
+        - mask: SECRET
+`
+	plugins := []traffic.PluginFactory{content_blocker_plugin.Factory}
+	test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+		wsConfig, err := websocket.NewConfig(relayService.WsUrl()+"/bridge", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error configuring websocket: %v", err)
+		}
+		wsConfig.Header.Set("User-Agent", "bridge-test")
+		ws, err := websocket.DialConfig(wsConfig)
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		defer ws.Close()
+
+		gzipped, err := traffic.EncodeData([]byte("gzipped SECRET"), traffic.Gzip)
+		if err != nil {
+			t.Fatalf("Error encoding data: %v", err)
+		}
+
+		testCases := []struct {
+			desc           string
+			message        map[string]interface{}
+			expectedStatus int
+			expectedPath   string
+			expectedBody   string
+		}{
+			{
+				desc: "Messages are relayed as POSTs through plugins",
+				message: map[string]interface{}{
+					"id":      "1",
+					"path":    "/rec/bundle?Seq=1",
+					"headers": map[string]string{"Content-Type": "text/plain"},
+					"body":    "first SECRET",
+				},
+				expectedStatus: http.StatusOK,
+				expectedPath:   "/rec/bundle?Seq=1",
+				expectedBody:   "first ******",
+			},
+			{
+				desc: "Base64-encoded bodies are decoded",
+				message: map[string]interface{}{
+					"id":      "2",
+					"path":    "/rec/bundle?Seq=2",
+					"headers": map[string]string{"Content-Type": "text/plain", "Content-Encoding": "gzip"},
+					"body":    base64.StdEncoding.EncodeToString(gzipped),
+					"base64":  true,
+				},
+				expectedStatus: http.StatusOK,
+				expectedPath:   "/rec/bundle?Seq=2",
+				expectedBody:   "gzipped ******",
+			},
+			{
+				desc:           "Messages need an absolute path",
+				message:        map[string]interface{}{"id": "3", "path": "http://example.com/"},
+				expectedStatus: http.StatusBadRequest,
+			},
+		}
+
+		for _, testCase := range testCases {
+			if err := websocket.JSON.Send(ws, testCase.message); err != nil {
+				t.Fatalf("Test '%v': Error sending message: %v", testCase.desc, err)
+			}
+			var reply struct {
+				Id     string `json:"id"`
+				Status int    `json:"status"`
+				Error  string `json:"error"`
+			}
+			if err := websocket.JSON.Receive(ws, &reply); err != nil {
+				t.Fatalf("Test '%v': Error receiving reply: %v", testCase.desc, err)
+			}
+			if reply.Id != testCase.message["id"] || reply.Status != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected reply %v with status %v but got %+v", testCase.desc, testCase.message["id"], testCase.expectedStatus, reply)
+				continue
+			}
+			if testCase.expectedPath == "" {
+				continue
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request: %v", testCase.desc, err)
+				continue
+			}
+			body, _ := io.ReadAll(lastRequest.Body)
+			if lastRequest.Header.Get("Content-Encoding") == "gzip" {
+				body, _ = traffic.DecodeData(body, traffic.Gzip)
+			}
+			if lastRequest.Method != http.MethodPost || lastRequest.URL.String() != testCase.expectedPath {
+				t.Errorf("Test '%v': Expected POST %v but got %v %v", testCase.desc, testCase.expectedPath, lastRequest.Method, lastRequest.URL)
+			}
+			if string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body %q but got %q", testCase.desc, testCase.expectedBody, body)
+			}
+			if userAgent := lastRequest.Header.Get("User-Agent"); userAgent != "bridge-test" {
+				t.Errorf("Test '%v': Expected the upgrade request's User-Agent but got %q", testCase.desc, userAgent)
+			}
+			if lastRequest.Header.Get("Sec-WebSocket-Key") != "" || lastRequest.Header.Get("Upgrade") != "" {
+				t.Errorf("Test '%v': Expected websocket headers to be removed but got %v", testCase.desc, lastRequest.Header)
+			}
+		}
+	})
+}
+
+func TestRetries(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	failures := 0 // The number of requests the target fails before succeeding.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts <= failures {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	unreachableTarget := httptest.NewServer(http.NotFoundHandler())
+	unreachableTarget.Close()
+
+	testCases := []struct {
+		desc             string
+		retries          string
+		target           string
+		method           string
+		failures         int
+		expectedStatus   int
+		expectedAttempts int
+		expectedHeader   string
+	}{
+		{
+			desc:             "Requests aren't retried by default",
+			retries:          "",
+			method:           "GET",
+			failures:         1,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+			expectedHeader:   "",
+		},
+		{
+			desc:             "GET requests are retried until they succeed",
+			retries:          "max-attempts: 3\n        initial-backoff: 1ms",
+			method:           "GET",
+			failures:         2,
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 3,
+			expectedHeader:   "3",
+		},
+		{
+			desc:             "HEAD requests are retried",
+			retries:          "max-attempts: 3\n        initial-backoff: 1ms",
+			method:           "HEAD",
+			failures:         1,
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 2,
+			expectedHeader:   "2",
+		},
+		{
+			desc:             "The last failure is relayed once attempts run out",
+			retries:          "max-attempts: 3\n        initial-backoff: 1ms",
+			method:           "GET",
+			failures:         5,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 3,
+			expectedHeader:   "3",
+		},
+		{
+			desc:             "POST requests aren't retried",
+			retries:          "max-attempts: 3\n        initial-backoff: 1ms",
+			method:           "POST",
+			failures:         1,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+			expectedHeader:   "1",
+		},
+		{
+			desc:             "No attempt starts after the time limit",
+			retries:          "max-attempts: 3\n        initial-backoff: 1s\n        max-elapsed: 500ms",
+			method:           "GET",
+			failures:         1,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+			expectedHeader:   "1",
+		},
+		{
+			desc:           "Connection errors are retried",
+			retries:        "max-attempts: 2\n        initial-backoff: 1ms",
+			target:         unreachableTarget.URL,
+			method:         "GET",
+			expectedStatus: http.StatusNotFound,
+			expectedHeader: "2",
+		},
+	}
+
+	for _, testCase := range testCases {
+		targetURL := target.URL
+		if testCase.target != "" {
+			targetURL = testCase.target
+		}
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+    retries:
+        %v
+`, targetURL, testCase.retries))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		mutex.Lock()
+		attempts = 0
+		failures = testCase.failures
+		mutex.Unlock()
+
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+		request, _ := http.NewRequest(testCase.method, relayServer.URL, nil)
+		response, err := http.DefaultClient.Do(request)
+		relayServer.Close()
+		if err != nil {
+			t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+		if header := response.Header.Get(traffic.AttemptsHeaderName); header != testCase.expectedHeader {
+			t.Errorf("Test '%v': Expected %v header '%v' but got '%v'", testCase.desc, traffic.AttemptsHeaderName, testCase.expectedHeader, header)
+		}
+		mutex.Lock()
+		if attempts != testCase.expectedAttempts {
+			t.Errorf("Test '%v': Expected %v attempts but the target saw %v", testCase.desc, testCase.expectedAttempts, attempts)
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestRetriesOfTargetFaults(t *testing.T) {
+	reset := catcher.Response{Fault: catcher.FaultConnectionReset}
+	unavailable := catcher.Response{Status: http.StatusServiceUnavailable}
+	ok := catcher.Response{Body: []byte("ok")}
+
+	testCases := []struct {
+		desc             string
+		responses        []catcher.Response
+		expectedStatus   int
+		expectedAttempts int
+	}{
+		{
+			desc:             "Reset connections are retried",
+			responses:        []catcher.Response{reset, ok},
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 2,
+		},
+		{
+			desc:             "Unavailable targets are retried",
+			responses:        []catcher.Response{unavailable, unavailable, ok},
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 3,
+		},
+		{
+			desc:             "Attempts stop at the maximum",
+			responses:        []catcher.Response{unavailable},
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, `relay:
+    retries:
+        max-attempts: 3
+        initial-backoff: 1ms
+`, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			catcherService.Respond("/events", testCase.responses...)
+
+			response, err := http.Get(relayService.HttpUrl() + "/events")
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if requests, _ := catcherService.Requests(catcher.WithPath("/events")); len(requests) != testCase.expectedAttempts {
+				t.Errorf("Test '%v': Expected the target to receive %v attempts but got %v", testCase.desc, testCase.expectedAttempts, len(requests))
+			}
+		})
+	}
+}
+
+func TestRetryOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"max-attempts: -1",
+		"max-attempts: many",
+		"initial-backoff: soon",
+		"max-elapsed: -1s",
+		"initial-backoff: 5s\n        max-backoff: 1s",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    retries:
+        %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+// debuggedPlugin handles requests in one of the ways debug headers report,
+// depending on its name.
+type debuggedPlugin struct {
+	name string
+}
+
+func (plug debuggedPlugin) Name() string {
+	return plug.name
+}
+
+func (plug debuggedPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	switch plug.name {
+	case "tagger":
+		info.Tags.Add("debugged")
+	case "modifier":
+		request.Header.Set("X-Modified", "true")
+	case "servicer":
+		if info.OriginalURL.Path == "/serviced" {
+			response.WriteHeader(http.StatusNoContent)
+			return true
+		}
+	}
+	return false
+}
+
+func TestDebugHeaders(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		config          string
+		path            string
+		debugHeader     bool
+		expectedPlugins string // Empty if no debug headers are expected.
+		expectedTags    string
+	}{
+		{
+			desc:            "Debug headers can be added to every response",
+			config:          "debug-headers: true",
+			path:            "/relayed",
+			expectedPlugins: "tagger=passed, modifier=modified(header), servicer=passed",
+			expectedTags:    "debugged",
+		},
+		{
+			desc:            "Plugins which service requests are listed last",
+			config:          "debug-headers: true",
+			path:            "/serviced",
+			expectedPlugins: "tagger=passed, modifier=modified(header), servicer=serviced",
+			expectedTags:    "debugged",
+		},
+		{
+			desc:            "Trusted clients can ask for debug headers",
+			config:          "debug-networks:\n        - 127.0.0.0/8",
+			path:            "/relayed",
+			debugHeader:     true,
+			expectedPlugins: "tagger=passed, modifier=modified(header), servicer=passed",
+			expectedTags:    "debugged",
+		},
+		{
+			desc:   "Trusted clients only get debug headers if they ask",
+			config: "debug-networks:\n        - 127.0.0.0/8",
+			path:   "/relayed",
+		},
+		{
+			desc:        "Other clients can't ask for debug headers",
+			config:      "debug-networks:\n        - 10.0.0.0/8",
+			path:        "/relayed",
+			debugHeader: true,
+		},
+		{
+			desc:        "Debug headers are off by default",
+			config:      "",
+			path:        "/relayed",
+			debugHeader: true,
+		},
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get(traffic.DebugHeaderName) != "" && request.Header.Get("X-Expect-Debug-Header") == "" {
+			response.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer target.Close()
+	plugins := []traffic.Plugin{
+		debuggedPlugin{"tagger"},
+		debuggedPlugin{"modifier"},
+		debuggedPlugin{"servicer"},
+	}
+
+	for _, testCase := range testCases {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+    %v
+`, target.URL, testCase.config))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, plugins))
+
+		request, _ := http.NewRequest("GET", relayServer.URL+testCase.path, nil)
+		if testCase.debugHeader {
+			request.Header.Set(traffic.DebugHeaderName, "true")
+			// The header is only relayed if the relay doesn't act on it.
+			if testCase.config == "" {
+				request.Header.Set("X-Expect-Debug-Header", "true")
+			}
+		}
+		response, err := http.DefaultClient.Do(request)
+		relayServer.Close()
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusBadRequest {
+			t.Errorf("Test '%v': Expected %v not to be relayed", testCase.desc, traffic.DebugHeaderName)
+		}
+		if values := response.Header.Values(traffic.DebugPluginsHeaderName); testCase.expectedPlugins == "" && len(values) > 0 {
+			t.Errorf("Test '%v': Expected no debug headers but got %q", testCase.desc, values)
+		} else if testCase.expectedPlugins != "" && response.Header.Get(traffic.DebugPluginsHeaderName) != testCase.expectedPlugins {
+			t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, traffic.DebugPluginsHeaderName, testCase.expectedPlugins, response.Header.Get(traffic.DebugPluginsHeaderName))
+		}
+		if tags := response.Header.Get(traffic.DebugTagsHeaderName); tags != testCase.expectedTags {
+			t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, traffic.DebugTagsHeaderName, testCase.expectedTags, tags)
+		}
+	}
+}
+
+func TestDebugOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"debug-headers: sometimes",
+		"debug-networks:\n        - 10.0.0.0",
+		"debug-networks:\n        - 10.0.0.0/33",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	testCases := []struct {
+		desc                 string
+		trustedProxies       string
+		forwardedFor         string
+		expectedClientIP     string
+		expectedForwardedFor string
+		expectForwardedPort  bool
+	}{
+		{
+			desc:                 "Requests from trusted proxies come from the client they were forwarded for",
+			trustedProxies:       "127.0.0.0/8",
+			forwardedFor:         "203.0.113.7",
+			expectedClientIP:     "203.0.113.7",
+			expectedForwardedFor: "203.0.113.7, 127.0.0.1",
+		},
+		{
+			desc:                 "The client is the last address in the chain which isn't a trusted proxy",
+			trustedProxies:       "127.0.0.0/8\n        - 10.0.0.0/8",
+			forwardedFor:         "198.51.100.1, 203.0.113.7,10.1.2.3",
+			expectedClientIP:     "203.0.113.7",
+			expectedForwardedFor: "198.51.100.1, 203.0.113.7, 10.1.2.3, 127.0.0.1",
+		},
+		{
+			desc:                 "Trusted proxies needn't forward requests",
+			trustedProxies:       "127.0.0.0/8",
+			expectedClientIP:     "127.0.0.1",
+			expectedForwardedFor: "127.0.0.1",
+			expectForwardedPort:  true,
+		},
+		{
+			desc:                 "X-Forwarded-For from other clients is replaced",
+			trustedProxies:       "10.0.0.0/8",
+			forwardedFor:         "203.0.113.7",
+			expectedClientIP:     "127.0.0.1",
+			expectedForwardedFor: "127.0.0.1",
+			expectForwardedPort:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		var lastClientIP string
+		plugins := []traffic.PluginFactory{
+			test_interceptor_plugin.NewFactoryWithListener(func(request *http.Request) {
+				lastClientIP, _, _ = net.SplitHostPort(request.RemoteAddr)
+			}),
+		}
+
+		configYaml := fmt.Sprintf("relay:\n    trusted-proxies:\n        - %v\n", testCase.trustedProxies)
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, _ := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if testCase.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if lastClientIP != testCase.expectedClientIP {
+				t.Errorf("Test '%v': Expected plugins to see client '%v' but got '%v'", testCase.desc, testCase.expectedClientIP, lastClientIP)
+			}
+			if values := lastRequest.Header.Values("X-Forwarded-For"); !reflect.DeepEqual(values, []string{testCase.expectedForwardedFor}) {
+				t.Errorf("Test '%v': Expected X-Forwarded-For '%v' but got %q", testCase.desc, testCase.expectedForwardedFor, values)
+			}
+			if port := lastRequest.Header.Get("X-Forwarded-Port"); (port != "") != testCase.expectForwardedPort {
+				t.Errorf("Test '%v': Unexpected X-Forwarded-Port '%v'", testCase.desc, port)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"trusted-proxies:\n        - 10.0.0.1",
+		"trusted-proxies:\n        - proxy.internal/8",
+		"trusted-proxies: 10.0.0.0/8",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		status         int  // The target's response status.
+		unreachable    bool // If true, the target can't be reached at all.
+		expectCaptured bool
+		expectedStatus int // The status recorded in the dead letter.
+	}{
+		{
+			desc:           "Requests the target is unavailable for are captured",
+			status:         http.StatusServiceUnavailable,
+			expectCaptured: true,
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			desc:           "Requests the target can't be reached for are captured",
+			unreachable:    true,
+			expectCaptured: true,
+		},
+		{
+			desc:   "Requests the target accepts aren't captured",
+			status: http.StatusOK,
+		},
+		{
+			desc:   "Requests the target rejects aren't captured",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(testCase.status)
+		}))
+		if testCase.unreachable {
+			target.Close()
+		}
+
+		webhookReceived := make(chan *traffic.DeadLetter, 1)
+		webhook := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			letter := &traffic.DeadLetter{}
+			if err := json.NewDecoder(request.Body).Decode(letter); err != nil {
+				t.Errorf("Test '%v': Error decoding webhook body: %v", testCase.desc, err)
+			}
+			webhookReceived <- letter
+		}))
+
+		directory := t.TempDir()
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+dead-letter:
+    directory: %v
+    webhook: %v
+    redact-headers:
+        - X-Api-Key
+`, target.URL, directory, webhook.URL))
+		if err != nil {
+			t.Errorf("Test '%v': Error parsing configuration YAML: %v", testCase.desc, err)
+			continue
+		}
+		options, err := relay.ReadOptions(configFile)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+		relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+
+		request, _ := http.NewRequest("POST", relayServer.URL+"/ingest", strings.NewReader(`{"event":"click"}`))
+		request.Header.Set("Authorization", "Bearer secret")
+		request.Header.Set("X-Api-Key", "secret")
+		request.Header.Set("X-Kept", "kept")
+		response, err := http.DefaultClient.Do(request)
+		relayServer.Close()
+		target.Close()
+		if err != nil {
+			t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+			webhook.Close()
+			continue
+		}
+		response.Body.Close()
+
+		names, err := options.Relay.DeadLetters.Store.List()
+		if err != nil {
+			t.Errorf("Test '%v': Error listing dead letters: %v", testCase.desc, err)
+		}
+		var webhookLetter *traffic.DeadLetter
+		if testCase.expectCaptured {
+			select {
+			case webhookLetter = <-webhookReceived:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		webhook.Close()
+
+		if !testCase.expectCaptured {
+			if len(names) != 0 {
+				t.Errorf("Test '%v': Expected no dead letters but got %v", testCase.desc, names)
+			}
+			continue
+		}
+		if len(names) != 1 {
+			t.Errorf("Test '%v': Expected one dead letter but got %v", testCase.desc, names)
+			continue
+		}
+		if webhookLetter == nil {
+			t.Errorf("Test '%v': Expected the dead letter to be sent to the webhook", testCase.desc)
+		}
+
+		letter, err := traffic.ReadDeadLetter(options.Relay.DeadLetters.Store, names[0])
+		if err != nil {
+			t.Errorf("Test '%v': Error reading dead letter: %v", testCase.desc, err)
+			continue
+		}
+		if letter.Method != "POST" || letter.URL != target.URL+"/ingest" {
+			t.Errorf("Test '%v': Expected POST %v/ingest but got %v %v", testCase.desc, target.URL, letter.Method, letter.URL)
+		}
+		if string(letter.Body) != `{"event":"click"}` {
+			t.Errorf("Test '%v': Expected the request body but got '%s'", testCase.desc, letter.Body)
+		}
+		if letter.Header.Get("Authorization") != "" || letter.Header.Get("X-Api-Key") != "" {
+			t.Errorf("Test '%v': Expected sensitive headers to be removed but got %v", testCase.desc, letter.Header)
+		}
+		if letter.Header.Get("X-Kept") != "kept" {
+			t.Errorf("Test '%v': Expected other headers to be kept but got %v", testCase.desc, letter.Header)
+		}
+		if letter.Status != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, letter.Status)
+		}
+		if testCase.unreachable && letter.Error == "" {
+			t.Errorf("Test '%v': Expected the delivery error to be recorded", testCase.desc)
+		}
+	}
+}
+
+func TestRedriveDeadLetters(t *testing.T) {
+	failing := true
+	var received []string
+	var mutex sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing {
+			response.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		received = append(received, fmt.Sprintf("%v %v %s", request.Method, request.URL.Path, body))
+	}))
+	defer target.Close()
+
+	configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+dead-letter:
+    directory: %v
+`, target.URL, t.TempDir()))
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+	defer relayServer.Close()
+
+	for _, path := range []string{"/first", "/second"} {
+		response, err := http.Post(relayServer.URL+path, "text/plain", strings.NewReader(path))
+		if err != nil {
+			t.Fatalf("Error POSTing: %v", err)
+		}
+		response.Body.Close()
+	}
+
+	store := options.Relay.DeadLetters.Store
+	if delivered, remaining, err := traffic.RedriveDeadLetters(store, http.DefaultClient, nil); err != nil {
+		t.Errorf("Error redriving dead letters: %v", err)
+	} else if delivered != 0 || remaining != 2 {
+		t.Errorf("Expected 2 dead letters to remain while the target fails, but got %v delivered and %v remaining", delivered, remaining)
+	}
+
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+	if delivered, remaining, err := traffic.RedriveDeadLetters(store, http.DefaultClient, nil); err != nil {
+		t.Errorf("Error redriving dead letters: %v", err)
+	} else if delivered != 2 || remaining != 0 {
+		t.Errorf("Expected 2 dead letters to be delivered, but got %v delivered and %v remaining", delivered, remaining)
+	}
 
-	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
-		response, err := http.Get(relayService.HttpUrl())
+	expected := []string{"POST /first /first", "POST /second /second"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected target to receive %v but got %v", expected, received)
+	}
+	if names, _ := store.List(); len(names) != 0 {
+		t.Errorf("Expected delivered dead letters to be deleted but got %v", names)
+	}
+}
+
+func TestDeadLetterOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"webhook: not-a-url",
+		"webhook: http://",
+		"redact-headers: X-Api-Key",
+		"directory: /tmp\n    encryption-key: not-base64",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+dead-letter:
+    %v
+`, invalidConfig))
 		if err != nil {
-			t.Errorf("Error GETing: %v", err)
-			return
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
 		}
-		defer response.Body.Close()
-		if response.StatusCode != 503 {
-			t.Errorf("Expected 503 response for surpassing max body size: %v", response)
-			return
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
 		}
-	})
+	}
 }
 
-func TestRelaySupportsContentEncoding(t *testing.T) {
-	testCases := map[string]struct {
-		encoding       traffic.Encoding
-		bodyContentStr string
-		headers        map[string]string
-		customUrl      func(relayServiceURL string) string
-	}{
-		"identity": {
-			encoding:       traffic.Identity,
-			bodyContentStr: "Hello, world!",
-		},
-		"gzip - with header": {
-			encoding:       traffic.Gzip,
-			bodyContentStr: "Hello, world!",
-			headers: map[string]string{
-				"Content-Encoding": "gzip",
-			},
-		},
-		"gzip - with query param": {
-			encoding:       traffic.Gzip,
-			bodyContentStr: "Hello, world!",
-			customUrl: func(relayServiceURL string) string {
-				return fmt.Sprintf("%v?ContentEncoding=gzip", relayServiceURL)
-			},
-		},
+// auditedPlugin strips and rewrites parts of requests, for TestAuditLog.
+type auditedPlugin struct{}
+
+func (plug auditedPlugin) Name() string {
+	return "audited"
+}
+
+func (plug auditedPlugin) HandleRequest(response http.ResponseWriter, request *http.Request, info traffic.RequestInfo) bool {
+	request.Header.Del("X-Secret")
+	request.Header.Set("User-Agent", "relay")
+	query := request.URL.Query()
+	query.Del("token")
+	request.URL.RawQuery = query.Encode()
+	request.Body = io.NopCloser(strings.NewReader("redacted"))
+	request.ContentLength = int64(len("redacted"))
+	return false
+}
+
+func TestAuditLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		io.Copy(io.Discard, request.Body)
+	}))
+	defer target.Close()
+
+	configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+audit:
+    directory: %v
+    flush-interval: 10ms
+`, target.URL, t.TempDir()))
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
 	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, []traffic.Plugin{auditedPlugin{}}))
+	defer relayServer.Close()
 
-	for desc, testCase := range testCases {
-		test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
-			// convert the body content to a reader with the proper content encoding applied
-			var body io.Reader
-			switch testCase.encoding {
-			case traffic.Gzip:
-				b, err := traffic.EncodeData([]byte(testCase.bodyContentStr), traffic.Gzip)
-				if err != nil {
-					t.Errorf("Test %s - Error encoding data: %v", desc, err)
-					return
-				}
-				body = bytes.NewReader(b)
-			case traffic.Identity:
-				body = strings.NewReader(testCase.bodyContentStr)
-			}
+	request, _ := http.NewRequest("POST", relayServer.URL+"/ingest?token=secret&id=1", strings.NewReader("secret body"))
+	request.Header.Set("X-Secret", "secret")
+	request.Header.Set("User-Agent", "client")
+	request.Header.Set("Cookie", "session=secret; theme=dark")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error POSTing: %v", err)
+	}
+	response.Body.Close()
 
-			requestURL := relayService.HttpUrl()
-			if testCase.customUrl != nil {
-				requestURL = testCase.customUrl(requestURL)
-			}
-			request, err := http.NewRequest("POST", requestURL, body)
+	store := options.Relay.Audit.Store
+	var entries []*traffic.AuditEntry
+	for start := time.Now(); len(entries) == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		names, err := store.List()
+		if err != nil {
+			t.Fatalf("Error listing audit batches: %v", err)
+		}
+		for _, name := range names {
+			batch, err := traffic.ReadAuditEntries(store, name)
 			if err != nil {
-				t.Errorf("Test %s - Error GETing: %v", desc, err)
-				return
+				t.Fatalf("Error reading audit batch: %v", err)
 			}
+			entries = append(entries, batch...)
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one audit entry but got %v", len(entries))
+	}
+	entry := entries[0]
 
-			for header, headerValue := range testCase.headers {
-				request.Header.Set(header, headerValue)
-			}
+	if entry.Method != "POST" || entry.Path != "/ingest" || entry.Status != http.StatusOK || entry.BodyBytes != int64(len("secret body")) {
+		t.Errorf("Expected the original request to be described, but got %+v", entry)
+	}
+	for _, check := range []struct {
+		desc     string
+		actual   []string
+		expected []string
+	}{
+		{"query parameters", entry.QueryParams, []string{"id", "token"}},
+		{"cookies", entry.Cookies, []string{"session", "theme"}},
+		{"plugin decisions", entry.Plugins, []string{"audited=modified(url,header,body)"}},
+		{"removed headers", entry.Changes.HeadersRemoved, []string{"X-Secret"}},
+		{"modified headers", entry.Changes.HeadersModified, []string{"User-Agent"}},
+		{"removed query parameters", entry.Changes.QueryParamsRemoved, []string{"token"}},
+		{"removed cookies", entry.Changes.CookiesRemoved, []string{"session", "theme"}},
+	} {
+		if !reflect.DeepEqual(check.actual, check.expected) {
+			t.Errorf("Expected %v %v but got %v", check.desc, check.expected, check.actual)
+		}
+	}
+	if !entry.Changes.BodyModified || entry.Changes.RelayedBodyBytes != int64(len("redacted")) {
+		t.Errorf("Expected the body to be reported as modified, but got %+v", entry.Changes)
+	}
 
-			response, err := http.DefaultClient.Do(request)
-			if err != nil {
-				t.Errorf("Test %s - Error POSTing: %v", desc, err)
-				return
-			}
+	// Values are never recorded.
+	names, _ := store.List()
+	data, _ := store.Read(names[0])
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Expected no values in the audit log, but got %s", data)
+	}
+}
 
-			defer response.Body.Close()
+func TestAuditOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"directory: /tmp\n    flush-interval: 0s",
+		"directory: /tmp\n    flush-interval: soon",
+		"directory: /tmp\n    encryption-key: not-base64",
+	}
 
-			if response.StatusCode != 200 {
-				t.Errorf("Test %s - Expected 200 response: %v", desc, response)
-				return
-			}
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+audit:
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
 
-			lastRequest, err := catcherService.LastRequestBody()
+func TestRecording(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		io.Copy(io.Discard, request.Body)
+		if request.URL.Path == "/missing" {
+			response.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+
+	var mutex sync.Mutex
+	var replayed []string
+	replayTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := io.ReadAll(request.Body)
+		replayed = append(replayed, fmt.Sprintf("%v %v %q %v", request.Method, request.URL.RequestURI(), body, request.Header.Get("X-Tenant")))
+		response.WriteHeader(http.StatusAccepted)
+	}))
+	defer replayTarget.Close()
+	replayURL, _ := url.Parse(replayTarget.URL)
+
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, format := range []string{"framed", "har"} {
+		directory := t.TempDir()
+		readOptions := func() *relay.Options {
+			configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: %v
+recording:
+    directory: %v
+    encryption-key: %v
+    format: %v
+    max-body-bytes: 8
+    redact-headers:
+        - X-Api-Key
+`, target.URL, directory, base64.StdEncoding.EncodeToString(key), format))
 			if err != nil {
-				t.Errorf("Test %s - Error reading last request body from catcher: %v", desc, err)
-				return
+				t.Fatalf("Format %v: Error parsing configuration YAML: %v", format, err)
+			}
+			options, err := relay.ReadOptions(configFile)
+			if err != nil {
+				t.Fatalf("Format %v: Error reading options: %v", format, err)
 			}
+			return options
+		}
 
-			switch testCase.encoding {
-			case traffic.Gzip:
-				decodedData, err := traffic.DecodeData(lastRequest, traffic.Gzip)
+		// Each time the relay starts, it begins a new recording.
+		for _, requests := range [][]struct{ path, body string }{
+			{{"/events?page=1", "{}"}, {"/missing", "\xff\xfe"}},
+			{{"/events", "0123456789"}},
+		} {
+			options := readOptions()
+			relayServer := httptest.NewServer(traffic.NewHandler(options.Relay, nil))
+			for _, sent := range requests {
+				request, _ := http.NewRequest("POST", relayServer.URL+sent.path, strings.NewReader(sent.body))
+				request.Header.Set("Authorization", "Bearer secret")
+				request.Header.Set("X-Api-Key", "secret")
+				request.Header.Set("X-Tenant", "acme")
+				response, err := http.DefaultClient.Do(request)
 				if err != nil {
-					t.Errorf("Test %s - Error decoding data: %v", desc, err)
-					return
-				}
-				if string(decodedData) != testCase.bodyContentStr {
-					t.Errorf("Test %s - Expected body '%v' but got: %v", desc, testCase.bodyContentStr, string(decodedData))
+					t.Fatalf("Format %v: Error POSTing: %v", format, err)
 				}
-			case traffic.Identity:
-				if string(lastRequest) != testCase.bodyContentStr {
-					t.Errorf("Test %s - Expected body '%v' but got: %v", desc, testCase.bodyContentStr, string(lastRequest))
+				response.Body.Close()
+			}
+			relayServer.Close()
+			options.Relay.Recorder.Close()
+		}
+
+		store, _ := storage.NewStore(&storage.Options{Directory: directory, EncryptionKey: key})
+		names, _ := store.List()
+		if len(names) != 2 {
+			t.Fatalf("Format %v: Expected 2 recordings but got %v", format, names)
+		}
+		for _, name := range names {
+			raw, _ := os.ReadFile(filepath.Join(directory, name+".rly"))
+			if bytes.Contains(raw, []byte("acme")) {
+				t.Errorf("Format %v: Expected recording %v to be encrypted", format, name)
+			}
+			if data, err := store.Read(name); format == "har" && (err != nil || !json.Valid(data)) {
+				t.Errorf("Format %v: Expected a valid HAR file but got %v:\n%s", format, err, data)
+			}
+		}
+
+		var recorded []string
+		for _, name := range names {
+			reader, _ := store.Open(name)
+			err := traffic.ReadRecording(reader, func(record *traffic.RecordedRequest) error {
+				recorded = append(recorded, fmt.Sprintf("%v %v %q %v %v", record.Method, record.URL[len(target.URL):], record.Body, record.BodyTruncated, record.Status))
+				if record.Header.Get("Authorization") != "" || record.Header.Get("X-Api-Key") != "" {
+					t.Errorf("Format %v: Expected credentials to be removed but got %v", format, record.Header)
 				}
+				return nil
+			})
+			reader.Close()
+			if err != nil {
+				t.Errorf("Format %v: Error reading recording: %v", format, err)
 			}
+		}
+		expectedRecorded := []string{
+			`POST /events?page=1 "{}" false 200`,
+			`POST /missing "\xff\xfe" false 404`,
+			`POST /events "01234567" true 200`,
+		}
+		if !reflect.DeepEqual(recorded, expectedRecorded) {
+			t.Errorf("Format %v: Expected recorded requests %v but got %v", format, expectedRecorded, recorded)
+		}
+
+		mutex.Lock()
+		replayed = nil
+		mutex.Unlock()
+		reader, _ := store.Open(names[0])
+		sent, failed, err := traffic.ReplayRecording(reader, traffic.ReplayOptions{Client: http.DefaultClient, Target: replayURL})
+		reader.Close()
+		if err != nil || sent != 2 || failed != 0 {
+			t.Errorf("Format %v: Expected 2 requests to be replayed, but got %v sent, %v failed, and error %v", format, sent, failed, err)
+		}
+		expectedReplayed := []string{
+			`POST /events?page=1 "{}" acme`,
+			`POST /missing "\xff\xfe" acme`,
+		}
+		if !reflect.DeepEqual(replayed, expectedReplayed) {
+			t.Errorf("Format %v: Expected replayed requests %v but got %v", format, expectedReplayed, replayed)
+		}
+	}
+}
+
+func TestUnfinishedRecordings(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, testCase := range []struct {
+		format traffic.RecordingFormat
+		key    []byte
+	}{
+		{format: traffic.RecordingFramed},
+		{format: traffic.RecordingFramed, key: bytes.Repeat([]byte{7}, 32)},
+		{format: traffic.RecordingHAR},
+		{format: traffic.RecordingHAR, key: bytes.Repeat([]byte{7}, 32)},
+	} {
+		desc := fmt.Sprintf("%v (encrypted: %v)", testCase.format, testCase.key != nil)
+		store, _ := storage.NewStore(&storage.Options{Directory: t.TempDir(), EncryptionKey: testCase.key})
+		recorder, err := traffic.NewRecorder(traffic.RecorderOptions{Store: store, Format: testCase.format})
+		if err != nil {
+			t.Fatalf("Test '%v': Error creating recorder: %v", desc, err)
+		}
+		options := traffic.NewDefaultRelayOptions()
+		options.TargetScheme = targetURL.Scheme
+		options.TargetHost = targetURL.Host
+		options.Recorder = recorder
+		handler := traffic.NewHandler(options, nil)
+		for i := 0; i < 2; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://relay.example/", nil))
+		}
+
+		// Requests are flushed as they're recorded, so a recording which
+		// hasn't been closed can be read as far as it goes.
+		reader, _ := store.Open(recorder.Name())
+		recorded := 0
+		err = traffic.ReadRecording(reader, func(record *traffic.RecordedRequest) error {
+			recorded++
+			return nil
 		})
+		reader.Close()
+		recorder.Close()
+		if recorded != 2 {
+			t.Errorf("Test '%v': Expected 2 requests to be read but got %v", desc, recorded)
+		}
+		// Unencrypted framed recordings can't be told apart from closed ones.
+		if expectUnfinished := testCase.key != nil || testCase.format == traffic.RecordingHAR; errors.Is(err, storage.ErrUnfinished) != expectUnfinished {
+			t.Errorf("Test '%v': Expected the recording to be reported as unfinished: %v, but got error %v", desc, expectUnfinished, err)
+		}
 	}
 }
 
-func TestRelayNotFound(t *testing.T) {
-	test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
-		faviconURL := fmt.Sprintf("%v/favicon.ico", relayService.HttpUrl())
-		response, err := http.Get(faviconURL)
+func TestReplaySpeed(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	store, _ := storage.NewStore(&storage.Options{Directory: t.TempDir()})
+	fakeClock := clock.NewFake(time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC))
+	recorder, err := traffic.NewRecorder(traffic.RecorderOptions{Store: store})
+	if err != nil {
+		t.Fatalf("Error creating recorder: %v", err)
+	}
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.Clock = fakeClock
+	options.Recorder = recorder
+	handler := traffic.NewHandler(options, nil)
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://relay.example/", nil))
+		fakeClock.Advance(200 * time.Millisecond)
+	}
+	recorder.Close()
+
+	// The requests were recorded 400ms apart from first to last.
+	for _, testCase := range []struct {
+		speed      float64
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{speed: 2, minElapsed: 200 * time.Millisecond, maxElapsed: 400 * time.Millisecond},
+		{speed: 0, maxElapsed: 200 * time.Millisecond},
+	} {
+		reader, _ := store.Open(recorder.Name())
+		start := time.Now()
+		sent, _, err := traffic.ReplayRecording(reader, traffic.ReplayOptions{Client: http.DefaultClient, Speed: testCase.speed})
+		elapsed := time.Since(start)
+		reader.Close()
+		if err != nil || sent != 3 {
+			t.Errorf("Speed %v: Expected 3 requests to be replayed, but got %v and error %v", testCase.speed, sent, err)
+		}
+		if elapsed < testCase.minElapsed || elapsed > testCase.maxElapsed {
+			t.Errorf("Speed %v: Expected replay to take between %v and %v but it took %v", testCase.speed, testCase.minElapsed, testCase.maxElapsed, elapsed)
+		}
+	}
+}
+
+func TestRecordingOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"directory: %v\n    format: pcap",
+		"directory: %v\n    max-body-bytes: 0",
+		"directory: %v\n    redact-headers: X-Api-Key",
+		"directory: %v\n    encryption-key: c2hvcnQ=",
+		"directory: %v/file/requests",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		// Recordings can't be stored beneath a file.
+		directory := t.TempDir()
+		os.WriteFile(filepath.Join(directory, "file"), []byte("not a directory"), 0o600)
+		invalidConfig = fmt.Sprintf(invalidConfig, directory)
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+recording:
+    %v
+`, invalidConfig))
 		if err != nil {
-			t.Errorf("Error GETing: %v", err)
-			return
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
 		}
-		if response.StatusCode != 404 {
-			t.Errorf("Should have received 404: %v", response)
-			return
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
 		}
-	})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var receivedTraceparent string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		receivedTraceparent = request.Header.Get("traceparent")
+		response.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	exporter := tracetest.NewInMemoryExporter()
+	options := traffic.NewDefaultRelayOptions()
+	options.TargetScheme = targetURL.Scheme
+	options.TargetHost = targetURL.Host
+	options.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	handler := traffic.NewHandler(options, []traffic.Plugin{panickingPlugin{}})
+
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID := "00f067aa0ba902b7"
+	request := httptest.NewRequest("POST", "http://relay.example/events", strings.NewReader("{}"))
+	request.Header.Set("traceparent", fmt.Sprintf("00-%v-%v-01", clientTraceID, clientSpanID))
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %v but got %v", http.StatusAccepted, response.Code)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	relaySpan, ok := spans["relay POST"]
+	if !ok {
+		t.Fatalf("Expected a span for the request but got %v", spans)
+	}
+	if relaySpan.SpanContext.TraceID().String() != clientTraceID || relaySpan.Parent.SpanID().String() != clientSpanID {
+		t.Errorf("Expected the request span to continue the client's trace but got parent %v", relaySpan.Parent)
+	}
+	for _, name := range []string{"plugin panicking", "upstream POST"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a span named '%v' but got %v", name, spans)
+			continue
+		}
+		if span.Parent.SpanID() != relaySpan.SpanContext.SpanID() || span.SpanContext.TraceID() != relaySpan.SpanContext.TraceID() {
+			t.Errorf("Expected span '%v' to be a child of the request span", name)
+		}
+	}
+
+	upstreamSpan := spans["upstream POST"]
+	expectedTraceparent := fmt.Sprintf("00-%v-%v-01", clientTraceID, upstreamSpan.SpanContext.SpanID())
+	if receivedTraceparent != expectedTraceparent {
+		t.Errorf("Expected the target to receive traceparent %v but got %v", expectedTraceparent, receivedTraceparent)
+	}
+	for _, span := range []tracetest.SpanStub{relaySpan, upstreamSpan} {
+		found := false
+		for _, attribute := range span.Attributes {
+			if attribute.Key == "http.response.status_code" && attribute.Value.AsInt64() == http.StatusAccepted {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected span '%v' to record status %v but got %v", span.Name, http.StatusAccepted, span.Attributes)
+		}
+	}
+}
+
+func TestTracingOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"exporter: zipkin",
+		"exporter: otlp-grpc\n        sample-ratio: 1.5",
+		"exporter: otlp-http\n        sample-ratio: -0.5",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    tracing:
+        %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestDNSOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"dns-servers: [dns.example.com]",
+		"dns-servers: [10.0.0.2:dns]",
+		"dns-cache-ttl: soon",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
+func TestS3SpoolOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"bucket: uploads\n    region: us-east-1\n    access-key-id: key\n    secret-access-key: secret",
+		"bucket: uploads\n    threshold: 4096\n    access-key-id: key\n    secret-access-key: secret",
+		"bucket: uploads\n    region: us-east-1\n    threshold: 4096\n    secret-access-key: secret",
+		"bucket: uploads\n    region: us-east-1\n    threshold: 100\n    access-key-id: key\n    secret-access-key: secret",
+		"bucket: uploads\n    region: us-east-1\n    threshold: 1048576\n    access-key-id: key\n    secret-access-key: secret",
+		"bucket: uploads\n    region: us-east-1\n    threshold: 4096\n    part-size: 1024\n    access-key-id: key\n    secret-access-key: secret",
+		"bucket: uploads\n    region: us-east-1\n    threshold: 4096\n    endpoint: minio\n    access-key-id: key\n    secret-access-key: secret",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    max-body-size: 1048576
+    spool-threshold: 1024
+s3-spool:
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
 }
 
 func TestWebSocketEcho(t *testing.T) {
@@ -282,6 +4591,92 @@ func TestWebSocketEcho(t *testing.T) {
 	})
 }
 
+func TestWebsocketKeepalive(t *testing.T) {
+	configYaml := `relay:
+    websocket-ping-interval: 20ms
+    websocket-idle-timeout: 200ms
+`
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		ws, err := websocket.Dial(relayService.WsUrl()+"/echo", "", relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error dialing websocket: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		if active, _ := relayService.Metrics().Value("relay_websocket_sessions_active", nil); active != 1 {
+			t.Errorf("Expected 1 active websocket session but got %v", active)
+		}
+
+		// The target's pongs keep the quiet connection alive.
+		time.Sleep(500 * time.Millisecond)
+		if err := testEcho(ws, "still there?"); err != nil {
+			t.Errorf("Error in echo after idling: %v", err)
+		}
+	})
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+	configYaml := `relay:
+    websocket-idle-timeout: 100ms
+`
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		ws, err := websocket.Dial(relayService.WsUrl()+"/echo", "", relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error dialing websocket: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		if err := testEcho(ws, "hello"); err != nil {
+			t.Errorf("Error in echo: %v", err)
+			return
+		}
+
+		value := func(name string, labels map[string]string) float64 {
+			value, err := relayService.Metrics().Value(name, labels)
+			if err != nil {
+				t.Fatalf("Error reading metric %v: %v", name, err)
+			}
+			return value
+		}
+		timedOut := map[string]string{"result": "timed-out"}
+		for start := time.Now(); value("relay_websocket_sessions_total", timedOut) < 1; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Timed out waiting for the idle websocket to be closed")
+			}
+		}
+		if active := value("relay_websocket_sessions_active", nil); active != 0 {
+			t.Errorf("Expected no active websocket sessions but got %v", active)
+		}
+		if err := testEcho(ws, "hello again"); err == nil {
+			t.Errorf("Expected the idle websocket to have been closed")
+		}
+	})
+}
+
+func TestWebsocketOptionsValidation(t *testing.T) {
+	invalidConfigs := []string{
+		"websocket-idle-timeout: -1s",
+		"websocket-ping-interval: 30s\n    websocket-idle-timeout: 30s",
+	}
+
+	for _, invalidConfig := range invalidConfigs {
+		configFile, err := config.NewFileFromYamlString(fmt.Sprintf(`relay:
+    port: 0
+    target: http://example.com
+    %v
+`, invalidConfig))
+		if err != nil {
+			t.Errorf("Error parsing configuration YAML: %v", err)
+			continue
+		}
+		if _, err := relay.ReadOptions(configFile); err == nil {
+			t.Errorf("Expected an error for configuration:\n%v", invalidConfig)
+		}
+	}
+}
+
 func testEcho(conn *websocket.Conn, message string) error {
 	_, err := conn.Write([]byte(message))
 	if err != nil {
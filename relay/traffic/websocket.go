@@ -0,0 +1,437 @@
+package traffic
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/clock"
+)
+
+// WebsocketDirection indicates which way a websocket message is travelling.
+type WebsocketDirection int
+
+const (
+	ClientToTarget WebsocketDirection = iota
+	TargetToClient
+)
+
+func (direction WebsocketDirection) String() string {
+	switch direction {
+	case ClientToTarget:
+		return "client-to-target"
+	case TargetToClient:
+		return "target-to-client"
+	default:
+		return "(unknown direction)"
+	}
+}
+
+// WebsocketMessageType is the type of a websocket data message, given by the
+// opcode of its first frame.
+type WebsocketMessageType byte
+
+const (
+	WebsocketTextMessage   WebsocketMessageType = websocketTextFrame
+	WebsocketBinaryMessage WebsocketMessageType = websocketBinaryFrame
+)
+
+func (messageType WebsocketMessageType) String() string {
+	switch messageType {
+	case WebsocketTextMessage:
+		return "text"
+	case WebsocketBinaryMessage:
+		return "binary"
+	default:
+		return "(unknown message type)"
+	}
+}
+
+// WsPlugin is an optional interface which plugins may implement to inspect,
+// rewrite, or drop every data message relayed over websocket connections, in
+// either direction, whether text or binary. It's the message-level
+// counterpart of HandleRequest and HandleResponse, so that plugins can treat
+// websocket traffic like HTTP bodies. Control frames, like pings and close
+// frames, are relayed unchanged.
+//
+// Fragmented messages are reassembled before plugins see them. When any
+// active plugin implements this interface, the relay only lets the client and
+// target negotiate the permessage-deflate extension, and plugins see
+// compressed messages after they've been decompressed.
+type WsPlugin interface {
+	// HandleMessage is invoked for each message, in the order plugins are
+	// configured. It returns the payload to relay, which may be the one it was
+	// passed, or true to drop the message, in which case later plugins don't
+	// see it.
+	HandleMessage(direction WebsocketDirection, messageType WebsocketMessageType, payload []byte) (newPayload []byte, drop bool)
+}
+
+// WebsocketRecorderPlugin is an optional interface which plugins may
+// implement to record the frames relayed over websocket connections. Frames
+// are recorded as they're sent, so messages are recorded after WsPlugins have
+// rewritten them; recorders can't modify frames.
+//
+// Like WsPlugin, this interface limits the extensions which may be
+// negotiated to permessage-deflate. Compressed messages are recorded as
+// single frames holding their decompressed payloads, so recorded payloads are
+// never compressed.
+type WebsocketRecorderPlugin interface {
+	// RecordWebsocket is invoked when a client requests a websocket upgrade.
+	// The request is the upgrade request, after all plugins have handled it.
+	// It returns a recording for the connection, or nil if the connection
+	// shouldn't be recorded.
+	RecordWebsocket(request *http.Request) WebsocketRecording
+}
+
+// WebsocketRecording records the frames of one websocket connection.
+// RecordFrame is invoked concurrently for the two directions, so
+// implementations must be safe for concurrent use.
+type WebsocketRecording interface {
+	// RecordFrame is invoked for each frame relayed in either direction,
+	// after it's been sent. Recordings must not modify the frame.
+	RecordFrame(frame *RecordedWebsocketFrame)
+
+	// Close is invoked once, when the connection is closed. If the target
+	// refused the upgrade, it's invoked without any frames being recorded.
+	Close()
+}
+
+// RecordedWebsocketFrame is a websocket frame passed to a WebsocketRecording.
+type RecordedWebsocketFrame struct {
+	Time      time.Time
+	Direction WebsocketDirection
+	Opcode    byte // The frame's opcode, as defined in RFC 6455 section 5.2.
+	Fin       bool // True if this is the final frame of a message.
+	Payload   []byte
+}
+
+// Websocket frame opcodes, from RFC 6455 section 5.2.
+const (
+	websocketContinuationFrame = 0x0
+	websocketTextFrame         = 0x1
+	websocketBinaryFrame       = 0x2
+	websocketCloseFrame        = 0x8
+)
+
+type websocketFrame struct {
+	fin     bool
+	rsv     byte // The RSV1-3 bits, in their original positions.
+	opcode  byte
+	payload []byte // Always stored unmasked.
+}
+
+var errWebsocketFrameTooLarge = errors.New("websocket frame exceeds maximum size")
+
+// readWebsocketFrame reads a single frame, unmasking its payload if necessary.
+func readWebsocketFrame(reader io.Reader, maxPayloadSize int64) (*websocketFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &websocketFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv:    header[0] & 0x70,
+		opcode: header[0] & 0x0f,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if maxPayloadSize > 0 && length > uint64(maxPayloadSize) {
+		return nil, errWebsocketFrameTooLarge
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(reader, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= maskKey[i%4]
+		}
+	}
+
+	return frame, nil
+}
+
+// writeWebsocketFrame writes a frame. Frames sent to a server must be masked,
+// so if mask is true, a fresh masking key is generated.
+func writeWebsocketFrame(writer io.Writer, frame *websocketFrame, mask bool) error {
+	header := make([]byte, 0, 14)
+	firstByte := frame.rsv | frame.opcode
+	if frame.fin {
+		firstByte |= 0x80
+	}
+	header = append(header, firstByte)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		header = append(header, maskBit|byte(length))
+	case length <= 0xffff:
+		header = append(header, maskBit|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, maskBit|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	payload := frame.payload
+	if mask {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		header = append(header, maskKey[:]...)
+		payload = make([]byte, length)
+		for i := range frame.payload {
+			payload[i] = frame.payload[i] ^ maskKey[i%4]
+		}
+	}
+
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(payload)
+	return err
+}
+
+// websocketMessageRelay relays frames in one direction, passing complete data
+// messages through the websocket plugins, and records the frames it sends.
+type websocketMessageRelay struct {
+	messagePlugins []WsPlugin
+	recordings     []WebsocketRecording
+	clock          clock.Clock
+	direction      WebsocketDirection
+	maxMessageSize int64
+
+	// If the connection negotiated permessage-deflate, deflate decompresses
+	// the messages sent in this direction, and compresses them once more.
+	deflate *websocketDeflate
+
+	// If keepalive is true, the relay pings the destination itself, so the
+	// pongs which answer it are dropped rather than relayed.
+	keepalive bool
+	writeLock sync.Mutex // Held while a frame is sent, since pings are sent concurrently.
+}
+
+// send writes a frame to its destination.
+func (relay *websocketMessageRelay) send(destination io.Writer, frame *websocketFrame) error {
+	relay.writeLock.Lock()
+	defer relay.writeLock.Unlock()
+	// Only frames sent to the target (a server) are masked.
+	return writeWebsocketFrame(destination, frame, relay.direction == ClientToTarget)
+}
+
+// ping sends one of the relay's own keepalive pings to the destination. It
+// isn't recorded.
+func (relay *websocketMessageRelay) ping(destination io.Writer) error {
+	return relay.send(destination, &websocketFrame{fin: true, opcode: websocketPingFrame, payload: websocketKeepalivePayload})
+}
+
+// write sends a frame to its destination and then records it.
+func (relay *websocketMessageRelay) write(destination io.Writer, frame *websocketFrame) error {
+	if err := relay.send(destination, frame); err != nil {
+		return err
+	}
+	relay.record(frame.opcode, frame.fin, frame.payload)
+	return nil
+}
+
+// writeMessage sends a complete data message as a single frame, compressing
+// it if the sender compressed it, and then records it uncompressed.
+func (relay *websocketMessageRelay) writeMessage(destination io.Writer, messageType WebsocketMessageType, payload []byte, compressed bool) error {
+	frame := &websocketFrame{fin: true, opcode: byte(messageType), payload: payload}
+	if compressed {
+		compressedPayload, err := relay.deflate.compress(payload)
+		if err != nil {
+			return fmt.Errorf("error compressing websocket message: %w", err)
+		}
+		frame.rsv = websocketRSV1
+		frame.payload = compressedPayload
+	}
+	if err := relay.send(destination, frame); err != nil {
+		return err
+	}
+	relay.record(frame.opcode, frame.fin, payload)
+	return nil
+}
+
+// record passes a frame which has been sent to the recordings.
+func (relay *websocketMessageRelay) record(opcode byte, fin bool, payload []byte) {
+	if len(relay.recordings) == 0 {
+		return
+	}
+	recordedFrame := &RecordedWebsocketFrame{
+		Time:      relay.clock.Now(),
+		Direction: relay.direction,
+		Opcode:    opcode,
+		Fin:       fin,
+		Payload:   payload,
+	}
+	for _, recording := range relay.recordings {
+		recording.RecordFrame(recordedFrame)
+	}
+}
+
+func (relay *websocketMessageRelay) run(destination io.WriteCloser, source io.Reader) error {
+	defer destination.Close()
+
+	// Binary messages are only reassembled if a plugin may inspect them, or
+	// if they may be compressed, so that they're recorded uncompressed.
+	inspectBinary := len(relay.messagePlugins) > 0 || relay.deflate != nil
+
+	var message []byte
+	var messageType WebsocketMessageType // Zero unless a message is being reassembled.
+	var compressed bool                  // True if the message's first frame set RSV1.
+	for {
+		frame, err := readWebsocketFrame(source, relay.maxMessageSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if relay.keepalive && isKeepalivePong(frame) {
+			// The pong answers the relay's own ping to the sender.
+			continue
+		}
+
+		continuation := frame.opcode == websocketContinuationFrame
+		inspect := frame.opcode == websocketTextFrame ||
+			(frame.opcode == websocketBinaryFrame && inspectBinary) ||
+			(continuation && messageType != 0)
+		if !inspect {
+			// Control frames, and the frames of messages which plugins don't
+			// inspect, are relayed unchanged. Control frames may legally be
+			// interleaved with the fragments of a message.
+			if err := relay.write(destination, frame); err != nil {
+				return err
+			}
+			if frame.opcode == websocketCloseFrame {
+				return nil
+			}
+			continue
+		}
+
+		// Only the first frame of a message may set RSV1, which marks it as
+		// compressed, and only if permessage-deflate was negotiated.
+		if frame.rsv != 0 && (continuation || frame.rsv != websocketRSV1 || relay.deflate == nil) {
+			return fmt.Errorf("cannot inspect websocket data frame with RSV bits set")
+		}
+
+		if !continuation {
+			messageType = WebsocketMessageType(frame.opcode)
+			compressed = frame.rsv == websocketRSV1
+		}
+		message = append(message, frame.payload...)
+		if relay.maxMessageSize > 0 && int64(len(message)) > relay.maxMessageSize {
+			return errWebsocketFrameTooLarge
+		}
+		if !frame.fin {
+			continue
+		}
+
+		if compressed {
+			if message, err = relay.deflate.decompress(message, relay.maxMessageSize); err != nil {
+				return err
+			}
+		}
+		if payload, drop := relay.handleMessage(messageType, message); !drop {
+			if err := relay.writeMessage(destination, messageType, payload, compressed); err != nil {
+				return err
+			}
+		}
+
+		message = nil
+		messageType = 0
+		compressed = false
+	}
+}
+
+// handleMessage passes a complete message through the plugins, returning the
+// payload to relay, or true if a plugin dropped the message.
+func (relay *websocketMessageRelay) handleMessage(messageType WebsocketMessageType, payload []byte) ([]byte, bool) {
+	for _, plugin := range relay.messagePlugins {
+		var drop bool
+		if payload, drop = plugin.HandleMessage(relay.direction, messageType, payload); drop {
+			return nil, true
+		}
+	}
+	return payload, false
+}
+
+// closeWebsocketRecordings closes each of the provided recordings.
+func closeWebsocketRecordings(recordings []WebsocketRecording) {
+	for _, recording := range recordings {
+		recording.Close()
+	}
+}
+
+// websocketHandshakeResponse is the target's HTTP response to an upgrade
+// request, read in full so that the relay can check what was negotiated
+// before relaying it to the client.
+type websocketHandshakeResponse struct {
+	raw        []byte
+	upgraded   bool     // True if the target agreed to switch protocols.
+	extensions []string // The values of any Sec-WebSocket-Extensions headers.
+}
+
+// readWebsocketHandshakeResponse reads the target's HTTP response to the
+// upgrade request, up to the blank line which ends its headers. The reader is
+// left positioned at the start of the first frame.
+func readWebsocketHandshakeResponse(source *bufio.Reader) (*websocketHandshakeResponse, error) {
+	response := &websocketHandshakeResponse{}
+	first := true
+	for {
+		line, err := source.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		response.raw = append(response.raw, line...)
+		if first {
+			fields := strings.Fields(line)
+			response.upgraded = len(fields) >= 2 && fields[1] == "101"
+			first = false
+		} else if name, value, ok := strings.Cut(line, ":"); ok &&
+			strings.EqualFold(strings.TrimSpace(name), "Sec-WebSocket-Extensions") {
+			response.extensions = append(response.extensions, strings.TrimSpace(value))
+		}
+		if line == "\r\n" || line == "\n" {
+			return response, nil
+		}
+	}
+}
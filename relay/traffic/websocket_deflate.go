@@ -0,0 +1,182 @@
+package traffic
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Websocket connections may compress messages using the permessage-deflate
+// extension (RFC 7692). When plugins or recordings inspect a connection's
+// messages, the relay only lets the client offer this extension to the
+// target, since it can't see through any other, and decompresses compressed
+// messages before they're inspected. Messages are compressed again before
+// they're relayed, so the client and target still see the compression they
+// negotiated.
+//
+// The relay compresses each message on its own, which is always valid,
+// whether or not the sender's context takeover was negotiated. If the
+// negotiated window is smaller than deflate's default of 32KB, messages are
+// compressed without back-references, which suits any window.
+
+// permessageDeflate is the name of the permessage-deflate extension.
+const permessageDeflate = "permessage-deflate"
+
+// websocketRSV1 marks the first frame of a compressed message.
+const websocketRSV1 = 0x40
+
+// deflateTail is appended to a compressed message before it's decompressed:
+// the 0x00 0x00 0xff 0xff which the sender removed, then an empty final block,
+// so that the decompressor finds the end of the message.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// maxDeflateWindow is the largest window, in bytes, which a deflate stream
+// may refer back into, as given by a window_bits parameter of 15.
+const maxDeflateWindow = 1 << 15
+
+var errUnsupportedWebsocketExtension = errors.New("unsupported websocket extension")
+
+// websocketExtension is an extension named in a Sec-WebSocket-Extensions
+// header, along with its parameters.
+type websocketExtension struct {
+	name   string
+	params map[string]string // Parameters without a value map to "".
+}
+
+// parseWebsocketExtensions parses the comma-separated extensions of one or more
+// Sec-WebSocket-Extensions header values.
+func parseWebsocketExtensions(values []string) []websocketExtension {
+	var extensions []websocketExtension
+	for _, value := range values {
+		for _, offer := range strings.Split(value, ",") {
+			parts := strings.Split(offer, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			extension := websocketExtension{name: name, params: map[string]string{}}
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(param, "=")
+				extension.params[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions
+}
+
+// filterWebsocketExtensionOffers returns the header value which offers only
+// the permessage-deflate offers among values, or "" if there are none.
+func filterWebsocketExtensionOffers(values []string) string {
+	var offers []string
+	for _, value := range values {
+		for _, offer := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(offer, ";")
+			if strings.TrimSpace(name) == permessageDeflate {
+				offers = append(offers, strings.TrimSpace(offer))
+			}
+		}
+	}
+	return strings.Join(offers, ", ")
+}
+
+// websocketDeflate decompresses and compresses the messages sent in one
+// direction of a connection which negotiated permessage-deflate.
+type websocketDeflate struct {
+	// If true, the sender compresses each message using the messages before
+	// it as a dictionary, so the last maxDeflateWindow bytes it sent are kept.
+	contextTakeover bool
+	window          []byte
+
+	// The deflate level at which messages are compressed.
+	level int
+}
+
+// negotiateWebsocketDeflate returns the compressors for the messages sent by
+// the client and by the target, given the extensions the target accepted in
+// its handshake response. It returns nils if compression wasn't negotiated.
+func negotiateWebsocketDeflate(responseExtensions []string) (clientToTarget *websocketDeflate, targetToClient *websocketDeflate, err error) {
+	extensions := parseWebsocketExtensions(responseExtensions)
+	if len(extensions) == 0 {
+		return nil, nil, nil
+	}
+	if len(extensions) > 1 || extensions[0].name != permessageDeflate {
+		// The relay only offered permessage-deflate.
+		return nil, nil, errUnsupportedWebsocketExtension
+	}
+	params := extensions[0].params
+
+	newDeflate := func(noContextTakeover string, maxWindowBits string) (*websocketDeflate, error) {
+		deflate := &websocketDeflate{level: flate.DefaultCompression}
+		_, deflate.contextTakeover = params[noContextTakeover]
+		deflate.contextTakeover = !deflate.contextTakeover
+		if value, ok := params[maxWindowBits]; ok {
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < 8 || bits > 15 {
+				return nil, fmt.Errorf("invalid %v in websocket extension: %q", maxWindowBits, value)
+			}
+			if bits < 15 {
+				// Huffman-only blocks never refer back into the window.
+				deflate.level = flate.HuffmanOnly
+			}
+		}
+		return deflate, nil
+	}
+
+	if clientToTarget, err = newDeflate("client_no_context_takeover", "client_max_window_bits"); err != nil {
+		return nil, nil, err
+	}
+	if targetToClient, err = newDeflate("server_no_context_takeover", "server_max_window_bits"); err != nil {
+		return nil, nil, err
+	}
+	return clientToTarget, targetToClient, nil
+}
+
+// decompress returns the uncompressed payload of a compressed message, or
+// errWebsocketFrameTooLarge if it's larger than maxSize.
+func (deflate *websocketDeflate) decompress(payload []byte, maxSize int64) ([]byte, error) {
+	source := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail))
+	reader := flate.NewReaderDict(source, deflate.window)
+	defer reader.Close()
+
+	var limited io.Reader = reader
+	if maxSize > 0 {
+		limited = io.LimitReader(reader, maxSize+1)
+	}
+	decompressed, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing websocket message: %w", err)
+	}
+	if maxSize > 0 && int64(len(decompressed)) > maxSize {
+		return nil, errWebsocketFrameTooLarge
+	}
+
+	if deflate.contextTakeover {
+		deflate.window = append(deflate.window, decompressed...)
+		if len(deflate.window) > maxDeflateWindow {
+			deflate.window = append([]byte(nil), deflate.window[len(deflate.window)-maxDeflateWindow:]...)
+		}
+	}
+	return decompressed, nil
+}
+
+// compress returns the compressed payload of a message, without the trailing
+// 0x00 0x00 0xff 0xff which RFC 7692 has senders remove.
+func (deflate *websocketDeflate) compress(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, deflate.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), deflateTail[:4]), nil
+}
@@ -0,0 +1,189 @@
+package traffic
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func TestFilterWebsocketExtensionOffers(t *testing.T) {
+	offers := filterWebsocketExtensionOffers([]string{
+		"x-webkit-deflate-frame, permessage-deflate; client_max_window_bits",
+		"permessage-deflate; server_no_context_takeover, x-custom",
+	})
+	expected := "permessage-deflate; client_max_window_bits, permessage-deflate; server_no_context_takeover"
+	if offers != expected {
+		t.Errorf("Expected offers %q but got %q", expected, offers)
+	}
+
+	if offers := filterWebsocketExtensionOffers([]string{"x-webkit-deflate-frame"}); offers != "" {
+		t.Errorf("Expected no offers but got %q", offers)
+	}
+}
+
+func TestNegotiateWebsocketDeflate(t *testing.T) {
+	testCases := []struct {
+		desc                  string
+		extensions            []string
+		expectDeflate         bool
+		expectError           bool
+		clientContextTakeover bool
+		serverContextTakeover bool
+		clientLevel           int
+		serverLevel           int
+	}{
+		{
+			desc: "No extensions",
+		},
+		{
+			desc:                  "Default parameters",
+			extensions:            []string{"permessage-deflate"},
+			expectDeflate:         true,
+			clientContextTakeover: true,
+			serverContextTakeover: true,
+			clientLevel:           flate.DefaultCompression,
+			serverLevel:           flate.DefaultCompression,
+		},
+		{
+			desc:                  "Parameters apply to their own direction",
+			extensions:            []string{`permessage-deflate; client_no_context_takeover; server_max_window_bits="10"`},
+			expectDeflate:         true,
+			serverContextTakeover: true,
+			clientLevel:           flate.DefaultCompression,
+			serverLevel:           flate.HuffmanOnly,
+		},
+		{
+			desc:        "Invalid window bits",
+			extensions:  []string{"permessage-deflate; client_max_window_bits=16"},
+			expectError: true,
+		},
+		{
+			desc:        "Extensions which weren't offered",
+			extensions:  []string{"x-webkit-deflate-frame"},
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		clientToTarget, targetToClient, err := negotiateWebsocketDeflate(testCase.extensions)
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error", testCase.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Unexpected error: %v", testCase.desc, err)
+			continue
+		}
+		if !testCase.expectDeflate {
+			if clientToTarget != nil || targetToClient != nil {
+				t.Errorf("Test '%v': Expected compression not to be negotiated", testCase.desc)
+			}
+			continue
+		}
+		if clientToTarget.contextTakeover != testCase.clientContextTakeover || clientToTarget.level != testCase.clientLevel {
+			t.Errorf("Test '%v': Unexpected client-to-target compression %+v", testCase.desc, clientToTarget)
+		}
+		if targetToClient.contextTakeover != testCase.serverContextTakeover || targetToClient.level != testCase.serverLevel {
+			t.Errorf("Test '%v': Unexpected target-to-client compression %+v", testCase.desc, targetToClient)
+		}
+	}
+}
+
+// deflateMessages compresses messages as a sender with context takeover
+// would, each referring back to those before it.
+func deflateMessages(t *testing.T, messages ...string) [][]byte {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("Error creating compressor: %v", err)
+	}
+	var compressed [][]byte
+	for _, message := range messages {
+		writer.Write([]byte(message))
+		writer.Flush()
+		compressed = append(compressed, bytes.TrimSuffix(bytes.Clone(buffer.Bytes()), deflateTail[:4]))
+		buffer.Reset()
+	}
+	return compressed
+}
+
+func TestWebsocketMessageRelayDecompressesMessages(t *testing.T) {
+	compressed := deflateMessages(t, "hello hello", "hello again")
+
+	var input bytes.Buffer
+	frames := []*websocketFrame{
+		{fin: true, rsv: websocketRSV1, opcode: websocketTextFrame, payload: compressed[0]},
+		{fin: true, opcode: websocketTextFrame, payload: []byte("plain")},
+		{fin: false, rsv: websocketRSV1, opcode: websocketTextFrame, payload: compressed[1][:2]},
+		{fin: true, opcode: websocketContinuationFrame, payload: compressed[1][2:]},
+	}
+	for _, frame := range frames {
+		if err := writeWebsocketFrame(&input, frame, true); err != nil {
+			t.Fatalf("Error writing frame: %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	relay := &websocketMessageRelay{
+		messagePlugins: []WsPlugin{upperCasePlugin{}},
+		direction:      TargetToClient,
+		deflate:        &websocketDeflate{contextTakeover: true, level: flate.DefaultCompression},
+	}
+	if err := relay.run(nopWriteCloser{&output}, &input); err != nil {
+		t.Fatalf("Error relaying: %v", err)
+	}
+
+	// The relay's own compression needs no context.
+	receiver := &websocketDeflate{}
+	expected := []struct {
+		compressed bool
+		payload    string
+	}{
+		{true, "HELLO HELLO"},
+		{false, "PLAIN"},
+		{true, "HELLO AGAIN"},
+	}
+	for _, expectedMessage := range expected {
+		frame, err := readWebsocketFrame(&output, 0)
+		if err != nil {
+			t.Fatalf("Error reading relayed frame: %v", err)
+		}
+		payload := frame.payload
+		if expectedMessage.compressed {
+			if frame.rsv != websocketRSV1 {
+				t.Errorf("Expected message %q to be compressed", expectedMessage.payload)
+				continue
+			}
+			if payload, err = receiver.decompress(payload, 0); err != nil {
+				t.Errorf("Error decompressing relayed message: %v", err)
+				continue
+			}
+		} else if frame.rsv != 0 {
+			t.Errorf("Expected message %q not to be compressed", expectedMessage.payload)
+		}
+		if string(payload) != expectedMessage.payload {
+			t.Errorf("Expected message %q but got %q", expectedMessage.payload, payload)
+		}
+	}
+}
+
+func TestWebsocketMessageRelayRejectsCompressionWhichWasNotNegotiated(t *testing.T) {
+	var input bytes.Buffer
+	compressed := deflateMessages(t, "hello")
+	writeWebsocketFrame(&input, &websocketFrame{fin: true, rsv: websocketRSV1, opcode: websocketTextFrame, payload: compressed[0]}, false)
+
+	relay := &websocketMessageRelay{messagePlugins: []WsPlugin{upperCasePlugin{}}, direction: TargetToClient}
+	if err := relay.run(nopWriteCloser{&bytes.Buffer{}}, &input); err == nil {
+		t.Errorf("Expected compressed message to be rejected")
+	}
+}
+
+func TestWebsocketDeflateEnforcesMaxMessageSize(t *testing.T) {
+	compressed := deflateMessages(t, "1234567890")
+	deflate := &websocketDeflate{}
+	if _, err := deflate.decompress(compressed[0], 8); err != errWebsocketFrameTooLarge {
+		t.Errorf("Expected oversized message to be rejected but got: %v", err)
+	}
+}
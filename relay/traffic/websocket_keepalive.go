@@ -0,0 +1,140 @@
+package traffic
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/immersa-co/relay-core/relay/metrics"
+)
+
+// Load balancers and proxies between the relay and its clients or target often
+// close connections which have been quiet for a while, without telling either
+// side. Long-lived websocket sessions, like those of a recording which is
+// paused, are then left relaying into a connection which no longer exists.
+//
+// WebsocketOptions lets the relay close such connections itself, once neither
+// side has sent anything for IdleTimeout, and keep healthy ones busy by
+// pinging both sides every PingInterval. The pongs which answer the relay's
+// pings count as activity, but aren't relayed.
+
+// WebsocketOptions configures the deadlines and keepalive pings of relayed
+// websocket connections. Zero values disable each feature.
+type WebsocketOptions struct {
+	IdleTimeout  time.Duration // Connections are closed once neither side has sent anything for this long.
+	WriteTimeout time.Duration // Connections are closed if relaying to either side takes longer than this.
+	PingInterval time.Duration // The relay pings both sides this often. Pinging requires relaying frame by frame.
+}
+
+// websocketKeepalivePayload marks the pings which the relay sends itself, so
+// that the pongs which answer them aren't relayed to the other side.
+var websocketKeepalivePayload = []byte("relay-keepalive")
+
+// isKeepalivePong returns true if the frame answers one of the relay's pings.
+func isKeepalivePong(frame *websocketFrame) bool {
+	return frame.opcode == websocketPongFrame && bytes.Equal(frame.payload, websocketKeepalivePayload)
+}
+
+// websocketSession applies the WebsocketOptions to the two connections of a
+// relayed websocket, and keeps the session metrics.
+type websocketSession struct {
+	options  WebsocketOptions
+	client   net.Conn
+	target   net.Conn
+	metrics  *metrics.Registry
+	timedOut atomic.Bool
+}
+
+// startWebsocketSession records a new session and sets its initial deadlines,
+// so that a target which never answers the upgrade is also subject to the
+// idle timeout. The session must be ended with end.
+func (handler *Handler) startWebsocketSession(client net.Conn, target net.Conn) *websocketSession {
+	session := &websocketSession{
+		options: handler.config.Websocket,
+		client:  client,
+		target:  target,
+		metrics: handler.metrics,
+	}
+	session.metrics.WebsocketSessionOpened()
+	session.activity()
+	return session
+}
+
+// end records that the session is over.
+func (session *websocketSession) end() {
+	result := "closed"
+	if session.timedOut.Load() {
+		logger.Printf("Closed websocket connection which timed out")
+		result = "timed-out"
+	}
+	session.metrics.WebsocketSessionClosed(result)
+}
+
+// activity pushes back the idle deadline of both connections, since either
+// side sending something means the session is still alive.
+func (session *websocketSession) activity() {
+	if session.options.IdleTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(session.options.IdleTimeout)
+	session.client.SetReadDeadline(deadline)
+	session.target.SetReadDeadline(deadline)
+}
+
+// wrap returns a connection which reports reads to the session as activity,
+// and applies the write timeout to each write.
+func (session *websocketSession) wrap(conn net.Conn) net.Conn {
+	return &websocketSessionConn{Conn: conn, session: session}
+}
+
+type websocketSessionConn struct {
+	net.Conn
+	session *websocketSession
+}
+
+func (conn *websocketSessionConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		conn.session.activity()
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		conn.session.timedOut.Store(true)
+	}
+	return n, err
+}
+
+func (conn *websocketSessionConn) Write(p []byte) (int, error) {
+	if timeout := conn.session.options.WriteTimeout; timeout > 0 {
+		conn.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := conn.Conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		conn.session.timedOut.Store(true)
+	}
+	return n, err
+}
+
+// keepWebsocketAlive pings the destinations of both relays every interval,
+// until stop is closed or a ping can't be sent.
+func keepWebsocketAlive(interval time.Duration, stop <-chan struct{}, clientToTarget, targetToClient *websocketMessageRelay, targetConn, clientConn net.Conn) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := clientToTarget.ping(targetConn); err != nil {
+				logger.Debugf("Error pinging websocket target: %v", err)
+				return
+			}
+			if err := targetToClient.ping(clientConn); err != nil {
+				logger.Debugf("Error pinging websocket client: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package traffic
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type upperCasePlugin struct{}
+
+// HandleMessage upper-cases text messages.
+func (upperCasePlugin) HandleMessage(direction WebsocketDirection, messageType WebsocketMessageType, payload []byte) ([]byte, bool) {
+	if messageType == WebsocketTextMessage {
+		payload = bytes.ToUpper(payload)
+	}
+	return payload, false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestWebsocketMessageRelayReassemblesFragments(t *testing.T) {
+	var input bytes.Buffer
+	frames := []*websocketFrame{
+		{fin: false, opcode: websocketTextFrame, payload: []byte("hello ")},
+		{fin: true, opcode: 0x9, payload: []byte("ping")},
+		{fin: true, opcode: websocketContinuationFrame, payload: []byte("world")},
+		{fin: true, opcode: 0x2, payload: []byte("binary")},
+	}
+	for _, frame := range frames {
+		if err := writeWebsocketFrame(&input, frame, true); err != nil {
+			t.Fatalf("Error writing frame: %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	relay := &websocketMessageRelay{
+		messagePlugins: []WsPlugin{upperCasePlugin{}},
+		direction:      TargetToClient,
+	}
+	if err := relay.run(nopWriteCloser{&output}, &input); err != nil {
+		t.Fatalf("Error relaying: %v", err)
+	}
+
+	expected := []struct {
+		opcode  byte
+		payload string
+	}{
+		{0x9, "ping"},
+		{websocketTextFrame, "HELLO WORLD"},
+		{0x2, "binary"},
+	}
+	for _, expectedFrame := range expected {
+		frame, err := readWebsocketFrame(&output, 0)
+		if err != nil {
+			t.Fatalf("Error reading relayed frame: %v", err)
+		}
+		if !frame.fin || frame.opcode != expectedFrame.opcode || string(frame.payload) != expectedFrame.payload {
+			t.Errorf("Expected frame %+v but got opcode %v payload '%s'", expectedFrame, frame.opcode, frame.payload)
+		}
+	}
+}
+
+// droppingPlugin drops text messages which say "drop", and reverses binary
+// messages.
+type droppingPlugin struct{}
+
+func (droppingPlugin) HandleMessage(direction WebsocketDirection, messageType WebsocketMessageType, payload []byte) ([]byte, bool) {
+	if messageType == WebsocketTextMessage {
+		return payload, string(payload) == "DROP"
+	}
+	reversed := make([]byte, len(payload))
+	for i, b := range payload {
+		reversed[len(payload)-1-i] = b
+	}
+	return reversed, false
+}
+
+func TestWebsocketMessageRelayPassesMessagesToWsPlugins(t *testing.T) {
+	var input bytes.Buffer
+	frames := []*websocketFrame{
+		{fin: true, opcode: websocketTextFrame, payload: []byte("drop")},
+		{fin: false, opcode: websocketBinaryFrame, payload: []byte("abc")},
+		{fin: true, opcode: websocketContinuationFrame, payload: []byte("def")},
+		{fin: true, opcode: websocketTextFrame, payload: []byte("keep")},
+	}
+	for _, frame := range frames {
+		if err := writeWebsocketFrame(&input, frame, true); err != nil {
+			t.Fatalf("Error writing frame: %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	relay := &websocketMessageRelay{
+		messagePlugins: []WsPlugin{upperCasePlugin{}, droppingPlugin{}},
+		direction:      TargetToClient,
+	}
+	if err := relay.run(nopWriteCloser{&output}, &input); err != nil {
+		t.Fatalf("Error relaying: %v", err)
+	}
+
+	// Plugins see messages in order, so "drop" is dropped once it's been
+	// upper-cased.
+	expected := []struct {
+		opcode  byte
+		payload string
+	}{
+		{websocketBinaryFrame, "fedcba"},
+		{websocketTextFrame, "KEEP"},
+	}
+	for _, expectedFrame := range expected {
+		frame, err := readWebsocketFrame(&output, 0)
+		if err != nil {
+			t.Fatalf("Error reading relayed frame: %v", err)
+		}
+		if !frame.fin || frame.opcode != expectedFrame.opcode || string(frame.payload) != expectedFrame.payload {
+			t.Errorf("Expected frame %+v but got opcode %v payload '%s'", expectedFrame, frame.opcode, frame.payload)
+		}
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected the dropped message not to be relayed")
+	}
+}
+
+func TestWebsocketMessageRelayEnforcesMaxMessageSize(t *testing.T) {
+	var input bytes.Buffer
+	writeWebsocketFrame(&input, &websocketFrame{fin: false, opcode: websocketTextFrame, payload: []byte("12345")}, false)
+	writeWebsocketFrame(&input, &websocketFrame{fin: true, opcode: websocketContinuationFrame, payload: []byte("67890")}, false)
+
+	relay := &websocketMessageRelay{direction: TargetToClient, maxMessageSize: 8}
+	if err := relay.run(nopWriteCloser{io.Discard}, &input); err != errWebsocketFrameTooLarge {
+		t.Errorf("Expected oversized message to be rejected but got: %v", err)
+	}
+}